@@ -4,8 +4,9 @@ package main
 import (
 	"context"
 	"fmt"
-	"httpcache/pkg"
-	"httpcache/pkg/api"
+	"github.com/Airren/poorman-httpcache/v2/pkg"
+	"github.com/Airren/poorman-httpcache/v2/pkg/admin"
+	"github.com/Airren/poorman-httpcache/v2/pkg/api"
 	"log/slog"
 	"net/http"
 	"os"
@@ -35,7 +36,11 @@ func run(ctx context.Context, cfg pkg.Config, logger *slog.Logger) error {
 
 	apiServer := api.NewServer(db, logger, cfg.AdminKey)
 	adminHandler := api.HandlerWithOptions(apiServer, api.ChiServerOptions{BaseURL: ""})
-	mux.Handle("/*", adminHandler)
+	// v2 has no breaking change yet, both versions are served by the same handler
+	api.Mount(mux, map[int]http.Handler{1: adminHandler, 2: adminHandler}, api.VersionOptions{
+		Sunsets:           map[int]time.Time{1: cfg.AdminAPIV1Sunset},
+		UnversionedSunset: cfg.AdminAPIUnversionedSunset,
+	})
 
 	// Redirect /docs to /docs/ for proper relative path resolution
 	mux.HandleFunc("GET /docs", func(w http.ResponseWriter, r *http.Request) {
@@ -63,6 +68,14 @@ func run(ctx context.Context, cfg pkg.Config, logger *slog.Logger) error {
 	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	// Expire the trial keys on their own connection, pgx.Conn isn't safe for concurrent use
+	expiryDB, err := pgx.Connect(ctx, cfg.PostgresURL)
+	if err != nil {
+		return fmt.Errorf("pgx.Connect: %w", err)
+	}
+	defer expiryDB.Close(context.Background())
+	go expireTrials(ctx, admin.NewAdminService(expiryDB), cfg.TrialExpiryInterval, logger)
+
 	// Wait for shutdown signal
 	<-ctx.Done()
 	logger.Info("Received shutdown signal, shutting down server...")
@@ -79,7 +92,34 @@ func run(ctx context.Context, cfg pkg.Config, logger *slog.Logger) error {
 	return nil
 }
 
+// expireTrials marks the trial keys past their expiry as expired every
+// interval, until ctx is done.
+func expireTrials(ctx context.Context, adminService *admin.AdminService, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		expired, err := adminService.ExpireTrials(ctx)
+		if err != nil {
+			logger.Error("Failed to expire trial keys", "error", err)
+		}
+		for _, apiKey := range expired {
+			logger.Info("Trial key expired", "api_key_id", apiKey.ID)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "quota" {
+		os.Exit(quota(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "usage" {
+		os.Exit(usage(os.Args[2:]))
+	}
 	// parse with generics
 	cfg, err := pkg.GetConfig()
 	if err != nil {
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg"
+	"github.com/Airren/poorman-httpcache/v2/pkg/httpcache"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// quotaSnapshot is the file written by quota export and read by quota import.
+// It holds the API keys in clear, handle it as a secret.
+type quotaSnapshot struct {
+	ExportedAt time.Time    `json:"exported_at"`
+	Quotas     []quotaEntry `json:"quotas"`
+}
+
+type quotaEntry struct {
+	Key            string `json:"key"`
+	Service        string `json:"service"`
+	InitialQuota   int64  `json:"initial_quota"`
+	RemainingQuota int64  `json:"remaining_quota"`
+	// Source is where the remaining quota was read from, "redis" when a
+	// balance was held there, not synced to Postgres yet, "postgres" otherwise.
+	Source string `json:"source"`
+}
+
+// quota snapshots and restores the remaining quotas, for staging refreshes
+// and datacenter migrations:
+//
+//	admin quota export [-o quotas.json]
+//	admin quota import [-i quotas.json] [-skip-missing]
+func quota(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: admin quota export|import [flags]")
+		return 2
+	}
+	cfg, err := pkg.ParseConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+		return 1
+	}
+	ctx := context.Background()
+	switch args[0] {
+	case "export":
+		err = quotaExport(ctx, cfg, args[1:])
+	case "import":
+		err = quotaImport(ctx, cfg, args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown quota command %q, expected export or import\n", args[0])
+		return 2
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "quota %s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// quotaExport writes the remaining quota of every key and service. Reservations
+// are made in the Redis hash "quota:{key}" before being synced to Postgres, so
+// a balance found there wins over the Postgres one.
+func quotaExport(ctx context.Context, cfg pkg.Config, args []string) error {
+	flags := flag.NewFlagSet("quota export", flag.ContinueOnError)
+	output := flags.String("o", "", "file to write the snapshot to, stdout by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	conn, err := pgx.Connect(ctx, cfg.PostgresURL)
+	if err != nil {
+		return fmt.Errorf("pgx.Connect: %w", err)
+	}
+	defer conn.Close(ctx)
+	rows, err := conn.Query(ctx, `SELECT ak.key_string, s.name, aksq.initial_quota, aksq.remaining_quota
+FROM api_key_service_quotas aksq
+JOIN api_keys ak ON aksq.api_key_id = ak.id
+JOIN services s ON aksq.service_id = s.id
+ORDER BY ak.key_string, s.name`)
+	if err != nil {
+		return fmt.Errorf("api_key_service_quotas: %w", err)
+	}
+	snapshot := quotaSnapshot{ExportedAt: time.Now().UTC()}
+	for rows.Next() {
+		entry := quotaEntry{Source: "postgres"}
+		if err := rows.Scan(&entry.Key, &entry.Service, &entry.InitialQuota, &entry.RemainingQuota); err != nil {
+			return fmt.Errorf("api_key_service_quotas: %w", err)
+		}
+		snapshot.Quotas = append(snapshot.Quotas, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("api_key_service_quotas: %w", err)
+	}
+
+	rdb := httpcache.NewRedisClient(cfg)
+	defer rdb.Close()
+	pipe := rdb.Pipeline()
+	balances := make([]*redis.StringCmd, len(snapshot.Quotas))
+	for i, entry := range snapshot.Quotas {
+		balances[i] = pipe.HGet(ctx, "quota:"+entry.Key, "service_"+entry.Service)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("redis HGET: %w", err)
+	}
+	reconciled := 0
+	for i, balance := range balances {
+		remaining, err := balance.Int64()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("redis HGET quota:%s: %w", maskKey(snapshot.Quotas[i].Key), err)
+		}
+		if remaining != snapshot.Quotas[i].RemainingQuota {
+			reconciled++
+		}
+		snapshot.Quotas[i].RemainingQuota = remaining
+		snapshot.Quotas[i].Source = "redis"
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(snapshot); err != nil {
+		return fmt.Errorf("json.Encode: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "exported %d quotas, %d taken from redis ahead of postgres\n", len(snapshot.Quotas), reconciled)
+	return nil
+}
+
+// quotaImport restores a snapshot into Postgres in one transaction, then
+// drops the Redis copies of the restored balances, so the next request loads
+// them from Postgres. The keys and services must exist already.
+func quotaImport(ctx context.Context, cfg pkg.Config, args []string) error {
+	flags := flag.NewFlagSet("quota import", flag.ContinueOnError)
+	input := flags.String("i", "", "file to read the snapshot from, stdin by default")
+	skipMissing := flags.Bool("skip-missing", false, "skip the quotas of keys or services missing here instead of failing")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	var snapshot quotaSnapshot
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return fmt.Errorf("json.Decode: %w", err)
+	}
+
+	conn, err := pgx.Connect(ctx, cfg.PostgresURL)
+	if err != nil {
+		return fmt.Errorf("pgx.Connect: %w", err)
+	}
+	defer conn.Close(ctx)
+	var restored []quotaEntry
+	var missing []string
+	err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		for _, entry := range snapshot.Quotas {
+			tag, err := tx.Exec(ctx, `INSERT INTO api_key_service_quotas (api_key_id, service_id, initial_quota, remaining_quota)
+SELECT ak.id, s.id, $3, $4
+FROM api_keys ak, services s
+WHERE ak.key_string = $1 AND s.name = $2
+ON CONFLICT (api_key_id, service_id) DO UPDATE
+SET initial_quota = EXCLUDED.initial_quota,
+    remaining_quota = EXCLUDED.remaining_quota,
+    updated_at = NOW()`, entry.Key, entry.Service, entry.InitialQuota, entry.RemainingQuota)
+			if err != nil {
+				return fmt.Errorf("api_key_service_quotas: %w", err)
+			}
+			if tag.RowsAffected() == 0 {
+				missing = append(missing, maskKey(entry.Key)+"/"+entry.Service)
+				continue
+			}
+			restored = append(restored, entry)
+		}
+		if len(missing) > 0 && !*skipMissing {
+			return fmt.Errorf("keys or services missing for %s, create them first or pass -skip-missing", strings.Join(missing, ", "))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	rdb := httpcache.NewRedisClient(cfg)
+	defer rdb.Close()
+	pipe := rdb.Pipeline()
+	for _, entry := range restored {
+		pipe.HDel(ctx, "quota:"+entry.Key, "service_"+entry.Service)
+		pipe.Del(ctx, fmt.Sprintf("quota:%s:%s", entry.Service, entry.Key))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("restored in postgres, but redis still holds the old balances: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "imported %d quotas exported at %s, skipped %d\n", len(restored), snapshot.ExportedAt.Format(time.RFC3339), len(missing))
+	return nil
+}
+
+// maskKey shortens an API key for messages, the snapshot is the only place
+// the keys are written in clear.
+func maskKey(key string) string {
+	if len(key) <= 8 {
+		return "***"
+	}
+	return key[:6] + "***"
+}
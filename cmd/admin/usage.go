@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg"
+	"github.com/Airren/poorman-httpcache/v2/pkg/admin"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// usage backfills the usage history from before the proxy was adopted:
+//
+//	admin usage import -key KEY -service serper [-provider serper] [-column credits] [-i export.csv]
+//
+// The provider-side export, e.g. the Serper usage CSV or a Jina dashboard
+// export, is summed per day and recorded as the daily usage of the key.
+func usage(args []string) int {
+	if len(args) == 0 || args[0] != "import" {
+		fmt.Fprintln(os.Stderr, "usage: admin usage import -key KEY -service NAME [flags]")
+		return 2
+	}
+	flags := flag.NewFlagSet("usage import", flag.ContinueOnError)
+	key := flags.String("key", "", "API key to record the usage for, e.g. the key the upstream was called with before the proxy")
+	service := flags.String("service", "", "service to record the usage for")
+	provider := flags.String("provider", "", "format of the export, serper or jina, the service by default")
+	column := flags.String("column", "", "column of the amount, e.g. credits, the request count by default")
+	input := flags.String("i", "", "file to read the export from, stdin by default")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if *key == "" || *service == "" {
+		fmt.Fprintln(os.Stderr, "usage import: -key and -service are required")
+		return 2
+	}
+	if *provider == "" {
+		*provider = *service
+	}
+
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "usage import: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+	days, err := admin.ParseUsageExport(*provider, r, *column)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "usage import: %v\n", err)
+		return 1
+	}
+
+	cfg, err := pkg.ParseConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+		return 1
+	}
+	ctx := context.Background()
+	db, err := pgx.Connect(ctx, cfg.PostgresURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "usage import: pgx.Connect: %v\n", err)
+		return 1
+	}
+	defer db.Close(ctx)
+	imported, err := admin.NewAdminService(db).ImportUsage(ctx, *key, *service, days)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "usage import: %v\n", err)
+		return 1
+	}
+	fmt.Printf("imported %d of %d days, %d units, skipped %d days already recorded\n",
+		imported.Imported, imported.Days, imported.Total, imported.Skipped)
+	return 0
+}
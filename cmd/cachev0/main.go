@@ -3,9 +3,9 @@ package main
 import (
 	"context"
 	"fmt"
-	"httpcache/pkg"
-	"httpcache/pkg/cache"
-	"httpcache/pkg/proxy"
+	"github.com/Airren/poorman-httpcache/v2/pkg"
+	"github.com/Airren/poorman-httpcache/v2/pkg/cache"
+	"github.com/Airren/poorman-httpcache/v2/pkg/proxy"
 	"log/slog"
 	"net/http"
 	"net/url"
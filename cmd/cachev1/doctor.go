@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg"
+	"github.com/Airren/poorman-httpcache/v2/pkg/cache"
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+	"github.com/Airren/poorman-httpcache/v2/pkg/dynconfig"
+	"github.com/Airren/poorman-httpcache/v2/pkg/httpcache"
+	"github.com/Airren/poorman-httpcache/v2/pkg/jobs"
+	"github.com/Airren/poorman-httpcache/v2/pkg/leader"
+	"github.com/Airren/poorman-httpcache/v2/pkg/proxy"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate/adapter"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// doctor checks the deployment end to end before it takes traffic:
+//
+//	cachev1 doctor [-providers jina,serper] [-offline]
+//
+// On top of the config checks of validate and the boot checks of preflight, it
+// checks that the keys of the Redis scripts fit a Redis Cluster, and sends a tiny request to each
+// provider, bypassing the cache. It prints a pass/fail report and returns 1
+// when a check failed.
+func doctor(args []string) int {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	only := flags.String("providers", "", "comma separated providers to send a request to, all the configured ones by default")
+	offline := flags.Bool("offline", false, "skip the provider requests, which spend upstream quota")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := pkg.ParseConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+		return 1
+	}
+	ctx := context.Background()
+	r := &report{}
+
+	if problems := checkConfig(cfg, dynconfig.Config{}); len(problems) > 0 {
+		r.add("config", errors.New(strings.Join(problems, "; ")))
+	} else {
+		r.pass("config")
+	}
+	r.pass(fmt.Sprintf("cache format version %d", cache.FormatVersion))
+
+	r.add("postgres", checkPostgres(ctx, cfg.PostgresURL))
+
+	rdb := httpcache.NewRedisClient(cfg)
+	defer rdb.Close()
+	pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	err = rdb.Ping(pingCtx).Err()
+	cancel()
+	if r.add("redis", err) {
+		r.add("redis version", checkRedisVersion(ctx, cfg, rdb))
+		for _, script := range scripts {
+			err := script.script.Load(ctx, rdb).Err()
+			if err != nil && script.fallback {
+				r.skip("redis script "+script.name, fmt.Sprintf("runs its Go fallback, %v", err))
+				continue
+			}
+			r.add("redis script "+script.name, err)
+		}
+		r.add("redis cluster", checkCluster(ctx, rdb))
+	}
+
+	if *offline {
+		r.skip("providers", "-offline")
+	} else {
+		checkProviders(ctx, cfg, rdb, *only, r)
+	}
+
+	return r.print(os.Stdout)
+}
+
+// report collects the outcome of the checks.
+type report struct {
+	lines  []string
+	failed bool
+}
+
+// add records a check, passed when err is nil, and returns whether it passed.
+func (r *report) add(name string, err error) bool {
+	if err == nil {
+		r.pass(name)
+		return true
+	}
+	r.failed = true
+	r.lines = append(r.lines, fmt.Sprintf("FAIL %s: %v", name, err))
+	return false
+}
+
+func (r *report) pass(name string) {
+	r.lines = append(r.lines, "PASS "+name)
+}
+
+func (r *report) skip(name, reason string) {
+	r.lines = append(r.lines, fmt.Sprintf("SKIP %s: %s", name, reason))
+}
+
+func (r *report) print(w io.Writer) int {
+	for _, line := range r.lines {
+		fmt.Fprintln(w, line)
+	}
+	if r.failed {
+		fmt.Fprintln(w, "doctor: some checks failed")
+		return 1
+	}
+	fmt.Fprintln(w, "doctor: all checks passed")
+	return 0
+}
+
+var (
+	createTable = regexp.MustCompile(`(?is)CREATE TABLE (\w+) \((.*?)\n\)[^;\n]*;`)
+	constraint  = regexp.MustCompile(`(?i)^(PRIMARY|UNIQUE|FOREIGN|CONSTRAINT|CHECK)\b`)
+)
+
+// schemaColumns returns the columns of the tables of a schema.
+func schemaColumns(schema string) map[string][]string {
+	tables := map[string][]string{}
+	for _, m := range createTable.FindAllStringSubmatch(schema, -1) {
+		var columns []string
+		for _, line := range strings.Split(m[2], "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "--") || constraint.MatchString(line) {
+				continue
+			}
+			columns = append(columns, strings.Fields(line)[0])
+		}
+		tables[m[1]] = columns
+	}
+	return tables
+}
+
+// checkSchema checks that Postgres has the tables and columns of dbsqlc.Schema.
+func checkSchema(ctx context.Context, conn *pgx.Conn) error {
+	rows, err := conn.Query(ctx, `SELECT table_name, column_name FROM information_schema.columns WHERE table_schema = current_schema()`)
+	if err != nil {
+		return fmt.Errorf("information_schema.columns: %w", err)
+	}
+	found := map[string]bool{}
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return fmt.Errorf("information_schema.columns: %w", err)
+		}
+		found[table] = true
+		found[table+"."+column] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("information_schema.columns: %w", err)
+	}
+	var missing []string
+	for table, columns := range schemaColumns(dbsqlc.Schema) {
+		if !found[table] {
+			missing = append(missing, table)
+			continue
+		}
+		for _, column := range columns {
+			if !found[table+"."+column] {
+				missing = append(missing, table+"."+column)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		slices.Sort(missing)
+		return fmt.Errorf("missing %s, apply pkg/dbsqlc/schema.sql", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// scripts are the Redis scripts cachev1 runs, with keys as they're called
+// with. Redis Cluster needs the keys of a script in one hash slot. Those with
+// a fallback run as transactions on a Redis refusing EVAL.
+var scripts = []struct {
+	name     string
+	script   *redis.Script
+	keys     []string
+	fallback bool
+}{
+	{"reserve quota", adapter.ReserveQuotaScript, []string{"quota:key", "usage:key:jina"}, true},
+	{"set and reserve quota", adapter.SetAndReserveScript, []string{"quota:key", "usage:key:jina"}, true},
+	{"refund quota", adapter.RefundQuotaScript, []string{"quota:key", "usage:key:jina"}, true},
+	{"limits", adapter.LimitsScript, []string{"limits:jina", "limits_usage:jina:key:0", "limits_alert:jina:key:0"}, false},
+	{"access token", adapter.AccessTokenScript, []string{"access_token:jti"}, false},
+	{"access token sweep", adapter.AccessTokenSweepScript, []string{"access_token:jti", "access_tokens"}, false},
+	{"tag budget", adapter.TagBudgetScript, []string{"tag_budgets:jina", "tag_budget_usage:jina:tag"}, false},
+	{"politeness", proxy.PolitenessScript, []string{"polite:inflight:host", "polite:rate:host:0"}, false},
+	{"job promotion", jobs.PromoteScript, []string{"jobs:delayed", "jobs:pending"}, false},
+	{"leader renew", leader.RenewScript, []string{"leader"}, false},
+	{"leader release", leader.ReleaseScript, []string{"leader"}, false},
+}
+
+// checkCluster checks, on a Redis Cluster, that the keys of each script share
+// a hash slot. A standalone Redis passes.
+func checkCluster(ctx context.Context, rdb *redis.Client) error {
+	info, err := rdb.Info(ctx, "cluster").Result()
+	if err != nil {
+		return fmt.Errorf("INFO cluster: %w", err)
+	}
+	if !strings.Contains(info, "cluster_enabled:1") {
+		return nil
+	}
+	var crossSlot []string
+	for _, script := range scripts {
+		slots := map[int64]bool{}
+		for _, key := range script.keys {
+			slot, err := rdb.ClusterKeySlot(ctx, key).Result()
+			if err != nil {
+				return fmt.Errorf("CLUSTER KEYSLOT: %w", err)
+			}
+			slots[slot] = true
+		}
+		if len(slots) > 1 {
+			crossSlot = append(crossSlot, script.name)
+		}
+	}
+	if len(crossSlot) > 0 {
+		return fmt.Errorf("the keys of the %s scripts span hash slots, run a standalone Redis", strings.Join(crossSlot, ", "))
+	}
+	return nil
+}
+
+// probes are the tiny requests sent to each provider, picked to spend as
+// little upstream quota as possible.
+var probes = map[string]struct {
+	method, path, body string
+}{
+	"jina":   {http.MethodGet, "/jina/https://example.com/", ""},
+	"serper": {http.MethodPost, "/serper/search", `{"q":"example","num":1}`},
+	"fetch":  {http.MethodGet, "/fetch/https://example.com/", ""},
+	"azure":  {http.MethodGet, "/azure/openai/models", ""},
+	"vertex": {http.MethodPost, "/vertex/gemini-2.0-flash:countTokens", `{"contents":[{"role":"user","parts":[{"text":"ping"}]}]}`},
+}
+
+// checkProviders sends a probe to each provider through its whole pipeline,
+// with the internal key and the cache bypassed.
+func checkProviders(ctx context.Context, cfg pkg.Config, rdb redis.Cmdable, only string, r *report) {
+	pipeline, err := httpcache.New(cfg, httpcache.WithLogger(slog.New(slog.DiscardHandler)), httpcache.WithRedis(rdb))
+	if !r.add("providers", err) {
+		return
+	}
+	defer pipeline.Close()
+	for _, name := range pipeline.Providers() {
+		if only != "" && !slices.Contains(strings.Split(only, ","), name) {
+			continue
+		}
+		probe := probes[name]
+		ctx, cancel := context.WithTimeout(cache.Bypass(ctx), 15*time.Second)
+		req, err := http.NewRequestWithContext(ctx, probe.method, probe.path, strings.NewReader(probe.body))
+		if err != nil {
+			cancel()
+			r.add("provider "+name, err)
+			continue
+		}
+		req.Header.Set("Authorization", "Bearer "+cfg.InternalKey)
+		req.Header.Set("X-API-KEY", cfg.InternalKey)
+		if probe.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		w := &probeWriter{header: http.Header{}}
+		pipeline.ServeHTTP(w, req)
+		cancel()
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		if w.status >= 400 {
+			err = fmt.Errorf("%s %s answered %d: %s", probe.method, probe.path, w.status, strings.TrimSpace(w.body.String()))
+		}
+		r.add("provider "+name, err)
+	}
+}
+
+// probeWriter keeps the status and the start of the body of a probe answer.
+type probeWriter struct {
+	header http.Header
+	status int
+	body   strings.Builder
+}
+
+func (w *probeWriter) Header() http.Header { return w.header }
+
+func (w *probeWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+func (w *probeWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if room := 200 - w.body.Len(); room > 0 {
+		w.body.Write(b[:min(len(b), room)])
+	}
+	return len(b), nil
+}
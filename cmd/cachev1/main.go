@@ -2,15 +2,37 @@ package main
 
 import (
 	"context"
+	"errors"
+	"expvar"
 	"fmt"
-	"httpcache/pkg"
-	"httpcache/pkg/cache"
-	"httpcache/pkg/proxy"
-	"httpcache/pkg/tollgate"
-	"httpcache/pkg/tollgate/adapter"
+	"github.com/Airren/poorman-httpcache/v2/pkg"
+	"github.com/Airren/poorman-httpcache/v2/pkg/adminauth"
+	"github.com/Airren/poorman-httpcache/v2/pkg/cache"
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+	"github.com/Airren/poorman-httpcache/v2/pkg/dynconfig"
+	"github.com/Airren/poorman-httpcache/v2/pkg/erasure"
+	"github.com/Airren/poorman-httpcache/v2/pkg/export"
+	"github.com/Airren/poorman-httpcache/v2/pkg/httpcache"
+	"github.com/Airren/poorman-httpcache/v2/pkg/impersonate"
+	"github.com/Airren/poorman-httpcache/v2/pkg/jobs"
+	"github.com/Airren/poorman-httpcache/v2/pkg/leader"
+	"github.com/Airren/poorman-httpcache/v2/pkg/plugin"
+	"github.com/Airren/poorman-httpcache/v2/pkg/privacy"
+	"github.com/Airren/poorman-httpcache/v2/pkg/proxy"
+	"github.com/Airren/poorman-httpcache/v2/pkg/reqlog"
+	"github.com/Airren/poorman-httpcache/v2/pkg/retention"
+	"github.com/Airren/poorman-httpcache/v2/pkg/rollup"
+	"github.com/Airren/poorman-httpcache/v2/pkg/rules"
+	"github.com/Airren/poorman-httpcache/v2/pkg/s3"
+	"github.com/Airren/poorman-httpcache/v2/pkg/search"
+	"github.com/Airren/poorman-httpcache/v2/pkg/slo"
+	"github.com/Airren/poorman-httpcache/v2/pkg/status"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate/adapter"
+	"github.com/Airren/poorman-httpcache/v2/pkg/upgrade"
+	"github.com/Airren/poorman-httpcache/v2/pkg/webhook"
 	"log/slog"
 	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
 	"strings"
@@ -18,121 +40,464 @@ import (
 	"time"
 
 	"github.com/go-chi/chi/middleware"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
 )
 
-func NewCache(cfg pkg.Config, logger *slog.Logger) (*cache.Cache, error) {
-	cache, err := cache.New(
-		cache.WithAdapter(cache.NewRedisAdapter(&redis.RingOptions{
+// NewCanaryCache creates the shadow cache of the canary, in its own namespace
+// of the Redis of the primary cache.
+func NewCanaryCache(cfg pkg.Config, logger *slog.Logger) (*cache.Cache, error) {
+	contentRules, err := cache.ParseContentRules(cfg.CacheContentRules)
+	if err != nil {
+		return nil, err
+	}
+	return cache.New(
+		cache.WithAdapter(cache.NewNamespace(cache.NewRedisAdapter(&redis.RingOptions{
 			Addrs:    map[string]string{"server0": fmt.Sprintf("%s:%d", cfg.RedisHost, cfg.RedisPort)},
 			Username: cfg.RedisUsername,
 			Password: cfg.RedisPassword,
-		}, logger)),
-		// cache both GET and PUT methods
+		}, logger), "canary")),
 		cache.WithMethods([]string{http.MethodGet, http.MethodPost}),
-		// cache responses for 24 hours
-		cache.WithTTL(24*time.Hour),
+		cache.WithTTL(cfg.CanaryTTL),
+		cache.WithStreamThreshold(cfg.CanaryStreamThreshold),
+		cache.WithContentRules(contentRules),
+		cache.WithMaxAge(cfg.CanaryMaxAge),
 		cache.WithLogger(logger),
 	)
-	if err != nil {
-		logger.Error("Failed to create cache", "error", err)
-		return nil, err
-	}
-	return cache, nil
 }
 
-func NewJinaProxy(cache *cache.Cache, cfg pkg.Config, logger *slog.Logger) (http.Handler, error) {
-	target, err := url.Parse("https://r.jina.ai")
-	if err != nil {
-		logger.Error("Failed to parse Jina target URL", "error", err)
-		return nil, err
-	}
-
-	rp, err := proxy.New(
-		proxy.WithRewrites(
-			proxy.RewriteJinaPath(target),
-			proxy.ReplaceJinaKey(cfg.JinaAPIKey),
-			proxy.DebugRequest(logger),
-		),
-	)
-	if err != nil {
-		logger.Error("Failed to create Jina proxy", "error", err)
-		return nil, err
+// applyDynamicConfig replaces the key pool of every provider present in the
+// dynamic config, providers without keys keep their current pool, and the
+// admission rules, the status notices and the quota defaults when present.
+// quotaDefaults is nil without a MetaStore.
+func applyDynamicConfig(pools map[string]*proxy.KeyPool, engine *rules.Engine, statusPage *status.Page, quotaDefaults *adapter.QuotaDefaults, logger *slog.Logger) func(dynconfig.Config) {
+	return func(c dynconfig.Config) {
+		if c.QuotaDefaults != nil {
+			if quotaDefaults == nil {
+				logger.Warn("Quota defaults in dynamic config ignored without METASTORE")
+			} else {
+				quotaDefaults.Set(c.QuotaDefaults)
+				logger.Info("Quota defaults updated", "services", len(c.QuotaDefaults))
+			}
+		}
+		if c.Notices != nil {
+			statusPage.SetNotices(c.Notices)
+			logger.Info("Status notices updated", "notices", len(c.Notices))
+		}
+		if c.Rules != nil {
+			if err := engine.Set(c.Rules); err != nil {
+				logger.Error("Invalid rules in dynamic config", "error", err)
+			} else {
+				logger.Info("Rules updated", "rules", len(c.Rules))
+			}
+		}
+		for name, provider := range c.Providers {
+			pool, ok := pools[name]
+			if !ok {
+				logger.Warn("Unknown provider in dynamic config", "provider", name)
+				continue
+			}
+			if len(provider.Keys) == 0 {
+				continue
+			}
+			pool.Set(provider.Keys)
+			logger.Info("Provider keys updated", "provider", name, "keys", pool.Len())
+		}
 	}
+}
 
-	skAdapter := adapter.NewSecretKey(cfg.InternalKey, "jina")
-	secretKeyExtract := func(r *http.Request) string {
+// keyAuth returns the tollgate of the routes of service open to the keys
+// without charging them, e.g. the job submissions, charged when the jobs
+// run: the keys of keyStore from where they're allowed, and the internal key.
+// Without a MetaStore, the internal key only.
+func keyAuth(service string, keyStore adapter.MetaStore, internalKey string) *tollgate.Tollgate {
+	extract := func(r *http.Request) string {
+		if key := r.Header.Get("X-API-KEY"); key != "" {
+			return key
+		}
 		return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
 	}
-	tollgate := tollgate.New(skAdapter, secretKeyExtract)
-
-	return tollgate.HTTPHandlerMiddleware(cache.HTTPHandlerMiddleware(rp)), nil
+	if keyStore == nil {
+		return tollgate.New(adapter.NewSecretKey(internalKey, service), extract)
+	}
+	restrictions := adapter.KeyRestrictions(keyStore)
+	return tollgate.New(adapter.NewInternalKey(internalKey, adapter.NewKnownKey(keyStore)), extract,
+		tollgate.WithRestrictions(func(ctx context.Context, key string) (tollgate.Restrictions, error) {
+			if internalKey != "" && key == internalKey {
+				return tollgate.Restrictions{}, nil
+			}
+			return restrictions(ctx, key)
+		}))
 }
 
-func NewSerperProxy(cache *cache.Cache, cfg pkg.Config, logger *slog.Logger) (http.Handler, error) {
-	target, err := url.Parse("https://google.serper.dev")
-	if err != nil {
-		logger.Error("Failed to parse Serper target URL", "error", err)
-		return nil, err
+func run(ctx context.Context, cfg pkg.Config, logger *slog.Logger) error {
+	if cfg.PrivacyMode {
+		if cfg.PrivacySalt == "" {
+			return fmt.Errorf("PRIVACY_SALT is required in privacy mode")
+		}
+		// a Redis queue would persist the job bodies
+		if cfg.JobQueue != "memory" {
+			return fmt.Errorf("job queue %q persists request bodies, use \"memory\" in privacy mode", cfg.JobQueue)
+		}
+		// the pending job callbacks carry the request and the result bodies
+		if cfg.WebhookStore != "memory" {
+			return fmt.Errorf("webhook store %q persists job bodies, use \"memory\" in privacy mode", cfg.WebhookStore)
+		}
+		// the semantic matcher keeps the queries and sends them to the embeddings endpoint
+		if cfg.SemanticEmbeddingURL != "" {
+			return fmt.Errorf("SEMANTIC_EMBEDDING_URL sends the queries out, it can't be set in privacy mode")
+		}
+		privacy.Enable(cfg.PrivacySalt)
 	}
-
-	rp, err := proxy.New(
-		proxy.WithRewrites(
-			proxy.RewriteSerperPath(target),
-			proxy.ReplaceSerperKey(cfg.SerperAPIKey),
-			proxy.DebugRequest(logger),
-		),
-	)
+	var searchIndex *search.Index
+	var cacheOpts []cache.Option
+	if cfg.SearchIndex {
+		searchIndex = search.New(cfg.PostgresURL, cfg.SearchIndexQueue, logger)
+		cacheOpts = append(cacheOpts, cache.WithOnStore(searchIndex.Add))
+	}
+	httpCache, err := httpcache.NewCache(cfg, logger, cacheOpts...)
 	if err != nil {
-		logger.Error("Failed to create Serper proxy", "error", err)
-		return nil, err
+		return fmt.Errorf("NewCache: %w", err)
 	}
-	skAdapter := adapter.NewSecretKey(cfg.InternalKey, "serper")
-	secretKeyExtract := func(r *http.Request) string {
-		return r.Header.Get("X-API-KEY")
+	rdb := httpcache.NewRedisClient(cfg)
+	defer func() {
+		if err := rdb.Close(); err != nil {
+			logger.Error("rdb.Close()", "error", err)
+		}
+	}()
+	if cfg.StartupChecks {
+		if err := preflight(ctx, cfg, rdb); err != nil {
+			return fmt.Errorf("startup checks: %w", err)
+		}
+	}
+	var usageSink adapter.UsageSink
+	var clickHouse *adapter.ClickHouseSink
+	switch cfg.UsageSink {
+	case "":
+	case "clickhouse":
+		clickHouse, err = adapter.NewClickHouseSink(cfg.ClickHouseURL, cfg.ClickHouseTable, cfg.ClickHouseBatchSize, logger)
+		if err != nil {
+			return fmt.Errorf("NewClickHouseSink: %w", err)
+		}
+		usageSink = clickHouse
+	default:
+		return fmt.Errorf("unknown usage sink %q", cfg.UsageSink)
+	}
+	if names := plugin.Default.Names(); len(names) > 0 {
+		logger.Info("Plugins registered", "plugins", names)
+	}
+	// admission rules come from RULES_FILE and the dynamic config
+	ruleEngine := rules.New(logger)
+	if cfg.RulesFile != "" {
+		if err := ruleEngine.WatchFile(ctx, cfg.RulesFile, cfg.RulesReloadInterval); err != nil {
+			return fmt.Errorf("WatchFile: %w", err)
+		}
+	}
+	var configSource dynconfig.Source
+	if cfg.ConfigSource != "" {
+		configSource, err = dynconfig.New(cfg.ConfigSource, cfg.ConfigSourceURL, cfg.ConfigSourceKey, cfg.ConfigSourceToken, logger)
+		if err != nil {
+			return fmt.Errorf("dynconfig.New: %w", err)
+		}
 	}
-	tollgate := tollgate.New(skAdapter, secretKeyExtract)
-
-	return tollgate.HTTPHandlerMiddleware(cache.HTTPHandlerMiddleware(rp)), nil
-}
 
-func run(ctx context.Context, cfg pkg.Config, logger *slog.Logger) error {
-	cache, err := NewCache(cfg, logger)
-	if err != nil {
-		return fmt.Errorf("NewCache: %w", err)
+	var webhookStore webhook.Store
+	switch cfg.WebhookStore {
+	case "memory":
+		webhookStore = webhook.NewMemoryStore(7 * 24 * time.Hour)
+	case "redis":
+		webhookStore = webhook.NewRedisStore(rdb, 7*24*time.Hour)
+	default:
+		return fmt.Errorf("unknown webhook store %q", cfg.WebhookStore)
 	}
-	jinaProxy, err := NewJinaProxy(cache, cfg, logger)
-	if err != nil {
-		return fmt.Errorf("NewJinaProxy: %w", err)
+	// the webhook and job callback URLs are chosen by the clients
+	var webhookTransport http.RoundTripper = proxy.PublicTransport()
+	if cfg.AllowPrivateTargets {
+		webhookTransport = http.DefaultTransport
+	}
+	// webhooks are signed, they're disabled without a secret
+	var deliverer *webhook.Deliverer
+	var notifier jobs.Notifier
+	switch {
+	case cfg.WebhookSecret != "":
+		deliverer, err = webhook.NewDeliverer(webhookStore, cfg.WebhookSecret, cfg.WebhookMaxAttempts, cfg.WebhookWorkers, webhookTransport, logger)
+		if err != nil {
+			return fmt.Errorf("webhook.NewDeliverer: %w", err)
+		}
+		notifier = deliverer
+	case cfg.ProviderAlertURL != "" || cfg.QuotaAlertURL != "":
+		return errors.New("PROVIDER_ALERT_URL and QUOTA_ALERT_URL need WEBHOOK_SECRET")
+	}
+	opts := []httpcache.Option{
+		httpcache.WithLogger(logger),
+		httpcache.WithRedis(rdb),
+		httpcache.WithCache(httpCache),
+		httpcache.WithUsageSink(usageSink),
+		httpcache.WithPauseAlert(func(ctx context.Context, alert proxy.PauseAlert) {
+			if cfg.ProviderAlertURL == "" {
+				return
+			}
+			if _, err := deliverer.Send(context.WithoutCancel(ctx), cfg.ProviderAlertURL, "provider.paused", alert); err != nil {
+				logger.Error("Failed to send provider alert", "error", err)
+			}
+		}),
+	}
+	var limitsAdmin *adapter.LimitsAdmin
+	if cfg.QuotaLimits {
+		limits := adapter.NewLimitStore(rdb, func(ctx context.Context, alert adapter.LimitAlert) {
+			if cfg.QuotaAlertURL == "" {
+				return
+			}
+			if _, err := deliverer.Send(context.WithoutCancel(ctx), cfg.QuotaAlertURL, alert.Event, alert); err != nil {
+				logger.Error("Failed to send quota alert", "error", err)
+			}
+		}, logger)
+		limitsAdmin = adapter.NewLimitsAdmin(limits)
+		opts = append(opts, httpcache.WithLimits(limits))
+	}
+	var membersAdmin *adapter.MembersAdmin
+	if cfg.MemberUsage {
+		members := adapter.NewMemberStore(rdb, logger)
+		membersAdmin = adapter.NewMembersAdmin(members)
+		opts = append(opts, httpcache.WithMemberStore(members))
+	}
+	var tagsAdmin *adapter.TagsAdmin
+	if cfg.TagUsage {
+		tags := adapter.NewTagStore(rdb, logger)
+		tagsAdmin = adapter.NewTagsAdmin(tags)
+		opts = append(opts, httpcache.WithTagStore(tags))
+	}
+	var domainsAdmin *adapter.DomainsAdmin
+	if cfg.DomainUsage {
+		domains := adapter.NewDomainStore(rdb, cfg.DomainUsageTop, logger)
+		domainsAdmin = adapter.NewDomainsAdmin(domains)
+		opts = append(opts, httpcache.WithDomainStore(domains))
+	}
+	var budgetsAdmin *adapter.TagBudgetsAdmin
+	if cfg.TagBudgets {
+		budgets := adapter.NewTagBudgetStore(rdb, logger)
+		budgetsAdmin = adapter.NewTagBudgetsAdmin(budgets)
+		opts = append(opts, httpcache.WithTagBudgets(budgets))
+	}
+	if cfg.SupportKey != "" {
+		opts = append(opts, httpcache.WithSupportKey(cfg.SupportKey))
+	}
+	var keyStore adapter.MetaStore
+	// quotaDefaults are replaced by the dynamic config
+	var quotaDefaults *adapter.QuotaDefaults
+	if cfg.MetaStore != "" {
+		store, closeStore, err := httpcache.NewMetaStore(ctx, cfg, rdb)
+		if err != nil {
+			return fmt.Errorf("NewMetaStore: %w", err)
+		}
+		defer closeStore()
+		quotaDefaults = adapter.NewQuotaDefaults(store)
+		keyStore = quotaDefaults
+		opts = append(opts, httpcache.WithMetaStore(keyStore))
+	}
+	var sloTracker *slo.Tracker
+	if cfg.SLOWindow > 0 {
+		sloTracker = slo.NewTracker(slo.Objectives{
+			Availability:  cfg.SLOAvailability,
+			Latency:       cfg.SLOLatency,
+			LatencyTarget: cfg.SLOLatencyTarget,
+			Window:        cfg.SLOWindow,
+			MinRequests:   cfg.SLOMinRequests,
+			CacheOnly:     cfg.SLOCacheOnly,
+		}, logger)
+		opts = append(opts, httpcache.WithSLO(sloTracker))
+	}
+	var accessTokens *adapter.AccessTokens
+	if cfg.AccessTokenSecret != "" {
+		accessTokens = adapter.NewAccessTokens(rdb, cfg.AccessTokenSecret, cfg.AccessTokenMaxTTL, logger)
+		opts = append(opts, httpcache.WithAccessTokens(accessTokens))
+	}
+	if cfg.CanaryPercent > 0 {
+		shadow, err := NewCanaryCache(cfg, logger)
+		if err != nil {
+			return fmt.Errorf("NewCanaryCache: %w", err)
+		}
+		canary := cache.NewCanary(shadow, shadow.RequestKey, cfg.CanaryPercent, logger)
+		opts = append(opts, httpcache.WithMiddleware(func(_ string, next http.Handler) http.Handler {
+			return canary.HTTPHandlerMiddleware(next)
+		}))
 	}
-	serperProxy, err := NewSerperProxy(cache, cfg, logger)
+	requestLog := reqlog.NewRecorder(rdb, keyStore, cfg.RequestLogMaxWindow, cfg.RequestLogMaxEntries, cfg.AdminKey, logger)
+	opts = append(opts, httpcache.WithRequestLog(requestLog))
+	// upstream keys start from the environment, dynamic config replaces them
+	pipeline, err := httpcache.New(cfg, opts...)
 	if err != nil {
-		return fmt.Errorf("NewSerperProxy: %w", err)
+		return fmt.Errorf("httpcache.New: %w", err)
 	}
 
 	// Create a single HTTP server with path-based routing
 	mux := http.NewServeMux()
+	notices := status.NewNoticeStore(rdb, cfg.NoticeInterval, logger)
+	for _, name := range pipeline.Providers() {
+		mux.Handle("/"+name+"/", notices.Middleware(pipeline.Provider(name)))
+	}
+	// the requests served straight through the mux, the batch sub-requests,
+	// the jobs and the replays, are ruled like the ones of the server
+	ruled := ruleEngine.HTTPHandlerMiddleware(mux)
+	if accessTokens != nil {
+		mux.HandleFunc("POST /tokens", accessTokens.Mint)
+	}
+	batch, err := proxy.NewBatch("/batch", ruled, httpCache.Prefetch, cfg.BatchConcurrency, cfg.BatchMaxRequests, logger)
+	if err != nil {
+		return fmt.Errorf("proxy.NewBatch: %w", err)
+	}
+	mux.Handle("/batch", batch)
+	var jobQueue jobs.Queue
+	switch cfg.JobQueue {
+	case "memory":
+		jobQueue = jobs.NewMemoryQueue(cfg.JobQueueSize, time.Hour, cfg.JobMaxPerKey)
+	case "redis":
+		jobQueue = jobs.NewRedisQueue(rdb, time.Hour, cfg.JobMaxPerKey, logger)
+	default:
+		return fmt.Errorf("unknown job queue %q", cfg.JobQueue)
+	}
+	// the admin endpoints are served behind the admin key, but for the
+	// request logs the key owners manage too
+	admin := http.NewServeMux()
+	adminAuth := adminauth.New(cfg.AdminKey)
+	mux.Handle("/admin/", adminAuth.HTTPHandlerMiddleware(admin))
+	cacheAdmin := cache.NewAdmin(httpCache)
+	admin.HandleFunc("POST /admin/cache/snapshots/{label}", cacheAdmin.CreateSnapshot)
+	admin.HandleFunc("GET /admin/cache/snapshots/{label}", cacheAdmin.GetSnapshot)
+	admin.HandleFunc("GET /admin/cache/entries", cacheAdmin.InspectEntry)
+	admin.HandleFunc("DELETE /admin/cache/groups/{group}", cacheAdmin.PurgeGroup)
+	var pageIndex erasure.PageIndex
+	if searchIndex != nil {
+		pageIndex = searchIndex
+		mux.Handle("GET /search-cache", keyAuth("search", keyStore, cfg.InternalKey).HTTPHandlerMiddleware(searchIndex))
+	}
+	admin.Handle("DELETE /admin/data", erasure.New(httpCache, pageIndex, cfg.PostgresURL, logger))
+	mux.HandleFunc("POST /admin/keys/{id}/requests/logging", requestLog.Enable)
+	mux.HandleFunc("DELETE /admin/keys/{id}/requests/logging", requestLog.Disable)
+	mux.HandleFunc("GET /admin/keys/{id}/requests", requestLog.Requests)
+	admin.Handle("POST /admin/debug/replay", reqlog.NewReplayer(requestLog, httpCache, ruled, cfg.InternalKey, logger))
+	if limitsAdmin != nil {
+		admin.HandleFunc("GET /admin/limits/{service}", limitsAdmin.List)
+		admin.HandleFunc("PUT /admin/limits/{service}", limitsAdmin.Set)
+		admin.HandleFunc("DELETE /admin/limits/{service}", limitsAdmin.Delete)
+	}
+	if membersAdmin != nil {
+		admin.HandleFunc("GET /admin/usage/{service}/members", membersAdmin.Report)
+	}
+	if tagsAdmin != nil {
+		admin.HandleFunc("GET /admin/usage/{service}/tags", tagsAdmin.Report)
+	}
+	if domainsAdmin != nil {
+		admin.HandleFunc("GET /admin/usage/{service}/domains", domainsAdmin.Report)
+	}
+	if budgetsAdmin != nil {
+		admin.HandleFunc("GET /admin/budgets/{service}", budgetsAdmin.List)
+		admin.HandleFunc("PUT /admin/budgets/{service}", budgetsAdmin.Set)
+		admin.HandleFunc("DELETE /admin/budgets/{service}", budgetsAdmin.Delete)
+	}
+	if sloTracker != nil {
+		admin.HandleFunc("GET /admin/slo", slo.NewAdmin(sloTracker).Reports)
+	}
+	pauseAdmin := proxy.NewPauseAdmin(rdb, pipeline.Providers())
+	admin.HandleFunc("GET /admin/providers/paused", pauseAdmin.Paused)
+	admin.HandleFunc("DELETE /admin/providers/{provider}/pause", pauseAdmin.Resume)
+	if deliverer != nil {
+		webhookAdmin := webhook.NewAdmin(deliverer)
+		admin.HandleFunc("GET /admin/webhooks/failed", webhookAdmin.Failed)
+		admin.HandleFunc("POST /admin/webhooks/{id}/replay", webhookAdmin.Replay)
+	}
+
+	jobManager := jobs.NewManager(jobQueue, ruled, notifier, keyStore, cfg.InternalKey, cfg.JobWorkers, cfg.JobMaxAttempts, logger)
+	// the submitters are checked here, their jobs are charged when they run
+	mux.Handle("POST /jobs", keyAuth("jobs", keyStore, cfg.InternalKey).HTTPHandlerMiddleware(http.HandlerFunc(jobManager.Submit)))
+	mux.HandleFunc("GET /jobs/{id}", jobManager.Get)
+	admin.HandleFunc("GET /admin/jobs/dead", jobManager.Dead)
+	admin.Handle("POST /admin/cache/warm", jobs.NewWarmer(jobQueue, httpCache, ruled, cfg.InternalKey, cfg.WarmMaxURLs, cfg.WarmHostInterval, logger))
 
-	mux.HandleFunc("/jina/", func(w http.ResponseWriter, r *http.Request) {
-		jinaProxy.ServeHTTP(w, r)
-	})
-	mux.HandleFunc("/serper/", func(w http.ResponseWriter, r *http.Request) {
-		serperProxy.ServeHTTP(w, r)
-	})
+	// the metrics hold the command line and the usage of every feature, admins only
+	mux.Handle("GET /debug/vars", adminAuth.HTTPHandlerMiddleware(expvar.Handler()))
+	statusPage := status.New(pipeline.Providers(), sloTracker, httpCache, notices, cfg.StatusNotice)
+	mux.Handle("GET /status", statusPage)
+	noticeAdmin := status.NewNoticeAdmin(notices)
+	admin.HandleFunc("GET /admin/notice", noticeAdmin.Get)
+	admin.HandleFunc("PUT /admin/notice", noticeAdmin.Set)
+	admin.HandleFunc("DELETE /admin/notice", noticeAdmin.Delete)
+	upgrader := upgrade.New(cfg.PIDFile, logger)
+	mux.HandleFunc("GET /readyz", upgrader.Readiness)
+
+	var bucket *s3.Client
+	if cfg.S3Bucket != "" {
+		bucket, err = s3.New(cfg.S3Endpoint, cfg.S3Region, cfg.S3Bucket, cfg.S3AccessKeyID, cfg.S3SecretAccessKey)
+		if err != nil {
+			return fmt.Errorf("s3.New: %w", err)
+		}
+	}
+	var retentionWorker *retention.Worker
+	if cfg.RetentionInterval > 0 {
+		retentionWorker = retention.NewWorker(retention.Policy{
+			UsageDays: cfg.RetentionUsageDays,
+			AuditDays: cfg.RetentionAuditDays,
+		}, cfg.PostgresURL, bucket, cfg.RetentionInterval, logger)
+	}
+	var rollupWorker *rollup.Worker
+	if cfg.RollupInterval > 0 {
+		rollupWorker = rollup.NewWorker(cfg.PostgresURL, cfg.RollupInterval, cfg.RollupLookback, logger)
+	}
+	var exporter *export.Exporter
+	if cfg.ExportInterval > 0 {
+		if bucket == nil {
+			return errors.New("usage export needs S3_BUCKET")
+		}
+		exporter = export.NewExporter(cfg.PostgresURL, bucket, cfg.ExportPrefix, cfg.ExportInterval, cfg.ExportLookbackDays, logger)
+	}
+	var usageTracker *adapter.UsageTracker
+	if cfg.UsageArchiveInterval > 0 {
+		pool, err := pgxpool.New(ctx, cfg.PostgresURL)
+		if err != nil {
+			return fmt.Errorf("pgxpool.New: %w", err)
+		}
+		defer pool.Close()
+		usageTracker = adapter.NewUsageTracker(ctx, rdb, dbsqlc.New(pool), logger, adapter.WithArchiveInterval(cfg.UsageArchiveInterval))
+	}
+	// the partitions of the usage the archive writes, created on election
+	// rather than by the retention worker, which may not run
+	var usagePartitions *retention.Partitions
+	if usageTracker != nil && cfg.UsagePartitionsAhead > 0 {
+		if cfg.UsagePartitionInterval <= 0 {
+			return errors.New("USAGE_PARTITION_INTERVAL must be positive")
+		}
+		usagePartitions = retention.NewPartitions(cfg.PostgresURL, cfg.UsagePartitionsAhead, cfg.UsagePartitionInterval, logger)
+	}
+	elector, err := leader.New(rdb, "cachev1", cfg.LeaderTTL, logger)
+	if err != nil {
+		return err
+	}
 
 	var h http.Handler = mux
+	h = ruleEngine.HTTPHandlerMiddleware(h)
+	if cfg.SupportKey != "" {
+		if keyStore == nil {
+			return fmt.Errorf("SUPPORT_KEY needs METASTORE to find the impersonated keys")
+		}
+		h = impersonate.New(cfg.AdminKey, keyStore, logger).HTTPHandlerMiddleware(h)
+	}
 	h = pkg.GetLoggerMiddleware(logger)(h)
 	h = middleware.Recoverer(h)
 
-	// Single server listening on port 8080
+	// Single server listening on port 8080, or on the listener of the
+	// previous version after an upgrade
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", cfg.Port),
 		Handler: h,
 	}
+	listener, err := upgrader.Listen(server.Addr, cfg.ReusePort)
+	if err != nil {
+		return fmt.Errorf("upgrader.Listen: %w", err)
+	}
 
 	// Start the single server
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			logger.Error("Server failed", "error", err)
 			return
 		}
@@ -140,24 +505,104 @@ func run(ctx context.Context, cfg pkg.Config, logger *slog.Logger) error {
 
 	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
+	// SIGHUP starts the next version, this one drains once it's ready
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangup:
+				if err := upgrader.Upgrade(ctx, cfg.UpgradeReadyTimeout); err != nil {
+					logger.Error("Upgrade failed, still serving", "error", err)
+					continue
+				}
+				cancel()
+				return
+			}
+		}
+	}()
+	jobManager.Start(ctx)
+	// the alerts and callbacks in a shared store are delivered by the
+	// leader, the ones in memory by the replica queuing them
+	if deliverer != nil && cfg.WebhookStore == "redis" {
+		elector.Register("webhooks", deliverer.Run)
+	} else if deliverer != nil {
+		deliverer.Start(ctx)
+	}
+	// singleton jobs run on the elected replica only
+	if retentionWorker != nil {
+		elector.Register("retention", retentionWorker.Run)
+	}
+	if rollupWorker != nil {
+		elector.Register("rollup", rollupWorker.Run)
+	}
+	if exporter != nil {
+		elector.Register("export", exporter.Run)
+	}
+	if accessTokens != nil {
+		elector.Register("access_tokens", accessTokens.Run)
+	}
+	if cfg.QuotaSweepInterval > 0 {
+		elector.Register("quota_sweep", adapter.NewQuotaSweeper(rdb, cfg.QuotaSweepInterval, logger).Run)
+	}
+	if usageTracker != nil {
+		elector.Register("usage_archive", usageTracker.Run)
+	}
+	if usagePartitions != nil {
+		elector.Register("usage_partitions", usagePartitions.Run)
+	}
+	elector.Start(ctx)
+	notices.Start(ctx)
+	if clickHouse != nil {
+		clickHouse.Start(ctx)
+	}
+	if searchIndex != nil {
+		searchIndex.Start(ctx)
+	}
+	if configSource != nil {
+		go configSource.Watch(ctx, applyDynamicConfig(pipeline.KeyPools(), ruleEngine, statusPage, quotaDefaults, logger))
+	}
+
+	if err := upgrader.Ready(); err != nil {
+		logger.Error("Failed to report ready", "error", err)
+	}
 
 	// Wait for shutdown signal
 	<-ctx.Done()
+	upgrader.Drain()
 	logger.Info("Received shutdown signal, shutting down server...")
 
 	// Create a context with a timeout for graceful shutdown
 	shutdownCtx := context.Background()
-	shutdownCtx, shutdownCancel := context.WithTimeout(shutdownCtx, 10*time.Second)
+	shutdownCtx, shutdownCancel := context.WithTimeout(shutdownCtx, cfg.ShutdownTimeout)
 	defer shutdownCancel()
 
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		logger.Error("Error shutting down server", "error", err)
 		return err
 	}
+	if clickHouse != nil {
+		clickHouse.Wait()
+	}
+	if searchIndex != nil {
+		searchIndex.Wait()
+	}
+	if err := httpCache.Close(); err != nil {
+		logger.Error("Error closing cache", "error", err)
+	}
 	return nil
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(doctor(os.Args[2:]))
+	}
 	// parse with generics
 	cfg, err := pkg.GetConfig()
 	if err != nil {
@@ -166,7 +611,12 @@ func main() {
 		os.Exit(1)
 	}
 	logger := pkg.GetLogger(cfg.LogLevel)
-	logger.Info("Config", "cfg", cfg)
+	// the effective settings, secrets and URL passwords masked
+	var settings []any
+	for _, setting := range cfg.Effective() {
+		settings = append(settings, slog.String(setting.Name, setting.Value))
+	}
+	logger.Info("Config", slog.Group("cfg", settings...))
 	ctx := context.Background()
 
 	if err := run(ctx, cfg, logger); err != nil {
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/fs"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg"
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisFeatures are the Redis commands cachev1 runs that older versions lack,
+// with the version that brought them and the settings running them.
+var redisFeatures = []struct {
+	command string
+	version string
+	usedBy  string
+	needed  func(pkg.Config) bool
+}{
+	{"GETDEL", "6.2.0", "the usage archive", func(pkg.Config) bool { return true }},
+	{"BLMOVE", "6.2.0", `JOB_QUEUE="redis"`, func(cfg pkg.Config) bool { return cfg.JobQueue == "redis" }},
+	{"EXPIRE NX", "7.0.0", "SEMANTIC_EMBEDDING_URL", func(cfg pkg.Config) bool { return cfg.SemanticEmbeddingURL != "" && !cfg.CacheReadOnly }},
+}
+
+// minPostgresVersion is the oldest Postgres with the identity columns and the
+// default partition of the schema, as server_version_num.
+const minPostgresVersion = 110000
+
+// preflight checks on boot that Redis and Postgres run what cachev1 needs, so
+// a mismatch fails the start with an actionable error rather than the first
+// request running into it. doctor runs the same checks.
+func preflight(ctx context.Context, cfg pkg.Config, rdb *redis.Client) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := checkRedisVersion(ctx, cfg, rdb); err != nil {
+		return fmt.Errorf("redis: %w", err)
+	}
+	if err := checkScripts(ctx, rdb); err != nil {
+		return fmt.Errorf("redis: %w", err)
+	}
+	if err := checkPostgres(ctx, cfg.PostgresURL); err != nil {
+		return fmt.Errorf("postgres: %w", err)
+	}
+	return nil
+}
+
+// checkRedisVersion checks that Redis has the commands of the features
+// configured.
+func checkRedisVersion(ctx context.Context, cfg pkg.Config, rdb *redis.Client) error {
+	info, err := rdb.Info(ctx, "server").Result()
+	if err != nil {
+		return fmt.Errorf("INFO server: %w", err)
+	}
+	version := infoField(info, "redis_version")
+	if version == "" {
+		return fmt.Errorf("INFO server has no redis_version")
+	}
+	var missing []string
+	for _, feature := range redisFeatures {
+		if feature.needed(cfg) && !versionAtLeast(version, feature.version) {
+			missing = append(missing, fmt.Sprintf("%s (Redis %s, for %s)", feature.command, feature.version, feature.usedBy))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Redis %s lacks %s, upgrade Redis", version, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// infoField returns a field of an INFO reply.
+func infoField(info, name string) string {
+	for _, line := range strings.Split(info, "\n") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), name+":"); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// versionAtLeast compares dotted versions such as "7.2.4", the missing parts
+// are 0.
+func versionAtLeast(have, want string) bool {
+	h, w := strings.Split(have, "."), strings.Split(want, ".")
+	for i := range max(len(h), len(w)) {
+		var a, b int
+		if i < len(h) {
+			a, _ = strconv.Atoi(h[i])
+		}
+		if i < len(w) {
+			b, _ = strconv.Atoi(w[i])
+		}
+		if a != b {
+			return a > b
+		}
+	}
+	return true
+}
+
+// checkScripts loads the Redis scripts without a Go fallback, they need EVAL.
+func checkScripts(ctx context.Context, rdb *redis.Client) error {
+	var failed []string
+	var lastErr error
+	for _, script := range scripts {
+		if script.fallback {
+			continue
+		}
+		if err := script.script.Load(ctx, rdb).Err(); err != nil {
+			failed, lastErr = append(failed, script.name), err
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("SCRIPT LOAD of the %s scripts: %w, allow EVAL and SCRIPT on this Redis", strings.Join(failed, ", "), lastErr)
+	}
+	return nil
+}
+
+// checkPostgres checks the Postgres version, that the schema has the tables
+// and columns of dbsqlc.Schema and that every query of dbsqlc prepares, so
+// the generated code matches the database.
+func checkPostgres(ctx context.Context, postgresURL string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	conn, err := pgx.Connect(ctx, postgresURL)
+	if err != nil {
+		return fmt.Errorf("pgx.Connect: %w", err)
+	}
+	defer conn.Close(ctx)
+	var version int
+	if err := conn.QueryRow(ctx, `SELECT current_setting('server_version_num')::int`).Scan(&version); err != nil {
+		return fmt.Errorf("server_version_num: %w", err)
+	}
+	if version < minPostgresVersion {
+		return fmt.Errorf("Postgres %d.%d is older than %d, upgrade Postgres", version/10000, version%10000, minPostgresVersion/10000)
+	}
+	if err := checkSchema(ctx, conn); err != nil {
+		return err
+	}
+	queries, err := sqlcQueries(dbsqlc.QueryFiles)
+	if err != nil {
+		return err
+	}
+	var broken []string
+	for _, name := range slices.Sorted(maps.Keys(queries)) {
+		if _, err := conn.Prepare(ctx, name, queries[name]); err != nil {
+			broken = append(broken, fmt.Sprintf("%s (%v)", name, err))
+		}
+	}
+	if len(broken) > 0 {
+		return fmt.Errorf("queries don't prepare: %s, apply pkg/dbsqlc/schema.sql or regenerate dbsqlc", strings.Join(broken, "; "))
+	}
+	return nil
+}
+
+// sqlcQueries returns the named queries of the sqlc files, by name.
+func sqlcQueries(files fs.FS) (map[string]string, error) {
+	paths, err := fs.Glob(files, "*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("fs.Glob: %w", err)
+	}
+	queries := map[string]string{}
+	for _, path := range paths {
+		b, err := fs.ReadFile(files, path)
+		if err != nil {
+			return nil, fmt.Errorf("fs.ReadFile: %w", err)
+		}
+		var name string
+		var query strings.Builder
+		scanner := bufio.NewScanner(strings.NewReader(string(b)))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if rest, ok := strings.CutPrefix(line, "-- name: "); ok {
+				name, _, _ = strings.Cut(rest, " ")
+				query.Reset()
+				continue
+			}
+			if name == "" || strings.HasPrefix(strings.TrimSpace(line), "--") {
+				continue
+			}
+			query.WriteString(line + "\n")
+			if strings.HasSuffix(strings.TrimSpace(line), ";") {
+				queries[name] = query.String()
+				name = ""
+			}
+		}
+	}
+	return queries, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg"
+	"github.com/Airren/poorman-httpcache/v2/pkg/dynconfig"
+	"github.com/Airren/poorman-httpcache/v2/pkg/httpcache"
+	"github.com/Airren/poorman-httpcache/v2/pkg/proxy"
+	"github.com/Airren/poorman-httpcache/v2/pkg/rules"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate/adapter"
+)
+
+// validate checks the config of the environment, and of a dynamic config
+// document, without serving, to gate config changes in CI:
+//
+//	cachev1 validate [-config dynconfig.json] [-connect]
+//
+// It prints the effective config with the secrets masked, then the problems
+// found, and returns 1 when there are any.
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	configFile := flags.String("config", "", "dynamic config document to check, as stored in Consul or etcd")
+	connect := flags.Bool("connect", false, "check that Redis and Postgres are reachable")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := pkg.ParseConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+		return 1
+	}
+	for _, setting := range cfg.Effective() {
+		fmt.Printf("%s=%q\n", setting.Name, setting.Value)
+	}
+
+	var doc dynconfig.Config
+	var problems []string
+	if *configFile != "" {
+		b, err := os.ReadFile(*configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+			return 1
+		}
+		if doc, err = dynconfig.Parse(b); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", *configFile, err))
+		}
+	}
+	problems = append(problems, checkConfig(cfg, doc)...)
+	if *connect {
+		if err := pkg.TestConnections(cfg); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "invalid config: %s\n", problem)
+		}
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, "config OK")
+	return 0
+}
+
+// checkConfig returns the problems of cfg and of the dynamic config doc that
+// would stop cachev1 or leave a provider unusable.
+func checkConfig(cfg pkg.Config, doc dynconfig.Config) []string {
+	logger := slog.New(slog.DiscardHandler)
+	var problems []string
+	problemf := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// the checks of run
+	if cfg.PrivacyMode && cfg.PrivacySalt == "" {
+		problemf("PRIVACY_SALT is required in privacy mode")
+	}
+	if cfg.PrivacyMode && cfg.JobQueue != "memory" {
+		problemf("job queue %q persists request bodies, use \"memory\" in privacy mode", cfg.JobQueue)
+	}
+	if cfg.PrivacyMode && cfg.WebhookStore != "memory" {
+		problemf("webhook store %q persists job bodies, use \"memory\" in privacy mode", cfg.WebhookStore)
+	}
+	if cfg.PrivacyMode && cfg.SemanticEmbeddingURL != "" {
+		problemf("SEMANTIC_EMBEDDING_URL sends the queries out, it can't be set in privacy mode")
+	}
+	switch cfg.UsageSink {
+	case "":
+	case "clickhouse":
+		if _, err := adapter.NewClickHouseSink(cfg.ClickHouseURL, cfg.ClickHouseTable, cfg.ClickHouseBatchSize, logger); err != nil {
+			problemf("NewClickHouseSink: %v", err)
+		}
+	default:
+		problemf("unknown usage sink %q", cfg.UsageSink)
+	}
+	if cfg.JobQueue != "memory" && cfg.JobQueue != "redis" {
+		problemf("unknown job queue %q", cfg.JobQueue)
+	}
+	if _, err := proxy.NewBatch("/batch", http.NotFoundHandler(), nil, cfg.BatchConcurrency, cfg.BatchMaxRequests, logger); err != nil {
+		problemf("proxy.NewBatch: %v", err)
+	}
+	if cfg.WebhookSecret == "" && (cfg.ProviderAlertURL != "" || cfg.QuotaAlertURL != "") {
+		problemf("PROVIDER_ALERT_URL and QUOTA_ALERT_URL need WEBHOOK_SECRET")
+	}
+	if cfg.WebhookStore != "memory" && cfg.WebhookStore != "redis" {
+		problemf("unknown webhook store %q", cfg.WebhookStore)
+	}
+	switch {
+	case cfg.MetaStore == "file":
+		if _, err := adapter.NewFileMetaStore(cfg.MetaStoreFile); err != nil {
+			problemf("METASTORE_FILE: %v", err)
+		}
+	case cfg.MetaStore != "" && !slices.Contains(adapter.MetaStores(), cfg.MetaStore):
+		problemf("unknown MetaStore backend %q, registered: %v", cfg.MetaStore, adapter.MetaStores())
+	}
+	if cfg.UsagePartitionsAhead > 0 && cfg.UsagePartitionInterval <= 0 {
+		problemf("USAGE_PARTITION_INTERVAL must be positive")
+	}
+	if cfg.SupportKey != "" && cfg.MetaStore == "" {
+		problemf("SUPPORT_KEY needs METASTORE to find the impersonated keys")
+	}
+	if cfg.ConfigSource != "" {
+		if _, err := dynconfig.New(cfg.ConfigSource, cfg.ConfigSourceURL, cfg.ConfigSourceKey, cfg.ConfigSourceToken, logger); err != nil {
+			problemf("dynconfig.New: %v", err)
+		}
+	}
+	if cfg.ExportInterval > 0 && cfg.S3Bucket == "" {
+		problemf("usage export needs S3_BUCKET")
+	}
+	if cfg.LeaderTTL <= 0 {
+		problemf("LEADER_TTL must be positive, got %s", cfg.LeaderTTL)
+	}
+	if cfg.InternalKey == "" {
+		problemf("INTERNAL_KEY is empty, the providers would accept requests without a key")
+	}
+
+	// URL targets
+	for _, setting := range cfg.Effective() {
+		if setting.Value == "" || !(strings.HasSuffix(setting.Name, "_URL") || strings.HasSuffix(setting.Name, "_ENDPOINT")) {
+			continue
+		}
+		u, err := url.Parse(setting.Value)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			problemf("%s: invalid URL %q", setting.Name, setting.Value)
+		}
+	}
+
+	// admission rules
+	engine := rules.New(logger)
+	if cfg.RulesFile != "" {
+		fileRules, err := rules.Load(cfg.RulesFile)
+		if err == nil {
+			err = engine.Set(fileRules)
+		}
+		if err != nil {
+			problemf("RULES_FILE: %v", err)
+		}
+	}
+	if err := engine.Set(doc.Rules); err != nil {
+		problemf("dynamic config rules: %v", err)
+	}
+
+	for name := range doc.Providers {
+		if !slices.Contains(httpcache.Providers, name) {
+			problemf("dynamic config: unknown provider %q", name)
+		}
+	}
+
+	// providers, built as cachev1 would without connecting to anything
+	pipeline, err := httpcache.New(cfg, httpcache.WithLogger(logger))
+	if err != nil {
+		problemf("httpcache.New: %v", err)
+		return problems
+	}
+	defer pipeline.Close()
+	keys := map[string]bool{
+		"jina":   cfg.JinaAPIKey != "" || cfg.JinaOAuth.TokenURL != "",
+		"serper": cfg.SerperAPIKey != "" || cfg.SerperOAuth.TokenURL != "",
+		"azure":  cfg.AzureOpenAIAPIKey != "",
+	}
+	for _, name := range pipeline.Providers() {
+		present, needed := keys[name]
+		if needed && !present && len(doc.Providers[name].Keys) == 0 {
+			problemf("the %s provider has no upstream key, in the environment or the dynamic config", name)
+		}
+	}
+	return problems
+}
@@ -5,9 +5,12 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"github.com/Airren/poorman-httpcache/v2/pkg"
+	"github.com/Airren/poorman-httpcache/v2/pkg/admin"
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+	"github.com/Airren/poorman-httpcache/v2/pkg/httpcache"
+	"github.com/Airren/poorman-httpcache/v2/pkg/status"
 	"html/template"
-	"httpcache/pkg"
-	"httpcache/pkg/dbsqlc"
 	"log/slog"
 	"net/http"
 	"os"
@@ -34,10 +37,12 @@ const formHTML = `
         input[type="submit"]:hover { background-color: #45a049; }
         .error { color: red; margin: 10px 0; }
         .success { color: green; margin: 10px 0; }
+        .notice { background-color: #fff8c5; border: 1px solid #d4a72c; padding: 10px; border-radius: 3px; margin: 10px 0; }
     </style>
 </head>
 <body>
     <h1>Request Your API Key</h1>
+    {{with notice}}<div class="notice">{{.}}</div>{{end}}
     {{if .Error}}<div class="error">{{.Error}}</div>{{end}}
     {{if .Success}}<div class="success">{{.Success}}</div>{{end}}
     <form method="post">
@@ -49,11 +54,20 @@ const formHTML = `
 </html>
 `
 
+// EmailData fills the email body template
+type EmailData struct {
+	APIKey      string
+	EmailDomain string
+	// ExpiresAt is set for trial keys
+	ExpiresAt string
+}
+
 // HTML template for the email body
 const emailHTML = `
 <h2>Your API Key</h2>
 <p>Hello,</p>
 <p>Your API key is: <strong>{{.APIKey}}</strong></p>
+{{if .ExpiresAt}}<p>This is a trial key, it stops working on {{.ExpiresAt}}. Contact us to keep using it.</p>{{end}}
 <p>Please keep this key secure and do not share it with others.</p>
 
 <h3>Bash Examples</h3>
@@ -141,8 +155,19 @@ func run(ctx context.Context, cfg pkg.Config, logger *slog.Logger) error {
 	// Create resend client
 	resendClient := resend.NewClient(cfg.ResendAPIKey)
 
+	// the service notice set on the admin API of cachev1, shown on the pages
+	rdb := httpcache.NewRedisClient(cfg)
+	defer func() {
+		if err := rdb.Close(); err != nil {
+			logger.Error("rdb.Close()", "error", err)
+		}
+	}()
+	notices := status.NewNoticeStore(rdb, cfg.NoticeInterval, logger)
+	notices.Start(ctx)
+	pageFuncs := template.FuncMap{"notice": notices.Current}
+
 	// Parse templates
-	formTmpl, err := template.New("form").Parse(formHTML)
+	formTmpl, err := template.New("form").Funcs(pageFuncs).Parse(formHTML)
 	if err != nil {
 		return fmt.Errorf("form template.Parse: %w", err)
 	}
@@ -222,11 +247,6 @@ func run(ctx context.Context, cfg pkg.Config, logger *slog.Logger) error {
 			apiKey := cfg.InternalKey
 
 			// Generate email body using template
-			type EmailData struct {
-				APIKey      string
-				EmailDomain string
-			}
-
 			emailData := EmailData{
 				APIKey:      apiKey,
 				EmailDomain: cfg.EmailDomain,
@@ -271,6 +291,11 @@ func run(ctx context.Context, cfg pkg.Config, logger *slog.Logger) error {
 		}
 	})
 
+	// Trial signups, verified by email
+	if err := handleSignup(mux, admin.NewAdminService(db), resendClient, emailTmpl, pageFuncs, cfg, logger); err != nil {
+		return err
+	}
+
 	// Single server listening on port 8080
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", cfg.Port),
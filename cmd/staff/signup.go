@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/Airren/poorman-httpcache/v2/pkg"
+	"github.com/Airren/poorman-httpcache/v2/pkg/admin"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/resend/resend-go/v2"
+)
+
+// HTML template for the signup and verification pages
+const signupHTML = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Start a Free Trial</title>
+    <style>
+        body { font-family: Arial, sans-serif; max-width: 500px; margin: 50px auto; padding: 20px; }
+        form { border: 1px solid #ccc; padding: 20px; border-radius: 5px; }
+        input[type="email"] { width: 100%; padding: 8px; margin: 10px 0; border: 1px solid #ccc; border-radius: 3px; }
+        input[type="submit"] { background-color: #4CAF50; color: white; padding: 10px 20px; border: none; border-radius: 3px; cursor: pointer; }
+        input[type="submit"]:hover { background-color: #45a049; }
+        .error { color: red; margin: 10px 0; }
+        .success { color: green; margin: 10px 0; }
+        .notice { background-color: #fff8c5; border: 1px solid #d4a72c; padding: 10px; border-radius: 3px; margin: 10px 0; }
+    </style>
+</head>
+<body>
+    <h1>Start a Free Trial</h1>
+    <p>Trial keys have {{.Quota}} requests per service and work for {{.Days}} days.</p>
+    {{with notice}}<div class="notice">{{.}}</div>{{end}}
+    {{if .Error}}<div class="error">{{.Error}}</div>{{end}}
+    {{if .Success}}<div class="success">{{.Success}}</div>{{end}}
+    {{if .Token}}
+    <form method="post" action="verify">
+        <input type="hidden" name="token" value="{{.Token}}">
+        <input type="submit" value="Create My Trial Key">
+    </form>
+    {{else if not .Success}}
+    <form method="post">
+        <label for="email">Email Address:</label>
+        <input type="email" id="email" name="email" required value="{{.Email}}">
+        <input type="submit" value="Send Verification Email">
+    </form>
+    {{end}}
+</body>
+</html>
+`
+
+// HTML template for the verification email
+const verifyEmailHTML = `
+<h2>Verify Your Email</h2>
+<p>Hello,</p>
+<p>Someone, hopefully you, asked for a trial API key for this address.</p>
+<p><a href="{{.Link}}">Verify your email and create your trial key</a></p>
+<p>The link is valid for 24 hours. If you didn't ask for a key, ignore this email.</p>
+<p>Best regards,<br>The Team</p>
+`
+
+// SignupData fills the signup page template
+type SignupData struct {
+	Email   string
+	Token   string
+	Error   string
+	Success string
+	Quota   int
+	Days    int
+}
+
+// handleSignup serves the trial signups on /signup. A signup sends a
+// verification link, whose page creates the trial key and emails it. The page
+// asks to confirm with a POST, so link scanners can't use the token. The page
+// functions are those of the staff pages, e.g. the service notice.
+func handleSignup(mux chi.Router, adminService *admin.AdminService, resendClient *resend.Client, emailTmpl *template.Template, pageFuncs template.FuncMap, cfg pkg.Config, logger *slog.Logger) error {
+	// the links are never derived from the Host of the requests, anyone can
+	// set it and have the verification emails point to their site
+	signupURL, err := url.Parse(cfg.TrialSignupURL)
+	if err != nil || cfg.TrialSignupURL == "" || signupURL.Host == "" || (signupURL.Scheme != "https" && signupURL.Scheme != "http") {
+		return fmt.Errorf("TRIAL_SIGNUP_URL must be the absolute URL of the signup page, got %q", cfg.TrialSignupURL)
+	}
+	signupTmpl, err := template.New("signup").Funcs(pageFuncs).Parse(signupHTML)
+	if err != nil {
+		return fmt.Errorf("signup template.Parse: %w", err)
+	}
+	verifyTmpl, err := template.New("verify").Parse(verifyEmailHTML)
+	if err != nil {
+		return fmt.Errorf("verify template.Parse: %w", err)
+	}
+	settings := admin.TrialSettings{
+		Quota:    int32(cfg.TrialQuota),
+		Duration: time.Duration(cfg.TrialDays) * 24 * time.Hour,
+	}
+	render := func(w http.ResponseWriter, data SignupData) {
+		data.Quota = cfg.TrialQuota
+		data.Days = cfg.TrialDays
+		if err := signupTmpl.Execute(w, data); err != nil {
+			logger.Error("Failed to execute signup template", "error", err)
+		}
+	}
+	send := func(to, subject string, tmpl *template.Template, data any) error {
+		var body bytes.Buffer
+		if err := tmpl.Execute(&body, data); err != nil {
+			return fmt.Errorf("template.Execute: %w", err)
+		}
+		sent, err := resendClient.Emails.Send(&resend.SendEmailRequest{
+			From:    fmt.Sprintf("API Keys <noreply@%s>", cfg.EmailDomain),
+			To:      []string{to},
+			Html:    body.String(),
+			Subject: subject,
+		})
+		if err != nil {
+			return fmt.Errorf("Emails.Send: %w", err)
+		}
+		logger.Info("Email sent successfully", "email", to, "subject", subject, "message_id", sent.Id)
+		return nil
+	}
+
+	mux.Get("/signup", func(w http.ResponseWriter, r *http.Request) {
+		render(w, SignupData{})
+	})
+
+	mux.Post("/signup", func(w http.ResponseWriter, r *http.Request) {
+		email := r.FormValue("email")
+		if email == "" {
+			render(w, SignupData{Error: "Email is required"})
+			return
+		}
+
+		token, err := adminService.RequestTrial(r.Context(), email)
+		switch {
+		case errors.Is(err, admin.ErrUserExists):
+			render(w, SignupData{Email: email, Error: "This email already has an account. Please contact support."})
+			return
+		case errors.Is(err, admin.ErrTooManySignups):
+			render(w, SignupData{Email: email, Error: "Too many signups for this email. Please try again tomorrow."})
+			return
+		case err != nil:
+			logger.Error("Failed to request trial", "email", email, "error", err)
+			render(w, SignupData{Email: email, Error: "Failed to sign up. Please try again later."})
+			return
+		}
+
+		link := strings.TrimSuffix(cfg.TrialSignupURL, "/") + "/verify?token=" + url.QueryEscape(token)
+		if err := send(email, "Verify your email", verifyTmpl, struct{ Link string }{link}); err != nil {
+			logger.Error("Failed to send verification email", "email", email, "error", err)
+			render(w, SignupData{Email: email, Error: "Failed to send email. Please try again later."})
+			return
+		}
+		render(w, SignupData{Success: "Check your inbox, we sent you a verification link."})
+	})
+
+	mux.Get("/signup/verify", func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			render(w, SignupData{Error: "The verification link is incomplete."})
+			return
+		}
+		render(w, SignupData{Token: token})
+	})
+
+	mux.Post("/signup/verify", func(w http.ResponseWriter, r *http.Request) {
+		token := r.FormValue("token")
+		result, err := adminService.VerifyTrial(r.Context(), token, settings)
+		switch {
+		case errors.Is(err, admin.ErrInvalidToken):
+			render(w, SignupData{Error: "The verification link is invalid, used or expired. Please sign up again."})
+			return
+		case errors.Is(err, admin.ErrUserExists):
+			render(w, SignupData{Error: "This email already has an account. Please contact support."})
+			return
+		case err != nil:
+			logger.Error("Failed to verify trial", "error", err)
+			render(w, SignupData{Token: token, Error: "Failed to create your key. Please try again later."})
+			return
+		}
+
+		emailData := EmailData{
+			APIKey:      result.APIKey.KeyString,
+			EmailDomain: cfg.EmailDomain,
+			ExpiresAt:   result.APIKey.ExpiresAt.Format("January 2, 2006"),
+		}
+		if err := send(result.User.Email, "Your Trial API Key", emailTmpl, emailData); err != nil {
+			// the key exists, support can resend it
+			logger.Error("Failed to send trial key email", "email", result.User.Email, "error", err)
+			render(w, SignupData{Error: "Your key was created but we failed to email it. Please contact support."})
+			return
+		}
+		render(w, SignupData{Success: "Your trial API key has been sent to your email address."})
+	})
+
+	return nil
+}
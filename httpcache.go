@@ -0,0 +1,31 @@
+// Package httpcache is the root of the module. The pipelines are built by
+// package github.com/Airren/poorman-httpcache/v2/pkg/httpcache, the names
+// below only keep building the code written against the module root.
+package httpcache
+
+import (
+	"github.com/Airren/poorman-httpcache/v2/pkg"
+	"github.com/Airren/poorman-httpcache/v2/pkg/httpcache"
+)
+
+// Config is the configuration of the pipelines.
+//
+// Deprecated: use pkg.Config of github.com/Airren/poorman-httpcache/v2/pkg.
+type Config = pkg.Config
+
+// Handler serves the providers of a pipeline.
+//
+// Deprecated: use httpcache.Handler of github.com/Airren/poorman-httpcache/v2/pkg/httpcache.
+type Handler = httpcache.Handler
+
+// Option is used to set Handler settings.
+//
+// Deprecated: use httpcache.Option of github.com/Airren/poorman-httpcache/v2/pkg/httpcache.
+type Option = httpcache.Option
+
+// New builds the pipelines of the providers of cfg.
+//
+// Deprecated: use httpcache.New of github.com/Airren/poorman-httpcache/v2/pkg/httpcache.
+func New(cfg Config, opts ...Option) (*Handler, error) {
+	return httpcache.New(cfg, opts...)
+}
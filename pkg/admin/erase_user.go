@@ -0,0 +1,99 @@
+// Package admin provides administrative operations for user and API key management.
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErasedUser represents what was erased for a user
+type ErasedUser struct {
+	UserID           int64  `json:"user_id"`
+	UsageLogsDeleted int64  `json:"usage_logs_deleted"`
+	AnonymizedEmail  string `json:"anonymized_email"`
+	// SignupsAnonymized is the number of trial signups of the email anonymized
+	SignupsAnonymized int64 `json:"signups_anonymized"`
+}
+
+// ErrUserNotFound is returned when no user has the given email
+var ErrUserNotFound = errors.New("user not found")
+
+// EraseUser deletes the usage history of a user, minute rows and daily
+// aggregates, and anonymizes the user record and the trial signups of the
+// email. The record is kept so the key status history stays consistent, but
+// it no longer identifies the person. An email that only signed up, without
+// a user, has its signups anonymized.
+func (as *AdminService) EraseUser(ctx context.Context, email string) (*ErasedUser, error) {
+	// Start transaction
+	tx, err := as.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+			// Rollback errors are typically expected after successful commits
+			_ = rollbackErr // Acknowledge but don't propagate rollback errors
+		}
+	}()
+
+	// Create queries with transaction context
+	qtx := as.queries.WithTx(tx)
+
+	user, err := qtx.GetUserByEmail(ctx, email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		signups, err := qtx.AnonymizeTrialSignups(ctx, &dbsqlc.AnonymizeTrialSignupsParams{Email: email, Email_2: "erased@invalid"})
+		if err != nil {
+			return nil, fmt.Errorf("failed to anonymize trial signups: %w", err)
+		}
+		if signups == 0 {
+			return nil, fmt.Errorf("user with email %s: %w", email, ErrUserNotFound)
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return nil, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		return &ErasedUser{AnonymizedEmail: "erased@invalid", SignupsAnonymized: signups}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	deleted, err := qtx.DeleteUsageLogsByUserID(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete usage logs: %w", err)
+	}
+	hourly, err := qtx.DeleteUsageHourlyByUserID(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete hourly usage: %w", err)
+	}
+	daily, err := qtx.DeleteUsageDailyByUserID(ctx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete daily usage: %w", err)
+	}
+
+	// emails are unique, the user ID keeps the placeholder unique too
+	anonymized := fmt.Sprintf("erased-%d@invalid", user.ID)
+	if err := qtx.AnonymizeUser(ctx, &dbsqlc.AnonymizeUserParams{ID: user.ID, Email: anonymized}); err != nil {
+		return nil, fmt.Errorf("failed to anonymize user: %w", err)
+	}
+	signups, err := qtx.AnonymizeTrialSignups(ctx, &dbsqlc.AnonymizeTrialSignupsParams{Email: email, Email_2: anonymized})
+	if err != nil {
+		return nil, fmt.Errorf("failed to anonymize trial signups: %w", err)
+	}
+
+	// Commit transaction
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return &ErasedUser{
+		UserID:            user.ID,
+		UsageLogsDeleted:  deleted + hourly + daily,
+		AnonymizedEmail:   anonymized,
+		SignupsAnonymized: signups,
+	}, nil
+}
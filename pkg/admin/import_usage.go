@@ -0,0 +1,231 @@
+package admin
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// ImportedUsage represents the outcome of a usage import
+type ImportedUsage struct {
+	Days     int   `json:"days"`
+	Imported int   `json:"imported"`
+	Skipped  int   `json:"skipped"` // days already recorded by the proxy
+	Total    int64 `json:"total"`
+}
+
+// ErrServiceNotFound is returned when no service has the given name
+var ErrServiceNotFound = errors.New("service not found")
+
+// usageColumns are the columns of the provider exports, by preference. The
+// proxy charges Jina and Serper one unit per request, so request counts come
+// first; credits or tokens are only picked when asked for.
+var usageColumns = map[string]struct {
+	date, amount []string
+}{
+	"serper": {
+		date:   []string{"date", "day", "timestamp", "created_at"},
+		amount: []string{"requests", "queries", "searches", "count"},
+	},
+	"jina": {
+		date:   []string{"date", "day", "time", "timestamp"},
+		amount: []string{"requests", "request_count", "calls", "count"},
+	},
+}
+
+var usageDateLayouts = []string{
+	time.DateOnly,
+	time.RFC3339,
+	time.DateTime,
+	"2006/01/02",
+	"01/02/2006",
+	"Jan 2, 2006",
+}
+
+// ParseUsageExport reads a provider-side usage export, CSV with a header row
+// or a JSON array of objects, and returns the usage per UTC day. column
+// overrides the amount column, e.g. "credits".
+func ParseUsageExport(provider string, r io.Reader, column string) (map[time.Time]int64, error) {
+	columns, ok := usageColumns[provider]
+	if !ok {
+		return nil, fmt.Errorf("no usage export format for %q, expected one of %s", provider, strings.Join(slices.Sorted(maps.Keys(usageColumns)), ", "))
+	}
+	amountColumns := columns.amount
+	if column != "" {
+		amountColumns = []string{column}
+	}
+
+	records, err := readUsageRecords(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("usage export is empty")
+	}
+	header := records[0]
+	dateAt := findColumn(header, columns.date)
+	amountAt := findColumn(header, amountColumns)
+	if dateAt < 0 || amountAt < 0 {
+		return nil, fmt.Errorf("usage export columns %s, expected a date column (%s) and an amount column (%s), pick it with -column",
+			strings.Join(header, ", "), strings.Join(columns.date, ", "), strings.Join(amountColumns, ", "))
+	}
+
+	days := map[time.Time]int64{}
+	for i, record := range records[1:] {
+		if len(record) <= max(dateAt, amountAt) {
+			return nil, fmt.Errorf("usage export row %d: %d fields", i+1, len(record))
+		}
+		day, err := parseUsageDay(record[dateAt])
+		if err != nil {
+			return nil, fmt.Errorf("usage export row %d: %w", i+1, err)
+		}
+		amount, err := parseUsageAmount(record[amountAt])
+		if err != nil {
+			return nil, fmt.Errorf("usage export row %d: %w", i+1, err)
+		}
+		days[day] += amount
+	}
+	return days, nil
+}
+
+// readUsageRecords returns the rows of an export, the header first.
+func readUsageRecords(r io.Reader) ([][]string, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if trimmed := strings.TrimSpace(string(body)); !strings.HasPrefix(trimmed, "[") {
+		records, err := csv.NewReader(strings.NewReader(trimmed)).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("csv.ReadAll: %w", err)
+		}
+		return records, nil
+	}
+
+	var rows []map[string]any
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	header := slices.Sorted(maps.Keys(rows[0]))
+	records := [][]string{header}
+	for _, row := range rows {
+		record := make([]string, len(header))
+		for i, name := range header {
+			if value, ok := row[name]; ok && value != nil {
+				record[i] = fmt.Sprint(value)
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// findColumn returns the index of the first of names in header, -1 if none is.
+func findColumn(header []string, names []string) int {
+	for _, name := range names {
+		for i, column := range header {
+			normalized := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(column)), " ", "_")
+			if normalized == name {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func parseUsageDay(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range usageDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			t = t.UTC()
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown date %q", value)
+}
+
+func parseUsageAmount(value string) (int64, error) {
+	value = strings.ReplaceAll(strings.TrimSpace(value), ",", "")
+	if value == "" {
+		return 0, nil
+	}
+	amount, err := strconv.ParseFloat(value, 64)
+	if err != nil || amount < 0 {
+		return 0, fmt.Errorf("invalid amount %q", value)
+	}
+	return int64(amount), nil
+}
+
+// ImportUsage records the daily usage of a provider export as usage of a key
+// and service, so reporting covers the time before the proxy was adopted.
+// The days the proxy already recorded are kept as is, which makes the import
+// safe to run again.
+func (as *AdminService) ImportUsage(ctx context.Context, keyString, serviceName string, days map[time.Time]int64) (*ImportedUsage, error) {
+	tx, err := as.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+			// Rollback errors are typically expected after successful commits
+			_ = rollbackErr // Acknowledge but don't propagate rollback errors
+		}
+	}()
+
+	qtx := as.queries.WithTx(tx)
+
+	key, err := qtx.GetAPIKeyByKeyString(ctx, keyString)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("api key: %w", ErrKeyNotFound)
+		}
+		return nil, fmt.Errorf("failed to get api key: %w", err)
+	}
+	service, err := qtx.GetServiceByName(ctx, serviceName)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("service %s: %w", serviceName, ErrServiceNotFound)
+		}
+		return nil, fmt.Errorf("failed to get service: %w", err)
+	}
+
+	imported := &ImportedUsage{Days: len(days)}
+	for _, day := range slices.SortedFunc(maps.Keys(days), time.Time.Compare) {
+		rows, err := qtx.ImportUsageDaily(ctx, &dbsqlc.ImportUsageDailyParams{
+			ApiKeyID:          key.ID,
+			ServiceID:         service.ID,
+			Day:               pgtype.Date{Time: day, Valid: true},
+			ConsumptionAmount: days[day],
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to import usage of %s: %w", day.Format(time.DateOnly), err)
+		}
+		if rows == 0 {
+			imported.Skipped++
+			continue
+		}
+		imported.Imported++
+		imported.Total += days[day]
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return imported, nil
+}
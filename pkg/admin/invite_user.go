@@ -8,7 +8,7 @@ import (
 	"fmt"
 	"time"
 
-	"httpcache/pkg/dbsqlc"
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
 
 	"github.com/jackc/pgx/v5"
 )
@@ -26,6 +26,11 @@ type APIKey struct {
 	KeyString string    `json:"key_string"`
 	Status    string    `json:"status"`
 	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is set on trial keys
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// AllowedCIDRs and AllowedOrigins restrict where the key works from
+	AllowedCIDRs   []string `json:"allowed_cidrs,omitempty"`
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
 }
 
 // ServiceQuota represents quota allocation for a service
@@ -60,13 +65,21 @@ func NewAdminService(db *pgx.Conn) *AdminService {
 // format {prefix}{random_string}
 const ServiceKeyPrefix = "svc-miro-api01-"
 
+// UserKeyPrefix is the prefix for user keys with quotas, such as trial keys
+const UserKeyPrefix = "usr-miro-api01-"
+
 // generateAPIKey creates a secure random API key string
 func generateAPIKey() (string, error) {
+	return generateKey(ServiceKeyPrefix)
+}
+
+// generateKey creates a secure random key string with the given prefix
+func generateKey(prefix string) (string, error) {
 	bytes := make([]byte, 32) // 64 character hex string
 	if _, err := rand.Read(bytes); err != nil {
 		return "", fmt.Errorf("failed to generate random bytes: %w", err)
 	}
-	return ServiceKeyPrefix + hex.EncodeToString(bytes), nil
+	return prefix + hex.EncodeToString(bytes), nil
 }
 
 // CreateNewUser creates a new user in the system.
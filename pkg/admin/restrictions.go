@@ -0,0 +1,48 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	// ErrKeyNotFound is returned for unknown key strings
+	ErrKeyNotFound = errors.New("API key not found")
+	// ErrInvalidRestrictions is returned for CIDRs or origins that don't parse
+	ErrInvalidRestrictions = errors.New("invalid restrictions")
+)
+
+// SetKeyRestrictions sets the client networks and web origins a key works
+// from, empty lists allow anywhere. The tollgates reading the metadata from
+// Redis see the change once it expires from the cache.
+func (as *AdminService) SetKeyRestrictions(ctx context.Context, keyString string, cidrs, origins []string) (*APIKey, error) {
+	if _, err := tollgate.ParseRestrictions(cidrs, origins); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRestrictions, err)
+	}
+	// NULL rather than empty arrays, nothing is restricted
+	if len(cidrs) == 0 {
+		cidrs = nil
+	}
+	if len(origins) == 0 {
+		origins = nil
+	}
+
+	apiKey, err := as.queries.SetAPIKeyRestrictions(ctx, &dbsqlc.SetAPIKeyRestrictionsParams{
+		KeyString:      keyString,
+		AllowedCidrs:   cidrs,
+		AllowedOrigins: origins,
+	})
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrKeyNotFound
+		}
+		return nil, fmt.Errorf("failed to set restrictions: %w", err)
+	}
+	return toAPIKey(apiKey), nil
+}
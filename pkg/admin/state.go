@@ -0,0 +1,401 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// State is a declarative document of the services, users, keys and quotas,
+// e.g. kept in git and applied by CI or Terraform.
+type State struct {
+	Services []ServiceState `json:"services"`
+	Users    []UserState    `json:"users"`
+	// Prune revokes the labeled keys of the listed users missing from the state
+	Prune bool `json:"prune"`
+}
+
+// ServiceState is a service and the quota new keys get for it
+type ServiceState struct {
+	Name         string `json:"name"`
+	DefaultQuota int32  `json:"default_quota"`
+}
+
+// UserState is a user and its keys
+type UserState struct {
+	Email string     `json:"email"`
+	Keys  []KeyState `json:"keys"`
+}
+
+// KeyState is a key, named by a label unique among the keys of its user
+type KeyState struct {
+	Label string `json:"label"`
+	// ServiceKey keys have no quota, it can't change once the key exists
+	ServiceKey bool `json:"service_key"`
+	Revoked    bool `json:"revoked"`
+	// Quotas are the initial quotas by service, the services missing get
+	// their default quota when the key is created and are left alone after
+	Quotas         map[string]int32 `json:"quotas"`
+	AllowedCIDRs   []string         `json:"allowed_cidrs"`
+	AllowedOrigins []string         `json:"allowed_origins"`
+}
+
+// Change is a step of the plan applying a state
+type Change struct {
+	Action   string `json:"action"`   // create, update or revoke
+	Resource string `json:"resource"` // service, user, key or quota
+	Name     string `json:"name"`     // e.g. "alice@example.com/ci/jina"
+	Detail   string `json:"detail,omitempty"`
+	// KeyString is returned once, when a key is created
+	KeyString string `json:"key_string,omitempty"`
+}
+
+// Plan lists the changes applying a state made, or would make on a dry run.
+// Applying the same state again plans no change.
+type Plan struct {
+	Changes []Change `json:"changes"`
+	Applied bool     `json:"applied"`
+}
+
+// ErrInvalidState is returned for states that can't be applied
+var ErrInvalidState = errors.New("invalid state")
+
+// ApplyState diffs the state against the database and applies the changes
+// in one transaction, or only plans them when dryRun is set. Quota changes
+// move the remaining quota by the change of the initial one; the tollgates
+// see them once the cached balances expire from Redis.
+func (as *AdminService) ApplyState(ctx context.Context, state *State, dryRun bool) (*Plan, error) {
+	if err := validateState(state); err != nil {
+		return nil, err
+	}
+
+	tx, err := as.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+			// Rollback errors are typically expected after successful commits
+			_ = rollbackErr // Acknowledge but don't propagate rollback errors
+		}
+	}()
+
+	a := &stateApply{qtx: as.queries.WithTx(tx), plan: &Plan{Changes: []Change{}}, dryRun: dryRun}
+	if err := a.applyServices(ctx, state.Services); err != nil {
+		return nil, err
+	}
+	for _, user := range state.Users {
+		if err := a.applyUser(ctx, user, state.Prune); err != nil {
+			return nil, err
+		}
+	}
+
+	if dryRun {
+		return a.plan, nil
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	a.plan.Applied = true
+	return a.plan, nil
+}
+
+// validateState checks a state before touching the database.
+func validateState(state *State) error {
+	services := map[string]bool{}
+	for _, service := range state.Services {
+		if service.Name == "" || services[service.Name] {
+			return fmt.Errorf("%w: service %q is empty or listed twice", ErrInvalidState, service.Name)
+		}
+		if service.DefaultQuota < 0 {
+			return fmt.Errorf("%w: service %s has a negative default quota", ErrInvalidState, service.Name)
+		}
+		services[service.Name] = true
+	}
+	emails := map[string]bool{}
+	for _, user := range state.Users {
+		if user.Email == "" || emails[user.Email] {
+			return fmt.Errorf("%w: user %q is empty or listed twice", ErrInvalidState, user.Email)
+		}
+		emails[user.Email] = true
+		labels := map[string]bool{}
+		for _, key := range user.Keys {
+			name := user.Email + "/" + key.Label
+			if key.Label == "" || labels[key.Label] {
+				return fmt.Errorf("%w: key %q is empty or listed twice", ErrInvalidState, name)
+			}
+			labels[key.Label] = true
+			if key.ServiceKey && len(key.Quotas) > 0 {
+				return fmt.Errorf("%w: key %s is a service key, it has no quota", ErrInvalidState, name)
+			}
+			for service, quota := range key.Quotas {
+				if quota < 0 {
+					return fmt.Errorf("%w: key %s has a negative %s quota", ErrInvalidState, name, service)
+				}
+			}
+			if _, err := tollgate.ParseRestrictions(key.AllowedCIDRs, key.AllowedOrigins); err != nil {
+				return fmt.Errorf("%w: key %s: %w", ErrInvalidState, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// stateApply is the application of a state in a transaction.
+type stateApply struct {
+	qtx      *dbsqlc.Queries
+	plan     *Plan
+	dryRun   bool
+	services map[string]*dbsqlc.Services
+}
+
+func (a *stateApply) change(action, resource, name, detail string) {
+	a.plan.Changes = append(a.plan.Changes, Change{Action: action, Resource: resource, Name: name, Detail: detail})
+}
+
+func (a *stateApply) applyServices(ctx context.Context, services []ServiceState) error {
+	current, err := a.qtx.ListServices(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list services: %w", err)
+	}
+	a.services = map[string]*dbsqlc.Services{}
+	for _, service := range current {
+		a.services[service.Name] = service
+	}
+	for _, service := range services {
+		existing, ok := a.services[service.Name]
+		if !ok {
+			created, err := a.qtx.CreateService(ctx, &dbsqlc.CreateServiceParams{Name: service.Name, DefaultQuota: service.DefaultQuota})
+			if err != nil {
+				return fmt.Errorf("failed to create service %s: %w", service.Name, err)
+			}
+			a.services[service.Name] = created
+			a.change("create", "service", service.Name, fmt.Sprintf("default_quota %d", service.DefaultQuota))
+			continue
+		}
+		if existing.DefaultQuota != service.DefaultQuota {
+			if err := a.qtx.SetServiceDefaultQuota(ctx, &dbsqlc.SetServiceDefaultQuotaParams{ID: existing.ID, DefaultQuota: service.DefaultQuota}); err != nil {
+				return fmt.Errorf("failed to set default quota of %s: %w", service.Name, err)
+			}
+			a.change("update", "service", service.Name, fmt.Sprintf("default_quota %d -> %d", existing.DefaultQuota, service.DefaultQuota))
+			existing.DefaultQuota = service.DefaultQuota
+		}
+	}
+	return nil
+}
+
+func (a *stateApply) applyUser(ctx context.Context, user UserState, prune bool) error {
+	record, err := a.qtx.GetUserByEmail(ctx, user.Email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		record, err = a.qtx.CreateUser(ctx, user.Email)
+		if err != nil {
+			return fmt.Errorf("failed to create user %s: %w", user.Email, err)
+		}
+		a.change("create", "user", user.Email, "")
+	} else if err != nil {
+		return fmt.Errorf("failed to get user %s: %w", user.Email, err)
+	}
+
+	keys, err := a.qtx.GetAPIKeysByUserID(ctx, record.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get keys of %s: %w", user.Email, err)
+	}
+	labeled := map[string]*dbsqlc.ApiKeys{}
+	for _, key := range keys {
+		if key.Label.Valid {
+			labeled[key.Label.String] = key
+		}
+	}
+
+	for _, key := range user.Keys {
+		name := user.Email + "/" + key.Label
+		existing, ok := labeled[key.Label]
+		delete(labeled, key.Label)
+		if !ok {
+			if err := a.createKey(ctx, record.ID, name, key); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := a.updateKey(ctx, existing, name, key); err != nil {
+			return err
+		}
+	}
+
+	if prune {
+		for label, key := range labeled {
+			if key.Status == "revoked" {
+				continue
+			}
+			if err := a.setStatus(ctx, key, "revoked"); err != nil {
+				return err
+			}
+			a.change("revoke", "key", user.Email+"/"+label, "missing from the state")
+		}
+	}
+	return nil
+}
+
+func (a *stateApply) createKey(ctx context.Context, userID int64, name string, key KeyState) error {
+	for service := range key.Quotas {
+		if _, ok := a.services[service]; !ok {
+			return fmt.Errorf("%w: key %s has a quota for the unknown service %s", ErrInvalidState, name, service)
+		}
+	}
+	prefix := UserKeyPrefix
+	if key.ServiceKey {
+		prefix = ServiceKeyPrefix
+	}
+	keyString, err := generateKey(prefix)
+	if err != nil {
+		return err
+	}
+	record, err := a.qtx.CreateLabeledAPIKey(ctx, &dbsqlc.CreateLabeledAPIKeyParams{
+		UserID:    userID,
+		KeyString: keyString,
+		HasQuota:  !key.ServiceKey,
+		Label:     pgtype.Text{String: key.Label, Valid: true},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create key %s: %w", name, err)
+	}
+	if err := a.qtx.CreateStatusEvent(ctx, &dbsqlc.CreateStatusEventParams{ApiKeyID: record.ID, Status: record.Status}); err != nil {
+		return fmt.Errorf("failed to record status of %s: %w", name, err)
+	}
+	change := Change{Action: "create", Resource: "key", Name: name}
+	if !a.dryRun {
+		change.KeyString = keyString
+	}
+	a.plan.Changes = append(a.plan.Changes, change)
+
+	if key.Revoked {
+		if err := a.setStatus(ctx, record, "revoked"); err != nil {
+			return err
+		}
+	}
+	if len(key.AllowedCIDRs) > 0 || len(key.AllowedOrigins) > 0 {
+		if err := a.setRestrictions(ctx, record, name, key); err != nil {
+			return err
+		}
+	}
+	if key.ServiceKey {
+		return nil
+	}
+	for _, service := range slices.Sorted(maps.Keys(a.services)) {
+		quota, ok := key.Quotas[service]
+		if !ok {
+			quota = a.services[service].DefaultQuota
+		}
+		if err := a.setQuota(ctx, record.ID, name, service, quota, "", false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *stateApply) updateKey(ctx context.Context, existing *dbsqlc.ApiKeys, name string, key KeyState) error {
+	if existing.HasQuota == key.ServiceKey {
+		return fmt.Errorf("%w: key %s can't become a service key or stop being one, revoke it and use a new label", ErrInvalidState, name)
+	}
+
+	switch {
+	case key.Revoked && existing.Status != "revoked":
+		if err := a.setStatus(ctx, existing, "revoked"); err != nil {
+			return err
+		}
+		a.change("revoke", "key", name, "")
+	case !key.Revoked && existing.Status == "revoked":
+		if err := a.setStatus(ctx, existing, "assigned"); err != nil {
+			return err
+		}
+		a.change("update", "key", name, "status revoked -> assigned")
+	}
+
+	if !slices.Equal(existing.AllowedCidrs, nilIfEmpty(key.AllowedCIDRs)) || !slices.Equal(existing.AllowedOrigins, nilIfEmpty(key.AllowedOrigins)) {
+		if err := a.setRestrictions(ctx, existing, name, key); err != nil {
+			return err
+		}
+		a.change("update", "key", name, "restrictions")
+	}
+
+	if len(key.Quotas) == 0 {
+		return nil
+	}
+	quotas, err := a.qtx.GetAPIKeyQuotas(ctx, existing.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get quotas of %s: %w", name, err)
+	}
+	current := map[string]int32{}
+	for _, quota := range quotas {
+		current[quota.ServiceName] = quota.InitialQuota
+	}
+	for _, service := range slices.Sorted(maps.Keys(key.Quotas)) {
+		initial, ok := current[service]
+		if ok && initial == key.Quotas[service] {
+			continue
+		}
+		detail := fmt.Sprintf("%d", key.Quotas[service])
+		if ok {
+			detail = fmt.Sprintf("%d -> %d", initial, key.Quotas[service])
+		}
+		if err := a.setQuota(ctx, existing.ID, name, service, key.Quotas[service], detail, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *stateApply) setStatus(ctx context.Context, key *dbsqlc.ApiKeys, status string) error {
+	if _, err := a.qtx.UpdateAPIKeyStatus(ctx, &dbsqlc.UpdateAPIKeyStatusParams{ID: key.ID, Status: status}); err != nil {
+		return fmt.Errorf("failed to set status of key %d: %w", key.ID, err)
+	}
+	if err := a.qtx.CreateStatusEvent(ctx, &dbsqlc.CreateStatusEventParams{ApiKeyID: key.ID, Status: status}); err != nil {
+		return fmt.Errorf("failed to record status of key %d: %w", key.ID, err)
+	}
+	return nil
+}
+
+func (a *stateApply) setRestrictions(ctx context.Context, key *dbsqlc.ApiKeys, name string, state KeyState) error {
+	_, err := a.qtx.SetAPIKeyRestrictions(ctx, &dbsqlc.SetAPIKeyRestrictionsParams{
+		KeyString:      key.KeyString,
+		AllowedCidrs:   nilIfEmpty(state.AllowedCIDRs),
+		AllowedOrigins: nilIfEmpty(state.AllowedOrigins),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set restrictions of %s: %w", name, err)
+	}
+	return nil
+}
+
+// setQuota sets the initial quota of a key for a service, planned as a change
+// when planned is set, quotas of new keys are part of their creation.
+func (a *stateApply) setQuota(ctx context.Context, apiKeyID int64, name, service string, quota int32, detail string, planned bool) error {
+	record, ok := a.services[service]
+	if !ok {
+		return fmt.Errorf("%w: key %s has a quota for the unknown service %s", ErrInvalidState, name, service)
+	}
+	err := a.qtx.SetKeyServiceQuota(ctx, &dbsqlc.SetKeyServiceQuotaParams{ApiKeyID: apiKeyID, ServiceID: record.ID, InitialQuota: quota})
+	if err != nil {
+		return fmt.Errorf("failed to set %s quota of %s: %w", service, name, err)
+	}
+	if planned {
+		a.change("update", "quota", name+"/"+service, detail)
+	}
+	return nil
+}
+
+// nilIfEmpty stores empty lists as NULL, nothing is restricted.
+func nilIfEmpty(values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
@@ -0,0 +1,302 @@
+// Package admin provides administrative operations for user and API key management.
+package admin
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// TrialSettings are the quota and lifetime of trial keys
+type TrialSettings struct {
+	// Quota is the initial quota of trial keys on every service
+	Quota int32
+	// Duration is how long trial keys work once the email is verified
+	Duration time.Duration
+}
+
+const (
+	// trialTokenTTL is how long a verification link stays valid
+	trialTokenTTL = 24 * time.Hour
+	// maxTrialSignupsPerDay caps the verification emails sent to an address
+	maxTrialSignupsPerDay = 3
+)
+
+var (
+	// ErrUserExists is returned when signing up an email that already has a user
+	ErrUserExists = errors.New("user already exists")
+	// ErrTooManySignups is returned when an email signed up too often lately
+	ErrTooManySignups = errors.New("too many signups, try again later")
+	// ErrInvalidToken is returned for unknown, used or expired verification tokens
+	ErrInvalidToken = errors.New("invalid or expired verification token")
+	// ErrNotTrialKey is returned when converting a key that isn't a trial key
+	ErrNotTrialKey = errors.New("not a trial key")
+)
+
+// hashToken is how verification tokens are stored, a leaked table can't verify signups
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RequestTrial records a trial signup for an email, and returns the token of
+// its verification link. Nothing is created until the token is verified.
+func (as *AdminService) RequestTrial(ctx context.Context, email string) (string, error) {
+	_, err := as.queries.GetUserByEmail(ctx, email)
+	if err == nil {
+		return "", fmt.Errorf("user with email %s: %w", email, ErrUserExists)
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return "", fmt.Errorf("failed to get user: %w", err)
+	}
+
+	count, err := as.queries.CountTrialSignupsSince(ctx, &dbsqlc.CountTrialSignupsSinceParams{
+		Email:     email,
+		CreatedAt: pgtype.Timestamptz{Time: time.Now().Add(-24 * time.Hour), Valid: true},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to count signups: %w", err)
+	}
+	if count >= maxTrialSignupsPerDay {
+		return "", ErrTooManySignups
+	}
+
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	}
+	token := hex.EncodeToString(bytes)
+
+	_, err = as.queries.CreateTrialSignup(ctx, &dbsqlc.CreateTrialSignupParams{
+		Email:     email,
+		TokenHash: hashToken(token),
+		ExpiresAt: pgtype.Timestamptz{Time: time.Now().Add(trialTokenTTL), Valid: true},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create signup: %w", err)
+	}
+	return token, nil
+}
+
+// VerifyTrial verifies the token of a signup, and creates its user with a
+// trial key. The key has settings.Quota on every service and stops working
+// after settings.Duration.
+func (as *AdminService) VerifyTrial(ctx context.Context, token string, settings TrialSettings) (*InviteNewUserResult, error) {
+	// Start transaction
+	tx, err := as.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+			// Rollback errors are typically expected after successful commits
+			_ = rollbackErr // Acknowledge but don't propagate rollback errors
+		}
+	}()
+
+	// Create queries with transaction context
+	qtx := as.queries.WithTx(tx)
+
+	signup, err := qtx.VerifyTrialSignup(ctx, hashToken(token))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrInvalidToken
+		}
+		return nil, fmt.Errorf("failed to verify signup: %w", err)
+	}
+
+	// the email may have been invited since the signup
+	_, err = qtx.GetUserByEmail(ctx, signup.Email)
+	if err == nil {
+		return nil, fmt.Errorf("user with email %s: %w", signup.Email, ErrUserExists)
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	user, err := qtx.CreateUser(ctx, signup.Email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	keyString, err := generateKey(UserKeyPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate API key: %w", err)
+	}
+	apiKey, err := qtx.CreateTrialAPIKey(ctx, &dbsqlc.CreateTrialAPIKeyParams{
+		UserID:    user.ID,
+		KeyString: keyString,
+		ExpiresAt: pgtype.Timestamptz{Time: time.Now().Add(settings.Duration), Valid: true},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create API key: %w", err)
+	}
+	if err := qtx.CreateStatusEvent(ctx, &dbsqlc.CreateStatusEventParams{ApiKeyID: apiKey.ID, Status: apiKey.Status}); err != nil {
+		return nil, fmt.Errorf("failed to record status event: %w", err)
+	}
+
+	services, err := qtx.GetAllServices(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get services: %w", err)
+	}
+	var initialQuotas []*ServiceQuota
+	for _, service := range services {
+		quota, err := qtx.InitializeKeyServiceQuota(ctx, &dbsqlc.InitializeKeyServiceQuotaParams{
+			ApiKeyID:     apiKey.ID,
+			ServiceID:    service.ID,
+			InitialQuota: settings.Quota,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize quota for service %s: %w", service.Name, err)
+		}
+		initialQuotas = append(initialQuotas, &ServiceQuota{
+			ServiceName:    service.Name,
+			InitialQuota:   quota.InitialQuota,
+			RemainingQuota: quota.RemainingQuota,
+		})
+	}
+
+	// Commit transaction
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return &InviteNewUserResult{
+		User: &User{
+			ID:        user.ID,
+			Email:     user.Email,
+			CreatedAt: user.CreatedAt.Time,
+		},
+		APIKey:        toAPIKey(apiKey),
+		InitialQuotas: initialQuotas,
+	}, nil
+}
+
+// ConvertTrial turns a trial key, expired or not, into a full key with the
+// default quotas of the services. The key string is kept, so the user doesn't
+// have to change anything.
+func (as *AdminService) ConvertTrial(ctx context.Context, keyString string) (*APIKeyInfo, error) {
+	// Start transaction
+	tx, err := as.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+			// Rollback errors are typically expected after successful commits
+			_ = rollbackErr // Acknowledge but don't propagate rollback errors
+		}
+	}()
+
+	// Create queries with transaction context
+	qtx := as.queries.WithTx(tx)
+
+	apiKey, err := qtx.ConvertTrialKey(ctx, keyString)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrNotTrialKey
+		}
+		return nil, fmt.Errorf("failed to convert API key: %w", err)
+	}
+	if err := qtx.CreateStatusEvent(ctx, &dbsqlc.CreateStatusEventParams{ApiKeyID: apiKey.ID, Status: apiKey.Status}); err != nil {
+		return nil, fmt.Errorf("failed to record status event: %w", err)
+	}
+
+	services, err := qtx.GetAllServices(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get services: %w", err)
+	}
+	var serviceQuotas []*ServiceQuota
+	for _, service := range services {
+		// Get service details to access default quota
+		serviceDetails, err := qtx.GetServiceByName(ctx, service.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get service details for %s: %w", service.Name, err)
+		}
+		quota, err := qtx.InitializeKeyServiceQuota(ctx, &dbsqlc.InitializeKeyServiceQuotaParams{
+			ApiKeyID:     apiKey.ID,
+			ServiceID:    service.ID,
+			InitialQuota: serviceDetails.DefaultQuota,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize quota for service %s: %w", service.Name, err)
+		}
+		serviceQuotas = append(serviceQuotas, &ServiceQuota{
+			ServiceName:    service.Name,
+			InitialQuota:   quota.InitialQuota,
+			RemainingQuota: quota.RemainingQuota,
+		})
+	}
+
+	// Commit transaction
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return &APIKeyInfo{APIKey: toAPIKey(apiKey), ServiceQuotas: serviceQuotas}, nil
+}
+
+// ExpireTrials marks the trial keys past their expiry as expired, and returns
+// them. The quota queries already reject them, this keeps their status and
+// history right.
+func (as *AdminService) ExpireTrials(ctx context.Context) ([]*APIKey, error) {
+	// Start transaction
+	tx, err := as.db.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer func() {
+		if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+			// Rollback errors are typically expected after successful commits
+			_ = rollbackErr // Acknowledge but don't propagate rollback errors
+		}
+	}()
+
+	// Create queries with transaction context
+	qtx := as.queries.WithTx(tx)
+
+	expired, err := qtx.ExpireTrialKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to expire trial keys: %w", err)
+	}
+	apiKeys := make([]*APIKey, 0, len(expired))
+	for _, apiKey := range expired {
+		if err := qtx.CreateStatusEvent(ctx, &dbsqlc.CreateStatusEventParams{ApiKeyID: apiKey.ID, Status: apiKey.Status}); err != nil {
+			return nil, fmt.Errorf("failed to record status event: %w", err)
+		}
+		apiKeys = append(apiKeys, toAPIKey(apiKey))
+	}
+
+	// Commit transaction
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return apiKeys, nil
+}
+
+// toAPIKey maps a dbsqlc key to the domain model
+func toAPIKey(apiKey *dbsqlc.ApiKeys) *APIKey {
+	key := &APIKey{
+		ID:        apiKey.ID,
+		KeyString: apiKey.KeyString,
+		Status:    apiKey.Status,
+		CreatedAt: apiKey.CreatedAt.Time,
+
+		AllowedCIDRs:   apiKey.AllowedCidrs,
+		AllowedOrigins: apiKey.AllowedOrigins,
+	}
+	if apiKey.ExpiresAt.Valid {
+		key.ExpiresAt = &apiKey.ExpiresAt.Time
+	}
+	return key
+}
@@ -0,0 +1,120 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// testPostgres returns a connection to a fresh schema with dbsqlc.Schema in
+// the disposable Postgres the admin tests run against, e.g.
+// TEST_POSTGRES_URL=postgres://postgres@localhost:5432/postgres.
+func testPostgres(t *testing.T) *pgx.Conn {
+	t.Helper()
+	base := os.Getenv("TEST_POSTGRES_URL")
+	if base == "" {
+		t.Skip("TEST_POSTGRES_URL is not set")
+	}
+	ctx := context.Background()
+	db, err := pgx.Connect(ctx, base)
+	if err != nil {
+		t.Fatalf("pgx.Connect: %v", err)
+	}
+	defer db.Close(ctx)
+	schema := fmt.Sprintf("admin_test_%d", time.Now().UnixNano())
+	if _, err := db.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatalf("CREATE SCHEMA: %v", err)
+	}
+	t.Cleanup(func() {
+		db, err := pgx.Connect(context.Background(), base)
+		if err != nil {
+			return
+		}
+		defer db.Close(context.Background())
+		_, _ = db.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE")
+	})
+
+	u, err := url.Parse(base)
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	conn, err := pgx.Connect(ctx, u.String())
+	if err != nil {
+		t.Fatalf("pgx.Connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close(context.Background()) })
+	if _, err := conn.Exec(ctx, dbsqlc.Schema); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	return conn
+}
+
+func TestTrialSignupOnce(t *testing.T) {
+	db := testPostgres(t)
+	ctx := context.Background()
+	if _, err := db.Exec(ctx, `INSERT INTO services (name) VALUES ('jina')`); err != nil {
+		t.Fatalf("services: %v", err)
+	}
+	as := NewAdminService(db)
+	settings := TrialSettings{Quota: 100, Duration: 14 * 24 * time.Hour}
+
+	// two signups pending for an address, e.g. the first email was lost
+	first, err := as.RequestTrial(ctx, "trial@example.com")
+	if err != nil {
+		t.Fatalf("RequestTrial: %v", err)
+	}
+	second, err := as.RequestTrial(ctx, "trial@example.com")
+	if err != nil {
+		t.Fatalf("RequestTrial again before the verification: %v", err)
+	}
+
+	result, err := as.VerifyTrial(ctx, first, settings)
+	if err != nil {
+		t.Fatalf("VerifyTrial: %v", err)
+	}
+	if result.APIKey.Status != "trial" || result.APIKey.ExpiresAt == nil || len(result.InitialQuotas) != 1 || result.InitialQuotas[0].InitialQuota != 100 {
+		t.Errorf("trial key %+v with quotas %+v", result.APIKey, result.InitialQuotas)
+	}
+
+	// the address has a user, it doesn't get another trial
+	if _, err := as.RequestTrial(ctx, "trial@example.com"); !errors.Is(err, ErrUserExists) {
+		t.Errorf("RequestTrial of a user = %v, want ErrUserExists", err)
+	}
+	if _, err := as.VerifyTrial(ctx, second, settings); !errors.Is(err, ErrUserExists) {
+		t.Errorf("VerifyTrial of the other pending signup = %v, want ErrUserExists", err)
+	}
+	if _, err := as.VerifyTrial(ctx, first, settings); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("VerifyTrial of a used token = %v, want ErrInvalidToken", err)
+	}
+	var users, keys int
+	if err := db.QueryRow(ctx, `SELECT (SELECT count(*) FROM users), (SELECT count(*) FROM api_keys)`).Scan(&users, &keys); err != nil {
+		t.Fatal(err)
+	}
+	if users != 1 || keys != 1 {
+		t.Errorf("%d users and %d keys, want 1 of each", users, keys)
+	}
+}
+
+func TestTrialSignupsAreCapped(t *testing.T) {
+	as := NewAdminService(testPostgres(t))
+	ctx := context.Background()
+	for range maxTrialSignupsPerDay {
+		if _, err := as.RequestTrial(ctx, "eager@example.com"); err != nil {
+			t.Fatalf("RequestTrial: %v", err)
+		}
+	}
+	if _, err := as.RequestTrial(ctx, "eager@example.com"); !errors.Is(err, ErrTooManySignups) {
+		t.Errorf("RequestTrial past the cap = %v, want ErrTooManySignups", err)
+	}
+}
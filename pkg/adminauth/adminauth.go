@@ -0,0 +1,43 @@
+// Package adminauth guards the admin endpoints with the X-Admin-Key header.
+// The admin routes are wrapped once with HTTPHandlerMiddleware, the handlers
+// serving both the admin and the key owners check Valid themselves.
+package adminauth
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// Header carries the admin key.
+const Header = "X-Admin-Key"
+
+// Valid reports whether r carries adminKey, in constant time. No request is
+// valid without an admin key.
+func Valid(r *http.Request, adminKey string) bool {
+	if adminKey == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(Header)), []byte(adminKey)) == 1
+}
+
+// Guard answers 401 to the requests without the admin key.
+type Guard struct {
+	adminKey string
+}
+
+// New creates a new Guard of adminKey, it refuses everything when adminKey is
+// empty.
+func New(adminKey string) *Guard {
+	return &Guard{adminKey: adminKey}
+}
+
+// HTTPHandlerMiddleware serves the requests carrying the admin key with next.
+func (g *Guard) HTTPHandlerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !Valid(r, g.adminKey) {
+			http.Error(w, "Invalid admin credentials", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
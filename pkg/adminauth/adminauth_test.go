@@ -0,0 +1,32 @@
+package adminauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGuard(t *testing.T) {
+	for _, tt := range []struct {
+		name, adminKey, header string
+		want                   int
+	}{
+		{"the admin key", "admin-secret", "admin-secret", http.StatusOK},
+		{"another key", "admin-secret", "admin-secre", http.StatusUnauthorized},
+		{"no key", "admin-secret", "", http.StatusUnauthorized},
+		{"no admin key set", "", "", http.StatusUnauthorized},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := New(tt.adminKey).HTTPHandlerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			req := httptest.NewRequest(http.MethodGet, "/admin/slo", nil)
+			if tt.header != "" {
+				req.Header.Set(Header, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("got %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
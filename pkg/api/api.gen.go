@@ -19,13 +19,33 @@ const (
 
 // ApiKey defines model for ApiKey.
 type ApiKey struct {
-	CreatedAt time.Time `json:"created_at"`
-	HasQuota  bool      `json:"has_quota"`
-	Id        int64     `json:"id"`
-	KeyString string    `json:"key_string"`
-	Status    string    `json:"status"`
-	UpdatedAt time.Time `json:"updated_at"`
-	UserId    int64     `json:"user_id"`
+	// AllowedCidrs Client networks the key works from, anywhere when unset
+	AllowedCidrs *[]string `json:"allowed_cidrs,omitempty"`
+
+	// AllowedOrigins Web origins the key works from, anywhere when unset
+	AllowedOrigins *[]string `json:"allowed_origins,omitempty"`
+	CreatedAt      time.Time `json:"created_at"`
+
+	// ExpiresAt Set on trial keys, they stop working at this time
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	HasQuota  bool       `json:"has_quota"`
+	Id        int64      `json:"id"`
+	KeyString string     `json:"key_string"`
+	Status    string     `json:"status"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	UserId    int64      `json:"user_id"`
+}
+
+// ConvertTrialKeyRequest defines model for ConvertTrialKeyRequest.
+type ConvertTrialKeyRequest struct {
+	KeyString string `json:"key_string"`
+}
+
+// ConvertTrialKeyResponse defines model for ConvertTrialKeyResponse.
+type ConvertTrialKeyResponse struct {
+	ApiKey        string         `json:"api_key"`
+	ServiceQuotas []ServiceQuota `json:"service_quotas"`
+	Status        string         `json:"status"`
 }
 
 // CreateApiKeyRequest defines model for CreateApiKeyRequest.
@@ -53,6 +73,32 @@ type ErrorResponse struct {
 	Traces []string `json:"traces"`
 }
 
+// KeyRestrictions defines model for KeyRestrictions.
+type KeyRestrictions struct {
+	// AllowedCidrs Client networks the key works from, a single address is a network of its own
+	AllowedCidrs *[]string `json:"allowed_cidrs,omitempty"`
+
+	// AllowedOrigins Web origins the key works from, read from the Origin or Referer header. "https://*.example.com" allows the subdomains.
+	AllowedOrigins *[]string `json:"allowed_origins,omitempty"`
+	KeyString      string    `json:"key_string"`
+}
+
+// KeyState defines model for KeyState.
+type KeyState struct {
+	AllowedCidrs   *[]string `json:"allowed_cidrs,omitempty"`
+	AllowedOrigins *[]string `json:"allowed_origins,omitempty"`
+
+	// Label Name of the key, unique among the keys of its user
+	Label string `json:"label"`
+
+	// Quotas Initial quotas by service, the services missing get their default quota when the key is created and are left alone after. Changes move the remaining quota by as much.
+	Quotas  *map[string]int `json:"quotas,omitempty"`
+	Revoked *bool           `json:"revoked,omitempty"`
+
+	// ServiceKey Service keys have no quota, it can't change once the key exists
+	ServiceKey *bool `json:"service_key,omitempty"`
+}
+
 // Pong defines model for Pong.
 type Pong struct {
 	Ping string `json:"ping"`
@@ -65,6 +111,44 @@ type ServiceQuota struct {
 	ServiceName    string `json:"service_name"`
 }
 
+// ServiceState defines model for ServiceState.
+type ServiceState struct {
+	// DefaultQuota Quota new keys get for the service
+	DefaultQuota int    `json:"default_quota"`
+	Name         string `json:"name"`
+}
+
+// State defines model for State.
+type State struct {
+	// DryRun Return the plan without applying it
+	DryRun *bool `json:"dry_run,omitempty"`
+
+	// Prune Revoke the labeled keys of the listed users missing from the document
+	Prune    *bool           `json:"prune,omitempty"`
+	Services *[]ServiceState `json:"services,omitempty"`
+	Users    *[]UserState    `json:"users,omitempty"`
+}
+
+// StateChange defines model for StateChange.
+type StateChange struct {
+	// Action create, update or revoke
+	Action string  `json:"action"`
+	Detail *string `json:"detail,omitempty"`
+
+	// KeyString Set on the creation of a key, returned this once
+	KeyString *string `json:"key_string,omitempty"`
+	Name      string  `json:"name"`
+
+	// Resource service, user, key or quota
+	Resource string `json:"resource"`
+}
+
+// StatePlan defines model for StatePlan.
+type StatePlan struct {
+	Applied bool          `json:"applied"`
+	Changes []StateChange `json:"changes"`
+}
+
 // User defines model for User.
 type User struct {
 	CreatedAt time.Time           `json:"created_at"`
@@ -72,9 +156,24 @@ type User struct {
 	Id        int64               `json:"id"`
 }
 
+// UserState defines model for UserState.
+type UserState struct {
+	Email string      `json:"email"`
+	Keys  *[]KeyState `json:"keys,omitempty"`
+}
+
 // PostAdminKeysJSONRequestBody defines body for PostAdminKeys for application/json ContentType.
 type PostAdminKeysJSONRequestBody = CreateApiKeyRequest
 
+// PostAdminKeysConvertJSONRequestBody defines body for PostAdminKeysConvert for application/json ContentType.
+type PostAdminKeysConvertJSONRequestBody = ConvertTrialKeyRequest
+
+// PutAdminKeysRestrictionsJSONRequestBody defines body for PutAdminKeysRestrictions for application/json ContentType.
+type PutAdminKeysRestrictionsJSONRequestBody = KeyRestrictions
+
+// PutAdminStateJSONRequestBody defines body for PutAdminState for application/json ContentType.
+type PutAdminStateJSONRequestBody = State
+
 // PostAdminUsersJSONRequestBody defines body for PostAdminUsers for application/json ContentType.
 type PostAdminUsersJSONRequestBody = CreateUserRequest
 
@@ -86,6 +185,15 @@ type ServerInterface interface {
 	// Create a new API key
 	// (POST /admin/keys)
 	PostAdminKeys(w http.ResponseWriter, r *http.Request)
+	// Convert a trial key into a full key
+	// (POST /admin/keys/convert)
+	PostAdminKeysConvert(w http.ResponseWriter, r *http.Request)
+	// Restrict where a key works from
+	// (PUT /admin/keys/restrictions)
+	PutAdminKeysRestrictions(w http.ResponseWriter, r *http.Request)
+	// Apply a declarative state
+	// (PUT /admin/state)
+	PutAdminState(w http.ResponseWriter, r *http.Request)
 	// List all users
 	// (GET /admin/users)
 	GetAdminUsers(w http.ResponseWriter, r *http.Request)
@@ -113,6 +221,24 @@ func (_ Unimplemented) PostAdminKeys(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNotImplemented)
 }
 
+// Convert a trial key into a full key
+// (POST /admin/keys/convert)
+func (_ Unimplemented) PostAdminKeysConvert(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNotImplemented)
+}
+
+// Restrict where a key works from
+// (PUT /admin/keys/restrictions)
+func (_ Unimplemented) PutAdminKeysRestrictions(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNotImplemented)
+}
+
+// Apply a declarative state
+// (PUT /admin/state)
+func (_ Unimplemented) PutAdminState(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNotImplemented)
+}
+
 // List all users
 // (GET /admin/users)
 func (_ Unimplemented) GetAdminUsers(w http.ResponseWriter, r *http.Request) {
@@ -179,6 +305,66 @@ func (siw *ServerInterfaceWrapper) PostAdminKeys(w http.ResponseWriter, r *http.
 	handler.ServeHTTP(w, r)
 }
 
+// PostAdminKeysConvert operation middleware
+func (siw *ServerInterfaceWrapper) PostAdminKeysConvert(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, ApiKeyAuthScopes, []string{})
+
+	r = r.WithContext(ctx)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PostAdminKeysConvert(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r)
+}
+
+// PutAdminKeysRestrictions operation middleware
+func (siw *ServerInterfaceWrapper) PutAdminKeysRestrictions(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, ApiKeyAuthScopes, []string{})
+
+	r = r.WithContext(ctx)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PutAdminKeysRestrictions(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r)
+}
+
+// PutAdminState operation middleware
+func (siw *ServerInterfaceWrapper) PutAdminState(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	ctx = context.WithValue(ctx, ApiKeyAuthScopes, []string{})
+
+	r = r.WithContext(ctx)
+
+	handler := http.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		siw.Handler.PutAdminState(w, r)
+	}))
+
+	for _, middleware := range siw.HandlerMiddlewares {
+		handler = middleware(handler)
+	}
+
+	handler.ServeHTTP(w, r)
+}
+
 // GetAdminUsers operation middleware
 func (siw *ServerInterfaceWrapper) GetAdminUsers(w http.ResponseWriter, r *http.Request) {
 
@@ -352,6 +538,15 @@ func HandlerWithOptions(si ServerInterface, options ChiServerOptions) http.Handl
 	r.Group(func(r chi.Router) {
 		r.Post(options.BaseURL+"/admin/keys", wrapper.PostAdminKeys)
 	})
+	r.Group(func(r chi.Router) {
+		r.Post(options.BaseURL+"/admin/keys/convert", wrapper.PostAdminKeysConvert)
+	})
+	r.Group(func(r chi.Router) {
+		r.Put(options.BaseURL+"/admin/keys/restrictions", wrapper.PutAdminKeysRestrictions)
+	})
+	r.Group(func(r chi.Router) {
+		r.Put(options.BaseURL+"/admin/state", wrapper.PutAdminState)
+	})
 	r.Group(func(r chi.Router) {
 		r.Get(options.BaseURL+"/admin/users", wrapper.GetAdminUsers)
 	})
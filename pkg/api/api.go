@@ -3,9 +3,13 @@ package api
 import (
 	"embed"
 	"encoding/json"
-	"httpcache/pkg/admin"
-	"httpcache/pkg/dbsqlc"
+	"errors"
+	"fmt"
+	"github.com/Airren/poorman-httpcache/v2/pkg/admin"
+	"github.com/Airren/poorman-httpcache/v2/pkg/adminauth"
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
 	"log/slog"
+	"math"
 	"net/http"
 
 	"github.com/jackc/pgx/v5"
@@ -73,7 +77,7 @@ func (s *Server) validateAdminKey(w http.ResponseWriter, r *http.Request) bool {
 		return false
 	}
 
-	if adminKey != s.adminKey {
+	if !adminauth.Valid(r, s.adminKey) {
 		s.writeJSONError(w, http.StatusUnauthorized, "Invalid admin credentials", []string{"X-Admin-Key header value is invalid"})
 		return false
 	}
@@ -183,6 +187,15 @@ func (s *Server) GetAdminKeys(w http.ResponseWriter, r *http.Request) {
 			CreatedAt: dbKey.CreatedAt.Time,
 			UpdatedAt: dbKey.UpdatedAt.Time,
 		}
+		if dbKey.ExpiresAt.Valid {
+			apiKey.ExpiresAt = &dbKey.ExpiresAt.Time
+		}
+		if dbKey.AllowedCidrs != nil {
+			apiKey.AllowedCidrs = &dbKey.AllowedCidrs
+		}
+		if dbKey.AllowedOrigins != nil {
+			apiKey.AllowedOrigins = &dbKey.AllowedOrigins
+		}
 		apiKeys = append(apiKeys, apiKey)
 	}
 
@@ -234,6 +247,197 @@ func (s *Server) PostAdminKeys(w http.ResponseWriter, r *http.Request) {
 	s.writeJSONResponse(w, http.StatusCreated, response)
 }
 
+// PostAdminKeysConvert handles POST /admin/keys/convert - Convert a trial key into a full key
+func (s *Server) PostAdminKeysConvert(w http.ResponseWriter, r *http.Request) {
+	// Validate admin authentication
+	if !s.validateAdminKey(w, r) {
+		return
+	}
+
+	ctx := r.Context()
+
+	// Parse request body
+	var req ConvertTrialKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, "Invalid request body", []string{err.Error()})
+		return
+	}
+	if req.KeyString == "" {
+		s.writeJSONError(w, http.StatusBadRequest, "Invalid request body", []string{"key_string is required"})
+		return
+	}
+
+	// Convert the key, keeping its key string
+	result, err := s.adminService.ConvertTrial(ctx, req.KeyString)
+	if errors.Is(err, admin.ErrNotTrialKey) {
+		s.writeJSONError(w, http.StatusNotFound, "Trial key not found", []string{err.Error()})
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to convert trial key", "error", err)
+		s.writeJSONError(w, http.StatusInternalServerError, "Failed to convert trial key", []string{err.Error()})
+		return
+	}
+
+	// Convert service quotas to API format
+	var serviceQuotas []ServiceQuota
+	for _, sq := range result.ServiceQuotas {
+		serviceQuotas = append(serviceQuotas, ServiceQuota{
+			ServiceName:    sq.ServiceName,
+			InitialQuota:   int(sq.InitialQuota),
+			RemainingQuota: int(sq.RemainingQuota),
+		})
+	}
+
+	s.writeJSONResponse(w, http.StatusOK, ConvertTrialKeyResponse{
+		ApiKey:        result.APIKey.KeyString,
+		Status:        result.APIKey.Status,
+		ServiceQuotas: serviceQuotas,
+	})
+}
+
+// PutAdminKeysRestrictions handles PUT /admin/keys/restrictions - Restrict where a key works from
+func (s *Server) PutAdminKeysRestrictions(w http.ResponseWriter, r *http.Request) {
+	// Validate admin authentication
+	if !s.validateAdminKey(w, r) {
+		return
+	}
+
+	ctx := r.Context()
+
+	// Parse request body
+	var req KeyRestrictions
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, "Invalid request body", []string{err.Error()})
+		return
+	}
+	if req.KeyString == "" {
+		s.writeJSONError(w, http.StatusBadRequest, "Invalid request body", []string{"key_string is required"})
+		return
+	}
+	var cidrs, origins []string
+	if req.AllowedCidrs != nil {
+		cidrs = *req.AllowedCidrs
+	}
+	if req.AllowedOrigins != nil {
+		origins = *req.AllowedOrigins
+	}
+
+	result, err := s.adminService.SetKeyRestrictions(ctx, req.KeyString, cidrs, origins)
+	if errors.Is(err, admin.ErrInvalidRestrictions) {
+		s.writeJSONError(w, http.StatusBadRequest, "Invalid restrictions", []string{err.Error()})
+		return
+	}
+	if errors.Is(err, admin.ErrKeyNotFound) {
+		s.writeJSONError(w, http.StatusNotFound, "API key not found", []string{err.Error()})
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to set key restrictions", "error", err)
+		s.writeJSONError(w, http.StatusInternalServerError, "Failed to set key restrictions", []string{err.Error()})
+		return
+	}
+
+	response := KeyRestrictions{KeyString: result.KeyString}
+	if result.AllowedCIDRs != nil {
+		response.AllowedCidrs = &result.AllowedCIDRs
+	}
+	if result.AllowedOrigins != nil {
+		response.AllowedOrigins = &result.AllowedOrigins
+	}
+	s.writeJSONResponse(w, http.StatusOK, response)
+}
+
+// PutAdminState handles PUT /admin/state - Apply a declarative state
+func (s *Server) PutAdminState(w http.ResponseWriter, r *http.Request) {
+	// Validate admin authentication
+	if !s.validateAdminKey(w, r) {
+		return
+	}
+
+	ctx := r.Context()
+
+	// Parse request body
+	var req State
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, "Invalid request body", []string{err.Error()})
+		return
+	}
+
+	state, err := toAdminState(req)
+	if err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, "Invalid state", []string{err.Error()})
+		return
+	}
+	plan, err := s.adminService.ApplyState(ctx, state, deref(req.DryRun))
+	if errors.Is(err, admin.ErrInvalidState) {
+		s.writeJSONError(w, http.StatusBadRequest, "Invalid state", []string{err.Error()})
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to apply state", "error", err)
+		s.writeJSONError(w, http.StatusInternalServerError, "Failed to apply state", []string{err.Error()})
+		return
+	}
+
+	response := StatePlan{Applied: plan.Applied, Changes: make([]StateChange, 0, len(plan.Changes))}
+	for _, change := range plan.Changes {
+		item := StateChange{Action: change.Action, Resource: change.Resource, Name: change.Name}
+		if change.Detail != "" {
+			item.Detail = &change.Detail
+		}
+		if change.KeyString != "" {
+			item.KeyString = &change.KeyString
+		}
+		response.Changes = append(response.Changes, item)
+	}
+	s.writeJSONResponse(w, http.StatusOK, response)
+}
+
+// toAdminState converts a state document into the admin service one.
+func toAdminState(req State) (*admin.State, error) {
+	state := &admin.State{Prune: deref(req.Prune)}
+	for _, service := range deref(req.Services) {
+		if service.DefaultQuota > math.MaxInt32 {
+			return nil, fmt.Errorf("default quota of service %s is out of range", service.Name)
+		}
+		state.Services = append(state.Services, admin.ServiceState{Name: service.Name, DefaultQuota: int32(service.DefaultQuota)})
+	}
+	for _, user := range deref(req.Users) {
+		userState := admin.UserState{Email: user.Email}
+		for _, key := range deref(user.Keys) {
+			keyState := admin.KeyState{
+				Label:          key.Label,
+				ServiceKey:     deref(key.ServiceKey),
+				Revoked:        deref(key.Revoked),
+				AllowedCIDRs:   deref(key.AllowedCidrs),
+				AllowedOrigins: deref(key.AllowedOrigins),
+			}
+			if key.Quotas != nil {
+				keyState.Quotas = map[string]int32{}
+				for service, quota := range *key.Quotas {
+					if quota > math.MaxInt32 {
+						return nil, fmt.Errorf("%s quota of key %s/%s is out of range", service, user.Email, key.Label)
+					}
+					keyState.Quotas[service] = int32(quota)
+				}
+			}
+			userState.Keys = append(userState.Keys, keyState)
+		}
+		state.Users = append(state.Users, userState)
+	}
+	return state, nil
+}
+
+// deref returns the value of an optional field, its zero value when unset.
+func deref[T any](v *T) T {
+	if v == nil {
+		var zero T
+		return zero
+	}
+	return *v
+}
+
 // NewHandlerWithMiddleware creates a new HTTP handler with custom middleware
 func NewHandlerWithMiddleware(server *Server, middlewares ...MiddlewareFunc) http.Handler {
 	return HandlerWithOptions(server, ChiServerOptions{
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Versions are the versions of the admin API, served under /v1/, /v2/...
+// Breaking changes go to a new version while the old ones keep being served
+// to existing tooling, until their sunset.
+//
+// A version is served by the ServerInterface generated from its spec. v2 has
+// no breaking change yet and shares api.yaml with v1; the first breaking
+// change copies api.yaml to api.v2.yaml, generated into its own package with
+// a cfg.v2.yaml, and mounts that ServerInterface under /v2 instead.
+var Versions = []int{1, 2}
+
+// LatestVersion is the version new tooling should be written against.
+const LatestVersion = 2
+
+// VersionHeader negotiates the version of the unversioned routes, and tells
+// the version a response was served with.
+const VersionHeader = "X-API-Version"
+
+// VersionOptions are the deprecations of the admin API versions.
+type VersionOptions struct {
+	// Sunsets are the dates deprecated versions stop being served, a
+	// version without one isn't deprecated.
+	Sunsets map[int]time.Time
+	// UnversionedSunset is the date the routes without a version prefix,
+	// deprecated for all their clients, stop being served. Zero for none set yet.
+	UnversionedSunset time.Time
+}
+
+// Mount serves the admin API under a prefix per version and, for the tooling
+// written before versioning, without prefix. The unversioned routes serve
+// the version asked for in the X-API-Version header, v1 by default, and are
+// marked deprecated in favor of the versioned ones.
+func Mount(mux chi.Router, handlers map[int]http.Handler, opts VersionOptions) {
+	for _, version := range Versions {
+		mux.Mount(fmt.Sprintf("/v%d", version), versioned(version, handlers[version], opts.Sunsets[version]))
+	}
+	mux.Handle("/*", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := 1
+		if requested := r.Header.Get(VersionHeader); requested != "" {
+			n, err := strconv.Atoi(strings.TrimPrefix(strings.ToLower(requested), "v"))
+			if err != nil || handlers[n] == nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(ErrorResponse{
+					Code:   http.StatusBadRequest,
+					Msg:    "Unknown API version " + requested,
+					Traces: []string{fmt.Sprintf("supported versions: %v", Versions)},
+				})
+				return
+			}
+			version = n
+		}
+		// the earliest of the sunsets of the route and of the version applies
+		sunset := opts.UnversionedSunset
+		if s := opts.Sunsets[version]; !s.IsZero() && (sunset.IsZero() || s.Before(sunset)) {
+			sunset = s
+		}
+		w.Header().Set(VersionHeader, strconv.Itoa(version))
+		deprecate(w.Header(), fmt.Sprintf("/v%d%s", LatestVersion, r.URL.Path), sunset)
+		handlers[version].ServeHTTP(w, r)
+	}))
+}
+
+// versioned serves a version, with the deprecation headers once it has a sunset.
+func versioned(version int, next http.Handler, sunset time.Time) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(VersionHeader, strconv.Itoa(version))
+		if !sunset.IsZero() {
+			successor := strings.Replace(r.URL.Path, fmt.Sprintf("/v%d/", version), fmt.Sprintf("/v%d/", LatestVersion), 1)
+			deprecate(w.Header(), successor, sunset)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deprecate sets the Deprecation (RFC 9745) and Sunset (RFC 8594) headers,
+// with a link to the route replacing the deprecated one.
+func deprecate(header http.Header, successor string, sunset time.Time) {
+	header.Set("Deprecation", "true")
+	header.Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, successor))
+	if !sunset.IsZero() {
+		header.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+	}
+}
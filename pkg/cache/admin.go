@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Admin serves the cache admin endpoints, behind adminauth.
+//
+//	curl -X POST "https://cachev1.example.com/admin/cache/snapshots/bench-2024-06" -H "X-Admin-Key: xxx"
+type Admin struct {
+	cache *Cache
+}
+
+// NewAdmin creates a new Admin handler set.
+func NewAdmin(cache *Cache) *Admin {
+	return &Admin{cache: cache}
+}
+
+// snapshotInfo describes a snapshot.
+type snapshotInfo struct {
+	Label   string    `json:"label"`
+	TakenAt time.Time `json:"taken_at"`
+}
+
+// CreateSnapshot handles POST /admin/cache/snapshots/{label}.
+func (a *Admin) CreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	label := r.PathValue("label")
+	taken, err := a.cache.CreateSnapshot(r.Context(), label)
+	if errors.Is(err, errNotWalkable) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusCreated, snapshotInfo{Label: label, TakenAt: taken})
+}
+
+// GetSnapshot handles GET /admin/cache/snapshots/{label}.
+func (a *Admin) GetSnapshot(w http.ResponseWriter, r *http.Request) {
+	label := r.PathValue("label")
+	taken, err := a.cache.SnapshotTime(r.Context(), label)
+	if errors.Is(err, ErrUnknownSnapshot) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshotInfo{Label: label, TakenAt: taken})
+}
+
+// entryInfo describes a cached entry and where it comes from.
+type entryInfo struct {
+	Key        string      `json:"key"`
+	Created    time.Time   `json:"created"`
+	Expiration time.Time   `json:"expiration"`
+	LastAccess time.Time   `json:"last_access"`
+	Frequency  int         `json:"frequency"`
+	Size       int         `json:"size"`
+	Streamed   bool        `json:"streamed"`
+	Header     http.Header `json:"header"`
+	Provenance Provenance  `json:"provenance"`
+	Content    Content     `json:"content"`
+	Versions   int         `json:"archived_versions"`
+}
+
+// InspectEntry handles GET /admin/cache/entries?url=..., the url is the
+// request URL as the middleware sees it, e.g. "/serper/search?q=golang".
+// Entries keyed by a request body are looked up with ?key=<base36 key>.
+func (a *Admin) InspectEntry(w http.ResponseWriter, r *http.Request) {
+	var key uint64
+	query := r.URL.Query()
+	if k := query.Get("key"); k != "" {
+		parsed, err := strconv.ParseUint(k, 36, 64)
+		if err != nil {
+			http.Error(w, "Invalid key", http.StatusBadRequest)
+			return
+		}
+		key = parsed
+	} else {
+		u, err := url.Parse(query.Get("url"))
+		if err != nil || query.Get("url") == "" {
+			http.Error(w, "Missing or invalid url", http.StatusBadRequest)
+			return
+		}
+		sortURLParams(u)
+		key = a.cache.generateKey(u.String())
+	}
+
+	b, ok := a.cache.adapter.Get(r.Context(), key)
+	if !ok {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+	response, err := BytesToResponse(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	info := entryInfo{
+		Key:        KeyAsString(key),
+		Created:    response.Created,
+		Expiration: response.Expiration,
+		LastAccess: response.LastAccess,
+		Frequency:  response.Frequency,
+		Size:       len(response.Value),
+		Streamed:   response.Streamed,
+		Header:     response.Header,
+		Provenance: response.Provenance,
+		Content:    response.Content,
+	}
+	if response.Streamed {
+		if body, ok := a.cache.body(r.Context(), key, response); ok {
+			if n, err := io.Copy(io.Discard, body); err == nil {
+				info.Size = int(n)
+			}
+			body.Close()
+		}
+	}
+	if versions, err := a.cache.Versions(r.Context(), key); err == nil {
+		info.Versions = len(versions)
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// PurgeGroup handles DELETE /admin/cache/groups/{group}, the group is the one
+// in the provenance of a page, see InspectEntry.
+func (a *Admin) PurgeGroup(w http.ResponseWriter, r *http.Request) {
+	purged, err := a.cache.PurgeGroup(r.Context(), r.PathValue("group"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"cache_entries_purged": purged})
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		// response was already committed, nothing left to do
+		_ = err
+	}
+}
@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Archive headers. AsOfHeader selects the archived version closest to a date,
+// as "2006-01-02" or RFC 3339, ArchivedAtHeader tells when it was fetched.
+const (
+	AsOfHeader       = "X-As-Of"
+	ArchivedAtHeader = "X-Archived-At"
+)
+
+// archiveRetention is how long archived versions are kept, they don't expire in practice.
+const archiveRetention = 100 * 365 * 24 * time.Hour
+
+// ArchiveVersion is a distinct answer for a URL. Bodies are content addressed,
+// versions with the same body share it.
+type ArchiveVersion struct {
+	Hash      string
+	Header    http.Header
+	FetchedAt time.Time
+}
+
+func archiveIndexKey(key uint64) uint64 {
+	return generateKey("archive:index:" + KeyAsString(key))
+}
+
+func archiveBodyKey(hash string) uint64 {
+	return generateKey("archive:body:" + hash)
+}
+
+// Versions returns the archived versions of a cache key, oldest first.
+func (c *Cache) Versions(ctx context.Context, key uint64) ([]ArchiveVersion, error) {
+	b, ok := c.adapter.Get(ctx, archiveIndexKey(key))
+	if !ok {
+		return nil, nil
+	}
+	var versions []ArchiveVersion
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&versions); err != nil {
+		return nil, fmt.Errorf("gob.Decode: %w", err)
+	}
+	return versions, nil
+}
+
+// archive records a fetched response as a new version when its body differs
+// from the latest archived one. Concurrent fetches of the same URL on several
+// replicas may drop a version, archiving is best effort.
+func (c *Cache) archive(ctx context.Context, key uint64, response Response) {
+	if !c.archiving {
+		return
+	}
+	sum := sha256.Sum256(response.Value)
+	hash := hex.EncodeToString(sum[:])
+	versions, err := c.Versions(ctx, key)
+	if err != nil {
+		c.logger.Warn("Failed to read archive index", "key", key, "error", err)
+	}
+	if len(versions) > 0 && versions[len(versions)-1].Hash == hash {
+		return
+	}
+
+	expiration := time.Now().Add(archiveRetention)
+	if _, ok := c.adapter.Get(ctx, archiveBodyKey(hash)); !ok {
+		c.adapter.Set(archiveBodyKey(hash), response.Value, expiration)
+	}
+	versions = append(versions, ArchiveVersion{Hash: hash, Header: response.Header, FetchedAt: response.Created})
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(versions); err != nil {
+		c.logger.Error("Failed to encode archive index", "key", key, "error", err)
+		return
+	}
+	c.adapter.Set(archiveIndexKey(key), b.Bytes(), expiration)
+	c.logger.Info("Archived new version", "key", key, "hash", hash, "versions", len(versions))
+}
+
+// parseAsOf parses the AsOfHeader value.
+func parseAsOf(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, s)
+}
+
+// serveArchived serves the archived version fetched closest to the AsOfHeader date.
+func (h *cachedHTTPHandler) serveArchived(w http.ResponseWriter, r *http.Request, key uint64, asOf string) {
+	c := h.client
+	at, err := parseAsOf(asOf)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid %s: %v", AsOfHeader, err), http.StatusBadRequest)
+		return
+	}
+	versions, err := c.Versions(r.Context(), key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(versions) == 0 {
+		http.Error(w, "No archived version", http.StatusNotFound)
+		return
+	}
+
+	closest := versions[0]
+	for _, v := range versions[1:] {
+		if v.FetchedAt.Sub(at).Abs() < closest.FetchedAt.Sub(at).Abs() {
+			closest = v
+		}
+	}
+	body, ok := c.adapter.GetReader(r.Context(), archiveBodyKey(closest.Hash))
+	if !ok {
+		http.Error(w, "Archived version body is gone", http.StatusNotFound)
+		return
+	}
+	defer body.Close()
+
+	c.logger.Info("Archive hit", "key", key, "as_of", at, "fetched_at", closest.FetchedAt)
+	copyHeader(w.Header(), closest.Header)
+	w.Header().Set(ArchivedAtHeader, closest.FetchedAt.UTC().Format(time.RFC3339))
+	if _, err := io.Copy(w, body); err != nil {
+		// response was already committed, nothing left to do
+		_ = err
+	}
+}
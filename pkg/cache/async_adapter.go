@@ -0,0 +1,268 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var writeMetrics = expvar.NewMap("cache_writes")
+
+// OverflowPolicy decides what an AsyncAdapter does with writes when its queue is full.
+type OverflowPolicy string
+
+const (
+	// OverflowBlock waits for room in the queue, as the synchronous writes did.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDrop drops the write, the next request fetches upstream again.
+	OverflowDrop OverflowPolicy = "drop"
+)
+
+// AsyncAdapter is an Adapter writing on a pool of workers, so slow writes
+// don't add latency to client answers. Writes are sharded by key: the writes
+// and releases of a key are applied in order. Pending writes are served by
+// reads, so a request sees the answer the previous one stored, until its
+// expiration. Writes after Close are dropped.
+type AsyncAdapter struct {
+	Adapter
+	shards []chan *asyncOp
+	policy OverflowPolicy
+	logger *slog.Logger
+	wg     sync.WaitGroup
+
+	mu      sync.RWMutex
+	pending map[uint64]*asyncOp
+
+	// queueing is held by the senders to the shards, and by Close to close them
+	queueing sync.RWMutex
+	closed   bool
+}
+
+type asyncOp struct {
+	key        uint64
+	value      []byte
+	expiration time.Time
+	release    bool
+}
+
+// expired reports whether the value of a pending write is past its expiration.
+func (op *asyncOp) expired(now time.Time) bool {
+	return !op.expiration.IsZero() && !now.Before(op.expiration)
+}
+
+// lookup returns the pending write of key. A write past its expiration is
+// reported as pending with no value, the stored one it replaces isn't served.
+func (a *AsyncAdapter) lookup(key uint64) (value []byte, found, pending bool) {
+	a.mu.RLock()
+	op, ok := a.pending[key]
+	a.mu.RUnlock()
+	if !ok {
+		return nil, false, false
+	}
+	if op.expired(time.Now()) {
+		return nil, false, true
+	}
+	return op.value, true, true
+}
+
+// enqueue sends op to the worker of its key, it reports false when the op
+// was dropped: the queue is full under OverflowDrop, or the adapter is closed.
+func (a *AsyncAdapter) enqueue(op *asyncOp, policy OverflowPolicy) bool {
+	a.queueing.RLock()
+	defer a.queueing.RUnlock()
+	if a.closed {
+		writeMetrics.Add("dropped_closed", 1)
+		return false
+	}
+	if policy == OverflowDrop {
+		select {
+		case a.shard(op.key) <- op:
+		default:
+			writeMetrics.Add("dropped", 1)
+			a.logger.Warn("Cache write queue full, write dropped", "key", op.key)
+			return false
+		}
+	} else {
+		a.shard(op.key) <- op
+	}
+	writeMetrics.Add("queued", 1)
+	return true
+}
+
+// NewAsyncAdapter creates a new AsyncAdapter writing to next with workers
+// goroutines, each with a queue of queueSize writes.
+func NewAsyncAdapter(next Adapter, workers, queueSize int, policy OverflowPolicy, logger *slog.Logger) (*AsyncAdapter, error) {
+	if workers < 1 {
+		return nil, fmt.Errorf("cache write workers %d is invalid", workers)
+	}
+	switch policy {
+	case OverflowBlock, OverflowDrop:
+	default:
+		return nil, fmt.Errorf("unknown cache write overflow policy %q", policy)
+	}
+	a := &AsyncAdapter{
+		Adapter: next,
+		shards:  make([]chan *asyncOp, workers),
+		policy:  policy,
+		logger:  logger,
+		pending: map[uint64]*asyncOp{},
+	}
+	for i := range a.shards {
+		a.shards[i] = make(chan *asyncOp, queueSize)
+		a.wg.Add(1)
+		go a.work(a.shards[i])
+	}
+	return a, nil
+}
+
+func (a *AsyncAdapter) work(ops chan *asyncOp) {
+	defer a.wg.Done()
+	for op := range ops {
+		if op.release {
+			a.Adapter.Release(context.Background(), op.key)
+			continue
+		}
+		a.Adapter.Set(op.key, op.value, op.expiration)
+		writeMetrics.Add("written", 1)
+		a.mu.Lock()
+		if a.pending[op.key] == op {
+			delete(a.pending, op.key)
+		}
+		a.mu.Unlock()
+	}
+}
+
+func (a *AsyncAdapter) shard(key uint64) chan *asyncOp {
+	return a.shards[key%uint64(len(a.shards))]
+}
+
+// Get implements the cache Adapter interface Get method.
+func (a *AsyncAdapter) Get(ctx context.Context, key uint64) ([]byte, bool) {
+	if value, found, pending := a.lookup(key); pending {
+		return value, found
+	}
+	return a.Adapter.Get(ctx, key)
+}
+
+// GetMulti implements the cache Adapter interface GetMulti method.
+func (a *AsyncAdapter) GetMulti(ctx context.Context, keys []uint64) map[uint64][]byte {
+	found := map[uint64][]byte{}
+	var stored []uint64
+	for _, key := range keys {
+		value, ok, pending := a.lookup(key)
+		switch {
+		case ok:
+			found[key] = value
+		case !pending:
+			stored = append(stored, key)
+		}
+	}
+	if len(stored) > 0 {
+		for k, v := range a.Adapter.GetMulti(ctx, stored) {
+			found[k] = v
+		}
+	}
+	return found
+}
+
+// GetReader implements the cache Adapter interface GetReader method.
+func (a *AsyncAdapter) GetReader(ctx context.Context, key uint64) (io.ReadCloser, bool) {
+	if value, found, pending := a.lookup(key); pending {
+		if !found {
+			return nil, false
+		}
+		return io.NopCloser(bytes.NewReader(value)), true
+	}
+	return a.Adapter.GetReader(ctx, key)
+}
+
+// Set implements the cache Adapter interface Set method, the write is queued.
+func (a *AsyncAdapter) Set(key uint64, response []byte, expiration time.Time) {
+	if len(response) == 0 {
+		a.Adapter.Set(key, response, expiration)
+		return
+	}
+	// the caller reuses the response buffer
+	op := &asyncOp{key: key, value: bytes.Clone(response), expiration: expiration}
+	a.mu.Lock()
+	a.pending[key] = op
+	a.mu.Unlock()
+	if !a.enqueue(op, a.policy) {
+		a.mu.Lock()
+		if a.pending[key] == op {
+			delete(a.pending, key)
+		}
+		a.mu.Unlock()
+	}
+}
+
+// Expire implements the Expirer interface when the adapter written to does.
+// A key with a pending write isn't expired, the write would overtake it.
+func (a *AsyncAdapter) Expire(ctx context.Context, key uint64, expiration time.Time) bool {
+	a.mu.RLock()
+	_, pending := a.pending[key]
+	a.mu.RUnlock()
+	return !pending && expire(ctx, a.Adapter, key, expiration)
+}
+
+// Walk implements the Walker interface when the adapter written to does, the
+// pending writes are listed first and their keys skipped in the stored ones.
+func (a *AsyncAdapter) Walk(ctx context.Context, fn func(key uint64, value []byte) bool) error {
+	now := time.Now()
+	a.mu.RLock()
+	pending := make(map[uint64][]byte, len(a.pending))
+	for key, op := range a.pending {
+		pending[key] = op.value
+		if op.expired(now) {
+			pending[key] = nil
+		}
+	}
+	a.mu.RUnlock()
+	for key, value := range pending {
+		if value != nil && !fn(key, value) {
+			return nil
+		}
+	}
+	return walk(ctx, a.Adapter, func(key uint64, value []byte) bool {
+		if _, ok := pending[key]; ok {
+			return true
+		}
+		return fn(key, value)
+	})
+}
+
+// Release implements the cache Adapter interface Release method. Releases are
+// queued behind the pending writes of the key, they are only dropped after
+// Close.
+func (a *AsyncAdapter) Release(ctx context.Context, key uint64) {
+	a.mu.Lock()
+	delete(a.pending, key)
+	a.mu.Unlock()
+	a.enqueue(&asyncOp{key: key, release: true}, OverflowBlock)
+}
+
+// Close applies the queued writes and stops the workers, then closes the
+// adapter written to when it holds resources. The writes that follow are
+// dropped.
+func (a *AsyncAdapter) Close() error {
+	a.queueing.Lock()
+	if a.closed {
+		a.queueing.Unlock()
+		return nil
+	}
+	a.closed = true
+	for _, ops := range a.shards {
+		close(ops)
+	}
+	a.queueing.Unlock()
+	a.wg.Wait()
+	if closer, ok := a.Adapter.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"expvar"
+	"io"
+	"sync"
+	"time"
+)
+
+var boundedMetrics = expvar.NewMap("cache_adapter")
+
+// BoundedAdapter bounds the time spent in each adapter operation, so the
+// latency of answers doesn't follow the tail latency of Redis. Timed out
+// reads are misses and timed out writes go on in the background.
+//
+// With hedging, reads slower than the hedge delay are served from a local LRU
+// of the recently read and written values. A hedged value may be stale when
+// another replica has released it since, its expiration still applies.
+type BoundedAdapter struct {
+	Adapter
+	getTimeout     time.Duration
+	setTimeout     time.Duration
+	releaseTimeout time.Duration
+	hedgeAfter     time.Duration
+	local          *lru
+}
+
+// NewBoundedAdapter creates a new BoundedAdapter, a zero timeout doesn't
+// bound the operation. A zero hedgeAfter disables hedging, otherwise the
+// local LRU holds up to localSize bytes.
+func NewBoundedAdapter(next Adapter, getTimeout, setTimeout, releaseTimeout, hedgeAfter time.Duration, localSize int) *BoundedAdapter {
+	a := &BoundedAdapter{
+		Adapter:        next,
+		getTimeout:     getTimeout,
+		setTimeout:     setTimeout,
+		releaseTimeout: releaseTimeout,
+		hedgeAfter:     hedgeAfter,
+	}
+	if hedgeAfter > 0 {
+		a.local = newLRU(localSize)
+	}
+	return a
+}
+
+type getResult struct {
+	value []byte
+	ok    bool
+}
+
+// Get implements the cache Adapter interface Get method, the contexts marked
+// by Strong aren't hedged.
+func (a *BoundedAdapter) Get(ctx context.Context, key uint64) ([]byte, bool) {
+	if a.getTimeout <= 0 && a.local == nil {
+		return a.Adapter.Get(ctx, key)
+	}
+	if a.getTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.getTimeout)
+		defer cancel()
+	}
+	result := make(chan getResult, 1)
+	go func() {
+		value, ok := a.Adapter.Get(ctx, key)
+		result <- getResult{value, ok}
+	}()
+
+	var hedge <-chan time.Time
+	if a.local != nil && !strongRead(ctx) {
+		timer := time.NewTimer(a.hedgeAfter)
+		defer timer.Stop()
+		hedge = timer.C
+	}
+	for {
+		select {
+		case r := <-result:
+			if r.ok && a.local != nil {
+				a.local.add(key, r.value)
+			}
+			return r.value, r.ok
+		case <-hedge:
+			hedge = nil
+			if value, ok := a.local.get(key); ok {
+				boundedMetrics.Add("hedged_hits", 1)
+				return value, true
+			}
+		case <-ctx.Done():
+			boundedMetrics.Add("get_timeouts", 1)
+			return nil, false
+		}
+	}
+}
+
+// GetMulti implements the cache Adapter interface GetMulti method, bounded by
+// the get timeout. It isn't hedged, the batch is one round trip.
+func (a *BoundedAdapter) GetMulti(ctx context.Context, keys []uint64) map[uint64][]byte {
+	if a.getTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.getTimeout)
+		defer cancel()
+	}
+	found := a.Adapter.GetMulti(ctx, keys)
+	if ctx.Err() != nil {
+		boundedMetrics.Add("get_timeouts", 1)
+	}
+	if a.local != nil {
+		for k, v := range found {
+			a.local.add(k, v)
+		}
+	}
+	return found
+}
+
+// GetReader implements the cache Adapter interface GetReader method. It isn't
+// bounded, values are streamed in chunks.
+func (a *BoundedAdapter) GetReader(ctx context.Context, key uint64) (io.ReadCloser, bool) {
+	if a.local != nil {
+		// streamed values are keyed by version and never change, the LRU copy is current
+		if value, ok := a.local.get(key); ok {
+			return io.NopCloser(bytes.NewReader(value)), true
+		}
+	}
+	return a.Adapter.GetReader(ctx, key)
+}
+
+// Set implements the cache Adapter interface Set method.
+func (a *BoundedAdapter) Set(key uint64, response []byte, expiration time.Time) {
+	if a.local != nil {
+		a.local.add(key, response)
+	}
+	if a.setTimeout <= 0 {
+		a.Adapter.Set(key, response, expiration)
+		return
+	}
+	// the write may outlive the call, it can't keep the caller's buffer
+	value := bytes.Clone(response)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.Adapter.Set(key, value, expiration)
+	}()
+	timer := time.NewTimer(a.setTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		boundedMetrics.Add("set_timeouts", 1)
+	}
+}
+
+// Expire implements the Expirer interface when the adapter bounded does,
+// within the write timeout.
+func (a *BoundedAdapter) Expire(ctx context.Context, key uint64, expiration time.Time) bool {
+	if a.setTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.setTimeout)
+		defer cancel()
+	}
+	return expire(ctx, a.Adapter, key, expiration)
+}
+
+// Walk implements the Walker interface when the adapter bounded does.
+func (a *BoundedAdapter) Walk(ctx context.Context, fn func(key uint64, value []byte) bool) error {
+	return walk(ctx, a.Adapter, fn)
+}
+
+// Release implements the cache Adapter interface Release method.
+func (a *BoundedAdapter) Release(ctx context.Context, key uint64) {
+	if a.local != nil {
+		a.local.remove(key)
+	}
+	if a.releaseTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.releaseTimeout)
+		defer cancel()
+	}
+	a.Adapter.Release(ctx, key)
+}
+
+// Forget evicts key from the local LRU, e.g. when another replica released it.
+func (a *BoundedAdapter) Forget(key uint64) {
+	if a.local != nil {
+		a.local.remove(key)
+	}
+}
+
+// Close closes the adapter bounded when it holds resources.
+func (a *BoundedAdapter) Close() error {
+	if closer, ok := a.Adapter.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// lru is a least recently used set of values, bounded in bytes.
+type lru struct {
+	mu      sync.Mutex
+	maxSize int
+	size    int
+	order   *list.List
+	entries map[uint64]*list.Element
+}
+
+type lruEntry struct {
+	key   uint64
+	value []byte
+}
+
+func newLRU(maxSize int) *lru {
+	return &lru{maxSize: maxSize, order: list.New(), entries: map[uint64]*list.Element{}}
+}
+
+func (l *lru) get(key uint64) ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+func (l *lru) add(key uint64, value []byte) {
+	// values larger than a tenth of the LRU would evict too much
+	if len(value) > l.maxSize/10 {
+		l.remove(key)
+		return
+	}
+	value = bytes.Clone(value)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[key]; ok {
+		l.size += len(value) - len(e.Value.(*lruEntry).value)
+		e.Value.(*lruEntry).value = value
+		l.order.MoveToFront(e)
+	} else {
+		l.entries[key] = l.order.PushFront(&lruEntry{key: key, value: value})
+		l.size += len(value)
+	}
+	for l.size > l.maxSize {
+		e := l.order.Back()
+		entry := e.Value.(*lruEntry)
+		l.order.Remove(e)
+		delete(l.entries, entry.key)
+		l.size -= len(entry.value)
+	}
+}
+
+func (l *lru) remove(key uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[key]; ok {
+		l.order.Remove(e)
+		delete(l.entries, key)
+		l.size -= len(e.Value.(*lruEntry).value)
+	}
+}
@@ -0,0 +1,255 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var budgetMetrics = expvar.NewMap("cache_budget")
+
+// entrySizes samples the sizes of the stored values, published on
+// /debug/vars under "cache_entry_sizes".
+var entrySizes = &sizeSample{max: 1024}
+
+func init() {
+	expvar.Publish("cache_entry_sizes", expvar.Func(entrySizes.summary))
+}
+
+// sizeSample is a reservoir sample of sizes, uniform over every size seen.
+type sizeSample struct {
+	mu    sync.Mutex
+	max   int
+	seen  int64
+	sizes []int64
+}
+
+func (s *sizeSample) observe(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seen++
+	if len(s.sizes) < s.max {
+		s.sizes = append(s.sizes, size)
+		return
+	}
+	if i := rand.Int63n(s.seen); i < int64(s.max) {
+		s.sizes[i] = size
+	}
+}
+
+// summary returns the number of sizes seen and the percentiles of the sample.
+func (s *sizeSample) summary() any {
+	s.mu.Lock()
+	sizes := slices.Clone(s.sizes)
+	seen := s.seen
+	s.mu.Unlock()
+	summary := map[string]int64{"count": seen}
+	if len(sizes) == 0 {
+		return summary
+	}
+	slices.Sort(sizes)
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	summary["mean"] = total / int64(len(sizes))
+	summary["p50"] = sizes[len(sizes)*50/100]
+	summary["p90"] = sizes[len(sizes)*90/100]
+	summary["p99"] = sizes[len(sizes)*99/100]
+	summary["max"] = sizes[len(sizes)-1]
+	return summary
+}
+
+// MemoryEstimate is how the memory of Redis splits between the cache and
+// the other data sharing it, e.g. the quota keys.
+type MemoryEstimate struct {
+	// Used is the memory used by Redis, overhead included.
+	Used int64
+	// Keys is the number of keys.
+	Keys int64
+	// Cache is the memory held by the cache entries and their values.
+	Cache int64
+	// Other is the memory held by the other keys.
+	Other int64
+}
+
+// EstimateMemory estimates the memory held by the cache from the usage of
+// samples random keys of each shard. The entries are under their bare key,
+// or the "raw:" one for large values, the other data has a prefix.
+func (ra *RedisAdapter) EstimateMemory(ctx context.Context, samples int) (MemoryEstimate, error) {
+	// the shards are sampled concurrently
+	var mu sync.Mutex
+	var estimate MemoryEstimate
+	err := ra.ring.ForEachShard(ctx, func(ctx context.Context, client *redis.Client) error {
+		info, err := client.Info(ctx, "memory").Result()
+		if err != nil {
+			return fmt.Errorf("Info: %w", err)
+		}
+		keys, err := client.DBSize(ctx).Result()
+		if err != nil {
+			return fmt.Errorf("DBSize: %w", err)
+		}
+		var cache, other int64
+		sampled := 0
+		for range min(int64(samples), keys) {
+			key, err := client.RandomKey(ctx).Result()
+			if err == redis.Nil {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("RandomKey: %w", err)
+			}
+			usage, err := client.MemoryUsage(ctx, key).Result()
+			if err == redis.Nil {
+				// expired since
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("MemoryUsage: %w", err)
+			}
+			sampled++
+			if !strings.Contains(key, ":") || strings.HasPrefix(key, "raw:") {
+				cache += usage
+			} else {
+				other += usage
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		estimate.Used += usedMemory(info)
+		estimate.Keys += keys
+		if sampled > 0 {
+			estimate.Cache += cache * keys / int64(sampled)
+			estimate.Other += other * keys / int64(sampled)
+		}
+		return nil
+	})
+	return estimate, err
+}
+
+// usedMemory returns the used_memory of an INFO memory answer.
+func usedMemory(info string) int64 {
+	scanner := bufio.NewScanner(strings.NewReader(info))
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "used_memory:"); ok {
+			used, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			return used
+		}
+	}
+	return 0
+}
+
+// Budget caps the memory of Redis held by the cache. While the estimate of
+// the cache is over the cap, the new entries are kept for a shorter TTL and
+// those larger than a stricter size limit aren't stored, until the entries
+// expire back under it.
+type Budget struct {
+	capacity int64
+	ttl      time.Duration
+	maxSize  int64
+	estimate func(context.Context) (MemoryEstimate, error)
+	interval time.Duration
+	logger   *slog.Logger
+	over     atomic.Bool
+}
+
+// NewBudget creates a new Budget of capacity bytes, estimated every interval.
+// Over it, the entries are kept for ttl at most and the values larger than
+// maxSize bytes aren't stored, 0 doesn't shorten or limit them.
+func NewBudget(capacity int64, ttl time.Duration, maxSize int64, estimate func(context.Context) (MemoryEstimate, error), interval time.Duration, logger *slog.Logger) *Budget {
+	return &Budget{
+		capacity: capacity,
+		ttl:      ttl,
+		maxSize:  maxSize,
+		estimate: estimate,
+		interval: interval,
+		logger:   logger,
+	}
+}
+
+// Start checks the budget now and every interval until ctx is done.
+func (b *Budget) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+		for {
+			if err := b.Check(ctx); err != nil {
+				b.logger.Warn("Failed to estimate the cache memory", "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Check estimates the memory held by the cache and raises or clears the
+// alarm. The alarm is left as is when the estimate fails.
+func (b *Budget) Check(ctx context.Context) error {
+	estimate, err := b.estimate(ctx)
+	if err != nil {
+		budgetMetrics.Add("estimate_errors", 1)
+		return err
+	}
+	for name, value := range map[string]int64{
+		"used_bytes":  estimate.Used,
+		"keys":        estimate.Keys,
+		"cache_bytes": estimate.Cache,
+		"other_bytes": estimate.Other,
+	} {
+		v := new(expvar.Int)
+		v.Set(value)
+		budgetMetrics.Set(name, v)
+	}
+	over := estimate.Cache > b.capacity
+	if b.over.Swap(over) != over {
+		if over {
+			b.logger.Warn("Cache over its memory budget, shortening TTLs", "cache_bytes", estimate.Cache, "capacity", b.capacity, "ttl", b.ttl, "max_size", b.maxSize)
+		} else {
+			b.logger.Info("Cache back under its memory budget", "cache_bytes", estimate.Cache, "capacity", b.capacity)
+		}
+	}
+	alarm := new(expvar.Int)
+	if over {
+		alarm.Set(1)
+	}
+	budgetMetrics.Set("over", alarm)
+	return nil
+}
+
+// Over reports whether the cache was over its budget at the last check.
+func (b *Budget) Over() bool {
+	return b.over.Load()
+}
+
+// admit applies the budget to a response about to be stored, shortening
+// its expiration. It returns false when the response isn't to be stored.
+func (b *Budget) admit(response *Response) bool {
+	if !b.Over() {
+		return true
+	}
+	if b.maxSize > 0 && int64(len(response.Value)) > b.maxSize {
+		budgetMetrics.Add("skipped", 1)
+		return false
+	}
+	if b.ttl > 0 {
+		if capped := time.Now().Add(b.ttl); capped.Before(response.Expiration) {
+			response.Expiration = capped
+			budgetMetrics.Add("shortened", 1)
+		}
+	}
+	return true
+}
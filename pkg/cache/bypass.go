@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+)
+
+type bypassKey struct{}
+
+// Bypass marks a request context so the middleware neither serves nor stores
+// its answer, e.g. to replay a request against upstream. Clients can't set it.
+func Bypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassKey{}, true)
+}
+
+// Bypassed reports whether the context was marked by Bypass.
+func Bypassed(ctx context.Context) bool {
+	v, _ := ctx.Value(bypassKey{}).(bool)
+	return v
+}
+
+// Cached returns the cached response of a request and its value, as the
+// middleware would serve it. The request body is restored.
+func (c *Cache) Cached(ctx context.Context, r *http.Request) (Response, []byte, bool) {
+	key, err := c.requestKey(r)
+	if err != nil {
+		return Response{}, nil, false
+	}
+	response, ok := c.lookup(ctx, key)
+	if !ok {
+		return Response{}, nil, false
+	}
+	body, ok := c.body(ctx, key, response)
+	if !ok {
+		return Response{}, nil, false
+	}
+	defer body.Close()
+	value, err := io.ReadAll(body)
+	if err != nil {
+		return Response{}, nil, false
+	}
+	return response, value, true
+}
+
+// Contains reports whether the middleware would answer a request from the
+// cache, without reading the cached value. The request body is restored.
+func (c *Cache) Contains(ctx context.Context, r *http.Request) bool {
+	key, err := c.requestKey(r)
+	if err != nil {
+		return false
+	}
+	_, ok := c.lookup(ctx, key)
+	return ok
+}
+
+// RequestKey returns the key the middleware caches a request under, e.g. the
+// candidate key of a Canary. The request body is restored.
+func (c *Cache) RequestKey(r *http.Request) (uint64, error) {
+	return c.requestKey(r)
+}
+
+// requestKey returns the key the middleware caches a request under. The
+// request body is restored.
+func (c *Cache) requestKey(r *http.Request) (uint64, error) {
+	u := *r.URL
+	sortURLParams(&u)
+	if r.Method != http.MethodPost || r.Body == nil {
+		return c.generateKey(u.String()), nil
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return c.generateKeyWithBody(u.String(), body), nil
+}
@@ -27,14 +27,20 @@ package cache
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/gob"
-	"hash/fnv"
+	"io"
 	"log/slog"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/privacy"
 )
 
 // Response is the cached response data structure.
@@ -55,6 +61,38 @@ type Response struct {
 	// Frequency is the count of times a cached response is accessed.
 	// Used for LFU and MFU algorithms.
 	Frequency int
+
+	// Created is when the response was fetched from upstream.
+	Created time.Time
+
+	// Provenance records where the response comes from.
+	Provenance Provenance
+
+	// Content is the type and the language detected in the value.
+	Content Content
+
+	// Streamed is true when the value is too large to be inlined, it's stored
+	// under its own body key and streamed from the adapter instead.
+	Streamed bool
+
+	// Size is the size of a streamed value.
+	Size int64
+
+	// BodyVersion tells apart the streamed values of concurrent stores of the
+	// same key, so an entry never points at the value of another store.
+	BodyVersion uint64
+
+	// Namespace is the key namespace the response was stored in, see
+	// FormatVersion.
+	Namespace uint64
+
+	// Snapshot is the label of the snapshot the response was recorded into,
+	// empty for the live entries.
+	Snapshot string
+
+	// Digest is the SHA-256 of a streamed value, a refresh to the same value
+	// moves its expiration instead of writing it again.
+	Digest []byte
 }
 
 // Cache data structure for HTTP cache middleware.
@@ -64,25 +102,64 @@ type Cache struct {
 	refreshKey         string
 	methods            []string
 	writeExpiresHeader bool
+	streamThreshold    int
+	contentRules       []ContentRule
+	ttlRules           []TTLRule
+	ttlJitter          float64
+	archiving          bool
+	knownMiss          *KnownMiss
+	domainOf           func(*http.Request) string
+	domains            DomainIndex
+	pages              *Pages
+	canonical          func(*http.Request, http.Header) *url.URL
+	onStore            func(*http.Request, Response)
+	maxAge             time.Duration
+	budget             *Budget
+	revalidateWindow   time.Duration
+	revalidating       []string
+	provenanceHeaders  []string
+	strongRoutes       []string
+	writeTimeout       time.Duration
+	keyConfig          string
+	namespace          uint64
+	readOnly           bool
+	lookups            lookupStats
 	logger             *slog.Logger
 }
 
-// HTTPHandlerMiddleware is the HTTP cache middleware handler.
+// HTTPHandlerMiddleware is the HTTP cache middleware handler. A read-only
+// cache never calls next.
 func (c *Cache) HTTPHandlerMiddleware(next http.Handler) http.Handler {
+	if c.readOnly {
+		next = notCached
+	}
 	return &cachedHTTPHandler{
 		next:   next,
 		client: c,
 	}
 }
 
-// RoundTripperMiddleware is the HTTP cache middleware for RoundTripper.
+// RoundTripperMiddleware is the HTTP cache middleware for RoundTripper. A
+// read-only cache never calls next.
 func (c *Cache) RoundTripperMiddleware(next http.RoundTripper) http.RoundTripper {
+	if c.readOnly {
+		next = notCachedTransport{}
+	}
 	return &cacheRoundTripper{
 		next:   next,
 		client: c,
 	}
 }
 
+// Close closes the adapter when it holds resources, e.g. the workers of an
+// AsyncAdapter, after the server stopped serving.
+func (c *Cache) Close() error {
+	if closer, ok := c.adapter.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
 func (c *Cache) cacheableMethod(method string) bool {
 	for _, m := range c.methods {
 		if method == m {
@@ -117,6 +194,10 @@ func (r Response) Bytes() []byte {
 }
 
 func sortURLParams(URL *url.URL) {
+	// most queries are already in order, skip the parse and re-encoding
+	if canonicalQuery(URL.RawQuery) {
+		return
+	}
 	params := URL.Query()
 	for _, param := range params {
 		sort.Slice(param, func(i, j int) bool {
@@ -126,38 +207,241 @@ func sortURLParams(URL *url.URL) {
 	URL.RawQuery = params.Encode()
 }
 
+// refreshRequested reports whether the query holds the refresh key. Queries
+// that can't hold it, even escaped, aren't parsed.
+func (c *Cache) refreshRequested(u *url.URL) bool {
+	if c.refreshKey != "" && !strings.Contains(u.RawQuery, c.refreshKey) && !strings.Contains(u.RawQuery, "%") {
+		return false
+	}
+	_, ok := u.Query()[c.refreshKey]
+	return ok
+}
+
+// canonicalQuery reports whether a query is already encoded as sortURLParams
+// would encode it: pairs ordered by key then value, made of unreserved characters.
+func canonicalQuery(raw string) bool {
+	var prevKey, prevValue string
+	for i := 0; raw != ""; i++ {
+		var pair string
+		var more bool
+		pair, raw, more = strings.Cut(raw, "&")
+		if more && raw == "" {
+			return false
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" || !unreserved(key) || !unreserved(value) {
+			return false
+		}
+		if i > 0 && (key < prevKey || key == prevKey && value < prevValue) {
+			return false
+		}
+		prevKey, prevValue = key, value
+	}
+	return true
+}
+
+// unreserved reports whether s is left as is by url.QueryEscape.
+func unreserved(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+			continue
+		}
+		switch c {
+		case '-', '_', '.', '~':
+			continue
+		}
+		return false
+	}
+	return true
+}
+
 // KeyAsString can be used by adapters to convert the cache key from uint64 to string.
 func KeyAsString(key uint64) string {
 	return strconv.FormatUint(key, 36)
 }
 
+// FNV-1a, as hash/fnv, inlined to hash strings and bodies without copies.
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+)
+
 func generateKey(URL string) uint64 {
-	hash := fnv.New64a()
-	hash.Write([]byte(URL))
+	return hashString(offset64, URL)
+}
+
+func hashString(hash uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		hash ^= uint64(s[i])
+		hash *= prime64
+	}
+	return hash
+}
 
-	return hash.Sum64()
+func hashBytes(hash uint64, b []byte) uint64 {
+	for _, c := range b {
+		hash ^= uint64(c)
+		hash *= prime64
+	}
+	return hash
+}
+
+// bodyKey is the key a streamed response value is stored under. Version 0
+// is the unversioned key of the entries stored before versions.
+func bodyKey(key uint64, version uint64) uint64 {
+	if version == 0 {
+		return generateKey("body:" + KeyAsString(key))
+	}
+	return generateKey("body:" + KeyAsString(key) + ":" + KeyAsString(version))
+}
+
+// store caches a response, values from the stream threshold are stored
+// under their own body key so hits can stream them. Expiration is capped
+// by the max age and the memory budget.
+func (c *Cache) store(key uint64, response Response) {
+	c.storeOver(key, response, Response{})
+}
+
+// storeOver caches a response replacing previous, e.g. on a refresh. When
+// both values are streamed and equal, the stored one is kept with its
+// expiration moved, only the entry is written.
+func (c *Cache) storeOver(key uint64, response Response, previous Response) {
+	response.Namespace = c.namespace
+	if c.maxAge > 0 && !response.Created.IsZero() {
+		if capped := response.Created.Add(c.maxAge); capped.Before(response.Expiration) {
+			response.Expiration = capped
+		}
+	}
+	entrySizes.observe(int64(len(response.Value)))
+	if c.budget != nil && !c.budget.admit(&response) {
+		return
+	}
+	if c.streamThreshold > 0 && len(response.Value) >= c.streamThreshold {
+		digest := sha256.Sum256(response.Value)
+		response.Digest = digest[:]
+		response.Size = int64(len(response.Value))
+		if c.reuseBody(key, response, previous) {
+			response.BodyVersion = previous.BodyVersion
+			writeMetrics.Add("bodies_kept", 1)
+			writeMetrics.Add("bytes_kept", response.Size)
+		} else {
+			response.BodyVersion = rand.Uint64() | 1
+			c.adapter.Set(bodyKey(key, response.BodyVersion), response.Value, c.keepUntil(response))
+		}
+		response.Value = nil
+		response.Streamed = true
+	}
+	c.adapter.Set(key, response.Bytes(), c.keepUntil(response))
+}
+
+// reuseBody moves the expiration of the streamed value of previous to the one
+// of response, when it's the same value.
+func (c *Cache) reuseBody(key uint64, response, previous Response) bool {
+	if !previous.Streamed || previous.Namespace != c.namespace || !bytes.Equal(previous.Digest, response.Digest) {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.writeTimeout)
+	defer cancel()
+	return expire(ctx, c.adapter, bodyKey(key, previous.BodyVersion), c.keepUntil(response))
+}
+
+// detach releases the entry of key but keeps its streamed value, the entry
+// is returned for the answer replacing it to reuse the value, see storeOver.
+// A value not reused is left to expire, as those of overwritten entries.
+func (c *Cache) detach(ctx context.Context, key uint64) Response {
+	b, ok := c.adapter.Get(ctx, key)
+	if !ok {
+		return Response{}
+	}
+	previous, err := BytesToResponse(b)
+	if err != nil || !previous.Streamed {
+		c.release(ctx, key)
+		return Response{}
+	}
+	c.adapter.Release(ctx, key)
+	return previous
+}
+
+// release frees a cached response and its streamed value. Values of
+// overwritten entries are left to expire.
+func (c *Cache) release(ctx context.Context, key uint64) {
+	if b, ok := c.adapter.Get(ctx, key); ok {
+		if response, err := BytesToResponse(b); err == nil && response.Streamed {
+			c.adapter.Release(ctx, bodyKey(key, response.BodyVersion))
+		}
+	}
+	c.adapter.Release(ctx, key)
+}
+
+// body returns the value of a cached response, streamed from the adapter
+// when it's stored under its own body key.
+func (c *Cache) body(ctx context.Context, key uint64, response Response) (io.ReadCloser, bool) {
+	if !response.Streamed {
+		return io.NopCloser(bytes.NewReader(response.Value)), true
+	}
+	return c.adapter.GetReader(ctx, bodyKey(key, response.BodyVersion))
 }
 
 func generateKeyWithBody(URL string, body []byte) uint64 {
-	hash := fnv.New64a()
-	body = append([]byte(URL), body...)
-	hash.Write(body)
+	return hashWithBody(offset64, URL, body)
+}
 
-	return hash.Sum64()
+func hashWithBody(hash uint64, URL string, body []byte) uint64 {
+	if privacy.Enabled() {
+		body = privacy.Sum(body)
+	}
+	return hashBytes(hashString(hash, URL), body)
 }
 
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
-	body       []byte
+	body       *bytes.Buffer
+	rules      []ContentRule
+	debug      bool
+	provenance Provenance
+	// provenanceHeaders are the upstream headers recorded in the provenance
+	provenanceHeaders []string
+	decided           bool
+	// skip is set once the answer is known not to be cached, the body is no longer buffered
+	skip    bool
+	maxSize int64
+}
+
+// decide applies the content rules to the answer headers, once.
+func (w *responseWriter) decide() {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	w.provenance = takeProvenance(w.Header(), w.provenanceHeaders)
+	if w.debug {
+		writeDebugHeaders(w.Header(), "MISS", Response{Provenance: w.provenance})
+	}
+	rule := matchContentRule(w.rules, w.Header())
+	w.skip = rule.Skip
+	w.maxSize = rule.MaxSize
+	if length, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); err == nil && w.maxSize > 0 && length > w.maxSize {
+		w.skip = true
+	}
 }
 
 func (w *responseWriter) WriteHeader(statusCode int) {
+	w.decide()
 	w.statusCode = statusCode
 	w.ResponseWriter.WriteHeader(statusCode)
 }
 
 func (w *responseWriter) Write(b []byte) (int, error) {
-	w.body = b
+	w.decide()
+	if !w.skip {
+		// the proxy writes large answers in several calls
+		w.body.Write(b)
+		if w.maxSize > 0 && int64(w.body.Len()) > w.maxSize {
+			w.skip = true
+			w.body.Reset()
+		}
+	}
 	return w.ResponseWriter.Write(b)
 }
@@ -0,0 +1,1093 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/internal/cachetest"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const benchURL = "/jina/https://www.example.com/articles/2024/06/some-long-article-slug?page=2&lang=en"
+
+func TestGenerateKeyMatchesFNV(t *testing.T) {
+	// keys must not change, existing entries would be lost
+	for _, tc := range []struct {
+		url  string
+		body string
+		want uint64
+	}{
+		{"", "", 0xcbf29ce484222325},
+		{"a", "", 0xaf63dc4c8601ec8c},
+		{"/serper/search", "", 0x35b7919b922cde98},
+		{"/serper/search", `{"q":"golang"}`, 0x2ebffa55ea905ed5},
+	} {
+		got := generateKey(tc.url)
+		if tc.body != "" {
+			got = generateKeyWithBody(tc.url, []byte(tc.body))
+		}
+		if got != tc.want {
+			t.Errorf("key of %q %q = %#x, want %#x", tc.url, tc.body, got, tc.want)
+		}
+	}
+}
+
+func TestSortURLParams(t *testing.T) {
+	for _, tc := range []struct {
+		raw  string
+		want string
+	}{
+		{"", ""},
+		{"a=1&b=2", "a=1&b=2"},
+		{"b=2&a=1", "a=1&b=2"},
+		{"a=2&a=1", "a=1&a=2"},
+		{"a", "a="},
+		{"q=hello world", "q=hello+world"},
+		{"q=hello%20world", "q=hello+world"},
+		{"q=%7e", "q=~"},
+		{"b=1&a=2&a=1", "a=1&a=2&b=1"},
+		{"a=1&", "a=1"},
+		{"a=1&&b=2", "a=1&b=2"},
+	} {
+		u := &url.URL{Path: "/", RawQuery: tc.raw}
+		sortURLParams(u)
+		if u.RawQuery != tc.want {
+			t.Errorf("sortURLParams(%q) = %q, want %q", tc.raw, u.RawQuery, tc.want)
+		}
+	}
+}
+
+func BenchmarkGenerateKey(b *testing.B) {
+	b.ReportAllocs()
+	for b.Loop() {
+		generateKey(benchURL)
+	}
+}
+
+func BenchmarkGenerateKeyWithBody(b *testing.B) {
+	body := []byte(strings.Repeat(`{"q":"golang"}`, 300))
+	b.ReportAllocs()
+	for b.Loop() {
+		generateKeyWithBody(benchURL, body)
+	}
+}
+
+func BenchmarkSortURLParams(b *testing.B) {
+	u, err := url.Parse(benchURL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		sortURLParams(u)
+	}
+}
+
+func BenchmarkMiddlewareHit(b *testing.B) {
+	c, err := New(
+		WithAdapter(cachetest.NewMemoryAdapter()),
+		WithTTL(time.Hour),
+		WithRefreshKey("refresh"),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	)
+	if err != nil {
+		b.Fatal(err)
+	}
+	h := c.HTTPHandlerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 4096)))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, benchURL, nil))
+	b.ReportAllocs()
+	for b.Loop() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, benchURL, nil))
+	}
+}
+
+// jinaPage is the size of a large Jina answer.
+var jinaPage = []byte(strings.Repeat("x", 256<<10))
+
+func newBenchCache(b *testing.B) *Cache {
+	c, err := New(
+		WithAdapter(cachetest.NewMemoryAdapter()),
+		WithTTL(time.Hour),
+		WithRefreshKey("refresh"),
+		WithMethods([]string{http.MethodGet, http.MethodPost}),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return c
+}
+
+func BenchmarkMiddlewareMissPost(b *testing.B) {
+	c := newBenchCache(b)
+	h := c.HTTPHandlerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		for chunk := range slices.Chunk(jinaPage, 32<<10) {
+			w.Write(chunk)
+		}
+	}))
+	body := strings.Repeat(`{"q":"golang"}`, 300)
+	b.ReportAllocs()
+	for b.Loop() {
+		req := httptest.NewRequest(http.MethodPost, benchURL+"&refresh", strings.NewReader(body))
+		h.ServeHTTP(discardWriter{}, req)
+	}
+}
+
+func BenchmarkRoundTripperMiss(b *testing.B) {
+	c := newBenchCache(b)
+	rt := c.RoundTripperMiddleware(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.Body != nil {
+			io.Copy(io.Discard, r.Body)
+			r.Body.Close()
+		}
+		return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(bytes.NewReader(jinaPage))}, nil
+	}))
+	body := strings.Repeat(`{"q":"golang"}`, 300)
+	b.ReportAllocs()
+	for b.Loop() {
+		req := httptest.NewRequest(http.MethodPost, "https://r.jina.ai/https://www.example.com?refresh", strings.NewReader(body))
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// discardWriter is a ResponseWriter dropping the answer.
+type discardWriter struct{}
+
+func (discardWriter) Header() http.Header         { return http.Header{} }
+func (discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (discardWriter) WriteHeader(int)             {}
+
+func newTestCache(t *testing.T) *Cache {
+	t.Helper()
+	c, err := New(
+		WithAdapter(cachetest.NewMemoryAdapter()),
+		WithTTL(time.Hour),
+		WithRefreshKey("refresh"),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestReplayChunkedUpstream(t *testing.T) {
+	page := strings.Repeat("chunk ", 4096)
+	c := newTestCache(t)
+	srv := httptest.NewServer(c.HTTPHandlerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		for chunk := range slices.Chunk([]byte(page), 1024) {
+			w.Write(chunk)
+		}
+	})))
+	defer srv.Close()
+
+	for _, want := range []struct {
+		cache   string
+		chunked bool
+	}{{"MISS", true}, {"HIT", false}} {
+		resp, err := http.Get(srv.URL + "/jina/https://example.com/chunked")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != page {
+			t.Fatalf("%s: body of %d bytes, want %d", want.cache, len(body), len(page))
+		}
+		chunked := slices.Contains(resp.TransferEncoding, "chunked")
+		if chunked != want.chunked {
+			t.Errorf("%s: chunked = %v, want %v", want.cache, chunked, want.chunked)
+		}
+		if !want.chunked && resp.ContentLength != int64(len(page)) {
+			t.Errorf("%s: Content-Length = %d, want %d", want.cache, resp.ContentLength, len(page))
+		}
+	}
+}
+
+func TestReplayRecomputesContentLength(t *testing.T) {
+	c := newTestCache(t)
+	h := c.HTTPHandlerMiddleware(http.NotFoundHandler())
+	// an entry stored with the framing of another encoding of its value
+	now := time.Now()
+	c.store(c.generateKey("/jina/https://example.com/stale"), Response{
+		Value: []byte("hello"),
+		Header: http.Header{
+			"Content-Type":      {"text/plain"},
+			"Content-Length":    {"42"},
+			"Transfer-Encoding": {"chunked"},
+			"Connection":        {"keep-alive"},
+		},
+		Expiration: now.Add(time.Hour),
+		Created:    now,
+	})
+
+	for _, headOnly := range []bool{false, true} {
+		req := httptest.NewRequest(http.MethodGet, "/jina/https://example.com/stale", nil)
+		if headOnly {
+			req.Header.Set(HeadOnlyHeader, "true")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("head only %v: status %d", headOnly, w.Code)
+		}
+		length := "Content-Length"
+		if headOnly {
+			// a GET answer without its body can't tell a Content-Length
+			length = ContentLengthHeader
+			if got := w.Header().Get("Content-Length"); got != "" || w.Body.Len() != 0 {
+				t.Errorf("head only: Content-Length = %q with a body of %d bytes", got, w.Body.Len())
+			}
+		}
+		if got := w.Header().Get(length); got != "5" {
+			t.Errorf("head only %v: %s = %q, want 5", headOnly, length, got)
+		}
+		for _, name := range []string{"Transfer-Encoding", "Connection"} {
+			if got := w.Header().Get(name); got != "" {
+				t.Errorf("head only %v: %s = %q replayed", headOnly, name, got)
+			}
+		}
+		if got := w.Header().Get("Content-Type"); got != "text/plain" {
+			t.Errorf("head only %v: Content-Type = %q", headOnly, got)
+		}
+	}
+}
+
+func TestHeadOnlyMiss(t *testing.T) {
+	c := newTestCache(t)
+	h := c.HTTPHandlerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "5")
+		w.Write([]byte("hello"))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/jina/https://example.com/checked", nil)
+	req.Header.Set(HeadOnlyHeader, "true")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if got := w.Header().Get("Content-Length"); got != "" || w.Body.Len() != 0 {
+		t.Errorf("head-only miss: Content-Length = %q with a body of %d bytes", got, w.Body.Len())
+	}
+	if got := w.Header().Get(ContentLengthHeader); got != "5" {
+		t.Errorf("head-only miss: %s = %q, want 5", ContentLengthHeader, got)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/jina/https://example.com/checked", nil))
+	if w.Body.String() != "hello" || w.Header().Get("Content-Length") != "5" || w.Header().Get(ContentLengthHeader) != "" {
+		t.Errorf("hit after a head-only miss: %q, headers %v", w.Body.String(), w.Header())
+	}
+}
+
+func TestRoundTripperReplayContentLength(t *testing.T) {
+	c := newTestCache(t)
+	page := []byte(strings.Repeat("x", 2048))
+	rt := c.RoundTripperMiddleware(roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode:       http.StatusOK,
+			Header:           http.Header{"Content-Type": {"text/plain"}},
+			TransferEncoding: []string{"chunked"},
+			ContentLength:    -1,
+			Body:             io.NopCloser(bytes.NewReader(page)),
+		}, nil
+	}))
+	for i := range 2 {
+		resp, err := rt.RoundTrip(httptest.NewRequest(http.MethodGet, "https://r.jina.ai/https://example.com/rt", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !bytes.Equal(body, page) {
+			t.Fatalf("round trip %d: body of %d bytes, want %d", i, len(body), len(page))
+		}
+		if i == 1 {
+			if resp.ContentLength != int64(len(page)) {
+				t.Errorf("replay ContentLength = %d, want %d", resp.ContentLength, len(page))
+			}
+			if got := resp.Header.Get("Content-Length"); got != "2048" {
+				t.Errorf("replay Content-Length = %q, want 2048", got)
+			}
+		}
+	}
+}
+
+func TestReplayMultiValueHeaders(t *testing.T) {
+	want := http.Header{
+		"Set-Cookie": {"a=1; Path=/; Expires=Wed, 21 Oct 2026 07:28:00 GMT", "b=2; HttpOnly"},
+		"Link":       {`<https://example.com/2>; rel="next"`, `<https://example.com/1>; rel="prev"`},
+		// folded values, a single value holding a comma separated list
+		"Vary":          {"Accept-Encoding, User-Agent"},
+		"Cache-Control": {"public, max-age=60"},
+	}
+	c := newTestCache(t)
+	srv := httptest.NewServer(c.HTTPHandlerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range want {
+			for _, value := range v {
+				w.Header().Add(k, value)
+			}
+		}
+		w.Write([]byte("ok"))
+	})))
+	defer srv.Close()
+
+	for _, state := range []string{"MISS", "HIT"} {
+		resp, err := http.Get(srv.URL + "/jina/https://example.com/cookies")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		for k, v := range want {
+			if got := resp.Header.Values(k); !slices.Equal(got, v) {
+				t.Errorf("%s: %s = %q, want %q", state, k, got, v)
+			}
+		}
+		if got := len(resp.Cookies()); got != 2 {
+			t.Errorf("%s: %d cookies, want 2", state, got)
+		}
+	}
+}
+
+func TestCopyHeaderReplaces(t *testing.T) {
+	dst := http.Header{"Set-Cookie": {"stale=1"}, "X-Kept": {"yes"}}
+	copyHeader(dst, http.Header{"Set-Cookie": {"a=1", "b=2"}})
+	if got := dst.Values("Set-Cookie"); !slices.Equal(got, []string{"a=1", "b=2"}) {
+		t.Errorf("Set-Cookie = %q", got)
+	}
+	if dst.Get("X-Kept") != "yes" {
+		t.Errorf("X-Kept dropped")
+	}
+}
+
+func TestKeyConfigSeparatesEntries(t *testing.T) {
+	adapter := cachetest.NewMemoryAdapter()
+	newCache := func(config string) http.Handler {
+		c, err := New(
+			WithAdapter(adapter),
+			WithTTL(time.Hour),
+			WithKeyConfig(config),
+			WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.HTTPHandlerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(config))
+		}))
+	}
+	get := func(h http.Handler) string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fetch/https://example.com/", nil))
+		return w.Body.String()
+	}
+	if got := get(newCache("extract=markdown")); got != "extract=markdown" {
+		t.Fatalf("first answer %q", got)
+	}
+	if got := get(newCache("extract=text")); got != "extract=text" {
+		t.Errorf("another config served %q", got)
+	}
+	if got := get(newCache("extract=markdown")); got != "extract=markdown" {
+		t.Errorf("same config served %q", got)
+	}
+}
+
+func TestIncompatibleEntriesAreEvicted(t *testing.T) {
+	c := newTestCache(t)
+	h := c.HTTPHandlerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fresh"))
+	}))
+	evictions := func() int64 {
+		v, _ := versionMetrics.Get("mismatch_evictions").(*expvar.Int)
+		if v == nil {
+			return 0
+		}
+		return v.Value()
+	}
+	now := time.Now()
+	for name, entry := range map[string][]byte{
+		"foreign namespace": Response{Value: []byte("stale"), Namespace: c.namespace + 1, Expiration: now.Add(time.Hour)}.Bytes(),
+		"old serialization": []byte("not a gob entry"),
+	} {
+		key := c.generateKey("/jina/https://example.com/" + strings.ReplaceAll(name, " ", "-"))
+		c.adapter.Set(key, entry, now.Add(time.Hour))
+		before := evictions()
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/jina/https://example.com/"+strings.ReplaceAll(name, " ", "-"), nil))
+		if got := w.Body.String(); got != "fresh" {
+			t.Errorf("%s: served %q", name, got)
+		}
+		if evictions() != before+1 {
+			t.Errorf("%s: eviction not counted", name)
+		}
+		response, ok := c.lookup(context.Background(), key)
+		if !ok || response.Namespace != c.namespace {
+			t.Errorf("%s: entry not replaced", name)
+		}
+	}
+}
+
+func TestSnapshotKeepsReplacedEntries(t *testing.T) {
+	c, err := New(
+		WithAdapter(cachetest.NewMemoryAdapter()),
+		WithTTL(time.Hour),
+		WithRefreshKey("refresh"),
+		WithLogger(slog.New(slog.DiscardHandler)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer := "before"
+	h := c.HTTPHandlerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(answer))
+	}))
+	get := func(url, label string) string {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		if label != "" {
+			req.Header.Set(SnapshotHeader, label)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+	get("/a", "")
+	if _, err := c.CreateSnapshot(context.Background(), "v1"); err != nil {
+		t.Fatal(err)
+	}
+	// the live entry is replaced before the snapshot reads it
+	answer = "after"
+	if got := get("/a?refresh", ""); got != "after" {
+		t.Fatalf("refreshed live entry = %q, want after", got)
+	}
+	if got := get("/a", "v1"); got != "before" {
+		t.Errorf("snapshot entry = %q, want before", got)
+	}
+	// entries missing from the snapshot are recorded on first read
+	if got := get("/b", "v1"); got != "after" {
+		t.Errorf("recorded snapshot entry = %q, want after", got)
+	}
+	answer = "later"
+	if got := get("/b", "v1"); got != "after" {
+		t.Errorf("snapshot entry = %q, want the recorded after", got)
+	}
+}
+
+func TestProvenanceHeaders(t *testing.T) {
+	c, err := New(
+		WithAdapter(cachetest.NewMemoryAdapter()),
+		WithTTL(time.Hour),
+		WithProvenanceHeaders("X-Credits"),
+		WithLogger(slog.New(slog.DiscardHandler)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := c.HTTPHandlerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(upstreamProviderHeader, "serper")
+		w.Header().Set("X-Credits", "2")
+		w.Write([]byte("answer"))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/a", nil))
+	req := httptest.NewRequest(http.MethodGet, "/a", nil)
+	req.Header.Set(DebugHeader, "1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get("X-Cache"); got != "HIT" {
+		t.Fatalf("X-Cache = %q, want HIT", got)
+	}
+	if got := rec.Header().Get("X-Cache-Upstream-Credits"); got != "2" {
+		t.Errorf("X-Cache-Upstream-Credits = %q, want 2", got)
+	}
+}
+
+func TestReplicatedAdapter(t *testing.T) {
+	local := cachetest.NewMemoryAdapter()
+	remote := cachetest.NewMemoryAdapter()
+	a, err := NewReplicatedAdapter(local, remote, 2, 10, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiration := time.Now().Add(time.Hour)
+	entry := Response{Value: []byte("answer"), Expiration: expiration}.Bytes()
+
+	// another region's entry is read on a local miss and copied locally
+	remote.Set(1, entry, expiration)
+	if got, ok := a.Get(context.Background(), 1); !ok || !bytes.Equal(got, entry) {
+		t.Fatalf("remote entry not served")
+	}
+	if _, ok := local.Get(context.Background(), 1); !ok {
+		t.Errorf("remote entry not backfilled")
+	}
+
+	// writes and releases reach the remote
+	a.Set(2, entry, expiration)
+	a.Release(context.Background(), 1)
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := remote.Get(context.Background(), 2); !ok || !bytes.Equal(got, entry) {
+		t.Errorf("write not replicated")
+	}
+	if _, ok := remote.Get(context.Background(), 1); ok {
+		t.Errorf("release not replicated")
+	}
+	if _, ok := local.Get(context.Background(), 1); ok {
+		t.Errorf("release not applied locally")
+	}
+}
+
+func TestReadOnlyCache(t *testing.T) {
+	adapter := cachetest.NewMemoryAdapter()
+	upstreamCalls := 0
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalls++
+		w.Write([]byte("answer"))
+	})
+	newCache := func(readOnly bool) http.Handler {
+		c, err := New(
+			WithAdapter(adapter),
+			WithTTL(time.Hour),
+			WithRefreshKey("refresh"),
+			WithReadOnly(readOnly),
+			WithLogger(slog.New(slog.DiscardHandler)),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.HTTPHandlerMiddleware(upstream)
+	}
+	serve := func(h http.Handler, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	serve(newCache(false), "/jina/https://example.com/cached")
+	stored := adapter.Entries()
+	reader := newCache(true)
+
+	if w := serve(reader, "/jina/https://example.com/cached"); w.Code != http.StatusOK || w.Body.String() != "answer" {
+		t.Errorf("hit answered %d %q", w.Code, w.Body.String())
+	}
+	for _, target := range []string{"/jina/https://example.com/missing", "/jina/https://example.com/cached?refresh"} {
+		if w := serve(reader, target); w.Code != http.StatusGatewayTimeout {
+			t.Errorf("%s answered %d, want 504", target, w.Code)
+		}
+	}
+	if upstreamCalls != 1 {
+		t.Errorf("upstream called %d times, want once by the writer", upstreamCalls)
+	}
+	if !maps.EqualFunc(adapter.Entries(), stored, bytes.Equal) {
+		t.Errorf("read-only cache wrote to the adapter")
+	}
+}
+
+func TestDetectContent(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		body   string
+		want   Content
+	}{
+		{"declared language", http.Header{"Content-Language": {"de-DE, en"}}, "<html><body>Hallo</body></html>", Content{Type: "text/html", Language: "de"}},
+		{"html lang", nil, `<!DOCTYPE html><html lang="fr-CA"><body>Bonjour</body></html>`, Content{Type: "text/html", Language: "fr"}},
+		{"english text", nil, "Title: Go\n\nThe language is fast and it is the one we use for this service, with the tooling of the team.", Content{Type: "text/plain", Language: "en"}},
+		{"spanish html", nil, "<html><body><p>El lenguaje es rápido y es el que usamos para los servicios de la empresa, con las herramientas del equipo.</p></body></html>", Content{Type: "text/html", Language: "es"}},
+		{"russian", nil, "Этот язык быстрый, и мы используем его для этого сервиса каждый день.", Content{Type: "text/plain", Language: "ru"}},
+		{"japanese", nil, "この言語は速くて、私たちはこのサービスのために毎日それを使っています。", Content{Type: "text/plain", Language: "ja"}},
+		{"json", nil, `{"data": {"title": "Go", "content": "short"}}`, Content{Type: "application/json"}},
+		{"pdf", nil, "%PDF-1.7\n...", Content{Type: "application/pdf"}},
+		{"empty", nil, "", Content{}},
+	}
+	for _, tt := range tests {
+		if got := detectContent(tt.header, []byte(tt.body)); got != tt.want {
+			t.Errorf("%s: detectContent() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRevalidation(t *testing.T) {
+	adapter := cachetest.NewMemoryAdapter()
+	var conditional []string
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conditional = append(conditional, r.Header.Get("If-None-Match"))
+		w.Header().Set(upstreamProviderHeader, "fetch")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.Header().Set("X-Revalidated", "true")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("page"))
+	})
+	c, err := New(
+		WithAdapter(adapter),
+		WithTTL(time.Millisecond),
+		WithRevalidation(time.Hour, "fetch"),
+		WithLogger(slog.New(slog.DiscardHandler)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := c.HTTPHandlerMiddleware(upstream)
+
+	for i := range 2 {
+		time.Sleep(5 * time.Millisecond)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fetch/https://example.com/", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "page" {
+			t.Errorf("request %d answered %d %q", i, w.Code, w.Body.String())
+		}
+		if w.Header().Get("X-Revalidated") != "" {
+			t.Errorf("request %d answered the headers of the 304", i)
+		}
+	}
+	if !slices.Equal(conditional, []string{"", `"v1"`}) {
+		t.Errorf("upstream asked with If-None-Match %q, want a full then a conditional request", conditional)
+	}
+	if len(adapter.Entries()) != 1 {
+		t.Errorf("%d entries kept, want the revalidated one", len(adapter.Entries()))
+	}
+}
+
+func TestEntryFrequency(t *testing.T) {
+	now := time.Now()
+	stored := func(response Response) []byte {
+		b, err := msgpack.Marshal(response.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	if frequency, ok := entryFrequency(stored(Response{Frequency: 7, Expiration: now.Add(time.Hour)}), now); !ok || frequency != 7 {
+		t.Errorf("entryFrequency() = %d, %v, want 7, true", frequency, ok)
+	}
+	if _, ok := entryFrequency(stored(Response{Frequency: 7, Expiration: now.Add(-time.Hour)}), now); ok {
+		t.Errorf("expired entry warmed")
+	}
+	body, _ := msgpack.Marshal([]byte("<html>a streamed body</html>"))
+	if _, ok := entryFrequency(body, now); ok {
+		t.Errorf("streamed body warmed as an entry")
+	}
+}
+
+func TestProviderLocalCache(t *testing.T) {
+	rules, err := ParseLocalCacheRules("fetch=10/1h, serper=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ra := &RedisAdapter{localEntries: 10, localTTL: time.Hour, localRules: rules}
+	local := ra.newLocalCache()
+	stored := func(provider string) []byte {
+		b, err := msgpack.Marshal(Response{Provenance: Provenance{Provider: provider}}.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	body, _ := msgpack.Marshal([]byte("streamed body"))
+	for key, value := range map[string][]byte{"fetch": stored("fetch"), "serper": stored("serper"), "jina": stored("jina"), "body": body} {
+		local.Set(key, value)
+	}
+	for key, want := range map[string]bool{"fetch": true, "serper": false, "jina": true, "body": true} {
+		if _, ok := local.Get(key); ok != want {
+			t.Errorf("local value of %s kept = %v, want %v", key, ok, want)
+		}
+	}
+	local.Del("fetch")
+	if _, ok := local.Get("fetch"); ok {
+		t.Errorf("deleted value still kept")
+	}
+
+	if local := (&RedisAdapter{localEntries: 0, localTTL: time.Hour}).newLocalCache(); local != nil {
+		t.Errorf("disabled local cache = %T, want nil", local)
+	}
+}
+
+// slowAdapter delays the reads of the adapter it wraps.
+type slowAdapter struct {
+	Adapter
+	delay time.Duration
+}
+
+func (a slowAdapter) Get(ctx context.Context, key uint64) ([]byte, bool) {
+	time.Sleep(a.delay)
+	return a.Adapter.Get(ctx, key)
+}
+
+func TestStrongConsistency(t *testing.T) {
+	redis := cachetest.NewMemoryAdapter()
+	a := NewBoundedAdapter(slowAdapter{redis, 50 * time.Millisecond}, 0, 0, 0, time.Millisecond, 1<<20)
+	expiration := time.Now().Add(time.Hour)
+	a.Set(1, []byte("old"), expiration)
+	// another replica replaced the value
+	redis.Set(1, []byte("new"), expiration)
+
+	if got, _ := a.Get(context.Background(), 1); string(got) != "old" {
+		t.Errorf("hedged read = %q, want the local value", got)
+	}
+	if got, _ := a.Get(Strong(context.Background()), 1); string(got) != "new" {
+		t.Errorf("strong read = %q, want the Redis value", got)
+	}
+
+	c, err := New(
+		WithAdapter(redis),
+		WithTTL(time.Hour),
+		WithStrongConsistency("serper"),
+		WithLogger(slog.New(slog.DiscardHandler)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]bool{"/serper/search": true, "/fetch/https://serper.dev": false, "/": false} {
+		if got := c.strong(httptest.NewRequest(http.MethodGet, path, nil)); got != want {
+			t.Errorf("strong(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestBudget(t *testing.T) {
+	var estimate MemoryEstimate
+	b := NewBudget(1000, time.Minute, 10, func(context.Context) (MemoryEstimate, error) {
+		return estimate, nil
+	}, time.Minute, slog.New(slog.DiscardHandler))
+	store := cachetest.NewMemoryAdapter()
+	c, err := New(
+		WithAdapter(store),
+		WithTTL(time.Hour),
+		WithBudget(b),
+		WithLogger(slog.New(slog.DiscardHandler)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiration := time.Now().Add(time.Hour)
+
+	estimate.Cache = 900
+	if err := b.Check(context.Background()); err != nil || b.Over() {
+		t.Fatalf("under the budget: over %v, error %v", b.Over(), err)
+	}
+	c.store(1, Response{Value: []byte("a large answer"), Expiration: expiration})
+	if _, ok := store.Get(context.Background(), 1); !ok {
+		t.Errorf("entry not stored under the budget")
+	}
+
+	estimate.Cache = 1100
+	if err := b.Check(context.Background()); err != nil || !b.Over() {
+		t.Fatalf("over the budget: over %v, error %v", b.Over(), err)
+	}
+	c.store(2, Response{Value: []byte("a large answer"), Expiration: expiration})
+	if _, ok := store.Get(context.Background(), 2); ok {
+		t.Errorf("large entry stored over the budget")
+	}
+	c.store(3, Response{Value: []byte("small"), Expiration: expiration})
+	b3, ok := store.Get(context.Background(), 3)
+	if !ok {
+		t.Fatalf("small entry not stored over the budget")
+	}
+	if response, _ := BytesToResponse(b3); response.Expiration.After(time.Now().Add(time.Minute)) {
+		t.Errorf("expiration %v not shortened", response.Expiration)
+	}
+
+	if used := usedMemory("# Memory\r\nused_memory:1048576\r\nused_memory_human:1.00M\r\n"); used != 1<<20 {
+		t.Errorf("usedMemory = %d, want %d", used, 1<<20)
+	}
+}
+
+func TestStreamedBodiesAreVersioned(t *testing.T) {
+	store := cachetest.NewMemoryAdapter()
+	c, err := New(
+		WithAdapter(store),
+		WithTTL(time.Hour),
+		WithStreamThreshold(4),
+		WithLogger(slog.New(slog.DiscardHandler)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	expiration := time.Now().Add(time.Hour)
+	entry := func() Response {
+		b, ok := store.Get(ctx, 1)
+		if !ok {
+			t.Fatalf("entry not stored")
+		}
+		response, err := BytesToResponse(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	// two stores of the same key, e.g. by two instances: each entry must
+	// point at the body stored with it, whichever body was written last
+	c.store(1, Response{Value: []byte("first answer"), Expiration: expiration})
+	first := entry()
+	c.store(1, Response{Value: []byte("second answer"), Expiration: expiration})
+	second := entry()
+	if !first.Streamed || !second.Streamed || first.BodyVersion == 0 || first.BodyVersion == second.BodyVersion {
+		t.Fatalf("body versions %d and %d", first.BodyVersion, second.BodyVersion)
+	}
+	for response, want := range map[*Response]string{&first: "first answer", &second: "second answer"} {
+		body, ok := c.body(ctx, 1, *response)
+		if !ok {
+			t.Fatalf("body of version %d missing", response.BodyVersion)
+		}
+		got, _ := io.ReadAll(body)
+		if string(got) != want {
+			t.Errorf("version %d read %q, want %q", response.BodyVersion, got, want)
+		}
+	}
+
+	c.release(ctx, 1)
+	if _, ok := store.Get(ctx, bodyKey(1, second.BodyVersion)); ok {
+		t.Errorf("body of the released entry kept")
+	}
+	if _, ok := store.Get(ctx, bodyKey(1, first.BodyVersion)); !ok {
+		t.Errorf("body of the overwritten entry released before it expired")
+	}
+}
+
+func TestPages(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Query().Get("page"))
+		mu.Unlock()
+		w.Write([]byte("results of page " + r.URL.Query().Get("page")))
+	})
+	pageOf := func(r *http.Request, _ []byte) (string, int, bool) {
+		query := r.URL.Query()
+		page, _ := strconv.Atoi(query.Get("page"))
+		query.Del("page")
+		return r.URL.Path + "?" + query.Encode(), page, page > 0
+	}
+	next := func(r *http.Request, _ []byte) *http.Request {
+		query := r.URL.Query()
+		page, _ := strconv.Atoi(query.Get("page"))
+		query.Set("page", strconv.Itoa(page+1))
+		r.URL.RawQuery = query.Encode()
+		return r
+	}
+	c, err := New(
+		WithAdapter(cachetest.NewMemoryAdapter()),
+		WithTTL(time.Hour),
+		WithPages(&Pages{Of: pageOf, Next: next, Prefetch: true}),
+		WithLogger(slog.New(slog.DiscardHandler)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := c.HTTPHandlerMiddleware(upstream)
+	get := func(page string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/serper/search?q=golang&page="+page, nil)
+		r.Header.Set(DebugHeader, "1")
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	get("1")
+	page2, _ := c.requestKey(httptest.NewRequest(http.MethodGet, "/serper/search?q=golang&page=2", nil))
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if _, ok := c.lookup(context.Background(), page2); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("page 2 not prefetched")
+		}
+	}
+	w := get("2")
+	if w.Header().Get("X-Cache") != "HIT" || w.Body.String() != "results of page 2" {
+		t.Errorf("page 2 answered %q, %s", w.Body.String(), w.Header().Get("X-Cache"))
+	}
+	group := w.Header().Get("X-Cache-Group")
+	if group == "" {
+		t.Fatalf("page 2 has no query group")
+	}
+	mu.Lock()
+	if !slices.Equal(fetched, []string{"1", "2"}) {
+		t.Errorf("upstream fetched pages %q, want 1 then 2", fetched)
+	}
+	mu.Unlock()
+
+	if purged, err := c.PurgeGroup(context.Background(), group); err != nil || purged != 2 {
+		t.Errorf("PurgeGroup() = %d, %v, want 2 pages", purged, err)
+	}
+	if _, ok := c.lookup(context.Background(), page2); ok {
+		t.Errorf("page 2 kept after its group was purged")
+	}
+}
+
+func TestTTLJitter(t *testing.T) {
+	c, err := New(
+		WithAdapter(cachetest.NewMemoryAdapter()),
+		WithTTL(24*time.Hour),
+		WithTTLRules([]TTLRule{{Status: "3xx", TTL: time.Hour}}),
+		WithTTLJitter(10),
+		WithLogger(slog.New(slog.DiscardHandler)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[time.Duration]bool{}
+	for range 100 {
+		ttl := c.entryTTL("fetch", http.StatusOK, 100)
+		if ttl < 21*time.Hour+36*time.Minute || ttl > 26*time.Hour+24*time.Minute {
+			t.Fatalf("ttl %v out of 24h ± 10%%", ttl)
+		}
+		seen[ttl] = true
+	}
+	if len(seen) < 50 {
+		t.Errorf("%d distinct TTLs out of 100, want them spread", len(seen))
+	}
+	if ttl := c.entryTTL("fetch", http.StatusFound, 100); ttl < 54*time.Minute || ttl > 66*time.Minute {
+		t.Errorf("redirect ttl %v out of its rule's 1h ± 10%%", ttl)
+	}
+	if _, err := New(WithTTLJitter(100)); err == nil {
+		t.Errorf("jitter of 100%% accepted")
+	}
+}
+
+// expiringAdapter is a MemoryAdapter counting the writes, that can move
+// expirations.
+type expiringAdapter struct {
+	*cachetest.MemoryAdapter
+	sets, expires int
+}
+
+func (m *expiringAdapter) Set(key uint64, response []byte, expiration time.Time) {
+	m.sets++
+	m.MemoryAdapter.Set(key, response, expiration)
+}
+
+func (m *expiringAdapter) Expire(ctx context.Context, key uint64, expiration time.Time) bool {
+	_, ok := m.Get(ctx, key)
+	if ok {
+		m.expires++
+	}
+	return ok
+}
+
+func TestRefreshKeepsSameBody(t *testing.T) {
+	value := strings.Repeat("stable document ", 8)
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(value))
+	})
+	adapter := &expiringAdapter{MemoryAdapter: cachetest.NewMemoryAdapter()}
+	c, err := New(
+		WithAdapter(adapter),
+		WithTTL(time.Hour),
+		WithRefreshKey("refresh"),
+		WithStreamThreshold(64),
+		WithLogger(slog.New(slog.DiscardHandler)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := c.HTTPHandlerMiddleware(upstream)
+	get := func(target string) string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w.Body.String()
+	}
+
+	get("/fetch/https://example.com/")
+	if adapter.sets != 2 {
+		t.Fatalf("first store wrote %d keys, want the body and the entry", adapter.sets)
+	}
+	adapter.sets = 0
+	get("/fetch/https://example.com/?refresh=1")
+	if adapter.sets != 1 || adapter.expires != 1 {
+		t.Errorf("refresh to the same body wrote %d keys and expired %d, want the entry written and the body expired", adapter.sets, adapter.expires)
+	}
+	if got := get("/fetch/https://example.com/"); got != value {
+		t.Errorf("hit after refresh = %q, want the kept body", got)
+	}
+
+	value = strings.Repeat("changed document ", 8)
+	adapter.sets = 0
+	get("/fetch/https://example.com/?refresh=1")
+	if adapter.sets != 2 {
+		t.Errorf("refresh to another body wrote %d keys, want the body and the entry", adapter.sets)
+	}
+	if got := get("/fetch/https://example.com/"); got != value {
+		t.Errorf("hit after refresh = %q, want the new body", got)
+	}
+}
+
+func TestAsyncAdapterAfterClose(t *testing.T) {
+	store := cachetest.NewMemoryAdapter()
+	a, err := NewAsyncAdapter(store, 2, 4, OverflowBlock, slog.New(slog.DiscardHandler))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	a.Set(1, []byte("kept"), time.Now().Add(time.Hour))
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := store.Get(ctx, 1); !ok || string(b) != "kept" {
+		t.Errorf("queued write not applied by Close")
+	}
+	// writes after Close are dropped, they don't panic
+	a.Set(2, []byte("late"), time.Now().Add(time.Hour))
+	a.Release(ctx, 1)
+	if _, ok := a.Get(ctx, 2); ok {
+		t.Errorf("write after Close served")
+	}
+	if err := a.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestAsyncAdapterPendingExpiration(t *testing.T) {
+	store := cachetest.NewMemoryAdapter()
+	store.Set(1, []byte("stored"), time.Now().Add(time.Hour))
+	a := &AsyncAdapter{Adapter: store, pending: map[uint64]*asyncOp{
+		1: {key: 1, value: []byte("pending"), expiration: time.Now().Add(-time.Second)},
+	}}
+	ctx := context.Background()
+	if b, ok := a.Get(ctx, 1); ok {
+		t.Errorf("expired pending write served %q", b)
+	}
+	if found := a.GetMulti(ctx, []uint64{1}); len(found) != 0 {
+		t.Errorf("expired pending write served by GetMulti")
+	}
+	if _, ok := a.GetReader(ctx, 1); ok {
+		t.Errorf("expired pending write served by GetReader")
+	}
+}
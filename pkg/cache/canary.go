@@ -0,0 +1,221 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"expvar"
+	"hash"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var canaryMetrics = expvar.NewMap("cache_canary")
+
+// canaryMaxBody is the size of the answers copied for the shadow, larger ones
+// are compared by digest and not stored in the shadow.
+const canaryMaxBody = 8 << 20
+
+// KeyFunc returns the key a request is cached under, see Cache.RequestKey.
+type KeyFunc func(r *http.Request) (uint64, error)
+
+// Namespace is an Adapter keeping its entries apart from the other users of
+// the same store, e.g. a canary cache sharing the Redis of the primary.
+type Namespace struct {
+	Adapter
+	prefix string
+}
+
+// NewNamespace creates a new Namespace of next.
+func NewNamespace(next Adapter, prefix string) *Namespace {
+	return &Namespace{Adapter: next, prefix: prefix}
+}
+
+func (n *Namespace) key(key uint64) uint64 {
+	return generateKey(n.prefix + ":" + KeyAsString(key))
+}
+
+// Get implements the cache Adapter interface Get method.
+func (n *Namespace) Get(ctx context.Context, key uint64) ([]byte, bool) {
+	return n.Adapter.Get(ctx, n.key(key))
+}
+
+// Set implements the cache Adapter interface Set method.
+func (n *Namespace) Set(key uint64, response []byte, expiration time.Time) {
+	n.Adapter.Set(n.key(key), response, expiration)
+}
+
+// Expire implements the Expirer interface when next does.
+func (n *Namespace) Expire(ctx context.Context, key uint64, expiration time.Time) bool {
+	return expire(ctx, n.Adapter, n.key(key), expiration)
+}
+
+// Release implements the cache Adapter interface Release method.
+func (n *Namespace) Release(ctx context.Context, key uint64) {
+	n.Adapter.Release(ctx, n.key(key))
+}
+
+// GetMulti implements the cache Adapter interface GetMulti method.
+func (n *Namespace) GetMulti(ctx context.Context, keys []uint64) map[uint64][]byte {
+	byNamespaced := make(map[uint64]uint64, len(keys))
+	namespaced := make([]uint64, len(keys))
+	for i, key := range keys {
+		namespaced[i] = n.key(key)
+		byNamespaced[namespaced[i]] = key
+	}
+	found := n.Adapter.GetMulti(ctx, namespaced)
+	result := make(map[uint64][]byte, len(found))
+	for k, v := range found {
+		result[byNamespaced[k]] = v
+	}
+	return result
+}
+
+// GetReader implements the cache Adapter interface GetReader method.
+func (n *Namespace) GetReader(ctx context.Context, key uint64) (io.ReadCloser, bool) {
+	return n.Adapter.GetReader(ctx, n.key(key))
+}
+
+type outcomeKey struct{}
+
+// outcome is filled by the middleware for the canary.
+type outcome struct {
+	hit bool
+}
+
+func markHit(ctx context.Context) {
+	if o, ok := ctx.Value(outcomeKey{}).(*outcome); ok {
+		o.hit = true
+	}
+}
+
+// Canary runs a share of the traffic through a secondary cache in shadow, to
+// compare its hit rate and answers with the primary before a cutover. The
+// shadow never calls upstream: its misses are filled with the primary answer,
+// its hits are compared with it. Results are in the "cache_canary" expvar map.
+type Canary struct {
+	shadow    *Cache
+	candidate KeyFunc
+	percent   float64
+	logger    *slog.Logger
+}
+
+// NewCanary creates a new Canary sampling percent, from 0 to 100, of the
+// requests. The shadow keys them with candidate, e.g. a new key scheme, or
+// shadow.RequestKey when nil.
+func NewCanary(shadow *Cache, candidate KeyFunc, percent float64, logger *slog.Logger) *Canary {
+	if candidate == nil {
+		candidate = shadow.RequestKey
+	}
+	return &Canary{shadow: shadow, candidate: candidate, percent: percent, logger: logger}
+}
+
+// HTTPHandlerMiddleware wraps a handler served by the primary cache.
+func (c *Canary) HTTPHandlerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !c.shadow.cacheableMethod(r.Method) || rand.Float64()*100 >= c.percent {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, err := c.candidate(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		o := &outcome{}
+		rw := &canaryWriter{ResponseWriter: w, statusCode: http.StatusOK, digest: sha256.New()}
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), outcomeKey{}, o)))
+		if rw.statusCode >= 400 {
+			return
+		}
+		canaryMetrics.Add("sampled", 1)
+		if o.hit {
+			canaryMetrics.Add("primary_hits", 1)
+		}
+		// the client has its answer, the shadow work doesn't hold it
+		go c.compare(context.WithoutCancel(r.Context()), key, rw.Header().Clone(), rw)
+	})
+}
+
+func (c *Canary) compare(ctx context.Context, key uint64, header http.Header, primary *canaryWriter) {
+	s := c.shadow
+	if response, ok := s.lookup(ctx, key); ok {
+		if value, found := s.body(ctx, key, response); found {
+			defer value.Close()
+			digest := sha256.New()
+			size, err := io.Copy(digest, value)
+			if err == nil {
+				canaryMetrics.Add("shadow_hits", 1)
+				if !bytes.Equal(digest.Sum(nil), primary.digest.Sum(nil)) {
+					canaryMetrics.Add("mismatches", 1)
+					c.logger.Warn("Canary cache answer differs", "key", key, "primary_size", primary.size, "shadow_size", size)
+				}
+				return
+			}
+		}
+	}
+	if primary.overflow {
+		canaryMetrics.Add("shadow_too_large", 1)
+		return
+	}
+	for name := range header {
+		if strings.HasPrefix(name, "X-Cache") || name == "Expires" {
+			header.Del(name)
+		}
+	}
+	if matchContentRule(s.contentRules, header).Skip {
+		return
+	}
+	now := time.Now()
+	s.store(key, Response{
+		Value:      primary.body.Bytes(),
+		Header:     header,
+		Expiration: now.Add(s.ttl),
+		LastAccess: now,
+		Frequency:  1,
+		Created:    now,
+	})
+	canaryMetrics.Add("shadow_stores", 1)
+}
+
+// canaryWriter keeps the digest of the answer for the shadow, and a copy of
+// it up to canaryMaxBody.
+type canaryWriter struct {
+	http.ResponseWriter
+	statusCode int
+	digest     hash.Hash
+	size       int64
+	body       bytes.Buffer
+	// overflow is set once the answer outgrew canaryMaxBody, the copy is dropped
+	overflow bool
+}
+
+func (w *canaryWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *canaryWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.digest.Write(b[:n])
+	w.size += int64(n)
+	if !w.overflow {
+		if w.body.Len()+n > canaryMaxBody {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b[:n])
+		}
+	}
+	return n, err
+}
+
+func (w *canaryWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
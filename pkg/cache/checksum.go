@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// digestAlgorithms are the digest algorithms checked, others are ignored.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+	"md5":     md5.New,
+}
+
+// verifyBody checks an upstream body against its Content-Length and, when
+// present, its Digest, Content-Digest, Repr-Digest or Content-MD5, so a body
+// cut mid-stream isn't cached. ETags are opaque and aren't checked.
+func verifyBody(header http.Header, body []byte) error {
+	if v := header.Get("Content-Length"); v != "" {
+		length, err := strconv.ParseInt(v, 10, 64)
+		if err == nil && length != int64(len(body)) {
+			return fmt.Errorf("got %d bytes of %d", len(body), length)
+		}
+	}
+	if v := header.Get("Content-MD5"); v != "" {
+		if err := checkDigest("md5", v, body); err != nil {
+			return err
+		}
+	}
+	// Digest: sha-256=X48E9q...=, Content-Digest: sha-256=:X48E9q...=:
+	for _, name := range []string{"Digest", "Content-Digest", "Repr-Digest"} {
+		for _, field := range header.Values(name) {
+			for _, part := range strings.Split(field, ",") {
+				algorithm, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+				if !ok {
+					continue
+				}
+				if err := checkDigest(strings.ToLower(algorithm), strings.Trim(value, ":"), body); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func checkDigest(algorithm, value string, body []byte) error {
+	newHash, ok := digestAlgorithms[algorithm]
+	if !ok {
+		return nil
+	}
+	want, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		// not a digest we can read, don't hold the answer against it
+		return nil
+	}
+	h := newHash()
+	h.Write(body)
+	if !bytes.Equal(h.Sum(nil), want) {
+		return fmt.Errorf("%s digest mismatch", algorithm)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type strongKey struct{}
+
+// Strong marks a context so the adapters read the latest value from Redis,
+// skipping their local caches, which may be behind the writes of another
+// replica until they expire.
+func Strong(ctx context.Context) context.Context {
+	return context.WithValue(ctx, strongKey{}, true)
+}
+
+// strongRead reports whether the context was marked by Strong.
+func strongRead(ctx context.Context) bool {
+	v, _ := ctx.Value(strongKey{}).(bool)
+	return v
+}
+
+// WithStrongConsistency reads the requests of routes, e.g. "serper" for
+// "/serper/...", from Redis, so they never see an entry another replica
+// released or replaced. The other routes, e.g. the immutable crawls, keep
+// the local caches. Optional setting.
+func WithStrongConsistency(routes ...string) Option {
+	return func(c *Cache) error {
+		c.strongRoutes = routes
+		return nil
+	}
+}
+
+// strong reports whether r is read with strong consistency.
+func (c *Cache) strong(r *http.Request) bool {
+	if len(c.strongRoutes) == 0 {
+		return false
+	}
+	route, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	return slices.Contains(c.strongRoutes, route)
+}
@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// maxDetectSize caps what's read of a body to detect its content.
+const maxDetectSize = 64 << 10
+
+// Content describes the body of a cached entry, detected when it's stored,
+// so the pages in another language or of another type than announced can be
+// told apart without fetching them again.
+type Content struct {
+	// Type is the media type sniffed from the body, e.g. "text/html", which
+	// may differ from the declared Content-Type.
+	Type string `json:"type,omitempty"`
+	// Language is the ISO 639-1 code of the language of the text, e.g.
+	// "en", "" when it's unknown.
+	Language string `json:"language,omitempty"`
+}
+
+var (
+	htmlLang   = regexp.MustCompile(`(?is)<html[^>]*?\slang\s*=\s*["']?([A-Za-z]{2,3})`)
+	htmlScript = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>`)
+	htmlTag    = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// stopwords are frequent words telling the languages written in the Latin
+// script apart.
+var stopwords = map[string][]string{
+	"en": {"the", "and", "of", "to", "is", "in", "that", "it", "for", "with", "was", "on", "are", "this"},
+	"de": {"der", "die", "und", "das", "ist", "nicht", "mit", "den", "ein", "eine", "auf", "sich", "auch", "dem"},
+	"fr": {"le", "la", "les", "et", "des", "est", "une", "dans", "que", "pour", "pas", "sur", "qui", "du"},
+	"es": {"el", "la", "los", "las", "y", "que", "del", "en", "por", "una", "con", "para", "es", "se"},
+	"pt": {"o", "os", "as", "e", "que", "do", "da", "em", "um", "uma", "para", "com", "não", "dos"},
+	"it": {"il", "di", "che", "e", "la", "per", "non", "una", "sono", "della", "gli", "con", "del", "le"},
+	"nl": {"de", "het", "een", "en", "van", "is", "dat", "niet", "op", "met", "zijn", "voor", "ook", "te"},
+}
+
+// stopwordLanguages are the languages of each stopword.
+var stopwordLanguages = func() map[string][]string {
+	languages := map[string][]string{}
+	for language, words := range stopwords {
+		for _, word := range words {
+			languages[word] = append(languages[word], language)
+		}
+	}
+	return languages
+}()
+
+// scripts are the languages told by their script alone, checked in order.
+var scripts = []struct {
+	language string
+	table    *unicode.RangeTable
+}{
+	{"ja", unicode.Hiragana},
+	{"ja", unicode.Katakana},
+	{"ko", unicode.Hangul},
+	{"zh", unicode.Han},
+	{"ru", unicode.Cyrillic},
+	{"ar", unicode.Arabic},
+	{"he", unicode.Hebrew},
+	{"el", unicode.Greek},
+	{"hi", unicode.Devanagari},
+	{"th", unicode.Thai},
+}
+
+// detectContent sniffs the type and the language of a body.
+func detectContent(header http.Header, body []byte) Content {
+	body = body[:min(len(body), maxDetectSize)]
+	if len(bytes.TrimSpace(body)) == 0 {
+		return Content{}
+	}
+	content := Content{Type: sniffType(body)}
+	if lang := header.Get("Content-Language"); lang != "" {
+		// the first of "en-US, fr" is the main one
+		lang, _, _ = strings.Cut(lang, ",")
+		content.Language = baseLanguage(lang)
+		return content
+	}
+	text := string(body)
+	if content.Type == "text/html" {
+		if m := htmlLang.FindStringSubmatch(text); m != nil {
+			content.Language = baseLanguage(m[1])
+			return content
+		}
+		text = htmlTag.ReplaceAllString(htmlScript.ReplaceAllString(text, " "), " ")
+	}
+	if content.Type == "text/plain" || content.Type == "text/html" || content.Type == "application/json" {
+		content.Language = detectLanguage(text)
+	}
+	return content
+}
+
+// sniffType returns the media type of a body, telling JSON from text.
+func sniffType(body []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(body))
+	if mediaType == "text/plain" {
+		trimmed := bytes.TrimSpace(body)
+		if (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+			return "application/json"
+		}
+	}
+	return mediaType
+}
+
+// baseLanguage returns the language of a tag such as "en-US", lowercased.
+func baseLanguage(tag string) string {
+	lang, _, _ := strings.Cut(strings.TrimSpace(tag), "-")
+	lang, _, _ = strings.Cut(lang, "_")
+	return strings.ToLower(lang)
+}
+
+// detectLanguage guesses the language of a text, by its script or, for the
+// Latin script, by its most frequent words. It's "" when the text is too
+// short or ambiguous to tell.
+func detectLanguage(text string) string {
+	var letters, latin int
+	perScript := make([]int, len(scripts))
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if unicode.Is(unicode.Latin, r) {
+			latin++
+			continue
+		}
+		for i, script := range scripts {
+			if unicode.Is(script.table, r) {
+				perScript[i]++
+				break
+			}
+		}
+	}
+	if letters < 20 {
+		return ""
+	}
+	// Japanese mixes kana with Han, a few kana are enough to tell it from Chinese
+	for i, script := range scripts {
+		if script.language == "ja" && perScript[i]*10 >= letters {
+			return "ja"
+		}
+	}
+	for i, script := range scripts {
+		if script.language != "ja" && perScript[i]*2 >= letters {
+			return script.language
+		}
+	}
+	if latin*2 < letters {
+		return ""
+	}
+
+	hits := map[string]int{}
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) })
+	for _, word := range words {
+		for _, language := range stopwordLanguages[word] {
+			hits[language]++
+		}
+	}
+	var best, second string
+	for language, n := range hits {
+		switch {
+		case best == "" || n > hits[best] || n == hits[best] && language < best:
+			best, second = language, best
+		case second == "" || n > hits[second]:
+			second = language
+		}
+	}
+	// a few hits, clearly ahead of the runner-up
+	if best == "" || hits[best] < 3 || hits[best]*4 < hits[second]*5 {
+		return ""
+	}
+	return best
+}
@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ContentRule decides whether answers of a content type are cached.
+// Rules are evaluated from the upstream headers before the body is buffered,
+// so skipped answers stream straight through.
+type ContentRule struct {
+	// Pattern is a media type such as "application/json", "video/*" or "*".
+	Pattern string
+	// Skip never caches matching answers.
+	Skip bool
+	// MaxSize stops caching matching answers larger than this many bytes, 0 is unlimited.
+	MaxSize int64
+}
+
+func (cr ContentRule) matches(mediaType string) bool {
+	switch {
+	case cr.Pattern == "*":
+		return true
+	case strings.HasSuffix(cr.Pattern, "/*"):
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(cr.Pattern, "*"))
+	default:
+		return mediaType == cr.Pattern
+	}
+}
+
+// matchContentRule returns the first rule matching the answer headers.
+// Answers no rule matches are cached without limit.
+func matchContentRule(rules []ContentRule, header http.Header) ContentRule {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = ""
+	}
+	for _, rule := range rules {
+		if rule.matches(mediaType) {
+			return rule
+		}
+	}
+	return ContentRule{Pattern: "*"}
+}
+
+// ParseContentRules parses rules such as "text/*=10MB,video/*=skip,*=50MB".
+// Each rule is a media type pattern and either "skip" or a maximum size.
+func ParseContentRules(s string) ([]ContentRule, error) {
+	var rules []ContentRule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		pattern, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("content rule %q: missing '='", part)
+		}
+		rule := ContentRule{Pattern: strings.ToLower(strings.TrimSpace(pattern))}
+		value = strings.TrimSpace(value)
+		if strings.EqualFold(value, "skip") {
+			rule.Skip = true
+		} else {
+			size, err := parseSize(value)
+			if err != nil {
+				return nil, fmt.Errorf("content rule %q: %w", part, err)
+			}
+			rule.MaxSize = size
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseSize parses sizes such as "512", "64KB", "10MB" or "1GB".
+func parseSize(s string) (int64, error) {
+	upper := strings.ToUpper(s)
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		factor int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(upper, unit.suffix) {
+			upper = strings.TrimSuffix(upper, unit.suffix)
+			multiplier = unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(upper), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
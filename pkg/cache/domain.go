@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrNoDomainIndex is returned by PurgeDomain when the entries aren't indexed
+// by domain, see WithDomains.
+var ErrNoDomainIndex = errors.New("cache entries aren't indexed by domain")
+
+// DomainIndex records the cache keys fetched from each domain, see WithDomains.
+type DomainIndex interface {
+	// Add records keys under domain.
+	Add(ctx context.Context, domain string, keys ...uint64) error
+	// Keys returns the keys recorded under domain.
+	Keys(ctx context.Context, domain string) ([]uint64, error)
+	// Delete forgets the keys of domain.
+	Delete(ctx context.Context, domain string) error
+}
+
+// RedisDomainIndex is a DomainIndex keeping a Redis set of keys per domain,
+// so concurrent misses add their keys without reading the index.
+type RedisDomainIndex struct {
+	rdb redis.Cmdable
+}
+
+// NewRedisDomainIndex creates a new RedisDomainIndex.
+func NewRedisDomainIndex(rdb redis.Cmdable) *RedisDomainIndex {
+	return &RedisDomainIndex{rdb: rdb}
+}
+
+// DomainIndex returns a RedisDomainIndex kept next to the entries.
+func (ra *RedisAdapter) DomainIndex() *RedisDomainIndex {
+	return NewRedisDomainIndex(ra.ring)
+}
+
+func domainIndexKey(domain string) string {
+	return "domain:index:" + domain
+}
+
+// Add implements the DomainIndex interface Add method. The index outlives the
+// entries it points to, snapshots and archives included.
+func (d *RedisDomainIndex) Add(ctx context.Context, domain string, keys ...uint64) error {
+	members := make([]any, len(keys))
+	for i, key := range keys {
+		members[i] = KeyAsString(key)
+	}
+	_, err := d.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, domainIndexKey(domain), members...)
+		pipe.Expire(ctx, domainIndexKey(domain), archiveRetention)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("RedisDomainIndex.Add: %w", err)
+	}
+	return nil
+}
+
+// Keys implements the DomainIndex interface Keys method.
+func (d *RedisDomainIndex) Keys(ctx context.Context, domain string) ([]uint64, error) {
+	members, err := d.rdb.SMembers(ctx, domainIndexKey(domain)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("RedisDomainIndex.Keys: %w", err)
+	}
+	keys := make([]uint64, 0, len(members))
+	for _, member := range members {
+		if key, err := strconv.ParseUint(member, 36, 64); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Delete implements the DomainIndex interface Delete method.
+func (d *RedisDomainIndex) Delete(ctx context.Context, domain string) error {
+	if err := d.rdb.Del(ctx, domainIndexKey(domain)).Err(); err != nil {
+		return fmt.Errorf("RedisDomainIndex.Delete: %w", err)
+	}
+	return nil
+}
+
+// domainSuffixes returns the host and its parent domains, without the bare TLD,
+// so purging "example.com" also purges "www.example.com".
+func domainSuffixes(host string) []string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	parts := strings.Split(host, ".")
+	if len(parts) < 2 {
+		return []string{host}
+	}
+	var suffixes []string
+	for i := 0; i < len(parts)-1; i++ {
+		suffixes = append(suffixes, strings.Join(parts[i:], "."))
+	}
+	return suffixes
+}
+
+// indexDomain records keys under the domain of the request and its parent
+// domains, so they can be purged by domain.
+func (c *Cache) indexDomain(ctx context.Context, r *http.Request, keys ...uint64) {
+	if c.domains == nil {
+		return
+	}
+	host := c.domainOf(r)
+	if host == "" {
+		return
+	}
+	for _, domain := range domainSuffixes(host) {
+		if err := c.domains.Add(ctx, domain, keys...); err != nil {
+			c.logger.Warn("Failed to index cache entry by domain", "domain", domain, "error", err)
+		}
+	}
+}
+
+// PurgeDomain releases every entry fetched from domain or its subdomains,
+// with their snapshot copies and archived versions. It returns the number
+// of cache keys released.
+func (c *Cache) PurgeDomain(ctx context.Context, domain string) (int, error) {
+	if c.domains == nil {
+		return 0, ErrNoDomainIndex
+	}
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	keys, err := c.domains.Keys(ctx, domain)
+	if err != nil {
+		return 0, err
+	}
+	// the copies made when the snapshots were tagged aren't indexed
+	labels, err := c.snapshotLabels(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		for _, label := range labels {
+			c.release(ctx, snapshotKey(label, key))
+		}
+		versions, err := c.Versions(ctx, key)
+		if err != nil {
+			c.logger.Warn("Failed to read archive index", "key", key, "error", err)
+		}
+		for _, v := range versions {
+			c.adapter.Release(ctx, archiveBodyKey(v.Hash))
+		}
+		c.adapter.Release(ctx, archiveIndexKey(key))
+		c.release(ctx, key)
+	}
+	if err := c.domains.Delete(ctx, domain); err != nil {
+		return len(keys), err
+	}
+	c.logger.Info("Purged cache entries by domain", "domain", domain, "keys", len(keys))
+	return len(keys), nil
+}
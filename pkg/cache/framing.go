@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// framingHeaders describe how an answer was transferred rather than the
+// answer. They aren't cached, and Content-Length is recomputed from the
+// cached value on replay, so a chunked upstream answer or headers changed
+// since it was stored never make the length lie. Content-Encoding is kept,
+// the value is stored as it was encoded.
+var framingHeaders = []string{
+	"Content-Length",
+	"Transfer-Encoding",
+	"Trailer",
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Upgrade",
+	ContentLengthHeader,
+}
+
+// stripFraming deletes the framing headers of header.
+func stripFraming(header http.Header) {
+	for _, name := range framingHeaders {
+		header.Del(name)
+	}
+}
+
+// replayHeader returns the headers to replay a cached response with, its
+// stored headers and the Content-Length of its value when it's known.
+func replayHeader(response Response) http.Header {
+	header := response.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	stripFraming(header)
+	if size := response.size(); size >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	return header
+}
+
+// copyHeader replays the headers of src into dst, replacing the values dst
+// already has. Each value is added on its own, joining them would corrupt
+// Set-Cookie and the other headers whose values may contain commas.
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst.Del(k)
+		for _, value := range v {
+			dst.Add(k, value)
+		}
+	}
+}
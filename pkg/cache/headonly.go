@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// HeadOnlyHeader asks for the status and headers of an answer without its
+// body, e.g. for link checkers. The body size is told by ContentLengthHeader,
+// the answer has no body so its Content-Length is left out, except on HEAD
+// requests whose Content-Length the server knows not to send a body for.
+const HeadOnlyHeader = "X-Head-Only"
+
+// ContentLengthHeader tells the size of the body left out of a head-only answer.
+const ContentLengthHeader = "X-Content-Length"
+
+func headOnly(r *http.Request) bool {
+	v, _ := strconv.ParseBool(r.Header.Get(HeadOnlyHeader))
+	return v
+}
+
+// size returns the size of the cached value, or -1 when it's unknown, for
+// values streamed before sizes were recorded.
+func (r Response) size() int64 {
+	if !r.Streamed {
+		return int64(len(r.Value))
+	}
+	if r.Size > 0 {
+		return r.Size
+	}
+	return -1
+}
+
+// headOnlyLength moves the Content-Length of the head-only answer to r to
+// ContentLengthHeader.
+func headOnlyLength(r *http.Request, header http.Header) {
+	if r.Method == http.MethodHead {
+		return
+	}
+	if length := header.Get("Content-Length"); length != "" {
+		header.Set(ContentLengthHeader, length)
+	}
+	header.Del("Content-Length")
+}
+
+// headOnlyWriter drops the body of an answer, it's still buffered to be cached.
+type headOnlyWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	wroteHeader bool
+}
+
+func (w *headOnlyWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		headOnlyLength(w.r, w.Header())
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *headOnlyWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return len(b), nil
+}
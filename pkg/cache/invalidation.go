@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"context"
+	"expvar"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var invalidationMetrics = expvar.NewMap("cache_invalidation")
+
+// WithInvalidation broadcasts the released keys on a Redis pub/sub channel,
+// and evicts the keys released by the other replicas from the local cache,
+// so a purge isn't served from the local caches until they expire. Empty
+// channel disables it.
+func WithInvalidation(channel string) RedisOption {
+	return func(ra *RedisAdapter) {
+		ra.invalidationChannel = channel
+	}
+}
+
+// OnInvalidate calls evict with the keys released by any replica, e.g. to
+// evict them from a cache in front of the adapter. It's a no-op without
+// WithInvalidation.
+func (ra *RedisAdapter) OnInvalidate(evict func(key uint64)) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	ra.evictors = append(ra.evictors, evict)
+}
+
+// invalidate broadcasts that key was released.
+func (ra *RedisAdapter) invalidate(ctx context.Context, key uint64) {
+	if ra.invalidationChannel == "" {
+		return
+	}
+	if err := ra.ring.Publish(ctx, ra.invalidationChannel, KeyAsString(key)).Err(); err != nil {
+		invalidationMetrics.Add("publish_errors", 1)
+		ra.logger.Warn("Failed to broadcast cache invalidation", "key", key, "error", err)
+		return
+	}
+	invalidationMetrics.Add("published", 1)
+}
+
+// subscribe evicts the keys broadcast on the invalidation channel until ctx
+// is done. The subscription reconnects by itself after a Redis failure.
+func (ra *RedisAdapter) subscribe(ctx context.Context, pubsub *redis.PubSub) {
+	defer close(ra.subscribed)
+	defer pubsub.Close()
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			key, err := strconv.ParseUint(msg.Payload, 36, 64)
+			if err != nil {
+				ra.logger.Warn("Invalid cache invalidation", "payload", msg.Payload)
+				continue
+			}
+			invalidationMetrics.Add("received", 1)
+			if ra.local != nil {
+				ra.local.Del(msg.Payload)
+			}
+			ra.mu.Lock()
+			evictors := ra.evictors
+			ra.mu.Unlock()
+			for _, evict := range evictors {
+				evict(key)
+			}
+		}
+	}
+}
+
+// Close stops the invalidation subscription and closes the Redis clients.
+func (ra *RedisAdapter) Close() error {
+	if ra.stop != nil {
+		ra.stop()
+		<-ra.subscribed
+	}
+	return ra.ring.Close()
+}
@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// KnownMissHeader marks answers short-circuited by the known miss filter.
+const KnownMissHeader = "X-Known-Miss"
+
+// KnownMiss remembers URLs that recently answered as dead (404, 410, 451), so
+// the cache middleware answers them before the cache lookup and the upstream call.
+// URLs are kept in two rotating bloom filters, so an entry lives between one
+// and two rotation periods. False positives are possible, at the configured size
+// the rate stays under 1%.
+type KnownMiss struct {
+	mu       sync.Mutex
+	current  *bloom
+	previous *bloom
+	rotate   time.Duration
+	rotated  time.Time
+	size     int
+}
+
+// NewKnownMiss creates a known miss filter sized for about size URLs per rotation.
+func NewKnownMiss(size int, rotate time.Duration) *KnownMiss {
+	return &KnownMiss{
+		current:  newBloom(size),
+		previous: newBloom(size),
+		rotate:   rotate,
+		rotated:  time.Now(),
+		size:     size,
+	}
+}
+
+// deadStatus reports whether an upstream status marks the URL as dead.
+func deadStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusNotFound, http.StatusGone, http.StatusUnavailableForLegalReasons:
+		return true
+	}
+	return false
+}
+
+// Add records a dead URL.
+func (k *KnownMiss) Add(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.maybeRotate()
+	k.current.add(key)
+}
+
+// Contains reports whether a URL is known dead.
+func (k *KnownMiss) Contains(key string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.maybeRotate()
+	return k.current.contains(key) || k.previous.contains(key)
+}
+
+func (k *KnownMiss) maybeRotate() {
+	if time.Since(k.rotated) < k.rotate {
+		return
+	}
+	// two periods without rotation means everything has aged out
+	if time.Since(k.rotated) >= 2*k.rotate {
+		k.current = newBloom(k.size)
+	}
+	k.previous, k.current = k.current, newBloom(k.size)
+	k.rotated = time.Now()
+}
+
+// bloom is a fixed size bloom filter using double hashing.
+type bloom struct {
+	bits   []uint64
+	hashes uint64
+}
+
+func newBloom(size int) *bloom {
+	if size < 1 {
+		size = 1
+	}
+	// ~10 bits and 7 hashes per entry keep false positives under 1%
+	words := (size*10 + 63) / 64
+	return &bloom{bits: make([]uint64, words), hashes: 7}
+}
+
+func (b *bloom) locations(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return sum, (sum >> 33) | 1
+}
+
+func (b *bloom) add(key string) {
+	h1, h2 := b.locations(key)
+	n := uint64(len(b.bits)) * 64
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % n
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (b *bloom) contains(key string) bool {
+	h1, h2 := b.locations(key)
+	n := uint64(len(b.bits)) * 64
+	for i := uint64(0); i < b.hashes; i++ {
+		bit := (h1 + i*h2) % n
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"cmp"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/cache/v9"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Local cache of the Redis adapter by default.
+const (
+	defaultLocalEntries = 1000
+	defaultLocalTTL     = 10 * time.Minute
+)
+
+// RedisOption configures a RedisAdapter.
+type RedisOption func(*RedisAdapter)
+
+// WithLocalCache keeps up to entries values in a TinyLFU cache in front of
+// Redis for ttl, 1000 for 10 minutes by default. The other replicas' writes
+// are seen once the local values expire, 0 entries or ttl disables it so
+// every read sees them.
+func WithLocalCache(entries int, ttl time.Duration) RedisOption {
+	return func(ra *RedisAdapter) {
+		ra.localEntries = entries
+		ra.localTTL = ttl
+	}
+}
+
+// WithLocalCacheRules sets the local caches of the entries of some
+// providers, the other values use the WithLocalCache one.
+func WithLocalCacheRules(rules []LocalCacheRule) RedisOption {
+	return func(ra *RedisAdapter) {
+		ra.localRules = rules
+	}
+}
+
+// LocalCacheRule sets the local cache of the entries of a provider, e.g. a
+// large one for crawls or none for the answers that must be fresh.
+type LocalCacheRule struct {
+	Provider string
+	// Entries is the capacity of the cache, 0 disables it.
+	Entries int
+	// TTL is how long values are kept, the WithLocalCache one, or 10 minutes
+	// when it's disabled, when 0.
+	TTL time.Duration
+}
+
+// ParseLocalCacheRules parses rules such as "fetch=100000/1h,serper=0".
+// Each rule is a provider, a number of entries and an optional TTL.
+func ParseLocalCacheRules(s string) ([]LocalCacheRule, error) {
+	var rules []LocalCacheRule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		provider, value, ok := strings.Cut(part, "=")
+		if !ok || strings.TrimSpace(provider) == "" {
+			return nil, fmt.Errorf("local cache rule %q: expected provider=entries[/ttl]", part)
+		}
+		rule := LocalCacheRule{Provider: strings.TrimSpace(provider)}
+		entries, ttl, hasTTL := strings.Cut(value, "/")
+		n, err := strconv.Atoi(strings.TrimSpace(entries))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("local cache rule %q: invalid entries %q", part, entries)
+		}
+		rule.Entries = n
+		if hasTTL {
+			d, err := time.ParseDuration(strings.TrimSpace(ttl))
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("local cache rule %q: invalid ttl %q", part, ttl)
+			}
+			rule.TTL = d
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// newLocalCache returns the local cache of the adapter settings, nil when
+// there's none.
+func (ra *RedisAdapter) newLocalCache() cache.LocalCache {
+	var fallback cache.LocalCache
+	if ra.localEntries > 0 && ra.localTTL > 0 {
+		fallback = cache.NewTinyLFU(ra.localEntries, ra.localTTL)
+	}
+	if len(ra.localRules) == 0 {
+		return fallback
+	}
+	local := &providerLocalCache{fallback: fallback, providers: map[string]cache.LocalCache{}}
+	for _, rule := range ra.localRules {
+		var provider cache.LocalCache
+		if rule.Entries > 0 {
+			provider = cache.NewTinyLFU(rule.Entries, cmp.Or(rule.TTL, ra.localTTL, defaultLocalTTL))
+		}
+		local.providers[rule.Provider] = provider
+	}
+	return local
+}
+
+// providerLocalCache keeps the entries in the local cache of their provider.
+// A provider mapped to nil has none, the values that aren't entries of a
+// provider with a rule, e.g. the bodies of streamed entries, are kept in
+// fallback.
+type providerLocalCache struct {
+	fallback  cache.LocalCache
+	providers map[string]cache.LocalCache
+}
+
+func (lc *providerLocalCache) Set(key string, data []byte) {
+	local, ok := lc.providers[entryProvider(data)]
+	if !ok {
+		local = lc.fallback
+	}
+	if local != nil {
+		local.Set(key, data)
+	}
+}
+
+func (lc *providerLocalCache) Get(key string) ([]byte, bool) {
+	if lc.fallback != nil {
+		if b, ok := lc.fallback.Get(key); ok {
+			return b, true
+		}
+	}
+	for _, local := range lc.providers {
+		if local == nil {
+			continue
+		}
+		if b, ok := local.Get(key); ok {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+func (lc *providerLocalCache) Del(key string) {
+	if lc.fallback != nil {
+		lc.fallback.Del(key)
+	}
+	for _, local := range lc.providers {
+		if local != nil {
+			local.Del(key)
+		}
+	}
+}
+
+// entryProvider returns the provider of a stored entry, "" for the values
+// that aren't entries.
+func entryProvider(data []byte) string {
+	var b []byte
+	if err := msgpack.Unmarshal(data, &b); err != nil {
+		return ""
+	}
+	response, err := BytesToResponse(b)
+	if err != nil {
+		return ""
+	}
+	return response.Provenance.Provider
+}
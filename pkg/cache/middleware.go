@@ -2,9 +2,9 @@ package cache
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
-	"strings"
 	"time"
 )
 
@@ -17,93 +17,270 @@ type cachedHTTPHandler struct {
 func (h *cachedHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	c := h.client
 	next := h.next
-	if c.cacheableMethod(r.Method) {
+	if c.cacheableMethod(r.Method) && !Bypassed(r.Context()) {
+		if c.strong(r) {
+			r = r.WithContext(Strong(r.Context()))
+		}
 		sortURLParams(r.URL)
-		key := generateKey(r.URL.String())
+		u := r.URL.String()
+		if c.knownMiss != nil && r.Method == http.MethodGet && c.knownMiss.Contains(u) {
+			h.client.logger.Info("Known miss", "method", r.Method, "url", u)
+			w.Header().Set(KnownMissHeader, "true")
+			http.Error(w, "Known dead link", http.StatusNotFound)
+			return
+		}
+		key := c.generateKey(u)
+		// an expired entry kept to be revalidated
+		var stale Response
+		var revalidate bool
+		// the entry the answer replaces, whose streamed value it may reuse
+		var previous Response
+		// the request body, nil without one
+		var body []byte
 		if r.Method == http.MethodPost && r.Body != nil {
-			body, err := io.ReadAll(r.Body)
-			defer r.Body.Close()
+			buf := getBuffer()
+			defer putBuffer(buf)
+			_, err := buf.ReadFrom(r.Body)
+			r.Body.Close()
 			if err != nil {
-				h.client.logger.Warn("Failed to read request body", "method", r.Method, "url", r.URL.String(), "error", err)
+				h.client.logger.Warn("Failed to read request body", "method", r.Method, "url", u, "error", err)
+				r.Body = io.NopCloser(bytes.NewReader(buf.Bytes()))
 				next.ServeHTTP(w, r)
 				return
 			}
-			reader := io.NopCloser(bytes.NewBuffer(body))
-			key = generateKeyWithBody(r.URL.String(), body)
-			r.Body = reader
+			body = buf.Bytes()
+			key = c.generateKeyWithBody(u, body)
+			r.Body = io.NopCloser(bytes.NewReader(buf.Bytes()))
 		}
 
-		params := r.URL.Query()
-		if _, ok := params[c.refreshKey]; ok {
+		var p pageOf
+		if c.refreshRequested(r.URL) {
+			params := r.URL.Query()
 			delete(params, c.refreshKey)
 
 			r.URL.RawQuery = params.Encode()
-			key = generateKey(r.URL.String())
+			key = c.generateKey(r.URL.String())
 
 			h.client.logger.Info("Cache refresh requested", "key", key, "method", r.Method, "url", r.URL.String())
-			c.adapter.Release(r.Context(), key)
-		} else {
-			b, ok := c.adapter.Get(r.Context(), key)
-			if ok {
-				response, err := BytesToResponse(b)
-				if err != nil {
-					h.client.logger.Warn("Failed to deserialize cached response", "key", key, "error", err)
-					next.ServeHTTP(w, r)
-					return
+			previous = c.detach(r.Context(), key)
+			// the other pages of the query are refreshed with it
+			if p = c.page(r, body); p.group != "" {
+				if _, err := c.PurgeGroup(r.Context(), p.group); err != nil {
+					c.logger.Warn("Failed to purge query group", "group", p.group, "error", err)
 				}
-				if response.Expiration.After(time.Now()) {
-					response.LastAccess = time.Now()
-					response.Frequency++
-					c.adapter.Set(key, response.Bytes(), response.Expiration)
-
-					h.client.logger.Info("Cache hit", "key", key, "method", r.Method, "url", r.URL.String(), "frequency", response.Frequency)
-					//w.WriteHeader(http.StatusNotModified)
-					for k, v := range response.Header {
-						w.Header().Set(k, strings.Join(v, ","))
-					}
-					if c.writeExpiresHeader {
-						w.Header().Set("Expires", response.Expiration.UTC().Format(http.TimeFormat))
-					}
-					if _, err := w.Write(response.Value); err != nil {
-						// Log the error but continue - response was already committed
-						// This error would be rare (client disconnect, etc.)
-						_ = err // Acknowledge the error exists
-					}
-					return
-				}
-
-				h.client.logger.Info("Cache entry expired", "key", key, "expiration", response.Expiration)
-				c.adapter.Release(r.Context(), key)
+			}
+		} else if asOf := r.Header.Get(AsOfHeader); asOf != "" && c.archiving {
+			h.serveArchived(w, r, key, asOf)
+			return
+		} else if label := r.Header.Get(SnapshotHeader); label != "" {
+			h.serveSnapshot(w, r, key, label)
+			return
+		} else {
+			p = c.page(r, body)
+			response, ok := c.lookup(r.Context(), key)
+			if ok && h.serveCached(w, r, key, response) {
+				h.prefetchNext(r, body, p)
+				return
+			}
+			if !ok {
+				stale, revalidate = c.stale(r.Context(), key)
+				previous = stale
 			}
 		}
+		c.lookups.record(false, time.Now())
 
-		rw := &responseWriter{ResponseWriter: w}
-		next.ServeHTTP(rw, r)
-
-		statusCode := rw.statusCode
-		value := rw.body
-		now := time.Now()
-		expires := now.Add(c.ttl)
-		if statusCode < 400 {
-			response := Response{
-				Value:      value,
-				Header:     rw.Header(),
-				Expiration: expires,
-				LastAccess: now,
-				Frequency:  1,
-			}
-			c.adapter.Set(key, response.Bytes(), response.Expiration)
-			h.client.logger.Info("Cache miss - new entry created", "key", key, "method", r.Method, "url", r.URL.String(), "status_code", statusCode, "expires", expires)
+		buf := getBuffer()
+		defer putBuffer(buf)
+		var response Response
+		var ok bool
+		if revalidate {
+			response, ok = h.revalidate(w, r, key, stale, buf)
 		} else {
-			h.client.logger.Warn("Response not cached due to error status", "key", key, "method", r.Method, "url", r.URL.String(), "status_code", statusCode)
+			response, ok = h.fetch(w, r, key, buf)
+		}
+		if ok {
+			// the answer cost an upstream call, it's kept when the client went away
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), c.writeTimeout)
+			defer cancel()
+			if p.group != "" {
+				response.Provenance.Group, response.Provenance.Page = p.group, p.page
+			}
+			c.storeOver(key, response, previous)
+			c.archive(ctx, key, response)
+			c.indexDomain(ctx, r, key)
+			if p.group != "" {
+				c.indexGroup(ctx, p.group, key)
+			}
+			c.storeCanonical(r, u, response)
+			if c.onStore != nil {
+				c.onStore(r, response)
+			}
+			h.prefetchNext(r, body, p)
 		}
-
 		return
 	}
 
 	next.ServeHTTP(w, r)
 }
 
+// storeCanonical also stores the answer of a GET request under its canonical
+// URL, when it has one other than the requested URL u.
+func (c *Cache) storeCanonical(r *http.Request, u string, response Response) {
+	if c.canonical == nil || r.Method != http.MethodGet {
+		return
+	}
+	canonical := c.canonical(r, response.Header)
+	if canonical == nil {
+		return
+	}
+	sortURLParams(canonical)
+	if canonical.String() == u {
+		return
+	}
+	c.logger.Info("Cache entry aliased to its canonical URL", "url", u, "canonical", canonical.String())
+	c.store(c.generateKey(canonical.String()), response)
+}
+
+// lookup returns the unexpired cached response by a given key.
+func (c *Cache) lookup(ctx context.Context, key uint64) (Response, bool) {
+	b, ok, prefetched := prefetchedEntry(ctx, key)
+	if !prefetched {
+		b, ok = c.adapter.Get(ctx, key)
+	}
+	if !ok {
+		return Response{}, false
+	}
+	response, err := BytesToResponse(b)
+	if err != nil || !c.compatible(response) {
+		// written by another format version or key config
+		versionMetrics.Add("mismatch_evictions", 1)
+		c.logger.Warn("Evicting incompatible cached response", "key", key, "error", err)
+		c.release(ctx, key)
+		return Response{}, false
+	}
+	expired := !response.Expiration.After(time.Now())
+	// entries stored before the max age was set are capped on read
+	if c.maxAge > 0 && !response.Created.IsZero() && time.Since(response.Created) > c.maxAge {
+		expired = true
+	}
+	if expired {
+		c.logger.Info("Cache entry expired", "key", key, "expiration", response.Expiration)
+		if !c.revalidatable(response) {
+			c.release(ctx, key)
+		}
+		return Response{}, false
+	}
+	return response, true
+}
+
+// serveCached writes a cached response. It returns false, having written
+// nothing, when the response value is gone.
+func (h *cachedHTTPHandler) serveCached(w http.ResponseWriter, r *http.Request, key uint64, response Response) bool {
+	c := h.client
+	var body io.ReadCloser
+	if headOnly(r) {
+		// the value isn't read, a streamed value that's gone is noticed on a full read
+		body = http.NoBody
+	} else {
+		var found bool
+		if body, found = c.body(r.Context(), key, response); !found {
+			c.release(r.Context(), key)
+			return false
+		}
+	}
+	defer body.Close()
+	response.LastAccess = time.Now()
+	response.Frequency++
+	c.adapter.Set(key, response.Bytes(), c.keepUntil(response))
+	markHit(r.Context())
+	c.lookups.record(true, response.LastAccess)
+
+	c.logger.Info("Cache hit", "key", key, "method", r.Method, "url", r.URL.String(), "frequency", response.Frequency, "streamed", response.Streamed, "provider", response.Provenance.Provider)
+	//w.WriteHeader(http.StatusNotModified)
+	copyHeader(w.Header(), replayHeader(response))
+	if headOnly(r) {
+		headOnlyLength(r, w.Header())
+	}
+	if r.Header.Get(DebugHeader) != "" {
+		writeDebugHeaders(w.Header(), "HIT", response)
+	}
+	if c.writeExpiresHeader {
+		w.Header().Set("Expires", response.Expiration.UTC().Format(http.TimeFormat))
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		// Log the error but continue - response was already committed
+		// This error would be rare (client disconnect, etc.)
+		_ = err // Acknowledge the error exists
+	}
+	return true
+}
+
+// fetch serves the request from upstream, and returns the response to cache
+// when it may be cached. The response value is read into buf, it's only valid
+// until buf is reused.
+func (h *cachedHTTPHandler) fetch(w http.ResponseWriter, r *http.Request, key uint64, buf *bytes.Buffer) (Response, bool) {
+	c := h.client
+	if headOnly(r) {
+		w = &headOnlyWriter{ResponseWriter: w, r: r}
+	}
+	rw := &responseWriter{ResponseWriter: w, body: buf, rules: c.contentRules, provenanceHeaders: c.provenanceHeaders, debug: r.Header.Get(DebugHeader) != ""}
+	start := time.Now()
+	h.next.ServeHTTP(rw, r)
+	latency := time.Since(start)
+	// an upstream answer cut short aborts the handler, the proxy panics with
+	// http.ErrAbortHandler, so a client that went away after a whole answer
+	// doesn't keep it from being cached
+	if r.Context().Err() != nil {
+		c.logger.Info("Client went away, caching the whole answer", "key", key, "method", r.Method, "url", r.URL.String())
+	}
+	if rw.skip {
+		c.logger.Info("Response not cached due to content rules", "key", key, "method", r.Method, "url", r.URL.String(), "content_type", rw.Header().Get("Content-Type"))
+		return Response{}, false
+	}
+
+	statusCode := rw.statusCode
+	if statusCode >= 400 {
+		c.logger.Warn("Response not cached due to error status", "key", key, "method", r.Method, "url", r.URL.String(), "status_code", statusCode)
+		if c.knownMiss != nil && r.Method == http.MethodGet && deadStatus(statusCode) {
+			c.knownMiss.Add(r.URL.String())
+		}
+		return Response{}, false
+	}
+	if statusCode == http.StatusNotModified {
+		// the answer of a conditional request has no value to cache
+		return Response{}, false
+	}
+
+	if err := verifyBody(rw.Header(), rw.body.Bytes()); err != nil {
+		c.logger.Warn("Response not cached due to an incomplete body", "key", key, "method", r.Method, "url", r.URL.String(), "error", err)
+		return Response{}, false
+	}
+
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	now := time.Now()
+	provenance := rw.provenance
+	provenance.Latency = latency
+	expires := now.Add(c.entryTTL(provenance.Provider, statusCode, int64(rw.body.Len())))
+	c.logger.Info("Cache miss - new entry created", "key", key, "method", r.Method, "url", r.URL.String(), "status_code", statusCode, "expires", expires, "provider", provenance.Provider, "latency", latency)
+	header := rw.Header().Clone()
+	for _, name := range []string{"X-Cache", "X-Cache-Provider", "X-Cache-Upstream-Key", "X-Quota-Warning"} {
+		header.Del(name)
+	}
+	stripFraming(header)
+	return Response{
+		Value:      rw.body.Bytes(),
+		Header:     header,
+		Expiration: expires,
+		LastAccess: now,
+		Frequency:  1,
+		Created:    now,
+		Provenance: provenance,
+		Content:    detectContent(header, rw.body.Bytes()),
+	}, true
+}
+
 // cacheRoundTripper is a `http.RoundTripper` that caches the responses.
 type cacheRoundTripper struct {
 	next   http.RoundTripper
@@ -113,51 +290,58 @@ type cacheRoundTripper struct {
 func (rt *cacheRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
 	if rt.client.cacheableMethod(r.Method) {
 		sortURLParams(r.URL)
-		key := generateKey(r.URL.String())
+		key := rt.client.generateKey(r.URL.String())
 		if r.Method == http.MethodPost && r.Body != nil {
-			body, err := io.ReadAll(r.Body)
+			buf := getBuffer()
+			_, err := buf.ReadFrom(r.Body)
+			r.Body.Close()
+			// Restore the body for downstream handlers, the transport closes it
+			r.Body = newPooledBody(buf)
 			if err != nil {
 				return rt.next.RoundTrip(r)
 			}
-			// Restore the body for downstream handlers
-			r.Body = io.NopCloser(bytes.NewBuffer(body))
-			key = generateKeyWithBody(r.URL.String(), body)
+			key = rt.client.generateKeyWithBody(r.URL.String(), buf.Bytes())
 		}
 
-		params := r.URL.Query()
-		if _, ok := params[rt.client.refreshKey]; ok {
+		if rt.client.refreshRequested(r.URL) {
+			params := r.URL.Query()
 			delete(params, rt.client.refreshKey)
 
 			r.URL.RawQuery = params.Encode()
-			key = generateKey(r.URL.String())
+			key = rt.client.generateKey(r.URL.String())
 
-			rt.client.adapter.Release(r.Context(), key)
+			rt.client.release(r.Context(), key)
 		} else {
 			b, ok := rt.client.adapter.Get(r.Context(), key)
 			if ok {
 				response, err := BytesToResponse(b)
-				if err != nil {
-					return rt.next.RoundTrip(r)
-				}
-				if response.Expiration.After(time.Now()) {
-					response.LastAccess = time.Now()
-					response.Frequency++
-					rt.client.adapter.Set(key, response.Bytes(), response.Expiration)
-
-					// Create a new response from the cached data
-					resp := &http.Response{
-						StatusCode: http.StatusOK,
-						Body:       io.NopCloser(bytes.NewBuffer(response.Value)),
-						Header:     response.Header,
-					}
+				if err != nil || !rt.client.compatible(response) {
+					// written by another format version or key config
+					versionMetrics.Add("mismatch_evictions", 1)
+					rt.client.release(r.Context(), key)
+				} else {
+					body, found := rt.client.body(r.Context(), key, response)
+					if found && response.Expiration.After(time.Now()) {
+						response.LastAccess = time.Now()
+						response.Frequency++
+						rt.client.adapter.Set(key, response.Bytes(), response.Expiration)
 
-					if rt.client.writeExpiresHeader {
-						resp.Header.Set("Expires", response.Expiration.UTC().Format(http.TimeFormat))
+						// Create a new response from the cached data
+						resp := &http.Response{
+							StatusCode:    http.StatusOK,
+							Body:          body,
+							Header:        replayHeader(response),
+							ContentLength: response.size(),
+						}
+
+						if rt.client.writeExpiresHeader {
+							resp.Header.Set("Expires", response.Expiration.UTC().Format(http.TimeFormat))
+						}
+						return resp, nil
 					}
-					return resp, nil
-				}
 
-				rt.client.adapter.Release(r.Context(), key)
+					rt.client.release(r.Context(), key)
+				}
 			}
 		}
 
@@ -167,29 +351,60 @@ func (rt *cacheRoundTripper) RoundTrip(r *http.Request) (*http.Response, error)
 			return nil, err
 		}
 
-		// Cache the response if successful
-		if resp.StatusCode < 400 {
-			// Read the body
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
+		// Cache the response if successful and allowed by the content rules
+		rule := matchContentRule(rt.client.contentRules, resp.Header)
+		tooLarge := rule.MaxSize > 0 && resp.ContentLength > rule.MaxSize
+		if resp.StatusCode < 400 && !rule.Skip && !tooLarge {
+			// Read the body, up to the rule size when there is one
+			reader := io.Reader(resp.Body)
+			if rule.MaxSize > 0 {
+				reader = io.LimitReader(resp.Body, rule.MaxSize+1)
+			}
+			buf := getBuffer()
+			if _, err := buf.ReadFrom(reader); err != nil {
+				putBuffer(buf)
 				resp.Body.Close()
 				return resp, nil
 			}
+			body := buf.Bytes()
+			if rule.MaxSize > 0 && int64(len(body)) > rule.MaxSize {
+				// too large to cache, hand back what was read and the rest unread
+				resp.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(bytes.Clone(body)), resp.Body), resp.Body}
+				putBuffer(buf)
+				return resp, nil
+			}
 
-			// Restore the body for downstream handlers
-			resp.Body = io.NopCloser(bytes.NewBuffer(body))
+			// Restore the body for downstream handlers, the buffer is reused once closed
+			resp.Body.Close()
+			resp.Body = newPooledBody(buf)
+			// the transport already dropped the length of bodies it decompressed
+			if !resp.Uncompressed {
+				if err := verifyBody(resp.Header, body); err != nil {
+					rt.client.logger.Warn("Response not cached due to an incomplete body", "key", key, "url", r.URL.String(), "error", err)
+					return resp, nil
+				}
+			}
 
 			now := time.Now()
-			expires := now.Add(rt.client.ttl)
+			provenance := takeProvenance(resp.Header, rt.client.provenanceHeaders)
+			expires := now.Add(rt.client.entryTTL(provenance.Provider, resp.StatusCode, int64(len(body))))
 
+			header := resp.Header.Clone()
+			stripFraming(header)
 			response := Response{
 				Value:      body,
-				Header:     resp.Header,
+				Header:     header,
 				Expiration: expires,
 				LastAccess: now,
 				Frequency:  1,
+				Created:    now,
+				Provenance: provenance,
+				Content:    detectContent(header, body),
 			}
-			rt.client.adapter.Set(key, response.Bytes(), response.Expiration)
+			rt.client.store(key, response)
 		}
 
 		return resp, nil
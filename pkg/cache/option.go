@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"time"
 )
 
@@ -34,6 +35,13 @@ func New(opts ...Option) (*Cache, error) {
 	if c.logger == nil {
 		return nil, errors.New("cache client logger is not set")
 	}
+	if c.writeTimeout == 0 {
+		c.writeTimeout = defaultWriteTimeout
+	}
+	c.namespace = namespaceOf(c.keyConfig)
+	if c.readOnly {
+		c.adapter = readOnlyAdapter{c.adapter}
+	}
 
 	return c, nil
 }
@@ -92,6 +100,204 @@ func WithExpiresHeader() Option {
 	}
 }
 
+// WithStreamThreshold sets the size from which cached values are stored apart
+// from their headers and streamed on hits. Optional setting. If not set,
+// every value is inlined.
+func WithStreamThreshold(size int) Option {
+	return func(c *Cache) error {
+		if size < 0 {
+			return fmt.Errorf("cache client stream threshold %d is invalid", size)
+		}
+		c.streamThreshold = size
+		return nil
+	}
+}
+
+// WithContentRules sets the rules deciding by content type which answers are
+// cached. Optional setting. If not set, every answer is cached.
+func WithContentRules(rules []ContentRule) Option {
+	return func(c *Cache) error {
+		c.contentRules = rules
+		return nil
+	}
+}
+
+// WithTTLRules sets the TTL of the answers by provider, status and size.
+// Optional setting. If not set, or no rule matches, the TTL is used.
+func WithTTLRules(rules []TTLRule) Option {
+	return func(c *Cache) error {
+		c.ttlRules = rules
+		return nil
+	}
+}
+
+// WithArchive keeps every distinct answer for a URL, without expiry, so
+// requests can read past versions with the X-As-Of header. Optional setting.
+// If not set, default is false.
+func WithArchive(enabled bool) Option {
+	return func(c *Cache) error {
+		c.archiving = enabled
+		return nil
+	}
+}
+
+// WithDomains sets how the target host of a request is found, entries are
+// then indexed by domain in index for PurgeDomain. Optional setting, a nil
+// index disables it.
+func WithDomains(domainOf func(*http.Request) string, index DomainIndex) Option {
+	return func(c *Cache) error {
+		if index != nil && domainOf == nil {
+			return errors.New("cache domain index has no domainOf")
+		}
+		c.domainOf = domainOf
+		c.domains = index
+		return nil
+	}
+}
+
+// WithPages sets how the pages of paginated requests are told apart, entries
+// are then indexed by query group for PurgeGroup and a refresh of a page
+// refreshes the group. Optional setting.
+func WithPages(pages *Pages) Option {
+	return func(c *Cache) error {
+		if pages != nil && pages.Of == nil {
+			return errors.New("cache pages have no Of")
+		}
+		c.pages = pages
+		return nil
+	}
+}
+
+// WithCanonical sets how the canonical URL of an answer is found, e.g. the
+// final URL of a redirected fetch, the answers of GET requests are then also
+// stored under it so the variants of a URL converge to one entry. canonical
+// returns nil when the answer has none. Optional setting.
+func WithCanonical(canonical func(r *http.Request, header http.Header) *url.URL) Option {
+	return func(c *Cache) error {
+		c.canonical = canonical
+		return nil
+	}
+}
+
+// WithOnStore sets a function called with every new entry the middleware
+// stores, e.g. to index the pages. The value is only valid during the call.
+// Optional setting.
+func WithOnStore(onStore func(r *http.Request, response Response)) Option {
+	return func(c *Cache) error {
+		c.onStore = onStore
+		return nil
+	}
+}
+
+// WithTTLJitter spreads the TTL of the new entries by up to ± percent, so the
+// entries written in a burst don't all expire at once and hit the upstream
+// together. Optional setting, 0 disables it.
+func WithTTLJitter(percent float64) Option {
+	return func(c *Cache) error {
+		if percent < 0 || percent >= 100 {
+			return fmt.Errorf("cache client ttl jitter %v%% is invalid", percent)
+		}
+		c.ttlJitter = percent
+		return nil
+	}
+}
+
+// WithMaxAge caps the age of every entry, snapshots included, whatever
+// their TTL. Optional setting, 0 disables the cap.
+func WithMaxAge(maxAge time.Duration) Option {
+	return func(c *Cache) error {
+		if maxAge < 0 {
+			return fmt.Errorf("cache client max age %v is invalid", maxAge)
+		}
+		c.maxAge = maxAge
+		return nil
+	}
+}
+
+// WithBudget shortens the TTL of the new entries and skips the large ones
+// while the cache is over the memory budget b. Optional setting.
+func WithBudget(b *Budget) Option {
+	return func(c *Cache) error {
+		c.budget = b
+		return nil
+	}
+}
+
+// WithRevalidation keeps the entries of providers that have a validator, an
+// ETag or a Last-Modified header, for window past their expiration. Asked
+// for then, they're revalidated with a conditional request, and an upstream
+// answering 304 Not Modified only extends them, saving the transfer and the
+// credits of a full answer. It's meant for the origin-style upstreams, e.g.
+// "fetch". Optional setting, 0 disables it.
+func WithRevalidation(window time.Duration, providers ...string) Option {
+	return func(c *Cache) error {
+		if window < 0 {
+			return fmt.Errorf("cache client revalidation window %v is invalid", window)
+		}
+		c.revalidateWindow = window
+		c.revalidating = providers
+		return nil
+	}
+}
+
+// WithProvenanceHeaders records the upstream answer headers named in the
+// provenance of the entries, e.g. the credits an answer cost. They're shown
+// by the debug headers prefixed with X-Cache-Upstream-. Optional setting.
+func WithProvenanceHeaders(names ...string) Option {
+	return func(c *Cache) error {
+		c.provenanceHeaders = names
+		return nil
+	}
+}
+
+// defaultWriteTimeout bounds the archive and index updates of fetched answers.
+const defaultWriteTimeout = 5 * time.Second
+
+// WithWriteTimeout bounds the archive and domain index updates of a fetched
+// answer. They're detached from the request, like the entry write, so an
+// answer that cost an upstream call is kept when the client went away.
+// Optional setting, 5s by default.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(c *Cache) error {
+		if timeout < 0 {
+			return fmt.Errorf("cache client write timeout %v is invalid", timeout)
+		}
+		c.writeTimeout = timeout
+		return nil
+	}
+}
+
+// WithKeyConfig sets the config the answers depend on, e.g. the provider
+// settings changing what's cached. It's hashed into the keys with the
+// FormatVersion, so the entries of another config aren't served. Optional
+// setting.
+func WithKeyConfig(config string) Option {
+	return func(c *Cache) error {
+		c.keyConfig = config
+		return nil
+	}
+}
+
+// WithReadOnly serves from the cache only: requests that aren't cached are
+// answered 504 without calling upstream, and nothing is written to the
+// adapter, not even the access statistics. The entries are written by the
+// writer instances sharing the store. Optional setting.
+func WithReadOnly(readOnly bool) Option {
+	return func(c *Cache) error {
+		c.readOnly = readOnly
+		return nil
+	}
+}
+
+// WithKnownMiss enables answering recently dead URLs without a cache lookup.
+// Optional setting.
+func WithKnownMiss(k *KnownMiss) Option {
+	return func(c *Cache) error {
+		c.knownMiss = k
+		return nil
+	}
+}
+
 func WithLogger(logger *slog.Logger) Option {
 	return func(c *Cache) error {
 		c.logger = logger
@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/privacy"
+)
+
+// pagePrefetchTimeout bounds the background fetch of a next page.
+const pagePrefetchTimeout = time.Minute
+
+var pageMetrics = expvar.NewMap("cache_pages")
+
+// Pages tells apart the pages of paginated requests, e.g. the search queries
+// of a search provider, see WithPages.
+type Pages struct {
+	// Of returns the query group of a request, e.g. the query without its
+	// page, and its page number from 1. ok is false for requests that aren't
+	// paginated. body is the request body, nil without one.
+	Of func(r *http.Request, body []byte) (group string, page int, ok bool)
+	// Next returns the request of the page after the one of r, nil when
+	// there's none. Only needed to prefetch.
+	Next func(r *http.Request, body []byte) *http.Request
+	// Prefetch fetches page 2 in the background once page 1 was served, so
+	// the clients paging through the results find it cached. It's an upstream
+	// call no client is charged for.
+	Prefetch bool
+}
+
+// pageOf is the page of a request, its group is empty when the request isn't
+// paginated.
+type pageOf struct {
+	group string
+	page  int
+}
+
+// page returns the page of r.
+func (c *Cache) page(r *http.Request, body []byte) pageOf {
+	if c.pages == nil {
+		return pageOf{}
+	}
+	group, page, ok := c.pages.Of(r, body)
+	if !ok || group == "" {
+		return pageOf{}
+	}
+	return pageOf{group: groupLabel(group), page: page}
+}
+
+// groupLabel hashes a query group, it's shown on the entries and may hold the
+// query. In privacy mode, the hash is salted.
+func groupLabel(group string) string {
+	if privacy.Enabled() {
+		return privacy.Hash([]byte("group:" + group))
+	}
+	return KeyAsString(generateKey("group:" + group))
+}
+
+// groupIndexKey is the key of the list of cache keys of a query group.
+func groupIndexKey(group string) uint64 {
+	return generateKey("group:index:" + group)
+}
+
+// indexGroup records key under its query group, so the pages are invalidated
+// together. Like the domain index, it's best effort.
+func (c *Cache) indexGroup(ctx context.Context, group string, key uint64) {
+	indexed, err := c.groupKeys(ctx, group)
+	if err != nil {
+		c.logger.Warn("Failed to read query group index", "group", group, "error", err)
+	}
+	for _, k := range indexed {
+		if k == key {
+			return
+		}
+	}
+	indexed = append(indexed, key)
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(indexed); err != nil {
+		c.logger.Error("Failed to encode query group index", "group", group, "error", err)
+		return
+	}
+	// the pages are refetched within the TTL, the index outlives them
+	c.adapter.Set(groupIndexKey(group), b.Bytes(), time.Now().Add(2*c.ttl))
+}
+
+func (c *Cache) groupKeys(ctx context.Context, group string) ([]uint64, error) {
+	b, ok := c.adapter.Get(ctx, groupIndexKey(group))
+	if !ok {
+		return nil, nil
+	}
+	var keys []uint64
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&keys); err != nil {
+		return nil, fmt.Errorf("gob.Decode: %w", err)
+	}
+	return keys, nil
+}
+
+// PurgeGroup releases every page of a query group, the group is the one in
+// the provenance of the entries. It returns the number of cache keys
+// released.
+func (c *Cache) PurgeGroup(ctx context.Context, group string) (int, error) {
+	keys, err := c.groupKeys(ctx, group)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		c.release(ctx, key)
+	}
+	c.adapter.Release(ctx, groupIndexKey(group))
+	pageMetrics.Add("group_purges", 1)
+	c.logger.Info("Purged cache entries by query group", "group", group, "keys", len(keys))
+	return len(keys), nil
+}
+
+// pagePrefetches are the keys of the next pages being prefetched.
+var pagePrefetches sync.Map
+
+// prefetchNext fetches the page after page 1 in the background, unless it's
+// cached or already being fetched. body is copied.
+func (h *cachedHTTPHandler) prefetchNext(r *http.Request, body []byte, p pageOf) {
+	c := h.client
+	if c.pages == nil || !c.pages.Prefetch || c.pages.Next == nil || c.readOnly || p.page != 1 {
+		return
+	}
+	// the client's request is done by the time the next page is fetched
+	ctx, cancel := context.WithTimeout(context.Background(), pagePrefetchTimeout)
+	next := c.pages.Next(r.Clone(ctx), bytes.Clone(body))
+	if next == nil {
+		cancel()
+		return
+	}
+	go func() {
+		defer cancel()
+		key, err := c.requestKey(next)
+		if err != nil {
+			return
+		}
+		if _, loaded := pagePrefetches.LoadOrStore(key, true); loaded {
+			return
+		}
+		defer pagePrefetches.Delete(key)
+		if _, ok := c.lookup(ctx, key); ok {
+			pageMetrics.Add("prefetch_cached", 1)
+			return
+		}
+		pageMetrics.Add("prefetches", 1)
+		c.logger.Info("Prefetching next page", "group", p.group, "method", next.Method, "url", next.URL.String())
+		h.ServeHTTP(prefetchWriter{header: http.Header{}}, next)
+	}()
+}
+
+// prefetchWriter drops the answer of a prefetch, the middleware caches it.
+type prefetchWriter struct {
+	header http.Header
+}
+
+func (w prefetchWriter) Header() http.Header         { return w.header }
+func (w prefetchWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w prefetchWriter) WriteHeader(int)             {}
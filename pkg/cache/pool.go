@@ -0,0 +1,44 @@
+package cache
+
+import (
+	"bytes"
+	"sync"
+)
+
+// maxPooledBuffer is the largest buffer kept for reuse, larger ones are left
+// to the GC so a few huge answers don't pin memory.
+const maxPooledBuffer = 8 << 20
+
+// bufferPool holds the buffers of request bodies and captured answers.
+var bufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// pooledBody is a body read from a pooled buffer, the buffer goes back to the
+// pool on Close.
+type pooledBody struct {
+	*bytes.Reader
+	buf  *bytes.Buffer
+	once sync.Once
+}
+
+func newPooledBody(buf *bytes.Buffer) *pooledBody {
+	return &pooledBody{Reader: bytes.NewReader(buf.Bytes()), buf: buf}
+}
+
+func (b *pooledBody) Close() error {
+	b.once.Do(func() { putBuffer(b.buf) })
+	return nil
+}
@@ -0,0 +1,46 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+)
+
+type prefetchKey struct{}
+
+// prefetched holds the entries looked up ahead for a batch, by key. Keys
+// without an entry were looked up and missed.
+type prefetched map[uint64][]byte
+
+// Prefetch looks up the cached entries of several requests in one adapter
+// round trip, e.g. for the sub-requests of a batch. The middleware serves the
+// requests carrying the returned context from the prefetched entries.
+func (c *Cache) Prefetch(ctx context.Context, reqs []*http.Request) context.Context {
+	var keys []uint64
+	for _, r := range reqs {
+		if !c.cacheableMethod(r.Method) {
+			continue
+		}
+		key, err := c.requestKey(r)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return ctx
+	}
+	found := c.adapter.GetMulti(ctx, keys)
+	entries := make(prefetched, len(keys))
+	for _, key := range keys {
+		entries[key] = found[key]
+	}
+	return context.WithValue(ctx, prefetchKey{}, entries)
+}
+
+// prefetchedEntry returns the entry prefetched for key, ok is false when key
+// wasn't prefetched.
+func prefetchedEntry(ctx context.Context, key uint64) (b []byte, found bool, ok bool) {
+	entries, _ := ctx.Value(prefetchKey{}).(prefetched)
+	b, ok = entries[key]
+	return b, b != nil, ok
+}
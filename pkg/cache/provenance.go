@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Provenance headers set by the proxy on upstream answers, see proxy.RecordProvenance.
+// They are moved into the cached entry and not sent to clients.
+const (
+	upstreamProviderHeader = "X-Upstream-Provider"
+	upstreamKeyHeader      = "X-Upstream-Key"
+)
+
+// DebugHeader asks for the cache debug headers on the answer.
+const DebugHeader = "X-Cache-Debug"
+
+// Provenance records where a cached entry comes from.
+type Provenance struct {
+	// Provider is the upstream provider that served the entry.
+	Provider string `json:"provider,omitempty"`
+	// UpstreamKey is the fingerprint of the upstream key that served the entry.
+	UpstreamKey string `json:"upstream_key,omitempty"`
+	// Latency is how long the upstream took to answer.
+	Latency time.Duration `json:"latency"`
+	// Group is the query group of a paginated request, shared by its pages,
+	// and Page the page of the entry, see WithPages.
+	Group string `json:"group,omitempty"`
+	Page  int    `json:"page,omitempty"`
+	// Headers are the upstream answer headers recorded, see WithProvenanceHeaders.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// takeProvenance moves the provenance headers out of an upstream answer and
+// records the values of the headers named, which are left on the answer.
+func takeProvenance(header http.Header, names []string) Provenance {
+	p := Provenance{
+		Provider:    header.Get(upstreamProviderHeader),
+		UpstreamKey: header.Get(upstreamKeyHeader),
+	}
+	for _, name := range names {
+		if v := header.Get(name); v != "" {
+			if p.Headers == nil {
+				p.Headers = map[string]string{}
+			}
+			p.Headers[http.CanonicalHeaderKey(name)] = v
+		}
+	}
+	header.Del(upstreamProviderHeader)
+	header.Del(upstreamKeyHeader)
+	return p
+}
+
+// writeDebugHeaders describes a cache hit or miss on the answer headers.
+func writeDebugHeaders(header http.Header, status string, response Response) {
+	header.Set("X-Cache", status)
+	if response.Provenance.Provider != "" {
+		header.Set("X-Cache-Provider", response.Provenance.Provider)
+	}
+	if response.Provenance.UpstreamKey != "" {
+		header.Set("X-Cache-Upstream-Key", response.Provenance.UpstreamKey)
+	}
+	if response.Provenance.Group != "" {
+		header.Set("X-Cache-Group", response.Provenance.Group)
+	}
+	for name, v := range response.Provenance.Headers {
+		header.Set("X-Cache-Upstream-"+strings.TrimPrefix(name, "X-"), v)
+	}
+	if status == "HIT" {
+		header.Set("X-Cache-Upstream-Latency", response.Provenance.Latency.String())
+		header.Set("X-Cache-Frequency", strconv.Itoa(response.Frequency))
+		if !response.Created.IsZero() {
+			header.Set("X-Cache-Fetched-At", response.Created.UTC().Format(time.RFC3339))
+		}
+		if response.Content.Type != "" {
+			header.Set("X-Cache-Content-Type", response.Content.Type)
+		}
+		if response.Content.Language != "" {
+			header.Set("X-Cache-Content-Language", response.Content.Language)
+		}
+	}
+}
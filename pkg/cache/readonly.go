@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// readOnlyMessage answers the requests a read-only cache can't serve.
+const readOnlyMessage = "Not cached, this instance is read-only"
+
+// readOnlyAdapter drops the writes and releases of a read-only cache, they're
+// left to the writer instances sharing the store.
+type readOnlyAdapter struct {
+	Adapter
+}
+
+// Set implements the cache Adapter interface Set method, the write is dropped.
+func (readOnlyAdapter) Set(key uint64, response []byte, expiration time.Time) {}
+
+// Release implements the cache Adapter interface Release method, the release is dropped.
+func (readOnlyAdapter) Release(ctx context.Context, key uint64) {}
+
+// Close closes the adapter read from when it holds resources.
+func (a readOnlyAdapter) Close() error {
+	if closer, ok := a.Adapter.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// notCached stands for the upstream of a read-only cache, whatever isn't
+// served from the cache is answered 504, as for "Cache-Control: only-if-cached".
+var notCached = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, readOnlyMessage, http.StatusGatewayTimeout)
+})
+
+// notCachedTransport is notCached for the RoundTripper middleware.
+type notCachedTransport struct{}
+
+func (notCachedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body != nil {
+		r.Body.Close()
+	}
+	return &http.Response{
+		StatusCode:    http.StatusGatewayTimeout,
+		Status:        "504 Gateway Timeout",
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(readOnlyMessage)),
+		ContentLength: int64(len(readOnlyMessage)),
+		Request:       r,
+	}, nil
+}
@@ -25,8 +25,16 @@ SOFTWARE.
 package cache
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/cache/v9"
@@ -41,30 +49,175 @@ type Adapter interface {
 	Get(ctx context.Context, key uint64) ([]byte, bool)
 
 	// Set caches a response for a given key until an expiration date.
+	// The response must not be kept after Set returns, its buffer is reused.
 	Set(key uint64, response []byte, expiration time.Time)
 
 	// Release frees cache for a given key.
 	Release(ctx context.Context, key uint64)
+
+	// GetReader streams the cached value by a given key, so large values
+	// don't have to be held in memory. It also returns true or false,
+	// whether it exists or not.
+	GetReader(ctx context.Context, key uint64) (io.ReadCloser, bool)
+
+	// GetMulti retrieves the cached responses of several keys at once, in
+	// as few round trips as the store allows. Missing keys are left out.
+	GetMulti(ctx context.Context, keys []uint64) map[uint64][]byte
+}
+
+// Expirer is implemented by the adapters that can move the expiration of a
+// stored value without writing it again.
+type Expirer interface {
+	// Expire sets the expiration of key, it returns false when the key isn't
+	// stored or its expiration couldn't be set.
+	Expire(ctx context.Context, key uint64, expiration time.Time) bool
+}
+
+// expire moves the expiration of key when adapter is an Expirer.
+func expire(ctx context.Context, adapter Adapter, key uint64, expiration time.Time) bool {
+	expirer, ok := adapter.(Expirer)
+	return ok && expirer.Expire(ctx, key, expiration)
+}
+
+// Walker is implemented by the adapters that can list the values they store.
+type Walker interface {
+	// Walk calls fn with each stored key and its value until fn returns
+	// false, the keys stored or released meanwhile may be skipped.
+	Walk(ctx context.Context, fn func(key uint64, value []byte) bool) error
 }
 
+// errNotWalkable is returned by walk for the adapters that aren't Walkers.
+var errNotWalkable = errors.New("cache adapter can't list its entries")
+
+// walk lists the values of adapter when it is a Walker.
+func walk(ctx context.Context, adapter Adapter, fn func(key uint64, value []byte) bool) error {
+	walker, ok := adapter.(Walker)
+	if !ok {
+		return errNotWalkable
+	}
+	return walker.Walk(ctx, fn)
+}
+
+// rawThreshold is the size from which values are stored uncompressed and
+// outside the local cache, so they can be streamed with GETRANGE.
+const rawThreshold = 1 << 20
+
+// rawChunkSize is the size of each GETRANGE read when streaming.
+const rawChunkSize = 256 << 10
+
 // RedisAdapter is the Redis adapter data structure.
 type RedisAdapter struct {
-	store  *cache.Cache
-	logger *slog.Logger
+	store *cache.Cache
+	// local is nil when the local cache is disabled
+	local        cache.LocalCache
+	localEntries int
+	localTTL     time.Duration
+	localRules   []LocalCacheRule
+	ring         *redis.Ring
+	logger       *slog.Logger
+
+	// invalidationChannel broadcasts the released keys when set, the
+	// subscription runs until stop and closes subscribed
+	invalidationChannel string
+	stop                context.CancelFunc
+	subscribed          chan struct{}
+	// mu guards evictors
+	mu       sync.Mutex
+	evictors []func(key uint64)
+}
+
+func rawKey(key uint64) string {
+	return "raw:" + KeyAsString(key)
 }
 
-// Get implements the cache Adapter interface Get method.
+// Get implements the cache Adapter interface Get method, the local cache
+// is skipped for the contexts marked by Strong.
 func (ra *RedisAdapter) Get(ctx context.Context, key uint64) ([]byte, bool) {
+	get := ra.store.Get
+	if strongRead(ctx) {
+		get = ra.store.GetSkippingLocalCache
+	}
 	var c []byte
-	if err := ra.store.Get(ctx, KeyAsString(key), &c); err == nil {
+	if err := get(ctx, KeyAsString(key), &c); err == nil {
+		return c, true
+	}
+	if c, err := ra.ring.Get(ctx, rawKey(key)).Bytes(); err == nil {
 		return c, true
 	}
 
 	return nil, false
 }
 
+// GetMulti implements the cache Adapter interface GetMulti method, keys
+// missing from the local cache are read in one pipeline, all of them for the
+// contexts marked by Strong.
+func (ra *RedisAdapter) GetMulti(ctx context.Context, keys []uint64) map[uint64][]byte {
+	found := make(map[uint64][]byte, len(keys))
+	var remote []uint64
+	for _, key := range keys {
+		if ra.local == nil || strongRead(ctx) {
+			remote = keys
+			break
+		}
+		if b, ok := ra.local.Get(KeyAsString(key)); ok {
+			var c []byte
+			if err := msgpack.Unmarshal(b, &c); err == nil {
+				found[key] = c
+				continue
+			}
+		}
+		remote = append(remote, key)
+	}
+	if len(remote) == 0 {
+		return found
+	}
+
+	cmds := make([][2]*redis.StringCmd, len(remote))
+	_, err := ra.ring.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range remote {
+			cmds[i] = [2]*redis.StringCmd{pipe.Get(ctx, KeyAsString(key)), pipe.Get(ctx, rawKey(key))}
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		ra.logger.Warn("Failed to get cache entries", "keys", len(remote), "error", err)
+	}
+	for i, key := range remote {
+		if b, err := cmds[i][0].Bytes(); err == nil {
+			var c []byte
+			if err := msgpack.Unmarshal(b, &c); err == nil {
+				found[key] = c
+				continue
+			}
+		}
+		if c, err := cmds[i][1].Bytes(); err == nil {
+			found[key] = c
+		}
+	}
+	return found
+}
+
+// GetReader implements the cache Adapter interface GetReader method.
+func (ra *RedisAdapter) GetReader(ctx context.Context, key uint64) (io.ReadCloser, bool) {
+	size, err := ra.ring.StrLen(ctx, rawKey(key)).Result()
+	if err == nil && size > 0 {
+		return &rangeReader{ctx: ctx, ring: ra.ring, key: rawKey(key), size: size}, true
+	}
+	c, ok := ra.Get(ctx, key)
+	if !ok {
+		return nil, false
+	}
+	return io.NopCloser(bytes.NewReader(c)), true
+}
+
 // Set implements the cache Adapter interface Set method.
 func (ra *RedisAdapter) Set(key uint64, response []byte, expiration time.Time) {
+	if len(response) >= rawThreshold {
+		if err := ra.ring.Set(context.Background(), rawKey(key), response, time.Until(expiration)).Err(); err != nil {
+			ra.logger.Error("Failed to set cache", "key", rawKey(key), "error", err)
+		}
+		return
+	}
 	err := ra.store.Set(&cache.Item{
 		Key:   KeyAsString(key),
 		Value: response,
@@ -75,18 +228,147 @@ func (ra *RedisAdapter) Set(key uint64, response []byte, expiration time.Time) {
 	}
 }
 
+// Expire implements the Expirer interface, with PEXPIREAT on the key the
+// value is stored under. The local copies keep their own short TTL.
+func (ra *RedisAdapter) Expire(ctx context.Context, key uint64, expiration time.Time) bool {
+	cmds, err := ra.ring.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.PExpireAt(ctx, KeyAsString(key), expiration)
+		pipe.PExpireAt(ctx, rawKey(key), expiration)
+		return nil
+	})
+	if err != nil {
+		ra.logger.Warn("Failed to expire cache entry", "key", KeyAsString(key), "error", err)
+		return false
+	}
+	for _, cmd := range cmds {
+		if ok, err := cmd.(*redis.BoolCmd).Result(); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Walk implements the Walker interface, scanning the shards of the ring. The
+// shards are scanned concurrently, fn isn't.
+func (ra *RedisAdapter) Walk(ctx context.Context, fn func(key uint64, value []byte) bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mu sync.Mutex
+	err := ra.ring.ForEachShard(ctx, func(ctx context.Context, client *redis.Client) error {
+		var cursor uint64
+		for {
+			keys, next, err := client.Scan(ctx, cursor, "*", warmBatch).Result()
+			if err != nil {
+				return fmt.Errorf("Scan: %w", err)
+			}
+			// the entries are under their bare key or under rawKey when large
+			keys = slices.DeleteFunc(keys, func(key string) bool {
+				return strings.Contains(strings.TrimPrefix(key, "raw:"), ":")
+			})
+			if len(keys) > 0 {
+				values, err := client.MGet(ctx, keys...).Result()
+				if err != nil {
+					return fmt.Errorf("MGet: %w", err)
+				}
+				for i, v := range values {
+					value, ok := v.(string)
+					if !ok {
+						continue
+					}
+					name, raw := strings.CutPrefix(keys[i], "raw:")
+					key, err := strconv.ParseUint(name, 36, 64)
+					if err != nil {
+						continue
+					}
+					b := []byte(value)
+					if !raw {
+						if err := msgpack.Unmarshal([]byte(value), &b); err != nil {
+							continue
+						}
+					}
+					mu.Lock()
+					more := ctx.Err() == nil && fn(key, b)
+					mu.Unlock()
+					if !more {
+						cancel()
+						return nil
+					}
+				}
+			}
+			if cursor = next; cursor == 0 {
+				return nil
+			}
+		}
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		return fmt.Errorf("RedisAdapter.Walk: %w", err)
+	}
+	return nil
+}
+
 // Release implements the cache Adapter interface Release method.
 func (ra *RedisAdapter) Release(ctx context.Context, key uint64) {
 	if err := ra.store.Delete(ctx, KeyAsString(key)); err != nil {
 		ra.logger.Error("Failed to delete cache entry", "key", key, "error", err)
 	}
+	if err := ra.ring.Del(ctx, rawKey(key)).Err(); err != nil {
+		ra.logger.Error("Failed to delete cache entry", "key", rawKey(key), "error", err)
+	}
+	ra.invalidate(ctx, key)
 }
 
-// NewRedisAdapter initializes Redis adapter
-func NewRedisAdapter(opt *redis.RingOptions, logger *slog.Logger) *RedisAdapter {
+// rangeReader reads a raw value from Redis one chunk at a time.
+type rangeReader struct {
+	ctx    context.Context
+	ring   *redis.Ring
+	key    string
+	size   int64
+	offset int64
+	buf    []byte
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.offset >= r.size {
+			return 0, io.EOF
+		}
+		chunk, err := r.ring.GetRange(r.ctx, r.key, r.offset, r.offset+rawChunkSize-1).Bytes()
+		if err != nil {
+			return 0, err
+		}
+		// the value expired or was replaced while streaming
+		if len(chunk) == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		r.offset += int64(len(chunk))
+		r.buf = chunk
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *rangeReader) Close() error {
+	r.buf = nil
+	return nil
+}
+
+// NewRedisAdapter initializes Redis adapter, with a local cache in front
+// of Redis as set by opts.
+func NewRedisAdapter(opt *redis.RingOptions, logger *slog.Logger, opts ...RedisOption) *RedisAdapter {
 	// We don't use cluster because standalond redis does not support cluster mode.
 	ring := redis.NewRing(opt)
-	store := cache.New(&cache.Options{
+	ra := &RedisAdapter{
+		localEntries: defaultLocalEntries,
+		localTTL:     defaultLocalTTL,
+		ring:         ring,
+		logger:       logger,
+	}
+	for _, o := range opts {
+		o(ra)
+	}
+	ra.local = ra.newLocalCache()
+	ra.store = cache.New(&cache.Options{
 		Redis: ring,
 		Marshal: func(v any) ([]byte, error) {
 			return msgpack.Marshal(v)
@@ -94,10 +376,13 @@ func NewRedisAdapter(opt *redis.RingOptions, logger *slog.Logger) *RedisAdapter
 		Unmarshal: func(b []byte, v any) error {
 			return msgpack.Unmarshal(b, v)
 		},
-		LocalCache: cache.NewTinyLFU(1000, 10*time.Minute),
+		LocalCache: ra.local,
 	})
-	return &RedisAdapter{
-		store:  store,
-		logger: logger,
+	if ra.invalidationChannel != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		ra.stop = cancel
+		ra.subscribed = make(chan struct{})
+		go ra.subscribe(ctx, ring.Subscribe(ctx, ra.invalidationChannel))
 	}
+	return ra
 }
@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var replicationMetrics = expvar.NewMap("cache_replication")
+
+// ReplicatedAdapter replicates the writes of a local Adapter to a remote one,
+// e.g. the Redis of another region, so the fleets of both regions share warm
+// entries. Reads are served locally and fall back to the remote on misses,
+// remote hits are then copied locally. Replication is asynchronous and drops
+// writes when its queue is full, the remote is a best effort.
+//
+// Remote reads add the cross-region latency to local misses only, bound them
+// with a BoundedAdapter.
+type ReplicatedAdapter struct {
+	Adapter
+	remote Adapter
+	shards []chan *asyncOp
+	logger *slog.Logger
+	wg     sync.WaitGroup
+}
+
+// NewReplicatedAdapter creates a new ReplicatedAdapter of local replicating
+// to remote with workers goroutines, each with a queue of queueSize writes.
+func NewReplicatedAdapter(local, remote Adapter, workers, queueSize int, logger *slog.Logger) (*ReplicatedAdapter, error) {
+	if workers < 1 {
+		return nil, fmt.Errorf("cache replication workers %d is invalid", workers)
+	}
+	a := &ReplicatedAdapter{
+		Adapter: local,
+		remote:  remote,
+		shards:  make([]chan *asyncOp, workers),
+		logger:  logger,
+	}
+	for i := range a.shards {
+		a.shards[i] = make(chan *asyncOp, queueSize)
+		a.wg.Add(1)
+		go a.work(a.shards[i])
+	}
+	return a, nil
+}
+
+func (a *ReplicatedAdapter) work(ops chan *asyncOp) {
+	defer a.wg.Done()
+	for op := range ops {
+		if op.release {
+			a.remote.Release(context.Background(), op.key)
+		} else {
+			a.remote.Set(op.key, op.value, op.expiration)
+		}
+		replicationMetrics.Add("replicated", 1)
+	}
+}
+
+// replicate queues op for the remote, writes of the same key are applied in order.
+func (a *ReplicatedAdapter) replicate(op *asyncOp) {
+	select {
+	case a.shards[op.key%uint64(len(a.shards))] <- op:
+	default:
+		replicationMetrics.Add("dropped", 1)
+		a.logger.Warn("Cache replication queue full, write dropped", "key", op.key)
+	}
+}
+
+// backfill copies a remote value locally when it's an entry, under its
+// expiration. Other values, e.g. indexes, are served without being copied.
+func (a *ReplicatedAdapter) backfill(key uint64, value []byte) {
+	response, err := BytesToResponse(value)
+	if err != nil || !response.Expiration.After(time.Now()) {
+		return
+	}
+	a.Adapter.Set(key, value, response.Expiration)
+	replicationMetrics.Add("backfilled", 1)
+}
+
+// Get implements the cache Adapter interface Get method.
+func (a *ReplicatedAdapter) Get(ctx context.Context, key uint64) ([]byte, bool) {
+	if value, ok := a.Adapter.Get(ctx, key); ok {
+		return value, true
+	}
+	value, ok := a.remote.Get(ctx, key)
+	if !ok {
+		replicationMetrics.Add("remote_misses", 1)
+		return nil, false
+	}
+	replicationMetrics.Add("remote_hits", 1)
+	a.backfill(key, value)
+	return value, true
+}
+
+// GetMulti implements the cache Adapter interface GetMulti method.
+func (a *ReplicatedAdapter) GetMulti(ctx context.Context, keys []uint64) map[uint64][]byte {
+	found := a.Adapter.GetMulti(ctx, keys)
+	var missing []uint64
+	for _, key := range keys {
+		if _, ok := found[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) == 0 {
+		return found
+	}
+	remote := a.remote.GetMulti(ctx, missing)
+	replicationMetrics.Add("remote_hits", int64(len(remote)))
+	replicationMetrics.Add("remote_misses", int64(len(missing)-len(remote)))
+	for key, value := range remote {
+		a.backfill(key, value)
+		found[key] = value
+	}
+	return found
+}
+
+// GetReader implements the cache Adapter interface GetReader method. Values
+// read from the remote are streamed without being copied locally.
+func (a *ReplicatedAdapter) GetReader(ctx context.Context, key uint64) (io.ReadCloser, bool) {
+	if r, ok := a.Adapter.GetReader(ctx, key); ok {
+		return r, true
+	}
+	r, ok := a.remote.GetReader(ctx, key)
+	if ok {
+		replicationMetrics.Add("remote_hits", 1)
+	} else {
+		replicationMetrics.Add("remote_misses", 1)
+	}
+	return r, ok
+}
+
+// Set implements the cache Adapter interface Set method, the write is
+// replicated in the background.
+func (a *ReplicatedAdapter) Set(key uint64, response []byte, expiration time.Time) {
+	a.Adapter.Set(key, response, expiration)
+	// the caller reuses the response buffer
+	a.replicate(&asyncOp{key: key, value: bytes.Clone(response), expiration: expiration})
+}
+
+// Expire implements the Expirer interface when both the local and the remote
+// adapters do. Unlike the writes it isn't replicated in the background, a
+// remote value left with its former expiration would vanish under its entry.
+func (a *ReplicatedAdapter) Expire(ctx context.Context, key uint64, expiration time.Time) bool {
+	return expire(ctx, a.Adapter, key, expiration) && expire(ctx, a.remote, key, expiration)
+}
+
+// Walk implements the Walker interface when the local adapter does, the
+// remote one holds the same values.
+func (a *ReplicatedAdapter) Walk(ctx context.Context, fn func(key uint64, value []byte) bool) error {
+	return walk(ctx, a.Adapter, fn)
+}
+
+// Release implements the cache Adapter interface Release method, the release
+// is replicated in the background.
+func (a *ReplicatedAdapter) Release(ctx context.Context, key uint64) {
+	a.Adapter.Release(ctx, key)
+	a.replicate(&asyncOp{key: key, release: true})
+}
+
+// Close applies the queued replication writes and stops the workers, then
+// closes the local and remote adapters when they hold resources. No write
+// may follow.
+func (a *ReplicatedAdapter) Close() error {
+	for _, ops := range a.shards {
+		close(ops)
+	}
+	a.wg.Wait()
+	var errs []error
+	for _, adapter := range []Adapter{a.Adapter, a.remote} {
+		if closer, ok := adapter.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
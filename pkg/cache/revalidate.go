@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+)
+
+var revalidationMetrics = expvar.NewMap("cache_revalidation")
+
+// revalidatable reports whether response is kept past its expiration to be
+// revalidated, it needs a validator.
+func (c *Cache) revalidatable(response Response) bool {
+	if c.revalidateWindow <= 0 || !slices.Contains(c.revalidating, response.Provenance.Provider) {
+		return false
+	}
+	return response.Header.Get("ETag") != "" || response.Header.Get("Last-Modified") != ""
+}
+
+// keepUntil returns when the adapter may drop response, the revalidatable
+// ones are kept for the revalidation window past their expiration.
+func (c *Cache) keepUntil(response Response) time.Time {
+	if c.revalidatable(response) {
+		return response.Expiration.Add(c.revalidateWindow)
+	}
+	return response.Expiration
+}
+
+// stale returns the expired response of key kept to be revalidated.
+func (c *Cache) stale(ctx context.Context, key uint64) (Response, bool) {
+	if c.revalidateWindow <= 0 || c.readOnly {
+		return Response{}, false
+	}
+	b, ok := c.adapter.Get(ctx, key)
+	if !ok {
+		return Response{}, false
+	}
+	response, err := BytesToResponse(b)
+	if err != nil || !c.compatible(response) || !c.revalidatable(response) {
+		return Response{}, false
+	}
+	// the max age caps the revalidated entries too
+	if c.maxAge > 0 && !response.Created.IsZero() && time.Since(response.Created) > c.maxAge {
+		return Response{}, false
+	}
+	return response, true
+}
+
+// revalidate serves a GET request with a conditional request to upstream,
+// with the validators of the stale response. When upstream answers 304 Not
+// Modified, the stale response is extended by its TTL and served, nothing
+// is returned to be cached. Any other answer is served and returned as by
+// fetch.
+func (h *cachedHTTPHandler) revalidate(w http.ResponseWriter, r *http.Request, key uint64, stale Response, buf *bytes.Buffer) (Response, bool) {
+	c := h.client
+	// the conditional requests of the clients are theirs to answer
+	if r.Method != http.MethodGet || r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		return h.fetch(w, r, key, buf)
+	}
+	if etag := stale.Header.Get("ETag"); etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := stale.Header.Get("Last-Modified"); lastModified != "" {
+		r.Header.Set("If-Modified-Since", lastModified)
+	}
+	nw := &notModifiedWriter{ResponseWriter: w, header: http.Header{}}
+	response, ok := h.fetch(nw, r, key, buf)
+	r.Header.Del("If-None-Match")
+	r.Header.Del("If-Modified-Since")
+	if !nw.notModified {
+		revalidationMetrics.Add("modified", 1)
+		return response, ok
+	}
+	revalidationMetrics.Add("not_modified", 1)
+
+	size := int64(len(stale.Value))
+	if stale.Streamed {
+		size = stale.Size
+	}
+	now := time.Now()
+	stale.Expiration = now.Add(c.entryTTL(stale.Provenance.Provider, http.StatusOK, size))
+	if stale.Streamed && !c.reuseBody(key, stale, stale) {
+		// the value is stored again with the entry when its TTL can't be extended alone
+		body, found := c.body(r.Context(), key, stale)
+		if !found {
+			return h.fetch(w, r, key, buf)
+		}
+		value, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return h.fetch(w, r, key, buf)
+		}
+		stale.Value, stale.Streamed, stale.Size, stale.BodyVersion = value, false, 0, 0
+	}
+	c.logger.Info("Cache entry revalidated", "key", key, "method", r.Method, "url", r.URL.String(), "expires", stale.Expiration, "provider", stale.Provenance.Provider)
+	c.store(key, stale)
+	if !h.serveCached(w, r, key, stale) {
+		return h.fetch(w, r, key, buf)
+	}
+	return Response{}, false
+}
+
+// notModifiedWriter holds the headers of an upstream answer back until its
+// status is known, a 304 Not Modified is dropped for the stale response to
+// be served instead.
+type notModifiedWriter struct {
+	http.ResponseWriter
+	header      http.Header
+	wroteHeader bool
+	notModified bool
+}
+
+func (w *notModifiedWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *notModifiedWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if statusCode == http.StatusNotModified {
+		w.notModified = true
+		return
+	}
+	copyHeader(w.ResponseWriter.Header(), w.header)
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *notModifiedWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.notModified {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
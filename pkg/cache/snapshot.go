@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// SnapshotHeader selects the snapshot a request reads from.
+const SnapshotHeader = "X-Cache-Snapshot"
+
+// snapshotRetention is how long snapshots and their entries are kept.
+const snapshotRetention = 10 * 365 * 24 * time.Hour
+
+var snapshotLabel = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// ErrUnknownSnapshot is returned for snapshot labels that were never tagged.
+var ErrUnknownSnapshot = errors.New("unknown snapshot")
+
+func snapshotMetaKey(label string) uint64 {
+	return generateKey("snapshot:" + label)
+}
+
+func snapshotKey(label string, key uint64) uint64 {
+	return generateKey("snapshot:" + label + ":" + KeyAsString(key))
+}
+
+// snapshotLabelsKey is the key of the list of the snapshot labels.
+var snapshotLabelsKey = generateKey("snapshot:labels")
+
+// CreateSnapshot tags the current cache state with label. The live entries
+// are copied into the snapshot when it's tagged, requests carrying the label
+// in SnapshotHeader then read them as they were even after they are replaced
+// or expire. Entries missing from the snapshot are fetched on first read,
+// recorded, and served identically from then on. It needs an adapter that
+// can list its entries, see Walker.
+func (c *Cache) CreateSnapshot(ctx context.Context, label string) (time.Time, error) {
+	if !snapshotLabel.MatchString(label) {
+		return time.Time{}, fmt.Errorf("invalid snapshot label %q", label)
+	}
+	if taken, err := c.SnapshotTime(ctx, label); err == nil {
+		return taken, fmt.Errorf("snapshot %q already exists", label)
+	}
+	now := time.Now()
+	expiration := now.Add(snapshotRetention)
+	labels, err := c.snapshotLabels(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(append(labels, label)); err != nil {
+		return time.Time{}, fmt.Errorf("gob.Encode: %w", err)
+	}
+	c.adapter.Set(snapshotLabelsKey, b.Bytes(), expiration)
+
+	// the copies are written after the walk, the adapter isn't written while listed
+	copies := map[uint64]Response{}
+	err = walk(ctx, c.adapter, func(key uint64, value []byte) bool {
+		response, err := BytesToResponse(value)
+		if err != nil || response.Snapshot != "" || response.Namespace != c.namespace ||
+			response.Created.IsZero() || !response.Expiration.After(now) {
+			// not a live entry: a body, an index, a snapshot copy or meta
+			return true
+		}
+		copies[key] = response
+		return true
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("walk: %w", err)
+	}
+	copied := 0
+	for key, response := range copies {
+		body, ok := c.body(ctx, key, response)
+		if !ok {
+			continue
+		}
+		value, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			c.logger.Warn("Failed to copy cache entry into snapshot", "key", key, "snapshot", label, "error", err)
+			continue
+		}
+		response.Value = value
+		response.Streamed = false
+		response.BodyVersion = 0
+		response.Size = 0
+		response.Snapshot = label
+		response.Expiration = expiration
+		c.store(snapshotKey(label, key), response)
+		copied++
+	}
+	meta := Response{Created: now, Expiration: expiration, Snapshot: label}
+	c.adapter.Set(snapshotMetaKey(label), meta.Bytes(), meta.Expiration)
+	c.logger.Info("Cache snapshot tagged", "snapshot", label, "entries", copied)
+	return now, nil
+}
+
+// snapshotLabels returns the labels of the snapshots tagged.
+func (c *Cache) snapshotLabels(ctx context.Context) ([]string, error) {
+	b, ok := c.adapter.Get(ctx, snapshotLabelsKey)
+	if !ok {
+		return nil, nil
+	}
+	var labels []string
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&labels); err != nil {
+		return nil, fmt.Errorf("gob.Decode: %w", err)
+	}
+	return labels, nil
+}
+
+// SnapshotTime returns when a snapshot was tagged.
+func (c *Cache) SnapshotTime(ctx context.Context, label string) (time.Time, error) {
+	b, ok := c.adapter.Get(ctx, snapshotMetaKey(label))
+	if !ok {
+		return time.Time{}, ErrUnknownSnapshot
+	}
+	meta, err := BytesToResponse(b)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("BytesToResponse: %w", err)
+	}
+	return meta.Created, nil
+}
+
+// serveSnapshot serves a request from a snapshot, recording the upstream
+// answer on first read of the entries missing from it.
+func (h *cachedHTTPHandler) serveSnapshot(w http.ResponseWriter, r *http.Request, key uint64, label string) {
+	c := h.client
+	taken, err := c.SnapshotTime(r.Context(), label)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Snapshot %q: %v", label, err), http.StatusNotFound)
+		return
+	}
+	skey := snapshotKey(label, key)
+	if response, ok := c.lookup(r.Context(), skey); ok && h.serveCached(w, r, skey, response) {
+		return
+	}
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	response, ok := h.fetch(w, r, key, buf)
+	if !ok {
+		return
+	}
+	c.store(key, response)
+	c.archive(r.Context(), key, response)
+	response.Expiration = taken.Add(snapshotRetention)
+	response.Snapshot = label
+	c.store(skey, response)
+	c.indexDomain(r.Context(), r, key, skey)
+	c.logger.Info("Upstream answer recorded into snapshot", "key", key, "snapshot", label)
+}
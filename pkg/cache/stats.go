@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// lookupMetrics counts the hits and misses of the middleware since start.
+var lookupMetrics = expvar.NewMap("cache_lookups")
+
+// hitRatioWindow is how far back HitRatio counts the lookups, by the minute.
+const hitRatioWindow = 15
+
+// lookupBucket counts the lookups of a minute.
+type lookupBucket struct {
+	minute int64
+	hits   int64
+	misses int64
+}
+
+// lookupStats are the lookups of the last minutes.
+type lookupStats struct {
+	mu      sync.Mutex
+	buckets [hitRatioWindow]lookupBucket
+}
+
+func (s *lookupStats) record(hit bool, now time.Time) {
+	if hit {
+		lookupMetrics.Add("hits", 1)
+	} else {
+		lookupMetrics.Add("misses", 1)
+	}
+	minute := now.Unix() / 60
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := &s.buckets[minute%hitRatioWindow]
+	if b.minute != minute {
+		*b = lookupBucket{minute: minute}
+	}
+	if hit {
+		b.hits++
+	} else {
+		b.misses++
+	}
+}
+
+// HitRatio returns the share of the lookups of the last 15 minutes answered
+// from the cache, and how many there were. It's 0 without lookups.
+func (c *Cache) HitRatio() (float64, int64) {
+	minute := time.Now().Unix() / 60
+	c.lookups.mu.Lock()
+	defer c.lookups.mu.Unlock()
+	var hits, total int64
+	for _, b := range c.lookups.buckets {
+		if minute-b.minute < hitRatioWindow {
+			hits += b.hits
+			total += b.hits + b.misses
+		}
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(hits) / float64(total), total
+}
@@ -0,0 +1,152 @@
+package cache
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TTLRule sets the TTL of the answers matching a provider, a status and a
+// body size, e.g. a day for redirects, an hour for tiny 200s that are
+// probably soft errors.
+type TTLRule struct {
+	// Provider is the provider of the answer, "" matches every provider.
+	Provider string
+	// Status is a status code such as "200", a class such as "3xx", or "*".
+	Status string
+	// Smaller and Larger bound the body size in bytes, 0 doesn't bound it.
+	Smaller int64
+	Larger  int64
+	TTL     time.Duration
+}
+
+func (tr TTLRule) matches(provider string, statusCode int, size int64) bool {
+	if tr.Provider != "" && tr.Provider != provider {
+		return false
+	}
+	status := strconv.Itoa(statusCode)
+	switch {
+	case tr.Status == "*":
+	case strings.HasSuffix(tr.Status, "xx"):
+		if !strings.HasPrefix(status, strings.TrimSuffix(tr.Status, "xx")) {
+			return false
+		}
+	case tr.Status != status:
+		return false
+	}
+	if tr.Smaller > 0 && size >= tr.Smaller {
+		return false
+	}
+	if tr.Larger > 0 && size <= tr.Larger {
+		return false
+	}
+	return true
+}
+
+// matchTTL returns the TTL of the first rule matching the answer, ttl when
+// none matches.
+func matchTTL(rules []TTLRule, provider string, statusCode int, size int64, ttl time.Duration) time.Duration {
+	for _, rule := range rules {
+		if rule.matches(provider, statusCode, size) {
+			return rule.TTL
+		}
+	}
+	return ttl
+}
+
+// entryTTL returns the TTL of a new answer, the one of its rule spread by the
+// jitter so the entries written in a burst, e.g. by a warm-up, don't expire
+// together.
+func (c *Cache) entryTTL(provider string, statusCode int, size int64) time.Duration {
+	ttl := matchTTL(c.ttlRules, provider, statusCode, size, c.ttl)
+	if c.ttlJitter > 0 {
+		ttl += time.Duration((2*rand.Float64() - 1) * c.ttlJitter / 100 * float64(ttl))
+	}
+	return ttl
+}
+
+// ParseTTLRules parses rules such as "200<1KB=1h,200>1KB=7d,3xx=30d,serper:*=1d".
+// Each rule is an optional provider, a status, code or class, an optional
+// body size bound and a TTL, a Go duration or a number of days.
+func ParseTTLRules(s string) ([]TTLRule, error) {
+	var rules []TTLRule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		match, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("ttl rule %q: missing '='", part)
+		}
+		var rule TTLRule
+		if provider, rest, ok := strings.Cut(match, ":"); ok {
+			rule.Provider = strings.TrimSpace(provider)
+			match = rest
+		}
+		status, size := strings.TrimSpace(match), ""
+		if i := strings.IndexAny(status, "<>"); i >= 0 {
+			status, size = strings.TrimSpace(status[:i]), status[i:]
+		}
+		if !validTTLStatus(status) {
+			return nil, fmt.Errorf("ttl rule %q: invalid status %q", part, status)
+		}
+		rule.Status = strings.ToLower(status)
+		if size != "" {
+			n, err := parseSize(strings.TrimSpace(size[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("ttl rule %q: %w", part, err)
+			}
+			if size[0] == '<' {
+				rule.Smaller = n
+			} else {
+				rule.Larger = n
+			}
+		}
+		ttl, err := parseTTL(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("ttl rule %q: %w", part, err)
+		}
+		rule.TTL = ttl
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// validTTLStatus accepts "*", codes such as "301" and classes such as "3xx".
+func validTTLStatus(s string) bool {
+	if s == "*" {
+		return true
+	}
+	if len(s) != 3 || s[0] < '1' || s[0] > '5' {
+		return false
+	}
+	if strings.EqualFold(s[1:], "xx") {
+		return true
+	}
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// parseTTL parses Go durations, and days such as "7d".
+func parseTTL(s string) (time.Duration, error) {
+	var ttl time.Duration
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid ttl %q", s)
+		}
+		ttl = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if ttl, err = time.ParseDuration(s); err != nil {
+			return 0, fmt.Errorf("invalid ttl %q", s)
+		}
+	}
+	if ttl < 1 {
+		return 0, fmt.Errorf("invalid ttl %q", s)
+	}
+	return ttl, nil
+}
@@ -0,0 +1,39 @@
+package cache
+
+import (
+	"expvar"
+	"strconv"
+)
+
+// versionMetrics are published on /debug/vars under "cache_versions".
+var versionMetrics = expvar.NewMap("cache_versions")
+
+// FormatVersion is the version of the key scheme, the request normalization
+// and the entry serialization. It's hashed into every key with the key
+// config, so bumping it, or deploying another config, moves the entries to
+// new keys instead of serving incompatible ones. The old entries expire with
+// their TTL.
+const FormatVersion = 1
+
+// namespaceOf returns the seed of the keys of a format version and key config.
+func namespaceOf(config string) uint64 {
+	return hashString(offset64, "v"+strconv.Itoa(FormatVersion)+":"+config+"\n")
+}
+
+// generateKey returns the key of a request URL in the namespace of the cache.
+func (c *Cache) generateKey(URL string) uint64 {
+	return hashString(c.namespace, URL)
+}
+
+// generateKeyWithBody returns the key of a request URL and body in the
+// namespace of the cache.
+func (c *Cache) generateKeyWithBody(URL string, body []byte) uint64 {
+	return hashWithBody(c.namespace, URL, body)
+}
+
+// compatible reports whether an entry was stored in the namespace of the
+// cache. Entries of another namespace are only found on key collisions, or
+// under keys computed without it, and are evicted.
+func (c *Cache) compatible(response Response) bool {
+	return response.Namespace == c.namespace
+}
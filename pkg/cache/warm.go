@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// warmBatch is the number of keys scanned and read per round trip.
+const warmBatch = 500
+
+// hotEntry is an entry loaded by Warm.
+type hotEntry struct {
+	key       string
+	value     []byte
+	frequency int
+}
+
+// hotEntries is a min-heap of the entries hit the most, by frequency.
+type hotEntries []hotEntry
+
+func (h hotEntries) Len() int           { return len(h) }
+func (h hotEntries) Less(i, j int) bool { return h[i].frequency < h[j].frequency }
+func (h hotEntries) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *hotEntries) Push(x any)        { *h = append(*h, x.(hotEntry)) }
+func (h *hotEntries) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// Warm loads the n entries hit the most into the local cache, so a freshly
+// deployed replica doesn't start with a cold local cache. Up to scanLimit
+// keys of Redis are scanned, the hits are the frequencies of their entries.
+// It returns the number of entries loaded, those found before ctx is done
+// are loaded regardless, none without a local cache.
+func (ra *RedisAdapter) Warm(ctx context.Context, n, scanLimit int) (int, error) {
+	if ra.local == nil {
+		return 0, nil
+	}
+	hot := &hotEntries{}
+	now := time.Now()
+	// the shards are scanned concurrently
+	var mu sync.Mutex
+	scanned := 0
+	err := ra.ring.ForEachShard(ctx, func(ctx context.Context, client *redis.Client) error {
+		var cursor uint64
+		for {
+			keys, next, err := client.Scan(ctx, cursor, "*", warmBatch).Result()
+			if err != nil {
+				return fmt.Errorf("Scan: %w", err)
+			}
+			// the entries are under their bare key, the other data has a prefix
+			keys = slices.DeleteFunc(keys, func(key string) bool { return strings.Contains(key, ":") })
+			mu.Lock()
+			keys = keys[:min(len(keys), scanLimit-scanned)]
+			scanned += len(keys)
+			done := scanned >= scanLimit
+			mu.Unlock()
+			if len(keys) > 0 {
+				values, err := client.MGet(ctx, keys...).Result()
+				if err != nil {
+					return fmt.Errorf("MGet: %w", err)
+				}
+				var entries []hotEntry
+				for i, v := range values {
+					value, ok := v.(string)
+					if !ok {
+						continue
+					}
+					if frequency, ok := entryFrequency([]byte(value), now); ok {
+						entries = append(entries, hotEntry{key: keys[i], value: []byte(value), frequency: frequency})
+					}
+				}
+				mu.Lock()
+				for _, entry := range entries {
+					heap.Push(hot, entry)
+					if hot.Len() > n {
+						heap.Pop(hot)
+					}
+				}
+				mu.Unlock()
+			}
+			if cursor = next; cursor == 0 || done {
+				return nil
+			}
+		}
+	})
+	for _, entry := range *hot {
+		ra.local.Set(entry.key, entry.value)
+	}
+	return hot.Len(), err
+}
+
+// entryFrequency returns the hits of a stored entry, false for the values
+// that aren't unexpired entries, e.g. the streamed bodies.
+func entryFrequency(value []byte, now time.Time) (int, bool) {
+	var b []byte
+	if err := msgpack.Unmarshal(value, &b); err != nil {
+		return 0, false
+	}
+	response, err := BytesToResponse(b)
+	if err != nil || !response.Expiration.After(now) {
+		return 0, false
+	}
+	return response.Frequency, true
+}
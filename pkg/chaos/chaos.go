@@ -0,0 +1,166 @@
+// Package chaos injects latency and failures into the shared stores, so
+// consistency tests can run several proxy instances against slow, flaky
+// Redis and cache adapters.
+package chaos
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/cache"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrInjected is returned by the failures the Injector makes up.
+var ErrInjected = errors.New("chaos: injected failure")
+
+// Injector decides the latency and failures of every store call.
+type Injector struct {
+	// MaxLatency is the upper bound of the random delay before each call.
+	MaxLatency time.Duration
+	// FailureRate is the probability, from 0 to 1, of a call failing.
+	FailureRate float64
+	// LostReplyRate is the probability of a call failing after it was applied,
+	// as if the reply was lost on the way back.
+	LostReplyRate float64
+}
+
+// delay sleeps for a random jitter, it returns early when ctx is done.
+func (i Injector) delay(ctx context.Context) {
+	if i.MaxLatency <= 0 {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Duration(rand.Int63n(int64(i.MaxLatency)))):
+	}
+}
+
+func (i Injector) fail() bool {
+	return i.FailureRate > 0 && rand.Float64() < i.FailureRate
+}
+
+func (i Injector) loseReply() bool {
+	return i.LostReplyRate > 0 && rand.Float64() < i.LostReplyRate
+}
+
+// RedisHook returns a go-redis hook applying the injector to every command:
+//
+//	rdb.AddHook(chaos.RedisHook(injector))
+func RedisHook(i Injector) redis.Hook {
+	return hook{i}
+}
+
+type hook struct {
+	injector Injector
+}
+
+func (h hook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (h hook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.injector.delay(ctx)
+		if h.injector.fail() {
+			cmd.SetErr(ErrInjected)
+			return ErrInjected
+		}
+		if err := next(ctx, cmd); err != nil {
+			return err
+		}
+		if h.injector.loseReply() {
+			cmd.SetErr(ErrInjected)
+			return ErrInjected
+		}
+		return nil
+	}
+}
+
+func (h hook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		h.injector.delay(ctx)
+		if h.injector.fail() {
+			for _, cmd := range cmds {
+				cmd.SetErr(ErrInjected)
+			}
+			return ErrInjected
+		}
+		return next(ctx, cmds)
+	}
+}
+
+// Adapter is a cache.Adapter applying the injector to every call. Failed reads
+// are misses and failed writes are dropped, as the Redis adapter does.
+type Adapter struct {
+	next     cache.Adapter
+	injector Injector
+}
+
+// NewAdapter creates a new Adapter wrapping next.
+func NewAdapter(next cache.Adapter, i Injector) *Adapter {
+	return &Adapter{next: next, injector: i}
+}
+
+// Get implements the cache Adapter interface Get method.
+func (a *Adapter) Get(ctx context.Context, key uint64) ([]byte, bool) {
+	a.injector.delay(ctx)
+	if a.injector.fail() {
+		return nil, false
+	}
+	return a.next.Get(ctx, key)
+}
+
+// Set implements the cache Adapter interface Set method.
+func (a *Adapter) Set(key uint64, response []byte, expiration time.Time) {
+	a.injector.delay(context.Background())
+	if a.injector.fail() {
+		return
+	}
+	a.next.Set(key, response, expiration)
+}
+
+// Expire implements the cache Expirer interface when next does.
+func (a *Adapter) Expire(ctx context.Context, key uint64, expiration time.Time) bool {
+	a.injector.delay(ctx)
+	if a.injector.fail() {
+		return false
+	}
+	expirer, ok := a.next.(cache.Expirer)
+	return ok && expirer.Expire(ctx, key, expiration)
+}
+
+// Release implements the cache Adapter interface Release method.
+func (a *Adapter) Release(ctx context.Context, key uint64) {
+	a.injector.delay(ctx)
+	if a.injector.fail() {
+		return
+	}
+	a.next.Release(ctx, key)
+}
+
+// GetMulti implements the cache Adapter interface GetMulti method, a failure
+// misses every key.
+func (a *Adapter) GetMulti(ctx context.Context, keys []uint64) map[uint64][]byte {
+	a.injector.delay(ctx)
+	if a.injector.fail() {
+		return map[uint64][]byte{}
+	}
+	return a.next.GetMulti(ctx, keys)
+}
+
+// GetReader implements the cache Adapter interface GetReader method.
+func (a *Adapter) GetReader(ctx context.Context, key uint64) (io.ReadCloser, bool) {
+	a.injector.delay(ctx)
+	if a.injector.fail() {
+		return nil, false
+	}
+	return a.next.GetReader(ctx, key)
+}
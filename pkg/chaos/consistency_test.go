@@ -0,0 +1,168 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/cache"
+	"github.com/Airren/poorman-httpcache/v2/pkg/internal/cachetest"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate/adapter"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestCacheNeverServesMixedProviders runs several cache instances, each in front
+// of a different provider, against one flaky store. Every answer must come from
+// the provider its metadata names, including streamed values stored apart.
+func TestCacheNeverServesMixedProviders(t *testing.T) {
+	const instances = 4
+	store := NewAdapter(cachetest.NewMemoryAdapter(), Injector{
+		MaxLatency:  2 * time.Millisecond,
+		FailureRate: 0.05,
+	})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var handlers []http.Handler
+	for i := range instances {
+		provider := fmt.Sprintf("provider-%d", i)
+		c, err := cache.New(
+			cache.WithAdapter(store),
+			cache.WithTTL(time.Minute),
+			cache.WithRefreshKey("refresh"),
+			cache.WithStreamThreshold(64),
+			cache.WithLogger(logger),
+		)
+		if err != nil {
+			t.Fatalf("cache.New: %v", err)
+		}
+		upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Upstream-Provider", provider)
+			// large enough to be streamed
+			fmt.Fprintf(w, "%s %s", provider, strings.Repeat(".", 128))
+		})
+		handlers = append(handlers, c.HTTPHandlerMiddleware(upstream))
+	}
+
+	var mixed atomic.Int64
+	var wg sync.WaitGroup
+	for worker := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range 200 {
+				target := fmt.Sprintf("/page/%d", n%5)
+				if rand.Intn(10) == 0 {
+					target += "?refresh"
+				}
+				req := httptest.NewRequest(http.MethodGet, target, nil)
+				req.Header.Set(cache.DebugHeader, "1")
+				rec := httptest.NewRecorder()
+				handlers[(worker+n)%instances].ServeHTTP(rec, req)
+
+				provider := rec.Header().Get("X-Cache-Provider")
+				if !strings.HasPrefix(rec.Body.String(), provider+" ") {
+					mixed.Add(1)
+					t.Errorf("%s %s: provider %q, body from %q", target, rec.Header().Get("X-Cache"), provider, strings.Fields(rec.Body.String() + " ")[0])
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if mixed.Load() > 0 {
+		t.Fatalf("%d mixed-provider answers", mixed.Load())
+	}
+}
+
+// TestQuotaNeverNegative runs several quota managers against one Redis with
+// injected latency, failures and lost replies. The quota must never go below
+// zero and the granted reservations must never exceed it.
+func TestQuotaNeverNegative(t *testing.T) {
+	addr := miniredis.RunT(t).Addr()
+	const (
+		instances = 4
+		quota     = 500
+		key       = "sk-chaos"
+	)
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "metastore.yaml")
+	doc := fmt.Sprintf("services:\n  - name: chaos\n    default_quota: %d\nkeys:\n  - key: %s\n    status: assigned\n    has_quota: true\n", quota, key)
+	if err := os.WriteFile(path, []byte(doc), 0o600); err != nil {
+		t.Fatalf("os.WriteFile: %v", err)
+	}
+	metaStore, err := adapter.NewFileMetaStore(path)
+	if err != nil {
+		t.Fatalf("NewFileMetaStore: %v", err)
+	}
+	keyMeta, err := metaStore.GetKey(ctx, key)
+	if err != nil {
+		t.Fatalf("GetKey: %v", err)
+	}
+
+	clean := redis.NewClient(&redis.Options{Addr: addr})
+	defer clean.Close()
+	quotaKey := fmt.Sprintf("quota:%s", key)
+	if err := clean.Del(ctx, quotaKey).Err(); err != nil {
+		t.Fatalf("Del: %v", err)
+	}
+
+	var managers []*adapter.QuotaManager
+	for range instances {
+		rdb := redis.NewClient(&redis.Options{Addr: addr, MaxRetries: -1})
+		defer rdb.Close()
+		rdb.AddHook(RedisHook(Injector{
+			MaxLatency:    5 * time.Millisecond,
+			FailureRate:   0.05,
+			LostReplyRate: 0.05,
+		}))
+		qm, err := adapter.NewQuotaManager(ctx, rdb, metaStore, "chaos")
+		if err != nil {
+			t.Fatalf("NewQuotaManager: %v", err)
+		}
+		managers = append(managers, qm)
+	}
+
+	var granted atomic.Int64
+	var wg sync.WaitGroup
+	for worker := range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range 50 {
+				qm := managers[(worker+n)%instances]
+				ok, err := qm.Reserve(ctx, keyMeta, 1)
+				if err == nil && ok {
+					granted.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	remaining, err := clean.HGet(ctx, quotaKey, "service_chaos").Int64()
+	if err != nil {
+		t.Fatalf("HGet: %v", err)
+	}
+	if remaining < 0 {
+		t.Fatalf("quota went negative: %d", remaining)
+	}
+	if granted.Load() > quota {
+		t.Fatalf("granted %d reservations over a quota of %d", granted.Load(), quota)
+	}
+	if granted.Load()+remaining > quota {
+		t.Fatalf("granted %d + remaining %d exceed the quota of %d", granted.Load(), remaining, quota)
+	}
+}
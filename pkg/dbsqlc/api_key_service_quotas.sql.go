@@ -155,7 +155,8 @@ WITH quota_update AS (
     FROM api_key_service_quotas aksq
     JOIN services s ON aksq.service_id = s.id
     JOIN api_keys ak ON aksq.api_key_id = ak.id
-    WHERE ak.key_string = $1 AND s.name = $2 AND ak.status = 'assigned'
+    WHERE ak.key_string = $1 AND s.name = $2 AND ak.status IN ('assigned', 'trial')
+        AND (ak.expires_at IS NULL OR ak.expires_at > NOW())
 )
 UPDATE api_key_service_quotas
 SET remaining_quota = LEAST(api_key_service_quotas.remaining_quota + $3, qu.initial_quota),
@@ -190,7 +191,7 @@ WITH quota_check AS (
     FROM api_key_service_quotas aksq
     JOIN services s ON aksq.service_id = s.id
     JOIN api_keys ak ON aksq.api_key_id = ak.id
-    WHERE ak.key_string = $1 AND s.name = $2 AND ak.status = 'assigned'
+    WHERE ak.key_string = $1 AND s.name = $2 AND ak.status IN ('assigned', 'trial', 'expired')
 )
 UPDATE api_key_service_quotas
 SET remaining_quota = api_key_service_quotas.remaining_quota - $3,
@@ -219,3 +220,25 @@ func (q *Queries) ReserveQuota(ctx context.Context, arg *ReserveQuotaParams) (*R
 	err := row.Scan(&i.RemainingQuota, &i.InitialQuota)
 	return &i, err
 }
+
+const setKeyServiceQuota = `-- name: SetKeyServiceQuota :exec
+INSERT INTO api_key_service_quotas (api_key_id, service_id, initial_quota, remaining_quota)
+VALUES ($1, $2, $3, $3)
+ON CONFLICT (api_key_id, service_id) DO UPDATE SET
+    remaining_quota = GREATEST(api_key_service_quotas.remaining_quota + EXCLUDED.initial_quota - api_key_service_quotas.initial_quota, 0),
+    initial_quota = EXCLUDED.initial_quota,
+    updated_at = NOW()
+`
+
+type SetKeyServiceQuotaParams struct {
+	ApiKeyID     int64
+	ServiceID    int64
+	InitialQuota int32
+}
+
+// Set the quota of a key for a service, moving the remaining quota by the
+// change of the initial one, so what was spent stays spent
+func (q *Queries) SetKeyServiceQuota(ctx context.Context, arg *SetKeyServiceQuotaParams) error {
+	_, err := q.db.Exec(ctx, setKeyServiceQuota, arg.ApiKeyID, arg.ServiceID, arg.InitialQuota)
+	return err
+}
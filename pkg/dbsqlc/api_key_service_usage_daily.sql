@@ -0,0 +1,74 @@
+CREATE TABLE api_key_service_usage_daily (
+    api_key_id BIGINT NOT NULL REFERENCES api_keys(id) ON DELETE CASCADE,
+    service_id BIGINT NOT NULL REFERENCES services(id) ON DELETE CASCADE,
+    day DATE NOT NULL,
+    consumption_amount BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (api_key_id, service_id, day)
+);
+
+CREATE INDEX idx_usage_daily_day ON api_key_service_usage_daily(day);
+
+-- Daily usage aggregates, kept after minute rows are deleted by retention
+
+-- Roll minute usage older than the cutoff up into daily aggregates, replacing
+-- those the rollup job materialized already
+-- name: RollupUsageLogsBefore :execrows
+INSERT INTO api_key_service_usage_daily (api_key_id, service_id, day, consumption_amount)
+SELECT api_key_id, service_id, (minute_timestamp AT TIME ZONE 'UTC')::date, SUM(consumption_amount)
+FROM api_key_service_usage_logs
+WHERE minute_timestamp < $1
+GROUP BY api_key_id, service_id, (minute_timestamp AT TIME ZONE 'UTC')::date
+ON CONFLICT (api_key_id, service_id, day)
+DO UPDATE SET consumption_amount = EXCLUDED.consumption_amount;
+
+-- Delete the daily usage of every key of a user
+-- name: DeleteUsageDailyByUserID :execrows
+DELETE FROM api_key_service_usage_daily
+WHERE api_key_id IN (SELECT id FROM api_keys WHERE user_id = $1);
+
+-- Serialize rollups across replicas, for the length of the transaction
+-- name: LockUsageRollup :exec
+SELECT pg_advisory_xact_lock(hashtext('api_key_service_usage_daily'));
+
+-- Serialize rollups across replicas until UnlockUsageRollupSession, for the
+-- work that can't run in a transaction, e.g. detaching partitions concurrently
+-- name: LockUsageRollupSession :exec
+SELECT pg_advisory_lock(hashtext('api_key_service_usage_daily'));
+
+-- name: UnlockUsageRollupSession :exec
+SELECT pg_advisory_unlock(hashtext('api_key_service_usage_daily'));
+
+-- Import a day of usage from a provider export, the days already recorded are kept
+-- name: ImportUsageDaily :execrows
+INSERT INTO api_key_service_usage_daily (api_key_id, service_id, day, consumption_amount)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (api_key_id, service_id, day) DO NOTHING;
+
+-- Daily usage in a range of whole days with the service name, for analytics
+-- exports: the materialized days, then the hourly and minute usage past them
+-- name: GetDailyUsageBetween :many
+WITH w AS (
+    SELECT
+        COALESCE((SELECT materialized_before FROM api_key_service_usage_rollups WHERE granularity = 'day'), '-infinity') AS day_before,
+        COALESCE((SELECT materialized_before FROM api_key_service_usage_rollups WHERE granularity = 'hour'), '-infinity') AS hour_before
+), days AS (
+    SELECT d.api_key_id, d.service_id, d.day, d.consumption_amount
+    FROM api_key_service_usage_daily d, w
+    WHERE d.day >= (@start_time::timestamptz AT TIME ZONE 'UTC')::date
+        AND d.day < (@end_time::timestamptz AT TIME ZONE 'UTC')::date
+        AND d.day < (w.day_before AT TIME ZONE 'UTC')::date
+    UNION ALL
+    SELECT h.api_key_id, h.service_id, (h.hour AT TIME ZONE 'UTC')::date, h.consumption_amount
+    FROM api_key_service_usage_hourly h, w
+    WHERE h.hour >= GREATEST(@start_time::timestamptz, w.day_before) AND h.hour < LEAST(@end_time::timestamptz, w.hour_before)
+    UNION ALL
+    SELECT l.api_key_id, l.service_id, (l.minute_timestamp AT TIME ZONE 'UTC')::date, l.consumption_amount::bigint
+    FROM api_key_service_usage_logs l, w
+    WHERE l.minute_timestamp >= GREATEST(@start_time::timestamptz, w.day_before, w.hour_before) AND l.minute_timestamp < @end_time::timestamptz
+)
+SELECT days.api_key_id, s.name AS service_name, days.day,
+    SUM(days.consumption_amount)::bigint AS consumption_amount
+FROM days
+JOIN services s ON s.id = days.service_id
+GROUP BY days.api_key_id, s.name, days.day
+ORDER BY s.name, days.day, days.api_key_id;
@@ -0,0 +1,62 @@
+CREATE TABLE api_key_service_usage_hourly (
+    api_key_id BIGINT NOT NULL REFERENCES api_keys(id) ON DELETE CASCADE,
+    service_id BIGINT NOT NULL REFERENCES services(id) ON DELETE CASCADE,
+    hour TIMESTAMPTZ NOT NULL, -- Truncated to hour boundary, in UTC
+    consumption_amount BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (api_key_id, service_id, hour)
+);
+
+CREATE INDEX idx_usage_hourly_hour ON api_key_service_usage_hourly(hour);
+
+-- How far the hourly and daily aggregates are materialized, the hours or days
+-- before materialized_before are complete
+CREATE TABLE api_key_service_usage_rollups (
+    granularity TEXT PRIMARY KEY, -- 'hour' or 'day'
+    materialized_before TIMESTAMPTZ NOT NULL
+);
+
+-- Hourly usage aggregates, materialized from the minute rows for reporting
+
+-- Recompute the hourly aggregates of the minute rows in a range of whole hours
+-- name: RollupUsageHourly :execrows
+INSERT INTO api_key_service_usage_hourly (api_key_id, service_id, hour, consumption_amount)
+SELECT api_key_id, service_id,
+    date_trunc('hour', minute_timestamp AT TIME ZONE 'UTC') AT TIME ZONE 'UTC',
+    SUM(consumption_amount)
+FROM api_key_service_usage_logs
+WHERE minute_timestamp >= @start_time AND minute_timestamp < @end_time
+GROUP BY api_key_id, service_id, date_trunc('hour', minute_timestamp AT TIME ZONE 'UTC')
+ON CONFLICT (api_key_id, service_id, hour)
+DO UPDATE SET consumption_amount = EXCLUDED.consumption_amount;
+
+-- Recompute the daily aggregates of the hourly ones in a range of whole days
+-- name: RollupUsageDaily :execrows
+INSERT INTO api_key_service_usage_daily (api_key_id, service_id, day, consumption_amount)
+SELECT api_key_id, service_id, (hour AT TIME ZONE 'UTC')::date, SUM(consumption_amount)
+FROM api_key_service_usage_hourly
+WHERE hour >= @start_time AND hour < @end_time
+GROUP BY api_key_id, service_id, (hour AT TIME ZONE 'UTC')::date
+ON CONFLICT (api_key_id, service_id, day)
+DO UPDATE SET consumption_amount = EXCLUDED.consumption_amount;
+
+-- The oldest minute row, where the first materialization starts
+-- name: GetOldestUsageLog :one
+SELECT MIN(minute_timestamp)::timestamptz AS oldest
+FROM api_key_service_usage_logs;
+
+-- How far a granularity is materialized
+-- name: GetUsageRollupWatermark :one
+SELECT materialized_before FROM api_key_service_usage_rollups
+WHERE granularity = $1;
+
+-- Move how far a granularity is materialized, never back
+-- name: SetUsageRollupWatermark :exec
+INSERT INTO api_key_service_usage_rollups (granularity, materialized_before)
+VALUES ($1, $2)
+ON CONFLICT (granularity)
+DO UPDATE SET materialized_before = GREATEST(api_key_service_usage_rollups.materialized_before, EXCLUDED.materialized_before);
+
+-- Delete the hourly usage of every key of a user
+-- name: DeleteUsageHourlyByUserID :execrows
+DELETE FROM api_key_service_usage_hourly
+WHERE api_key_id IN (SELECT id FROM api_keys WHERE user_id = $1);
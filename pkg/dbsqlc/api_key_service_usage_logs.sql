@@ -1,17 +1,21 @@
 CREATE TABLE api_key_service_usage_logs (
-    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
     api_key_id BIGINT NOT NULL REFERENCES api_keys(id) ON DELETE CASCADE,
     service_id BIGINT NOT NULL REFERENCES services(id) ON DELETE CASCADE,
     consumption_amount INTEGER NOT NULL DEFAULT 1, -- Aggregated count for the minute
     minute_timestamp TIMESTAMPTZ NOT NULL, -- Truncated to minute boundary
-    created_at TIMESTAMPTZ DEFAULT NOW()
-);
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (api_key_id, service_id, minute_timestamp)
+) PARTITION BY RANGE (minute_timestamp);
 
--- Updated indexes for minute aggregation
-CREATE INDEX idx_usage_log_api_key_id ON api_key_service_usage_logs(api_key_id);
+-- Monthly partitions, e.g. api_key_service_usage_logs_2025_06, are created
+-- ahead by cachev1 and dropped past retention by the retention worker. The
+-- default partition catches the minutes no partition covers yet, they're moved
+-- out when their month gets its partition.
+CREATE TABLE api_key_service_usage_logs_default PARTITION OF api_key_service_usage_logs DEFAULT;
+
+-- Indexes for minute aggregation, created on every partition
 CREATE INDEX idx_usage_log_service_id ON api_key_service_usage_logs(service_id);
 CREATE INDEX idx_usage_log_minute_timestamp ON api_key_service_usage_logs(minute_timestamp);
-CREATE UNIQUE INDEX idx_usage_log_unique_minute ON api_key_service_usage_logs(api_key_id, service_id, minute_timestamp);
 
 -- New queries for aggregation
 -- name: UpsertMinuteUsage :one
@@ -25,3 +29,52 @@ RETURNING consumption_amount;
 -- name: BatchInsertUsageLogs :copyfrom
 INSERT INTO api_key_service_usage_logs (api_key_id, service_id, consumption_amount, minute_timestamp, created_at)
 VALUES ($1, $2, $3, $4, $5);
+
+-- Delete the usage history of every key of a user
+-- name: DeleteUsageLogsByUserID :execrows
+DELETE FROM api_key_service_usage_logs
+WHERE api_key_id IN (SELECT id FROM api_keys WHERE user_id = $1);
+
+-- Delete minute usage older than the cutoff, once rolled up
+-- name: DeleteUsageLogsBefore :execrows
+DELETE FROM api_key_service_usage_logs WHERE minute_timestamp < $1;
+
+-- Minute usage in a time range with the service name, for analytics exports
+-- name: GetMinuteUsageBetween :many
+SELECT l.api_key_id, s.name AS service_name, l.minute_timestamp, l.consumption_amount
+FROM api_key_service_usage_logs l
+JOIN services s ON s.id = l.service_id
+WHERE l.minute_timestamp >= @start_time AND l.minute_timestamp < @end_time
+ORDER BY s.name, l.minute_timestamp, l.api_key_id;
+
+-- Hourly usage in a range of whole hours with the service name, for analytics
+-- exports: the materialized hours, then the minute rows past them
+-- name: GetHourlyUsageBetween :many
+WITH w AS (
+    SELECT COALESCE((SELECT materialized_before FROM api_key_service_usage_rollups WHERE granularity = 'hour'), '-infinity') AS hour_before
+), hours AS (
+    SELECT h.api_key_id, h.service_id, h.hour, h.consumption_amount
+    FROM api_key_service_usage_hourly h, w
+    WHERE h.hour >= @start_time::timestamptz AND h.hour < LEAST(@end_time::timestamptz, w.hour_before)
+    UNION ALL
+    SELECT l.api_key_id, l.service_id,
+        date_trunc('hour', l.minute_timestamp AT TIME ZONE 'UTC') AT TIME ZONE 'UTC',
+        SUM(l.consumption_amount)::bigint
+    FROM api_key_service_usage_logs l, w
+    WHERE l.minute_timestamp >= GREATEST(@start_time::timestamptz, w.hour_before) AND l.minute_timestamp < @end_time::timestamptz
+    GROUP BY l.api_key_id, l.service_id, date_trunc('hour', l.minute_timestamp AT TIME ZONE 'UTC')
+)
+SELECT hours.api_key_id, s.name AS service_name,
+    hours.hour::timestamptz AS hour,
+    hours.consumption_amount::bigint AS consumption_amount
+FROM hours
+JOIN services s ON s.id = hours.service_id
+ORDER BY s.name, hours.hour, hours.api_key_id;
+
+-- The partitions of the minute usage, for cachev1 to maintain
+-- name: ListUsageLogPartitions :many
+SELECT c.relname::text AS name
+FROM pg_inherits i
+JOIN pg_class c ON c.oid = i.inhrelid
+WHERE i.inhparent = 'api_key_service_usage_logs'::regclass
+ORDER BY c.relname;
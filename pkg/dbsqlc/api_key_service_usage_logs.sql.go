@@ -19,6 +19,170 @@ type BatchInsertUsageLogsParams struct {
 	CreatedAt         pgtype.Timestamptz
 }
 
+const deleteUsageLogsBefore = `-- name: DeleteUsageLogsBefore :execrows
+DELETE FROM api_key_service_usage_logs WHERE minute_timestamp < $1
+`
+
+// Delete minute usage older than the cutoff, once rolled up
+func (q *Queries) DeleteUsageLogsBefore(ctx context.Context, minuteTimestamp pgtype.Timestamptz) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteUsageLogsBefore, minuteTimestamp)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteUsageLogsByUserID = `-- name: DeleteUsageLogsByUserID :execrows
+DELETE FROM api_key_service_usage_logs
+WHERE api_key_id IN (SELECT id FROM api_keys WHERE user_id = $1)
+`
+
+// Delete the usage history of every key of a user
+func (q *Queries) DeleteUsageLogsByUserID(ctx context.Context, userID int64) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteUsageLogsByUserID, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const getHourlyUsageBetween = `-- name: GetHourlyUsageBetween :many
+WITH w AS (
+    SELECT COALESCE((SELECT materialized_before FROM api_key_service_usage_rollups WHERE granularity = 'hour'), '-infinity') AS hour_before
+), hours AS (
+    SELECT h.api_key_id, h.service_id, h.hour, h.consumption_amount
+    FROM api_key_service_usage_hourly h, w
+    WHERE h.hour >= $1::timestamptz AND h.hour < LEAST($2::timestamptz, w.hour_before)
+    UNION ALL
+    SELECT l.api_key_id, l.service_id,
+        date_trunc('hour', l.minute_timestamp AT TIME ZONE 'UTC') AT TIME ZONE 'UTC',
+        SUM(l.consumption_amount)::bigint
+    FROM api_key_service_usage_logs l, w
+    WHERE l.minute_timestamp >= GREATEST($1::timestamptz, w.hour_before) AND l.minute_timestamp < $2::timestamptz
+    GROUP BY l.api_key_id, l.service_id, date_trunc('hour', l.minute_timestamp AT TIME ZONE 'UTC')
+)
+SELECT hours.api_key_id, s.name AS service_name,
+    hours.hour::timestamptz AS hour,
+    hours.consumption_amount::bigint AS consumption_amount
+FROM hours
+JOIN services s ON s.id = hours.service_id
+ORDER BY s.name, hours.hour, hours.api_key_id
+`
+
+type GetHourlyUsageBetweenParams struct {
+	StartTime pgtype.Timestamptz
+	EndTime   pgtype.Timestamptz
+}
+
+type GetHourlyUsageBetweenRow struct {
+	ApiKeyID          int64
+	ServiceName       string
+	Hour              pgtype.Timestamptz
+	ConsumptionAmount int64
+}
+
+// Hourly usage in a range of whole hours with the service name, for analytics
+// exports: the materialized hours, then the minute rows past them
+func (q *Queries) GetHourlyUsageBetween(ctx context.Context, arg *GetHourlyUsageBetweenParams) ([]*GetHourlyUsageBetweenRow, error) {
+	rows, err := q.db.Query(ctx, getHourlyUsageBetween, arg.StartTime, arg.EndTime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*GetHourlyUsageBetweenRow
+	for rows.Next() {
+		var i GetHourlyUsageBetweenRow
+		if err := rows.Scan(
+			&i.ApiKeyID,
+			&i.ServiceName,
+			&i.Hour,
+			&i.ConsumptionAmount,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, &i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getMinuteUsageBetween = `-- name: GetMinuteUsageBetween :many
+SELECT l.api_key_id, s.name AS service_name, l.minute_timestamp, l.consumption_amount
+FROM api_key_service_usage_logs l
+JOIN services s ON s.id = l.service_id
+WHERE l.minute_timestamp >= $1 AND l.minute_timestamp < $2
+ORDER BY s.name, l.minute_timestamp, l.api_key_id
+`
+
+type GetMinuteUsageBetweenParams struct {
+	StartTime pgtype.Timestamptz
+	EndTime   pgtype.Timestamptz
+}
+
+type GetMinuteUsageBetweenRow struct {
+	ApiKeyID          int64
+	ServiceName       string
+	MinuteTimestamp   pgtype.Timestamptz
+	ConsumptionAmount int32
+}
+
+// Minute usage in a time range with the service name, for analytics exports
+func (q *Queries) GetMinuteUsageBetween(ctx context.Context, arg *GetMinuteUsageBetweenParams) ([]*GetMinuteUsageBetweenRow, error) {
+	rows, err := q.db.Query(ctx, getMinuteUsageBetween, arg.StartTime, arg.EndTime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*GetMinuteUsageBetweenRow
+	for rows.Next() {
+		var i GetMinuteUsageBetweenRow
+		if err := rows.Scan(
+			&i.ApiKeyID,
+			&i.ServiceName,
+			&i.MinuteTimestamp,
+			&i.ConsumptionAmount,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, &i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listUsageLogPartitions = `-- name: ListUsageLogPartitions :many
+SELECT c.relname::text AS name
+FROM pg_inherits i
+JOIN pg_class c ON c.oid = i.inhrelid
+WHERE i.inhparent = 'api_key_service_usage_logs'::regclass
+ORDER BY c.relname
+`
+
+// The partitions of the minute usage, for cachev1 to maintain
+func (q *Queries) ListUsageLogPartitions(ctx context.Context) ([]string, error) {
+	rows, err := q.db.Query(ctx, listUsageLogPartitions)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		items = append(items, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const upsertMinuteUsage = `-- name: UpsertMinuteUsage :one
 INSERT INTO api_key_service_usage_logs (api_key_id, service_id, consumption_amount, minute_timestamp)
 VALUES ($1, $2, $3, $4)
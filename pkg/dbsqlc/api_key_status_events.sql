@@ -7,3 +7,21 @@ CREATE TABLE api_key_status_events (
 
 CREATE INDEX idx_status_events_api_key_id ON api_key_status_events(api_key_id);
 CREATE INDEX idx_status_events_api_key_created ON api_key_status_events(api_key_id, created_at DESC);
+
+-- Status event queries
+
+-- Record a status change of a key
+-- name: CreateStatusEvent :exec
+INSERT INTO api_key_status_events (api_key_id, status)
+VALUES ($1, $2);
+
+-- Get status events older than the cutoff, in ID order
+-- name: GetStatusEventsBefore :many
+SELECT * FROM api_key_status_events
+WHERE created_at < $1
+ORDER BY id
+LIMIT $2;
+
+-- Delete status events up to an archived ID
+-- name: DeleteStatusEventsUpTo :execrows
+DELETE FROM api_key_status_events WHERE created_at < $1 AND id <= $2;
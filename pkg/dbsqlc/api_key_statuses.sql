@@ -9,4 +9,6 @@ INSERT INTO api_key_statuses (name, description) VALUES
 ('unassigned', 'Key generated but not yet assigned to user'),
 ('assigned', 'Key assigned to user and active'),
 ('exhausted', 'All quotas for this key are depleted'),
-('revoked', 'Key manually revoked/suspended');
+('revoked', 'Key manually revoked/suspended'),
+('trial', 'Trial key, active until it expires'),
+('expired', 'Trial key past its expiry');
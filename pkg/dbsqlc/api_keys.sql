@@ -5,12 +5,21 @@ CREATE TABLE api_keys (
     status TEXT NOT NULL DEFAULT 'unassigned' REFERENCES api_key_statuses(name),
     has_quota BOOLEAN NOT NULL DEFAULT TRUE,
     created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
-    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    -- trial keys stop working at expires_at, NULL never expires
+    expires_at TIMESTAMPTZ,
+    -- client networks and web origins the key works from, NULL allows anywhere
+    allowed_cidrs TEXT[],
+    allowed_origins TEXT[],
+    -- name of the key in the declarative state of its user, NULL for keys made otherwise
+    label TEXT
 );
 
 CREATE UNIQUE INDEX idx_api_keys_key_string ON api_keys(key_string);
+CREATE UNIQUE INDEX idx_api_keys_user_label ON api_keys(user_id, label);
 CREATE INDEX idx_api_keys_user_id ON api_keys(user_id);
 CREATE INDEX idx_api_keys_status ON api_keys(status);
+CREATE INDEX idx_api_keys_trial_expires_at ON api_keys(expires_at) WHERE status = 'trial';
 
 -- API Key-related queries
 
@@ -26,6 +35,12 @@ INSERT INTO api_keys (user_id, key_string, status, has_quota)
 VALUES ($1, $2, 'unassigned', TRUE)
 RETURNING *;
 
+-- Create trial key with quota, expiring at $3
+-- name: CreateTrialAPIKey :one
+INSERT INTO api_keys (user_id, key_string, status, has_quota, expires_at)
+VALUES ($1, $2, 'trial', TRUE, $3)
+RETURNING *;
+
 -- Batch create API keys (for generating multiple keys at once)
 -- name: BatchCreateAPIKeys :copyfrom
 INSERT INTO api_keys (user_id, key_string, status, has_quota)
@@ -37,6 +52,13 @@ SELECT * FROM api_keys
 WHERE status = 'unassigned' AND user_id = $1
 LIMIT 1;
 
+-- Set where a key can be used from, NULL allows anywhere
+-- name: SetAPIKeyRestrictions :one
+UPDATE api_keys
+SET allowed_cidrs = $2, allowed_origins = $3, updated_at = NOW()
+WHERE key_string = $1
+RETURNING *;
+
 -- Update API key status
 -- name: UpdateAPIKeyStatus :one
 UPDATE api_keys 
@@ -82,6 +104,33 @@ ORDER BY created_at DESC;
 SELECT * FROM api_keys
 ORDER BY created_at DESC;
 
+-- Get the API keys whose fingerprint, the first 4 bytes of the SHA-256 of
+-- the key in hex, is the given one (for impersonation)
+-- name: GetAPIKeysByFingerprint :many
+SELECT id, key_string, has_quota, status, expires_at, allowed_cidrs, allowed_origins FROM api_keys
+WHERE left(encode(sha256(convert_to(key_string, 'UTF8')), 'hex'), 8) = @fingerprint::text
+LIMIT 2;
+
 -- Get API key info by key string (for quota checking)
 -- name: GetAPIKeyByKeyString :one
-SELECT id, key_string,has_quota, status FROM api_keys WHERE key_string = $1;
+SELECT id, key_string,has_quota, status, expires_at, allowed_cidrs, allowed_origins FROM api_keys WHERE key_string = $1;
+
+-- Expire the trial keys past their expiry
+-- name: ExpireTrialKeys :many
+UPDATE api_keys
+SET status = 'expired', updated_at = NOW()
+WHERE status = 'trial' AND expires_at <= NOW()
+RETURNING *;
+
+-- Convert a trial key, expired or not, into a full key
+-- name: ConvertTrialKey :one
+UPDATE api_keys
+SET status = 'assigned', expires_at = NULL, updated_at = NOW()
+WHERE key_string = $1 AND status IN ('trial', 'expired')
+RETURNING *;
+
+-- Create an assigned key named by label in the declarative state of its user
+-- name: CreateLabeledAPIKey :one
+INSERT INTO api_keys (user_id, key_string, status, has_quota, label)
+VALUES ($1, $2, 'assigned', $3, $4)
+RETURNING *;
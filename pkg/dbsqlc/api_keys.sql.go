@@ -15,7 +15,7 @@ const assignKeyToUser = `-- name: AssignKeyToUser :one
 UPDATE api_keys 
 SET user_id = $2, status = 'assigned', updated_at = NOW()
 WHERE key_string = $1 AND status = 'unassigned'
-RETURNING id, user_id, key_string, status, has_quota, created_at, updated_at
+RETURNING id, user_id, key_string, status, has_quota, created_at, updated_at, expires_at, allowed_cidrs, allowed_origins, label
 `
 
 type AssignKeyToUserParams struct {
@@ -35,6 +35,10 @@ func (q *Queries) AssignKeyToUser(ctx context.Context, arg *AssignKeyToUserParam
 		&i.HasQuota,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.ExpiresAt,
+		&i.AllowedCidrs,
+		&i.AllowedOrigins,
+		&i.Label,
 	)
 	return &i, err
 }
@@ -46,11 +50,76 @@ type BatchCreateAPIKeysParams struct {
 	HasQuota  bool
 }
 
+const convertTrialKey = `-- name: ConvertTrialKey :one
+UPDATE api_keys
+SET status = 'assigned', expires_at = NULL, updated_at = NOW()
+WHERE key_string = $1 AND status IN ('trial', 'expired')
+RETURNING id, user_id, key_string, status, has_quota, created_at, updated_at, expires_at, allowed_cidrs, allowed_origins, label
+`
+
+// Convert a trial key, expired or not, into a full key
+func (q *Queries) ConvertTrialKey(ctx context.Context, keyString string) (*ApiKeys, error) {
+	row := q.db.QueryRow(ctx, convertTrialKey, keyString)
+	var i ApiKeys
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.KeyString,
+		&i.Status,
+		&i.HasQuota,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.ExpiresAt,
+		&i.AllowedCidrs,
+		&i.AllowedOrigins,
+		&i.Label,
+	)
+	return &i, err
+}
+
+const createLabeledAPIKey = `-- name: CreateLabeledAPIKey :one
+INSERT INTO api_keys (user_id, key_string, status, has_quota, label)
+VALUES ($1, $2, 'assigned', $3, $4)
+RETURNING id, user_id, key_string, status, has_quota, created_at, updated_at, expires_at, allowed_cidrs, allowed_origins, label
+`
+
+type CreateLabeledAPIKeyParams struct {
+	UserID    int64
+	KeyString string
+	HasQuota  bool
+	Label     pgtype.Text
+}
+
+// Create an assigned key named by label in the declarative state of its user
+func (q *Queries) CreateLabeledAPIKey(ctx context.Context, arg *CreateLabeledAPIKeyParams) (*ApiKeys, error) {
+	row := q.db.QueryRow(ctx, createLabeledAPIKey,
+		arg.UserID,
+		arg.KeyString,
+		arg.HasQuota,
+		arg.Label,
+	)
+	var i ApiKeys
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.KeyString,
+		&i.Status,
+		&i.HasQuota,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.ExpiresAt,
+		&i.AllowedCidrs,
+		&i.AllowedOrigins,
+		&i.Label,
+	)
+	return &i, err
+}
+
 const createServiceKey = `-- name: CreateServiceKey :one
 
 INSERT INTO api_keys (user_id, key_string, status, has_quota)
 VALUES ($1, $2, 'unassigned', FALSE)
-RETURNING id, user_id, key_string, status, has_quota, created_at, updated_at
+RETURNING id, user_id, key_string, status, has_quota, created_at, updated_at, expires_at, allowed_cidrs, allowed_origins, label
 `
 
 type CreateServiceKeyParams struct {
@@ -71,6 +140,42 @@ func (q *Queries) CreateServiceKey(ctx context.Context, arg *CreateServiceKeyPar
 		&i.HasQuota,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.ExpiresAt,
+		&i.AllowedCidrs,
+		&i.AllowedOrigins,
+		&i.Label,
+	)
+	return &i, err
+}
+
+const createTrialAPIKey = `-- name: CreateTrialAPIKey :one
+INSERT INTO api_keys (user_id, key_string, status, has_quota, expires_at)
+VALUES ($1, $2, 'trial', TRUE, $3)
+RETURNING id, user_id, key_string, status, has_quota, created_at, updated_at, expires_at, allowed_cidrs, allowed_origins, label
+`
+
+type CreateTrialAPIKeyParams struct {
+	UserID    int64
+	KeyString string
+	ExpiresAt pgtype.Timestamptz
+}
+
+// Create trial key with quota, expiring at $3
+func (q *Queries) CreateTrialAPIKey(ctx context.Context, arg *CreateTrialAPIKeyParams) (*ApiKeys, error) {
+	row := q.db.QueryRow(ctx, createTrialAPIKey, arg.UserID, arg.KeyString, arg.ExpiresAt)
+	var i ApiKeys
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.KeyString,
+		&i.Status,
+		&i.HasQuota,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.ExpiresAt,
+		&i.AllowedCidrs,
+		&i.AllowedOrigins,
+		&i.Label,
 	)
 	return &i, err
 }
@@ -78,7 +183,7 @@ func (q *Queries) CreateServiceKey(ctx context.Context, arg *CreateServiceKeyPar
 const createUserAPIKey = `-- name: CreateUserAPIKey :one
 INSERT INTO api_keys (user_id, key_string, status, has_quota)
 VALUES ($1, $2, 'unassigned', TRUE)
-RETURNING id, user_id, key_string, status, has_quota, created_at, updated_at
+RETURNING id, user_id, key_string, status, has_quota, created_at, updated_at, expires_at, allowed_cidrs, allowed_origins, label
 `
 
 type CreateUserAPIKeyParams struct {
@@ -98,19 +203,66 @@ func (q *Queries) CreateUserAPIKey(ctx context.Context, arg *CreateUserAPIKeyPar
 		&i.HasQuota,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.ExpiresAt,
+		&i.AllowedCidrs,
+		&i.AllowedOrigins,
+		&i.Label,
 	)
 	return &i, err
 }
 
+const expireTrialKeys = `-- name: ExpireTrialKeys :many
+UPDATE api_keys
+SET status = 'expired', updated_at = NOW()
+WHERE status = 'trial' AND expires_at <= NOW()
+RETURNING id, user_id, key_string, status, has_quota, created_at, updated_at, expires_at, allowed_cidrs, allowed_origins, label
+`
+
+// Expire the trial keys past their expiry
+func (q *Queries) ExpireTrialKeys(ctx context.Context) ([]*ApiKeys, error) {
+	rows, err := q.db.Query(ctx, expireTrialKeys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*ApiKeys
+	for rows.Next() {
+		var i ApiKeys
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.KeyString,
+			&i.Status,
+			&i.HasQuota,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.ExpiresAt,
+			&i.AllowedCidrs,
+			&i.AllowedOrigins,
+			&i.Label,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, &i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getAPIKeyByKeyString = `-- name: GetAPIKeyByKeyString :one
-SELECT id, key_string,has_quota, status FROM api_keys WHERE key_string = $1
+SELECT id, key_string,has_quota, status, expires_at, allowed_cidrs, allowed_origins FROM api_keys WHERE key_string = $1
 `
 
 type GetAPIKeyByKeyStringRow struct {
-	ID        int64
-	KeyString string
-	HasQuota  bool
-	Status    string
+	ID             int64
+	KeyString      string
+	HasQuota       bool
+	Status         string
+	ExpiresAt      pgtype.Timestamptz
+	AllowedCidrs   []string
+	AllowedOrigins []string
 }
 
 // Get API key info by key string (for quota checking)
@@ -122,26 +274,33 @@ func (q *Queries) GetAPIKeyByKeyString(ctx context.Context, keyString string) (*
 		&i.KeyString,
 		&i.HasQuota,
 		&i.Status,
+		&i.ExpiresAt,
+		&i.AllowedCidrs,
+		&i.AllowedOrigins,
 	)
 	return &i, err
 }
 
 const getAPIKeyWithUser = `-- name: GetAPIKeyWithUser :one
-SELECT ak.id, ak.user_id, ak.key_string, ak.status, ak.has_quota, ak.created_at, ak.updated_at, u.email as user_email
+SELECT ak.id, ak.user_id, ak.key_string, ak.status, ak.has_quota, ak.created_at, ak.updated_at, ak.expires_at, ak.allowed_cidrs, ak.allowed_origins, ak.label, u.email as user_email
 FROM api_keys ak
 JOIN users u ON ak.user_id = u.id
 WHERE ak.id = $1
 `
 
 type GetAPIKeyWithUserRow struct {
-	ID        int64
-	UserID    int64
-	KeyString string
-	Status    string
-	HasQuota  bool
-	CreatedAt pgtype.Timestamptz
-	UpdatedAt pgtype.Timestamptz
-	UserEmail string
+	ID             int64
+	UserID         int64
+	KeyString      string
+	Status         string
+	HasQuota       bool
+	CreatedAt      pgtype.Timestamptz
+	UpdatedAt      pgtype.Timestamptz
+	ExpiresAt      pgtype.Timestamptz
+	AllowedCidrs   []string
+	AllowedOrigins []string
+	Label          pgtype.Text
+	UserEmail      string
 }
 
 // Get API key with user info
@@ -156,13 +315,63 @@ func (q *Queries) GetAPIKeyWithUser(ctx context.Context, id int64) (*GetAPIKeyWi
 		&i.HasQuota,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.ExpiresAt,
+		&i.AllowedCidrs,
+		&i.AllowedOrigins,
+		&i.Label,
 		&i.UserEmail,
 	)
 	return &i, err
 }
 
+const getAPIKeysByFingerprint = `-- name: GetAPIKeysByFingerprint :many
+SELECT id, key_string, has_quota, status, expires_at, allowed_cidrs, allowed_origins FROM api_keys
+WHERE left(encode(sha256(convert_to(key_string, 'UTF8')), 'hex'), 8) = $1::text
+LIMIT 2
+`
+
+type GetAPIKeysByFingerprintRow struct {
+	ID             int64
+	KeyString      string
+	HasQuota       bool
+	Status         string
+	ExpiresAt      pgtype.Timestamptz
+	AllowedCidrs   []string
+	AllowedOrigins []string
+}
+
+// Get the API keys whose fingerprint, the first 4 bytes of the SHA-256 of
+// the key in hex, is the given one (for impersonation)
+func (q *Queries) GetAPIKeysByFingerprint(ctx context.Context, fingerprint string) ([]*GetAPIKeysByFingerprintRow, error) {
+	rows, err := q.db.Query(ctx, getAPIKeysByFingerprint, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*GetAPIKeysByFingerprintRow
+	for rows.Next() {
+		var i GetAPIKeysByFingerprintRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.KeyString,
+			&i.HasQuota,
+			&i.Status,
+			&i.ExpiresAt,
+			&i.AllowedCidrs,
+			&i.AllowedOrigins,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, &i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getAPIKeysByUserID = `-- name: GetAPIKeysByUserID :many
-SELECT id, user_id, key_string, status, has_quota, created_at, updated_at FROM api_keys 
+SELECT id, user_id, key_string, status, has_quota, created_at, updated_at, expires_at, allowed_cidrs, allowed_origins, label FROM api_keys 
 WHERE user_id = $1
 ORDER BY created_at DESC
 `
@@ -185,6 +394,10 @@ func (q *Queries) GetAPIKeysByUserID(ctx context.Context, userID int64) ([]*ApiK
 			&i.HasQuota,
 			&i.CreatedAt,
 			&i.UpdatedAt,
+			&i.ExpiresAt,
+			&i.AllowedCidrs,
+			&i.AllowedOrigins,
+			&i.Label,
 		); err != nil {
 			return nil, err
 		}
@@ -197,7 +410,7 @@ func (q *Queries) GetAPIKeysByUserID(ctx context.Context, userID int64) ([]*ApiK
 }
 
 const getAllAPIKeys = `-- name: GetAllAPIKeys :many
-SELECT id, user_id, key_string, status, has_quota, created_at, updated_at FROM api_keys
+SELECT id, user_id, key_string, status, has_quota, created_at, updated_at, expires_at, allowed_cidrs, allowed_origins, label FROM api_keys
 ORDER BY created_at DESC
 `
 
@@ -219,6 +432,10 @@ func (q *Queries) GetAllAPIKeys(ctx context.Context) ([]*ApiKeys, error) {
 			&i.HasQuota,
 			&i.CreatedAt,
 			&i.UpdatedAt,
+			&i.ExpiresAt,
+			&i.AllowedCidrs,
+			&i.AllowedOrigins,
+			&i.Label,
 		); err != nil {
 			return nil, err
 		}
@@ -231,7 +448,7 @@ func (q *Queries) GetAllAPIKeys(ctx context.Context) ([]*ApiKeys, error) {
 }
 
 const getAssignedAPIKeysByUserID = `-- name: GetAssignedAPIKeysByUserID :many
-SELECT id, user_id, key_string, status, has_quota, created_at, updated_at FROM api_keys 
+SELECT id, user_id, key_string, status, has_quota, created_at, updated_at, expires_at, allowed_cidrs, allowed_origins, label FROM api_keys 
 WHERE user_id = $1 AND status = 'assigned'
 ORDER BY created_at DESC
 `
@@ -254,6 +471,10 @@ func (q *Queries) GetAssignedAPIKeysByUserID(ctx context.Context, userID int64)
 			&i.HasQuota,
 			&i.CreatedAt,
 			&i.UpdatedAt,
+			&i.ExpiresAt,
+			&i.AllowedCidrs,
+			&i.AllowedOrigins,
+			&i.Label,
 		); err != nil {
 			return nil, err
 		}
@@ -299,7 +520,7 @@ func (q *Queries) GetKeyWithServicesForInitialization(ctx context.Context, id in
 }
 
 const getUnassignedKey = `-- name: GetUnassignedKey :one
-SELECT id, user_id, key_string, status, has_quota, created_at, updated_at FROM api_keys 
+SELECT id, user_id, key_string, status, has_quota, created_at, updated_at, expires_at, allowed_cidrs, allowed_origins, label FROM api_keys 
 WHERE status = 'unassigned' AND user_id = $1
 LIMIT 1
 `
@@ -316,6 +537,43 @@ func (q *Queries) GetUnassignedKey(ctx context.Context, userID int64) (*ApiKeys,
 		&i.HasQuota,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.ExpiresAt,
+		&i.AllowedCidrs,
+		&i.AllowedOrigins,
+		&i.Label,
+	)
+	return &i, err
+}
+
+const setAPIKeyRestrictions = `-- name: SetAPIKeyRestrictions :one
+UPDATE api_keys
+SET allowed_cidrs = $2, allowed_origins = $3, updated_at = NOW()
+WHERE key_string = $1
+RETURNING id, user_id, key_string, status, has_quota, created_at, updated_at, expires_at, allowed_cidrs, allowed_origins, label
+`
+
+type SetAPIKeyRestrictionsParams struct {
+	KeyString      string
+	AllowedCidrs   []string
+	AllowedOrigins []string
+}
+
+// Set where a key can be used from, NULL allows anywhere
+func (q *Queries) SetAPIKeyRestrictions(ctx context.Context, arg *SetAPIKeyRestrictionsParams) (*ApiKeys, error) {
+	row := q.db.QueryRow(ctx, setAPIKeyRestrictions, arg.KeyString, arg.AllowedCidrs, arg.AllowedOrigins)
+	var i ApiKeys
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.KeyString,
+		&i.Status,
+		&i.HasQuota,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.ExpiresAt,
+		&i.AllowedCidrs,
+		&i.AllowedOrigins,
+		&i.Label,
 	)
 	return &i, err
 }
@@ -324,7 +582,7 @@ const updateAPIKeyStatus = `-- name: UpdateAPIKeyStatus :one
 UPDATE api_keys 
 SET status = $2, updated_at = NOW()
 WHERE id = $1
-RETURNING id, user_id, key_string, status, has_quota, created_at, updated_at
+RETURNING id, user_id, key_string, status, has_quota, created_at, updated_at, expires_at, allowed_cidrs, allowed_origins, label
 `
 
 type UpdateAPIKeyStatusParams struct {
@@ -344,6 +602,10 @@ func (q *Queries) UpdateAPIKeyStatus(ctx context.Context, arg *UpdateAPIKeyStatu
 		&i.HasQuota,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.ExpiresAt,
+		&i.AllowedCidrs,
+		&i.AllowedOrigins,
+		&i.Label,
 	)
 	return &i, err
 }
@@ -0,0 +1,41 @@
+CREATE TABLE cached_pages (
+    url TEXT PRIMARY KEY,
+    host TEXT NOT NULL,
+    provider TEXT NOT NULL,
+    content_type TEXT NOT NULL DEFAULT '',
+    language TEXT NOT NULL DEFAULT '',
+    title TEXT NOT NULL DEFAULT '',
+    content TEXT NOT NULL,
+    content_tsv TSVECTOR GENERATED ALWAYS AS (to_tsvector('english', title || ' ' || content)) STORED,
+    fetched_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_cached_pages_content_tsv ON cached_pages USING GIN (content_tsv);
+CREATE INDEX idx_cached_pages_host ON cached_pages(host);
+
+-- Full-text index of the pages read through the Jina and fetch routes
+
+-- Index a page, or refresh it when it was read again
+-- name: UpsertCachedPage :exec
+INSERT INTO cached_pages (url, host, provider, content_type, language, title, content, fetched_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+ON CONFLICT (url)
+DO UPDATE SET host = EXCLUDED.host, provider = EXCLUDED.provider, content_type = EXCLUDED.content_type,
+    language = EXCLUDED.language, title = EXCLUDED.title, content = EXCLUDED.content, fetched_at = EXCLUDED.fetched_at;
+
+-- Search the pages matching a web search style query, best matches first
+-- name: SearchCachedPages :many
+SELECT url, host, provider, content_type, language, title, fetched_at,
+    ts_headline('english', content, query, 'MaxFragments=2, MaxWords=30, MinWords=10')::text AS snippet,
+    ts_rank(content_tsv, query)::real AS rank
+FROM cached_pages, websearch_to_tsquery('english', @query::text) query
+WHERE content_tsv @@ query AND (@host::text = '' OR host = @host::text)
+    AND (@language::text = '' OR language = @language::text)
+    AND (@content_type::text = '' OR content_type = @content_type::text)
+ORDER BY rank DESC, fetched_at DESC
+LIMIT @max_results::int;
+
+-- Delete the pages of a domain and its subdomains
+-- name: DeleteCachedPagesByDomain :execrows
+DELETE FROM cached_pages
+WHERE host = @domain::text OR host LIKE '%.' || @domain::text;
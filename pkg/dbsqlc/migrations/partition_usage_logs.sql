@@ -0,0 +1,59 @@
+-- Partitions an existing api_key_service_usage_logs table by month, as in
+-- schema.sql: the table is recreated partitioned, with its default partition
+-- and the partitions of the months it holds, and the rows are copied over.
+-- It runs in one transaction and does nothing on a partitioned table, so it
+-- can be run again:
+--
+--	just migrate-usage-partitions
+--	psql "$POSTGRES_URL" -v ON_ERROR_STOP=1 -f pkg/dbsqlc/migrations/partition_usage_logs.sql
+--
+-- The usage writes wait for it, the reads don't. The partitions of the next
+-- months are created by cachev1 on startup, see USAGE_PARTITIONS_AHEAD.
+DO $$
+DECLARE
+    m timestamp;
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_partitioned_table WHERE partrelid = 'api_key_service_usage_logs'::regclass) THEN
+        RAISE NOTICE 'api_key_service_usage_logs is partitioned already';
+        RETURN;
+    END IF;
+
+    LOCK TABLE api_key_service_usage_logs IN EXCLUSIVE MODE;
+    ALTER TABLE api_key_service_usage_logs RENAME TO api_key_service_usage_logs_old;
+    -- the names of the indexes are taken by the partitioned table
+    ALTER INDEX IF EXISTS api_key_service_usage_logs_pkey RENAME TO api_key_service_usage_logs_old_pkey;
+    DROP INDEX IF EXISTS idx_usage_log_api_key_id, idx_usage_log_service_id, idx_usage_log_created_at,
+        idx_usage_log_request_id, idx_usage_log_api_key_created, idx_usage_log_minute_timestamp,
+        idx_usage_log_unique_minute;
+
+    CREATE TABLE api_key_service_usage_logs (
+        api_key_id BIGINT NOT NULL REFERENCES api_keys(id) ON DELETE CASCADE,
+        service_id BIGINT NOT NULL REFERENCES services(id) ON DELETE CASCADE,
+        consumption_amount INTEGER NOT NULL DEFAULT 1,
+        minute_timestamp TIMESTAMPTZ NOT NULL,
+        created_at TIMESTAMPTZ DEFAULT NOW(),
+        PRIMARY KEY (api_key_id, service_id, minute_timestamp)
+    ) PARTITION BY RANGE (minute_timestamp);
+    CREATE TABLE api_key_service_usage_logs_default PARTITION OF api_key_service_usage_logs DEFAULT;
+    CREATE INDEX idx_usage_log_service_id ON api_key_service_usage_logs(service_id);
+    CREATE INDEX idx_usage_log_minute_timestamp ON api_key_service_usage_logs(minute_timestamp);
+
+    FOR m IN
+        SELECT DISTINCT date_trunc('month', minute_timestamp AT TIME ZONE 'UTC')
+        FROM api_key_service_usage_logs_old
+    LOOP
+        EXECUTE format('CREATE TABLE %I PARTITION OF api_key_service_usage_logs FOR VALUES FROM (%L) TO (%L)',
+            'api_key_service_usage_logs_' || to_char(m, 'YYYY_MM'),
+            m AT TIME ZONE 'UTC', (m + interval '1 month') AT TIME ZONE 'UTC');
+    END LOOP;
+
+    -- the minutes recorded twice, without the unique index, are added up
+    INSERT INTO api_key_service_usage_logs (api_key_id, service_id, consumption_amount, minute_timestamp, created_at)
+    SELECT api_key_id, service_id, consumption_amount, minute_timestamp, created_at
+    FROM api_key_service_usage_logs_old
+    ON CONFLICT (api_key_id, service_id, minute_timestamp)
+    DO UPDATE SET consumption_amount = api_key_service_usage_logs.consumption_amount + EXCLUDED.consumption_amount;
+
+    DROP TABLE api_key_service_usage_logs_old;
+END
+$$;
@@ -18,8 +18,21 @@ type ApiKeyServiceQuotas struct {
 	UpdatedAt      pgtype.Timestamptz
 }
 
+type ApiKeyServiceUsageDaily struct {
+	ApiKeyID          int64
+	ServiceID         int64
+	Day               pgtype.Date
+	ConsumptionAmount int64
+}
+
+type ApiKeyServiceUsageHourly struct {
+	ApiKeyID          int64
+	ServiceID         int64
+	Hour              pgtype.Timestamptz
+	ConsumptionAmount int64
+}
+
 type ApiKeyServiceUsageLogs struct {
-	ID                int64
 	ApiKeyID          int64
 	ServiceID         int64
 	ConsumptionAmount int32
@@ -27,6 +40,11 @@ type ApiKeyServiceUsageLogs struct {
 	CreatedAt         pgtype.Timestamptz
 }
 
+type ApiKeyServiceUsageRollups struct {
+	Granularity        string
+	MaterializedBefore pgtype.Timestamptz
+}
+
 type ApiKeyStatusEvents struct {
 	ID        int64
 	ApiKeyID  int64
@@ -42,13 +60,29 @@ type ApiKeyStatuses struct {
 }
 
 type ApiKeys struct {
-	ID        int64
-	UserID    int64
-	KeyString string
-	Status    string
-	HasQuota  bool
-	CreatedAt pgtype.Timestamptz
-	UpdatedAt pgtype.Timestamptz
+	ID             int64
+	UserID         int64
+	KeyString      string
+	Status         string
+	HasQuota       bool
+	CreatedAt      pgtype.Timestamptz
+	UpdatedAt      pgtype.Timestamptz
+	ExpiresAt      pgtype.Timestamptz
+	AllowedCidrs   []string
+	AllowedOrigins []string
+	Label          pgtype.Text
+}
+
+type CachedPages struct {
+	Url         string
+	Host        string
+	Provider    string
+	ContentType string
+	Language    string
+	Title       string
+	Content     string
+	ContentTsv  interface{}
+	FetchedAt   pgtype.Timestamptz
 }
 
 type Services struct {
@@ -64,3 +98,12 @@ type Users struct {
 	Email     string
 	CreatedAt pgtype.Timestamptz
 }
+
+type TrialSignups struct {
+	ID         int64
+	Email      string
+	TokenHash  string
+	ExpiresAt  pgtype.Timestamptz
+	VerifiedAt pgtype.Timestamptz
+	CreatedAt  pgtype.Timestamptz
+}
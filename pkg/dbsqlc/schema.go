@@ -0,0 +1,15 @@
+package dbsqlc
+
+import "embed"
+
+// Schema is the schema the queries are generated from, e.g. to check a
+// database before serving.
+//
+//go:embed schema.sql
+var Schema string
+
+// QueryFiles are the files the queries are generated from, e.g. to check they
+// prepare against a database before serving.
+//
+//go:embed *.sql
+var QueryFiles embed.FS
@@ -34,7 +34,9 @@ INSERT INTO api_key_statuses (name, description) VALUES
 ('unassigned', 'Key generated but not yet assigned to user'),
 ('assigned', 'Key assigned to user and active'),
 ('exhausted', 'All quotas for this key are depleted'),
-('revoked', 'Key manually revoked/suspended');
+('revoked', 'Key manually revoked/suspended'),
+('trial', 'Trial key, active until it expires'),
+('expired', 'Trial key past its expiry');
 
 -- API Keys table
 CREATE TABLE api_keys (
@@ -44,11 +46,19 @@ CREATE TABLE api_keys (
     status TEXT NOT NULL DEFAULT 'unassigned' REFERENCES api_key_statuses(name),
     has_quota BOOLEAN DEFAULT TRUE,
     created_at TIMESTAMPTZ DEFAULT NOW(),
-    updated_at TIMESTAMPTZ DEFAULT NOW()
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    -- trial keys stop working at expires_at, NULL never expires
+    expires_at TIMESTAMPTZ,
+    -- client networks and web origins the key works from, NULL allows anywhere
+    allowed_cidrs TEXT[],
+    allowed_origins TEXT[],
+    -- name of the key in the declarative state of its user, NULL for keys made otherwise
+    label TEXT
 );
 
 -- Indexes for performance
 CREATE UNIQUE INDEX idx_api_keys_key_string ON api_keys(key_string);
+CREATE UNIQUE INDEX idx_api_keys_user_label ON api_keys(user_id, label);
 CREATE INDEX idx_api_keys_user_id ON api_keys(user_id);
 CREATE INDEX idx_api_keys_status ON api_keys(status);
 
@@ -68,21 +78,26 @@ CREATE TABLE api_key_service_quotas (
 CREATE INDEX idx_api_key_service_quotas_api_key_id ON api_key_service_quotas(api_key_id);
 CREATE INDEX idx_api_key_service_quotas_service_id ON api_key_service_quotas(service_id);
 
--- API Key Service Usage Logs table
+-- API Key Service Usage Logs table, the usage per key, service and minute,
+-- partitioned by month
 CREATE TABLE api_key_service_usage_logs (
-    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
     api_key_id BIGINT NOT NULL REFERENCES api_keys(id) ON DELETE CASCADE,
     service_id BIGINT NOT NULL REFERENCES services(id) ON DELETE CASCADE,
-    consumption_amount INTEGER NOT NULL DEFAULT 1,
-    remaining_quota_after INTEGER NOT NULL,
-    created_at TIMESTAMPTZ DEFAULT NOW()
-);
+    consumption_amount INTEGER NOT NULL DEFAULT 1, -- Aggregated count for the minute
+    minute_timestamp TIMESTAMPTZ NOT NULL, -- Truncated to minute boundary
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (api_key_id, service_id, minute_timestamp)
+) PARTITION BY RANGE (minute_timestamp);
+
+-- Monthly partitions, e.g. api_key_service_usage_logs_2025_06, are created
+-- ahead by cachev1 and dropped past retention by the retention worker. The
+-- default partition catches the minutes no partition covers yet, they're moved
+-- out when their month gets its partition.
+CREATE TABLE api_key_service_usage_logs_default PARTITION OF api_key_service_usage_logs DEFAULT;
 
--- Indexes for performance and analytics
-CREATE INDEX idx_usage_log_api_key_id ON api_key_service_usage_logs(api_key_id);
+-- Indexes for performance and analytics, created on every partition
 CREATE INDEX idx_usage_log_service_id ON api_key_service_usage_logs(service_id);
-CREATE INDEX idx_usage_log_created_at ON api_key_service_usage_logs(created_at);
-CREATE INDEX idx_usage_log_api_key_created ON api_key_service_usage_logs(api_key_id, created_at);
+CREATE INDEX idx_usage_log_minute_timestamp ON api_key_service_usage_logs(minute_timestamp);
 
 -- API Key Status Events table
 CREATE TABLE api_key_status_events (
@@ -95,3 +110,63 @@ CREATE TABLE api_key_status_events (
 -- Indexes for timeline queries
 CREATE INDEX idx_status_events_api_key_id ON api_key_status_events(api_key_id);
 CREATE INDEX idx_status_events_api_key_created ON api_key_status_events(api_key_id, created_at DESC);
+
+-- API Key Service Usage Daily table
+CREATE TABLE api_key_service_usage_daily (
+    api_key_id BIGINT NOT NULL REFERENCES api_keys(id) ON DELETE CASCADE,
+    service_id BIGINT NOT NULL REFERENCES services(id) ON DELETE CASCADE,
+    day DATE NOT NULL,
+    consumption_amount BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (api_key_id, service_id, day)
+);
+
+-- Index for retention and reporting
+CREATE INDEX idx_usage_daily_day ON api_key_service_usage_daily(day);
+
+-- API Key Service Usage Hourly table, materialized from the minute usage for reporting
+CREATE TABLE api_key_service_usage_hourly (
+    api_key_id BIGINT NOT NULL REFERENCES api_keys(id) ON DELETE CASCADE,
+    service_id BIGINT NOT NULL REFERENCES services(id) ON DELETE CASCADE,
+    hour TIMESTAMPTZ NOT NULL, -- Truncated to hour boundary, in UTC
+    consumption_amount BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (api_key_id, service_id, hour)
+);
+
+CREATE INDEX idx_usage_hourly_hour ON api_key_service_usage_hourly(hour);
+
+-- API Key Service Usage Rollups table, how far the hourly and daily aggregates
+-- are materialized
+CREATE TABLE api_key_service_usage_rollups (
+    granularity TEXT PRIMARY KEY, -- 'hour' or 'day'
+    materialized_before TIMESTAMPTZ NOT NULL
+);
+
+-- Trial Signups table, the pending email verifications of trial keys
+CREATE TABLE trial_signups (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    email TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    verified_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Index for the signup rate limit
+CREATE INDEX idx_trial_signups_email_created ON trial_signups(email, created_at);
+
+-- Cached Pages table, the full-text index of the pages read through the Jina and fetch routes
+CREATE TABLE cached_pages (
+    url TEXT PRIMARY KEY,
+    host TEXT NOT NULL,
+    provider TEXT NOT NULL,
+    content_type TEXT NOT NULL DEFAULT '',
+    language TEXT NOT NULL DEFAULT '',
+    title TEXT NOT NULL DEFAULT '',
+    content TEXT NOT NULL,
+    content_tsv TSVECTOR GENERATED ALWAYS AS (to_tsvector('english', title || ' ' || content)) STORED,
+    fetched_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Indexes for search and domain erasure
+CREATE INDEX idx_cached_pages_content_tsv ON cached_pages USING GIN (content_tsv);
+CREATE INDEX idx_cached_pages_host ON cached_pages(host);
@@ -17,3 +17,19 @@ SELECT id, name FROM services;
 -- Get service by name
 -- name: GetServiceByName :one
 SELECT * FROM services WHERE name = $1;
+
+-- List services with their default quota
+-- name: ListServices :many
+SELECT * FROM services ORDER BY name;
+
+-- Create a service
+-- name: CreateService :one
+INSERT INTO services (name, default_quota)
+VALUES ($1, $2)
+RETURNING *;
+
+-- Set the quota new keys get for a service
+-- name: SetServiceDefaultQuota :exec
+UPDATE services
+SET default_quota = $2, updated_at = NOW()
+WHERE id = $1;
@@ -9,6 +9,31 @@ import (
 	"context"
 )
 
+const createService = `-- name: CreateService :one
+INSERT INTO services (name, default_quota)
+VALUES ($1, $2)
+RETURNING id, name, default_quota, created_at, updated_at
+`
+
+type CreateServiceParams struct {
+	Name         string
+	DefaultQuota int32
+}
+
+// Create a service
+func (q *Queries) CreateService(ctx context.Context, arg *CreateServiceParams) (*Services, error) {
+	row := q.db.QueryRow(ctx, createService, arg.Name, arg.DefaultQuota)
+	var i Services
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.DefaultQuota,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return &i, err
+}
+
 const getAllServices = `-- name: GetAllServices :many
 
 SELECT id, name FROM services
@@ -58,3 +83,51 @@ func (q *Queries) GetServiceByName(ctx context.Context, name string) (*Services,
 	)
 	return &i, err
 }
+
+const listServices = `-- name: ListServices :many
+SELECT id, name, default_quota, created_at, updated_at FROM services ORDER BY name
+`
+
+// List services with their default quota
+func (q *Queries) ListServices(ctx context.Context) ([]*Services, error) {
+	rows, err := q.db.Query(ctx, listServices)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*Services
+	for rows.Next() {
+		var i Services
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.DefaultQuota,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, &i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const setServiceDefaultQuota = `-- name: SetServiceDefaultQuota :exec
+UPDATE services
+SET default_quota = $2, updated_at = NOW()
+WHERE id = $1
+`
+
+type SetServiceDefaultQuotaParams struct {
+	ID           int64
+	DefaultQuota int32
+}
+
+// Set the quota new keys get for a service
+func (q *Queries) SetServiceDefaultQuota(ctx context.Context, arg *SetServiceDefaultQuotaParams) error {
+	_, err := q.db.Exec(ctx, setServiceDefaultQuota, arg.ID, arg.DefaultQuota)
+	return err
+}
@@ -0,0 +1,34 @@
+CREATE TABLE trial_signups (
+    id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    email TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    verified_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX idx_trial_signups_email_created ON trial_signups(email, created_at);
+
+-- Trial signup queries
+
+-- Record a pending signup, only the hash of its token is kept
+-- name: CreateTrialSignup :one
+INSERT INTO trial_signups (email, token_hash, expires_at)
+VALUES ($1, $2, $3)
+RETURNING *;
+
+-- Count the signups of an email since a time
+-- name: CountTrialSignupsSince :one
+SELECT COUNT(*) FROM trial_signups
+WHERE email = $1 AND created_at > $2;
+
+-- Verify a pending signup, once and before its token expires
+-- name: VerifyTrialSignup :one
+UPDATE trial_signups
+SET verified_at = NOW()
+WHERE token_hash = $1 AND verified_at IS NULL AND expires_at > NOW()
+RETURNING *;
+
+-- Replace the email of the signups of an erased person
+-- name: AnonymizeTrialSignups :execrows
+UPDATE trial_signups SET email = $2 WHERE email = $1;
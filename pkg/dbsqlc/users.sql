@@ -22,3 +22,7 @@ SELECT * FROM users WHERE email = $1;
 -- Get all users
 -- name: GetAllUsers :many
 SELECT * FROM users ORDER BY created_at DESC;
+
+-- Replace the email of an erased user, keeping the row for its key history
+-- name: AnonymizeUser :exec
+UPDATE users SET email = $2 WHERE id = $1;
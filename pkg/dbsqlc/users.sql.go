@@ -9,6 +9,21 @@ import (
 	"context"
 )
 
+const anonymizeUser = `-- name: AnonymizeUser :exec
+UPDATE users SET email = $2 WHERE id = $1
+`
+
+type AnonymizeUserParams struct {
+	ID    int64
+	Email string
+}
+
+// Replace the email of an erased user, keeping the row for its key history
+func (q *Queries) AnonymizeUser(ctx context.Context, arg *AnonymizeUserParams) error {
+	_, err := q.db.Exec(ctx, anonymizeUser, arg.ID, arg.Email)
+	return err
+}
+
 const createUser = `-- name: CreateUser :one
 
 INSERT INTO users (email)
@@ -0,0 +1,108 @@
+package dynconfig
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Consul watches a key of the Consul KV store with blocking queries.
+type Consul struct {
+	endpoint string
+	key      string
+	token    string
+	client   *http.Client
+	logger   *slog.Logger
+}
+
+// NewConsul creates a new Consul source, endpoint is e.g. "http://localhost:8500".
+func NewConsul(endpoint, key, token string, logger *slog.Logger) *Consul {
+	return &Consul{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		key:      strings.TrimPrefix(key, "/"),
+		token:    token,
+		// blocking queries wait up to 5 minutes, plus jitter
+		client: &http.Client{Timeout: 6 * time.Minute},
+		logger: logger,
+	}
+}
+
+// Watch implements Source.
+func (c *Consul) Watch(ctx context.Context, apply func(Config)) {
+	var index uint64
+	var last []byte
+	failures := 0
+	for ctx.Err() == nil {
+		value, next, err := c.get(ctx, index)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			c.logger.Warn("Failed to watch Consul config", "key", c.key, "error", err)
+			if !backoff(ctx, failures) {
+				return
+			}
+			continue
+		}
+		failures = 0
+		// the index may go backwards after a Consul restore, start over
+		if next < index {
+			next = 0
+		}
+		index = next
+		if value == nil || bytes.Equal(value, last) {
+			continue
+		}
+		cfg, err := Parse(value)
+		if err != nil {
+			c.logger.Error("Invalid Consul config", "key", c.key, "error", err)
+			last = value
+			continue
+		}
+		last = value
+		c.logger.Info("Dynamic config updated", "source", "consul", "key", c.key, "index", index)
+		apply(cfg)
+	}
+}
+
+// get reads the key, blocking until it changes past index.
+func (c *Consul) get(ctx context.Context, index uint64) ([]byte, uint64, error) {
+	u := fmt.Sprintf("%s/v1/kv/%s?raw=true&wait=5m&index=%d", c.endpoint, url.PathEscape(c.key), index)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("client.Do: %w", err)
+	}
+	defer resp.Body.Close()
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid X-Consul-Index %q", resp.Header.Get("X-Consul-Index"))
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, next, nil
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, 0, fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	value, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, 0, fmt.Errorf("io.ReadAll: %w", err)
+	}
+	return value, next, nil
+}
@@ -0,0 +1,79 @@
+// Package dynconfig watches fleet-wide configuration kept in Consul or etcd,
+// so changes reach every replica without a restart.
+//
+// The configuration is a single JSON document stored under one key:
+//
+//	{
+//	  "providers": {"jina": {"keys": ["jina_a", "jina_b"]}, "serper": {"keys": ["xxx"]}},
+//	  "quota_defaults": {"jina": 1000},
+//	  "rules": [{"name": "no-bots", "when": "request.header[\"User-Agent\"].matches(\"(?i)bot\")", "action": "block"}],
+//	  "notices": ["Jina is answered from the cache only until 18:00 UTC"]
+//	}
+package dynconfig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Airren/poorman-httpcache/v2/pkg/rules"
+	"log/slog"
+	"time"
+)
+
+// Config is the dynamic configuration document.
+type Config struct {
+	// Providers holds the upstream key pool of each provider.
+	Providers map[string]Provider `json:"providers"`
+	// QuotaDefaults overrides the default quota of services.
+	QuotaDefaults map[string]int32 `json:"quota_defaults"`
+	// Rules replaces the admission rules when present.
+	Rules []rules.Rule `json:"rules"`
+	// Notices replaces the maintenance notices of /status when present.
+	Notices []string `json:"notices"`
+}
+
+// Provider is the configuration of an upstream provider.
+type Provider struct {
+	Keys []string `json:"keys"`
+}
+
+// Parse parses a configuration document.
+func Parse(b []byte) (Config, error) {
+	var cfg Config
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return Config{}, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return cfg, nil
+}
+
+// Source is a configuration store that can be watched.
+type Source interface {
+	// Watch calls apply with the current configuration, then with every change,
+	// until ctx is done. Errors are logged and the watch is retried.
+	Watch(ctx context.Context, apply func(Config))
+}
+
+// New creates the Source of kind, "consul" or "etcd", for the key at endpoint.
+// The token is sent as the ACL token of Consul, or the auth token of etcd.
+func New(kind, endpoint, key, token string, logger *slog.Logger) (Source, error) {
+	switch kind {
+	case "consul":
+		return NewConsul(endpoint, key, token, logger), nil
+	case "etcd":
+		return NewEtcd(endpoint, key, token, logger), nil
+	default:
+		return nil, fmt.Errorf("unknown dynamic config source %q", kind)
+	}
+}
+
+// backoff waits before a retry, doubling up to 30s. It returns false when ctx is done.
+func backoff(ctx context.Context, attempt int) bool {
+	delay := time.Second << min(attempt, 5)
+	delay = min(delay, 30*time.Second)
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
@@ -0,0 +1,161 @@
+package dynconfig
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Etcd watches a key of etcd v3 through its JSON gateway.
+type Etcd struct {
+	endpoint string
+	key      string
+	token    string
+	client   *http.Client
+	logger   *slog.Logger
+}
+
+// NewEtcd creates a new etcd source, endpoint is e.g. "http://localhost:2379".
+func NewEtcd(endpoint, key, token string, logger *slog.Logger) *Etcd {
+	return &Etcd{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		key:      key,
+		token:    token,
+		// watches are long-lived streams, cancelled through the context
+		client: &http.Client{},
+		logger: logger,
+	}
+}
+
+type etcdKV struct {
+	Value       string `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+type etcdRangeResponse struct {
+	Header struct {
+		Revision string `json:"revision"`
+	} `json:"header"`
+	Kvs []etcdKV `json:"kvs"`
+}
+
+type etcdWatchResponse struct {
+	Result struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		Events []struct {
+			Type string `json:"type"`
+			Kv   etcdKV `json:"kv"`
+		} `json:"events"`
+		Canceled bool `json:"canceled"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Watch implements Source.
+func (e *Etcd) Watch(ctx context.Context, apply func(Config)) {
+	failures := 0
+	for ctx.Err() == nil {
+		err := e.watch(ctx, apply)
+		if ctx.Err() != nil {
+			return
+		}
+		failures++
+		e.logger.Warn("Failed to watch etcd config", "key", e.key, "error", err)
+		if !backoff(ctx, failures) {
+			return
+		}
+	}
+}
+
+// watch reads the key then streams its changes, until the stream breaks.
+func (e *Etcd) watch(ctx context.Context, apply func(Config)) error {
+	key := base64.StdEncoding.EncodeToString([]byte(e.key))
+	var current etcdRangeResponse
+	if err := e.post(ctx, "/v3/kv/range", map[string]any{"key": key}, func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&current)
+	}); err != nil {
+		return fmt.Errorf("range: %w", err)
+	}
+	if len(current.Kvs) > 0 {
+		e.apply(current.Kvs[0], apply)
+	}
+	revision, err := strconv.ParseInt(current.Header.Revision, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid revision %q", current.Header.Revision)
+	}
+
+	create := map[string]any{"create_request": map[string]any{"key": key, "start_revision": revision + 1}}
+	return e.post(ctx, "/v3/watch", create, func(body io.Reader) error {
+		dec := json.NewDecoder(body)
+		for {
+			var resp etcdWatchResponse
+			if err := dec.Decode(&resp); err != nil {
+				return fmt.Errorf("watch: %w", err)
+			}
+			if resp.Error != nil {
+				return fmt.Errorf("watch: %s", resp.Error.Message)
+			}
+			if resp.Result.Canceled {
+				return fmt.Errorf("watch canceled")
+			}
+			for _, event := range resp.Result.Events {
+				// deletes keep the last configuration
+				if event.Type == "DELETE" {
+					continue
+				}
+				e.apply(event.Kv, apply)
+			}
+		}
+	})
+}
+
+func (e *Etcd) apply(kv etcdKV, apply func(Config)) {
+	value, err := base64.StdEncoding.DecodeString(kv.Value)
+	if err != nil {
+		e.logger.Error("Invalid etcd value", "key", e.key, "error", err)
+		return
+	}
+	cfg, err := Parse(value)
+	if err != nil {
+		e.logger.Error("Invalid etcd config", "key", e.key, "error", err)
+		return
+	}
+	e.logger.Info("Dynamic config updated", "source", "etcd", "key", e.key, "revision", kv.ModRevision)
+	apply(cfg)
+}
+
+func (e *Etcd) post(ctx context.Context, path string, payload any, read func(io.Reader) error) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint+path, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("http.NewRequest: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.token != "" {
+		req.Header.Set("Authorization", e.token)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("client.Do: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	return read(resp.Body)
+}
@@ -0,0 +1,143 @@
+// Package erasure deletes the data held about a person or a third-party site.
+package erasure
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Airren/poorman-httpcache/v2/pkg/admin"
+	"github.com/Airren/poorman-httpcache/v2/pkg/cache"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Subject kinds.
+const (
+	KindEmail  = "email"
+	KindDomain = "domain"
+)
+
+// Report is the deletion report returned to the caller and logged for compliance.
+type Report struct {
+	Subject             string    `json:"subject"`
+	Kind                string    `json:"kind"`
+	CacheEntriesPurged  int       `json:"cache_entries_purged"`
+	IndexedPagesDeleted int64     `json:"indexed_pages_deleted"`
+	UsageLogsDeleted    int64     `json:"usage_logs_deleted"`
+	UsersAnonymized     int       `json:"users_anonymized"`
+	SignupsAnonymized   int64     `json:"signups_anonymized"`
+	CompletedAt         time.Time `json:"completed_at"`
+}
+
+// Handler serves DELETE /admin/data?subject=<email-or-domain>, behind adminauth.
+// An email deletes the usage history of the user and anonymizes the user record
+// and its trial signups,
+// a domain purges the cache entries fetched from it and its subdomains, and
+// their full-text index.
+//
+//	curl -X DELETE "https://cachev1.example.com/admin/data?subject=example.com" -H "X-Admin-Key: xxx"
+type Handler struct {
+	cache       *cache.Cache
+	index       PageIndex
+	postgresURL string
+	logger      *slog.Logger
+}
+
+// PageIndex is the full-text index of the cached pages, see pkg/search.
+type PageIndex interface {
+	DeleteDomain(ctx context.Context, domain string) (int64, error)
+}
+
+// New creates a new erasure Handler, index is nil without a page index.
+// Postgres is only connected to for email subjects, so the cache keeps
+// running without it.
+func New(cache *cache.Cache, index PageIndex, postgresURL string, logger *slog.Logger) *Handler {
+	return &Handler{
+		cache:       cache,
+		index:       index,
+		postgresURL: postgresURL,
+		logger:      logger,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	subject := strings.TrimSpace(r.URL.Query().Get("subject"))
+	if subject == "" {
+		http.Error(w, "Missing subject", http.StatusBadRequest)
+		return
+	}
+
+	var report Report
+	var err error
+	if strings.Contains(subject, "@") {
+		report, err = h.eraseEmail(r.Context(), subject)
+	} else {
+		report, err = h.eraseDomain(r.Context(), subject)
+	}
+	if errors.Is(err, admin.ErrUserNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, cache.ErrNoDomainIndex) {
+		http.Error(w, err.Error()+", set CACHE_DOMAIN_INDEX", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		h.logger.Error("Data deletion failed", "kind", report.Kind, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the report is the compliance record, it doesn't repeat the subject of an email
+	h.logger.Info("Data deleted", "kind", report.Kind, "cache_entries_purged", report.CacheEntriesPurged, "indexed_pages_deleted", report.IndexedPagesDeleted,
+		"usage_logs_deleted", report.UsageLogsDeleted, "users_anonymized", report.UsersAnonymized, "signups_anonymized", report.SignupsAnonymized)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		// response was already committed, nothing left to do
+		_ = err
+	}
+}
+
+func (h *Handler) eraseEmail(ctx context.Context, email string) (Report, error) {
+	report := Report{Subject: email, Kind: KindEmail}
+	db, err := pgx.Connect(ctx, h.postgresURL)
+	if err != nil {
+		return report, fmt.Errorf("pgx.Connect: %w", err)
+	}
+	defer db.Close(ctx)
+
+	erased, err := admin.NewAdminService(db).EraseUser(ctx, email)
+	if err != nil {
+		return report, fmt.Errorf("EraseUser: %w", err)
+	}
+	report.UsageLogsDeleted = erased.UsageLogsDeleted
+	if erased.UserID != 0 {
+		report.UsersAnonymized = 1
+	}
+	report.SignupsAnonymized = erased.SignupsAnonymized
+	report.CompletedAt = time.Now()
+	return report, nil
+}
+
+func (h *Handler) eraseDomain(ctx context.Context, domain string) (Report, error) {
+	report := Report{Subject: domain, Kind: KindDomain}
+	purged, err := h.cache.PurgeDomain(ctx, domain)
+	if err != nil {
+		return report, fmt.Errorf("PurgeDomain: %w", err)
+	}
+	report.CacheEntriesPurged = purged
+	if h.index != nil {
+		deleted, err := h.index.DeleteDomain(ctx, domain)
+		if err != nil {
+			return report, fmt.Errorf("DeleteDomain: %w", err)
+		}
+		report.IndexedPagesDeleted = deleted
+	}
+	report.CompletedAt = time.Now()
+	return report, nil
+}
@@ -0,0 +1,179 @@
+// Package export writes usage aggregates to S3 as Parquet, so analytics run
+// in data-warehouse tooling instead of the operational Postgres.
+package export
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+	"github.com/Airren/poorman-httpcache/v2/pkg/parquet"
+	"github.com/Airren/poorman-httpcache/v2/pkg/s3"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// metrics are published on /debug/vars under "export".
+var metrics = expvar.NewMap("export")
+
+// usageRow is a usage aggregate, by minute, hour or day.
+type usageRow struct {
+	apiKeyID int64
+	service  string
+	at       time.Time
+	amount   int64
+}
+
+// Exporter writes the minute, hour and day usage of recent days to Parquet files
+// partitioned Hive-style by date and service:
+//
+//	{prefix}/granularity=minute/date=2024-06-01/service=jina/usage.parquet
+//
+// Every run rewrites the files of the last lookback days, today included,
+// so a missed run is caught up and partial days are completed later.
+type Exporter struct {
+	postgresURL string
+	bucket      *s3.Client
+	prefix      string
+	interval    time.Duration
+	lookback    int
+	logger      *slog.Logger
+}
+
+// NewExporter creates a new Exporter.
+func NewExporter(postgresURL string, bucket *s3.Client, prefix string, interval time.Duration, lookback int, logger *slog.Logger) *Exporter {
+	return &Exporter{
+		postgresURL: postgresURL,
+		bucket:      bucket,
+		prefix:      prefix,
+		interval:    interval,
+		lookback:    lookback,
+		logger:      logger,
+	}
+}
+
+// Run exports every interval until ctx is done.
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.RunOnce(ctx); err != nil {
+				e.logger.Error("Usage export failed", "error", err)
+			}
+		}
+	}
+}
+
+// RunOnce exports the last lookback days once.
+func (e *Exporter) RunOnce(ctx context.Context) error {
+	start := time.Now()
+	metrics.Add("runs", 1)
+	err := e.run(ctx, start)
+	if err != nil {
+		metrics.Add("failures", 1)
+	}
+	duration := new(expvar.Int)
+	duration.Set(time.Since(start).Milliseconds())
+	metrics.Set("last_run_ms", duration)
+	return err
+}
+
+func (e *Exporter) run(ctx context.Context, now time.Time) error {
+	db, err := pgx.Connect(ctx, e.postgresURL)
+	if err != nil {
+		return fmt.Errorf("pgx.Connect: %w", err)
+	}
+	defer db.Close(ctx)
+	queries := dbsqlc.New(db)
+
+	today := now.UTC().Truncate(24 * time.Hour)
+	for i := e.lookback - 1; i >= 0; i-- {
+		day := today.AddDate(0, 0, -i)
+		if err := e.exportDay(ctx, queries, day); err != nil {
+			return fmt.Errorf("exportDay(%s): %w", day.Format(time.DateOnly), err)
+		}
+	}
+	return nil
+}
+
+func (e *Exporter) exportDay(ctx context.Context, queries *dbsqlc.Queries, day time.Time) error {
+	start := pgtype.Timestamptz{Time: day, Valid: true}
+	end := pgtype.Timestamptz{Time: day.AddDate(0, 0, 1), Valid: true}
+
+	minutes, err := queries.GetMinuteUsageBetween(ctx, &dbsqlc.GetMinuteUsageBetweenParams{StartTime: start, EndTime: end})
+	if err != nil {
+		return fmt.Errorf("GetMinuteUsageBetween: %w", err)
+	}
+	minuteRows := make([]usageRow, 0, len(minutes))
+	for _, m := range minutes {
+		minuteRows = append(minuteRows, usageRow{m.ApiKeyID, m.ServiceName, m.MinuteTimestamp.Time, int64(m.ConsumptionAmount)})
+	}
+	if err := e.write(ctx, "minute", day, minuteRows); err != nil {
+		return err
+	}
+
+	hours, err := queries.GetHourlyUsageBetween(ctx, &dbsqlc.GetHourlyUsageBetweenParams{StartTime: start, EndTime: end})
+	if err != nil {
+		return fmt.Errorf("GetHourlyUsageBetween: %w", err)
+	}
+	hourRows := make([]usageRow, 0, len(hours))
+	for _, h := range hours {
+		hourRows = append(hourRows, usageRow{h.ApiKeyID, h.ServiceName, h.Hour.Time, h.ConsumptionAmount})
+	}
+	if err := e.write(ctx, "hour", day, hourRows); err != nil {
+		return err
+	}
+
+	days, err := queries.GetDailyUsageBetween(ctx, &dbsqlc.GetDailyUsageBetweenParams{StartTime: start, EndTime: end})
+	if err != nil {
+		return fmt.Errorf("GetDailyUsageBetween: %w", err)
+	}
+	dayRows := make([]usageRow, 0, len(days))
+	for _, d := range days {
+		dayRows = append(dayRows, usageRow{d.ApiKeyID, d.ServiceName, d.Day.Time, d.ConsumptionAmount})
+	}
+	return e.write(ctx, "day", day, dayRows)
+}
+
+// write uploads one file per service, rows are sorted by service.
+func (e *Exporter) write(ctx context.Context, granularity string, day time.Time, rows []usageRow) error {
+	for len(rows) > 0 {
+		service := rows[0].service
+		n := 1
+		for n < len(rows) && rows[n].service == service {
+			n++
+		}
+		ids := make([]int64, n)
+		ats := make([]int64, n)
+		amounts := make([]int64, n)
+		for i, row := range rows[:n] {
+			ids[i], ats[i], amounts[i] = row.apiKeyID, row.at.UnixMilli(), row.amount
+		}
+		rows = rows[n:]
+
+		file, err := parquet.Encode([]parquet.Column{
+			{Name: "api_key_id", Int64: ids},
+			{Name: granularity, Int64: ats, Timestamp: true},
+			{Name: "consumption_amount", Int64: amounts},
+		})
+		if err != nil {
+			return fmt.Errorf("parquet.Encode: %w", err)
+		}
+		key := fmt.Sprintf("%s/granularity=%s/date=%s/service=%s/usage.parquet",
+			e.prefix, granularity, day.Format(time.DateOnly), service)
+		if err := e.bucket.PutObject(ctx, key, file, "application/vnd.apache.parquet"); err != nil {
+			return fmt.Errorf("PutObject: %w", err)
+		}
+		metrics.Add("files_written", 1)
+		metrics.Add("rows_written", int64(n))
+		e.logger.Debug("Usage exported", "object", key, "rows", n)
+	}
+	return nil
+}
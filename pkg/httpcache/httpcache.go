@@ -0,0 +1,390 @@
+// Package httpcache embeds the caching proxy of cachev1 in other Go services.
+// New builds the whole pipeline of each provider, tollgate, cache, proxy and
+// filters, from a pkg.Config and returns it as an http.Handler:
+//
+//	cfg, err := pkg.GetConfig()
+//	...
+//	h, err := httpcache.New(cfg, httpcache.WithLogger(logger), httpcache.WithProviders("jina", "serper"))
+//	...
+//	defer h.Close()
+//	mux.Handle("/", h)
+//
+// The providers are served under their name, e.g. /jina/https://example.com.
+package httpcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Airren/poorman-httpcache/v2/pkg"
+	"github.com/Airren/poorman-httpcache/v2/pkg/cache"
+	"github.com/Airren/poorman-httpcache/v2/pkg/proxy"
+	"github.com/Airren/poorman-httpcache/v2/pkg/reqlog"
+	"github.com/Airren/poorman-httpcache/v2/pkg/slo"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate/adapter"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Providers lists the providers New can build. azure needs
+// AZURE_OPENAI_ENDPOINT, vertex needs VERTEX_PROJECT.
+var Providers = []string{"jina", "serper", "fetch", "azure", "vertex"}
+
+// Option is used to set Handler settings.
+type Option func(h *Handler) error
+
+// Handler serves the providers of a pipeline.
+type Handler struct {
+	mux       *http.ServeMux
+	providers []string
+	handlers  map[string]http.Handler
+	keys      map[string]*proxy.KeyPool
+
+	logger    *slog.Logger
+	rdb       redis.Cmdable
+	cache     *cache.Cache
+	metering  metering
+	transport http.RoundTripper
+	// targets is the transport of the URLs the clients choose, e.g. /fetch
+	targets     http.RoundTripper
+	middlewares []func(provider string, next http.Handler) http.Handler
+	// pauseAlert is told about the providers paused for lack of credits
+	pauseAlert func(ctx context.Context, alert proxy.PauseAlert)
+	// closers are the clients New created, and Close releases
+	closers []func() error
+}
+
+// New builds the pipelines of the providers of cfg. Without WithProviders,
+// jina, serper and fetch are built, and azure and vertex when configured.
+// The Redis client and the cache are created from cfg unless set with
+// WithRedis and WithCache.
+func New(cfg pkg.Config, opts ...Option) (*Handler, error) {
+	h := &Handler{
+		handlers: map[string]http.Handler{},
+		keys: map[string]*proxy.KeyPool{
+			"jina":   proxy.NewKeyPool(cfg.JinaAPIKey),
+			"serper": proxy.NewKeyPool(cfg.SerperAPIKey),
+			"azure":  proxy.NewKeyPool(cfg.AzureOpenAIAPIKey),
+		},
+	}
+	for _, opt := range opts {
+		if err := opt(h); err != nil {
+			return nil, err
+		}
+	}
+	if h.providers == nil {
+		h.providers = []string{"jina", "serper", "fetch"}
+		if cfg.AzureOpenAIEndpoint != "" {
+			h.providers = append(h.providers, "azure")
+		}
+		if cfg.VertexProject != "" {
+			h.providers = append(h.providers, "vertex")
+		}
+	}
+	if h.logger == nil {
+		h.logger = slog.Default()
+	}
+	if err := h.build(cfg); err != nil {
+		h.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *Handler) build(cfg pkg.Config) error {
+	if h.rdb == nil {
+		rdb := NewRedisClient(cfg)
+		h.rdb = rdb
+		h.closers = append(h.closers, rdb.Close)
+	}
+	if h.cache == nil {
+		c, err := NewCache(cfg, h.logger)
+		if err != nil {
+			return fmt.Errorf("NewCache: %w", err)
+		}
+		h.cache = c
+		h.closers = append(h.closers, c.Close)
+	}
+	if h.transport == nil {
+		transport, err := upstreamTransport(cfg)
+		if err != nil {
+			return err
+		}
+		h.transport = transport
+	}
+	targets, err := targetTransport(cfg, h.transport)
+	if err != nil {
+		return err
+	}
+	h.targets = targets
+	counter, err := tokenCounter(cfg)
+	if err != nil {
+		return err
+	}
+	filters, err := loadFilters(cfg, h.logger)
+	if err != nil {
+		return err
+	}
+
+	h.metering.rdb = h.rdb
+	h.metering.internalKey = cfg.InternalKey
+	h.metering.readOnly = cfg.CacheReadOnly
+	h.metering.dedupeWindow = cfg.DedupeWindow
+	h.metering.logger = h.logger
+	if cfg.PolicyURL != "" {
+		// the keys of the providers are static, the policy sees their IDs only
+		h.metering.policy = adapter.NewOPA(cfg.PolicyURL, cfg.PolicyTimeout, cfg.PolicyFailOpen, nil, h.logger)
+	}
+	if cfg.CooldownMax > 0 {
+		h.metering.cooldowns = map[string]*proxy.Cooldown{}
+		for _, name := range h.providers {
+			h.metering.cooldowns[name] = proxy.NewCooldown(h.rdb, name, cfg.CooldownDefault, cfg.CooldownMax, cfg.CooldownMaxWait, h.logger)
+		}
+	}
+
+	if cfg.ProviderCreditPause > 0 {
+		h.metering.pauses = map[string]*proxy.CreditPause{}
+		for _, name := range h.providers {
+			h.metering.pauses[name] = proxy.NewCreditPause(h.rdb, name, cfg.ProviderCreditPause, h.pauseAlert, h.logger)
+		}
+	}
+
+	h.mux = http.NewServeMux()
+	for _, name := range h.providers {
+		var handler http.Handler
+		switch name {
+		case "jina":
+			handler, err = newJinaProxy(h.cache, h.rdb, h.metering, h.keys["jina"], h.transport, h.targets, cfg, h.logger)
+		case "serper":
+			handler, err = newSerperProxy(h.cache, h.rdb, h.metering, h.keys["serper"], h.transport, cfg, h.logger)
+		case "fetch":
+			handler, err = newFetchProxy(h.cache, h.rdb, h.metering, h.targets, cfg, h.logger)
+		case "azure":
+			if cfg.AzureOpenAIEndpoint == "" {
+				return errors.New("the azure provider needs AZURE_OPENAI_ENDPOINT")
+			}
+			handler, err = newAzureOpenAIProxy(h.cache, h.metering, h.keys["azure"], h.transport, counter, cfg, h.logger)
+		case "vertex":
+			if cfg.VertexProject == "" {
+				return errors.New("the vertex provider needs VERTEX_PROJECT")
+			}
+			handler, err = newVertexProxy(h.cache, h.metering, h.transport, counter, cfg, h.logger)
+		}
+		if err != nil {
+			return fmt.Errorf("%s proxy: %w", name, err)
+		}
+		handler = filtered(handler, filters)
+		for _, middleware := range h.middlewares {
+			handler = middleware(name, handler)
+		}
+		h.handlers[name] = handler
+		h.mux.Handle("/"+name+"/", handler)
+	}
+	return nil
+}
+
+// WithLogger sets the logger of the pipeline, slog.Default() by default.
+func WithLogger(logger *slog.Logger) Option {
+	return func(h *Handler) error {
+		h.logger = logger
+		return nil
+	}
+}
+
+// WithProviders sets the providers to build, among Providers.
+func WithProviders(names ...string) Option {
+	return func(h *Handler) error {
+		for _, name := range names {
+			if !slices.Contains(Providers, name) {
+				return fmt.Errorf("unknown provider %q", name)
+			}
+		}
+		h.providers = slices.Compact(slices.Clone(names))
+		return nil
+	}
+}
+
+// WithRedis sets the Redis of the tollgate state and the host politeness.
+// The caller keeps closing it.
+func WithRedis(rdb redis.Cmdable) Option {
+	return func(h *Handler) error {
+		h.rdb = rdb
+		return nil
+	}
+}
+
+// WithCache sets the response cache, e.g. to share it with an admin API. The
+// caller keeps closing it.
+func WithCache(c *cache.Cache) Option {
+	return func(h *Handler) error {
+		h.cache = c
+		return nil
+	}
+}
+
+// WithPauseAlert calls alert when a provider is paused, its account being
+// out of credits.
+func WithPauseAlert(alert func(ctx context.Context, alert proxy.PauseAlert)) Option {
+	return func(h *Handler) error {
+		h.pauseAlert = alert
+		return nil
+	}
+}
+
+// WithUsageSink records a usage event per request in sink.
+func WithUsageSink(sink adapter.UsageSink) Option {
+	return func(h *Handler) error {
+		h.metering.sink = sink
+		return nil
+	}
+}
+
+// WithMetaStore serves the keys of store, with their quotas kept in Redis,
+// instead of the internal key alone, see NewMetaStore.
+func WithMetaStore(store adapter.MetaStore) Option {
+	return func(h *Handler) error {
+		h.metering.keys = store
+		return nil
+	}
+}
+
+// WithLimits enforces the soft and hard limits of the keys in limits.
+func WithLimits(limits *adapter.LimitStore) Option {
+	return func(h *Handler) error {
+		h.metering.limits = limits
+		return nil
+	}
+}
+
+// WithMemberStore counts the usage of the keys per X-Member-Id in members.
+func WithMemberStore(members *adapter.MemberStore) Option {
+	return func(h *Handler) error {
+		h.metering.members = members
+		return nil
+	}
+}
+
+// WithTagStore counts the usage of the keys per X-Usage-Tag in tags.
+func WithTagStore(tags *adapter.TagStore) Option {
+	return func(h *Handler) error {
+		h.metering.tags = tags
+		return nil
+	}
+}
+
+// WithDomainStore counts the usage of jina and fetch per target domain in domains.
+func WithDomainStore(domains *adapter.DomainStore) Option {
+	return func(h *Handler) error {
+		h.metering.domains = domains
+		return nil
+	}
+}
+
+// WithTagBudgets enforces the budgets of the X-Usage-Tag tags in budgets.
+func WithTagBudgets(budgets *adapter.TagBudgetStore) Option {
+	return func(h *Handler) error {
+		h.metering.budgets = budgets
+		return nil
+	}
+}
+
+// WithAccessTokens accepts the access tokens minted by tokens in place of the keys.
+func WithAccessTokens(tokens *adapter.AccessTokens) Option {
+	return func(h *Handler) error {
+		h.metering.tokens = tokens
+		return nil
+	}
+}
+
+// WithSupportKey charges the debit of the requests admins run as another key
+// to key, the requests go through the policy and the limits of the other key.
+func WithSupportKey(key string) Option {
+	return func(h *Handler) error {
+		h.metering.supportKey = key
+		return nil
+	}
+}
+
+// WithSLO tracks the upstreams of the providers in tracker.
+func WithSLO(tracker *slo.Tracker) Option {
+	return func(h *Handler) error {
+		h.metering.slo = tracker
+		return nil
+	}
+}
+
+// WithRequestLog logs the requests of the keys that opted in to requests,
+// once the tollgate let them through.
+func WithRequestLog(requests *reqlog.Recorder) Option {
+	return func(h *Handler) error {
+		h.metering.requests = requests
+		return nil
+	}
+}
+
+// WithTransport sets the transport of the upstream requests. By default it
+// resolves through the DNS cache of DNS_CACHE_TTL and DNS_PIN. The requests to
+// the URLs the clients choose, e.g. /fetch, only use it with ALLOW_PRIVATE_TARGETS.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(h *Handler) error {
+		h.transport = transport
+		return nil
+	}
+}
+
+// WithKeyPool sets the upstream key pool of a provider, e.g. to rotate its
+// keys from a config service. By default the pools hold the keys of cfg.
+func WithKeyPool(provider string, keys *proxy.KeyPool) Option {
+	return func(h *Handler) error {
+		if _, ok := h.keys[provider]; !ok {
+			return fmt.Errorf("provider %q has no upstream keys", provider)
+		}
+		h.keys[provider] = keys
+		return nil
+	}
+}
+
+// WithMiddleware wraps the pipeline of every provider in middleware. The
+// middlewares run in the reverse order they're given, the last one first.
+func WithMiddleware(middleware func(provider string, next http.Handler) http.Handler) Option {
+	return func(h *Handler) error {
+		h.middlewares = append(h.middlewares, middleware)
+		return nil
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Providers returns the names of the providers served, in order.
+func (h *Handler) Providers() []string {
+	return slices.Clone(h.providers)
+}
+
+// Provider returns the pipeline of a provider, nil when it isn't served.
+func (h *Handler) Provider(name string) http.Handler {
+	return h.handlers[name]
+}
+
+// KeyPools returns the upstream key pools by provider.
+func (h *Handler) KeyPools() map[string]*proxy.KeyPool {
+	return h.keys
+}
+
+// Cache returns the response cache.
+func (h *Handler) Cache() *cache.Cache {
+	return h.cache
+}
+
+// Close releases the Redis client and the cache New created.
+func (h *Handler) Close() error {
+	var errs []error
+	for _, closer := range h.closers {
+		errs = append(errs, closer())
+	}
+	return errors.Join(errs...)
+}
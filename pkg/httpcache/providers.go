@@ -0,0 +1,921 @@
+package httpcache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Airren/poorman-httpcache/v2/pkg"
+	"github.com/Airren/poorman-httpcache/v2/pkg/cache"
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+	"github.com/Airren/poorman-httpcache/v2/pkg/plugin"
+	"github.com/Airren/poorman-httpcache/v2/pkg/proxy"
+	"github.com/Airren/poorman-httpcache/v2/pkg/reqlog"
+	"github.com/Airren/poorman-httpcache/v2/pkg/semantic"
+	"github.com/Airren/poorman-httpcache/v2/pkg/slo"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tokens"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate/adapter"
+	"github.com/Airren/poorman-httpcache/v2/pkg/wasm"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+// NewCache creates the response cache of the providers in Redis, opts are
+// applied after the settings of cfg.
+func NewCache(cfg pkg.Config, logger *slog.Logger, opts ...cache.Option) (*cache.Cache, error) {
+	var knownMiss *cache.KnownMiss
+	if cfg.KnownMissRotate > 0 {
+		knownMiss = cache.NewKnownMiss(100_000, cfg.KnownMissRotate)
+	}
+	contentRules, err := cache.ParseContentRules(cfg.CacheContentRules)
+	if err != nil {
+		logger.Error("Failed to parse cache content rules", "error", err)
+		return nil, err
+	}
+	ttlRules, err := cache.ParseTTLRules(cfg.CacheTTLRules)
+	if err != nil {
+		logger.Error("Failed to parse cache TTL rules", "error", err)
+		return nil, err
+	}
+	localRules, err := cache.ParseLocalCacheRules(cfg.CacheLocalRules)
+	if err != nil {
+		logger.Error("Failed to parse local cache rules", "error", err)
+		return nil, err
+	}
+	local := []cache.RedisOption{
+		cache.WithLocalCache(cfg.CacheLocalEntries, cfg.CacheLocalTTL),
+		cache.WithLocalCacheRules(localRules),
+		cache.WithInvalidation(cfg.CacheInvalidationChannel),
+	}
+	redisStore := cache.NewRedisAdapter(&redis.RingOptions{
+		Addrs:    map[string]string{"server0": fmt.Sprintf("%s:%d", cfg.RedisHost, cfg.RedisPort)},
+		Username: cfg.RedisUsername,
+		Password: cfg.RedisPassword,
+	}, logger, local...)
+	if cfg.CacheWarmEntries > 0 {
+		warmCache(redisStore, cfg, logger)
+	}
+	var domains cache.DomainIndex
+	if cfg.CacheDomainIndex {
+		domains = redisStore.DomainIndex()
+	}
+	var budget *cache.Budget
+	if cfg.CacheMemoryBudget > 0 {
+		estimate := func(ctx context.Context) (cache.MemoryEstimate, error) {
+			return redisStore.EstimateMemory(ctx, cfg.CacheMemorySamples)
+		}
+		budget = cache.NewBudget(cfg.CacheMemoryBudget, cfg.CacheBudgetTTL, cfg.CacheBudgetMaxSize, estimate, cfg.CacheMemoryInterval, logger)
+		budget.Start(context.Background())
+	}
+	bounded := cache.NewBoundedAdapter(redisStore, cfg.CacheGetTimeout, cfg.CacheSetTimeout, cfg.CacheReleaseTimeout, cfg.CacheHedgeAfter, cfg.CacheLocalSize)
+	// the hedged reads don't serve what another replica released
+	redisStore.OnInvalidate(bounded.Forget)
+	var store cache.Adapter = bounded
+	if cfg.CacheReplicaURL != "" {
+		opt, err := redis.ParseURL(cfg.CacheReplicaURL)
+		if err != nil {
+			logger.Error("Failed to parse cache replica URL", "error", err)
+			return nil, err
+		}
+		var remote cache.Adapter = cache.NewRedisAdapter(&redis.RingOptions{
+			Addrs:    map[string]string{"server0": opt.Addr},
+			Username: opt.Username,
+			Password: opt.Password,
+			DB:       opt.DB,
+		}, logger, local...)
+		// a remote region answers local misses within the timeout or not at all
+		remote = cache.NewBoundedAdapter(remote, cfg.CacheReplicaTimeout, cfg.CacheReplicaTimeout, cfg.CacheReplicaTimeout, 0, 0)
+		store, err = cache.NewReplicatedAdapter(store, remote, cfg.CacheReplicaWorkers, cfg.CacheReplicaQueue, logger)
+		if err != nil {
+			logger.Error("Failed to create cache replication", "error", err)
+			return nil, err
+		}
+	}
+	if cfg.CacheWriteWorkers > 0 {
+		// write off the request goroutine
+		store, err = cache.NewAsyncAdapter(store, cfg.CacheWriteWorkers, cfg.CacheWriteQueue, cache.OverflowPolicy(cfg.CacheWriteOverflow), logger)
+		if err != nil {
+			logger.Error("Failed to create cache writer", "error", err)
+			return nil, err
+		}
+	}
+	cache, err := cache.New(append([]cache.Option{
+		cache.WithAdapter(store),
+		// cache both GET and PUT methods
+		cache.WithMethods([]string{http.MethodGet, http.MethodPost}),
+		// cache responses for 24 hours
+		cache.WithTTL(24 * time.Hour),
+		// stream values from 1MB instead of inlining them
+		cache.WithStreamThreshold(1 << 20),
+		cache.WithContentRules(contentRules),
+		cache.WithTTLRules(ttlRules),
+		cache.WithTTLJitter(cfg.CacheTTLJitter),
+		cache.WithArchive(cfg.CacheArchive),
+		cache.WithKnownMiss(knownMiss),
+		// index entries by target host for DELETE /admin/data
+		cache.WithDomains(targetHost, domains),
+		// redirected fetches are also stored under their final URL
+		cache.WithCanonical(fetchCanonical),
+		cache.WithMaxAge(cfg.CacheMaxAge),
+		cache.WithBudget(budget),
+		// the origins answer conditional requests, the reader APIs don't
+		cache.WithRevalidation(cfg.CacheRevalidateWindow, "fetch"),
+		cache.WithProvenanceHeaders(strings.FieldsFunc(cfg.CacheProvenanceHeaders, func(r rune) bool { return r == ',' || r == ' ' })...),
+		cache.WithPages(searchPages(cfg)),
+		cache.WithStrongConsistency(strings.FieldsFunc(cfg.CacheStrongRoutes, func(r rune) bool { return r == ',' || r == ' ' })...),
+		cache.WithWriteTimeout(cfg.CacheDetachedWriteTimeout),
+		// entries cached under other provider settings aren't served
+		cache.WithKeyConfig(keyConfig(cfg)),
+		cache.WithReadOnly(cfg.CacheReadOnly),
+		cache.WithLogger(logger),
+	}, opts...)...)
+	if err != nil {
+		logger.Error("Failed to create cache", "error", err)
+		return nil, err
+	}
+	return cache, nil
+}
+
+// keyConfig returns the settings changing what the providers answer, e.g. the
+// fetch extraction, for the cache keys. Settings are only added when they're
+// not at their default so adding one doesn't move the existing entries.
+func keyConfig(cfg pkg.Config) string {
+	var parts []string
+	for _, setting := range []struct{ name, value, def string }{
+		{"version", cfg.CacheKeyVersion, ""},
+		{"fetch_extract", cfg.FetchExtract, ""},
+		{"fetch_max_redirects", strconv.Itoa(cfg.FetchMaxRedirects), "0"},
+		{"jina_fallback", cfg.JinaFallback, ""},
+		{"privacy", strconv.FormatBool(cfg.PrivacyMode), "false"},
+	} {
+		if setting.value != setting.def {
+			parts = append(parts, setting.name+"="+setting.value)
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// targetHost returns the host read by a Jina or fetch request, e.g. "www.example.com"
+// for "/jina/https://www.example.com". Serper searches have none.
+func targetHost(r *http.Request) string {
+	_, path, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if !ok {
+		return ""
+	}
+	target, err := proxy.FetchTarget(path, r.URL.RawQuery)
+	if err != nil {
+		return ""
+	}
+	return target.Hostname()
+}
+
+// searchPages returns the pages of the Serper queries, the page of a query is
+// the "page" of its body or URL, 1 without one. Nil unless CacheSearchPages.
+func searchPages(cfg pkg.Config) *cache.Pages {
+	if !cfg.CacheSearchPages {
+		return nil
+	}
+	return &cache.Pages{Of: serperPage, Next: serperNextPage, Prefetch: cfg.CachePagePrefetch}
+}
+
+// serperPage returns the query of a Serper request without its page, and its
+// page. Batches of queries aren't paginated.
+func serperPage(r *http.Request, body []byte) (string, int, bool) {
+	if !strings.HasPrefix(r.URL.Path, "/serper/") {
+		return "", 0, false
+	}
+	query := r.URL.Query()
+	page := 1
+	if r.Method == http.MethodPost {
+		var params map[string]any
+		if err := json.Unmarshal(body, &params); err != nil {
+			return "", 0, false
+		}
+		if n, ok := params["page"].(float64); ok {
+			page = int(n)
+		}
+		delete(params, "page")
+		// the keys are sorted, the same query groups whatever their order
+		b, err := json.Marshal(params)
+		if err != nil {
+			return "", 0, false
+		}
+		query.Set("body", string(b))
+	} else if p := query.Get("page"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return "", 0, false
+		}
+		page = n
+		query.Del("page")
+	}
+	return r.URL.Path + "?" + query.Encode(), page, page > 0
+}
+
+// serperNextPage returns the Serper request of the page after the one of r.
+func serperNextPage(r *http.Request, body []byte) *http.Request {
+	_, page, ok := serperPage(r, body)
+	if !ok {
+		return nil
+	}
+	if r.Method != http.MethodPost {
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(page+1))
+		r.URL.RawQuery = query.Encode()
+		return r
+	}
+	var params map[string]any
+	if err := json.Unmarshal(body, &params); err != nil {
+		return nil
+	}
+	params["page"] = page + 1
+	b, err := json.Marshal(params)
+	if err != nil {
+		return nil
+	}
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	r.ContentLength = int64(len(b))
+	return r
+}
+
+// fetchCanonical returns the fetch route path of the final URL of a
+// redirected fetch, nil for other answers.
+func fetchCanonical(r *http.Request, header http.Header) *url.URL {
+	final := header.Get(proxy.FinalURLHeader)
+	if final == "" || !strings.HasPrefix(r.URL.Path, "/fetch/") {
+		return nil
+	}
+	target, err := url.Parse(final)
+	if err != nil || target.Host == "" {
+		return nil
+	}
+	return proxy.FetchPath("/fetch", target)
+}
+
+// NewMetaStore opens the MetaStore backend named by cfg.MetaStore, with the
+// Postgres pool the redis and postgres backends read from. close releases
+// the pool.
+func NewMetaStore(ctx context.Context, cfg pkg.Config, rdb redis.Cmdable) (store adapter.MetaStore, close func(), err error) {
+	opts := adapter.MetaStoreOptions{Redis: rdb, Path: cfg.MetaStoreFile}
+	close = func() {}
+	if cfg.MetaStore != "file" {
+		pool, err := pgxpool.New(ctx, cfg.PostgresURL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("pgxpool.New: %w", err)
+		}
+		opts.DB = dbsqlc.New(pool)
+		close = pool.Close
+	}
+	store, err = adapter.OpenMetaStore(cfg.MetaStore, opts)
+	if err != nil {
+		close()
+		return nil, nil, err
+	}
+	return store, close, nil
+}
+
+// NewRedisClient creates the client of the Redis shared by the tollgate
+// state, the host politeness and the request log.
+func NewRedisClient(cfg pkg.Config) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:     fmt.Sprintf("%s:%d", cfg.RedisHost, cfg.RedisPort),
+		Username: cfg.RedisUsername,
+		Password: cfg.RedisPassword,
+		DB:       cfg.RedisDB,
+	})
+}
+
+// trackUsage records per-request usage events when a usage sink is configured.
+func trackUsage(next tollgate.Adapter, service string, sink adapter.UsageSink) tollgate.Adapter {
+	if sink == nil {
+		return next
+	}
+	return adapter.NewEventRecorder(next, service, sink)
+}
+
+// metering is how the tollgates account the requests of the providers.
+type metering struct {
+	sink adapter.UsageSink
+	// keys are the keys of the clients when set, the internal key only otherwise
+	keys adapter.MetaStore
+	// internalKey is the key of the jobs and the replays, it has no restrictions
+	internalKey string
+	// rdb holds the quotas of the keys
+	rdb redis.Cmdable
+	// limits enforces the soft and hard limits of the keys when set
+	limits *adapter.LimitStore
+	// members counts the usage of the keys per member when set
+	members *adapter.MemberStore
+	// tags counts the usage of the keys per tag when set
+	tags *adapter.TagStore
+	// domains counts the usage of the page providers per target domain when set
+	domains *adapter.DomainStore
+	// budgets caps the usage of the tags when set
+	budgets *adapter.TagBudgetStore
+	// tokens accepts the access tokens minted from the keys when set
+	tokens *adapter.AccessTokens
+	// supportKey is charged the debit of the impersonated requests when set
+	supportKey string
+	// slo tracks the upstreams against the objectives when set
+	slo *slo.Tracker
+	// requests logs the requests of the keys that opted in when set
+	requests *reqlog.Recorder
+	// policy decides whether the requests are allowed when set
+	policy *adapter.OPA
+	// cooldowns hold the requests to the providers back after their 429s
+	cooldowns map[string]*proxy.Cooldown
+	// pauses put the providers whose account is out of credits in cache-only mode
+	pauses map[string]*proxy.CreditPause
+	// dedupeWindow answers the identical POSTs of a key within it once, 0 disables it
+	dedupeWindow time.Duration
+	logger       *slog.Logger
+	// readOnly serves from the cache only, the keys are checked but nothing is counted
+	readOnly bool
+}
+
+// logged logs the requests of the keys that opted in, behind the tollgate so
+// only the keys it let through are logged. keyFunc is the key extraction of
+// the tollgate.
+func (m metering) logged(keyFunc func(r *http.Request) string, next http.Handler) http.Handler {
+	if m.requests == nil {
+		return next
+	}
+	return m.requests.HTTPHandlerMiddleware(keyFunc, next)
+}
+
+// measure tracks the upstream of provider against the objectives, the
+// requests its cooldowns hold back or its pause refuses don't reach it.
+func (m metering) measure(provider string, upstream http.Handler) http.Handler {
+	if cooldown, ok := m.cooldowns[provider]; ok {
+		upstream = cooldown.HTTPHandlerMiddleware(upstream)
+	}
+	if m.slo != nil {
+		upstream = m.slo.Upstream(provider, upstream)
+	}
+	if pause, ok := m.pauses[provider]; ok {
+		upstream = pause.HTTPHandlerMiddleware(upstream)
+	}
+	return upstream
+}
+
+// dedupe answers the duplicate POSTs of a key to provider from the first
+// one, under the tollgate so the keys are still checked and charged.
+func (m metering) dedupe(provider string, keyFunc func(r *http.Request) string, next http.Handler) http.Handler {
+	if m.dedupeWindow <= 0 {
+		return next
+	}
+	return proxy.NewDedupe(provider, m.dedupeWindow, keyFunc, m.logger).HTTPHandlerMiddleware(next)
+}
+
+// keyAdapter returns the adapter the keys of provider are reserved from: the
+// keys of the MetaStore when set, the internal key alone otherwise. The
+// internal key, used by the jobs and the replays, isn't charged either way.
+func (m metering) keyAdapter(provider, internalKey string) (tollgate.Adapter, error) {
+	if m.keys == nil {
+		return adapter.NewSecretKey(internalKey, provider), nil
+	}
+	// the quota manager needs the service, it isn't created without
+	if _, err := m.keys.GetService(context.Background(), provider); err != nil {
+		return nil, fmt.Errorf("MetaStore service %q: %w", provider, err)
+	}
+	keys := adapter.NewKeyValueWithMetaStore(adapter.RedisClient(m.rdb), nil, m.keys, provider, m.logger)
+	return adapter.NewInternalKey(internalKey, keys), nil
+}
+
+// restrictions returns the network and origin restrictions of the keys.
+func (m metering) restrictions() func(ctx context.Context, key string) (tollgate.Restrictions, error) {
+	restrictions := adapter.KeyRestrictions(m.keys)
+	return func(ctx context.Context, key string) (tollgate.Restrictions, error) {
+		if m.internalKey != "" && key == m.internalKey {
+			return tollgate.Restrictions{}, nil
+		}
+		return restrictions(ctx, key)
+	}
+}
+
+// newTollgate creates the tollgate of provider, with the restrictions of the
+// keys, the access tokens, the usage events, the limits, the usage per
+// member, tag and domain, the tag budgets and the extensions of the
+// registered plugins.
+func newTollgate(provider string, quota tollgate.Adapter, keyFunc func(r *http.Request) string, m metering, opts ...tollgate.Option) *tollgate.Tollgate {
+	if m.supportKey != "" {
+		// the impersonated requests go through the layers of their key, only
+		// the debit goes to the support key
+		quota = adapter.NewSupportKey(m.supportKey, quota)
+	}
+	quota = plugin.Default.Adapter(provider, quota)
+	var restrictions func(ctx context.Context, key string) (tollgate.Restrictions, error)
+	if m.keys != nil {
+		restrictions = m.restrictions()
+		opts = append(opts, tollgate.WithRestrictions(restrictions))
+	}
+	if m.tokens != nil {
+		// the tokens are resolved to the keys they were minted from, the
+		// layers above the quota of the keys, the restrictions included, see
+		// the keys; the quota takes the requests from the slices of the tokens
+		quota = m.tokens.Adapter(provider, quota, restrictions)
+		opts = append(opts, tollgate.WithKeyResolver(m.tokens.Resolve(provider)))
+	}
+	if m.policy != nil {
+		opts = append(opts, tollgate.WithPolicy(provider, m.policy.Decide))
+	}
+	if m.readOnly {
+		// cached answers don't spend quota, the usage events are still recorded
+		return tollgate.New(trackUsage(quota, provider, m.sink), plugin.Default.KeyFunc(provider, keyFunc), opts...)
+	}
+	if m.members != nil {
+		quota = m.members.Adapter(provider, quota)
+	}
+	if m.tags != nil {
+		quota = m.tags.Adapter(provider, quota)
+	}
+	if m.domains != nil && (provider == "jina" || provider == "fetch") {
+		quota = m.domains.Adapter(provider, quota)
+	}
+	if m.limits != nil {
+		quota = m.limits.Adapter(provider, quota)
+	}
+	if m.budgets != nil {
+		quota = m.budgets.Adapter(provider, quota)
+	}
+	quota = trackUsage(quota, provider, m.sink)
+	if m.supportKey != "" {
+		opts = append(opts, tollgate.WithSupportKey(m.supportKey))
+	}
+	opts = append(opts, plugin.Default.TollgateOptions(provider)...)
+	return tollgate.New(quota, plugin.Default.KeyFunc(provider, keyFunc), opts...)
+}
+
+// warmCache pre-loads the local cache of store with the entries hit the
+// most, a failure only leaves it cold.
+func warmCache(store *cache.RedisAdapter, cfg pkg.Config, logger *slog.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.CacheWarmTimeout)
+	defer cancel()
+	start := time.Now()
+	loaded, err := store.Warm(ctx, cfg.CacheWarmEntries, cfg.CacheWarmScan)
+	if err != nil {
+		logger.Warn("Failed to warm the local cache", "loaded", loaded, "error", err)
+		return
+	}
+	logger.Info("Local cache warmed", "loaded", loaded, "duration", time.Since(start))
+}
+
+// politeUpstream caps the requests to each target host when configured.
+func politeUpstream(upstream http.Handler, rdb redis.Cmdable, prefix string, cfg pkg.Config, logger *slog.Logger) http.Handler {
+	if cfg.HostMaxInflight <= 0 && cfg.HostMaxRate <= 0 {
+		return upstream
+	}
+	politeness := proxy.NewPoliteness(rdb, prefix, cfg.HostMaxInflight, cfg.HostMaxRate, logger)
+	return politeness.HTTPHandlerMiddleware(upstream)
+}
+
+// upstreamTransport returns the transport of the upstream requests, resolving
+// through a DNS cache when configured.
+func upstreamTransport(cfg pkg.Config) (http.RoundTripper, error) {
+	pins, err := proxy.ParseDNSPins(cfg.DNSPin)
+	if err != nil {
+		return nil, fmt.Errorf("ParseDNSPins: %w", err)
+	}
+	if cfg.DNSCacheTTL <= 0 && len(pins) == 0 {
+		return http.DefaultTransport, nil
+	}
+	return proxy.NewResolver(cfg.DNSCacheTTL, pins).Transport(), nil
+}
+
+// targetTransport returns the transport of the requests to the URLs the
+// clients choose, e.g. /fetch, connecting to public addresses only unless
+// AllowPrivateTargets.
+func targetTransport(cfg pkg.Config, transport http.RoundTripper) (http.RoundTripper, error) {
+	if cfg.AllowPrivateTargets {
+		return transport, nil
+	}
+	pins, err := proxy.ParseDNSPins(cfg.DNSPin)
+	if err != nil {
+		return nil, fmt.Errorf("ParseDNSPins: %w", err)
+	}
+	if cfg.DNSCacheTTL <= 0 && len(pins) == 0 {
+		return proxy.PublicTransport(), nil
+	}
+	return proxy.NewResolver(cfg.DNSCacheTTL, pins).PublicTransport(), nil
+}
+
+// authorize sets the OAuth2 tokens of an upstream on its requests when configured.
+func authorize(transport http.RoundTripper, oauth pkg.OAuth) http.RoundTripper {
+	if oauth.TokenURL == "" {
+		return transport
+	}
+	source := proxy.NewClientCredentials(oauth.TokenURL, oauth.ClientID, oauth.ClientSecret, strings.Fields(oauth.Scopes), transport)
+	return proxy.NewTokenTransport(transport, source)
+}
+
+// identify sets the configured identity of the outbound requests to a provider.
+func identify(id pkg.Identity) (func(*httputil.ProxyRequest), error) {
+	header, err := proxy.ParseIdentityHeaders(id.Headers)
+	if err != nil {
+		return nil, fmt.Errorf("ParseIdentityHeaders: %w", err)
+	}
+	return proxy.Identify(proxy.Identity{UserAgent: id.UserAgent, From: id.From, Header: header}), nil
+}
+
+// limitProvider checks the answers of a provider against its schema, and caps
+// the concurrent requests and the rate of the calls to it when configured.
+func limitProvider(upstream http.Handler, rdb redis.Cmdable, provider string, cfg pkg.Config, logger *slog.Logger) (http.Handler, error) {
+	schemas, err := proxy.ParseSchemas(cfg.ProviderSchemas)
+	if err != nil {
+		return nil, fmt.Errorf("ParseSchemas: %w", err)
+	}
+	// the retries of invalid answers run within the slot and the turn of the call
+	if schema, ok := schemas[provider]; ok {
+		check := proxy.NewSchemaCheck(provider, schema, cfg.ProviderSchemaRetries, logger)
+		upstream = check.HTTPHandlerMiddleware(upstream)
+	}
+	limits, err := proxy.ParseProviderLimits(cfg.ProviderMaxInflight)
+	if err != nil {
+		return nil, fmt.Errorf("ParseProviderLimits: %w", err)
+	}
+	budgets, err := proxy.ParseMissBudgets(cfg.ProviderMissBudget)
+	if err != nil {
+		return nil, fmt.Errorf("ParseMissBudgets: %w", err)
+	}
+	if limits[provider] > 0 {
+		limit := proxy.NewConcurrencyLimit(rdb, provider, limits[provider], cfg.ProviderQueueTimeout, logger)
+		upstream = limit.HTTPHandlerMiddleware(upstream)
+	}
+	// the calls waiting for their turn don't hold a concurrency slot
+	if rate, ok := budgets[provider]; ok {
+		queueTimeout := cfg.ProviderQueueTimeout
+		if cfg.ProviderMissBudgetReject {
+			queueTimeout = 0
+		}
+		budget := proxy.NewMissBudget(provider, rate, queueTimeout, logger)
+		upstream = budget.HTTPHandlerMiddleware(upstream)
+	}
+	return upstream, nil
+}
+
+// newJinaProxy creates the proxy of the Jina reader, with a fetch fallback
+// through targets when configured.
+func newJinaProxy(cache *cache.Cache, rdb redis.Cmdable, m metering, keys *proxy.KeyPool, transport, targets http.RoundTripper, cfg pkg.Config, logger *slog.Logger) (http.Handler, error) {
+	target, err := url.Parse("https://r.jina.ai")
+	if err != nil {
+		logger.Error("Failed to parse Jina target URL", "error", err)
+		return nil, err
+	}
+
+	jinaIdentity, err := identify(cfg.JinaIdentity)
+	if err != nil {
+		return nil, err
+	}
+	fetchIdentity, err := identify(cfg.FetchIdentity)
+	if err != nil {
+		return nil, err
+	}
+	rp, err := proxy.New(
+		proxy.WithTransport(authorize(transport, cfg.JinaOAuth)),
+		proxy.WithRewrites(
+			proxy.RewriteJinaPath(target),
+			proxy.PoolJinaKey(keys),
+			jinaIdentity,
+			proxy.NegotiateEncoding(),
+			plugin.Default.Rewrite("jina"),
+			proxy.DebugRequest(logger),
+		),
+		proxy.WithModifyResponse(proxy.DecodeBody(cfg.DecodedBodyMax)),
+		proxy.WithModifyResponse(proxy.RecordProvenance("jina")),
+		proxy.WithModifyResponse(proxy.ClassifyErrors("jina")),
+	)
+	if err != nil {
+		logger.Error("Failed to create Jina proxy", "error", err)
+		return nil, err
+	}
+
+	jina, err := limitProvider(rp, m.rdb, "jina", cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	upstream := jina
+	switch cfg.JinaFallback {
+	case "":
+	case "fetch":
+		fetch, err := proxy.New(
+			proxy.WithTransport(targets),
+			proxy.WithRewrites(
+				proxy.RewriteFetchPath("/jina"),
+				fetchIdentity,
+				proxy.NegotiateEncoding(),
+				plugin.Default.Rewrite("fetch"),
+				proxy.DebugRequest(logger),
+			),
+			proxy.WithModifyResponse(proxy.DecodeBody(cfg.DecodedBodyMax)),
+			proxy.WithModifyResponse(proxy.RecordProvenance("fetch")),
+			proxy.WithModifyResponse(proxy.ClassifyErrors("fetch")),
+		)
+		if err != nil {
+			logger.Error("Failed to create Jina fallback proxy", "error", err)
+			return nil, err
+		}
+		// the fallback fetches the pages itself, as the fetch proxy does
+		fallback, err := fetchRobots(fetch, "/jina", targets, cfg, logger)
+		if err != nil {
+			return nil, err
+		}
+		upstream = proxy.NewFallback(
+			proxy.Provider{Name: "jina", Handler: jina},
+			proxy.Provider{Name: "fetch", Handler: fallback},
+			proxy.JinaBlocked,
+			cfg.DecodedBodyMax,
+			logger,
+		)
+	default:
+		return nil, fmt.Errorf("unknown Jina fallback provider %q", cfg.JinaFallback)
+	}
+	upstream = politeUpstream(upstream, rdb, "/jina", cfg, logger)
+
+	skAdapter, err := m.keyAdapter("jina", cfg.InternalKey)
+	if err != nil {
+		return nil, err
+	}
+	secretKeyExtract := func(r *http.Request) string {
+		return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	tollgate := newTollgate("jina", skAdapter, secretKeyExtract, m)
+
+	return tollgate.HTTPHandlerMiddleware(m.logged(secretKeyExtract, m.dedupe("jina", secretKeyExtract, cache.HTTPHandlerMiddleware(m.measure("jina", upstream))))), nil
+}
+
+// newFetchProxy creates the proxy fetching pages directly, transport is the
+// one of the client chosen URLs.
+func newFetchProxy(cache *cache.Cache, rdb redis.Cmdable, m metering, transport http.RoundTripper, cfg pkg.Config, logger *slog.Logger) (http.Handler, error) {
+	fetchIdentity, err := identify(cfg.FetchIdentity)
+	if err != nil {
+		return nil, err
+	}
+	rewrites := []func(*httputil.ProxyRequest){
+		proxy.RewriteFetchPath("/fetch"),
+		fetchIdentity,
+		proxy.NegotiateEncoding(),
+		plugin.Default.Rewrite("fetch"),
+		proxy.DebugRequest(logger),
+	}
+	fetchTransport := transport
+	if cfg.FetchMaxRedirects > 0 {
+		// robots.txt and the host caps apply to the requested host only
+		fetchTransport = proxy.FollowRedirects(transport, cfg.FetchMaxRedirects)
+	}
+	opts := []proxy.Option{
+		proxy.WithTransport(fetchTransport),
+		proxy.WithModifyResponse(proxy.DecodeBody(cfg.DecodedBodyMax)),
+		proxy.WithModifyResponse(proxy.RecordProvenance("fetch")),
+		proxy.WithModifyResponse(proxy.ClassifyErrors("fetch")),
+	}
+	switch cfg.FetchExtract {
+	case "":
+	case proxy.ExtractMarkdown, proxy.ExtractText:
+		// extract server-side so the cache stores the readable page
+		opts = append(opts, proxy.WithModifyResponse(proxy.ExtractHTML(cfg.FetchExtract, cfg.FetchExtractMax)))
+	default:
+		return nil, fmt.Errorf("unknown fetch extraction format %q", cfg.FetchExtract)
+	}
+	opts = append(opts, proxy.WithRewrites(rewrites...))
+
+	rp, err := proxy.New(opts...)
+	if err != nil {
+		logger.Error("Failed to create fetch proxy", "error", err)
+		return nil, err
+	}
+
+	upstream, err := limitProvider(rp, m.rdb, "fetch", cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	upstream, err = fetchRobots(upstream, "/fetch", transport, cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	upstream = politeUpstream(upstream, rdb, "/fetch", cfg, logger)
+
+	skAdapter, err := m.keyAdapter("fetch", cfg.InternalKey)
+	if err != nil {
+		return nil, err
+	}
+	secretKeyExtract := func(r *http.Request) string {
+		return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	tollgate := newTollgate("fetch", skAdapter, secretKeyExtract, m)
+
+	return tollgate.HTTPHandlerMiddleware(m.logged(secretKeyExtract, cache.HTTPHandlerMiddleware(m.measure("fetch", upstream)))), nil
+}
+
+// fetchRobots checks the fetches of next, under prefix, against robots.txt
+// as FETCH_ROBOTS says.
+func fetchRobots(next http.Handler, prefix string, transport http.RoundTripper, cfg pkg.Config, logger *slog.Logger) (http.Handler, error) {
+	switch cfg.FetchRobots {
+	case "":
+		return next, nil
+	case proxy.RobotsEnforce, proxy.RobotsFlag:
+		robots := proxy.NewRobots(prefix, cfg.FetchRobots, time.Hour, transport, logger)
+		return robots.HTTPHandlerMiddleware(next), nil
+	}
+	return nil, fmt.Errorf("unknown fetch robots mode %q", cfg.FetchRobots)
+}
+
+// newSerperProxy creates the proxy of the Serper search API.
+func newSerperProxy(cache *cache.Cache, rdb redis.Cmdable, m metering, keys *proxy.KeyPool, transport http.RoundTripper, cfg pkg.Config, logger *slog.Logger) (http.Handler, error) {
+	target, err := url.Parse("https://google.serper.dev")
+	if err != nil {
+		logger.Error("Failed to parse Serper target URL", "error", err)
+		return nil, err
+	}
+
+	serperIdentity, err := identify(cfg.SerperIdentity)
+	if err != nil {
+		return nil, err
+	}
+	rp, err := proxy.New(
+		proxy.WithTransport(authorize(transport, cfg.SerperOAuth)),
+		proxy.WithRewrites(
+			proxy.RewriteSerperPath(target),
+			proxy.PoolSerperKey(keys),
+			serperIdentity,
+			proxy.NegotiateEncoding(),
+			plugin.Default.Rewrite("serper"),
+			proxy.DebugRequest(logger),
+		),
+		proxy.WithModifyResponse(proxy.DecodeBody(cfg.DecodedBodyMax)),
+		proxy.WithModifyResponse(proxy.RecordProvenance("serper")),
+		proxy.WithModifyResponse(proxy.ClassifyErrors("serper")),
+	)
+	if err != nil {
+		logger.Error("Failed to create Serper proxy", "error", err)
+		return nil, err
+	}
+	upstream, err := limitProvider(rp, m.rdb, "serper", cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	skAdapter, err := m.keyAdapter("serper", cfg.InternalKey)
+	if err != nil {
+		return nil, err
+	}
+	secretKeyExtract := func(r *http.Request) string {
+		return r.Header.Get("X-API-KEY")
+	}
+	tollgate := newTollgate("serper", skAdapter, secretKeyExtract, m)
+
+	handler := cache.HTTPHandlerMiddleware(m.measure("serper", upstream))
+	// the embeddings endpoint is an upstream a read-only instance doesn't
+	// call, and the queries aren't kept nor sent out in privacy mode
+	if cfg.SemanticEmbeddingURL != "" && !cfg.CacheReadOnly && !cfg.PrivacyMode {
+		embedder := semantic.NewEmbedder(cfg.SemanticEmbeddingURL, cfg.SemanticEmbeddingKey, cfg.SemanticEmbeddingModel, transport)
+		matcher := semantic.New(rdb, cache, embedder, "serper", cfg.SemanticThreshold, cfg.SemanticMaxQueries, logger)
+		handler = matcher.HTTPHandlerMiddleware(handler)
+	}
+	return tollgate.HTTPHandlerMiddleware(m.logged(secretKeyExtract, m.dedupe("serper", secretKeyExtract, handler))), nil
+}
+
+// loadFilters compiles the WASM filters of WASM_FILTERS.
+func loadFilters(cfg pkg.Config, logger *slog.Logger) ([]*proxy.WASMFilter, error) {
+	var filters []*proxy.WASMFilter
+	limits := wasm.Limits{Fuel: cfg.WASMFilterFuel, MaxMemory: cfg.WASMFilterMaxMemoryMB << 20}
+	for _, path := range strings.Split(cfg.WASMFilters, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		filter, err := proxy.LoadWASMFilter(path, limits, cfg.WASMFilterTimeout, logger)
+		if err != nil {
+			return nil, fmt.Errorf("LoadWASMFilter %s: %w", path, err)
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// filtered runs the WASM filters around a provider, the first one sees the
+// requests first and the answers last.
+func filtered(h http.Handler, filters []*proxy.WASMFilter) http.Handler {
+	for i := len(filters) - 1; i >= 0; i-- {
+		h = filters[i].HTTPHandlerMiddleware(h)
+	}
+	return h
+}
+
+// tokenCounter loads the tokenizer of TOKENIZER_FILE, the LLM routes
+// estimate tokens from the text length without one.
+func tokenCounter(cfg pkg.Config) (tokens.Counter, error) {
+	if cfg.TokenizerFile == "" {
+		return tokens.Estimate{}, nil
+	}
+	encoding, err := tokens.Load(cfg.TokenizerFile)
+	if err != nil {
+		return nil, fmt.Errorf("tokens.Load: %w", err)
+	}
+	return encoding, nil
+}
+
+// newAzureOpenAIProxy creates the proxy of an Azure OpenAI resource. Quotas
+// are charged in tokens.
+func newAzureOpenAIProxy(cache *cache.Cache, m metering, keys *proxy.KeyPool, transport http.RoundTripper, counter tokens.Counter, cfg pkg.Config, logger *slog.Logger) (http.Handler, error) {
+	target, err := url.Parse(cfg.AzureOpenAIEndpoint)
+	if err != nil {
+		logger.Error("Failed to parse Azure OpenAI endpoint", "error", err)
+		return nil, err
+	}
+
+	rp, err := proxy.New(
+		proxy.WithTransport(transport),
+		proxy.WithRewrites(
+			proxy.RewriteAzureOpenAIPath(target, cfg.AzureOpenAIAPIVersion, proxy.ParseDeployments(cfg.AzureOpenAIDeployments)),
+			proxy.PoolAzureKey(keys),
+			proxy.NegotiateEncoding(),
+			plugin.Default.Rewrite("azure"),
+			proxy.DebugRequest(logger),
+		),
+		proxy.WithModifyResponse(proxy.DecodeBody(cfg.DecodedBodyMax)),
+		proxy.WithModifyResponse(proxy.RecordProvenance("azure")),
+		proxy.WithModifyResponse(proxy.ClassifyErrors("azure")),
+	)
+	if err != nil {
+		logger.Error("Failed to create Azure OpenAI proxy", "error", err)
+		return nil, err
+	}
+	upstream, err := limitProvider(rp, m.rdb, "azure", cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	skAdapter, err := m.keyAdapter("azure", cfg.InternalKey)
+	if err != nil {
+		return nil, err
+	}
+	// Azure OpenAI clients send the api-key header, OpenAI clients a bearer token
+	secretKeyExtract := func(r *http.Request) string {
+		if key := r.Header.Get("api-key"); key != "" {
+			return key
+		}
+		return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	tollgate := newTollgate("azure", skAdapter, secretKeyExtract, m,
+		tollgate.WithCost(tokens.RequestCost(counter)),
+		tollgate.WithUsage(tokens.ResponseUsage),
+	)
+
+	return tollgate.HTTPHandlerMiddleware(m.logged(secretKeyExtract, m.dedupe("azure", secretKeyExtract, cache.HTTPHandlerMiddleware(m.measure("azure", upstream))))), nil
+}
+
+// newVertexProxy creates the proxy of the Vertex AI publisher models of a
+// project, authenticated with the Application Default Credentials. Quotas
+// are charged in tokens.
+func newVertexProxy(cache *cache.Cache, m metering, transport http.RoundTripper, counter tokens.Counter, cfg pkg.Config, logger *slog.Logger) (http.Handler, error) {
+	target, err := proxy.VertexTarget(cfg.VertexLocation)
+	if err != nil {
+		logger.Error("Failed to parse Vertex AI target URL", "error", err)
+		return nil, err
+	}
+	credentials, err := proxy.NewGoogleCredentials([]string{proxy.GoogleCloudScope}, transport)
+	if err != nil {
+		return nil, fmt.Errorf("proxy.NewGoogleCredentials: %w", err)
+	}
+
+	rp, err := proxy.New(
+		proxy.WithTransport(proxy.NewTokenTransport(transport, credentials)),
+		proxy.WithRewrites(
+			proxy.RewriteVertexPath(target, cfg.VertexProject, cfg.VertexLocation),
+			proxy.NegotiateEncoding(),
+			plugin.Default.Rewrite("vertex"),
+			proxy.DebugRequest(logger),
+		),
+		proxy.WithModifyResponse(proxy.DecodeBody(cfg.DecodedBodyMax)),
+		proxy.WithModifyResponse(proxy.RecordProvenance("vertex")),
+		proxy.WithModifyResponse(proxy.ClassifyErrors("vertex")),
+	)
+	if err != nil {
+		logger.Error("Failed to create Vertex AI proxy", "error", err)
+		return nil, err
+	}
+	upstream, err := limitProvider(rp, m.rdb, "vertex", cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	skAdapter, err := m.keyAdapter("vertex", cfg.InternalKey)
+	if err != nil {
+		return nil, err
+	}
+	secretKeyExtract := func(r *http.Request) string {
+		return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	tollgate := newTollgate("vertex", skAdapter, secretKeyExtract, m,
+		tollgate.WithCost(tokens.RequestCost(counter)),
+		tollgate.WithUsage(tokens.ResponseUsage),
+	)
+
+	return tollgate.HTTPHandlerMiddleware(m.logged(secretKeyExtract, m.dedupe("vertex", secretKeyExtract, cache.HTTPHandlerMiddleware(m.measure("vertex", upstream))))), nil
+}
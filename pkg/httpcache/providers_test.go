@@ -0,0 +1,201 @@
+package httpcache
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/impersonate"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate/adapter"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// reserveCounter lets every key through, counting the reservations.
+type reserveCounter struct {
+	reserved map[string]int
+}
+
+func (c *reserveCounter) Reserve(ctx context.Context, key string, amount int) (bool, error) {
+	c.reserved[key] += amount
+	return true, nil
+}
+
+func (c *reserveCounter) Refund(ctx context.Context, key string, amount int) (bool, error) {
+	c.reserved[key] -= amount
+	return true, nil
+}
+
+// restrictedKeys returns a MetaStore with sk-office, allowed from
+// 203.0.113.0/24 only, and sk-anywhere.
+func restrictedKeys(t *testing.T) adapter.MetaStore {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	err := os.WriteFile(path, []byte(`
+services:
+  - name: serper
+    default_quota: 100
+keys:
+  - key: sk-office
+    status: assigned
+    allowed_cidrs:
+      - 203.0.113.0/24
+  - key: sk-anywhere
+    status: assigned
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := adapter.NewFileMetaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestTollgateRestrictions(t *testing.T) {
+	counter := &reserveCounter{reserved: map[string]int{}}
+	m := metering{keys: restrictedKeys(t), internalKey: "sk-internal"}
+	keyFunc := func(r *http.Request) string { return r.Header.Get("X-API-KEY") }
+	handler := newTollgate("serper", counter, keyFunc, m).HTTPHandlerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for _, tc := range []struct {
+		key, remoteAddr string
+		want            int
+	}{
+		{"sk-office", "198.51.100.7:1234", http.StatusForbidden},
+		{"sk-office", "203.0.113.7:1234", http.StatusOK},
+		{"sk-anywhere", "198.51.100.7:1234", http.StatusOK},
+		{"sk-internal", "198.51.100.7:1234", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/serper/search", nil)
+		r.RemoteAddr = tc.remoteAddr
+		r.Header.Set("X-API-KEY", tc.key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s from %s: got %d, want %d", tc.key, tc.remoteAddr, w.Code, tc.want)
+		}
+	}
+	// the request refused wasn't reserved
+	if got := counter.reserved["sk-office"]; got != 1 {
+		t.Errorf("sk-office reserved %d, want 1", got)
+	}
+}
+
+func TestImpersonationRunsAsTheKey(t *testing.T) {
+	counter := &reserveCounter{reserved: map[string]int{}}
+	keys := restrictedKeys(t)
+	m := metering{keys: keys, supportKey: "sk-support"}
+	var decided []string
+	policy := tollgate.WithPolicy("serper", func(ctx context.Context, key string, input *tollgate.PolicyInput) (tollgate.Decision, error) {
+		decided = append(decided, key)
+		return tollgate.Decision{Allow: true}, nil
+	})
+	keyFunc := func(r *http.Request) string { return r.Header.Get("X-API-KEY") }
+	handler := newTollgate("serper", counter, keyFunc, m, policy).HTTPHandlerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler = impersonate.New("admin", keys, slog.New(slog.NewTextHandler(io.Discard, nil))).HTTPHandlerMiddleware(handler)
+
+	for _, tc := range []struct {
+		keyID string
+		want  int
+	}{
+		// the restrictions of the key don't apply to the admins
+		{tollgate.KeyFingerprint("sk-office"), http.StatusOK},
+		{tollgate.KeyFingerprint("sk-unknown"), http.StatusNotFound},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/serper/search", nil)
+		r.RemoteAddr = "198.51.100.7:1234"
+		r.Header.Set("X-Admin-Key", "admin")
+		r.Header.Set(tollgate.ImpersonateHeader, tc.keyID)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("impersonating %s: got %d %q, want %d", tc.keyID, w.Code, w.Body, tc.want)
+		}
+	}
+	// the policy saw the key, the support key paid for it
+	if len(decided) != 1 || decided[0] != "sk-office" {
+		t.Errorf("the policy decided for %v, want sk-office", decided)
+	}
+	if counter.reserved["sk-support"] != 1 || counter.reserved["sk-office"] != 0 {
+		t.Errorf("reserved %v, want sk-support only", counter.reserved)
+	}
+}
+
+func TestAccessTokensAreTheirKeys(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	tokens := adapter.NewAccessTokens(rdb, "secret", time.Hour, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	counter := &reserveCounter{reserved: map[string]int{}}
+	m := metering{keys: restrictedKeys(t), tokens: tokens}
+	keyFunc := func(r *http.Request) string { return r.Header.Get("X-API-KEY") }
+	handler := newTollgate("serper", counter, keyFunc, m).HTTPHandlerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	mint := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/tokens", strings.NewReader(`{"service": "serper", "quota": 10}`))
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-API-KEY", "sk-office")
+		w := httptest.NewRecorder()
+		tokens.Mint(w, r)
+		return w
+	}
+	if w := mint("198.51.100.7:1234"); w.Code != http.StatusForbidden {
+		t.Fatalf("minted from outside the key's network: got %d %q", w.Code, w.Body)
+	}
+	w := mint("203.0.113.7:1234")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("mint: got %d %q", w.Code, w.Body)
+	}
+	var minted struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &minted); err != nil {
+		t.Fatal(err)
+	}
+	if got := counter.reserved["sk-office"]; got != 10 {
+		t.Fatalf("the slice reserved %d, want 10", got)
+	}
+
+	for _, tc := range []struct {
+		token, remoteAddr string
+		want              int
+	}{
+		// the restrictions of the key apply to its tokens
+		{minted.Token, "198.51.100.7:1234", http.StatusForbidden},
+		{minted.Token, "203.0.113.7:1234", http.StatusOK},
+		{minted.Token + "x", "203.0.113.7:1234", http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/serper/search", nil)
+		r.RemoteAddr = tc.remoteAddr
+		r.Header.Set("X-API-KEY", tc.token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("token from %s: got %d %q, want %d", tc.remoteAddr, w.Code, w.Body, tc.want)
+		}
+	}
+	// the request was taken from the slice, not from the key again
+	if got := counter.reserved["sk-office"]; got != 10 {
+		t.Errorf("sk-office reserved %d, want 10", got)
+	}
+	if len(counter.reserved) != 1 {
+		t.Errorf("reserved %v, want sk-office only", counter.reserved)
+	}
+	slices, err := rdb.Keys(context.Background(), "access_token:*").Result()
+	if err != nil || len(slices) != 1 {
+		t.Fatalf("token slices %v, %v", slices, err)
+	}
+	if remaining, _ := rdb.HGet(context.Background(), slices[0], "remaining").Int(); remaining != 9 {
+		t.Errorf("the slice has %d left, want 9", remaining)
+	}
+}
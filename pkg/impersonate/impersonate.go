@@ -0,0 +1,82 @@
+// Package impersonate lets admins run proxied requests as a given key, to
+// reproduce what its owner reported exactly:
+//
+//	curl "https://cachev1.example.com/jina/https://example.com" \
+//		-H "X-Admin-Key: xxx" -H "X-Impersonate-Key-Id: 1a2b3c4d"
+//
+// The key is identified by its fingerprint, see tollgate.KeyFingerprint, and
+// found in the MetaStore, unknown fingerprints are rejected. The request goes
+// through the policy and the limits of the key, its debit is charged to the
+// support key rather than to the key, see tollgate.WithSupportKey, and it's
+// flagged in the audit log, the usage events and the request log of the key.
+package impersonate
+
+import (
+	"errors"
+	"expvar"
+	"log/slog"
+	"net/http"
+	"regexp"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/adminauth"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate/adapter"
+)
+
+// metrics are published on /debug/vars under "impersonation".
+var metrics = expvar.NewMap("impersonation")
+
+// validKeyID matches the fingerprints of tollgate.KeyFingerprint.
+var validKeyID = regexp.MustCompile(`^[0-9a-f]{8}$`)
+
+// Impersonator accepts the tollgate.ImpersonateHeader of the admins.
+type Impersonator struct {
+	adminKey string
+	keys     adapter.MetaStore
+	logger   *slog.Logger
+}
+
+// New creates a new Impersonator for the admins authenticated with adminKey,
+// running the requests as the keys of keys.
+func New(adminKey string, keys adapter.MetaStore, logger *slog.Logger) *Impersonator {
+	return &Impersonator{adminKey: adminKey, keys: keys, logger: logger}
+}
+
+// HTTPHandlerMiddleware runs the requests with the impersonation header as
+// its key. The header and the admin credentials aren't forwarded upstream.
+func (i *Impersonator) HTTPHandlerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keyID := r.Header.Get(tollgate.ImpersonateHeader)
+		if keyID == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !adminauth.Valid(r, i.adminKey) {
+			metrics.Add("rejected", 1)
+			i.logger.Warn("Impersonation without admin credentials", "key_id", keyID, "remote_addr", r.RemoteAddr)
+			http.Error(w, "Invalid admin credentials", http.StatusUnauthorized)
+			return
+		}
+		if !validKeyID.MatchString(keyID) {
+			http.Error(w, "Invalid "+tollgate.ImpersonateHeader, http.StatusBadRequest)
+			return
+		}
+		key, err := adapter.FindKey(r.Context(), i.keys, keyID)
+		switch {
+		case errors.Is(err, adapter.ErrKeyNotFound):
+			metrics.Add("unknown", 1)
+			http.Error(w, "Unknown key", http.StatusNotFound)
+			return
+		case err != nil:
+			i.logger.Error("Failed to find the impersonated key", "key_id", keyID, "error", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		r.Header.Del(tollgate.ImpersonateHeader)
+		r.Header.Del(adminauth.Header)
+		metrics.Add("requests", 1)
+		// the audit log of the support requests
+		i.logger.Info("Impersonated request", "key_id", keyID, "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+		next.ServeHTTP(w, r.WithContext(tollgate.WithImpersonated(r.Context(), keyID, key.APIKey)))
+	})
+}
@@ -0,0 +1,77 @@
+// Package cachetest holds the in-memory cache adapter the cache tests run
+// against, standing in for Redis.
+package cachetest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"maps"
+	"sync"
+	"time"
+)
+
+// MemoryAdapter is an in-memory cache.Adapter, safe for concurrent use. The
+// expirations are ignored.
+type MemoryAdapter struct {
+	mu      sync.RWMutex
+	entries map[uint64][]byte
+}
+
+// NewMemoryAdapter creates an empty MemoryAdapter.
+func NewMemoryAdapter() *MemoryAdapter {
+	return &MemoryAdapter{entries: map[uint64][]byte{}}
+}
+
+// Entries returns a copy of the stored values.
+func (m *MemoryAdapter) Entries() map[uint64][]byte {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return maps.Clone(m.entries)
+}
+
+func (m *MemoryAdapter) Get(ctx context.Context, key uint64) ([]byte, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	b, ok := m.entries[key]
+	return b, ok
+}
+
+func (m *MemoryAdapter) Set(key uint64, response []byte, expiration time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[key] = bytes.Clone(response)
+}
+
+func (m *MemoryAdapter) Release(ctx context.Context, key uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+}
+
+func (m *MemoryAdapter) GetMulti(ctx context.Context, keys []uint64) map[uint64][]byte {
+	found := map[uint64][]byte{}
+	for _, key := range keys {
+		if b, ok := m.Get(ctx, key); ok {
+			found[key] = b
+		}
+	}
+	return found
+}
+
+func (m *MemoryAdapter) Walk(ctx context.Context, fn func(key uint64, value []byte) bool) error {
+	for key, value := range m.Entries() {
+		if !fn(key, value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (m *MemoryAdapter) GetReader(ctx context.Context, key uint64) (io.ReadCloser, bool) {
+	b, ok := m.Get(ctx, key)
+	if !ok {
+		return nil, false
+	}
+	return io.NopCloser(bytes.NewReader(b)), true
+}
@@ -0,0 +1,187 @@
+// Package wasmtest assembles the small WebAssembly modules the wasm and
+// filter tests run.
+package wasmtest
+
+// Value types.
+const (
+	I32 byte = 0x7F
+	I64 byte = 0x7E
+	F32 byte = 0x7D
+	F64 byte = 0x7C
+)
+
+// Func is a function of a module.
+type Func struct {
+	// Export is the name the function is exported as, none when empty.
+	Export          string
+	Params, Results []byte
+	Locals          []byte
+	// Code is the body of the function, without its final end.
+	Code []byte
+}
+
+// Import is a function imported by a module.
+type Import struct {
+	Module, Name    string
+	Params, Results []byte
+}
+
+// Memory is the memory of a module, in pages.
+type Memory struct {
+	Min, Max uint32
+	HasMax   bool
+}
+
+// Module is a module to assemble. The imports come first in the function
+// index space, then Funcs.
+type Module struct {
+	Imports []Import
+	Funcs   []Func
+	Memory  *Memory
+	// Globals is the number of mutable i32 globals, all initialized to 0.
+	Globals int
+}
+
+// Bytes returns the binary module.
+func (m Module) Bytes() []byte {
+	b := []byte("\x00asm\x01\x00\x00\x00")
+
+	var types [][]byte
+	for _, imp := range m.Imports {
+		types = append(types, funcType(imp.Params, imp.Results))
+	}
+	for _, f := range m.Funcs {
+		types = append(types, funcType(f.Params, f.Results))
+	}
+	b = section(b, 1, vec(types))
+
+	if len(m.Imports) > 0 {
+		var imports [][]byte
+		for i, imp := range m.Imports {
+			entry := append(name(imp.Module), name(imp.Name)...)
+			entry = append(entry, 0x00)
+			imports = append(imports, append(entry, ULEB(uint32(i))...))
+		}
+		b = section(b, 2, vec(imports))
+	}
+
+	var funcs [][]byte
+	for i := range m.Funcs {
+		funcs = append(funcs, ULEB(uint32(len(m.Imports)+i)))
+	}
+	b = section(b, 3, vec(funcs))
+
+	if m.Memory != nil {
+		memory := []byte{0x00}
+		if m.Memory.HasMax {
+			memory[0] = 0x01
+		}
+		memory = append(memory, ULEB(m.Memory.Min)...)
+		if m.Memory.HasMax {
+			memory = append(memory, ULEB(m.Memory.Max)...)
+		}
+		b = section(b, 5, vec([][]byte{memory}))
+	}
+
+	if m.Globals > 0 {
+		var globals [][]byte
+		for range m.Globals {
+			globals = append(globals, []byte{I32, 0x01, 0x41, 0x00, 0x0B})
+		}
+		b = section(b, 6, vec(globals))
+	}
+
+	var exports [][]byte
+	for i, f := range m.Funcs {
+		if f.Export != "" {
+			entry := append(name(f.Export), 0x00)
+			exports = append(exports, append(entry, ULEB(uint32(len(m.Imports)+i))...))
+		}
+	}
+	if m.Memory != nil {
+		exports = append(exports, append(name("memory"), 0x02, 0x00))
+	}
+	b = section(b, 7, vec(exports))
+
+	var bodies [][]byte
+	for _, f := range m.Funcs {
+		var locals [][]byte
+		for _, typ := range f.Locals {
+			locals = append(locals, []byte{0x01, typ})
+		}
+		body := append(vec(locals), f.Code...)
+		body = append(body, 0x0B)
+		bodies = append(bodies, append(ULEB(uint32(len(body))), body...))
+	}
+	return section(b, 10, vec(bodies))
+}
+
+func funcType(params, results []byte) []byte {
+	t := append([]byte{0x60}, ULEB(uint32(len(params)))...)
+	t = append(t, params...)
+	t = append(t, ULEB(uint32(len(results)))...)
+	return append(t, results...)
+}
+
+func name(s string) []byte {
+	return append(ULEB(uint32(len(s))), s...)
+}
+
+func vec(items [][]byte) []byte {
+	b := ULEB(uint32(len(items)))
+	for _, item := range items {
+		b = append(b, item...)
+	}
+	return b
+}
+
+func section(b []byte, id byte, payload []byte) []byte {
+	b = append(b, id)
+	b = append(b, ULEB(uint32(len(payload)))...)
+	return append(b, payload...)
+}
+
+// ULEB encodes v as an unsigned LEB128, e.g. the index of a local.
+func ULEB(v uint32) []byte {
+	var b []byte
+	for {
+		c := byte(v & 0x7F)
+		v >>= 7
+		if v == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+// SLEB encodes v as a signed LEB128, the immediate of i32.const and i64.const.
+func SLEB(v int64) []byte {
+	var b []byte
+	for {
+		c := byte(v & 0x7F)
+		v >>= 7
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+// I32Const returns an i32.const instruction.
+func I32Const(v int32) []byte {
+	return append([]byte{0x41}, SLEB(int64(v))...)
+}
+
+// I64Const returns an i64.const instruction.
+func I64Const(v int64) []byte {
+	return append([]byte{0x42}, SLEB(v)...)
+}
+
+// Code concatenates instructions.
+func Code(instructions ...[]byte) []byte {
+	var b []byte
+	for _, ins := range instructions {
+		b = append(b, ins...)
+	}
+	return b
+}
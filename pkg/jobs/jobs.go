@@ -0,0 +1,255 @@
+// Package jobs runs proxy requests asynchronously, so clients aren't held open on slow scrapes.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/proxy"
+)
+
+var (
+	// ErrNotFound is returned when a job does not exist or has expired.
+	ErrNotFound = errors.New("job not found")
+	// ErrQueueFull is returned when no more jobs can be queued.
+	ErrQueueFull = errors.New("job queue is full")
+	// ErrTooManyJobs is returned when a key has too many unfinished jobs.
+	ErrTooManyJobs = errors.New("too many unfinished jobs for this key")
+)
+
+// Status is the lifecycle state of a job.
+type Status string
+
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+	// StatusDead is a job that failed every attempt, it is kept in the dead-letter list.
+	StatusDead Status = "dead"
+)
+
+// Job is a proxy request executed in the background. The request doesn't
+// carry credentials, only KeyID, the fingerprint of the key of the submitter,
+// is kept: the job runs with the internal key, or as the key of KeyID when
+// ChargeKey is set.
+type Job struct {
+	ID    string `json:"id"`
+	KeyID string `json:"key_id"`
+	// ChargeKey is set on the jobs charged to the key of KeyID, found in the
+	// MetaStore when they run
+	ChargeKey   bool                 `json:"charge_key,omitempty"`
+	Status      Status               `json:"status"`
+	Request     proxy.BatchRequest   `json:"request"`
+	CallbackURL string               `json:"callback_url,omitempty"`
+	Result      *proxy.BatchResponse `json:"result,omitempty"`
+	Error       string               `json:"error,omitempty"`
+	Attempts    int                  `json:"attempts"`
+	// NotBefore holds the job back until then, e.g. to space out cache warm-ups
+	NotBefore time.Time `json:"not_before,omitzero"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Public returns a copy of the job without the request headers.
+func (j *Job) Public() *Job {
+	public := *j
+	public.Request.Headers = nil
+	return &public
+}
+
+// Finished reports whether the job reached a final status.
+func (j *Job) Finished() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed || j.Status == StatusDead
+}
+
+// Key returns the fingerprint of the key of the submitter, used for per-key limits.
+func (j *Job) Key() string {
+	return j.KeyID
+}
+
+// newJobID creates a random, unguessable job ID.
+func newJobID() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// Queue stores jobs and hands queued jobs to workers.
+type Queue interface {
+	// Enqueue stores a new job and queues it for execution.
+	// It returns ErrTooManyJobs when the job key has too many unfinished jobs.
+	Enqueue(ctx context.Context, job *Job) error
+	// Dequeue blocks until a job is queued or ctx is done.
+	Dequeue(ctx context.Context) (*Job, error)
+	// Get returns a job by ID, or ErrNotFound.
+	Get(ctx context.Context, id string) (*Job, error)
+	// Update stores the state of a running job.
+	Update(ctx context.Context, job *Job) error
+	// Retry queues the job again once delay has passed.
+	Retry(ctx context.Context, job *Job, delay time.Duration) error
+	// Complete stores a finished job, dead jobs go to the dead-letter list.
+	Complete(ctx context.Context, job *Job) error
+	// Dead lists the IDs of the most recent dead-letter jobs, up to limit.
+	Dead(ctx context.Context, limit int) ([]string, error)
+}
+
+// MemoryQueue is an in-process Queue. Jobs are lost on restart.
+type MemoryQueue struct {
+	mu        sync.Mutex
+	jobs      map[string]*Job
+	active    map[string]int
+	dead      []string
+	pending   chan string
+	retention time.Duration
+	maxPerKey int
+}
+
+// NewMemoryQueue creates a new MemoryQueue holding up to size queued jobs,
+// and up to maxPerKey unfinished jobs per key. Finished jobs are kept for retention.
+func NewMemoryQueue(size int, retention time.Duration, maxPerKey int) *MemoryQueue {
+	return &MemoryQueue{
+		jobs:      map[string]*Job{},
+		active:    map[string]int{},
+		pending:   make(chan string, size),
+		retention: retention,
+		maxPerKey: maxPerKey,
+	}
+}
+
+// Enqueue implements the Queue interface Enqueue method.
+func (q *MemoryQueue) Enqueue(ctx context.Context, job *Job) error {
+	q.mu.Lock()
+	q.prune()
+	if q.maxPerKey > 0 && q.active[job.Key()] >= q.maxPerKey {
+		q.mu.Unlock()
+		return ErrTooManyJobs
+	}
+	copied := *job
+	q.jobs[job.ID] = &copied
+	q.active[job.Key()]++
+	q.mu.Unlock()
+
+	select {
+	case q.pending <- job.ID:
+		return nil
+	default:
+		q.mu.Lock()
+		delete(q.jobs, job.ID)
+		q.release(job.Key())
+		q.mu.Unlock()
+		return ErrQueueFull
+	}
+}
+
+// Dequeue implements the Queue interface Dequeue method.
+func (q *MemoryQueue) Dequeue(ctx context.Context) (*Job, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case id := <-q.pending:
+			if job, err := q.Get(ctx, id); err == nil {
+				return job, nil
+			}
+		}
+	}
+}
+
+// Get implements the Queue interface Get method.
+func (q *MemoryQueue) Get(ctx context.Context, id string) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	copied := *job
+	return &copied, nil
+}
+
+// Update implements the Queue interface Update method.
+func (q *MemoryQueue) Update(ctx context.Context, job *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.jobs[job.ID]; !ok {
+		return ErrNotFound
+	}
+	copied := *job
+	q.jobs[job.ID] = &copied
+	return nil
+}
+
+// Retry implements the Queue interface Retry method.
+func (q *MemoryQueue) Retry(ctx context.Context, job *Job, delay time.Duration) error {
+	if err := q.Update(ctx, job); err != nil {
+		return err
+	}
+	time.AfterFunc(delay, func() {
+		select {
+		case q.pending <- job.ID:
+		default:
+			job.Status = StatusDead
+			job.Error = ErrQueueFull.Error()
+			_ = q.Complete(context.Background(), job)
+		}
+	})
+	return nil
+}
+
+// Complete implements the Queue interface Complete method.
+func (q *MemoryQueue) Complete(ctx context.Context, job *Job) error {
+	if err := q.Update(ctx, job); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.release(job.Key())
+	if job.Status == StatusDead {
+		q.dead = append(q.dead, job.ID)
+	}
+	return nil
+}
+
+// Dead implements the Queue interface Dead method.
+func (q *MemoryQueue) Dead(ctx context.Context, limit int) ([]string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune()
+	var ids []string
+	for i := len(q.dead) - 1; i >= 0 && len(ids) < limit; i-- {
+		ids = append(ids, q.dead[i])
+	}
+	return ids, nil
+}
+
+// release frees an unfinished job slot of a key, the caller holds the lock.
+func (q *MemoryQueue) release(key string) {
+	q.active[key]--
+	if q.active[key] <= 0 {
+		delete(q.active, key)
+	}
+}
+
+// prune drops finished jobs past retention, the caller holds the lock.
+func (q *MemoryQueue) prune() {
+	for id, job := range q.jobs {
+		if job.Finished() && time.Since(job.UpdatedAt) > q.retention {
+			delete(q.jobs, id)
+		}
+	}
+	kept := q.dead[:0]
+	for _, id := range q.dead {
+		if _, ok := q.jobs[id]; ok {
+			kept = append(kept, id)
+		}
+	}
+	q.dead = kept
+}
@@ -0,0 +1,308 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/proxy"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate/adapter"
+)
+
+// Manager accepts jobs over HTTP and executes them with a pool of workers.
+// Jobs go through handler, so they pass the same cache and tollgate chain
+// as direct requests, and their results end up in the cache. The credentials
+// of the submitters aren't stored, Submit must be served behind a tollgate.
+// The jobs of the keys of the MetaStore run as their key, found again by its
+// fingerprint, and are charged and limited as its requests; the others run
+// with the internal key, as the replays of pkg/reqlog do.
+//
+//	curl "https://cachev1.example.com/jobs" \
+//	 -H "Authorization: Bearer xxx" \
+//	 --data '{"method":"GET","path":"/fetch/https://www.example.com","callback_url":"https://hooks.example.com"}'
+type Manager struct {
+	queue       Queue
+	handler     http.Handler
+	notifier    Notifier
+	keys        adapter.MetaStore
+	internalKey string
+	workers     int
+	maxAttempts int
+	backoff     time.Duration
+	logger      *slog.Logger
+}
+
+// Notifier delivers the job callbacks, jobs with a callback are refused without one.
+type Notifier interface {
+	Send(ctx context.Context, url, event string, payload any) (string, error)
+}
+
+// CallbackEvent is the event name of job callbacks.
+const CallbackEvent = "job.finished"
+
+// NewManager creates a new Manager running the jobs as the keys of keys, nil
+// without a MetaStore, or with internalKey. Jobs failing with 429 or 5xx are
+// retried with exponential backoff until maxAttempts, then moved to the
+// dead-letter list.
+func NewManager(queue Queue, handler http.Handler, notifier Notifier, keys adapter.MetaStore, internalKey string, workers, maxAttempts int, logger *slog.Logger) *Manager {
+	return &Manager{
+		queue:       queue,
+		handler:     handler,
+		notifier:    notifier,
+		keys:        keys,
+		internalKey: internalKey,
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		backoff:     5 * time.Second,
+		logger:      logger,
+	}
+}
+
+// submitRequest is the body of POST /jobs.
+type submitRequest struct {
+	proxy.BatchRequest
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+// Start launches the workers, they stop when ctx is done.
+func (m *Manager) Start(ctx context.Context) {
+	for i := 0; i < m.workers; i++ {
+		go m.work(ctx)
+	}
+}
+
+func (m *Manager) work(ctx context.Context) {
+	for {
+		job, err := m.queue.Dequeue(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			m.logger.Error("Failed to dequeue job", "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		m.process(ctx, job)
+	}
+}
+
+func (m *Manager) process(ctx context.Context, job *Job) {
+	if wait := time.Until(job.NotBefore); wait > 0 {
+		// not due yet, it doesn't count as an attempt
+		if err := m.queue.Retry(ctx, job, wait); err != nil {
+			m.logger.Error("Failed to hold job back", "id", job.ID, "error", err)
+		}
+		return
+	}
+	job.Status = StatusRunning
+	job.Attempts++
+	job.UpdatedAt = time.Now()
+	if err := m.queue.Update(ctx, job); err != nil {
+		m.logger.Error("Failed to update job", "id", job.ID, "error", err)
+	}
+
+	result := m.run(ctx, job)
+	job.Result = &result
+	job.Error = ""
+	job.UpdatedAt = time.Now()
+	retryable := result.Status == http.StatusTooManyRequests || result.Status >= 500
+	switch {
+	case result.Status < 400:
+		job.Status = StatusSucceeded
+	case retryable && job.Attempts < m.maxAttempts:
+		delay := m.backoff << (job.Attempts - 1)
+		job.Status = StatusQueued
+		job.Error = fmt.Sprintf("upstream answered %d, retrying in %s", result.Status, delay)
+		if err := m.queue.Retry(ctx, job, delay); err != nil {
+			m.logger.Error("Failed to retry job", "id", job.ID, "error", err)
+		}
+		m.logger.Info("Job retrying", "id", job.ID, "attempts", job.Attempts, "delay", delay)
+		return
+	case retryable:
+		job.Status = StatusDead
+		job.Error = fmt.Sprintf("upstream answered %d after %d attempts", result.Status, job.Attempts)
+	default:
+		job.Status = StatusFailed
+		job.Error = fmt.Sprintf("upstream answered %d", result.Status)
+	}
+	if err := m.queue.Complete(ctx, job); err != nil {
+		m.logger.Error("Failed to complete job", "id", job.ID, "error", err)
+	}
+	m.logger.Info("Job finished", "id", job.ID, "path", job.Request.Path, "status", job.Status)
+
+	if job.CallbackURL != "" {
+		m.notify(ctx, job)
+	}
+}
+
+// run serves the request of job, as the key of the submitter when it's charged.
+func (m *Manager) run(ctx context.Context, job *Job) proxy.BatchResponse {
+	if !job.ChargeKey {
+		return proxy.Do(ctx, m.handler, WithInternalKey(job.Request, m.internalKey), "")
+	}
+	if m.keys == nil {
+		return proxy.BatchResponse{Status: http.StatusUnauthorized, Body: "Job keys need a MetaStore"}
+	}
+	key, err := adapter.FindKey(ctx, m.keys, job.KeyID)
+	switch {
+	case errors.Is(err, adapter.ErrKeyNotFound):
+		return proxy.BatchResponse{Status: http.StatusUnauthorized, Body: "The key of the job no longer exists"}
+	case err != nil:
+		m.logger.Error("Failed to find the key of a job", "id", job.ID, "key_id", job.KeyID, "error", err)
+		return proxy.BatchResponse{Status: http.StatusServiceUnavailable, Body: "Failed to find the key of the job"}
+	}
+	return proxy.Do(tollgate.WithBackground(ctx, key.APIKey), m.handler, job.Request, "")
+}
+
+// WithInternalKey returns a copy of req authenticated with key, in the
+// headers of every provider.
+func WithInternalKey(req proxy.BatchRequest, key string) proxy.BatchRequest {
+	headers := make(map[string]string, len(req.Headers)+2)
+	for k, v := range req.Headers {
+		headers[k] = v
+	}
+	headers["Authorization"] = "Bearer " + key
+	headers["X-API-KEY"] = key
+	req.Headers = headers
+	return req
+}
+
+// notify sends the finished job to its callback URL.
+func (m *Manager) notify(ctx context.Context, job *Job) {
+	id, err := m.notifier.Send(ctx, job.CallbackURL, CallbackEvent, job.Public())
+	if err != nil {
+		m.logger.Warn("Failed to send job callback", "id", job.ID, "url", job.CallbackURL, "error", err)
+		return
+	}
+	m.logger.Debug("Job callback queued", "id", job.ID, "delivery_id", id)
+}
+
+// Submit handles POST /jobs, it answers 202 with the queued job.
+func (m *Manager) Submit(w http.ResponseWriter, r *http.Request) {
+	var body submitRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid job: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(body.Path, "/") || strings.HasPrefix(body.Path, "/jobs") || strings.HasPrefix(body.Path, "/batch") {
+		http.Error(w, fmt.Sprintf("Invalid job path %q", body.Path), http.StatusBadRequest)
+		return
+	}
+	if body.CallbackURL != "" && m.notifier == nil {
+		http.Error(w, "Job callbacks are disabled", http.StatusBadRequest)
+		return
+	}
+	credential := requestCredential(r)
+	if credential == "" {
+		http.Error(w, "Missing API key", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := newJobID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// credentials aren't stored, the job runs with the internal key
+	headers := map[string]string{}
+	for k, v := range body.Headers {
+		headers[http.CanonicalHeaderKey(k)] = v
+	}
+	delete(headers, "Authorization")
+	delete(headers, "X-Api-Key")
+	delete(headers, "Api-Key")
+	body.Headers = headers
+
+	now := time.Now()
+	job := &Job{
+		ID:    id,
+		KeyID: tollgate.KeyFingerprint(credential),
+		// the tollgate of Submit let the key through, it's charged when the job runs
+		ChargeKey:   credential != m.internalKey,
+		Status:      StatusQueued,
+		Request:     body.BatchRequest,
+		CallbackURL: body.CallbackURL,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := m.queue.Enqueue(r.Context(), job); err != nil {
+		m.logger.Warn("Failed to enqueue job", "error", err)
+		statusCode := http.StatusServiceUnavailable
+		if errors.Is(err, ErrTooManyJobs) {
+			statusCode = http.StatusTooManyRequests
+		}
+		http.Error(w, err.Error(), statusCode)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job.Public())
+}
+
+// Get handles GET /jobs/{id}, only the submitter may poll a job.
+func (m *Manager) Get(w http.ResponseWriter, r *http.Request) {
+	job, err := m.queue.Get(r.Context(), r.PathValue("id"))
+	if errors.Is(err, ErrNotFound) || (err == nil && job.Key() != tollgate.KeyFingerprint(requestCredential(r))) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, job.Public())
+}
+
+// Dead handles GET /admin/jobs/dead, it lists the most recent dead-letter
+// jobs, up to the limit query parameter, 100 by default.
+func (m *Manager) Dead(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 10000 {
+			http.Error(w, "Invalid limit, expected 1 to 10000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	ids, err := m.queue.Dead(r.Context(), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dead := []*Job{}
+	for _, id := range ids {
+		job, err := m.queue.Get(r.Context(), id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		dead = append(dead, job.Public())
+	}
+	writeJSON(w, http.StatusOK, dead)
+}
+
+// requestCredential returns the API key a request carries.
+func requestCredential(r *http.Request) string {
+	if key := r.Header.Get("X-API-KEY"); key != "" {
+		return key
+	}
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		// response was already committed, nothing left to do
+		_ = err
+	}
+}
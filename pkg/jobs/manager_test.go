@@ -0,0 +1,114 @@
+package jobs
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/proxy"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate/adapter"
+)
+
+// chargedKeys records the keys reserved from.
+type chargedKeys struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+func (c *chargedKeys) Reserve(ctx context.Context, key string, amount int) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys = append(c.keys, key)
+	return true, nil
+}
+
+func (c *chargedKeys) Refund(ctx context.Context, key string, amount int) (bool, error) {
+	return true, nil
+}
+
+func TestJobsAreChargedToTheirKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	err := os.WriteFile(path, []byte(`
+keys:
+  - key: sk-office
+    status: assigned
+    allowed_cidrs:
+      - 203.0.113.0/24
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := adapter.NewFileMetaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	charged := &chargedKeys{}
+	restrictions := adapter.KeyRestrictions(store)
+	gate := tollgate.New(charged, func(r *http.Request) string {
+		return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}, tollgate.WithRestrictions(func(ctx context.Context, key string) (tollgate.Restrictions, error) {
+		if key == "sk-internal" {
+			return tollgate.Restrictions{}, nil
+		}
+		return restrictions(ctx, key)
+	}))
+	handler := gate.HTTPHandlerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	queue := NewMemoryQueue(10, time.Hour, 0)
+	m := NewManager(queue, handler, nil, store, "sk-internal", 1, 1, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	run := func(credential string) *Job {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(`{"path":"/fetch/example.com"}`))
+		req.Header.Set("Authorization", "Bearer "+credential)
+		rec := httptest.NewRecorder()
+		m.Submit(rec, req)
+		if rec.Code != http.StatusAccepted {
+			t.Fatalf("Submit answered %d: %s", rec.Code, rec.Body)
+		}
+		job, err := queue.Dequeue(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.process(context.Background(), job)
+		job, err = queue.Get(context.Background(), job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return job
+	}
+
+	// the job runs as the key, away from the network the key is restricted to
+	if job := run("sk-office"); job.Status != StatusSucceeded || !job.ChargeKey {
+		t.Errorf("job of sk-office %s: %+v", job.Status, job.Result)
+	}
+	if job := run("sk-internal"); job.Status != StatusSucceeded || job.ChargeKey {
+		t.Errorf("job of the internal key %s: %+v", job.Status, job.Result)
+	}
+	if want := []string{"sk-office", "sk-internal"}; strings.Join(charged.keys, ",") != strings.Join(want, ",") {
+		t.Errorf("charged %q, want %q", charged.keys, want)
+	}
+
+	// a key deleted before its job ran isn't replaced by the internal key
+	job := &Job{ID: "deleted", KeyID: tollgate.KeyFingerprint("sk-deleted"), ChargeKey: true, Request: proxy.BatchRequest{Path: "/fetch/example.com"}}
+	if err := queue.Enqueue(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+	m.process(context.Background(), job)
+	if job.Status != StatusFailed || job.Result.Status != http.StatusUnauthorized {
+		t.Errorf("job of a deleted key %s: %+v", job.Status, job.Result)
+	}
+	if len(charged.keys) != 2 {
+		t.Errorf("the job of a deleted key was charged to %q", charged.keys[2:])
+	}
+}
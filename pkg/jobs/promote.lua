@@ -0,0 +1,12 @@
+-- All keys must be explicitly provided for Redis clustering compatibility
+local delayedKey = KEYS[1] -- Pre-constructed "jobs:delayed" sorted set, scored by ready time
+local pendingKey = KEYS[2] -- Pre-constructed "jobs:pending" list
+local now = tonumber(ARGV[1])
+
+-- Move the jobs whose backoff has passed back to the pending list
+local ids = redis.call('ZRANGEBYSCORE', delayedKey, '-inf', now, 'LIMIT', 0, 100)
+for _, id in ipairs(ids) do
+	redis.call('ZREM', delayedKey, id)
+	redis.call('LPUSH', pendingKey, id)
+end
+return #ids
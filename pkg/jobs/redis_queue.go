@@ -0,0 +1,239 @@
+package jobs
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+//go:embed promote.lua
+var promoteScript string
+
+// PromoteScript is the Redis script moving delayed jobs back to the pending list
+var PromoteScript = redis.NewScript(promoteScript)
+
+const (
+	pendingKey    = "jobs:pending"
+	processingKey = "jobs:processing"
+	delayedKey    = "jobs:delayed"
+	deadKey       = "jobs:dead"
+)
+
+// RedisQueue is a durable Queue backed by Redis, so queued jobs survive restarts
+// and are shared by every replica. Jobs held by a replica that died are queued
+// again once they've been running for longer than the visibility timeout.
+type RedisQueue struct {
+	redis      redis.Cmdable
+	retention  time.Duration
+	maxPerKey  int
+	visibility time.Duration
+	logger     *slog.Logger
+
+	mu        sync.Mutex
+	recovered time.Time
+}
+
+// NewRedisQueue creates a new RedisQueue allowing up to maxPerKey unfinished jobs
+// per key. Finished jobs are kept for retention.
+func NewRedisQueue(rdb redis.Cmdable, retention time.Duration, maxPerKey int, logger *slog.Logger) *RedisQueue {
+	return &RedisQueue{
+		redis:      rdb,
+		retention:  retention,
+		maxPerKey:  maxPerKey,
+		visibility: 10 * time.Minute,
+		logger:     logger,
+	}
+}
+
+func jobKey(id string) string {
+	return fmt.Sprintf("job:%s", id)
+}
+
+// activeKey is the sorted set of the unfinished jobs of a key, scored by the
+// time they expire, so the jobs lost or expired unfinished don't hold a slot.
+func activeKey(key string) string {
+	return fmt.Sprintf("jobs:active:%s", key)
+}
+
+// unfinishedTTL is how long an unfinished job is kept on top of retention, it
+// may wait for retries.
+const unfinishedTTL = 24 * time.Hour
+
+func (q *RedisQueue) save(ctx context.Context, pipe redis.Pipeliner, job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("json.Marshal(job): %w", err)
+	}
+	// unfinished jobs outlive retention, they may wait for retries
+	ttl := q.retention
+	if !job.Finished() {
+		ttl += unfinishedTTL
+	}
+	pipe.Set(ctx, jobKey(job.ID), data, ttl)
+	return nil
+}
+
+// Enqueue implements the Queue interface Enqueue method.
+func (q *RedisQueue) Enqueue(ctx context.Context, job *Job) error {
+	active := activeKey(job.Key())
+	now := time.Now()
+	expires := now.Add(q.retention + unfinishedTTL)
+	pipe := q.redis.TxPipeline()
+	pipe.ZRemRangeByScore(ctx, active, "-inf", strconv.FormatInt(now.Unix(), 10))
+	pipe.ZAdd(ctx, active, redis.Z{Score: float64(expires.Unix()), Member: job.ID})
+	count := pipe.ZCard(ctx, active)
+	pipe.ExpireAt(ctx, active, expires)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("pipe.Exec: %w", err)
+	}
+	if q.maxPerKey > 0 && count.Val() > int64(q.maxPerKey) {
+		q.redis.ZRem(ctx, active, job.ID)
+		return ErrTooManyJobs
+	}
+
+	pipe = q.redis.TxPipeline()
+	if err := q.save(ctx, pipe, job); err != nil {
+		q.redis.ZRem(ctx, active, job.ID)
+		return err
+	}
+	pipe.LPush(ctx, pendingKey, job.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		q.redis.ZRem(ctx, active, job.ID)
+		return fmt.Errorf("pipe.Exec: %w", err)
+	}
+	return nil
+}
+
+// Dequeue implements the Queue interface Dequeue method.
+func (q *RedisQueue) Dequeue(ctx context.Context) (*Job, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := PromoteScript.Run(ctx, q.redis, []string{delayedKey, pendingKey}, strconv.FormatInt(time.Now().Unix(), 10)).Err(); err != nil {
+			return nil, fmt.Errorf("PromoteScript.Run: %w", err)
+		}
+		q.maybeRecover(ctx)
+
+		// block briefly, so delayed jobs and ctx are checked regularly
+		id, err := q.redis.BLMove(ctx, pendingKey, processingKey, "RIGHT", "LEFT", time.Second).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("redis.BLMove: %w", err)
+		}
+		job, err := q.Get(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			// expired while queued, drop it
+			q.redis.LRem(ctx, processingKey, 1, id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return job, nil
+	}
+}
+
+// Get implements the Queue interface Get method.
+func (q *RedisQueue) Get(ctx context.Context, id string) (*Job, error) {
+	data, err := q.redis.Get(ctx, jobKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis.Get: %w", err)
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return &job, nil
+}
+
+// Update implements the Queue interface Update method.
+func (q *RedisQueue) Update(ctx context.Context, job *Job) error {
+	pipe := q.redis.Pipeline()
+	if err := q.save(ctx, pipe, job); err != nil {
+		return err
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Retry implements the Queue interface Retry method.
+func (q *RedisQueue) Retry(ctx context.Context, job *Job, delay time.Duration) error {
+	pipe := q.redis.TxPipeline()
+	if err := q.save(ctx, pipe, job); err != nil {
+		return err
+	}
+	pipe.LRem(ctx, processingKey, 1, job.ID)
+	pipe.ZAdd(ctx, delayedKey, redis.Z{Score: float64(time.Now().Add(delay).Unix()), Member: job.ID})
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Complete implements the Queue interface Complete method. The slot of the
+// key is freed even when the job can't be saved.
+func (q *RedisQueue) Complete(ctx context.Context, job *Job) error {
+	defer q.redis.ZRem(context.WithoutCancel(ctx), activeKey(job.Key()), job.ID)
+	pipe := q.redis.TxPipeline()
+	if err := q.save(ctx, pipe, job); err != nil {
+		return err
+	}
+	pipe.LRem(ctx, processingKey, 1, job.ID)
+	if job.Status == StatusDead {
+		pipe.LPush(ctx, deadKey, job.ID)
+		pipe.LTrim(ctx, deadKey, 0, 9999)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Dead implements the Queue interface Dead method.
+func (q *RedisQueue) Dead(ctx context.Context, limit int) ([]string, error) {
+	return q.redis.LRange(ctx, deadKey, 0, int64(limit)-1).Result()
+}
+
+// maybeRecover queues again the jobs running for longer than the visibility
+// timeout, their replica most likely died. It runs at most once a minute.
+func (q *RedisQueue) maybeRecover(ctx context.Context) {
+	q.mu.Lock()
+	if time.Since(q.recovered) < time.Minute {
+		q.mu.Unlock()
+		return
+	}
+	q.recovered = time.Now()
+	q.mu.Unlock()
+
+	ids, err := q.redis.LRange(ctx, processingKey, 0, -1).Result()
+	if err != nil {
+		q.logger.Warn("Failed to list processing jobs", "error", err)
+		return
+	}
+	for _, id := range ids {
+		job, err := q.Get(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			q.redis.LRem(ctx, processingKey, 1, id)
+			continue
+		}
+		if err != nil || time.Since(job.UpdatedAt) < q.visibility {
+			continue
+		}
+		// only the replica removing it from processing requeues it
+		if removed, err := q.redis.LRem(ctx, processingKey, 1, id).Result(); err != nil || removed == 0 {
+			continue
+		}
+		q.redis.LPush(ctx, pendingKey, id)
+		q.logger.Warn("Requeued stale job", "id", id, "updated_at", job.UpdatedAt)
+	}
+}
@@ -0,0 +1,238 @@
+package jobs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/cache"
+	"github.com/Airren/poorman-httpcache/v2/pkg/proxy"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+)
+
+// maxSitemapSize caps a sitemap or URL list, uploaded or fetched, as the
+// sitemaps protocol caps sitemap files.
+const maxSitemapSize = 50 << 20
+
+// maxSitemapDepth is how deep sitemap indexes are expanded.
+const maxSitemapDepth = 2
+
+// Warmer expands sitemaps and URL lists into warm-up jobs, so the pages are
+// in the cache before clients ask for them. URLs already cached are skipped,
+// and the jobs of a host are spaced out by hostInterval on top of the host
+// caps of the routes.
+//
+//	curl "https://cachev1.example.com/admin/cache/warm?route=fetch" \
+//	 -H "X-Admin-Key: xxx" \
+//	 --data-binary @sitemap.xml
+type Warmer struct {
+	queue        Queue
+	cache        *cache.Cache
+	handler      http.Handler
+	internalKey  string
+	maxURLs      int
+	hostInterval time.Duration
+	logger       *slog.Logger
+}
+
+// NewWarmer creates a new Warmer queueing up to maxURLs jobs per call on
+// queue. The jobs, and the fetches of nested sitemaps, go through handler
+// authenticated with the internal key.
+func NewWarmer(queue Queue, cache *cache.Cache, handler http.Handler, internalKey string, maxURLs int, hostInterval time.Duration, logger *slog.Logger) *Warmer {
+	return &Warmer{
+		queue:        queue,
+		cache:        cache,
+		handler:      handler,
+		internalKey:  internalKey,
+		maxURLs:      maxURLs,
+		hostInterval: hostInterval,
+		logger:       logger,
+	}
+}
+
+// WarmReport is the answer of POST /admin/cache/warm.
+type WarmReport struct {
+	// URLs is the number of distinct URLs found
+	URLs int `json:"urls"`
+	// Cached is the number of URLs skipped, they are in the cache already
+	Cached int `json:"cached"`
+	Queued int `json:"queued"`
+	// Skipped is the number of URLs not queued, past the cap or the queue capacity
+	Skipped int `json:"skipped"`
+	// Invalid lists the entries that aren't http or https URLs
+	Invalid []string `json:"invalid,omitempty"`
+	// Sitemaps lists the nested sitemaps that couldn't be read
+	Sitemaps []string `json:"failed_sitemaps,omitempty"`
+}
+
+// ServeHTTP handles POST /admin/cache/warm. The body is a sitemap, a
+// sitemap index, gzipped or not, or a list of URLs, one per line. The route
+// query parameter picks the provider reading the pages, "fetch" by default.
+func (wm *Warmer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := r.URL.Query().Get("route")
+	switch route {
+	case "":
+		route = "fetch"
+	case "fetch", "jina":
+	default:
+		http.Error(w, fmt.Sprintf("Unknown route %q, expected fetch or jina", route), http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSitemapSize+1))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxSitemapSize {
+		http.Error(w, "Sitemap too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var report WarmReport
+	var urls []string
+	seen := map[string]bool{}
+	if err := wm.expand(r.Context(), body, 0, &report, func(u string) {
+		if !seen[u] {
+			seen[u] = true
+			urls = append(urls, u)
+		}
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report.URLs = len(urls)
+	wm.schedule(r.Context(), "/"+route, urls, &report)
+	wm.logger.Info("Cache warm-up queued", "route", route, "urls", report.URLs, "cached", report.Cached, "queued", report.Queued, "skipped", report.Skipped)
+	writeJSON(w, http.StatusAccepted, report)
+}
+
+// expand adds the URLs of a sitemap, a sitemap index or a URL list.
+func (wm *Warmer) expand(ctx context.Context, body []byte, depth int, report *WarmReport, add func(string)) error {
+	if bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("gzip.NewReader: %w", err)
+		}
+		if body, err = io.ReadAll(io.LimitReader(zr, maxSitemapSize)); err != nil {
+			return fmt.Errorf("gunzip: %w", err)
+		}
+	}
+	trimmed := bytes.TrimSpace(body)
+	if !bytes.HasPrefix(trimmed, []byte("<")) {
+		scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			wm.addURL(line, report, add)
+		}
+		return scanner.Err()
+	}
+
+	var doc struct {
+		XMLName  xml.Name
+		URLs     []string `xml:"url>loc"`
+		Sitemaps []string `xml:"sitemap>loc"`
+	}
+	if err := xml.Unmarshal(trimmed, &doc); err != nil {
+		return fmt.Errorf("invalid sitemap: %w", err)
+	}
+	for _, loc := range doc.URLs {
+		wm.addURL(strings.TrimSpace(loc), report, add)
+	}
+	for _, loc := range doc.Sitemaps {
+		loc = strings.TrimSpace(loc)
+		if depth >= maxSitemapDepth {
+			report.Sitemaps = append(report.Sitemaps, loc)
+			continue
+		}
+		nested, err := wm.fetchSitemap(ctx, loc)
+		if err == nil {
+			err = wm.expand(ctx, nested, depth+1, report, add)
+		}
+		if err != nil {
+			wm.logger.Warn("Failed to read nested sitemap", "url", loc, "error", err)
+			report.Sitemaps = append(report.Sitemaps, loc)
+		}
+	}
+	return nil
+}
+
+func (wm *Warmer) addURL(raw string, report *WarmReport, add func(string)) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		report.Invalid = append(report.Invalid, raw)
+		return
+	}
+	u.Fragment = ""
+	add(u.String())
+}
+
+// fetchSitemap reads a nested sitemap through the fetch route, so robots.txt
+// and the host caps apply to it too.
+func (wm *Warmer) fetchSitemap(ctx context.Context, loc string) ([]byte, error) {
+	target, err := url.Parse(loc)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, fmt.Errorf("invalid sitemap URL %q", loc)
+	}
+	sitemap := proxy.BatchRequest{Method: http.MethodGet, Path: proxy.FetchPath("/fetch", target).String()}
+	result := proxy.Do(ctx, wm.handler, WithInternalKey(sitemap, wm.internalKey), "")
+	if result.Status != http.StatusOK {
+		return nil, fmt.Errorf("fetch answered %d", result.Status)
+	}
+	if len(result.Body) > maxSitemapSize {
+		return nil, errors.New("sitemap too large")
+	}
+	return []byte(result.Body), nil
+}
+
+// schedule queues the jobs warming the URLs not cached yet under prefix.
+func (wm *Warmer) schedule(ctx context.Context, prefix string, urls []string, report *WarmReport) {
+	now := time.Now()
+	perHost := map[string]int{}
+	for i, raw := range urls {
+		target, _ := url.Parse(raw)
+		path := proxy.FetchPath(prefix, target).String()
+		if r, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil); err == nil && wm.cache.Contains(ctx, r) {
+			report.Cached++
+			continue
+		}
+		if wm.maxURLs > 0 && report.Queued >= wm.maxURLs {
+			report.Skipped = len(urls) - i
+			break
+		}
+		id, err := newJobID()
+		if err != nil {
+			report.Skipped++
+			continue
+		}
+		host := strings.ToLower(target.Host)
+		job := &Job{
+			ID:        id,
+			KeyID:     tollgate.KeyFingerprint(wm.internalKey),
+			Status:    StatusQueued,
+			Request:   proxy.BatchRequest{Method: http.MethodGet, Path: path},
+			NotBefore: now.Add(time.Duration(perHost[host]) * wm.hostInterval),
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		if err := wm.queue.Enqueue(ctx, job); err != nil {
+			wm.logger.Warn("Failed to queue warm-up job", "url", raw, "error", err)
+			report.Skipped = len(urls) - i
+			break
+		}
+		perHost[host]++
+		report.Queued++
+	}
+}
@@ -0,0 +1,229 @@
+// Package jsonschema validates JSON documents against the subset of JSON
+// Schema the provider answers need: type, properties, required, items, enum,
+// minItems, maxItems, minLength, minimum and maximum. The other keywords are
+// ignored.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Schema is a compiled schema.
+type Schema struct {
+	Type       types              `json:"type"`
+	Properties map[string]*Schema `json:"properties"`
+	Required   []string           `json:"required"`
+	Items      *Schema            `json:"items"`
+	Enum       []any              `json:"enum"`
+	MinItems   *int               `json:"minItems"`
+	MaxItems   *int               `json:"maxItems"`
+	MinLength  *int               `json:"minLength"`
+	Minimum    *float64           `json:"minimum"`
+	Maximum    *float64           `json:"maximum"`
+}
+
+// types is the type keyword, a name or a list of names.
+type types []string
+
+func (t *types) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err == nil {
+		*t = types{name}
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(b, &names); err != nil {
+		return fmt.Errorf("type is a name or a list of names")
+	}
+	*t = names
+	return nil
+}
+
+var typeNames = []string{"null", "boolean", "object", "array", "number", "integer", "string"}
+
+// Parse compiles a schema.
+func Parse(b []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	if err := s.check("#"); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Load compiles the schema of a file.
+func Load(path string) (*Schema, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+	s, err := Parse(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// check rejects the unknown types, which would fail every document.
+func (s *Schema) check(path string) error {
+	for _, t := range s.Type {
+		if !slices.Contains(typeNames, t) {
+			return fmt.Errorf("%s: unknown type %q", path, t)
+		}
+	}
+	for name, property := range s.Properties {
+		if err := property.check(path + "/properties/" + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.check(path + "/items")
+	}
+	return nil
+}
+
+// Validate returns the problems of a document, as JSON pointers with what's
+// wrong, none when it's valid. A document that isn't JSON, e.g. a truncated
+// one, has a single problem.
+func (s *Schema) Validate(document []byte) []string {
+	dec := json.NewDecoder(bytes.NewReader(document))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return []string{fmt.Sprintf("invalid JSON: %v", err)}
+	}
+	if dec.More() {
+		return []string{"invalid JSON: trailing data"}
+	}
+	var problems []string
+	s.validate("", v, &problems)
+	return problems
+}
+
+// maxProblems bounds the problems reported of a document.
+const maxProblems = 10
+
+func (s *Schema) validate(path string, v any, problems *[]string) {
+	if len(*problems) >= maxProblems {
+		return
+	}
+	report := func(format string, args ...any) {
+		*problems = append(*problems, fmt.Sprintf("%s: %s", pointer(path), fmt.Sprintf(format, args...)))
+	}
+	if len(s.Type) > 0 && !slices.ContainsFunc(s.Type, func(t string) bool { return hasType(v, t) }) {
+		report("is %s, not %s", typeOf(v), strings.Join(s.Type, " or "))
+		return
+	}
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(e any) bool { return equal(e, v) }) {
+		report("is not one of the enum values")
+	}
+	switch v := v.(type) {
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				report("misses required property %q", name)
+			}
+		}
+		for name, property := range s.Properties {
+			if value, ok := v[name]; ok {
+				property.validate(path+"/"+escape(name), value, problems)
+			}
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			report("has %d items, fewer than %d", len(v), *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			report("has %d items, more than %d", len(v), *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(path+"/"+strconv.Itoa(i), item, problems)
+			}
+		}
+	case string:
+		if s.MinLength != nil && len([]rune(v)) < *s.MinLength {
+			report("is shorter than %d", *s.MinLength)
+		}
+	case json.Number:
+		f, _ := v.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			report("is less than %v", *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			report("is more than %v", *s.Maximum)
+		}
+	}
+}
+
+// pointer returns path for the reports, "/" for the document itself.
+func pointer(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// escape escapes a property name in a JSON pointer.
+func escape(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
+
+func hasType(v any, t string) bool {
+	switch t {
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return false
+		}
+		f, err := n.Float64()
+		return err == nil && f == math.Trunc(f)
+	case "number":
+		_, ok := v.(json.Number)
+		return ok
+	default:
+		return typeOf(v) == t
+	}
+}
+
+func typeOf(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case json.Number:
+		return "number"
+	default:
+		return "string"
+	}
+}
+
+// equal compares an enum value, decoded without UseNumber, with a value.
+func equal(e, v any) bool {
+	if n, ok := v.(json.Number); ok {
+		f, err := n.Float64()
+		ef, isNumber := e.(float64)
+		return err == nil && isNumber && f == ef
+	}
+	switch e.(type) {
+	case map[string]any, []any:
+		eb, _ := json.Marshal(e)
+		vb, _ := json.Marshal(v)
+		return bytes.Equal(eb, vb)
+	}
+	return e == v
+}
@@ -0,0 +1,123 @@
+package jsonschema
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		schema   string
+		document string
+		problems []string
+	}{
+		// type
+		{"type", `{"type":"string"}`, `"a"`, nil},
+		{"wrong type", `{"type":"string"}`, `1`, []string{"/: is number, not string"}},
+		{"type list", `{"type":["string","null"]}`, `null`, nil},
+		{"wrong type list", `{"type":["string","null"]}`, `true`, []string{"/: is boolean, not string or null"}},
+		{"integer", `{"type":"integer"}`, `3.0`, nil},
+		{"not an integer", `{"type":"integer"}`, `3.5`, []string{"/: is number, not integer"}},
+		{"number", `{"type":"number"}`, `3.5`, nil},
+		{"object", `{"type":"object"}`, `[]`, []string{"/: is array, not object"}},
+		{"no type", `{}`, `{"anything":[1,"a"]}`, nil},
+
+		// required and properties
+		{"required", `{"type":"object","required":["title","url"]}`, `{"title":"a","url":"b"}`, nil},
+		{"missing required", `{"type":"object","required":["title","url"]}`, `{"url":"b"}`, []string{`/: misses required property "title"`}},
+		{"required null", `{"required":["title"]}`, `{"title":null}`, nil},
+		{"properties", `{"properties":{"title":{"type":"string"}}}`, `{"title":"a","other":1}`, nil},
+		{"wrong property", `{"properties":{"title":{"type":"string"}}}`, `{"title":1}`, []string{"/title: is number, not string"}},
+		{"absent property", `{"properties":{"title":{"type":"string"}}}`, `{}`, nil},
+		{"nested property", `{"properties":{"a":{"properties":{"b":{"type":"string"}}}}}`, `{"a":{"b":false}}`, []string{"/a/b: is boolean, not string"}},
+		{"escaped property", `{"properties":{"a/b~c":{"type":"string"}}}`, `{"a/b~c":1}`, []string{"/a~1b~0c: is number, not string"}},
+
+		// enum
+		{"enum", `{"enum":["a","b"]}`, `"b"`, nil},
+		{"not in enum", `{"enum":["a","b"]}`, `"c"`, []string{"/: is not one of the enum values"}},
+		{"numeric enum", `{"enum":[1,2]}`, `2.0`, nil},
+		{"numeric enum of a string", `{"enum":[1,2]}`, `"1"`, []string{"/: is not one of the enum values"}},
+		{"object enum", `{"enum":[{"a":1}]}`, `{"a":1}`, nil},
+		{"null enum", `{"enum":[null]}`, `null`, nil},
+
+		// minimum and maximum
+		{"in range", `{"minimum":1,"maximum":5}`, `5`, nil},
+		{"less than minimum", `{"minimum":1}`, `0.5`, []string{"/: is less than 1"}},
+		{"more than maximum", `{"maximum":5}`, `6`, []string{"/: is more than 5"}},
+		{"minimum of a string", `{"minimum":1}`, `"0"`, nil},
+		{"min length", `{"minLength":2}`, `"éé"`, nil},
+		{"shorter than min length", `{"minLength":2}`, `"é"`, []string{"/: is shorter than 2"}},
+
+		// items
+		{"items", `{"type":"array","items":{"type":"string"}}`, `["a","b"]`, nil},
+		{"wrong items", `{"type":"array","items":{"type":"string"}}`, `["a",1,true]`, []string{"/1: is number, not string", "/2: is boolean, not string"}},
+		{"min items", `{"minItems":2}`, `[1]`, []string{"/: has 1 items, fewer than 2"}},
+		{"max items", `{"maxItems":1}`, `[1,2]`, []string{"/: has 2 items, more than 1"}},
+		{"items of objects", `{"items":{"required":["url"]}}`, `[{"url":"a"},{}]`, []string{`/1: misses required property "url"`}},
+
+		// documents
+		{"invalid JSON", `{}`, `{"a":`, []string{"invalid JSON: unexpected EOF"}},
+		{"trailing data", `{}`, `{} {}`, []string{"invalid JSON: trailing data"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Parse([]byte(tt.schema))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Validate([]byte(tt.document)); !slices.Equal(got, tt.problems) {
+				t.Errorf("Validate(%s) = %q, want %q", tt.document, got, tt.problems)
+			}
+		})
+	}
+}
+
+func TestValidateCapsTheProblems(t *testing.T) {
+	s, err := Parse([]byte(`{"items":{"type":"string"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Validate([]byte("[" + strings.Repeat("1,", 20) + "1]")); len(got) != maxProblems {
+		t.Errorf("%d problems, want %d", len(got), maxProblems)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, schema := range []string{
+		``,
+		`[]`,
+		`{"type":"str"}`,
+		`{"type":["string","date"]}`,
+		`{"type":1}`,
+		`{"properties":{"a":{"type":"nope"}}}`,
+		`{"items":{"type":"nope"}}`,
+		`{"minItems":"1"}`,
+		`{"required":"a"}`,
+	} {
+		if _, err := Parse([]byte(schema)); err == nil {
+			t.Errorf("Parse(%s) succeeded, want an error", schema)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	for name, schema := range map[string]string{"good.json": `{"type":"object"}`, "bad.json": `{"type":"nope"}`} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(schema), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := Load(filepath.Join(dir, "good.json")); err != nil {
+		t.Error(err)
+	}
+	_, err := Load(filepath.Join(dir, "bad.json"))
+	if err == nil || !strings.Contains(err.Error(), "bad.json") {
+		t.Errorf("Load of an invalid schema: %v, want an error naming the file", err)
+	}
+	if _, err := Load(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("Load of a missing file succeeded")
+	}
+}
@@ -0,0 +1,167 @@
+// Package leader elects one replica to run the singleton background jobs,
+// e.g. retention and usage export, with a Redis lock.
+//
+// The leader renews the lock every third of its TTL. When it dies or can't
+// reach Redis, the lock expires and another replica takes over within a TTL.
+// A leader that fails to renew cancels its jobs before the lock can expire.
+package leader
+
+import (
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+//go:embed renew.lua
+var renewScript string
+
+//go:embed release.lua
+var releaseScript string
+
+// RenewScript extends the lock when it's still held by the caller
+var RenewScript = redis.NewScript(renewScript)
+
+// ReleaseScript deletes the lock when it's still held by the caller
+var ReleaseScript = redis.NewScript(releaseScript)
+
+var metrics = expvar.NewMap("leader")
+
+// Job is a singleton job, it blocks until ctx is done. ctx is cancelled
+// when the replica loses the leadership.
+type Job func(ctx context.Context)
+
+// Elector campaigns for the lock and runs the registered jobs while leading.
+type Elector struct {
+	redis  redis.Cmdable
+	key    string
+	id     string
+	ttl    time.Duration
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	jobs    map[string]Job
+	leading atomic.Bool
+}
+
+// New creates a new Elector for the lock name, e.g. "cachev1". ttl must be
+// positive, the lock is renewed every third of it.
+func New(rdb redis.Cmdable, name string, ttl time.Duration, logger *slog.Logger) (*Elector, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("leader.New: TTL must be positive, got %s", ttl)
+	}
+	b := make([]byte, 8)
+	_, _ = rand.Read(b) // never fails
+	return &Elector{
+		redis:  rdb,
+		key:    fmt.Sprintf("leader:%s", name),
+		id:     hex.EncodeToString(b),
+		ttl:    ttl,
+		logger: logger,
+		jobs:   map[string]Job{},
+	}, nil
+}
+
+// Register adds a job, run by the leader only. Jobs are registered before Start.
+func (e *Elector) Register(name string, job Job) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.jobs[name] = job
+}
+
+// IsLeader reports whether this replica currently leads.
+func (e *Elector) IsLeader() bool {
+	return e.leading.Load()
+}
+
+// Start campaigns in the background until ctx is done, the lock is
+// released on the way out so another replica takes over at once.
+func (e *Elector) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(e.ttl / 3)
+		defer ticker.Stop()
+		var cancel context.CancelFunc
+		for {
+			if e.campaign(ctx) {
+				if cancel == nil {
+					var jobsCtx context.Context
+					jobsCtx, cancel = context.WithCancel(ctx)
+					e.lead(jobsCtx)
+				}
+			} else if cancel != nil {
+				cancel()
+				cancel = nil
+				e.logger.Warn("Lost leadership", "key", e.key, "id", e.id)
+			}
+			select {
+			case <-ctx.Done():
+				if cancel != nil {
+					cancel()
+					e.release()
+				}
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// campaign acquires or renews the lock, and reports whether this replica holds it.
+func (e *Elector) campaign(ctx context.Context) bool {
+	var held bool
+	if e.leading.Load() {
+		renewed, err := RenewScript.Run(ctx, e.redis, []string{e.key}, e.id, e.ttl.Milliseconds()).Int()
+		if err != nil {
+			e.logger.Warn("Failed to renew leadership", "key", e.key, "error", err)
+		}
+		held = err == nil && renewed == 1
+	} else {
+		acquired, err := e.redis.SetNX(ctx, e.key, e.id, e.ttl).Result()
+		if err != nil {
+			e.logger.Warn("Failed to campaign for leadership", "key", e.key, "error", err)
+		}
+		held = err == nil && acquired
+	}
+	if held != e.leading.Load() {
+		metrics.Add("transitions", 1)
+	}
+	e.leading.Store(held)
+	return held
+}
+
+func (e *Elector) lead(ctx context.Context) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.logger.Info("Elected leader", "key", e.key, "id", e.id, "jobs", len(e.jobs))
+	for name, job := range e.jobs {
+		go func() {
+			defer func() {
+				if err := recover(); err != nil {
+					e.logger.Error("Leader job panicked", "job", name, "error", err)
+				}
+			}()
+			job(ctx)
+			if ctx.Err() == nil {
+				e.logger.Warn("Leader job returned before losing the leadership", "job", name)
+			}
+		}()
+	}
+}
+
+func (e *Elector) release() {
+	e.leading.Store(false)
+	// the campaign context is done, give the release its own deadline
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := ReleaseScript.Run(ctx, e.redis, []string{e.key}, e.id).Err(); err != nil {
+		e.logger.Warn("Failed to release leadership", "key", e.key, "error", err)
+	}
+}
@@ -0,0 +1,7 @@
+-- KEYS[1]: lock key
+-- ARGV[1]: holder id
+-- ARGV[2]: ttl in milliseconds
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+    return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
@@ -0,0 +1,172 @@
+// Package parquet writes small Parquet files: one row group of required,
+// flat columns, plain encoded and uncompressed. That's enough for analytics
+// exports to be read by DuckDB, Spark or Athena, without a dependency.
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Parquet physical types, encodings and converted types.
+const (
+	typeInt64     = 2
+	typeByteArray = 6
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	convertedUTF8            = 0
+	convertedTimestampMillis = 9
+
+	repetitionRequired = 0
+	pageData           = 0
+	codecUncompressed  = 0
+)
+
+var magic = []byte("PAR1")
+
+// Column is a named column of values, set either Int64 or String.
+type Column struct {
+	Name string
+	// Int64 values, annotated as timestamps in milliseconds when Timestamp is set.
+	Int64     []int64
+	Timestamp bool
+	// String values, stored as UTF-8 byte arrays.
+	String []string
+}
+
+func (col Column) len() int {
+	if col.String != nil {
+		return len(col.String)
+	}
+	return len(col.Int64)
+}
+
+// Encode returns the Parquet file of columns, which all hold as many values.
+func Encode(columns []Column) ([]byte, error) {
+	if len(columns) == 0 {
+		return nil, errors.New("no columns")
+	}
+	rows := columns[0].len()
+	for _, col := range columns {
+		if col.len() != rows {
+			return nil, fmt.Errorf("column %q has %d values, want %d", col.Name, col.len(), rows)
+		}
+	}
+
+	var file bytes.Buffer
+	file.Write(magic)
+	type chunk struct {
+		offset int64
+		size   int64
+	}
+	chunks := make([]chunk, len(columns))
+	for i, col := range columns {
+		values := plain(col)
+		var page compact
+		page.beginStruct()
+		page.i32(1, pageData)
+		page.i32(2, int32(len(values)))
+		page.i32(3, int32(len(values)))
+		page.structField(5)
+		page.i32(1, int32(rows))
+		page.i32(2, encodingPlain)
+		page.i32(3, encodingRLE)
+		page.i32(4, encodingRLE)
+		page.endStruct()
+		page.endStruct()
+
+		chunks[i] = chunk{offset: int64(file.Len()), size: int64(page.buf.Len() + len(values))}
+		file.Write(page.buf.Bytes())
+		file.Write(values)
+	}
+
+	var meta compact
+	meta.beginStruct()
+	meta.i32(1, 1)
+	meta.listHeader(2, ctStruct, len(columns)+1)
+	meta.beginStruct()
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(columns)))
+	meta.endStruct()
+	for _, col := range columns {
+		meta.beginStruct()
+		meta.i32(1, physicalType(col))
+		meta.i32(3, repetitionRequired)
+		meta.binary(4, col.Name)
+		switch {
+		case col.String != nil:
+			meta.i32(6, convertedUTF8)
+		case col.Timestamp:
+			meta.i32(6, convertedTimestampMillis)
+		}
+		meta.endStruct()
+	}
+	meta.i64(3, int64(rows))
+	meta.listHeader(4, ctStruct, 1)
+	meta.beginStruct()
+	meta.listHeader(1, ctStruct, len(columns))
+	var total int64
+	for i, col := range columns {
+		total += chunks[i].size
+		meta.beginStruct()
+		meta.i64(2, chunks[i].offset)
+		meta.structField(3)
+		meta.i32(1, physicalType(col))
+		meta.listHeader(2, ctI32, 2)
+		meta.varint(zigzag(encodingPlain))
+		meta.varint(zigzag(encodingRLE))
+		meta.listHeader(3, ctBinary, 1)
+		meta.varint(uint64(len(col.Name)))
+		meta.buf.WriteString(col.Name)
+		meta.i32(4, codecUncompressed)
+		meta.i64(5, int64(rows))
+		meta.i64(6, chunks[i].size)
+		meta.i64(7, chunks[i].size)
+		meta.i64(9, chunks[i].offset)
+		meta.endStruct()
+		meta.endStruct()
+	}
+	meta.i64(2, total)
+	meta.i64(3, int64(rows))
+	meta.endStruct()
+	meta.binary(6, "poorman-httpcache")
+	meta.endStruct()
+
+	file.Write(meta.buf.Bytes())
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(meta.buf.Len()))
+	file.Write(size[:])
+	file.Write(magic)
+	return file.Bytes(), nil
+}
+
+func physicalType(col Column) int32 {
+	if col.String != nil {
+		return typeByteArray
+	}
+	return typeInt64
+}
+
+// plain encodes the values of a required column, there are no levels to write.
+func plain(col Column) []byte {
+	var b bytes.Buffer
+	if col.String != nil {
+		var n [4]byte
+		for _, s := range col.String {
+			binary.LittleEndian.PutUint32(n[:], uint32(len(s)))
+			b.Write(n[:])
+			b.WriteString(s)
+		}
+		return b.Bytes()
+	}
+	var v [8]byte
+	for _, i := range col.Int64 {
+		binary.LittleEndian.PutUint64(v[:], uint64(i))
+		b.Write(v[:])
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,258 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func usageColumns() []Column {
+	return []Column{
+		{Name: "api_key_id", Int64: []int64{1, 2, 42}},
+		{Name: "minute", Int64: []int64{1767225600000, 1767225660000, 1767225720000}, Timestamp: true},
+		{Name: "consumption_amount", Int64: []int64{10, -3, 1 << 40}},
+		{Name: "service", String: []string{"jina", "", "fetch"}},
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	many := make([]Column, 20)
+	for i := range many {
+		many[i] = Column{Name: fmt.Sprintf("c%d", i), Int64: []int64{int64(i)}}
+	}
+	for _, columns := range [][]Column{
+		usageColumns(),
+		{{Name: "empty", String: []string{}}},
+		// more than 14 columns take the long list header
+		many,
+	} {
+		file, err := Encode(columns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta := readFooter(t, file)
+
+		if meta.field(1).(int64) != 1 {
+			t.Errorf("version %v, want 1", meta.field(1))
+		}
+		rows := int64(len(columns[0].Int64) + len(columns[0].String))
+		if meta.field(3).(int64) != rows {
+			t.Errorf("num_rows %v, want %d", meta.field(3), rows)
+		}
+		schema := meta.field(2).([]any)
+		if len(schema) != len(columns)+1 {
+			t.Fatalf("%d schema elements, want %d", len(schema), len(columns)+1)
+		}
+		if root := schema[0].(tstruct); string(root.field(4).([]byte)) != "schema" || root.field(5).(int64) != int64(len(columns)) {
+			t.Errorf("schema root %v", root)
+		}
+		groups := meta.field(4).([]any)
+		if len(groups) != 1 {
+			t.Fatalf("%d row groups, want 1", len(groups))
+		}
+		group := groups[0].(tstruct)
+		if group.field(3).(int64) != rows {
+			t.Errorf("row group num_rows %v, want %d", group.field(3), rows)
+		}
+		chunks := group.field(1).([]any)
+		var total int64
+		for i, col := range columns {
+			element := schema[i+1].(tstruct)
+			if string(element.field(4).([]byte)) != col.Name || element.field(1).(int64) != int64(physicalType(col)) || element.field(3).(int64) != repetitionRequired {
+				t.Errorf("schema element %d %v", i, element)
+			}
+			var converted any
+			switch {
+			case col.String != nil:
+				converted = int64(convertedUTF8)
+			case col.Timestamp:
+				converted = int64(convertedTimestampMillis)
+			}
+			if element.field(6) != converted {
+				t.Errorf("column %s converted type %v, want %v", col.Name, element.field(6), converted)
+			}
+
+			chunk := chunks[i].(tstruct)
+			md := chunk.field(3).(tstruct)
+			if path := md.field(3).([]any); len(path) != 1 || string(path[0].([]byte)) != col.Name {
+				t.Errorf("column %s path %q", col.Name, path)
+			}
+			if md.field(5).(int64) != rows || md.field(4).(int64) != codecUncompressed {
+				t.Errorf("column %s metadata %v", col.Name, md)
+			}
+			offset := md.field(9).(int64)
+			if chunk.field(2).(int64) != offset {
+				t.Errorf("column %s file_offset %v, want the data page %d", col.Name, chunk.field(2), offset)
+			}
+			total += md.field(7).(int64)
+
+			r := &treader{b: file[offset:]}
+			page := r.readStruct(t)
+			header := page.field(5).(tstruct)
+			if page.field(1).(int64) != pageData || header.field(1).(int64) != rows || header.field(2).(int64) != encodingPlain {
+				t.Errorf("column %s page header %v", col.Name, page)
+			}
+			size := page.field(3).(int64)
+			if int64(r.off)+size != md.field(7).(int64) {
+				t.Errorf("column %s chunk of %v bytes, want the page header and %d values bytes", col.Name, md.field(7), size)
+			}
+			if got := decodePlain(t, col, file[offset+int64(r.off):offset+int64(r.off)+size]); !reflect.DeepEqual(got, col) {
+				t.Errorf("column %s decoded %+v, want %+v", col.Name, got, col)
+			}
+		}
+		if group.field(2).(int64) != total {
+			t.Errorf("row group total_byte_size %v, want %d", group.field(2), total)
+		}
+	}
+}
+
+// testdata/usage.parquet pins the bytes Encode writes. A change to them is
+// checked with a real reader before the file is replaced, e.g.
+//
+//	duckdb -c "select * from 'pkg/parquet/testdata/usage.parquet'"
+func TestEncodeGolden(t *testing.T) {
+	want, err := os.ReadFile("testdata/usage.parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Encode(usageColumns())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Encode wrote %d bytes unlike testdata/usage.parquet (%d bytes)", len(got), len(want))
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	if _, err := Encode(nil); err == nil {
+		t.Error("Encode of no columns succeeded")
+	}
+	if _, err := Encode([]Column{{Name: "a", Int64: []int64{1}}, {Name: "b", Int64: []int64{1, 2}}}); err == nil {
+		t.Error("Encode of uneven columns succeeded")
+	}
+}
+
+// readFooter checks the magic around file and decodes its FileMetaData.
+func readFooter(t *testing.T, file []byte) tstruct {
+	t.Helper()
+	if len(file) < 12 || !bytes.Equal(file[:4], magic) || !bytes.Equal(file[len(file)-4:], magic) {
+		t.Fatalf("no PAR1 magic around %q", file)
+	}
+	size := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	start := len(file) - 8 - size
+	if start < 4 {
+		t.Fatalf("footer of %d bytes in a file of %d", size, len(file))
+	}
+	r := &treader{b: file[start : len(file)-8]}
+	meta := r.readStruct(t)
+	if r.off != size {
+		t.Fatalf("FileMetaData ends at %d, the footer length is %d", r.off, size)
+	}
+	return meta
+}
+
+func decodePlain(t *testing.T, col Column, b []byte) Column {
+	t.Helper()
+	got := Column{Name: col.Name, Timestamp: col.Timestamp}
+	if col.String != nil {
+		got.String = []string{}
+		for len(b) > 0 {
+			n := binary.LittleEndian.Uint32(b)
+			got.String = append(got.String, string(b[4:4+n]))
+			b = b[4+n:]
+		}
+		return got
+	}
+	for ; len(b) >= 8; b = b[8:] {
+		got.Int64 = append(got.Int64, int64(binary.LittleEndian.Uint64(b)))
+	}
+	if len(b) != 0 {
+		t.Errorf("column %s has %d trailing bytes", col.Name, len(b))
+	}
+	return got
+}
+
+// tstruct is a decoded Thrift struct: integers as int64, binaries as []byte,
+// lists as []any and structs as tstruct, by field id.
+type tstruct map[int16]any
+
+func (s tstruct) field(id int16) any { return s[id] }
+
+// treader reads the Thrift compact protocol written by compact.
+type treader struct {
+	b   []byte
+	off int
+}
+
+func (r *treader) byte(t *testing.T) byte {
+	t.Helper()
+	if r.off >= len(r.b) {
+		t.Fatalf("short read at %d", r.off)
+	}
+	r.off++
+	return r.b[r.off-1]
+}
+
+func (r *treader) varint(t *testing.T) uint64 {
+	t.Helper()
+	v, n := binary.Uvarint(r.b[r.off:])
+	if n <= 0 {
+		t.Fatalf("bad varint at %d", r.off)
+	}
+	r.off += n
+	return v
+}
+
+func (r *treader) readStruct(t *testing.T) tstruct {
+	t.Helper()
+	s := tstruct{}
+	var last int16
+	for {
+		b := r.byte(t)
+		if b == 0 {
+			return s
+		}
+		id, typ := last+int16(b>>4), b&0x0f
+		if b>>4 == 0 {
+			v := r.varint(t)
+			id = int16(int64(v>>1) ^ -int64(v&1))
+		}
+		s[id] = r.value(t, typ)
+		last = id
+	}
+}
+
+func (r *treader) value(t *testing.T, typ byte) any {
+	t.Helper()
+	switch typ {
+	case ctI32, ctI64:
+		v := r.varint(t)
+		return int64(v>>1) ^ -int64(v&1)
+	case ctBinary:
+		n := int(r.varint(t))
+		if r.off+n > len(r.b) {
+			t.Fatalf("binary of %d bytes at %d", n, r.off)
+		}
+		r.off += n
+		return r.b[r.off-n : r.off]
+	case ctList:
+		b := r.byte(t)
+		n, elem := int(b>>4), b&0x0f
+		if n == 15 {
+			n = int(r.varint(t))
+		}
+		list := make([]any, n)
+		for i := range list {
+			list[i] = r.value(t, elem)
+		}
+		return list
+	case ctStruct:
+		return r.readStruct(t)
+	}
+	t.Fatalf("unexpected type %d at %d", typ, r.off)
+	return nil
+}
@@ -0,0 +1,90 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Thrift compact protocol types.
+const (
+	ctI32    = 5
+	ctI64    = 6
+	ctBinary = 8
+	ctList   = 9
+	ctStruct = 12
+)
+
+// compact writes the subset of the Thrift compact protocol the file
+// metadata needs.
+type compact struct {
+	buf  bytes.Buffer
+	last []int16
+}
+
+func (c *compact) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	c.buf.Write(b[:n])
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func (c *compact) fieldHeader(id int16, typ byte) {
+	last := int16(0)
+	if len(c.last) > 0 {
+		last = c.last[len(c.last)-1]
+	}
+	if delta := id - last; delta > 0 && delta <= 15 {
+		c.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		c.buf.WriteByte(typ)
+		c.varint(zigzag(int64(id)))
+	}
+	if len(c.last) > 0 {
+		c.last[len(c.last)-1] = id
+	}
+}
+
+func (c *compact) beginStruct() {
+	c.last = append(c.last, 0)
+}
+
+func (c *compact) endStruct() {
+	c.buf.WriteByte(0) // stop field
+	c.last = c.last[:len(c.last)-1]
+}
+
+func (c *compact) i32(id int16, v int32) {
+	c.fieldHeader(id, ctI32)
+	c.varint(zigzag(int64(v)))
+}
+
+func (c *compact) i64(id int16, v int64) {
+	c.fieldHeader(id, ctI64)
+	c.varint(zigzag(v))
+}
+
+func (c *compact) binary(id int16, v string) {
+	c.fieldHeader(id, ctBinary)
+	c.varint(uint64(len(v)))
+	c.buf.WriteString(v)
+}
+
+// listHeader starts a list field of size elements of typ.
+func (c *compact) listHeader(id int16, typ byte, size int) {
+	c.fieldHeader(id, ctList)
+	if size < 15 {
+		c.buf.WriteByte(byte(size)<<4 | typ)
+	} else {
+		c.buf.WriteByte(0xf0 | typ)
+		c.varint(uint64(size))
+	}
+}
+
+// structField starts a struct field, end it with endStruct.
+func (c *compact) structField(id int16) {
+	c.fieldHeader(id, ctStruct)
+	c.beginStruct()
+}
@@ -0,0 +1,190 @@
+// Package plugin lets downstream builds compile custom behavior into cachev1
+// without forking it. A plugin implements one or more of the extension
+// interfaces and registers itself from an init function:
+//
+//	package acme
+//
+//	func init() {
+//		plugin.Register(tenantHeader{})
+//	}
+//
+//	type tenantHeader struct{}
+//
+//	func (tenantHeader) Name() string { return "acme-tenant" }
+//
+//	func (tenantHeader) Rewrite(provider string) func(*httputil.ProxyRequest) {
+//		if provider != "jina" {
+//			return nil
+//		}
+//		return func(req *httputil.ProxyRequest) {
+//			req.Out.Header.Set("X-Tenant", "acme")
+//		}
+//	}
+//
+// and is compiled in with a blank import in a file added to cmd/cachev1,
+// e.g. plugins_acme.go:
+//
+//	package main
+//
+//	import _ "example.com/acme/cachev1plugin"
+//
+// Every provider (jina, serper, fetch, azure, vertex) asks the registry for
+// its extensions when it's built; a plugin returns nil for the providers it
+// doesn't extend.
+package plugin
+
+import (
+	"fmt"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+)
+
+// Plugin is implemented by every plugin.
+type Plugin interface {
+	// Name identifies the plugin in the logs, it must be unique.
+	Name() string
+}
+
+// RewritePlugin rewrites the outbound requests of providers, after the
+// provider's own rewrites.
+type RewritePlugin interface {
+	Plugin
+	Rewrite(provider string) func(*httputil.ProxyRequest)
+}
+
+// KeyFuncPlugin extracts the quota key of the requests of providers, e.g.
+// from a custom header. The first plugin with a key function wins.
+type KeyFuncPlugin interface {
+	Plugin
+	KeyFunc(provider string) func(r *http.Request) string
+}
+
+// CostPlugin sets the amount of quota the requests of providers reserve.
+// The first plugin with a cost function wins.
+type CostPlugin interface {
+	Plugin
+	Cost(provider string) func(r *http.Request) int
+}
+
+// AdapterPlugin wraps or replaces the quota adapter of providers, e.g. to
+// check quotas against an external billing system. Adapters are chained in
+// registration order.
+type AdapterPlugin interface {
+	Plugin
+	Adapter(provider string, next tollgate.Adapter) tollgate.Adapter
+}
+
+// Registry holds the registered plugins.
+type Registry struct {
+	mu      sync.RWMutex
+	plugins []Plugin
+}
+
+// NewRegistry creates a new empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Default is the registry of the plugins compiled in.
+var Default = NewRegistry()
+
+// Register adds a plugin to the Default registry. It panics on an invalid or
+// duplicate plugin, like database/sql.Register.
+func Register(p Plugin) {
+	if err := Default.Register(p); err != nil {
+		panic(err)
+	}
+}
+
+// Register adds a plugin to the registry.
+func (r *Registry) Register(p Plugin) error {
+	switch p.(type) {
+	case RewritePlugin, KeyFuncPlugin, CostPlugin, AdapterPlugin:
+	default:
+		return fmt.Errorf("plugin %q implements no extension interface", p.Name())
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, registered := range r.plugins {
+		if registered.Name() == p.Name() {
+			return fmt.Errorf("plugin %q registered twice", p.Name())
+		}
+	}
+	r.plugins = append(r.plugins, p)
+	return nil
+}
+
+// Names returns the names of the registered plugins.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, len(r.plugins))
+	for i, p := range r.plugins {
+		names[i] = p.Name()
+	}
+	return names
+}
+
+func (r *Registry) snapshot() []Plugin {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Plugin(nil), r.plugins...)
+}
+
+// Rewrite returns the rewrites of the plugins extending provider as a single
+// rewrite, a no-op without any.
+func (r *Registry) Rewrite(provider string) func(*httputil.ProxyRequest) {
+	var rewrites []func(*httputil.ProxyRequest)
+	for _, p := range r.snapshot() {
+		if rp, ok := p.(RewritePlugin); ok {
+			if rewrite := rp.Rewrite(provider); rewrite != nil {
+				rewrites = append(rewrites, rewrite)
+			}
+		}
+	}
+	return func(req *httputil.ProxyRequest) {
+		for _, rewrite := range rewrites {
+			rewrite(req)
+		}
+	}
+}
+
+// KeyFunc returns the key function of the first plugin extending provider,
+// or fallback.
+func (r *Registry) KeyFunc(provider string, fallback func(r *http.Request) string) func(r *http.Request) string {
+	for _, p := range r.snapshot() {
+		if kp, ok := p.(KeyFuncPlugin); ok {
+			if keyFunc := kp.KeyFunc(provider); keyFunc != nil {
+				return keyFunc
+			}
+		}
+	}
+	return fallback
+}
+
+// Adapter chains the adapters of the plugins extending provider around next.
+func (r *Registry) Adapter(provider string, next tollgate.Adapter) tollgate.Adapter {
+	for _, p := range r.snapshot() {
+		if ap, ok := p.(AdapterPlugin); ok {
+			if adapter := ap.Adapter(provider, next); adapter != nil {
+				next = adapter
+			}
+		}
+	}
+	return next
+}
+
+// TollgateOptions returns the tollgate options of the plugins extending
+// provider, to be passed after the provider's own options.
+func (r *Registry) TollgateOptions(provider string) []tollgate.Option {
+	for _, p := range r.snapshot() {
+		if cp, ok := p.(CostPlugin); ok {
+			if cost := cp.Cost(provider); cost != nil {
+				return []tollgate.Option{tollgate.WithCost(cost)}
+			}
+		}
+	}
+	return nil
+}
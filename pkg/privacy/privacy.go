@@ -0,0 +1,95 @@
+// Package privacy keeps raw request bodies out of everything the service
+// persists, for deployments that must not store prompts. It's enabled once at
+// startup, then cache keys, page groups and request logs only see salted
+// hashes of bodies, and body attributes are dropped from the logs. The
+// semantic matcher, which keeps the search queries, is off, and the jobs and
+// their callbacks, which carry bodies, stay in memory.
+package privacy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"sync/atomic"
+)
+
+var salt atomic.Pointer[[]byte]
+
+// Enable turns privacy mode on, bodies are hashed with HMAC-SHA256 keyed by salt.
+func Enable(s string) {
+	b := []byte(s)
+	salt.Store(&b)
+}
+
+// Enabled reports whether privacy mode is on.
+func Enabled() bool {
+	return salt.Load() != nil
+}
+
+// Sum returns the salted hash of a body.
+func Sum(body []byte) []byte {
+	s := salt.Load()
+	if s == nil {
+		return nil
+	}
+	mac := hmac.New(sha256.New, *s)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Hash returns the salted hash of a body, hex encoded.
+func Hash(body []byte) string {
+	return hex.EncodeToString(Sum(body))
+}
+
+// bodyAttrs are the log attributes that may hold a body.
+var bodyAttrs = map[string]bool{
+	"body":          true,
+	"dump":          true,
+	"request_body":  true,
+	"response_body": true,
+}
+
+// Handler drops the attributes holding bodies from the records of next
+// while privacy mode is on.
+func Handler(next slog.Handler) slog.Handler {
+	return &handler{next: next}
+}
+
+type handler struct {
+	next slog.Handler
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *handler) Handle(ctx context.Context, record slog.Record) error {
+	if !Enabled() {
+		return h.next.Handle(ctx, record)
+	}
+	clean := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(a slog.Attr) bool {
+		if !bodyAttrs[a.Key] {
+			clean.AddAttrs(a)
+		}
+		return true
+	})
+	return h.next.Handle(ctx, clean)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	kept := make([]slog.Attr, 0, len(attrs))
+	for _, a := range attrs {
+		if !Enabled() || !bodyAttrs[a.Key] {
+			kept = append(kept, a)
+		}
+	}
+	return &handler{next: h.next.WithAttrs(kept)}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{next: h.next.WithGroup(name)}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// RewriteAzureOpenAIPath rewrites OpenAI style requests to the deployment of
+// their model on an Azure OpenAI resource. deployments maps models to
+// deployment names, models without one are deployed under their own name.
+//
+//	curl "https://cachev1.example.com/azure/chat/completions" \
+//	 -H "api-key: xxx" \
+//	 -d '{"model":"gpt-4o","messages":[{"role":"user","content":"Hello"}]}'
+//
+// is sent to
+//
+//	https://{resource}.openai.azure.com/openai/deployments/{deployment}/chat/completions?api-version={version}
+func RewriteAzureOpenAIPath(target *url.URL, apiVersion string, deployments map[string]string) func(*httputil.ProxyRequest) {
+	return func(req *httputil.ProxyRequest) {
+		req.SetURL(target)
+		path := strings.TrimPrefix(strings.TrimPrefix(req.In.URL.Path, "/azure"), "/v1")
+		if model := requestModel(req); model != "" && !strings.HasPrefix(path, "/openai/") {
+			deployment := model
+			if name, ok := deployments[model]; ok {
+				deployment = name
+			}
+			path = "/openai/deployments/" + url.PathEscape(deployment) + path
+		}
+		req.Out.URL.Path = strings.TrimSuffix(target.Path, "/") + path
+		req.Out.URL.RawPath = ""
+		query := req.Out.URL.Query()
+		if apiVersion != "" && query.Get("api-version") == "" {
+			query.Set("api-version", apiVersion)
+			req.Out.URL.RawQuery = query.Encode()
+		}
+	}
+}
+
+// requestModel reads the model of a JSON request body, the body is restored.
+func requestModel(req *httputil.ProxyRequest) string {
+	if req.Out.Body == nil {
+		return ""
+	}
+	body, err := io.ReadAll(req.Out.Body)
+	req.Out.Body.Close()
+	req.Out.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	var payload struct {
+		Model string `json:"model"`
+	}
+	if json.Unmarshal(body, &payload) != nil {
+		return ""
+	}
+	return payload.Model
+}
+
+// PoolAzureKey sets the api-key header to a key of the pool. The client's
+// credentials are dropped, they're our keys, not the upstream's.
+func PoolAzureKey(pool *KeyPool) func(*httputil.ProxyRequest) {
+	return func(req *httputil.ProxyRequest) {
+		req.Out.Header.Del("Authorization")
+		req.Out.Header.Set("api-key", pool.Pick())
+	}
+}
+
+// ParseDeployments parses model to deployment names such as "gpt-4o=prod-gpt4o,gpt-4o-mini=mini".
+func ParseDeployments(s string) map[string]string {
+	deployments := map[string]string{}
+	for _, part := range strings.Split(s, ",") {
+		model, deployment, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok {
+			deployments[strings.TrimSpace(model)] = strings.TrimSpace(deployment)
+		}
+	}
+	return deployments
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// BatchRequest is a single proxy sub-request of a batch.
+type BatchRequest struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// BatchResponse is the answer to a single sub-request, in the order of the batch.
+type BatchResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body"`
+}
+
+// Batch fans out an array of sub-requests to the routes of handler concurrently,
+// so every sub-request goes through the same cache and tollgate chain.
+//
+//	curl "https://cachev1.example.com/batch" \
+//	 -H "Authorization: Bearer xxx" \
+//	 --data '[{"method":"GET","path":"/jina/https://www.example.com"}]'
+type Batch struct {
+	prefix      string
+	handler     http.Handler
+	prefetch    Prefetch
+	concurrency int
+	maxRequests int
+	logger      *slog.Logger
+}
+
+// Prefetch looks up ahead what the sub-requests of a batch need, e.g. their
+// cache entries in one round trip, and returns the context to serve them with.
+type Prefetch func(ctx context.Context, reqs []*http.Request) context.Context
+
+// maxBatchBody caps the body of a batch, sub-requests and their bodies included.
+const maxBatchBody = 16 << 20
+
+// NewBatch creates a new Batch handler mounted at prefix (e.g. "/batch").
+// prefetch may be nil.
+func NewBatch(prefix string, handler http.Handler, prefetch Prefetch, concurrency, maxRequests int, logger *slog.Logger) (*Batch, error) {
+	if concurrency < 1 {
+		return nil, fmt.Errorf("batch concurrency must be at least 1, got %d", concurrency)
+	}
+	if maxRequests < 1 {
+		return nil, fmt.Errorf("batch max requests must be at least 1, got %d", maxRequests)
+	}
+	return &Batch{
+		prefix:      prefix,
+		handler:     handler,
+		prefetch:    prefetch,
+		concurrency: concurrency,
+		maxRequests: maxRequests,
+		logger:      logger,
+	}, nil
+}
+
+func (b *Batch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var subs []BatchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBody)).Decode(&subs); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Batch larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Invalid batch: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(subs) == 0 || len(subs) > b.maxRequests {
+		http.Error(w, fmt.Sprintf("Batch must hold 1 to %d requests", b.maxRequests), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]BatchResponse, len(subs))
+	reqs := make([]*http.Request, len(subs))
+	var valid []*http.Request
+	for i, sub := range subs {
+		req, err := b.newRequest(r, sub)
+		if err != nil {
+			results[i] = BatchResponse{Status: http.StatusBadRequest, Body: err.Error()}
+			continue
+		}
+		reqs[i] = req
+		valid = append(valid, req)
+	}
+	ctx := r.Context()
+	if b.prefetch != nil && len(valid) > 1 {
+		ctx = b.prefetch(ctx, valid)
+	}
+
+	g := errgroup.Group{}
+	g.SetLimit(b.concurrency)
+	for i, req := range reqs {
+		if req == nil {
+			continue
+		}
+		g.Go(func() error {
+			defer func() {
+				if err := recover(); err != nil {
+					b.logger.Error("Batch sub-request panicked", "path", req.URL.Path, "error", err)
+					results[i] = BatchResponse{Status: http.StatusInternalServerError, Body: "internal error"}
+				}
+			}()
+			results[i] = serve(b.handler, req.WithContext(ctx))
+			return nil
+		})
+	}
+	_ = g.Wait() // sub-requests report their own errors
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		b.logger.Warn("Failed to write batch response", "error", err)
+	}
+}
+
+func (b *Batch) newRequest(outer *http.Request, sub BatchRequest) (*http.Request, error) {
+	if strings.HasPrefix(sub.Path, b.prefix) {
+		return nil, fmt.Errorf("invalid path %q", sub.Path)
+	}
+	// sub-requests inherit the credentials of the batch unless they carry their own
+	headers := map[string]string{}
+	for _, name := range []string{"Authorization", "X-API-KEY"} {
+		if v := outer.Header.Get(name); v != "" {
+			headers[name] = v
+		}
+	}
+	for k, v := range sub.Headers {
+		headers[k] = v
+	}
+	sub.Headers = headers
+	return newSubRequest(outer.Context(), sub, outer.RemoteAddr)
+}
+
+// Do serves a sub-request through handler and buffers its answer.
+func Do(ctx context.Context, handler http.Handler, sub BatchRequest, remoteAddr string) BatchResponse {
+	req, err := newSubRequest(ctx, sub, remoteAddr)
+	if err != nil {
+		return BatchResponse{Status: http.StatusBadRequest, Body: err.Error()}
+	}
+	return serve(handler, req)
+}
+
+func newSubRequest(ctx context.Context, sub BatchRequest, remoteAddr string) (*http.Request, error) {
+	if !strings.HasPrefix(sub.Path, "/") {
+		return nil, fmt.Errorf("invalid path %q", sub.Path)
+	}
+	method := sub.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, method, sub.Path, bytes.NewReader([]byte(sub.Body)))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range sub.Headers {
+		req.Header.Set(k, v)
+	}
+	req.RemoteAddr = remoteAddr
+	return req, nil
+}
+
+// serve serves a sub-request through handler and buffers its answer.
+func serve(handler http.Handler, req *http.Request) BatchResponse {
+	rec := newBufferedWriter()
+	handler.ServeHTTP(rec, req)
+	headers := make(map[string]string, len(rec.header))
+	for k := range rec.header {
+		headers[k] = rec.header.Get(k)
+	}
+	return BatchResponse{Status: rec.statusCode, Headers: headers, Body: rec.body.String()}
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var concurrencyMetrics = expvar.NewMap("provider_concurrency")
+
+// ParseProviderLimits parses caps such as "jina=10,serper=5" into the maximum
+// concurrent upstream requests per provider.
+func ParseProviderLimits(s string) (map[string]int, error) {
+	limits := map[string]int{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		provider, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("provider limit %q: missing '='", part)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("provider limit %q: invalid limit %q", part, value)
+		}
+		limits[strings.TrimSpace(provider)] = n
+	}
+	return limits, nil
+}
+
+//go:embed concurrency.lua
+var concurrencyScript string
+
+// ConcurrencyScript is the Redis script for leasing a concurrency slot of a provider
+var ConcurrencyScript = redis.NewScript(concurrencyScript)
+
+// concurrencyLeaseTTL is how long the slot of a replica dying mid-request is
+// held, the leases of the requests in flight are renewed every third of it.
+const concurrencyLeaseTTL = 30 * time.Second
+
+// concurrencyPoll is how often a queued request retries for a slot.
+const concurrencyPoll = 50 * time.Millisecond
+
+// ConcurrencyLimit caps the concurrent requests of all the replicas to a
+// provider, so we stay within the plan's limit however many clients hit us.
+// The slots are leases in Redis. Requests over the cap queue for a slot, up
+// to the queue timeout. Redis failures let the request through, as the
+// host politeness does.
+type ConcurrencyLimit struct {
+	redis        redis.Cmdable
+	provider     string
+	max          int
+	queueTimeout time.Duration
+	logger       *slog.Logger
+}
+
+// NewConcurrencyLimit creates a new ConcurrencyLimit of max concurrent
+// requests to provider.
+func NewConcurrencyLimit(rdb redis.Cmdable, provider string, max int, queueTimeout time.Duration, logger *slog.Logger) *ConcurrencyLimit {
+	return &ConcurrencyLimit{
+		redis:        rdb,
+		provider:     provider,
+		max:          max,
+		queueTimeout: queueTimeout,
+		logger:       logger,
+	}
+}
+
+func (l *ConcurrencyLimit) key() string {
+	return fmt.Sprintf("concurrency:%s", l.provider)
+}
+
+// HTTPHandlerMiddleware waits for a slot before calling next, and answers
+// 503 when none frees up in time.
+func (l *ConcurrencyLimit) HTTPHandlerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lease := newLease()
+		acquired, err := l.acquire(r.Context(), lease)
+		if err != nil {
+			l.logger.Warn("Failed to lease a provider concurrency slot", "provider", l.provider, "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !acquired && !l.wait(w, r, lease) {
+			return
+		}
+		concurrencyMetrics.Add(l.provider+"_inflight", 1)
+		stop := l.renew(lease)
+		defer func() {
+			stop()
+			concurrencyMetrics.Add(l.provider+"_inflight", -1)
+			l.release(lease)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newLease() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b) // never fails
+	return hex.EncodeToString(b)
+}
+
+func (l *ConcurrencyLimit) acquire(ctx context.Context, lease string) (bool, error) {
+	acquired, err := ConcurrencyScript.Run(ctx, l.redis, []string{l.key()},
+		l.max, time.Now().UnixMilli(), concurrencyLeaseTTL.Milliseconds(), lease).Int()
+	if err != nil {
+		return false, fmt.Errorf("ConcurrencyScript.Run: %w", err)
+	}
+	return acquired == 1, nil
+}
+
+// renew extends the lease until the returned stop is called.
+func (l *ConcurrencyLimit) renew(lease string) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		ticker := time.NewTicker(concurrencyLeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				expiry := float64(time.Now().Add(concurrencyLeaseTTL).UnixMilli())
+				pipe := l.redis.Pipeline()
+				pipe.ZAddXX(ctx, l.key(), redis.Z{Score: expiry, Member: lease})
+				pipe.PExpire(ctx, l.key(), concurrencyLeaseTTL)
+				if _, err := pipe.Exec(ctx); err != nil && ctx.Err() == nil {
+					l.logger.Warn("Failed to renew a provider concurrency slot", "provider", l.provider, "error", err)
+				}
+			}
+		}
+	}()
+	return cancel
+}
+
+func (l *ConcurrencyLimit) release(lease string) {
+	// the request context may be done already, release regardless
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := l.redis.ZRem(ctx, l.key(), lease).Err(); err != nil {
+		l.logger.Warn("Failed to release a provider concurrency slot", "provider", l.provider, "error", err)
+	}
+}
+
+// wait queues for a slot, it returns false having answered the request when
+// none was acquired.
+func (l *ConcurrencyLimit) wait(w http.ResponseWriter, r *http.Request, lease string) bool {
+	concurrencyMetrics.Add(l.provider+"_saturated", 1)
+	concurrencyMetrics.Add(l.provider+"_queued", 1)
+	defer concurrencyMetrics.Add(l.provider+"_queued", -1)
+
+	start := time.Now()
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	poll := time.NewTicker(concurrencyPoll)
+	defer poll.Stop()
+	for {
+		select {
+		case <-poll.C:
+			acquired, err := l.acquire(r.Context(), lease)
+			if err != nil || acquired {
+				// Redis failures let the request through
+				concurrencyMetrics.Add(l.provider+"_wait_ms", time.Since(start).Milliseconds())
+				return true
+			}
+		case <-timer.C:
+			concurrencyMetrics.Add(l.provider+"_rejected", 1)
+			l.logger.Warn("Provider concurrency cap reached", "provider", l.provider, "limit", l.max, "waited", l.queueTimeout)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, fmt.Sprintf("Too many concurrent requests to %s", l.provider), http.StatusServiceUnavailable)
+			return false
+		case <-r.Context().Done():
+			return false
+		}
+	}
+}
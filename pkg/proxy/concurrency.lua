@@ -0,0 +1,15 @@
+-- All keys must be explicitly provided for Redis clustering compatibility
+local leasesKey = KEYS[1]          -- Pre-constructed "concurrency:{provider}" sorted set of leases
+local max = tonumber(ARGV[1])      -- concurrent requests of all the replicas
+local now = tonumber(ARGV[2])      -- milliseconds
+local leaseTTL = tonumber(ARGV[3]) -- milliseconds, the lease of a replica dying mid-request expires
+local lease = ARGV[4]
+
+-- the leases not renewed in time are freed
+redis.call('ZREMRANGEBYSCORE', leasesKey, '-inf', now)
+if redis.call('ZCARD', leasesKey) >= max then
+	return 0
+end
+redis.call('ZADD', leasesKey, now + leaseTTL, lease)
+redis.call('PEXPIRE', leasesKey, leaseTTL)
+return 1
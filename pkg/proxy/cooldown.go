@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var cooldownMetrics = expvar.NewMap("provider_cooldown")
+
+// Cooldown remembers the 429s of a provider in Redis, for every replica, and
+// holds its requests back for the cooldown the provider stated in
+// Retry-After instead of spending connections on certain failures. Requests
+// wait out cooldowns up to maxWait, and fail fast with 429 past it.
+type Cooldown struct {
+	redis    redis.Cmdable
+	provider string
+	// fallback is the cooldown of a 429 without Retry-After
+	fallback time.Duration
+	// max caps the cooldowns, a bogus Retry-After doesn't block a provider for days
+	max     time.Duration
+	maxWait time.Duration
+	logger  *slog.Logger
+}
+
+// NewCooldown creates a new Cooldown of provider.
+func NewCooldown(rdb redis.Cmdable, provider string, fallback, max, maxWait time.Duration, logger *slog.Logger) *Cooldown {
+	return &Cooldown{
+		redis:    rdb,
+		provider: provider,
+		fallback: min(fallback, max),
+		max:      max,
+		maxWait:  maxWait,
+		logger:   logger,
+	}
+}
+
+func (c *Cooldown) key() string {
+	return "cooldown:" + c.provider
+}
+
+// cooldownWriter captures the status and the Retry-After of the answer.
+type cooldownWriter struct {
+	http.ResponseWriter
+	status     int
+	retryAfter string
+}
+
+func (w *cooldownWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+		w.retryAfter = w.Header().Get("Retry-After")
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *cooldownWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// HTTPHandlerMiddleware waits out or rejects the requests during a cooldown,
+// and starts one when next answers 429. Redis failures let the request
+// through, the cooldown is best effort.
+func (c *Cooldown) HTTPHandlerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remaining, err := c.redis.PTTL(r.Context(), c.key()).Result()
+		if err != nil {
+			c.logger.Warn("Failed to check provider cooldown", "provider", c.provider, "error", err)
+		} else if remaining > 0 && !c.wait(w, r, remaining) {
+			return
+		}
+
+		cw := &cooldownWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		if cw.status == http.StatusTooManyRequests {
+			c.start(context.WithoutCancel(r.Context()), cw.retryAfter)
+		}
+	})
+}
+
+// wait waits out the remaining cooldown when it's within maxWait, it returns
+// false having answered the request otherwise.
+func (c *Cooldown) wait(w http.ResponseWriter, r *http.Request, remaining time.Duration) bool {
+	if remaining > c.maxWait {
+		cooldownMetrics.Add(c.provider+"_rejected", 1)
+		seconds := int(math.Ceil(remaining.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		w.Header().Set(tollgate.ErrorCodeHeader, ErrorProviderRateLimited)
+		http.Error(w, fmt.Sprintf("%s is rate limiting us, retry in %ds", c.provider, seconds), http.StatusTooManyRequests)
+		return false
+	}
+	cooldownMetrics.Add(c.provider+"_queued", 1)
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// start starts a cooldown of the provider, as long as retryAfter, seconds or
+// an HTTP date, says.
+func (c *Cooldown) start(ctx context.Context, retryAfter string) {
+	cooldown := c.fallback
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		cooldown = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(retryAfter); err == nil {
+		cooldown = time.Until(date)
+	}
+	cooldown = min(cooldown, c.max)
+	if cooldown <= 0 {
+		return
+	}
+	cooldownMetrics.Add(c.provider+"_started", 1)
+	c.logger.Warn("Provider rate limited us, cooling down", "provider", c.provider, "cooldown", cooldown, "retry_after", retryAfter)
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := c.redis.Set(ctx, c.key(), 1, cooldown).Err(); err != nil {
+		c.logger.Warn("Failed to start provider cooldown", "provider", c.provider, "error", err)
+	}
+}
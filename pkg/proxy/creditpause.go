@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var pauseMetrics = expvar.NewMap("provider_pause")
+
+// ErrorProviderPaused is the code of the requests refused while a provider
+// is paused, its account being out of credits.
+const ErrorProviderPaused = "provider_paused"
+
+// PauseAlert is sent to the operators when a provider is paused.
+type PauseAlert struct {
+	Provider string `json:"provider"`
+	// KeyFingerprint identifies the upstream key refused, see KeyFingerprint
+	KeyFingerprint string    `json:"key_fingerprint,omitempty"`
+	Status         int       `json:"status"`
+	Until          time.Time `json:"until"`
+}
+
+// CreditPause puts a provider in cache-only mode, for every replica, when its
+// answers say the provider account is out of credits, ErrorProviderCredits,
+// instead of spending every miss on a certain 402. The cached answers are
+// still served, as it goes under the cache; the misses are answered 503 with
+// ErrorProviderPaused until the pause ends or an operator resumes it, and the
+// first one after tells whether the credits were topped up.
+type CreditPause struct {
+	redis    redis.Cmdable
+	provider string
+	duration time.Duration
+	alert    func(ctx context.Context, alert PauseAlert)
+	logger   *slog.Logger
+}
+
+// NewCreditPause creates a new CreditPause of provider, pausing it for
+// duration. alert is called once per pause, by the replica that started it.
+func NewCreditPause(rdb redis.Cmdable, provider string, duration time.Duration, alert func(ctx context.Context, alert PauseAlert), logger *slog.Logger) *CreditPause {
+	return &CreditPause{
+		redis:    rdb,
+		provider: provider,
+		duration: duration,
+		alert:    alert,
+		logger:   logger,
+	}
+}
+
+func pauseKey(provider string) string {
+	return "paused:" + provider
+}
+
+// pauseWriter captures the status and the error code of the answer.
+type pauseWriter struct {
+	http.ResponseWriter
+	status int
+	code   string
+}
+
+func (w *pauseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+		w.code = w.Header().Get(tollgate.ErrorCodeHeader)
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *pauseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// HTTPHandlerMiddleware rejects the requests while the provider is paused,
+// and pauses it when next answers ErrorProviderCredits. Redis failures let
+// the request through, the pause is best effort.
+func (p *CreditPause) HTTPHandlerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remaining, err := p.redis.PTTL(r.Context(), pauseKey(p.provider)).Result()
+		if err != nil {
+			p.logger.Warn("Failed to check provider pause", "provider", p.provider, "error", err)
+		} else if remaining > 0 {
+			pauseMetrics.Add(p.provider+"_rejected", 1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(remaining.Seconds()))))
+			w.Header().Set(tollgate.ErrorCodeHeader, ErrorProviderPaused)
+			http.Error(w, fmt.Sprintf("%s is paused, its upstream account is out of credits; cached answers are still served", p.provider), http.StatusServiceUnavailable)
+			return
+		}
+
+		pw := &pauseWriter{ResponseWriter: w}
+		next.ServeHTTP(pw, r)
+		if pw.code == ErrorProviderCredits {
+			p.pause(context.WithoutCancel(r.Context()), PauseAlert{
+				Provider:       p.provider,
+				KeyFingerprint: w.Header().Get(UpstreamKeyHeader),
+				Status:         pw.status,
+			})
+		}
+	})
+}
+
+// pause pauses the provider unless another request or replica already did,
+// and alerts the operators.
+func (p *CreditPause) pause(ctx context.Context, alert PauseAlert) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	started, err := p.redis.SetNX(ctx, pauseKey(p.provider), 1, p.duration).Result()
+	if err != nil {
+		p.logger.Warn("Failed to pause provider", "provider", p.provider, "error", err)
+		return
+	}
+	if !started {
+		return
+	}
+	pauseMetrics.Add(p.provider+"_paused", 1)
+	alert.Until = time.Now().Add(p.duration)
+	p.logger.Error("Provider account out of credits, serving from the cache only", "provider", p.provider, "key", alert.KeyFingerprint, "until", alert.Until)
+	if p.alert != nil {
+		p.alert(ctx, alert)
+	}
+}
+
+// PauseAdmin lists and resumes the paused providers, behind adminauth.
+//
+//	curl "https://cachev1.example.com/admin/providers/paused" -H "X-Admin-Key: xxx"
+//	curl -X DELETE "https://cachev1.example.com/admin/providers/serper/pause" -H "X-Admin-Key: xxx"
+type PauseAdmin struct {
+	redis     redis.Cmdable
+	providers []string
+}
+
+// NewPauseAdmin creates a new PauseAdmin handler set of providers.
+func NewPauseAdmin(rdb redis.Cmdable, providers []string) *PauseAdmin {
+	return &PauseAdmin{redis: rdb, providers: providers}
+}
+
+// Paused handles GET /admin/providers/paused, the paused providers with the
+// end of their pause.
+func (a *PauseAdmin) Paused(w http.ResponseWriter, r *http.Request) {
+	paused := map[string]time.Time{}
+	for _, provider := range a.providers {
+		remaining, err := a.redis.PTTL(r.Context(), pauseKey(provider)).Result()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if remaining > 0 {
+			paused[provider] = time.Now().Add(remaining).UTC()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(paused); err != nil {
+		// response was already committed, nothing left to do
+		_ = err
+	}
+}
+
+// Resume handles DELETE /admin/providers/{provider}/pause, once the credits
+// are topped up.
+func (a *PauseAdmin) Resume(w http.ResponseWriter, r *http.Request) {
+	provider := r.PathValue("provider")
+	if !slices.Contains(a.providers, provider) {
+		http.Error(w, fmt.Sprintf("unknown provider %q", provider), http.StatusNotFound)
+		return
+	}
+	if err := a.redis.Del(r.Context(), pauseKey(provider)).Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"expvar"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var dedupeMetrics = expvar.NewMap("provider_dedupe")
+
+// DedupeHeader marks the answers replayed from an identical request.
+const DedupeHeader = "X-Deduplicated"
+
+// maxDedupeBody bounds the answers kept for replay, larger ones aren't.
+const maxDedupeBody = 1 << 20
+
+// dedupeEntry is a request in flight, then its answer for the window.
+type dedupeEntry struct {
+	done   chan struct{}
+	ok     bool
+	status int
+	header http.Header
+	body   []byte
+}
+
+// Dedupe answers the identical POSTs of a key, same URL and body, sent
+// within a window, e.g. retries of an agent, with the answer of the first
+// one: those sent while it's in flight wait for it, those sent after get it
+// replayed. It works whether the route caches or not, per replica. Answers
+// of 400 and over aren't replayed, the duplicates call next.
+type Dedupe struct {
+	provider string
+	window   time.Duration
+	keyFunc  func(r *http.Request) string
+	logger   *slog.Logger
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*dedupeEntry
+}
+
+// NewDedupe creates a new Dedupe of provider, keyFunc returns the key of the
+// requests.
+func NewDedupe(provider string, window time.Duration, keyFunc func(r *http.Request) string, logger *slog.Logger) *Dedupe {
+	return &Dedupe{
+		provider: provider,
+		window:   window,
+		keyFunc:  keyFunc,
+		logger:   logger,
+		entries:  map[[sha256.Size]byte]*dedupeEntry{},
+	}
+}
+
+// dedupeWriter tees the answer to the client into the entry.
+type dedupeWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	// overflow is set when the body went past maxDedupeBody
+	overflow bool
+}
+
+func (w *dedupeWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *dedupeWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.overflow {
+		if w.body.Len()+len(b) > maxDedupeBody {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *dedupeWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// HTTPHandlerMiddleware serves the duplicates of the POSTs from the first
+// one, and calls next for the others.
+func (d *Dedupe) HTTPHandlerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Body == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			d.logger.Warn("Failed to read request body", "provider", d.provider, "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := sha256.New()
+		for _, part := range []string{d.keyFunc(r), r.URL.String()} {
+			h.Write([]byte(part))
+			h.Write([]byte{0})
+		}
+		h.Write(body)
+		var id [sha256.Size]byte
+		h.Sum(id[:0])
+
+		d.mu.Lock()
+		entry, found := d.entries[id]
+		if !found {
+			entry = &dedupeEntry{done: make(chan struct{})}
+			d.entries[id] = entry
+		}
+		d.mu.Unlock()
+
+		if found {
+			select {
+			case <-entry.done:
+			case <-r.Context().Done():
+				return
+			}
+			if entry.ok {
+				dedupeMetrics.Add(d.provider+"_replayed", 1)
+				maps.Copy(w.Header(), entry.header)
+				w.Header().Set(DedupeHeader, "true")
+				w.WriteHeader(entry.status)
+				_, _ = w.Write(entry.body)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		dw := &dedupeWriter{ResponseWriter: w}
+		// the entry is settled whatever happens, the proxy aborts answers the
+		// client left halfway with a panic
+		defer func() {
+			if dw.status == 0 {
+				dw.status = http.StatusOK
+			}
+			entry.ok = r.Context().Err() == nil && dw.status < 400 && !dw.overflow
+			if entry.ok {
+				entry.status, entry.header, entry.body = dw.status, w.Header().Clone(), dw.body.Bytes()
+			}
+			close(entry.done)
+			forget := func() {
+				d.mu.Lock()
+				delete(d.entries, id)
+				d.mu.Unlock()
+			}
+			if !entry.ok {
+				forget()
+				return
+			}
+			time.AfterFunc(d.window, forget)
+		}()
+		next.ServeHTTP(dw, r)
+	})
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestDedupe(next http.Handler) http.Handler {
+	return NewDedupe("jina", time.Minute, func(r *http.Request) string { return r.Header.Get("X-API-KEY") },
+		slog.New(slog.NewTextHandler(io.Discard, nil))).HTTPHandlerMiddleware(next)
+}
+
+func dedupeRequest(ctx context.Context) *http.Request {
+	req := httptest.NewRequestWithContext(ctx, http.MethodPost, "/jina/", strings.NewReader(`{"url":"https://example.com"}`))
+	req.Header.Set("X-API-KEY", "sk-a")
+	return req
+}
+
+func TestDedupeConcurrentRequests(t *testing.T) {
+	const n = 10
+	var calls atomic.Int32
+	release := make(chan struct{})
+	h := newTestDedupe(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, "Title: Example")
+	}))
+
+	recs := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(recs[i], dedupeRequest(context.Background()))
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("%d upstream calls, want 1", got)
+	}
+	replayed := 0
+	for _, rec := range recs {
+		if rec.Code != http.StatusOK || rec.Body.String() != "Title: Example" || rec.Header().Get("Content-Type") != "text/plain" {
+			t.Errorf("got %d %q %v", rec.Code, rec.Body, rec.Header())
+		}
+		if rec.Header().Get(DedupeHeader) != "" {
+			replayed++
+		}
+	}
+	if replayed != n-1 {
+		t.Errorf("%d answers replayed, want %d", replayed, n-1)
+	}
+
+	// another key or body isn't a duplicate
+	req := dedupeRequest(context.Background())
+	req.Header.Set("X-API-KEY", "sk-b")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got := calls.Load(); got != 2 {
+		t.Errorf("%d upstream calls after another key, want 2", got)
+	}
+}
+
+func TestDedupeCancelledLeader(t *testing.T) {
+	var calls atomic.Int32
+	started := make(chan struct{})
+	h := newTestDedupe(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			close(started)
+			<-r.Context().Done()
+			return
+		}
+		_, _ = io.WriteString(w, "Title: Example")
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		h.ServeHTTP(httptest.NewRecorder(), dedupeRequest(ctx))
+	}()
+	<-started
+
+	const n = 3
+	recs := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(recs[i], dedupeRequest(context.Background()))
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	<-leaderDone
+	wg.Wait()
+
+	for _, rec := range recs {
+		if rec.Code != http.StatusOK || rec.Body.String() != "Title: Example" {
+			t.Errorf("a follower of the cancelled leader got %d %q", rec.Code, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+var dnsMetrics = expvar.NewMap("dns")
+
+// ParseDNSPins parses pinned addresses such as "r.jina.ai=104.18.0.1|104.18.1.1,google.serper.dev=34.1.2.3".
+func ParseDNSPins(s string) (map[string][]string, error) {
+	pins := map[string][]string{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		host, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("dns pin %q: missing '='", part)
+		}
+		var addrs []string
+		for _, addr := range strings.Split(value, "|") {
+			addr = strings.TrimSpace(addr)
+			if net.ParseIP(addr) == nil {
+				return nil, fmt.Errorf("dns pin %q: invalid IP %q", part, addr)
+			}
+			addrs = append(addrs, addr)
+		}
+		pins[strings.ToLower(strings.TrimSpace(host))] = addrs
+	}
+	return pins, nil
+}
+
+const (
+	// dnsCacheHosts bounds the hosts cached, /fetch resolves the hosts the
+	// clients choose. The least recently used are evicted first.
+	dnsCacheHosts = 4096
+	// dnsMaxStale is how long an expired answer is kept to fall back on when
+	// the lookups fail.
+	dnsMaxStale = time.Hour
+	// dialFallbackDelay is how long the dial of an address runs before the
+	// next address is dialed too, as happy eyeballs does.
+	dialFallbackDelay = 300 * time.Millisecond
+)
+
+type dnsEntry struct {
+	host    string
+	addrs   []string
+	expires time.Time
+}
+
+// Resolver caches upstream DNS answers for ttl, so resolver flakiness doesn't
+// show in the latency of every request. A failed lookup falls back to the
+// last answer, for up to dnsMaxStale. Pinned hosts are never resolved.
+type Resolver struct {
+	ttl      time.Duration
+	pins     map[string][]string
+	resolver *net.Resolver
+	dialer   *net.Dialer
+	group    singleflight.Group
+
+	mu    sync.Mutex
+	order *list.List
+	cache map[string]*list.Element
+}
+
+// NewResolver creates a new Resolver caching answers for ttl.
+func NewResolver(ttl time.Duration, pins map[string][]string) *Resolver {
+	return &Resolver{
+		ttl:      ttl,
+		pins:     pins,
+		resolver: net.DefaultResolver,
+		dialer:   &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+		order:    list.New(),
+		cache:    map[string]*list.Element{},
+	}
+}
+
+// cached returns the cached answer of host, expired or not, unless it's
+// been stale for more than dnsMaxStale.
+func (res *Resolver) cached(host string, now time.Time) (dnsEntry, bool) {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	e, ok := res.cache[host]
+	if !ok {
+		return dnsEntry{}, false
+	}
+	entry := e.Value.(*dnsEntry)
+	if now.Sub(entry.expires) > dnsMaxStale {
+		res.order.Remove(e)
+		delete(res.cache, host)
+		return dnsEntry{}, false
+	}
+	res.order.MoveToFront(e)
+	return *entry, true
+}
+
+// store caches the answer of host, evicting the least recently used hosts
+// over dnsCacheHosts.
+func (res *Resolver) store(host string, addrs []string, expires time.Time) {
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	if e, ok := res.cache[host]; ok {
+		entry := e.Value.(*dnsEntry)
+		entry.addrs, entry.expires = addrs, expires
+		res.order.MoveToFront(e)
+		return
+	}
+	res.cache[host] = res.order.PushFront(&dnsEntry{host: host, addrs: addrs, expires: expires})
+	for res.order.Len() > dnsCacheHosts {
+		oldest := res.order.Back()
+		res.order.Remove(oldest)
+		delete(res.cache, oldest.Value.(*dnsEntry).host)
+		dnsMetrics.Add("evictions", 1)
+	}
+}
+
+// Lookup returns the addresses of host, from the pins or the cache when it can.
+func (res *Resolver) Lookup(ctx context.Context, host string) ([]string, error) {
+	host = strings.ToLower(host)
+	if addrs, ok := res.pins[host]; ok {
+		dnsMetrics.Add("pinned", 1)
+		return addrs, nil
+	}
+
+	entry, cached := res.cached(host, time.Now())
+	if cached && time.Now().Before(entry.expires) {
+		dnsMetrics.Add("hits", 1)
+		return entry.addrs, nil
+	}
+
+	// the lookup outlives a canceled request, its answer is shared
+	result, err, _ := res.group.Do(host, func() (any, error) {
+		dnsMetrics.Add("lookups", 1)
+		lookupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		addrs, err := res.resolver.LookupHost(lookupCtx, host)
+		if err != nil {
+			return nil, err
+		}
+		res.store(host, addrs, time.Now().Add(res.ttl))
+		return addrs, nil
+	})
+	if err != nil {
+		dnsMetrics.Add("failures", 1)
+		if cached {
+			dnsMetrics.Add("stale", 1)
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+	return result.([]string), nil
+}
+
+// DialContext dials addr through the cached addresses of its host, in order,
+// the next one being dialed too when the previous hasn't connected within
+// dialFallbackDelay.
+func (res *Resolver) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return res.dial(ctx, res.dialer, network, addr)
+}
+
+func (res *Resolver) dial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := res.Lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	return dialStaggered(ctx, dialer, network, port, addrs)
+}
+
+// dialStaggered dials the addresses in order, starting the next one when the
+// previous fails or hasn't connected within dialFallbackDelay. The first
+// connection wins, the other attempts are canceled.
+func dialStaggered(ctx context.Context, dialer *net.Dialer, network, port string, addrs []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type attempt struct {
+		conn net.Conn
+		err  error
+	}
+	// buffered for every attempt, the losers never block
+	attempts := make(chan attempt, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(addrs[next], port)
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			attempts <- attempt{conn, err}
+		}()
+	}
+	start()
+	fallback := time.NewTimer(dialFallbackDelay)
+	defer fallback.Stop()
+	var errs []error
+	for pending > 0 {
+		select {
+		case a := <-attempts:
+			pending--
+			if a.err == nil {
+				// close the connections of the attempts that won anyway
+				go func(pending int) {
+					for range pending {
+						if loser := <-attempts; loser.conn != nil {
+							loser.conn.Close()
+						}
+					}
+				}(pending)
+				return a.conn, nil
+			}
+			errs = append(errs, a.err)
+			if next < len(addrs) && ctx.Err() == nil {
+				start()
+				fallback.Reset(dialFallbackDelay)
+			}
+		case <-fallback.C:
+			if next < len(addrs) {
+				start()
+				fallback.Reset(dialFallbackDelay)
+			}
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Transport returns a copy of the default transport dialing through the Resolver.
+func (res *Resolver) Transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = res.DialContext
+	return transport
+}
+
+// PublicTransport is Transport connecting to public addresses only, see
+// PublicDialer. The pinned addresses are checked as the resolved ones.
+func (res *Resolver) PublicTransport() *http.Transport {
+	dialer := *res.dialer
+	dialer.Control = RefusePrivate
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return res.dial(ctx, &dialer, network, addr)
+	}
+	return transport
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// acceptEncoding is what upstreams are asked for, whatever the client sent.
+const acceptEncoding = "zstd, gzip"
+
+// NegotiateEncoding replaces the client Accept-Encoding, so upstreams that
+// support it answer compressed, with an encoding DecodeBody can read.
+func NegotiateEncoding() func(*httputil.ProxyRequest) {
+	return func(req *httputil.ProxyRequest) {
+		req.Out.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+}
+
+// ErrDecodedBodyTooLarge is returned reading a decoded body past the maximum
+// size of DecodeBody.
+var ErrDecodedBodyTooLarge = errors.New("decoded body too large")
+
+// DecodeBody decodes gzip and zstd answers once, so the cache middleware stores
+// and serves decoded bodies. It must run before the other response modifiers.
+// A decoded body fails past maxSize bytes, so a small compressed answer can't
+// expand without bounds. 0 disables the cap.
+func DecodeBody(maxSize int64) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		var body io.ReadCloser
+		switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+		case "gzip", "x-gzip":
+			zr, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				return fmt.Errorf("gzip.NewReader: %w", err)
+			}
+			body = &decodedBody{Reader: zr, closeDecoder: zr.Close, raw: resp.Body}
+		case "zstd":
+			zr, err := zstd.NewReader(resp.Body, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+			if err != nil {
+				return fmt.Errorf("zstd.NewReader: %w", err)
+			}
+			body = &decodedBody{Reader: zr, closeDecoder: func() error { zr.Close(); return nil }, raw: resp.Body}
+		default:
+			return nil
+		}
+		if maxSize > 0 {
+			body = &cappedBody{ReadCloser: body, left: maxSize}
+		}
+		resp.Body = body
+		resp.ContentLength = -1
+		resp.Uncompressed = true
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		// digests of the encoded body, the gzip and zstd checksums cover the decoded one
+		resp.Header.Del("Content-MD5")
+		resp.Header.Del("Digest")
+		resp.Header.Del("Content-Digest")
+		resp.Header.Del("Repr-Digest")
+		// a validator of the encoded body doesn't match the decoded one
+		if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			resp.Header.Set("ETag", "W/"+etag)
+		}
+		return nil
+	}
+}
+
+// decodedBody closes both the decoder and the encoded body.
+type decodedBody struct {
+	io.Reader
+	closeDecoder func() error
+	raw          io.ReadCloser
+}
+
+func (b *decodedBody) Close() error {
+	err := b.closeDecoder()
+	if rawErr := b.raw.Close(); err == nil {
+		err = rawErr
+	}
+	return err
+}
+
+// cappedBody fails the reads past its size.
+type cappedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *cappedBody) Read(p []byte) (int, error) {
+	if b.left < 0 {
+		return 0, ErrDecodedBodyTooLarge
+	}
+	// a byte past the size tells a body of exactly the size from a larger one
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	if b.left < 0 {
+		return n + int(b.left), ErrDecodedBodyTooLarge
+	}
+	return n, err
+}
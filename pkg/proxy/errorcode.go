@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"bytes"
+	"expvar"
+	"io"
+	"net/http"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+)
+
+var errorMetrics = expvar.NewMap("provider_errors")
+
+// Normalized error codes of the upstream answers, set in
+// tollgate.ErrorCodeHeader so clients and dashboards tell a provider account
+// out of credits from a target site blocking us, and both from our own quota,
+// tollgate.ErrorQuotaExhausted.
+const (
+	// ErrorProviderCredits is a provider account out of credits.
+	ErrorProviderCredits = "provider_credits"
+	// ErrorProviderAuth is an upstream key the provider refused.
+	ErrorProviderAuth = "provider_auth"
+	// ErrorProviderRateLimited is a provider rate limiting us.
+	ErrorProviderRateLimited = "provider_rate_limited"
+	// ErrorTargetBlocked is a target site refusing the provider or us.
+	ErrorTargetBlocked = "target_blocked"
+	// ErrorUpstream is any other upstream error.
+	ErrorUpstream = "upstream_error"
+)
+
+// ErrorRule maps the error answers of a status whose body contains a string
+// to a code. A Status of 0 matches every status, a Contains of "" every body.
+type ErrorRule struct {
+	Status   int
+	Contains string
+	Code     string
+}
+
+// errorRules are the rules of each provider, the first match wins, then the
+// default ones.
+var errorRules = map[string][]ErrorRule{
+	"serper": {
+		{Contains: "Not enough credits", Code: ErrorProviderCredits},
+	},
+	"jina": {
+		{Status: http.StatusPaymentRequired, Code: ErrorProviderCredits},
+		{Contains: "InsufficientBalanceError", Code: ErrorProviderCredits},
+		{Status: http.StatusUnavailableForLegalReasons, Code: ErrorTargetBlocked},
+		{Contains: "SecurityCompromiseError", Code: ErrorTargetBlocked},
+	},
+	// fetch calls the target sites themselves, their refusals are blocks
+	"fetch": {
+		{Status: http.StatusUnauthorized, Code: ErrorTargetBlocked},
+		{Status: http.StatusForbidden, Code: ErrorTargetBlocked},
+		{Status: http.StatusTooManyRequests, Code: ErrorTargetBlocked},
+		{Status: http.StatusUnavailableForLegalReasons, Code: ErrorTargetBlocked},
+	},
+}
+
+var defaultErrorRules = []ErrorRule{
+	{Status: http.StatusPaymentRequired, Code: ErrorProviderCredits},
+	{Status: http.StatusUnauthorized, Code: ErrorProviderAuth},
+	{Status: http.StatusForbidden, Code: ErrorProviderAuth},
+	{Status: http.StatusTooManyRequests, Code: ErrorProviderRateLimited},
+}
+
+// maxErrorBody bounds the start of the error bodies searched by the rules.
+const maxErrorBody = 64 << 10
+
+// ClassifyError returns the code of an error answer of provider.
+func ClassifyError(provider string, statusCode int, body []byte) string {
+	for _, rules := range [][]ErrorRule{errorRules[provider], defaultErrorRules} {
+		for _, rule := range rules {
+			if rule.Status != 0 && rule.Status != statusCode {
+				continue
+			}
+			if rule.Contains != "" && !bytes.Contains(bytes.ToLower(body), bytes.ToLower([]byte(rule.Contains))) {
+				continue
+			}
+			return rule.Code
+		}
+	}
+	return ErrorUpstream
+}
+
+// ClassifyErrors sets the code of the error answers of provider in
+// tollgate.ErrorCodeHeader, and counts them by code. It reads the start of the
+// body, so it must run after DecodeBody.
+func ClassifyErrors(provider string) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		// the header is ours, not the provider's
+		resp.Header.Del(tollgate.ErrorCodeHeader)
+		if resp.StatusCode < 400 {
+			return nil
+		}
+		head, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		if err != nil {
+			return err
+		}
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+		code := ClassifyError(provider, resp.StatusCode, head)
+		resp.Header.Set(tollgate.ErrorCodeHeader, code)
+		errorMetrics.Add(provider+"_"+code, 1)
+		return nil
+	}
+}
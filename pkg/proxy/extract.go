@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Extraction formats for the fetch path.
+const (
+	ExtractMarkdown = "markdown"
+	ExtractText     = "text"
+)
+
+// codeFence opens and closes the markdown code blocks.
+const codeFence = "```"
+
+var (
+	blankLines = regexp.MustCompile(`\n{3,}`)
+	spaces     = regexp.MustCompile(`[ \t\n\r\f\v]+`)
+	// elements whose content is never part of the readable page
+	noiseElements = map[atom.Atom]bool{
+		atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Template: true, atom.Svg: true,
+		atom.Iframe: true, atom.Head: true, atom.Nav: true, atom.Footer: true, atom.Aside: true, atom.Form: true,
+	}
+)
+
+// ErrPageTooLarge is returned extracting a page past the maximum size of
+// ExtractHTML, the proxy answers 502.
+var ErrPageTooLarge = errors.New("page too large to extract")
+
+// ExtractHTML converts HTML answers of the fetch path into markdown or plain text,
+// so simple pages can be read without Jina. Non-HTML answers pass through untouched.
+// The extracted body is what the cache middleware stores. Pages past maxSize
+// bytes fail, they're parsed in memory. 0 disables the cap.
+func ExtractHTML(format string, maxSize int64) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if resp.StatusCode >= 400 {
+			return nil
+		}
+		mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if err != nil || (mediaType != "text/html" && mediaType != "application/xhtml+xml") {
+			return nil
+		}
+		// bodies DecodeBody couldn't decode can't be parsed, leave them to the client
+		if enc := resp.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+			return nil
+		}
+
+		var body io.Reader = resp.Body
+		if maxSize > 0 {
+			// a byte past the size tells a page of exactly the size from a larger one
+			body = io.LimitReader(resp.Body, maxSize+1)
+		}
+		raw, err := io.ReadAll(body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("io.ReadAll(resp.Body): %w", err)
+		}
+		if maxSize > 0 && int64(len(raw)) > maxSize {
+			return fmt.Errorf("%w: more than %d bytes", ErrPageTooLarge, maxSize)
+		}
+
+		var out string
+		contentType := "text/plain; charset=utf-8"
+		switch format {
+		case ExtractText:
+			out = HTMLToText(string(raw))
+		default:
+			out = HTMLToMarkdown(string(raw))
+			contentType = "text/markdown; charset=utf-8"
+		}
+
+		resp.Body = io.NopCloser(bytes.NewReader([]byte(out)))
+		resp.ContentLength = int64(len(out))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(out)))
+		resp.Header.Set("Content-Type", contentType)
+		resp.Header.Del("ETag")
+		resp.Header.Del("Content-MD5")
+		resp.Header.Del("Digest")
+		resp.Header.Del("Content-Digest")
+		resp.Header.Del("Repr-Digest")
+		return nil
+	}
+}
+
+// HTMLToMarkdown extracts the readable part of a page as markdown.
+// It keeps the title, headings, paragraphs, list items and links.
+func HTMLToMarkdown(page string) string {
+	return extract(page, true)
+}
+
+// HTMLToText extracts the readable part of a page as plain text.
+func HTMLToText(page string) string {
+	return extract(page, false)
+}
+
+func extract(page string, markdown bool) string {
+	// the parser repairs unclosed and misnested tags as browsers do
+	doc, err := html.Parse(strings.NewReader(page))
+	if err != nil {
+		return ""
+	}
+
+	var sb strings.Builder
+	if title := findElement(doc, atom.Title); title != nil {
+		if text := strings.TrimSpace(spaces.ReplaceAllString(textOf(title), " ")); text != "" {
+			if markdown {
+				sb.WriteString("# ")
+			}
+			sb.WriteString(text)
+			sb.WriteString("\n\n")
+		}
+	}
+
+	renderNode(&sb, readableContent(doc), markdown)
+
+	lines := strings.Split(sb.String(), "\n")
+	inCode := false
+	for i, line := range lines {
+		if markdown && strings.TrimSpace(line) == codeFence {
+			inCode = !inCode
+		}
+		// the code blocks keep their indentation
+		if inCode {
+			lines[i] = strings.TrimRight(line, " \t\r")
+			continue
+		}
+		lines[i] = strings.TrimSpace(line)
+	}
+	text := blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.TrimSpace(text) + "\n"
+}
+
+// readableContent returns the node holding the readable part of the page:
+// the main article, or else the smallest container holding most of the text
+// of the paragraphs, or else the body.
+func readableContent(doc *html.Node) *html.Node {
+	if n := findElement(doc, atom.Article); n != nil {
+		return n
+	}
+	if n := findElement(doc, atom.Main); n != nil {
+		return n
+	}
+	body := findElement(doc, atom.Body)
+	if body == nil {
+		return doc
+	}
+
+	// as readability does, containers are scored by the text of their paragraphs
+	scores := map[*html.Node]int{}
+	var score func(n *html.Node) int
+	score = func(n *html.Node) int {
+		total := 0
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || skipped(c) {
+				continue
+			}
+			if c.DataAtom == atom.P {
+				total += len(strings.TrimSpace(textOf(c)))
+				continue
+			}
+			text := score(c)
+			if c.DataAtom == atom.Div || c.DataAtom == atom.Section || c.DataAtom == atom.Td {
+				scores[c] = text
+			}
+			total += text
+		}
+		return total
+	}
+	total := score(body)
+	best, bestScore := body, total
+	for n, text := range scores {
+		// a container leaving a quarter of the text out isn't the content
+		if text*4 >= total*3 && text > 0 && (text < bestScore || (text == bestScore && contains(best, n))) {
+			best, bestScore = n, text
+		}
+	}
+	return best
+}
+
+// contains reports whether n is a descendant of ancestor.
+func contains(ancestor, n *html.Node) bool {
+	for p := n.Parent; p != nil; p = p.Parent {
+		if p == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+// skipped reports whether the content of n is never part of the readable page.
+func skipped(n *html.Node) bool {
+	if noiseElements[n.DataAtom] {
+		return true
+	}
+	for _, attr := range n.Attr {
+		if attr.Key == "hidden" || (attr.Key == "aria-hidden" && attr.Val == "true") {
+			return true
+		}
+	}
+	return false
+}
+
+// findElement returns the first element a under n outside the noise, in document order.
+func findElement(n *html.Node, a atom.Atom) *html.Node {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode && c.Type != html.DocumentNode {
+			continue
+		}
+		if c.DataAtom == a {
+			return c
+		}
+		if c.DataAtom != atom.Head && a != atom.Title && skipped(c) {
+			continue
+		}
+		if found := findElement(c, a); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// textOf returns the text under n, entities decoded.
+func textOf(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.ElementNode && skipped(c) {
+				continue
+			}
+			walk(c)
+		}
+	}
+	walk(n)
+	return sb.String()
+}
+
+// renderNode writes the readable text under n, as markdown when markdown.
+func renderNode(sb *strings.Builder, n *html.Node, markdown bool) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch c.Type {
+		case html.TextNode:
+			sb.WriteString(spaces.ReplaceAllString(c.Data, " "))
+		case html.ElementNode:
+			if skipped(c) {
+				continue
+			}
+			renderElement(sb, c, markdown)
+		}
+	}
+}
+
+func renderElement(sb *strings.Builder, n *html.Node, markdown bool) {
+	switch n.DataAtom {
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		sb.WriteString("\n\n")
+		if markdown {
+			sb.WriteString(strings.Repeat("#", int(n.Data[1]-'0')) + " ")
+		}
+		renderNode(sb, n, markdown)
+		sb.WriteString("\n\n")
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Main, atom.Table, atom.Tr, atom.Blockquote, atom.Ul, atom.Ol:
+		sb.WriteString("\n\n")
+		renderNode(sb, n, markdown)
+		sb.WriteString("\n\n")
+	case atom.Pre:
+		sb.WriteString("\n\n")
+		if markdown {
+			sb.WriteString(codeFence + "\n")
+		}
+		sb.WriteString(strings.Trim(textOf(n), "\n"))
+		if markdown {
+			sb.WriteString("\n" + codeFence)
+		}
+		sb.WriteString("\n\n")
+	case atom.Br, atom.Hr:
+		sb.WriteString("\n")
+	case atom.Li:
+		sb.WriteString("\n" + listMarker(n) + " ")
+		renderNode(sb, n, markdown)
+	case atom.Td, atom.Th:
+		sb.WriteString(" ")
+		renderNode(sb, n, markdown)
+		sb.WriteString(" ")
+	case atom.A:
+		href := attribute(n, "href")
+		if !markdown || href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(strings.TrimSpace(href)), "javascript:") {
+			renderNode(sb, n, markdown)
+			return
+		}
+		sb.WriteString("[")
+		renderNode(sb, n, markdown)
+		sb.WriteString("](" + href + ")")
+	default:
+		renderNode(sb, n, markdown)
+	}
+}
+
+// listMarker returns the marker of the list item n, its number in ordered lists.
+func listMarker(n *html.Node) string {
+	if n.Parent == nil || n.Parent.DataAtom != atom.Ol {
+		return "-"
+	}
+	number := 1
+	if start, err := strconv.Atoi(attribute(n.Parent, "start")); err == nil {
+		number = start
+	}
+	for c := n.Parent.FirstChild; c != nil && c != n; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Li {
+			number++
+		}
+	}
+	return strconv.Itoa(number) + "."
+}
+
+// attribute returns the value of the attribute key of n, empty without one.
+func attribute(n *html.Node, key string) string {
+	for _, attr := range n.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The pages of testdata/extract and their extractions, .md and .txt.
+func TestExtractGolden(t *testing.T) {
+	pages, err := filepath.Glob("testdata/extract/*.html")
+	if err != nil || len(pages) == 0 {
+		t.Fatalf("no pages: %v", err)
+	}
+	for _, page := range pages {
+		html, err := os.ReadFile(page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ext, extract := range map[string]func(string) string{".md": HTMLToMarkdown, ".txt": HTMLToText} {
+			golden := strings.TrimSuffix(page, ".html") + ext
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := extract(string(html)); got != string(want) {
+				t.Errorf("%s:\n%s\nwant:\n%s", golden, got, want)
+			}
+		}
+	}
+}
+
+func TestHTMLToMarkdown(t *testing.T) {
+	for _, tt := range []struct{ html, want string }{
+		{`<h2>Title</h2><h4>Sub</h4>`, "## Title\n\n#### Sub\n"},
+		{`<p><a href="/a">relative</a> <a href="#top">anchor</a> <a href="javascript:x()">script</a> <a>none</a></p>`, "[relative](/a) anchor script none\n"},
+		{`<ol start="3"><li>three</li><li>four</li></ol>`, "3. three\n4. four\n"},
+		{`<ul><li>a<ul><li>b</li></ul></li></ul>`, "- a\n\n- b\n"},
+		{"<pre>  indented\n    more</pre>", "```\n  indented\n    more\n```\n"},
+		{`<p>before</p><script>alert(1)</script><style>p{}</style><template>t</template><p>after</p>`, "before\n\nafter\n"},
+		{`<p aria-hidden="true">hidden</p><p>shown</p>`, "shown\n"},
+	} {
+		if got := HTMLToMarkdown(tt.html); got != tt.want {
+			t.Errorf("HTMLToMarkdown(%s) = %q, want %q", tt.html, got, tt.want)
+		}
+	}
+}
+
+func TestExtractHTMLMaxSize(t *testing.T) {
+	page := "<p>" + strings.Repeat("a", 100) + "</p>"
+	for _, tt := range []struct {
+		maxSize int64
+		wantErr bool
+	}{
+		{0, false},
+		{int64(len(page)), false},
+		{int64(len(page)) - 1, true},
+	} {
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+			Body:       io.NopCloser(strings.NewReader(page)),
+		}
+		err := ExtractHTML(ExtractMarkdown, tt.maxSize)(resp)
+		if got := errors.Is(err, ErrPageTooLarge); got != tt.wantErr {
+			t.Errorf("max %d: error %v", tt.maxSize, err)
+		}
+	}
+}
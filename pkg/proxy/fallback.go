@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// ProviderHeader records which provider served the final answer.
+const ProviderHeader = "X-Provider"
+
+// Provider is a named upstream handler.
+type Provider struct {
+	Name    string
+	Handler http.Handler
+}
+
+// fallbackPeek is how much of the primary answer is held to tell whether it's
+// blocked, the rest is streamed. Jina puts its warnings in the header of its
+// answers.
+const fallbackPeek = 16 * 1024
+
+// Fallback serves a request through the primary provider, and retries the same
+// request through the fallback provider when the primary answer is unusable.
+type Fallback struct {
+	primary  Provider
+	fallback Provider
+	blocked  func(statusCode int, body []byte) bool
+	maxBody  int64
+	logger   *slog.Logger
+}
+
+// NewFallback creates a new Fallback handler. blocked reports whether the
+// primary answer must be retried through the fallback, from its status and
+// its first bytes, up to 16 KiB. maxBody caps the request body replayed and
+// the primary answer held while the fallback runs, 0 disables the cap.
+func NewFallback(primary, fallback Provider, blocked func(statusCode int, body []byte) bool, maxBody int64, logger *slog.Logger) *Fallback {
+	return &Fallback{
+		primary:  primary,
+		fallback: fallback,
+		blocked:  blocked,
+		maxBody:  maxBody,
+		logger:   logger,
+	}
+}
+
+// JinaBlocked reports whether a Jina read failed or returned blocked content.
+func JinaBlocked(statusCode int, body []byte) bool {
+	if statusCode >= 400 {
+		return true
+	}
+	content := bytes.TrimSpace(body)
+	if len(content) == 0 {
+		return true
+	}
+	// Jina answers 200 with a warning when the target refused the read
+	return bytes.Contains(content, []byte("Warning: Target URL returned error"))
+}
+
+func (f *Fallback) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Buffer the request body so it can be replayed to the fallback
+	var body []byte
+	if r.Body != nil {
+		reader := r.Body
+		if f.maxBody > 0 {
+			reader = http.MaxBytesReader(w, r.Body, f.maxBody)
+		}
+		var err error
+		body, err = io.ReadAll(reader)
+		r.Body.Close()
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, fmt.Sprintf("Request body larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	primary := &peekWriter{w: w, provider: f.primary.Name, blocked: f.blocked, maxBody: f.maxBody, header: http.Header{}, statusCode: http.StatusOK}
+	f.primary.Handler.ServeHTTP(primary, r)
+	if !primary.finish() {
+		return
+	}
+
+	f.logger.Warn("Primary provider failed, retrying through fallback",
+		"primary", f.primary.Name, "fallback", f.fallback.Name,
+		"url", r.URL.String(), "status_code", primary.statusCode)
+
+	retry := r.Clone(r.Context())
+	retry.Body = io.NopCloser(bytes.NewReader(body))
+	fallback := &fallbackWriter{w: w, provider: f.fallback.Name, header: http.Header{}}
+	f.fallback.Handler.ServeHTTP(fallback, retry)
+	if !fallback.committed && !fallback.failed {
+		fallback.WriteHeader(http.StatusOK)
+	}
+	if fallback.failed {
+		// Both failed, the primary error is the more meaningful one
+		primary.flush()
+	}
+}
+
+// peekWriter holds the primary answer until it's known whether it's blocked,
+// then streams it when it isn't.
+type peekWriter struct {
+	w        http.ResponseWriter
+	provider string
+	blocked  func(statusCode int, body []byte) bool
+	maxBody  int64
+
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+	// decided is set once the answer is known to be blocked, streaming once
+	// it's known not to be
+	decided, streaming bool
+}
+
+func (p *peekWriter) Header() http.Header {
+	if p.streaming {
+		return p.w.Header()
+	}
+	return p.header
+}
+
+func (p *peekWriter) WriteHeader(statusCode int) {
+	if !p.streaming && p.body.Len() == 0 {
+		p.statusCode = statusCode
+	}
+}
+
+func (p *peekWriter) Write(b []byte) (int, error) {
+	if p.streaming {
+		return p.w.Write(b)
+	}
+	n := len(b)
+	if p.maxBody > 0 && int64(p.body.Len()+len(b)) > p.maxBody {
+		// a blocked answer is only served when the fallback fails too
+		b = b[:max(p.maxBody-int64(p.body.Len()), 0)]
+		p.decided = true
+	}
+	p.body.Write(b)
+	if !p.decided && p.body.Len() >= fallbackPeek {
+		p.decided = true
+		if !p.blocked(p.statusCode, p.body.Bytes()) {
+			return n, p.flush()
+		}
+	}
+	return n, nil
+}
+
+// Flush flushes the answer once it's streamed.
+func (p *peekWriter) Flush() {
+	if p.streaming {
+		_ = http.NewResponseController(p.w).Flush()
+	}
+}
+
+// finish reports whether the whole answer is blocked, and serves it when it isn't.
+func (p *peekWriter) finish() bool {
+	if p.streaming {
+		return false
+	}
+	if !p.decided && !p.blocked(p.statusCode, p.body.Bytes()) {
+		_ = p.flush() // response was already committed, nothing left to do
+		return false
+	}
+	return true
+}
+
+// flush serves the answer held, and streams the rest.
+func (p *peekWriter) flush() error {
+	for k, v := range p.header {
+		p.w.Header()[k] = v
+	}
+	p.w.Header().Set(ProviderHeader, p.provider)
+	p.w.WriteHeader(p.statusCode)
+	p.streaming = true
+	_, err := p.w.Write(p.body.Bytes())
+	p.body = bytes.Buffer{}
+	return err
+}
+
+// fallbackWriter streams the fallback answer when it succeeds, and drops it
+// otherwise.
+type fallbackWriter struct {
+	w        http.ResponseWriter
+	provider string
+	header   http.Header
+	// committed is set once the answer is streamed, failed once it's dropped
+	committed, failed bool
+}
+
+func (f *fallbackWriter) Header() http.Header {
+	if f.committed {
+		return f.w.Header()
+	}
+	return f.header
+}
+
+func (f *fallbackWriter) WriteHeader(statusCode int) {
+	if f.committed || f.failed {
+		return
+	}
+	if statusCode >= 400 {
+		f.failed = true
+		return
+	}
+	for k, v := range f.header {
+		f.w.Header()[k] = v
+	}
+	f.w.Header().Set(ProviderHeader, f.provider)
+	f.w.WriteHeader(statusCode)
+	f.committed = true
+}
+
+func (f *fallbackWriter) Write(b []byte) (int, error) {
+	if !f.committed && !f.failed {
+		f.WriteHeader(http.StatusOK)
+	}
+	if f.failed {
+		return len(b), nil
+	}
+	return f.w.Write(b)
+}
+
+// Flush flushes the answer once it's streamed.
+func (f *fallbackWriter) Flush() {
+	if f.committed {
+		_ = http.NewResponseController(f.w).Flush()
+	}
+}
+
+// bufferedWriter holds a response until it's known which provider answers.
+type bufferedWriter struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func newBufferedWriter() *bufferedWriter {
+	return &bufferedWriter{header: http.Header{}, statusCode: http.StatusOK}
+}
+
+func (b *bufferedWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedWriter) WriteHeader(statusCode int) {
+	b.statusCode = statusCode
+}
+
+func (b *bufferedWriter) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+func (b *bufferedWriter) flushTo(w http.ResponseWriter, provider string) {
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set(ProviderHeader, provider)
+	w.WriteHeader(b.statusCode)
+	if _, err := w.Write(b.body.Bytes()); err != nil {
+		// response was already committed, nothing left to do
+		_ = err
+	}
+}
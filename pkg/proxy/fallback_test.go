@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFallback(t *testing.T) {
+	page := strings.Repeat("a", 2*fallbackPeek)
+	for _, tt := range []struct {
+		name         string
+		primary      func(w http.ResponseWriter)
+		fallback     int
+		wantStatus   int
+		wantProvider string
+		wantBody     string
+	}{
+		{
+			name:         "the primary answer",
+			primary:      func(w http.ResponseWriter) { _, _ = io.WriteString(w, "Title: Example") },
+			wantStatus:   http.StatusOK,
+			wantProvider: "jina",
+			wantBody:     "Title: Example",
+		},
+		{
+			name: "a long primary answer",
+			primary: func(w http.ResponseWriter) {
+				for i := 0; i < len(page); i += 1000 {
+					_, _ = io.WriteString(w, page[i:min(i+1000, len(page))])
+				}
+			},
+			wantStatus:   http.StatusOK,
+			wantProvider: "jina",
+			wantBody:     page,
+		},
+		{
+			name:         "a blocked primary answer",
+			primary:      func(w http.ResponseWriter) { _, _ = io.WriteString(w, "Warning: Target URL returned error 403") },
+			fallback:     http.StatusOK,
+			wantStatus:   http.StatusOK,
+			wantProvider: "fetch",
+			wantBody:     "fetched",
+		},
+		{
+			name: "both failed",
+			primary: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				_, _ = io.WriteString(w, "primary error")
+			},
+			fallback:     http.StatusBadGateway,
+			wantStatus:   http.StatusUnprocessableEntity,
+			wantProvider: "jina",
+			wantBody:     "primary error",
+		},
+		{
+			name: "a primary error past the cap",
+			primary: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusBadGateway)
+				_, _ = io.WriteString(w, page)
+			},
+			fallback:     http.StatusBadGateway,
+			wantStatus:   http.StatusBadGateway,
+			wantProvider: "jina",
+			wantBody:     page[:3*fallbackPeek/2],
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fallbackCalled := false
+			f := NewFallback(
+				Provider{Name: "jina", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { tt.primary(w) })},
+				Provider{Name: "fetch", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					fallbackCalled = true
+					w.WriteHeader(tt.fallback)
+					_, _ = io.WriteString(w, "fetched")
+				})},
+				JinaBlocked, 3*fallbackPeek/2, slog.New(slog.NewTextHandler(io.Discard, nil)),
+			)
+			rec := httptest.NewRecorder()
+			f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jina/example.com", nil))
+			if rec.Code != tt.wantStatus || rec.Header().Get(ProviderHeader) != tt.wantProvider {
+				t.Errorf("got %d from %q, want %d from %q", rec.Code, rec.Header().Get(ProviderHeader), tt.wantStatus, tt.wantProvider)
+			}
+			if rec.Body.String() != tt.wantBody {
+				t.Errorf("got a body of %d bytes, want %d", rec.Body.Len(), len(tt.wantBody))
+			}
+			if fallbackCalled != (tt.fallback != 0) {
+				t.Errorf("fallback called %v", fallbackCalled)
+			}
+		})
+	}
+}
+
+// The primary answer is streamed once it's known not to be blocked, not held
+// until it ends.
+func TestFallbackStreamsThePrimaryAnswer(t *testing.T) {
+	rec := httptest.NewRecorder()
+	f := NewFallback(
+		Provider{Name: "jina", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, strings.Repeat("a", fallbackPeek))
+			if rec.Body.Len() != fallbackPeek {
+				t.Errorf("%d bytes sent after the peek, want %d", rec.Body.Len(), fallbackPeek)
+			}
+			_, _ = io.WriteString(w, "b")
+			if rec.Body.Len() != fallbackPeek+1 {
+				t.Errorf("%d bytes sent after the peek, want %d", rec.Body.Len(), fallbackPeek+1)
+			}
+		})},
+		Provider{Name: "fetch", Handler: http.NotFoundHandler()},
+		JinaBlocked, 0, slog.New(slog.NewTextHandler(io.Discard, nil)),
+	)
+	f.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jina/example.com", nil))
+}
+
+func TestFallbackRequestBodyCap(t *testing.T) {
+	called := false
+	f := NewFallback(
+		Provider{Name: "jina", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true })},
+		Provider{Name: "fetch", Handler: http.NotFoundHandler()},
+		JinaBlocked, 10, slog.New(slog.NewTextHandler(io.Discard, nil)),
+	)
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/jina/", strings.NewReader(`{"url":"https://example.com"}`)))
+	if rec.Code != http.StatusRequestEntityTooLarge || called {
+		t.Errorf("got %d, primary called %v, want 413", rec.Code, called)
+	}
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// RewriteFetchPath rewrites the request to fetch the target URL embedded in the path.
+// The prefix (e.g. "/fetch") is stripped first, and client credentials are removed
+// so they never leak to arbitrary hosts.
+//
+//	curl "https://cachev1.example.com/fetch/https://www.example.com" \
+//	 -H "Authorization: Bearer xxx"
+func RewriteFetchPath(prefix string) func(*httputil.ProxyRequest) {
+	return func(req *httputil.ProxyRequest) {
+		target, err := FetchTarget(strings.TrimPrefix(req.In.URL.Path, prefix), req.In.URL.RawQuery)
+		if err != nil {
+			// leave the host empty, the transport fails and the proxy answers 502
+			req.Out.URL = &url.URL{}
+			return
+		}
+		req.Out.URL = target
+		req.Out.Host = ""
+		req.Out.Header.Del("Authorization")
+		req.Out.Header.Del("X-API-KEY")
+		req.Out.Header.Del("Cookie")
+	}
+}
+
+// FetchTarget parses the target URL embedded in a path such as "/https://www.example.com".
+// Path cleaning may collapse "https://" into "https:/", which is repaired here.
+func FetchTarget(path, rawQuery string) (*url.URL, error) {
+	raw := strings.TrimPrefix(path, "/")
+	for _, scheme := range []string{"http:/", "https:/"} {
+		if strings.HasPrefix(raw, scheme) && !strings.HasPrefix(raw, scheme+"/") {
+			raw = scheme + "/" + strings.TrimPrefix(raw, scheme)
+		}
+	}
+	target, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", target.Scheme)
+	}
+	if target.Host == "" {
+		return nil, fmt.Errorf("missing host in %q", raw)
+	}
+	if rawQuery != "" {
+		target.RawQuery = rawQuery
+	}
+	return target, nil
+}
+
+// FetchPath is the reverse of FetchTarget, it returns the path under prefix
+// reading target as the router cleans it, e.g. "/fetch/https:/www.example.com/".
+func FetchPath(prefix string, target *url.URL) *url.URL {
+	raw := prefix + "/" + target.Scheme + "://" + target.Host + target.Path
+	if target.Path == "" {
+		raw += "/"
+	}
+	// as http.ServeMux does, the trailing slash is kept
+	cleaned := path.Clean(raw)
+	if strings.HasSuffix(raw, "/") {
+		cleaned += "/"
+	}
+	return &url.URL{Path: cleaned, RawQuery: target.RawQuery}
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GoogleCloudScope is the OAuth2 scope of the Google Cloud APIs, Vertex AI included.
+const GoogleCloudScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// googleMetadataToken is the token endpoint of the GCE/GKE/Cloud Run metadata server.
+const googleMetadataToken = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// googleKey is the part of a credentials file used, a service account key
+// or the authorized user of "gcloud auth application-default login".
+type googleKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// GoogleCredentials is a TokenSource of Google Application Default
+// Credentials: the GOOGLE_APPLICATION_CREDENTIALS file, the gcloud
+// application default credentials file, then the metadata server.
+type GoogleCredentials struct {
+	key    *googleKey
+	rsaKey *rsa.PrivateKey
+	scopes []string
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewGoogleCredentials finds the Application Default Credentials.
+func NewGoogleCredentials(scopes []string, transport http.RoundTripper) (*GoogleCredentials, error) {
+	g := &GoogleCredentials{scopes: scopes, client: &http.Client{Transport: transport, Timeout: 10 * time.Second}}
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return g, nil
+		}
+		path = filepath.Join(dir, "gcloud", "application_default_credentials.json")
+		if _, err := os.Stat(path); err != nil {
+			// on Google Cloud, the metadata server provides the tokens
+			return g, nil
+		}
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+	var key googleKey
+	if err := json.Unmarshal(b, &key); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	switch key.Type {
+	case "service_account":
+		block, _ := pem.Decode([]byte(key.PrivateKey))
+		if block == nil {
+			return nil, fmt.Errorf("%s: invalid private key", path)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("x509.ParsePKCS8PrivateKey: %w", err)
+		}
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: private key isn't RSA", path)
+		}
+		g.rsaKey = rsaKey
+	case "authorized_user":
+	default:
+		return nil, fmt.Errorf("%s: unsupported credentials type %q", path, key.Type)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	g.key = &key
+	return g, nil
+}
+
+// Token implements the TokenSource interface Token method.
+func (g *GoogleCredentials) Token(ctx context.Context) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.token != "" && time.Now().Before(g.expires) {
+		return g.token, nil
+	}
+
+	req, err := g.tokenRequest(ctx)
+	if err != nil {
+		return "", err
+	}
+	g.token, g.expires, err = requestToken(g.client, req)
+	if err != nil {
+		return "", err
+	}
+	return g.token, nil
+}
+
+func (g *GoogleCredentials) tokenRequest(ctx context.Context) (*http.Request, error) {
+	if g.key == nil {
+		u := googleMetadataToken
+		if len(g.scopes) > 0 {
+			u += "?scopes=" + url.QueryEscape(strings.Join(g.scopes, ","))
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, fmt.Errorf("http.NewRequest: %w", err)
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		return req, nil
+	}
+
+	form := url.Values{}
+	if g.rsaKey != nil {
+		assertion, err := g.assertion(time.Now())
+		if err != nil {
+			return nil, err
+		}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", assertion)
+	} else {
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", g.key.ClientID)
+		form.Set("client_secret", g.key.ClientSecret)
+		form.Set("refresh_token", g.key.RefreshToken)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.key.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// assertion returns the JWT a service account exchanges for a token, RFC 7523.
+func (g *GoogleCredentials) assertion(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": g.key.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   g.key.ClientEmail,
+		"scope": strings.Join(g.scopes, " "),
+		"aud":   g.key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, g.rsaKey, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("rsa.SignPKCS1v15: %w", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Invalidate implements the TokenSource interface Invalidate method.
+func (g *GoogleCredentials) Invalidate() {
+	g.mu.Lock()
+	g.token = ""
+	g.mu.Unlock()
+}
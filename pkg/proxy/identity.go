@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"runtime/debug"
+	"strings"
+)
+
+// Version stamps the default User-Agent, set at build time with
+// -ldflags "-X httpcache/pkg/proxy.Version=v1.2.3". It defaults to the
+// module version of the build.
+var Version = ""
+
+// DefaultUserAgent is the User-Agent of outbound requests without a configured
+// one, instead of Go's default.
+func DefaultUserAgent() string {
+	version := Version
+	if version == "" {
+		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "(devel)" {
+			version = info.Main.Version
+		}
+	}
+	if version == "" {
+		version = "dev"
+	}
+	return fmt.Sprintf("%s/%s (+https://github.com/Airren/poorman-httpcache)", RobotsUserAgent, version)
+}
+
+// Identity is how outbound requests to a provider identify us. Some scraping
+// targets and APIs require a contact or a registered User-Agent.
+type Identity struct {
+	// UserAgent replaces the client's User-Agent, the default one is only set
+	// when the client sent none.
+	UserAgent string
+	// From is the contact email address of the From header.
+	From string
+	// Header holds custom identification headers.
+	Header http.Header
+}
+
+// ParseIdentityHeaders parses headers such as "X-Contact: ops@example.com; X-Team: search".
+func ParseIdentityHeaders(s string) (http.Header, error) {
+	header := http.Header{}
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("identity header %q: expected \"Name: value\"", part)
+		}
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return header, nil
+}
+
+// Identify sets the identity headers of outbound requests.
+func Identify(id Identity) func(*httputil.ProxyRequest) {
+	defaultUserAgent := DefaultUserAgent()
+	return func(req *httputil.ProxyRequest) {
+		switch {
+		case id.UserAgent != "":
+			req.Out.Header.Set("User-Agent", id.UserAgent)
+		case req.Out.Header.Get("User-Agent") == "":
+			req.Out.Header.Set("User-Agent", defaultUserAgent)
+		}
+		if id.From != "" {
+			req.Out.Header.Set("From", id.From)
+		}
+		for name, values := range id.Header {
+			req.Out.Header[name] = values
+		}
+	}
+}
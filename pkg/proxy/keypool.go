@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http/httputil"
+	"sync/atomic"
+)
+
+// KeyPool is a set of upstream keys that can be replaced while serving,
+// e.g. from dynamic configuration. Requests pick a random key.
+type KeyPool struct {
+	keys atomic.Pointer[[]string]
+}
+
+// NewKeyPool creates a new KeyPool, empty keys are ignored.
+func NewKeyPool(keys ...string) *KeyPool {
+	p := &KeyPool{}
+	p.Set(keys)
+	return p
+}
+
+// Set replaces the keys of the pool.
+func (p *KeyPool) Set(keys []string) {
+	var nonEmpty []string
+	for _, key := range keys {
+		if key != "" {
+			nonEmpty = append(nonEmpty, key)
+		}
+	}
+	p.keys.Store(&nonEmpty)
+}
+
+// Len returns the number of keys in the pool.
+func (p *KeyPool) Len() int {
+	return len(*p.keys.Load())
+}
+
+// Pick returns a random key, or "" when the pool is empty.
+func (p *KeyPool) Pick() string {
+	keys := *p.keys.Load()
+	if len(keys) == 0 {
+		return ""
+	}
+	return keys[rand.Intn(len(keys))]
+}
+
+// PoolJinaKey rewrites the header to use a key of the pool.
+func PoolJinaKey(pool *KeyPool) func(*httputil.ProxyRequest) {
+	return func(req *httputil.ProxyRequest) {
+		req.Out.Header.Set("Authorization", fmt.Sprintf("Bearer %s", pool.Pick()))
+	}
+}
+
+// PoolSerperKey rewrites the header to use a key of the pool.
+func PoolSerperKey(pool *KeyPool) func(*httputil.ProxyRequest) {
+	return func(req *httputil.ProxyRequest) {
+		req.Out.Header.Set("X-API-KEY", pool.Pick())
+	}
+}
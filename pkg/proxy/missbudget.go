@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"expvar"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var missBudgetMetrics = expvar.NewMap("provider_miss_budget")
+
+// MissRate is a number of upstream calls per period.
+type MissRate struct {
+	Calls  int
+	Period time.Duration
+}
+
+// ParseMissBudgets parses budgets such as "jina=600/1m,serper=100/1m" into
+// the upstream calls allowed per period and provider.
+func ParseMissBudgets(s string) (map[string]MissRate, error) {
+	budgets := map[string]MissRate{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		provider, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("miss budget %q: missing '='", part)
+		}
+		calls, period, ok := strings.Cut(strings.TrimSpace(value), "/")
+		if !ok {
+			return nil, fmt.Errorf("miss budget %q: missing '/'", part)
+		}
+		n, err := strconv.Atoi(calls)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("miss budget %q: invalid calls %q", part, calls)
+		}
+		d, err := time.ParseDuration(period)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("miss budget %q: invalid period %q", part, period)
+		}
+		budgets[strings.TrimSpace(provider)] = MissRate{Calls: n, Period: d}
+	}
+	return budgets, nil
+}
+
+// MissBudget caps the rate of the upstream calls of a replica to a provider,
+// that is of the cache misses, so a cold cache doesn't spend a month of the
+// plan in an hour. It's a token bucket: the calls of a period may come in a
+// burst. Calls over it queue for their turn up to the queue timeout, or are
+// answered 503 right away with a queue timeout of 0.
+type MissBudget struct {
+	provider     string
+	rate         MissRate
+	queueTimeout time.Duration
+	logger       *slog.Logger
+
+	mu sync.Mutex
+	// tokens is negative when calls are queued
+	tokens float64
+	last   time.Time
+}
+
+// NewMissBudget creates a new MissBudget of rate calls to provider.
+func NewMissBudget(provider string, rate MissRate, queueTimeout time.Duration, logger *slog.Logger) *MissBudget {
+	return &MissBudget{
+		provider:     provider,
+		rate:         rate,
+		queueTimeout: queueTimeout,
+		logger:       logger,
+		tokens:       float64(rate.Calls),
+		last:         time.Now(),
+	}
+}
+
+// reserve takes the turn of a call, it returns how long to wait for it. No
+// turn is taken when the wait would be over the queue timeout.
+func (b *MissBudget) reserve(now time.Time) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	perSecond := float64(b.rate.Calls) / b.rate.Period.Seconds()
+	b.tokens = math.Min(float64(b.rate.Calls), b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+	var wait time.Duration
+	if b.tokens < 1 {
+		wait = time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	if wait > b.queueTimeout {
+		return wait, false
+	}
+	b.tokens--
+	return wait, true
+}
+
+// cancel gives back the turn of a call that didn't wait for it.
+func (b *MissBudget) cancel() {
+	b.mu.Lock()
+	b.tokens++
+	b.mu.Unlock()
+}
+
+// HTTPHandlerMiddleware waits for the turn of the call before calling next,
+// and answers 503 with a Retry-After when it's past the queue timeout.
+func (b *MissBudget) HTTPHandlerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wait, ok := b.reserve(time.Now())
+		if !ok {
+			missBudgetMetrics.Add(b.provider+"_rejected", 1)
+			b.logger.Warn("Provider miss budget exhausted", "provider", b.provider, "calls", b.rate.Calls, "period", b.rate.Period, "retry_after", wait)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, fmt.Sprintf("Too many uncached requests to %s", b.provider), http.StatusServiceUnavailable)
+			return
+		}
+		if wait > 0 {
+			missBudgetMetrics.Add(b.provider+"_queued", 1)
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+				missBudgetMetrics.Add(b.provider+"_wait_ms", wait.Milliseconds())
+			case <-r.Context().Done():
+				timer.Stop()
+				b.cancel()
+				return
+			}
+		}
+		missBudgetMetrics.Add(b.provider+"_calls", 1)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+//go:embed politeness.lua
+var politenessScript string
+
+// PolitenessScript is the Redis script for admitting a request to a target host
+var PolitenessScript = redis.NewScript(politenessScript)
+
+//go:embed politeness_release.lua
+var politenessReleaseScript string
+
+// PolitenessReleaseScript is the Redis script for releasing the in-flight slot
+// of a target host
+var PolitenessReleaseScript = redis.NewScript(politenessReleaseScript)
+
+// Politeness caps concurrent and per-second requests to each target host,
+// coordinated across replicas through Redis, so agents can't hammer a website.
+type Politeness struct {
+	redis       redis.Cmdable
+	prefix      string
+	maxInflight int
+	maxRate     int
+	inflightTTL time.Duration
+	logger      *slog.Logger
+}
+
+// NewPoliteness creates a new Politeness limiter for paths under prefix (e.g. "/fetch").
+// maxInflight is the concurrency cap and maxRate the requests per second cap per host,
+// 0 disables either cap.
+func NewPoliteness(rdb redis.Cmdable, prefix string, maxInflight, maxRate int, logger *slog.Logger) *Politeness {
+	return &Politeness{
+		redis:       rdb,
+		prefix:      prefix,
+		maxInflight: maxInflight,
+		maxRate:     maxRate,
+		inflightTTL: time.Minute,
+		logger:      logger,
+	}
+}
+
+// HTTPHandlerMiddleware answers 429 when the target host is over its caps.
+// Redis failures let the request through, politeness is best effort.
+func (p *Politeness) HTTPHandlerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target, err := FetchTarget(strings.TrimPrefix(r.URL.Path, p.prefix), r.URL.RawQuery)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		host := target.Hostname()
+
+		status, err := p.acquire(r.Context(), host)
+		if err != nil {
+			p.logger.Warn("Failed to check host politeness", "host", host, "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch status {
+		case "RATE_LIMITED", "BUSY":
+			p.logger.Info("Host politeness cap reached", "host", host, "status", status)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, fmt.Sprintf("Too many requests to %s", host), http.StatusTooManyRequests)
+			return
+		}
+
+		defer p.release(host)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (p *Politeness) acquire(ctx context.Context, host string) (string, error) {
+	second := time.Now().Unix()
+	keys := []string{
+		fmt.Sprintf("polite:inflight:%s", host),
+		fmt.Sprintf("polite:rate:%s:%d", host, second),
+	}
+	argv := []interface{}{
+		strconv.Itoa(p.maxInflight),
+		strconv.Itoa(p.maxRate),
+		strconv.Itoa(int(p.inflightTTL.Seconds())),
+	}
+	result, err := PolitenessScript.Run(ctx, p.redis, keys, argv...).Text()
+	if err != nil {
+		return "", fmt.Errorf("PolitenessScript.Run: %w", err)
+	}
+	return result, nil
+}
+
+func (p *Politeness) release(host string) {
+	if p.maxInflight <= 0 {
+		return
+	}
+	// the request context may be done already, release regardless
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := PolitenessReleaseScript.Run(ctx, p.redis, []string{fmt.Sprintf("polite:inflight:%s", host)}).Err(); err != nil {
+		p.logger.Warn("Failed to release host politeness slot", "host", host, "error", err)
+	}
+}
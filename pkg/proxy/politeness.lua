@@ -0,0 +1,27 @@
+-- All keys must be explicitly provided for Redis clustering compatibility
+local inflightKey = KEYS[1] -- Pre-constructed "polite:inflight:{host}" key
+local rateKey = KEYS[2]     -- Pre-constructed "polite:rate:{host}:{second}" key
+local maxInflight = tonumber(ARGV[1]) -- 0 disables the concurrency cap
+local maxRate = tonumber(ARGV[2])     -- 0 disables the rate cap
+local inflightTTL = tonumber(ARGV[3]) -- seconds, guards against replicas dying mid-request
+
+if maxRate > 0 then
+	local count = redis.call('INCR', rateKey)
+	if count == 1 then
+		redis.call('EXPIRE', rateKey, 2)
+	end
+	if count > maxRate then
+		return 'RATE_LIMITED'
+	end
+end
+
+if maxInflight > 0 then
+	local inflight = redis.call('INCR', inflightKey)
+	redis.call('EXPIRE', inflightKey, inflightTTL)
+	if inflight > maxInflight then
+		redis.call('DECR', inflightKey)
+		return 'BUSY'
+	end
+end
+
+return 'OK'
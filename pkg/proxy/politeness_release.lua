@@ -0,0 +1,11 @@
+-- All keys must be explicitly provided for Redis clustering compatibility
+local inflightKey = KEYS[1] -- Pre-constructed "polite:inflight:{host}" key
+
+-- the key expired or was released already when it's missing, a DECR would
+-- recreate it at -1 without a TTL and lift the cap of the host for good
+local inflight = tonumber(redis.call('GET', inflightKey))
+if inflight == nil or inflight <= 0 then
+	return 0
+end
+-- DECR keeps the TTL of the key
+return redis.call('DECR', inflightKey)
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestPolitenessReleaseKeepsTheCap(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	p := NewPoliteness(rdb, "/fetch", 1, 0, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ctx := context.Background()
+	key := "polite:inflight:example.com"
+
+	if status, err := p.acquire(ctx, "example.com"); err != nil || status != "OK" {
+		t.Fatalf("acquire = %q, %v", status, err)
+	}
+	if status, _ := p.acquire(ctx, "example.com"); status != "BUSY" {
+		t.Fatalf("second acquire = %q, want BUSY", status)
+	}
+	p.release("example.com")
+	if got, _ := mr.Get(key); got != "0" {
+		t.Errorf("in flight %q after the release, want 0", got)
+	}
+	if ttl := mr.TTL(key); ttl <= 0 {
+		t.Errorf("the release dropped the TTL, got %v", ttl)
+	}
+
+	// a slot released after its key expired isn't taken from the next request
+	if status, _ := p.acquire(ctx, "example.com"); status != "OK" {
+		t.Fatalf("acquire after the release = %q, want OK", status)
+	}
+	mr.FastForward(2 * p.inflightTTL)
+	p.release("example.com")
+	p.release("example.com")
+	if mr.Exists(key) {
+		got, _ := mr.Get(key)
+		t.Fatalf("the release of an expired slot left %q without a TTL", got)
+	}
+	if status, _ := p.acquire(ctx, "example.com"); status != "OK" {
+		t.Fatalf("acquire after the expiry = %q, want OK", status)
+	}
+	if status, _ := p.acquire(ctx, "example.com"); status != "BUSY" {
+		t.Errorf("second acquire after the expiry = %q, want BUSY", status)
+	}
+	if ttl := mr.TTL(key); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("TTL %v, want the in-flight TTL", ttl)
+	}
+}
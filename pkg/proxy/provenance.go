@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+)
+
+// Provenance headers set on upstream answers, the cache middleware moves
+// them into the cached entry. The key is a fingerprint, never the key itself.
+const (
+	UpstreamProviderHeader = "X-Upstream-Provider"
+	UpstreamKeyHeader      = "X-Upstream-Key"
+)
+
+// RecordProvenance marks upstream answers with the provider and a fingerprint
+// of the upstream key that served them.
+func RecordProvenance(provider string) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		resp.Header.Set(UpstreamProviderHeader, provider)
+		if resp.Request == nil {
+			return nil
+		}
+		key := resp.Request.Header.Get("X-API-KEY")
+		if key == "" {
+			key = strings.TrimPrefix(resp.Request.Header.Get("Authorization"), "Bearer ")
+		}
+		if key != "" {
+			resp.Header.Set(UpstreamKeyHeader, tollgate.KeyFingerprint(key))
+		}
+		return nil
+	}
+}
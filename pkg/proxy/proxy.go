@@ -2,6 +2,7 @@
 package proxy
 
 import (
+	"log"
 	"log/slog"
 	"net/http"
 	"net/http/httputil"
@@ -10,9 +11,13 @@ import (
 
 type Option func(rp *httputil.ReverseProxy) error
 
+// StatusClientClosedRequest is the status of requests whose client went away
+// before the answer, it's never seen by the client.
+const StatusClientClosedRequest = 499
+
 // New creates a new ReverseProxy with the given options.
 func New(opts ...Option) (*httputil.ReverseProxy, error) {
-	rp := &httputil.ReverseProxy{}
+	rp := &httputil.ReverseProxy{ErrorHandler: errorHandler}
 	for _, opt := range opts {
 		if err := opt(rp); err != nil {
 			return nil, err
@@ -21,6 +26,17 @@ func New(opts ...Option) (*httputil.ReverseProxy, error) {
 	return rp, nil
 }
 
+// errorHandler answers 502 Bad Gateway to upstream failures. Requests aborted
+// because the client went away aren't upstream failures.
+func errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if r.Context().Err() != nil {
+		w.WriteHeader(StatusClientClosedRequest)
+		return
+	}
+	log.Printf("http: proxy error: %v", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
 // WithTransport sets the transport for the ReverseProxy.
 func WithTransport(transport http.RoundTripper) Option {
 	return func(rp *httputil.ReverseProxy) error {
@@ -29,10 +45,21 @@ func WithTransport(transport http.RoundTripper) Option {
 	}
 }
 
-// WithModifyResponse sets the modify response function for the ReverseProxy.
+// WithModifyResponse adds a modify response function to the ReverseProxy.
+// Functions run in the order they were added, the first error stops the chain.
 func WithModifyResponse(modifyResponse func(*http.Response) error) Option {
 	return func(rp *httputil.ReverseProxy) error {
-		rp.ModifyResponse = modifyResponse
+		previous := rp.ModifyResponse
+		if previous == nil {
+			rp.ModifyResponse = modifyResponse
+			return nil
+		}
+		rp.ModifyResponse = func(resp *http.Response) error {
+			if err := previous(resp); err != nil {
+				return err
+			}
+			return modifyResponse(resp)
+		}
 		return nil
 	}
 }
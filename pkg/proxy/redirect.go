@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// FinalURLHeader is the URL an answer was read from after following the
+// redirects, set when there were any.
+const FinalURLHeader = "X-Final-URL"
+
+// maxRedirectDrain caps what's read from a redirect body to reuse its connection.
+const maxRedirectDrain = 64 << 10
+
+// redirectTransport follows the redirects of the upstream answers.
+type redirectTransport struct {
+	next    http.RoundTripper
+	maxHops int
+}
+
+// FollowRedirects follows up to maxHops redirects within the proxy, so the
+// cache stores the page rather than the redirect, and sets FinalURLHeader on
+// the answer. Redirects past maxHops, to other schemes than http and https,
+// or of requests with a body that can't be replayed are answered as is.
+func FollowRedirects(next http.RoundTripper, maxHops int) http.RoundTripper {
+	return &redirectTransport{next: next, maxHops: maxHops}
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	for hops := 0; err == nil; hops++ {
+		next, ok := t.redirect(req, resp, hops)
+		if !ok {
+			if hops > 0 {
+				resp.Header.Set(FinalURLHeader, req.URL.String())
+			}
+			return resp, nil
+		}
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxRedirectDrain))
+		resp.Body.Close()
+		req = next
+		resp, err = t.next.RoundTrip(req)
+	}
+	return nil, err
+}
+
+// redirect returns the request following the redirect resp, false when it's
+// not a redirect to follow.
+func (t *redirectTransport) redirect(req *http.Request, resp *http.Response, hops int) (*http.Request, bool) {
+	if hops >= t.maxHops {
+		return nil, false
+	}
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil, false
+	}
+	location, err := req.URL.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" || (location.Scheme != "http" && location.Scheme != "https") {
+		return nil, false
+	}
+
+	next := req.Clone(req.Context())
+	next.URL = location
+	next.Host = ""
+	keepMethod := resp.StatusCode == http.StatusTemporaryRedirect || resp.StatusCode == http.StatusPermanentRedirect
+	switch {
+	case keepMethod && req.Body != nil && req.Body != http.NoBody:
+		if req.GetBody == nil {
+			return nil, false
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, false
+		}
+		next.Body = body
+	case !keepMethod && req.Method != http.MethodGet && req.Method != http.MethodHead:
+		// as browsers do, the target is read with GET
+		next.Method = http.MethodGet
+		next.Body = nil
+		next.GetBody = nil
+		next.ContentLength = 0
+		next.Header.Del("Content-Type")
+		next.Header.Del("Content-Length")
+	}
+	if !strings.EqualFold(location.Hostname(), req.URL.Hostname()) {
+		// nothing meant for one host goes to another
+		next.Header.Del("Authorization")
+		next.Header.Del("Cookie")
+	}
+	return next, true
+}
@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Robots modes for the fetch path.
+const (
+	// RobotsEnforce refuses fetches disallowed by robots.txt with 403.
+	RobotsEnforce = "enforce"
+	// RobotsFlag serves disallowed fetches but marks them with RobotsHeader.
+	RobotsFlag = "flag"
+)
+
+// RobotsHeader is set to "disallowed" on answers robots.txt did not allow.
+const RobotsHeader = "X-Robots-Disallowed"
+
+// RobotsUserAgent is the token matched against robots.txt user-agent groups.
+const RobotsUserAgent = "poorman-httpcache"
+
+// Robots checks the target of a fetch against the robots.txt of its host.
+// robots.txt files are cached per host. As in RFC 9309, a robots.txt
+// answering 4xx allows everything, and one that is unreachable or answering
+// 5xx disallows everything until it's retried after robotsRetryTTL.
+type Robots struct {
+	prefix string
+	mode   string
+	ttl    time.Duration
+	client *http.Client
+	logger *slog.Logger
+
+	mu    sync.Mutex
+	rules map[string]robotsEntry
+}
+
+// maxRobotsHosts bounds the robots.txt files cached, the expired ones are
+// swept when it's reached, then any.
+const maxRobotsHosts = 10000
+
+// robotsRetryTTL is how long an unreachable robots.txt disallows its host.
+const robotsRetryTTL = time.Minute
+
+// disallowAll are the rules of an unreachable robots.txt.
+var disallowAll = []robotsRule{{allow: false, pattern: "/"}}
+
+type robotsEntry struct {
+	rules   []robotsRule
+	expires time.Time
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+// NewRobots creates a new Robots checker for paths under prefix (e.g. "/fetch").
+func NewRobots(prefix, mode string, ttl time.Duration, transport http.RoundTripper, logger *slog.Logger) *Robots {
+	return &Robots{
+		prefix: prefix,
+		mode:   mode,
+		ttl:    ttl,
+		client: &http.Client{Transport: transport, Timeout: 5 * time.Second},
+		logger: logger,
+		rules:  map[string]robotsEntry{},
+	}
+}
+
+// HTTPHandlerMiddleware refuses or flags fetches disallowed by robots.txt.
+func (rb *Robots) HTTPHandlerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target, err := FetchTarget(strings.TrimPrefix(r.URL.Path, rb.prefix), r.URL.RawQuery)
+		if err != nil || rb.Allowed(r.Context(), target) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rb.logger.Info("Fetch disallowed by robots.txt", "url", target.String(), "mode", rb.mode)
+		w.Header().Set(RobotsHeader, "disallowed")
+		if rb.mode == RobotsEnforce {
+			http.Error(w, "Disallowed by robots.txt", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Allowed reports whether robots.txt of the target host allows the fetch.
+func (rb *Robots) Allowed(ctx context.Context, target *url.URL) bool {
+	path := target.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if target.RawQuery != "" {
+		path += "?" + target.RawQuery
+	}
+
+	allowed, matched := true, -1
+	for _, rule := range rb.hostRules(ctx, target) {
+		if len(rule.pattern) < matched || !robotsMatch(rule.pattern, path) {
+			continue
+		}
+		// the longest pattern wins, allow wins a tie
+		if len(rule.pattern) > matched || rule.allow {
+			allowed, matched = rule.allow, len(rule.pattern)
+		}
+	}
+	return allowed
+}
+
+func (rb *Robots) hostRules(ctx context.Context, target *url.URL) []robotsRule {
+	origin := target.Scheme + "://" + target.Host
+	rb.mu.Lock()
+	entry, ok := rb.rules[origin]
+	rb.mu.Unlock()
+	if ok && entry.expires.After(time.Now()) {
+		return entry.rules
+	}
+
+	ttl := rb.ttl
+	rules, err := rb.load(ctx, origin)
+	if err != nil {
+		if ctx.Err() != nil {
+			// the client went away, the next fetch retries
+			return disallowAll
+		}
+		rb.logger.Debug("Failed to load robots.txt", "origin", origin, "error", err)
+		rules, ttl = disallowAll, min(ttl, robotsRetryTTL)
+	}
+	rb.mu.Lock()
+	rb.store(origin, robotsEntry{rules: rules, expires: time.Now().Add(ttl)})
+	rb.mu.Unlock()
+	return rules
+}
+
+// store caches the rules of origin, rb.mu is held.
+func (rb *Robots) store(origin string, entry robotsEntry) {
+	if _, ok := rb.rules[origin]; !ok && len(rb.rules) >= maxRobotsHosts {
+		now := time.Now()
+		for o, e := range rb.rules {
+			if !e.expires.After(now) {
+				delete(rb.rules, o)
+			}
+		}
+		// still full, drop some of the rest
+		for o := range rb.rules {
+			if len(rb.rules) < maxRobotsHosts*9/10 {
+				break
+			}
+			delete(rb.rules, o)
+		}
+	}
+	rb.rules[origin] = entry
+}
+
+func (rb *Robots) load(ctx context.Context, origin string) ([]robotsRule, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, origin+"/robots.txt", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", DefaultUserAgent())
+	resp, err := rb.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 500:
+		return nil, fmt.Errorf("robots.txt answered %d", resp.StatusCode)
+	case resp.StatusCode >= 400:
+		// a missing robots.txt allows everything
+		return nil, nil
+	}
+	return parseRobots(io.LimitReader(resp.Body, 512*1024), RobotsUserAgent), nil
+}
+
+// parseRobots returns the rules of the groups matching userAgent,
+// or of the "*" groups when no group names it.
+func parseRobots(r io.Reader, userAgent string) []robotsRule {
+	var specific, wildcard []robotsRule
+	// named is set once a group names userAgent, even one allowing everything
+	named := false
+	var agents []string
+	inRules := false
+	userAgent = strings.ToLower(userAgent)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		switch key {
+		case "user-agent":
+			// a user-agent after rules starts a new group
+			if inRules {
+				agents, inRules = nil, false
+			}
+			agent := strings.ToLower(value)
+			if agent == "" {
+				continue
+			}
+			if agent != "*" && strings.Contains(userAgent, agent) {
+				named = true
+			}
+			agents = append(agents, agent)
+		case "allow", "disallow":
+			inRules = true
+			// an empty disallow allows everything
+			if value == "" {
+				continue
+			}
+			rule := robotsRule{allow: key == "allow", pattern: value}
+			for _, agent := range agents {
+				switch {
+				case agent == "*":
+					wildcard = append(wildcard, rule)
+				case strings.Contains(userAgent, agent):
+					specific = append(specific, rule)
+				}
+			}
+		}
+	}
+	if named {
+		return specific
+	}
+	return wildcard
+}
+
+// robotsMatch matches a path against a robots.txt pattern with "*" and "$" wildcards.
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	rest := path[len(parts[0]):]
+	for _, part := range parts[1:] {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(part):]
+	}
+	if anchored && len(parts) > 1 {
+		return strings.HasSuffix(path, parts[len(parts)-1])
+	}
+	return !anchored || rest == ""
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseRobotsGroups(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		robots  string
+		allowed map[string]bool
+	}{
+		{
+			name:    "the group naming us wins over *",
+			robots:  "User-agent: *\nDisallow: /\n\nUser-agent: poorman-httpcache\nDisallow: /private\n",
+			allowed: map[string]bool{"/": true, "/private/a": false},
+		},
+		{
+			name:    "a group naming us with an empty disallow allows everything",
+			robots:  "User-agent: *\nDisallow: /\n\nUser-agent: poorman-httpcache\nDisallow:\n",
+			allowed: map[string]bool{"/": true, "/private/a": true},
+		},
+		{
+			name:    "an empty user-agent names nobody",
+			robots:  "User-agent:\nDisallow:\n\nUser-agent: *\nDisallow: /private\n",
+			allowed: map[string]bool{"/": true, "/private/a": false},
+		},
+		{
+			name:    "without a group naming us, the * group applies",
+			robots:  "User-agent: otherbot\nDisallow: /\n\nUser-agent: *\nDisallow: /private\n",
+			allowed: map[string]bool{"/": true, "/private/a": false},
+		},
+		{
+			name:    "the longest pattern wins",
+			robots:  "User-agent: *\nDisallow: /docs\nAllow: /docs/public\n",
+			allowed: map[string]bool{"/docs/a": false, "/docs/public/a": true},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rb := newTestRobots(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, tt.robots)
+			}))
+			for path, want := range tt.allowed {
+				if got := rb.allowed(t, path); got != want {
+					t.Errorf("Allowed(%s) = %v, want %v", path, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRobotsFetchErrors(t *testing.T) {
+	for _, tt := range []struct {
+		status  int
+		allowed bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusNotFound, true},
+		{http.StatusForbidden, true},
+		{http.StatusInternalServerError, false},
+		{http.StatusServiceUnavailable, false},
+	} {
+		t.Run(fmt.Sprint(tt.status), func(t *testing.T) {
+			rb := newTestRobots(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = io.WriteString(w, "User-agent: *\nDisallow: /\n")
+			}))
+			if got := rb.allowed(t, "/page"); got != tt.allowed {
+				t.Errorf("Allowed = %v, want %v", got, tt.allowed)
+			}
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		srv.Close()
+		rb := NewRobots("/fetch", RobotsEnforce, time.Hour, http.DefaultTransport, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		target, _ := url.Parse(srv.URL + "/page")
+		if rb.Allowed(context.Background(), target) {
+			t.Error("an unreachable robots.txt allowed the fetch")
+		}
+		entry := rb.rules[target.Scheme+"://"+target.Host]
+		if ttl := time.Until(entry.expires); ttl > robotsRetryTTL {
+			t.Errorf("an unreachable robots.txt is cached for %v, want a retry within %v", ttl, robotsRetryTTL)
+		}
+	})
+}
+
+func TestRobotsCacheIsBounded(t *testing.T) {
+	rb := NewRobots("/fetch", RobotsEnforce, time.Hour, http.DefaultTransport, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	expires := time.Now().Add(time.Hour)
+	for i := range maxRobotsHosts + 100 {
+		rb.store(fmt.Sprintf("https://host-%d.example.com", i), robotsEntry{expires: expires})
+	}
+	if n := len(rb.rules); n > maxRobotsHosts {
+		t.Errorf("%d robots.txt cached, want at most %d", n, maxRobotsHosts)
+	}
+	if _, ok := rb.rules[fmt.Sprintf("https://host-%d.example.com", maxRobotsHosts+99)]; !ok {
+		t.Error("the last robots.txt stored was dropped")
+	}
+}
+
+type testRobots struct {
+	*Robots
+	origin string
+}
+
+// newTestRobots returns a Robots whose targets are served robots.txt by h.
+func newTestRobots(t *testing.T, h http.Handler) testRobots {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return testRobots{
+		Robots: NewRobots("/fetch", RobotsEnforce, time.Hour, http.DefaultTransport, slog.New(slog.NewTextHandler(io.Discard, nil))),
+		origin: srv.URL,
+	}
+}
+
+func (rb testRobots) allowed(t *testing.T, path string) bool {
+	t.Helper()
+	target, err := url.Parse(rb.origin + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rb.Allowed(context.Background(), target)
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/jsonschema"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+)
+
+var schemaMetrics = expvar.NewMap("provider_schema")
+
+// ErrorInvalidResponse is the code of the answers failing the schema of
+// their provider, malformed or truncated.
+const ErrorInvalidResponse = "invalid_response"
+
+// ParseSchemas parses schemas such as "serper=/etc/cachev1/serper.json" into
+// the compiled schema of each provider.
+func ParseSchemas(s string) (map[string]*jsonschema.Schema, error) {
+	schemas := map[string]*jsonschema.Schema{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		provider, path, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("schema %q: missing '='", part)
+		}
+		schema, err := jsonschema.Load(os.ExpandEnv(strings.TrimSpace(path)))
+		if err != nil {
+			return nil, fmt.Errorf("schema %q: %w", part, err)
+		}
+		schemas[strings.TrimSpace(provider)] = schema
+	}
+	return schemas, nil
+}
+
+// SchemaCheck validates the successful JSON answers of a provider against its
+// schema before they reach the cache, so malformed or truncated ones are
+// never stored. Invalid answers are retried up to retries times, then
+// answered 502 with the problems found. The answers are buffered, it doesn't
+// suit streamed ones.
+type SchemaCheck struct {
+	provider string
+	schema   *jsonschema.Schema
+	retries  int
+	logger   *slog.Logger
+}
+
+// NewSchemaCheck creates a new SchemaCheck of provider.
+func NewSchemaCheck(provider string, schema *jsonschema.Schema, retries int, logger *slog.Logger) *SchemaCheck {
+	return &SchemaCheck{provider: provider, schema: schema, retries: max(retries, 0), logger: logger}
+}
+
+// HTTPHandlerMiddleware calls next until its answer is valid, or the retries
+// are spent.
+func (s *SchemaCheck) HTTPHandlerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Buffer the request body so it can be replayed
+		var body []byte
+		if r.Body != nil {
+			var err error
+			body, err = io.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				http.Error(w, "Failed to read request body", http.StatusBadRequest)
+				return
+			}
+		}
+
+		var problems []string
+		for attempt := 0; attempt <= s.retries; attempt++ {
+			try := r.Clone(r.Context())
+			try.Body = io.NopCloser(bytes.NewReader(body))
+			answer := newBufferedWriter()
+			next.ServeHTTP(answer, try)
+			if r.Context().Err() != nil {
+				w.WriteHeader(StatusClientClosedRequest)
+				return
+			}
+			if problems = s.check(answer); len(problems) == 0 {
+				maps.Copy(w.Header(), answer.header)
+				w.WriteHeader(answer.statusCode)
+				_, _ = w.Write(answer.body.Bytes())
+				return
+			}
+			schemaMetrics.Add(s.provider+"_invalid", 1)
+			s.logger.Warn("Provider answer fails its schema", "provider", s.provider, "url", r.URL.String(), "attempt", attempt+1, "problems", problems)
+		}
+
+		schemaMetrics.Add(s.provider+"_rejected", 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(tollgate.ErrorCodeHeader, ErrorInvalidResponse)
+		w.WriteHeader(http.StatusBadGateway)
+		if err := json.NewEncoder(w).Encode(map[string]any{
+			"error":    fmt.Sprintf("%s answered an invalid response", s.provider),
+			"attempts": s.retries + 1,
+			"problems": problems,
+		}); err != nil {
+			// response was already committed, nothing left to do
+			_ = err
+		}
+	})
+}
+
+// check returns the problems of a successful JSON answer, errors and other
+// types pass as they are.
+func (s *SchemaCheck) check(answer *bufferedWriter) []string {
+	if answer.statusCode < 200 || answer.statusCode >= 300 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(answer.header.Get("Content-Type"))
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return nil
+	}
+	return s.schema.Validate(answer.body.Bytes())
+}
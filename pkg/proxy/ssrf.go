@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// sharedAddressSpace is the carrier-grade NAT range, not global either.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// PublicAddress reports whether ip is reachable on the internet, i.e. not a
+// loopback, private, link-local (e.g. 169.254.169.254), unspecified or multicast address.
+func PublicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsValid() && ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// RefusePrivate is a net.Dialer Control refusing the connections to addresses
+// that aren't public. It runs after the DNS resolution, so names resolving to
+// private addresses, e.g. metadata.google.internal, are refused too.
+func RefusePrivate(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("refused %s connection to %q: %w", network, address, err)
+	}
+	if !PublicAddress(addrPort.Addr()) {
+		return fmt.Errorf("refused %s connection to non-public address %s", network, addrPort.Addr())
+	}
+	return nil
+}
+
+// PublicDialer returns a dialer connecting to public addresses only.
+func PublicDialer() *net.Dialer {
+	return &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: RefusePrivate}
+}
+
+// PublicTransport returns a copy of the default transport connecting to
+// public addresses only, for the requests to URLs the clients choose. The
+// proxies of the environment aren't used, the connections would go to them.
+func PublicTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = PublicDialer().DialContext
+	return transport
+}
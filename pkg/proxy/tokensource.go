@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenSource provides the access tokens of an upstream.
+type TokenSource interface {
+	// Token returns a valid access token, fetching a new one when needed.
+	Token(ctx context.Context) (string, error)
+	// Invalidate drops the current token, e.g. after the upstream refused it.
+	Invalidate()
+}
+
+// expiryMargin renews tokens this long before they expire.
+const expiryMargin = 30 * time.Second
+
+// ClientCredentials is an OAuth2 client credentials TokenSource (RFC 6749 4.4).
+type ClientCredentials struct {
+	tokenURL     string
+	clientID     string
+	clientSecret string
+	scopes       []string
+	client       *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// NewClientCredentials creates a new ClientCredentials source requesting
+// tokens from tokenURL.
+func NewClientCredentials(tokenURL, clientID, clientSecret string, scopes []string, transport http.RoundTripper) *ClientCredentials {
+	return &ClientCredentials{
+		tokenURL:     tokenURL,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		scopes:       scopes,
+		client:       &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}
+}
+
+// Token implements the TokenSource interface Token method. Concurrent
+// callers wait for a single token request.
+func (c *ClientCredentials) Token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Now().Before(c.expires) {
+		return c.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.scopes) > 0 {
+		form.Set("scope", strings.Join(c.scopes, " "))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("http.NewRequest: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(c.clientID), url.QueryEscape(c.clientSecret))
+	c.token, c.expires, err = requestToken(c.client, req)
+	if err != nil {
+		return "", err
+	}
+	return c.token, nil
+}
+
+// requestToken sends a token request and reads the OAuth2 token answer.
+func requestToken(client *http.Client, req *http.Request) (string, time.Time, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("client.Do: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("io.ReadAll: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("token endpoint answered %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var answer struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &answer); err != nil {
+		return "", time.Time{}, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	if answer.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("token endpoint answered without an access token")
+	}
+	if answer.TokenType != "" && !strings.EqualFold(answer.TokenType, "bearer") {
+		return "", time.Time{}, fmt.Errorf("unsupported token type %q", answer.TokenType)
+	}
+	// tokens without a lifetime are kept until the upstream refuses them
+	expires := time.Now().Add(24 * time.Hour)
+	if answer.ExpiresIn > 0 {
+		expires = time.Now().Add(time.Duration(answer.ExpiresIn)*time.Second - expiryMargin)
+	}
+	return answer.AccessToken, expires, nil
+}
+
+// Invalidate implements the TokenSource interface Invalidate method.
+func (c *ClientCredentials) Invalidate() {
+	c.mu.Lock()
+	c.token = ""
+	c.mu.Unlock()
+}
+
+// TokenTransport sets the bearer token of a TokenSource on the outbound
+// requests, replacing the Authorization set by the rewrites. A refused token
+// is dropped, so the next request fetches a new one.
+type TokenTransport struct {
+	next   http.RoundTripper
+	source TokenSource
+}
+
+// NewTokenTransport creates a new TokenTransport around next.
+func NewTokenTransport(next http.RoundTripper, source TokenSource) *TokenTransport {
+	return &TokenTransport{next: next, source: source}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *TokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	token, err := t.source.Token(r.Context())
+	if err != nil {
+		return nil, fmt.Errorf("TokenSource.Token: %w", err)
+	}
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+token)
+	resp, err := t.next.RoundTrip(r)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		t.source.Invalidate()
+	}
+	return resp, err
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// VertexTarget returns the regional endpoint of Vertex AI, e.g.
+// "https://us-central1-aiplatform.googleapis.com".
+func VertexTarget(location string) (*url.URL, error) {
+	if location == "global" {
+		return url.Parse("https://aiplatform.googleapis.com")
+	}
+	return url.Parse(fmt.Sprintf("https://%s-aiplatform.googleapis.com", location))
+}
+
+// RewriteVertexPath rewrites model calls to the publisher models of a project.
+// The token is set by a TokenTransport of GoogleCredentials.
+//
+//	curl "https://cachev1.example.com/vertex/gemini-2.0-flash:generateContent" \
+//	 -H "Authorization: Bearer xxx" \
+//	 -d '{"contents":[{"role":"user","parts":[{"text":"Hello"}]}]}'
+//
+// is sent to
+//
+//	https://{location}-aiplatform.googleapis.com/v1/projects/{project}/locations/{location}/publishers/google/models/gemini-2.0-flash:generateContent
+func RewriteVertexPath(target *url.URL, project, location string) func(*httputil.ProxyRequest) {
+	prefix := fmt.Sprintf("/v1/projects/%s/locations/%s/publishers/google/models/", url.PathEscape(project), url.PathEscape(location))
+	return func(req *httputil.ProxyRequest) {
+		req.SetURL(target)
+		model := strings.TrimPrefix(req.In.URL.Path, "/vertex/")
+		req.Out.URL.Path = prefix + model
+		req.Out.URL.RawPath = ""
+		// the client's credentials are our keys, the transport sets the upstream token
+		req.Out.Header.Del("Authorization")
+	}
+}
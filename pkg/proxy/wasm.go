@@ -0,0 +1,367 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/Airren/poorman-httpcache/v2/pkg/wasm"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var wasmMetrics = expvar.NewMap("wasm_filters")
+
+// maxFilterBody caps the bodies passed to filters, larger bodies and
+// streamed answers aren't filtered.
+const maxFilterBody = 1 << 20
+
+// filterMessage is the JSON message exchanged with filters. Requests have a
+// method, path, query, headers and body; answers a status, headers and body.
+type filterMessage struct {
+	Method  string      `json:"method,omitempty"`
+	Path    string      `json:"path,omitempty"`
+	Query   string      `json:"query,omitempty"`
+	Status  int         `json:"status,omitempty"`
+	Headers http.Header `json:"headers,omitempty"`
+	// Body is omitted when it isn't UTF-8 text or is over maxFilterBody.
+	Body *string `json:"body,omitempty"`
+}
+
+// WASMFilter transforms requests and answers with a WebAssembly module built
+// for wasip1 as a reactor, e.g. with GOOS=wasip1 go build -buildmode=c-shared.
+// The module exports:
+//
+//   - alloc(size i32) i32, a buffer the input message is written to
+//   - on_request(ptr i32, size i32) i64 and/or on_response(ptr i32, size i32) i64
+//
+// The input is a JSON filterMessage. The result packs the address and size
+// of the output message, ptr<<32 | size, which stays valid until the next
+// call; 0 keeps the message unchanged. The fields present in the output
+// replace those of the input, and a status returned by on_request answers
+// the request without forwarding it.
+//
+// Every call runs under an instruction budget, a memory cap and a timeout. A
+// failing filter fails the request rather than letting it through unfiltered.
+type WASMFilter struct {
+	name       string
+	module     *wasm.Module
+	limits     wasm.Limits
+	timeout    time.Duration
+	onRequest  bool
+	onResponse bool
+	// instances holds the idle instances, an instance runs one call at a time
+	instances chan *wasm.Instance
+	logger    *slog.Logger
+}
+
+// LoadWASMFilter compiles the filter module at path.
+func LoadWASMFilter(path string, limits wasm.Limits, timeout time.Duration, logger *slog.Logger) (*WASMFilter, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+	module, err := wasm.Compile(b)
+	if err != nil {
+		return nil, fmt.Errorf("wasm.Compile: %w", err)
+	}
+	f := &WASMFilter{
+		name:      strings.TrimSuffix(filepath.Base(path), ".wasm"),
+		module:    module,
+		limits:    limits,
+		timeout:   timeout,
+		instances: make(chan *wasm.Instance, runtime.GOMAXPROCS(0)),
+		logger:    logger,
+	}
+	if _, ok := module.ExportedFunc("alloc"); !ok {
+		return nil, fmt.Errorf("%s doesn't export alloc", path)
+	}
+	_, f.onRequest = module.ExportedFunc("on_request")
+	_, f.onResponse = module.ExportedFunc("on_response")
+	if !f.onRequest && !f.onResponse {
+		return nil, fmt.Errorf("%s exports neither on_request nor on_response", path)
+	}
+	// instantiate one now, so broken modules fail at startup
+	in, err := f.instance()
+	if err != nil {
+		return nil, err
+	}
+	f.release(in)
+	return f, nil
+}
+
+// instance returns an idle instance, or a new one.
+func (f *WASMFilter) instance() (*wasm.Instance, error) {
+	select {
+	case in := <-f.instances:
+		return in, nil
+	default:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+	in, err := f.module.Instantiate(ctx, wasm.WASI(&filterLog{name: f.name, logger: f.logger}), f.limits)
+	if err != nil {
+		return nil, fmt.Errorf("Instantiate: %w", err)
+	}
+	if _, ok := f.module.ExportedFunc("_initialize"); ok {
+		if _, err := in.Call(ctx, "_initialize"); err != nil {
+			return nil, fmt.Errorf("_initialize: %w", err)
+		}
+	}
+	wasmMetrics.Add(f.name+"_instances", 1)
+	return in, nil
+}
+
+func (f *WASMFilter) release(in *wasm.Instance) {
+	select {
+	case f.instances <- in:
+	default:
+	}
+}
+
+// call passes msg to the export fn, and applies its output to msg.
+func (f *WASMFilter) call(ctx context.Context, fn string, msg *filterMessage) error {
+	input, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	in, err := f.instance()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, f.timeout)
+	defer cancel()
+	start := time.Now()
+	output, err := f.exchange(ctx, in, fn, input)
+	wasmMetrics.Add(f.name+"_"+fn, 1)
+	wasmMetrics.Add(f.name+"_"+fn+"_us", time.Since(start).Microseconds())
+	if err != nil {
+		// a trapped instance may be left in any state
+		wasmMetrics.Add(f.name+"_errors", 1)
+		return err
+	}
+	f.release(in)
+	if output == nil {
+		return nil
+	}
+	var out filterMessage
+	if err := json.Unmarshal(output, &out); err != nil {
+		return fmt.Errorf("%s output: %w", fn, err)
+	}
+	if out.Method != "" {
+		msg.Method = out.Method
+	}
+	if out.Path != "" {
+		msg.Path = out.Path
+	}
+	if out.Query != "" {
+		msg.Query = out.Query
+	}
+	if out.Status != 0 {
+		msg.Status = out.Status
+	}
+	if out.Headers != nil {
+		msg.Headers = out.Headers
+	}
+	if out.Body != nil {
+		msg.Body = out.Body
+	}
+	return nil
+}
+
+func (f *WASMFilter) exchange(ctx context.Context, in *wasm.Instance, fn string, input []byte) ([]byte, error) {
+	results, err := in.Call(ctx, "alloc", uint64(len(input)))
+	if err != nil {
+		return nil, fmt.Errorf("alloc: %w", err)
+	}
+	ptr := uint32(results[0])
+	if err := in.Write(ptr, input); err != nil {
+		return nil, fmt.Errorf("alloc: %w", err)
+	}
+	results, err = in.Call(ctx, fn, uint64(ptr), uint64(len(input)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	if len(results) != 1 {
+		return nil, fmt.Errorf("%s: expected an i64 result", fn)
+	}
+	if results[0] == 0 {
+		return nil, nil
+	}
+	output, err := in.Read(uint32(results[0]>>32), uint32(results[0]))
+	if err != nil {
+		return nil, fmt.Errorf("%s output: %w", fn, err)
+	}
+	return bytes.Clone(output), nil
+}
+
+// filterBody returns body as a message body, nil when it can't be passed.
+func filterBody(body []byte) *string {
+	if len(body) > maxFilterBody || !utf8.Valid(body) {
+		return nil
+	}
+	s := string(body)
+	return &s
+}
+
+// HTTPHandlerMiddleware filters the requests before next, and its answers.
+func (f *WASMFilter) HTTPHandlerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f.onRequest {
+			if !f.filterRequest(w, r) {
+				return
+			}
+		}
+		if !f.onResponse {
+			next.ServeHTTP(w, r)
+			return
+		}
+		fw := &filterWriter{ResponseWriter: w}
+		next.ServeHTTP(fw, r)
+		if fw.passthrough {
+			return
+		}
+		if fw.status == 0 {
+			fw.status = http.StatusOK
+		}
+		msg := &filterMessage{Status: fw.status, Headers: w.Header().Clone(), Body: filterBody(fw.body.Bytes())}
+		if msg.Body == nil {
+			w.WriteHeader(fw.status)
+			w.Write(fw.body.Bytes())
+			return
+		}
+		if err := f.call(r.Context(), "on_response", msg); err != nil {
+			f.logger.Error("WASM filter failed", "filter", f.name, "error", err)
+			http.Error(w, "Filter failed", http.StatusInternalServerError)
+			return
+		}
+		for name := range w.Header() {
+			w.Header().Del(name)
+		}
+		for name, values := range msg.Headers {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(*msg.Body)))
+		w.WriteHeader(msg.Status)
+		io.WriteString(w, *msg.Body)
+	})
+}
+
+// filterRequest applies on_request to r, it returns false when the filter
+// answered the request.
+func (f *WASMFilter) filterRequest(w http.ResponseWriter, r *http.Request) bool {
+	msg := &filterMessage{Method: r.Method, Path: r.URL.Path, Query: r.URL.RawQuery, Headers: r.Header.Clone()}
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxFilterBody+1))
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return false
+		}
+		// bodies over the cap are forwarded unfiltered
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		msg.Body = filterBody(body)
+	}
+	original := msg.Body
+	if err := f.call(r.Context(), "on_request", msg); err != nil {
+		f.logger.Error("WASM filter failed", "filter", f.name, "error", err)
+		http.Error(w, "Filter failed", http.StatusInternalServerError)
+		return false
+	}
+	if msg.Status != 0 {
+		for name, values := range msg.Headers {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(msg.Status)
+		if msg.Body != nil && msg.Body != original {
+			io.WriteString(w, *msg.Body)
+		}
+		return false
+	}
+	r.Method = msg.Method
+	r.URL.Path = msg.Path
+	r.URL.RawPath = ""
+	r.URL.RawQuery = msg.Query
+	r.Header = msg.Headers
+	if msg.Body != original {
+		r.Body = io.NopCloser(strings.NewReader(*msg.Body))
+		r.ContentLength = int64(len(*msg.Body))
+		r.Header.Set("Content-Length", strconv.Itoa(len(*msg.Body)))
+	}
+	return true
+}
+
+// filterWriter holds an answer for on_response. Streams and answers over
+// maxFilterBody pass through unfiltered.
+type filterWriter struct {
+	http.ResponseWriter
+	status      int
+	body        bytes.Buffer
+	passthrough bool
+}
+
+func (w *filterWriter) WriteHeader(code int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = code
+	length, _ := strconv.Atoi(w.Header().Get("Content-Length"))
+	if strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") || length > maxFilterBody {
+		w.passthrough = true
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *filterWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.passthrough {
+		return w.ResponseWriter.Write(b)
+	}
+	if w.body.Len()+len(b) > maxFilterBody {
+		w.passthrough = true
+		w.ResponseWriter.WriteHeader(w.status)
+		if _, err := w.ResponseWriter.Write(w.body.Bytes()); err != nil {
+			return 0, err
+		}
+		return w.ResponseWriter.Write(b)
+	}
+	return w.body.Write(b)
+}
+
+func (w *filterWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok && w.passthrough {
+		flusher.Flush()
+	}
+}
+
+func (w *filterWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// filterLog logs what filters write to stdout and stderr.
+type filterLog struct {
+	name   string
+	logger *slog.Logger
+}
+
+func (l *filterLog) Write(b []byte) (int, error) {
+	if line := strings.TrimSpace(string(b)); line != "" {
+		l.logger.Info("WASM filter output", "filter", l.name, "output", line)
+	}
+	return len(b), nil
+}
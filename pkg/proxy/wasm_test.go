@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/internal/wasmtest"
+	"github.com/Airren/poorman-httpcache/v2/pkg/wasm"
+)
+
+func TestWASMFilterDiscardsTrappedInstances(t *testing.T) {
+	// on_request traps the first time it's called on an instance, and lets
+	// the requests through afterwards: an instance that trapped, reused,
+	// would let them through.
+	module := wasmtest.Module{
+		Memory:  &wasmtest.Memory{Min: 1},
+		Globals: 1,
+		Funcs: []wasmtest.Func{
+			{Export: "alloc", Params: []byte{wasm.I32}, Results: []byte{wasm.I32}, Code: wasmtest.I32Const(1024)},
+			{
+				Export: "on_request", Params: []byte{wasm.I32, wasm.I32}, Results: []byte{wasm.I64},
+				Code: wasmtest.Code(
+					[]byte{0x23, 0x00, 0x04, 0x40}, wasmtest.I64Const(0), []byte{0x0F, 0x0B},
+					wasmtest.I32Const(1), []byte{0x24, 0x00, 0x00},
+				),
+			},
+		},
+	}
+	path := filepath.Join(t.TempDir(), "trap.wasm")
+	if err := os.WriteFile(path, module.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	f, err := LoadWASMFilter(path, wasm.Limits{Fuel: 1 << 20}, time.Second, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := f.HTTPHandlerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("forwarded"))
+	}))
+	for i := range 3 {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("request %d: got %d %q, want the filter to fail", i, w.Code, w.Body)
+		}
+	}
+}
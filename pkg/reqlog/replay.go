@@ -0,0 +1,197 @@
+package reqlog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/cache"
+	"github.com/Airren/poorman-httpcache/v2/pkg/proxy"
+)
+
+// excerpt is the size of the body excerpts around the first difference.
+const excerpt = 200
+
+// Replayer re-executes logged requests against upstream, bypassing the cache,
+// and diffs the answer against the cached one, to triage stale answers.
+//
+//	curl -X POST "https://cachev1.example.com/admin/debug/replay" \
+//	 -H "X-Admin-Key: xxx" \
+//	 --data '{"request_id":"1a2b3c4d-0011223344556677"}'
+type Replayer struct {
+	recorder    *Recorder
+	cache       *cache.Cache
+	handler     http.Handler
+	internalKey string
+	logger      *slog.Logger
+}
+
+// NewReplayer creates a new Replayer serving the requests through handler,
+// authenticated with the internal key.
+func NewReplayer(recorder *Recorder, cache *cache.Cache, handler http.Handler, internalKey string, logger *slog.Logger) *Replayer {
+	return &Replayer{
+		recorder:    recorder,
+		cache:       cache,
+		handler:     handler,
+		internalKey: internalKey,
+		logger:      logger,
+	}
+}
+
+// ReplayRequest is the body of POST /admin/debug/replay.
+type ReplayRequest struct {
+	RequestID string `json:"request_id"`
+}
+
+// Answer summarizes one side of the diff.
+type Answer struct {
+	Status int               `json:"status"`
+	Header map[string]string `json:"header,omitempty"`
+	Size   int               `json:"size"`
+	SHA256 string            `json:"sha256,omitempty"`
+}
+
+// HeaderChange is a header that differs between the cached and replayed answers.
+type HeaderChange struct {
+	Name     string `json:"name"`
+	Cached   string `json:"cached,omitempty"`
+	Replayed string `json:"replayed,omitempty"`
+}
+
+// BodyDiff locates the first difference between the bodies.
+type BodyDiff struct {
+	Equal bool `json:"equal"`
+	// Offset is the byte offset of the first difference, -1 when equal.
+	Offset   int    `json:"offset"`
+	Cached   string `json:"cached,omitempty"`
+	Replayed string `json:"replayed,omitempty"`
+}
+
+// Report is the answer of POST /admin/debug/replay.
+type Report struct {
+	Request  Entry          `json:"request"`
+	Previous Answer         `json:"previous"`
+	Cached   *Answer        `json:"cached"`
+	Replayed Answer         `json:"replayed"`
+	Headers  []HeaderChange `json:"headers,omitempty"`
+	Body     *BodyDiff      `json:"body,omitempty"`
+}
+
+// ServeHTTP handles POST /admin/debug/replay.
+func (rp *Replayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req ReplayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RequestID == "" {
+		http.Error(w, "Missing or invalid request_id", http.StatusBadRequest)
+		return
+	}
+	entry, err := rp.recorder.Get(r.Context(), req.RequestID)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if entry.BodyHash != "" {
+		http.Error(w, "Request body not kept in privacy mode, it can't be replayed", http.StatusUnprocessableEntity)
+		return
+	}
+	if entry.Truncated {
+		http.Error(w, fmt.Sprintf("Request body longer than the %d bytes kept, it can't be replayed", maxBody), http.StatusUnprocessableEntity)
+		return
+	}
+
+	headers := map[string]string{}
+	for k, v := range entry.Header {
+		headers[k] = v
+	}
+	// logged requests don't keep credentials
+	headers["Authorization"] = "Bearer " + rp.internalKey
+	headers["X-API-KEY"] = rp.internalKey
+	sub := proxy.BatchRequest{Method: entry.Method, Path: entry.URL, Headers: headers, Body: entry.Body}
+
+	report := Report{
+		Request:  entry,
+		Previous: Answer{Status: entry.Status, Size: int(entry.Size)},
+	}
+	var cachedBody []byte
+	if cached, err := http.NewRequestWithContext(r.Context(), sub.Method, sub.Path, bytes.NewReader([]byte(sub.Body))); err == nil {
+		if response, value, ok := rp.cache.Cached(r.Context(), cached); ok {
+			report.Cached = &Answer{Status: http.StatusOK, Header: flatten(response.Header), Size: len(value), SHA256: digest(value)}
+			cachedBody = value
+		}
+	}
+
+	replayed := proxy.Do(cache.Bypass(r.Context()), rp.handler, sub, r.RemoteAddr)
+	report.Replayed = Answer{Status: replayed.Status, Header: replayed.Headers, Size: len(replayed.Body), SHA256: digest([]byte(replayed.Body))}
+	if report.Cached != nil {
+		report.Headers = diffHeaders(report.Cached.Header, replayed.Headers)
+		report.Body = diffBody(cachedBody, []byte(replayed.Body))
+	}
+	rp.logger.Info("Request replayed", "request_id", entry.ID, "url", entry.URL, "status", replayed.Status, "cached", report.Cached != nil)
+	writeJSON(w, http.StatusOK, report)
+}
+
+func flatten(header http.Header) map[string]string {
+	m := make(map[string]string, len(header))
+	for k := range header {
+		m[k] = header.Get(k)
+	}
+	return m
+}
+
+func digest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// volatileHeaders change on every answer, they are left out of the diff.
+var volatileHeaders = map[string]bool{
+	"Date":         true,
+	"Expires":      true,
+	"Age":          true,
+	"X-Request-Id": true,
+}
+
+func diffHeaders(cached, replayed map[string]string) []HeaderChange {
+	names := map[string]bool{}
+	for k := range cached {
+		names[k] = true
+	}
+	for k := range replayed {
+		names[k] = true
+	}
+	var changes []HeaderChange
+	for name := range names {
+		if volatileHeaders[name] || cached[name] == replayed[name] {
+			continue
+		}
+		changes = append(changes, HeaderChange{Name: name, Cached: cached[name], Replayed: replayed[name]})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes
+}
+
+func diffBody(cached, replayed []byte) *BodyDiff {
+	if bytes.Equal(cached, replayed) {
+		return &BodyDiff{Equal: true, Offset: -1}
+	}
+	offset := 0
+	for offset < len(cached) && offset < len(replayed) && cached[offset] == replayed[offset] {
+		offset++
+	}
+	start := max(offset-excerpt/2, 0)
+	return &BodyDiff{
+		Offset:   offset,
+		Cached:   fmt.Sprintf("%q", cached[start:min(start+excerpt, len(cached))]),
+		Replayed: fmt.Sprintf("%q", replayed[start:min(start+excerpt, len(replayed))]),
+	}
+}
@@ -0,0 +1,352 @@
+// Package reqlog records the detailed requests of the keys whose owners opted
+// in, for a limited window, so they can debug their agent's calls themselves.
+//
+// Keys are identified by their fingerprint, see tollgate.KeyFingerprint. Owners
+// authenticate with the key itself, a valid key of the MetaStore, and may use
+// "me" as the id:
+//
+//	curl -X POST "https://cachev1.example.com/admin/keys/me/requests/logging?window=1h" -H "Authorization: Bearer xxx"
+//	curl "https://cachev1.example.com/admin/keys/me/requests" -H "Authorization: Bearer xxx"
+//	curl "https://cachev1.example.com/admin/keys/{id}/requests" -H "X-Admin-Key: xxx"
+package reqlog
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/adminauth"
+	"github.com/Airren/poorman-httpcache/v2/pkg/privacy"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate/adapter"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// maxBody is the size of the request body kept with an entry, the entries
+// of longer ones are Truncated and not replayed.
+const maxBody = 4 << 10
+
+// Entry is a logged request.
+type Entry struct {
+	// ID is "{key id}-{random}", see Recorder.Get.
+	ID     string            `json:"id"`
+	Time   time.Time         `json:"time"`
+	Method string            `json:"method"`
+	URL    string            `json:"url"`
+	Header map[string]string `json:"header,omitempty"`
+	Body   string            `json:"body,omitempty"`
+	// BodyHash replaces Body in privacy mode, the hash of the same head of
+	// the body, see pkg/privacy.
+	BodyHash string `json:"body_hash,omitempty"`
+	// Truncated is set when the body is longer than the head kept.
+	Truncated bool          `json:"truncated,omitempty"`
+	Status    int           `json:"status"`
+	Cache     string        `json:"cache,omitempty"`
+	Size      int64         `json:"size"`
+	Duration  time.Duration `json:"duration"`
+	// Impersonated is set on the requests an admin ran as the key.
+	Impersonated bool `json:"impersonated,omitempty"`
+}
+
+// Recorder logs the requests of opted-in keys to Redis.
+type Recorder struct {
+	redis      redis.Cmdable
+	keys       adapter.MetaStore
+	maxWindow  time.Duration
+	maxEntries int64
+	adminKey   string
+	logger     *slog.Logger
+}
+
+// NewRecorder creates a new Recorder. Logging windows are capped at maxWindow
+// and at most maxEntries requests are kept per key. The owners authenticate
+// with the keys of keys, without a MetaStore only the admin manages logging.
+func NewRecorder(rdb redis.Cmdable, keys adapter.MetaStore, maxWindow time.Duration, maxEntries int, adminKey string, logger *slog.Logger) *Recorder {
+	return &Recorder{
+		redis:      rdb,
+		keys:       keys,
+		maxWindow:  maxWindow,
+		maxEntries: int64(maxEntries),
+		adminKey:   adminKey,
+		logger:     logger,
+	}
+}
+
+func enabledKey(id string) string {
+	return fmt.Sprintf("reqlog:enabled:%s", id)
+}
+
+func entriesKey(id string) string {
+	return fmt.Sprintf("reqlog:entries:%s", id)
+}
+
+// requestKey returns the key the endpoints of the owners are authenticated with.
+func requestKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-KEY"); key != "" {
+		return key
+	}
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// sensitiveHeaders aren't logged, nor the other headers holding the key.
+var sensitiveHeaders = map[string]bool{"Authorization": true, "X-Api-Key": true, "Api-Key": true, "Cookie": true}
+
+// HTTPHandlerMiddleware logs the requests of opted-in keys. It runs behind
+// the tollgate, only the requests of the keys it let through are logged;
+// keyFunc is the key extraction of the tollgate, so the requests are
+// attributed to the key it charged, whatever header the provider reads it from.
+func (rec *Recorder) HTTPHandlerMiddleware(keyFunc func(r *http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := keyFunc(r)
+		id := tollgate.ImpersonatedFromContext(r.Context())
+		if id == "" {
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			id = tollgate.KeyFingerprint(key)
+		}
+		enabled, err := rec.redis.Exists(r.Context(), enabledKey(id)).Result()
+		if err != nil || enabled == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		entry := Entry{
+			ID:           newEntryID(id),
+			Time:         time.Now(),
+			Method:       r.Method,
+			URL:          r.URL.String(),
+			Header:       map[string]string{},
+			Impersonated: tollgate.ImpersonatedFromContext(r.Context()) != "",
+		}
+		for name := range r.Header {
+			value := r.Header.Get(name)
+			if sensitiveHeaders[http.CanonicalHeaderKey(name)] || (key != "" && strings.Contains(value, key)) {
+				continue
+			}
+			entry.Header[name] = value
+		}
+		if r.Body != nil {
+			// only the head is kept, the rest is streamed to next as it comes
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxBody+1))
+			if err != nil {
+				rec.logger.Warn("Failed to read request body", "id", id, "error", err)
+			}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			kept := body[:min(len(body), maxBody)]
+			entry.Truncated = len(body) > maxBody
+			if privacy.Enabled() {
+				entry.BodyHash = privacy.Hash(kept)
+			} else {
+				entry.Body = string(kept)
+			}
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		entry.Status = sw.status
+		entry.Size = sw.size
+		entry.Cache = w.Header().Get("X-Cache")
+		entry.Duration = time.Since(entry.Time)
+		// the request is served, don't let a slow Redis hold it
+		go rec.append(context.WithoutCancel(r.Context()), id, entry)
+	})
+}
+
+func (rec *Recorder) append(ctx context.Context, id string, entry Entry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		rec.logger.Error("Failed to marshal request log", "id", id, "error", err)
+		return
+	}
+	ttl, err := rec.redis.TTL(ctx, enabledKey(id)).Result()
+	if err != nil || ttl <= 0 {
+		return
+	}
+	pipe := rec.redis.TxPipeline()
+	pipe.LPush(ctx, entriesKey(id), b)
+	pipe.LTrim(ctx, entriesKey(id), 0, rec.maxEntries-1)
+	// entries are kept for a window after the last one
+	pipe.Expire(ctx, entriesKey(id), rec.maxWindow)
+	if _, err := pipe.Exec(ctx); err != nil {
+		rec.logger.Warn("Failed to append request log", "id", id, "error", err)
+	}
+}
+
+// ErrNotFound is returned for requests that aren't logged, or no longer.
+var ErrNotFound = errors.New("request not found")
+
+func newEntryID(id string) string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b) // never fails
+	return id + "-" + hex.EncodeToString(b)
+}
+
+// Get returns a logged request by its ID.
+func (rec *Recorder) Get(ctx context.Context, requestID string) (Entry, error) {
+	id, _, ok := strings.Cut(requestID, "-")
+	if !ok {
+		return Entry{}, ErrNotFound
+	}
+	values, err := rec.redis.LRange(ctx, entriesKey(id), 0, rec.maxEntries-1).Result()
+	if err != nil {
+		return Entry{}, fmt.Errorf("LRange: %w", err)
+	}
+	for _, v := range values {
+		var entry Entry
+		if err := json.Unmarshal([]byte(v), &entry); err == nil && entry.ID == requestID {
+			return entry, nil
+		}
+	}
+	return Entry{}, ErrNotFound
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	size    int64
+	written bool
+}
+
+func (w *statusWriter) WriteHeader(statusCode int) {
+	if !w.written {
+		w.status = statusCode
+		w.written = true
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.written = true
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// authorize resolves the key id of the path, for the admin or the key owner.
+func (rec *Recorder) authorize(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id := r.PathValue("id")
+	if adminauth.Valid(r, rec.adminKey) && id != "me" {
+		return id, true
+	}
+	if key := requestKey(r); key != "" && rec.validKey(r.Context(), key) {
+		own := tollgate.KeyFingerprint(key)
+		if id == "me" || id == own {
+			return own, true
+		}
+	}
+	http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	return "", false
+}
+
+// validKey reports whether key is a key of the MetaStore, not expired.
+func (rec *Recorder) validKey(ctx context.Context, key string) bool {
+	if rec.keys == nil {
+		return false
+	}
+	meta, err := rec.keys.GetKey(ctx, key)
+	if err != nil {
+		return false
+	}
+	return !meta.Expired(time.Now())
+}
+
+// Status is the logging state of a key.
+type Status struct {
+	ID      string     `json:"id"`
+	Enabled bool       `json:"enabled"`
+	Until   *time.Time `json:"until,omitempty"`
+}
+
+// Enable handles POST /admin/keys/{id}/requests/logging?window=1h.
+func (rec *Recorder) Enable(w http.ResponseWriter, r *http.Request) {
+	id, ok := rec.authorize(w, r)
+	if !ok {
+		return
+	}
+	window := time.Hour
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid window %q", v), http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+	if window > rec.maxWindow {
+		http.Error(w, fmt.Sprintf("Window is limited to %s", rec.maxWindow), http.StatusBadRequest)
+		return
+	}
+	until := time.Now().Add(window)
+	if err := rec.redis.Set(r.Context(), enabledKey(id), until.Unix(), window).Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rec.logger.Info("Request logging enabled", "id", id, "until", until)
+	writeJSON(w, http.StatusOK, Status{ID: id, Enabled: true, Until: &until})
+}
+
+// Disable handles DELETE /admin/keys/{id}/requests/logging, logged requests are kept.
+func (rec *Recorder) Disable(w http.ResponseWriter, r *http.Request) {
+	id, ok := rec.authorize(w, r)
+	if !ok {
+		return
+	}
+	if err := rec.redis.Del(r.Context(), enabledKey(id)).Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rec.logger.Info("Request logging disabled", "id", id)
+	writeJSON(w, http.StatusOK, Status{ID: id})
+}
+
+// Requests handles GET /admin/keys/{id}/requests, newest first.
+func (rec *Recorder) Requests(w http.ResponseWriter, r *http.Request) {
+	id, ok := rec.authorize(w, r)
+	if !ok {
+		return
+	}
+	values, err := rec.redis.LRange(r.Context(), entriesKey(id), 0, rec.maxEntries-1).Result()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entries := make([]Entry, 0, len(values))
+	for _, v := range values {
+		var entry Entry
+		if err := json.Unmarshal([]byte(v), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		// response was already committed, nothing left to do
+		_ = err
+	}
+}
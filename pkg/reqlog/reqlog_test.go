@@ -0,0 +1,63 @@
+package reqlog
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// The requests are attributed with the key extraction of the provider, e.g.
+// the api-key header of Azure OpenAI, and the key isn't logged.
+func TestRecorderAttributesAndScrubsTheKey(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	rec := NewRecorder(rdb, nil, time.Hour, 10, "", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	id := tollgate.KeyFingerprint("sk-azure")
+	if err := rdb.Set(context.Background(), enabledKey(id), 1, time.Hour).Err(); err != nil {
+		t.Fatal(err)
+	}
+	azureKey := func(r *http.Request) string {
+		if key := r.Header.Get("api-key"); key != "" {
+			return key
+		}
+		return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	h := rec.HTTPHandlerMiddleware(azureKey, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/azure/openai/deployments/gpt/chat/completions", strings.NewReader(`{"messages":[]}`))
+	req.Header.Set("api-key", "sk-azure")
+	req.Header.Set("X-Upstream-Auth", "Key sk-azure")
+	req.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var entries []string
+	for deadline := time.Now().Add(5 * time.Second); len(entries) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		entries, _ = rdb.LRange(context.Background(), entriesKey(id), 0, -1).Result()
+	}
+	if len(entries) != 1 {
+		t.Fatalf("%d entries logged for the api-key, want 1", len(entries))
+	}
+	var entry Entry
+	if err := json.Unmarshal([]byte(entries[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(entries[0], "sk-azure") {
+		t.Errorf("the key was logged: %s", entries[0])
+	}
+	if entry.Header["Content-Type"] != "application/json" || entry.Body != `{"messages":[]}` {
+		t.Errorf("entry %+v", entry)
+	}
+}
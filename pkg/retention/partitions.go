@@ -0,0 +1,257 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// usageTable is the minute usage table, partitioned by month.
+const usageTable = "api_key_service_usage_logs"
+
+// defaultPartition catches the minutes no monthly partition covers.
+const defaultPartition = usageTable + "_default"
+
+// partitionLayout names the monthly partitions, e.g.
+// api_key_service_usage_logs_2025_06.
+const partitionLayout = "2006_01"
+
+// lockTimeout bounds how long the statements locking the whole table wait
+// for their lock, the usage writes queue behind them meanwhile.
+const lockTimeout = "5s"
+
+// minConcurrentDetach is the oldest Postgres detaching partitions
+// concurrently, as server_version_num.
+const minConcurrentDetach = 140000
+
+// partitionName returns the name of the partition of the month of t.
+func partitionName(t time.Time) string {
+	return usageTable + "_" + t.UTC().Format(partitionLayout)
+}
+
+// partitionMonth returns the month of a partition name, false for the default
+// partition and the ones not named by partitionName.
+func partitionMonth(name string) (time.Time, bool) {
+	suffix, ok := strings.CutPrefix(name, usageTable+"_")
+	if !ok {
+		return time.Time{}, false
+	}
+	month, err := time.Parse(partitionLayout, suffix)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return month, true
+}
+
+// monthStart returns the first instant of the month of t, in UTC.
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// Partitions creates the monthly partitions of the minute usage ahead of
+// time, whether the retention worker runs or not, so the usage doesn't pile
+// up in the default partition. It connects to Postgres on each run only.
+type Partitions struct {
+	postgresURL string
+	ahead       int
+	interval    time.Duration
+	logger      *slog.Logger
+}
+
+// NewPartitions creates a new Partitions creating the partitions of the
+// current month and of the ahead months after it every interval.
+func NewPartitions(postgresURL string, ahead int, interval time.Duration, logger *slog.Logger) *Partitions {
+	return &Partitions{
+		postgresURL: postgresURL,
+		ahead:       ahead,
+		interval:    interval,
+		logger:      logger,
+	}
+}
+
+// Run creates the partitions right away, then every interval until ctx is
+// done.
+func (p *Partitions) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		if err := p.RunOnce(ctx); err != nil {
+			p.logger.Error("Usage partitions failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce creates the missing partitions once.
+func (p *Partitions) RunOnce(ctx context.Context) error {
+	db, err := pgx.Connect(ctx, p.postgresURL)
+	if err != nil {
+		return fmt.Errorf("pgx.Connect: %w", err)
+	}
+	defer db.Close(ctx)
+	if err := createPartitions(ctx, db, time.Now(), p.ahead, p.logger); err != nil {
+		return fmt.Errorf("createPartitions: %w", err)
+	}
+	return nil
+}
+
+// createPartitions creates the partitions of the month of now and of the
+// ahead months after it, the existing ones are left as they are. A month
+// whose rows landed in the default partition gets them moved to its own.
+func createPartitions(ctx context.Context, db *pgx.Conn, now time.Time, ahead int, logger *slog.Logger) error {
+	names, err := dbsqlc.New(db).ListUsageLogPartitions(ctx)
+	if err != nil {
+		return fmt.Errorf("ListUsageLogPartitions: %w", err)
+	}
+	existing := make(map[string]bool, len(names))
+	for _, name := range names {
+		existing[name] = true
+	}
+	start := monthStart(now)
+	for i := 0; i <= ahead; i++ {
+		from, to := start.AddDate(0, i, 0), start.AddDate(0, i+1, 0)
+		name := partitionName(from)
+		if existing[name] {
+			continue
+		}
+		moved, err := createPartition(ctx, db, name, from, to, existing[defaultPartition])
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			metrics.Add("usage_partition_failures", 1)
+			logger.Warn("Failed to create usage partition", "partition", name, "error", err)
+			continue
+		}
+		metrics.Add("usage_partitions_created", 1)
+		if moved > 0 {
+			metrics.Add("usage_rows_moved", moved)
+			logger.Info("Usage moved out of the default partition", "partition", name, "rows", moved)
+		}
+	}
+	return nil
+}
+
+// createPartition creates the partition name of [from, to) and returns how
+// many rows it moved there from the default partition. Postgres refuses to
+// create a partition whose rows are in the default partition, so they're
+// moved to a new table attached as the partition, all in one transaction.
+// The usage writes wait meanwhile, only for the months the partitions were
+// late for.
+func createPartition(ctx context.Context, db *pgx.Conn, name string, from, to time.Time, hasDefault bool) (int64, error) {
+	parent, partition := pgx.Identifier{usageTable}.Sanitize(), pgx.Identifier{name}.Sanitize()
+	bounds := fmt.Sprintf("FOR VALUES FROM ('%s') TO ('%s')", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	if !hasDefault {
+		if _, err := db.Exec(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s %s", partition, parent, bounds)); err != nil {
+			return 0, fmt.Errorf("CREATE TABLE %s: %w", name, err)
+		}
+		return 0, nil
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("db.Begin: %w", err)
+	}
+	defer func() {
+		// Rollback errors are expected after successful commits
+		_ = tx.Rollback(ctx)
+	}()
+	if _, err := tx.Exec(ctx, "SET LOCAL lock_timeout = '"+lockTimeout+"'"); err != nil {
+		return 0, fmt.Errorf("SET lock_timeout: %w", err)
+	}
+	// no usage lands in the default partition while its rows move
+	if _, err := tx.Exec(ctx, fmt.Sprintf("LOCK TABLE %s IN SHARE ROW EXCLUSIVE MODE", parent)); err != nil {
+		return 0, fmt.Errorf("LOCK TABLE: %w", err)
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING DEFAULTS INCLUDING CONSTRAINTS)", partition, parent)); err != nil {
+		return 0, fmt.Errorf("CREATE TABLE %s: %w", name, err)
+	}
+	tag, err := tx.Exec(ctx, fmt.Sprintf("WITH moved AS (DELETE FROM %s WHERE minute_timestamp >= $1 AND minute_timestamp < $2 RETURNING *) INSERT INTO %s SELECT * FROM moved",
+		pgx.Identifier{defaultPartition}.Sanitize(), partition), from, to)
+	if err != nil {
+		return 0, fmt.Errorf("move the default partition rows: %w", err)
+	}
+	// the indexes and the foreign keys of the table are created on attach
+	if _, err := tx.Exec(ctx, fmt.Sprintf("ALTER TABLE %s ATTACH PARTITION %s %s", parent, partition, bounds)); err != nil {
+		return 0, fmt.Errorf("ATTACH PARTITION %s: %w", name, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("tx.Commit: %w", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+// dropPartitions detaches and drops the monthly partitions ending before
+// cutoff, whose rows were rolled up, and returns how many it dropped. Each
+// runs on its own, outside the rollup transaction: concurrently from Postgres
+// 14, which Postgres only allows without a default partition, otherwise with
+// a plain detach giving up after lockTimeout.
+func dropPartitions(ctx context.Context, db *pgx.Conn, cutoff time.Time) (int64, error) {
+	names, err := dbsqlc.New(db).ListUsageLogPartitions(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("ListUsageLogPartitions: %w", err)
+	}
+	var version int
+	if err := db.QueryRow(ctx, "SELECT current_setting('server_version_num')::int").Scan(&version); err != nil {
+		return 0, fmt.Errorf("server_version_num: %w", err)
+	}
+	concurrently := version >= minConcurrentDetach && !slices.Contains(names, defaultPartition)
+	var dropped int64
+	for _, name := range names {
+		month, ok := partitionMonth(name)
+		if !ok || month.AddDate(0, 1, 0).After(cutoff) {
+			continue
+		}
+		if err := detachPartition(ctx, db, name, concurrently); err != nil {
+			return dropped, fmt.Errorf("DETACH PARTITION %s: %w", name, err)
+		}
+		if _, err := db.Exec(ctx, "DROP TABLE "+pgx.Identifier{name}.Sanitize()); err != nil {
+			return dropped, fmt.Errorf("DROP TABLE %s: %w", name, err)
+		}
+		dropped++
+	}
+	return dropped, nil
+}
+
+// detachPartition detaches the partition name. A concurrent detach
+// interrupted earlier is finalized.
+func detachPartition(ctx context.Context, db *pgx.Conn, name string, concurrently bool) error {
+	detach := fmt.Sprintf("ALTER TABLE %s DETACH PARTITION %s", pgx.Identifier{usageTable}.Sanitize(), pgx.Identifier{name}.Sanitize())
+	if concurrently {
+		_, err := db.Exec(ctx, detach+" CONCURRENTLY")
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "55000" && strings.Contains(pgErr.Hint, "FINALIZE") {
+			_, err = db.Exec(ctx, detach+" FINALIZE")
+		}
+		return err
+	}
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("db.Begin: %w", err)
+	}
+	defer func() {
+		// Rollback errors are expected after successful commits
+		_ = tx.Rollback(ctx)
+	}()
+	if _, err := tx.Exec(ctx, "SET LOCAL lock_timeout = '"+lockTimeout+"'"); err != nil {
+		return fmt.Errorf("SET lock_timeout: %w", err)
+	}
+	if _, err := tx.Exec(ctx, detach); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
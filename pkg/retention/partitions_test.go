@@ -0,0 +1,150 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// testPostgres returns a connection to a fresh schema with dbsqlc.Schema in
+// the disposable Postgres the partition tests run against, e.g.
+// TEST_POSTGRES_URL=postgres://postgres@localhost:5432/postgres.
+func testPostgres(t *testing.T) *pgx.Conn {
+	t.Helper()
+	base := os.Getenv("TEST_POSTGRES_URL")
+	if base == "" {
+		t.Skip("TEST_POSTGRES_URL is not set")
+	}
+	ctx := context.Background()
+	db, err := pgx.Connect(ctx, base)
+	if err != nil {
+		t.Fatalf("pgx.Connect: %v", err)
+	}
+	defer db.Close(ctx)
+	schema := fmt.Sprintf("retention_test_%d", time.Now().UnixNano())
+	if _, err := db.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatalf("CREATE SCHEMA: %v", err)
+	}
+	t.Cleanup(func() {
+		db, err := pgx.Connect(context.Background(), base)
+		if err != nil {
+			return
+		}
+		defer db.Close(context.Background())
+		_, _ = db.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE")
+	})
+
+	u, err := url.Parse(base)
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	conn, err := pgx.Connect(ctx, u.String())
+	if err != nil {
+		t.Fatalf("pgx.Connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close(context.Background()) })
+	if _, err := conn.Exec(ctx, dbsqlc.Schema); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	return conn
+}
+
+func TestPartitions(t *testing.T) {
+	db := testPostgres(t)
+	ctx := context.Background()
+	queries := dbsqlc.New(db)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	var userID, keyID, serviceID int64
+	if err := db.QueryRow(ctx, `INSERT INTO users (email) VALUES ('retention@example.com') RETURNING id`).Scan(&userID); err != nil {
+		t.Fatalf("users: %v", err)
+	}
+	if err := db.QueryRow(ctx, `INSERT INTO api_keys (user_id, key_string) VALUES ($1, 'sk-retention') RETURNING id`, userID).Scan(&keyID); err != nil {
+		t.Fatalf("api_keys: %v", err)
+	}
+	if err := db.QueryRow(ctx, `INSERT INTO services (name) VALUES ('jina') RETURNING id`).Scan(&serviceID); err != nil {
+		t.Fatalf("services: %v", err)
+	}
+	use := func(minute time.Time) {
+		t.Helper()
+		if _, err := queries.UpsertMinuteUsage(ctx, &dbsqlc.UpsertMinuteUsageParams{
+			ApiKeyID:          keyID,
+			ServiceID:         serviceID,
+			ConsumptionAmount: 1,
+			MinuteTimestamp:   pgtype.Timestamptz{Time: minute, Valid: true},
+		}); err != nil {
+			t.Fatalf("UpsertMinuteUsage: %v", err)
+		}
+	}
+	partitions := func() []string {
+		t.Helper()
+		names, err := queries.ListUsageLogPartitions(ctx)
+		if err != nil {
+			t.Fatalf("ListUsageLogPartitions: %v", err)
+		}
+		return names
+	}
+	count := func(table string) int {
+		t.Helper()
+		var n int
+		if err := db.QueryRow(ctx, "SELECT count(*) FROM "+pgx.Identifier{table}.Sanitize()).Scan(&n); err != nil {
+			t.Fatalf("count %s: %v", table, err)
+		}
+		return n
+	}
+
+	// the usage of June lands in the default partition until June gets its own
+	june := time.Date(2025, 6, 10, 12, 0, 0, 0, time.UTC)
+	use(june)
+	use(june.Add(time.Minute))
+	if err := createPartitions(ctx, db, june, 1, logger); err != nil {
+		t.Fatalf("createPartitions: %v", err)
+	}
+	want := []string{defaultPartition, usageTable + "_2025_06", usageTable + "_2025_07"}
+	if got := partitions(); !slices.Equal(got, want) {
+		t.Fatalf("partitions %v, want %v", got, want)
+	}
+	if count(defaultPartition) != 0 || count(usageTable+"_2025_06") != 2 {
+		t.Errorf("the June rows weren't moved out of the default partition")
+	}
+	// the moved partition has the primary key of the table
+	use(june)
+	if n := count(usageTable + "_2025_06"); n != 2 {
+		t.Errorf("June has %d rows after an upsert of a minute, want 2", n)
+	}
+
+	// the months ending before the cutoff are dropped, the rows left deleted
+	use(time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC))
+	w := NewWorker(Policy{UsageDays: 1}, "", nil, time.Hour, logger)
+	if err := w.rollupUsage(ctx, db, time.Date(2025, 7, 2, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("rollupUsage: %v", err)
+	}
+	want = []string{defaultPartition, usageTable + "_2025_07"}
+	if got := partitions(); !slices.Equal(got, want) {
+		t.Fatalf("partitions after the rollup %v, want %v", got, want)
+	}
+	if n := count(usageTable); n != 0 {
+		t.Errorf("%d minute rows left before the cutoff", n)
+	}
+	var daily int64
+	if err := db.QueryRow(ctx, "SELECT COALESCE(SUM(consumption_amount), 0) FROM api_key_service_usage_daily").Scan(&daily); err != nil {
+		t.Fatalf("daily: %v", err)
+	}
+	if daily != 4 {
+		t.Errorf("rolled up %d, want 4", daily)
+	}
+}
@@ -0,0 +1,218 @@
+// Package retention enforces how long usage and audit data are kept.
+package retention
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+	"github.com/Airren/poorman-httpcache/v2/pkg/s3"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// auditBatch is how many audit events are archived per object.
+const auditBatch = 1000
+
+// metrics are published on /debug/vars under "retention".
+var metrics = expvar.NewMap("retention")
+
+// Policy sets how long each dataset is kept, 0 keeps it forever.
+type Policy struct {
+	// UsageDays is how long minute usage rows are kept, older rows are
+	// rolled up into daily aggregates then deleted.
+	UsageDays int
+	// AuditDays is how long key status events are kept, older events are
+	// archived to S3 then deleted. They are kept when no archive is set.
+	AuditDays int
+}
+
+// Worker runs the retention policy on a schedule. It connects to Postgres on
+// each run only, so the proxy keeps running without it.
+type Worker struct {
+	policy      Policy
+	postgresURL string
+	archive     *s3.Client
+	interval    time.Duration
+	logger      *slog.Logger
+}
+
+// NewWorker creates a new Worker, archive may be nil.
+func NewWorker(policy Policy, postgresURL string, archive *s3.Client, interval time.Duration, logger *slog.Logger) *Worker {
+	return &Worker{
+		policy:      policy,
+		postgresURL: postgresURL,
+		archive:     archive,
+		interval:    interval,
+		logger:      logger,
+	}
+}
+
+// Run runs the policy every interval until ctx is done.
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.RunOnce(ctx); err != nil {
+				w.logger.Error("Retention run failed", "error", err)
+			}
+		}
+	}
+}
+
+// RunOnce runs the policy once.
+func (w *Worker) RunOnce(ctx context.Context) error {
+	start := time.Now()
+	metrics.Add("runs", 1)
+	err := w.run(ctx, start)
+	if err != nil {
+		metrics.Add("failures", 1)
+	}
+	last := new(expvar.Int)
+	last.Set(start.Unix())
+	metrics.Set("last_run_unix", last)
+	duration := new(expvar.Int)
+	duration.Set(time.Since(start).Milliseconds())
+	metrics.Set("last_run_ms", duration)
+	return err
+}
+
+func (w *Worker) run(ctx context.Context, now time.Time) error {
+	if w.policy.UsageDays <= 0 && (w.policy.AuditDays <= 0 || w.archive == nil) {
+		return nil
+	}
+	db, err := pgx.Connect(ctx, w.postgresURL)
+	if err != nil {
+		return fmt.Errorf("pgx.Connect: %w", err)
+	}
+	defer db.Close(ctx)
+
+	if w.policy.UsageDays > 0 {
+		cutoff := now.UTC().Truncate(24*time.Hour).AddDate(0, 0, -w.policy.UsageDays)
+		if err := w.rollupUsage(ctx, db, cutoff); err != nil {
+			return fmt.Errorf("rollupUsage: %w", err)
+		}
+	}
+	if w.policy.AuditDays > 0 && w.archive != nil {
+		cutoff := now.AddDate(0, 0, -w.policy.AuditDays)
+		if err := w.archiveAudit(ctx, db, cutoff); err != nil {
+			return fmt.Errorf("archiveAudit: %w", err)
+		}
+	}
+	return nil
+}
+
+// rollupUsage rolls minute usage before cutoff up into daily aggregates,
+// then drops the monthly partitions ending before cutoff whole and deletes
+// the rows left. The aggregates are replaced, never added to, and the reports
+// read the days before the watermark from them only, so a run interrupted
+// after the rollup counts no usage twice and is repeated safely. The rollups
+// are serialized for the whole run, the partitions are detached outside of a
+// transaction.
+func (w *Worker) rollupUsage(ctx context.Context, db *pgx.Conn, cutoff time.Time) error {
+	queries := dbsqlc.New(db)
+	if err := queries.LockUsageRollupSession(ctx); err != nil {
+		return fmt.Errorf("LockUsageRollupSession: %w", err)
+	}
+	defer func() {
+		// the lock is released with the connection otherwise
+		_ = queries.UnlockUsageRollupSession(context.WithoutCancel(ctx))
+	}()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("db.Begin: %w", err)
+	}
+	defer func() {
+		if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+			// Rollback errors are typically expected after successful commits
+			_ = rollbackErr
+		}
+	}()
+	qtx := dbsqlc.New(tx)
+	ts := pgtype.Timestamptz{Time: cutoff, Valid: true}
+	rolled, err := qtx.RollupUsageLogsBefore(ctx, ts)
+	if err != nil {
+		return fmt.Errorf("RollupUsageLogsBefore: %w", err)
+	}
+	// the days before cutoff are whole in the daily aggregates now, the
+	// reports read them there
+	if err := qtx.SetUsageRollupWatermark(ctx, &dbsqlc.SetUsageRollupWatermarkParams{Granularity: "day", MaterializedBefore: ts}); err != nil {
+		return fmt.Errorf("SetUsageRollupWatermark: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
+	}
+	metrics.Add("usage_days_rolled_up", rolled)
+
+	dropped, err := dropPartitions(ctx, db, cutoff)
+	metrics.Add("usage_partitions_dropped", dropped)
+	if err != nil {
+		return fmt.Errorf("dropPartitions: %w", err)
+	}
+	deleted, err := queries.DeleteUsageLogsBefore(ctx, ts)
+	if err != nil {
+		return fmt.Errorf("DeleteUsageLogsBefore: %w", err)
+	}
+	metrics.Add("usage_rows_deleted", deleted)
+	w.logger.Info("Usage rolled up", "cutoff", cutoff, "daily_rows", rolled, "dropped_partitions", dropped, "deleted_rows", deleted)
+	return nil
+}
+
+// auditEvent is an archived key status event, one JSON object per line.
+type auditEvent struct {
+	ID        int64     `json:"id"`
+	APIKeyID  int64     `json:"api_key_id"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// archiveAudit uploads status events before cutoff to S3 in batches, then
+// deletes them. Objects are named by ID range, so a retried batch overwrites
+// the same object.
+func (w *Worker) archiveAudit(ctx context.Context, db *pgx.Conn, cutoff time.Time) error {
+	queries := dbsqlc.New(db)
+	ts := pgtype.Timestamptz{Time: cutoff, Valid: true}
+	for {
+		events, err := queries.GetStatusEventsBefore(ctx, &dbsqlc.GetStatusEventsBeforeParams{CreatedAt: ts, Limit: auditBatch})
+		if err != nil {
+			return fmt.Errorf("GetStatusEventsBefore: %w", err)
+		}
+		if len(events) == 0 {
+			return nil
+		}
+
+		var b bytes.Buffer
+		enc := json.NewEncoder(&b)
+		for _, e := range events {
+			if err := enc.Encode(auditEvent{ID: e.ID, APIKeyID: e.ApiKeyID, Status: e.Status, CreatedAt: e.CreatedAt.Time}); err != nil {
+				return fmt.Errorf("json.Encode: %w", err)
+			}
+		}
+		first, last := events[0], events[len(events)-1]
+		key := fmt.Sprintf("audit/api_key_status_events/%s/%d-%d.jsonl",
+			first.CreatedAt.Time.UTC().Format("2006-01"), first.ID, last.ID)
+		if err := w.archive.PutObject(ctx, key, b.Bytes(), "application/x-ndjson"); err != nil {
+			return fmt.Errorf("PutObject: %w", err)
+		}
+
+		deleted, err := queries.DeleteStatusEventsUpTo(ctx, &dbsqlc.DeleteStatusEventsUpToParams{CreatedAt: ts, ID: last.ID})
+		if err != nil {
+			return fmt.Errorf("DeleteStatusEventsUpTo: %w", err)
+		}
+		metrics.Add("audit_events_archived", deleted)
+		w.logger.Info("Audit events archived", "object", key, "events", len(events))
+		if len(events) < auditBatch {
+			return nil
+		}
+	}
+}
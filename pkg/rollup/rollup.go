@@ -0,0 +1,181 @@
+// Package rollup materializes the minute usage into hourly and daily
+// aggregates, so the reports read a row per hour or day instead of summing
+// minutes as the raw data grows.
+package rollup
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// metrics are published on /debug/vars under "rollup".
+var metrics = expvar.NewMap("rollup")
+
+// Granularities of the watermarks, how far each is materialized.
+const (
+	granularityHour = "hour"
+	granularityDay  = "day"
+)
+
+// span is a range of time, start included, end excluded.
+type span struct {
+	start, end time.Time
+}
+
+// windows returns the whole hours and days to recompute at now.
+//
+// The hours start lookback before the current hour, so the minute rows synced
+// late are counted, or earlier at the watermark when the previous runs are
+// behind, or at the oldest minute row on the first run. They end at the
+// current hour, excluded as it's still partial. The days are those of the
+// hours, from the day of the first hour: its earlier hours were materialized
+// by the previous runs. They end at the current day, excluded as well.
+func windows(now time.Time, lookback time.Duration, watermark, oldest time.Time) (hours, days span) {
+	end := now.UTC().Truncate(time.Hour)
+	start := end.Add(-lookback).Truncate(time.Hour)
+	if !watermark.IsZero() && watermark.Before(start) {
+		start = watermark.UTC().Truncate(time.Hour)
+	}
+	if watermark.IsZero() && !oldest.IsZero() && oldest.Before(start) {
+		start = oldest.UTC().Truncate(time.Hour)
+	}
+	if start.After(end) {
+		start = end
+	}
+	hours = span{start, end}
+	days = span{start.Truncate(24 * time.Hour), end.Truncate(24 * time.Hour)}
+	return hours, days
+}
+
+// Worker recomputes the recent hourly and daily aggregates on a schedule. It
+// connects to Postgres on each run only, so the proxy keeps running without
+// it. The aggregates are replaced, never added to, so a run can be repeated.
+type Worker struct {
+	postgresURL string
+	interval    time.Duration
+	lookback    time.Duration
+	logger      *slog.Logger
+}
+
+// NewWorker creates a new Worker recomputing the hours of the last lookback,
+// which should be longer than the usage takes to reach Postgres.
+func NewWorker(postgresURL string, interval, lookback time.Duration, logger *slog.Logger) *Worker {
+	return &Worker{
+		postgresURL: postgresURL,
+		interval:    interval,
+		lookback:    lookback,
+		logger:      logger,
+	}
+}
+
+// Run runs the rollup every interval until ctx is done.
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.RunOnce(ctx); err != nil {
+				w.logger.Error("Usage rollup failed", "error", err)
+			}
+		}
+	}
+}
+
+// RunOnce runs the rollup once.
+func (w *Worker) RunOnce(ctx context.Context) error {
+	start := time.Now()
+	metrics.Add("runs", 1)
+	err := w.run(ctx, start)
+	if err != nil {
+		metrics.Add("failures", 1)
+	}
+	duration := new(expvar.Int)
+	duration.Set(time.Since(start).Milliseconds())
+	metrics.Set("last_run_ms", duration)
+	return err
+}
+
+// run recomputes the aggregates and moves the watermarks in one transaction,
+// under the lock of the retention rollup so no minute row is deleted halfway.
+func (w *Worker) run(ctx context.Context, now time.Time) error {
+	db, err := pgx.Connect(ctx, w.postgresURL)
+	if err != nil {
+		return fmt.Errorf("pgx.Connect: %w", err)
+	}
+	defer db.Close(ctx)
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("db.Begin: %w", err)
+	}
+	defer func() {
+		if rollbackErr := tx.Rollback(ctx); rollbackErr != nil {
+			// Rollback errors are typically expected after successful commits
+			_ = rollbackErr
+		}
+	}()
+	qtx := dbsqlc.New(tx)
+	if err := qtx.LockUsageRollup(ctx); err != nil {
+		return fmt.Errorf("LockUsageRollup: %w", err)
+	}
+
+	var watermark, oldest time.Time
+	mark, err := qtx.GetUsageRollupWatermark(ctx, granularityHour)
+	switch {
+	case err == nil:
+		watermark = mark.Time
+	case errors.Is(err, pgx.ErrNoRows):
+		first, err := qtx.GetOldestUsageLog(ctx)
+		if err != nil {
+			return fmt.Errorf("GetOldestUsageLog: %w", err)
+		}
+		oldest = first.Time
+	default:
+		return fmt.Errorf("GetUsageRollupWatermark: %w", err)
+	}
+
+	hours, days := windows(now, w.lookback, watermark, oldest)
+	hourly, err := qtx.RollupUsageHourly(ctx, &dbsqlc.RollupUsageHourlyParams{
+		StartTime: pgtype.Timestamptz{Time: hours.start, Valid: true},
+		EndTime:   pgtype.Timestamptz{Time: hours.end, Valid: true},
+	})
+	if err != nil {
+		return fmt.Errorf("RollupUsageHourly: %w", err)
+	}
+	daily, err := qtx.RollupUsageDaily(ctx, &dbsqlc.RollupUsageDailyParams{
+		StartTime: pgtype.Timestamptz{Time: days.start, Valid: true},
+		EndTime:   pgtype.Timestamptz{Time: days.end, Valid: true},
+	})
+	if err != nil {
+		return fmt.Errorf("RollupUsageDaily: %w", err)
+	}
+	for granularity, before := range map[string]time.Time{granularityHour: hours.end, granularityDay: days.end} {
+		if err := qtx.SetUsageRollupWatermark(ctx, &dbsqlc.SetUsageRollupWatermarkParams{
+			Granularity:        granularity,
+			MaterializedBefore: pgtype.Timestamptz{Time: before, Valid: true},
+		}); err != nil {
+			return fmt.Errorf("SetUsageRollupWatermark(%s): %w", granularity, err)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("tx.Commit: %w", err)
+	}
+
+	metrics.Add("hourly_rows", hourly)
+	metrics.Add("daily_rows", daily)
+	w.logger.Info("Usage rolled up", "hours_from", hours.start, "hours_to", hours.end,
+		"days_from", days.start, "days_to", days.end, "hourly_rows", hourly, "daily_rows", daily)
+	return nil
+}
@@ -0,0 +1,292 @@
+package rollup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func at(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestWindows(t *testing.T) {
+	tests := []struct {
+		name      string
+		now       string
+		lookback  time.Duration
+		watermark string
+		oldest    string
+		hours     [2]string
+		days      [2]string
+	}{
+		{
+			name:      "current hour is partial",
+			now:       "2025-06-02T11:30:00Z",
+			lookback:  2 * time.Hour,
+			watermark: "2025-06-02T11:00:00Z",
+			hours:     [2]string{"2025-06-02T09:00:00Z", "2025-06-02T11:00:00Z"},
+			days:      [2]string{"2025-06-02T00:00:00Z", "2025-06-02T00:00:00Z"},
+		},
+		{
+			name:      "on the hour",
+			now:       "2025-06-02T11:00:00Z",
+			lookback:  time.Hour,
+			watermark: "2025-06-02T10:00:00Z",
+			hours:     [2]string{"2025-06-02T10:00:00Z", "2025-06-02T11:00:00Z"},
+			days:      [2]string{"2025-06-02T00:00:00Z", "2025-06-02T00:00:00Z"},
+		},
+		{
+			name:      "lookback not a whole hour",
+			now:       "2025-06-02T11:10:00Z",
+			lookback:  90 * time.Minute,
+			watermark: "2025-06-02T11:00:00Z",
+			hours:     [2]string{"2025-06-02T09:00:00Z", "2025-06-02T11:00:00Z"},
+			days:      [2]string{"2025-06-02T00:00:00Z", "2025-06-02T00:00:00Z"},
+		},
+		{
+			name:      "past midnight completes the day",
+			now:       "2025-06-03T00:20:00Z",
+			lookback:  2 * time.Hour,
+			watermark: "2025-06-03T00:00:00Z",
+			hours:     [2]string{"2025-06-02T22:00:00Z", "2025-06-03T00:00:00Z"},
+			days:      [2]string{"2025-06-02T00:00:00Z", "2025-06-03T00:00:00Z"},
+		},
+		{
+			name:      "behind the watermark catches up",
+			now:       "2025-06-03T05:45:00Z",
+			lookback:  time.Hour,
+			watermark: "2025-06-02T13:00:00Z",
+			hours:     [2]string{"2025-06-02T13:00:00Z", "2025-06-03T05:00:00Z"},
+			days:      [2]string{"2025-06-02T00:00:00Z", "2025-06-03T00:00:00Z"},
+		},
+		{
+			name:     "first run starts at the oldest minute",
+			now:      "2025-06-02T11:30:00Z",
+			lookback: time.Hour,
+			oldest:   "2025-06-01T23:42:00Z",
+			hours:    [2]string{"2025-06-01T23:00:00Z", "2025-06-02T11:00:00Z"},
+			days:     [2]string{"2025-06-01T00:00:00Z", "2025-06-02T00:00:00Z"},
+		},
+		{
+			name:     "first run without minutes",
+			now:      "2025-06-02T11:30:00Z",
+			lookback: time.Hour,
+			hours:    [2]string{"2025-06-02T10:00:00Z", "2025-06-02T11:00:00Z"},
+			days:     [2]string{"2025-06-02T00:00:00Z", "2025-06-02T00:00:00Z"},
+		},
+		{
+			name:     "other time zone",
+			now:      "2025-06-02T12:15:00+05:30",
+			lookback: time.Hour,
+			oldest:   "2025-06-02T06:00:00Z",
+			hours:    [2]string{"2025-06-02T05:00:00Z", "2025-06-02T06:00:00Z"},
+			days:     [2]string{"2025-06-02T00:00:00Z", "2025-06-02T00:00:00Z"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var watermark, oldest time.Time
+			if tt.watermark != "" {
+				watermark = at(tt.watermark)
+			}
+			if tt.oldest != "" {
+				oldest = at(tt.oldest)
+			}
+			hours, days := windows(at(tt.now), tt.lookback, watermark, oldest)
+			if !hours.start.Equal(at(tt.hours[0])) || !hours.end.Equal(at(tt.hours[1])) {
+				t.Errorf("hours = [%s, %s), want [%s, %s)", hours.start, hours.end, tt.hours[0], tt.hours[1])
+			}
+			if !days.start.Equal(at(tt.days[0])) || !days.end.Equal(at(tt.days[1])) {
+				t.Errorf("days = [%s, %s), want [%s, %s)", days.start, days.end, tt.days[0], tt.days[1])
+			}
+		})
+	}
+}
+
+// testPostgres returns the URL of a fresh schema with dbsqlc.Schema in the
+// disposable Postgres the rollup tests run against, e.g.
+// TEST_POSTGRES_URL=postgres://postgres@localhost:5432/postgres.
+func testPostgres(t *testing.T) string {
+	t.Helper()
+	base := os.Getenv("TEST_POSTGRES_URL")
+	if base == "" {
+		t.Skip("TEST_POSTGRES_URL is not set")
+	}
+	ctx := context.Background()
+	db, err := pgx.Connect(ctx, base)
+	if err != nil {
+		t.Fatalf("pgx.Connect: %v", err)
+	}
+	defer db.Close(ctx)
+	schema := fmt.Sprintf("rollup_test_%d", time.Now().UnixNano())
+	if _, err := db.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatalf("CREATE SCHEMA: %v", err)
+	}
+	t.Cleanup(func() {
+		db, err := pgx.Connect(context.Background(), base)
+		if err != nil {
+			return
+		}
+		defer db.Close(context.Background())
+		_, _ = db.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE")
+	})
+
+	u, err := url.Parse(base)
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+	conn, err := pgx.Connect(ctx, u.String())
+	if err != nil {
+		t.Fatalf("pgx.Connect: %v", err)
+	}
+	defer conn.Close(ctx)
+	if _, err := conn.Exec(ctx, dbsqlc.Schema); err != nil {
+		t.Fatalf("schema: %v", err)
+	}
+	return u.String()
+}
+
+func TestRollupPartialHours(t *testing.T) {
+	postgresURL := testPostgres(t)
+	ctx := context.Background()
+	db, err := pgx.Connect(ctx, postgresURL)
+	if err != nil {
+		t.Fatalf("pgx.Connect: %v", err)
+	}
+	defer db.Close(ctx)
+	queries := dbsqlc.New(db)
+
+	var userID, keyID, serviceID int64
+	if err := db.QueryRow(ctx, `INSERT INTO users (email) VALUES ('rollup@example.com') RETURNING id`).Scan(&userID); err != nil {
+		t.Fatalf("users: %v", err)
+	}
+	if err := db.QueryRow(ctx, `INSERT INTO api_keys (user_id, key_string) VALUES ($1, 'sk-rollup') RETURNING id`, userID).Scan(&keyID); err != nil {
+		t.Fatalf("api_keys: %v", err)
+	}
+	if err := db.QueryRow(ctx, `INSERT INTO services (name) VALUES ('jina') RETURNING id`).Scan(&serviceID); err != nil {
+		t.Fatalf("services: %v", err)
+	}
+	use := func(minute string, amount int32) {
+		t.Helper()
+		if _, err := queries.UpsertMinuteUsage(ctx, &dbsqlc.UpsertMinuteUsageParams{
+			ApiKeyID:          keyID,
+			ServiceID:         serviceID,
+			ConsumptionAmount: amount,
+			MinuteTimestamp:   pgtype.Timestamptz{Time: at(minute), Valid: true},
+		}); err != nil {
+			t.Fatalf("UpsertMinuteUsage: %v", err)
+		}
+	}
+	hourly := func(start, end string) map[string]int64 {
+		t.Helper()
+		rows, err := queries.GetHourlyUsageBetween(ctx, &dbsqlc.GetHourlyUsageBetweenParams{
+			StartTime: pgtype.Timestamptz{Time: at(start), Valid: true},
+			EndTime:   pgtype.Timestamptz{Time: at(end), Valid: true},
+		})
+		if err != nil {
+			t.Fatalf("GetHourlyUsageBetween: %v", err)
+		}
+		got := map[string]int64{}
+		for _, row := range rows {
+			got[row.Hour.Time.UTC().Format("2006-01-02T15")] += row.ConsumptionAmount
+		}
+		return got
+	}
+	daily := func(start, end string) map[string]int64 {
+		t.Helper()
+		rows, err := queries.GetDailyUsageBetween(ctx, &dbsqlc.GetDailyUsageBetweenParams{
+			StartTime: pgtype.Timestamptz{Time: at(start), Valid: true},
+			EndTime:   pgtype.Timestamptz{Time: at(end), Valid: true},
+		})
+		if err != nil {
+			t.Fatalf("GetDailyUsageBetween: %v", err)
+		}
+		got := map[string]int64{}
+		for _, row := range rows {
+			got[row.Day.Time.Format(time.DateOnly)] += row.ConsumptionAmount
+		}
+		return got
+	}
+	expect := func(name string, got, want map[string]int64) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Errorf("%s = %v, want %v", name, got, want)
+			return
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("%s = %v, want %v", name, got, want)
+				return
+			}
+		}
+	}
+
+	use("2025-06-01T23:30:00Z", 1)
+	use("2025-06-02T09:15:00Z", 2)
+	use("2025-06-02T10:00:00Z", 3)
+	use("2025-06-02T10:59:00Z", 4)
+	use("2025-06-02T11:00:00Z", 5)
+	use("2025-06-02T11:20:00Z", 6)
+
+	w := NewWorker(postgresURL, time.Hour, 2*time.Hour, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err := w.run(ctx, at("2025-06-02T11:30:00Z")); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	var materialized int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM api_key_service_usage_hourly WHERE hour >= '2025-06-02T11:00:00Z'`).Scan(&materialized); err != nil {
+		t.Fatalf("api_key_service_usage_hourly: %v", err)
+	}
+	if materialized != 0 {
+		t.Errorf("the partial hour is materialized")
+	}
+	// the partial hour comes from the minute rows
+	expect("hourly", hourly("2025-06-01T00:00:00Z", "2025-06-03T00:00:00Z"),
+		map[string]int64{"2025-06-01T23": 1, "2025-06-02T09": 2, "2025-06-02T10": 7, "2025-06-02T11": 11})
+	expect("daily", daily("2025-06-01T00:00:00Z", "2025-06-03T00:00:00Z"),
+		map[string]int64{"2025-06-01": 1, "2025-06-02": 20})
+
+	// a minute synced late, within the lookback, and the rest of the hour
+	use("2025-06-02T10:30:00Z", 10)
+	use("2025-06-02T11:45:00Z", 1)
+	for range 2 {
+		if err := w.run(ctx, at("2025-06-02T12:10:00Z")); err != nil {
+			t.Fatalf("run: %v", err)
+		}
+	}
+	expect("hourly", hourly("2025-06-02T00:00:00Z", "2025-06-03T00:00:00Z"),
+		map[string]int64{"2025-06-02T09": 2, "2025-06-02T10": 17, "2025-06-02T11": 12})
+	expect("daily", daily("2025-06-01T00:00:00Z", "2025-06-03T00:00:00Z"),
+		map[string]int64{"2025-06-01": 1, "2025-06-02": 31})
+
+	// past midnight the day is materialized whole
+	if err := w.run(ctx, at("2025-06-03T00:05:00Z")); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	var day int64
+	if err := db.QueryRow(ctx, `SELECT consumption_amount FROM api_key_service_usage_daily WHERE day = '2025-06-02'`).Scan(&day); err != nil {
+		t.Fatalf("api_key_service_usage_daily: %v", err)
+	}
+	if day != 31 {
+		t.Errorf("2025-06-02 = %d, want 31", day)
+	}
+	expect("daily", daily("2025-06-01T00:00:00Z", "2025-06-03T00:00:00Z"),
+		map[string]int64{"2025-06-01": 1, "2025-06-02": 31})
+}
@@ -0,0 +1,630 @@
+package rules
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The expressions are a subset of CEL: string, int and bool literals, lists,
+// the request map, ==, !=, <, <=, >, >=, in, &&, ||, !, and the functions
+// startsWith, endsWith, contains, matches, inCIDR, lower and size.
+//
+//	request.method == "POST" && request.header["User-Agent"].matches("(?i)bot")
+//	request.remote_addr.inCIDR("10.0.0.0/8")
+
+// node is a compiled expression.
+type node interface {
+	eval(vars map[string]any) (any, error)
+}
+
+// compile parses an expression.
+func compile(src string) (node, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", tok.text, tok.pos)
+	}
+	return n, nil
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokInt
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func lex(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(src) && src[j] != c {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			text := src[i+1 : j]
+			if c == '\'' {
+				text = strings.ReplaceAll(strings.ReplaceAll(text, `"`, `\"`), `\'`, `'`)
+			}
+			s, err := strconv.Unquote(`"` + text + `"`)
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %d: %w", i, err)
+			}
+			tokens = append(tokens, token{tokString, s, i})
+			i = j + 1
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && src[j] >= '0' && src[j] <= '9' {
+				j++
+			}
+			tokens = append(tokens, token{tokInt, src[i:j], i})
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(src) && (src[j] == '_' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			tokens = append(tokens, token{tokIdent, src[i:j], i})
+			i = j
+		default:
+			op := ""
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ".", ","} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			tokens = append(tokens, token{tokOp, op, i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{tokEOF, "end of expression", len(src)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the operator op if it's next.
+func (p *parser) accept(op string) bool {
+	if tok := p.peek(); tok.kind == tokOp && tok.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		tok := p.peek()
+		return fmt.Errorf("expected %q at %d, got %q", op, tok.pos, tok.text)
+	}
+	return nil
+}
+
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = logical{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.comparison()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.comparison()
+		if err != nil {
+			return nil, err
+		}
+		left = logical{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) comparison() (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	op := ""
+	switch {
+	case tok.kind == tokOp:
+		switch tok.text {
+		case "==", "!=", "<", "<=", ">", ">=":
+			op = tok.text
+		}
+	case tok.kind == tokIdent && tok.text == "in":
+		op = "in"
+	}
+	if op == "" {
+		return left, nil
+	}
+	p.next()
+	right, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	return compare{op: op, left: left, right: right}, nil
+}
+
+func (p *parser) unary() (node, error) {
+	if p.accept("!") {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return not{operand}, nil
+	}
+	return p.postfix()
+}
+
+func (p *parser) postfix() (node, error) {
+	n, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			tok := p.next()
+			if tok.kind != tokIdent {
+				return nil, fmt.Errorf("expected a name at %d, got %q", tok.pos, tok.text)
+			}
+			if !p.accept("(") {
+				n = index{target: n, key: literal{tok.text}}
+				continue
+			}
+			args, err := p.args()
+			if err != nil {
+				return nil, err
+			}
+			n, err = newCall(tok.text, append([]node{n}, args...))
+			if err != nil {
+				return nil, fmt.Errorf("%s at %d", err, tok.pos)
+			}
+		case p.accept("["):
+			key, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			n = index{target: n, key: key}
+		default:
+			return n, nil
+		}
+	}
+}
+
+// args parses the arguments of a call after its opening parenthesis.
+func (p *parser) args() ([]node, error) {
+	var args []node
+	if p.accept(")") {
+		return args, nil
+	}
+	for {
+		arg, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.accept(")") {
+			return args, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) primary() (node, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokString:
+		return literal{tok.text}, nil
+	case tokInt:
+		i, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid int at %d: %w", tok.pos, err)
+		}
+		return literal{i}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return literal{true}, nil
+		case "false":
+			return literal{false}, nil
+		}
+		if p.accept("(") {
+			args, err := p.args()
+			if err != nil {
+				return nil, err
+			}
+			n, err := newCall(tok.text, args)
+			if err != nil {
+				return nil, fmt.Errorf("%s at %d", err, tok.pos)
+			}
+			return n, nil
+		}
+		return variable(tok.text), nil
+	case tokOp:
+		switch tok.text {
+		case "(":
+			n, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		case "[":
+			args, err := p.list()
+			if err != nil {
+				return nil, err
+			}
+			return list(args), nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", tok.text, tok.pos)
+}
+
+// list parses the items of a list after its opening bracket.
+func (p *parser) list() ([]node, error) {
+	var items []node
+	if p.accept("]") {
+		return items, nil
+	}
+	for {
+		item, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if p.accept("]") {
+			return items, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+type literal struct {
+	value any
+}
+
+func (l literal) eval(map[string]any) (any, error) {
+	return l.value, nil
+}
+
+type variable string
+
+func (v variable) eval(vars map[string]any) (any, error) {
+	value, ok := vars[string(v)]
+	if !ok {
+		return nil, fmt.Errorf("undeclared reference to %q", string(v))
+	}
+	return value, nil
+}
+
+type list []node
+
+func (l list) eval(vars map[string]any) (any, error) {
+	values := make([]any, len(l))
+	for i, item := range l {
+		value, err := item.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// index looks up a key of a map, missing keys are empty strings so that
+// absent headers and query parameters compare as such.
+type index struct {
+	target node
+	key    node
+}
+
+func (x index) eval(vars map[string]any) (any, error) {
+	target, err := x.target.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x.key.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	name, ok := key.(string)
+	if !ok {
+		return nil, fmt.Errorf("no such key %v", key)
+	}
+	switch m := target.(type) {
+	case map[string]any:
+		value, ok := m[name]
+		if !ok {
+			return nil, fmt.Errorf("no such field %q", name)
+		}
+		return value, nil
+	case lookup:
+		return m.get(name), nil
+	}
+	return nil, fmt.Errorf("%T has no fields", target)
+}
+
+// lookup is a map of strings such as the headers or the query parameters.
+type lookup interface {
+	get(key string) string
+	has(key string) bool
+}
+
+type logical struct {
+	op          string
+	left, right node
+}
+
+func (l logical) eval(vars map[string]any) (any, error) {
+	left, err := evalBool(l.left, vars)
+	if err != nil {
+		return nil, err
+	}
+	if l.op == "&&" && !left || l.op == "||" && left {
+		return left, nil
+	}
+	return evalBool(l.right, vars)
+}
+
+type not struct {
+	operand node
+}
+
+func (n not) eval(vars map[string]any) (any, error) {
+	b, err := evalBool(n.operand, vars)
+	return !b, err
+}
+
+func evalBool(n node, vars map[string]any) (bool, error) {
+	value, err := n.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expected a bool, got %T", value)
+	}
+	return b, nil
+}
+
+type compare struct {
+	op          string
+	left, right node
+}
+
+func (c compare) eval(vars map[string]any) (any, error) {
+	left, err := c.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	right, err := c.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	switch c.op {
+	case "==":
+		return left == right, nil
+	case "!=":
+		return left != right, nil
+	case "in":
+		switch r := right.(type) {
+		case []any:
+			for _, item := range r {
+				if item == left {
+					return true, nil
+				}
+			}
+			return false, nil
+		case lookup:
+			key, ok := left.(string)
+			return ok && r.has(key), nil
+		}
+		return nil, fmt.Errorf("in expects a list or a map, got %T", right)
+	}
+	switch l := left.(type) {
+	case int64:
+		if r, ok := right.(int64); ok {
+			return ordered(c.op, l, r), nil
+		}
+	case string:
+		if r, ok := right.(string); ok {
+			return ordered(c.op, l, r), nil
+		}
+	}
+	return nil, fmt.Errorf("no such overload %T %s %T", left, c.op, right)
+}
+
+func ordered[T int64 | string](op string, l, r T) bool {
+	switch op {
+	case "<":
+		return l < r
+	case "<=":
+		return l <= r
+	case ">":
+		return l > r
+	}
+	return l >= r
+}
+
+// call is a function call, for methods the receiver is the first argument.
+type call struct {
+	name string
+	args []node
+	// re is the compiled pattern of matches with a literal pattern
+	re *regexp.Regexp
+	// prefix is the parsed network of inCIDR with a literal network
+	prefix netip.Prefix
+}
+
+// arities of the functions.
+var functions = map[string]int{
+	"startsWith": 2,
+	"endsWith":   2,
+	"contains":   2,
+	"matches":    2,
+	"inCIDR":     2,
+	"lower":      1,
+	"size":       1,
+}
+
+func newCall(name string, args []node) (node, error) {
+	arity, ok := functions[name]
+	if !ok {
+		return nil, fmt.Errorf("undeclared function %q", name)
+	}
+	if len(args) != arity {
+		return nil, fmt.Errorf("%s expects %d arguments, got %d", name, arity, len(args))
+	}
+	c := call{name: name, args: args}
+	if pattern, ok := args[len(args)-1].(literal); ok && name == "matches" {
+		s, ok := pattern.value.(string)
+		if !ok {
+			return nil, fmt.Errorf("matches expects a string pattern")
+		}
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("regexp.Compile: %w", err)
+		}
+		c.re = re
+	}
+	if network, ok := args[len(args)-1].(literal); ok && name == "inCIDR" {
+		s, ok := network.value.(string)
+		if !ok {
+			return nil, fmt.Errorf("inCIDR expects a string network")
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("netip.ParsePrefix: %w", err)
+		}
+		c.prefix = prefix
+	}
+	return c, nil
+}
+
+func (c call) eval(vars map[string]any) (any, error) {
+	args := make([]any, len(c.args))
+	for i, arg := range c.args {
+		value, err := arg.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	if c.name == "size" {
+		switch v := args[0].(type) {
+		case string:
+			return int64(len(v)), nil
+		case []any:
+			return int64(len(v)), nil
+		}
+		return nil, fmt.Errorf("no such overload size(%T)", args[0])
+	}
+	s, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("no such overload %T.%s", args[0], c.name)
+	}
+	if c.name == "lower" {
+		return strings.ToLower(s), nil
+	}
+	arg, ok := args[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("no such overload %s(%T)", c.name, args[1])
+	}
+	switch c.name {
+	case "startsWith":
+		return strings.HasPrefix(s, arg), nil
+	case "endsWith":
+		return strings.HasSuffix(s, arg), nil
+	case "contains":
+		return strings.Contains(s, arg), nil
+	case "inCIDR":
+		prefix := c.prefix
+		if !prefix.IsValid() {
+			var err error
+			if prefix, err = netip.ParsePrefix(arg); err != nil {
+				return nil, fmt.Errorf("netip.ParsePrefix: %w", err)
+			}
+		}
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			// not an address, e.g. the remote of a unix socket
+			return false, nil
+		}
+		return prefix.Contains(addr.Unmap()), nil
+	}
+	re := c.re
+	if re == nil {
+		var err error
+		if re, err = regexp.Compile(arg); err != nil {
+			return nil, fmt.Errorf("regexp.Compile: %w", err)
+		}
+	}
+	return re.MatchString(s), nil
+}
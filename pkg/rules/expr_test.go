@@ -0,0 +1,161 @@
+package rules
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func testVars() map[string]any {
+	return map[string]any{"request": map[string]any{
+		"method":      "POST",
+		"path":        "/jina/docs.example.com/guide.pdf",
+		"host":        "cache.example.com",
+		"provider":    "jina",
+		"remote_addr": "10.1.2.3",
+		"header":      headerLookup(http.Header{"User-Agent": {"Googlebot/2.1"}, "X-Team": {"search"}, "X-Pattern": {"("}}),
+		"query":       queryLookup(url.Values{"page": {"2"}}),
+	}}
+}
+
+func TestEval(t *testing.T) {
+	for _, tt := range []struct {
+		expr string
+		want bool
+	}{
+		// precedence: ! binds tighter than comparisons, then &&, then ||
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`false && false || true`, true},
+		{`!false && false`, false},
+		{`!(false && false)`, true},
+		{`!true == false`, true},
+		{`request.method == "GET" || request.provider == "jina" && request.method == "POST"`, true},
+		{`request.method == "GET" || request.provider == "fetch" && request.method == "POST"`, false},
+		// short-circuit: the right side isn't evaluated
+		{`false && request.nope == "x"`, false},
+		{`true || request.nope == "x"`, true},
+
+		// strings
+		{`request.path.startsWith("/jina/")`, true},
+		{`request.path.endsWith(".pdf")`, true},
+		{`request.path.contains("example.com")`, true},
+		{`request.path.contains("other.com")`, false},
+		{`request.header["User-Agent"].lower() == "googlebot/2.1"`, true},
+		{`request.header["X-Missing"] == ""`, true},
+		{`request.query["page"] == "2"`, true},
+		{`"X-Team" in request.header`, true},
+		{`"X-Missing" in request.header`, false},
+		{`request.method in ["GET", "POST"]`, true},
+		{`request.method in []`, false},
+		{`size(request.provider) == 4`, true},
+		{`request.provider.size() > 3`, true},
+		{`"abc" < "abd"`, true},
+		{`'single "quoted"' == "single \"quoted\""`, true},
+
+		// regexes
+		{`request.header["User-Agent"].matches("(?i)bot")`, true},
+		{`request.header["User-Agent"].matches("^bot")`, false},
+		{`request.path.matches("\\.pdf$")`, true},
+		{`request.path.matches(request.provider)`, true},
+
+		// CIDR
+		{`request.remote_addr.inCIDR("10.0.0.0/8")`, true},
+		{`request.remote_addr.inCIDR("10.1.2.3/32")`, true},
+		{`request.remote_addr.inCIDR("192.168.0.0/16")`, false},
+		{`request.remote_addr.inCIDR("::/0")`, false},
+		{`"::ffff:10.1.2.3".inCIDR("10.0.0.0/8")`, true},
+		{`"2001:db8::1".inCIDR("2001:db8::/32")`, true},
+		{`"@".inCIDR("0.0.0.0/0")`, false},
+	} {
+		n, err := compile(tt.expr)
+		if err != nil {
+			t.Errorf("compile(%s): %v", tt.expr, err)
+			continue
+		}
+		got, err := evalBool(n, testVars())
+		if err != nil {
+			t.Errorf("eval(%s): %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("eval(%s) = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`(`,
+		`)`,
+		`request.`,
+		`request.method ==`,
+		`== "GET"`,
+		`request.method == "GET" &&`,
+		`"unterminated`,
+		`"bad escape \q"`,
+		`request.method = "GET"`,
+		`request.method == "GET" "POST"`,
+		`1 < 2 == true`,
+		`[1, 2`,
+		`[1 2]`,
+		`request.header["a"`,
+		`request.path.startsWith("a"`,
+		`request.path.startsWith("a" "b")`,
+		`request.path.nope("a")`,
+		`request.path.startsWith()`,
+		`request.path.matches("(")`,
+		`request.path.matches(1)`,
+		`request.remote_addr.inCIDR("10.0.0.0")`,
+		`request.remote_addr.inCIDR("nope/8")`,
+		`99999999999999999999 == 1`,
+		`request.1`,
+		`#`,
+		`request.method == "GET" ; drop`,
+		"\\",
+		"'",
+		`"\`,
+		`!`,
+		`!!!`,
+		`((((`,
+		`[`,
+		`a[`,
+		`a.b(`,
+		`a.b(,`,
+	} {
+		if _, err := compile(expr); err == nil {
+			t.Errorf("compile(%s) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	for _, expr := range []string{
+		`nope == "x"`,
+		`request.nope == "x"`,
+		`request.method == "POST" && request.nope == "x"`,
+		`request.method`,
+		`1`,
+		`!"x"`,
+		`request.method < 1`,
+		`request.method in "POST"`,
+		`request.method.method == "x"`,
+		`request[1] == "x"`,
+		`size(1) == 1`,
+		`request.path.startsWith(1)`,
+		`request.path.matches(request.nope)`,
+		`request.path.matches(request.header["X-Pattern"])`,
+		`request.remote_addr.inCIDR(request.path)`,
+		`(1).lower() == "1"`,
+	} {
+		n, err := compile(expr)
+		if err != nil {
+			t.Errorf("compile(%s): %v", expr, err)
+			continue
+		}
+		if got, err := evalBool(n, testVars()); err == nil {
+			t.Errorf("eval(%s) = %v, want an error", expr, got)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Package rules evaluates operator admission rules on every request. A rule
+// is an expression over the request and an action taken when it's true:
+//
+//	[
+//	  {"name": "no-bots", "when": "request.header[\"User-Agent\"].matches(\"(?i)bot\")", "action": "block"},
+//	  {"name": "tag-pdf", "when": "request.path.endsWith(\".pdf\")", "action": "header", "headers": {"X-Respond-With": "markdown"}},
+//	  {"name": "fetch-docs", "when": "request.provider == \"jina\" && request.path.contains(\"docs.example.com\")", "action": "route", "route": "fetch"}
+//	]
+//
+// The request map holds method, path, host, provider (the first path
+// segment), remote_addr, header and query. Rules run in order, a block stops
+// the evaluation.
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var metrics = expvar.NewMap("rules")
+
+// Rule is an admission or transform rule.
+type Rule struct {
+	Name string `json:"name"`
+	// When is the expression selecting the requests.
+	When string `json:"when"`
+	// Action is "block", "header" or "route".
+	Action string `json:"action"`
+	// Status and Message answer blocked requests, 403 by default.
+	Status  int    `json:"status,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Headers are set on the requests of a header rule.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Route is the provider a route rule sends the requests to, e.g. "fetch".
+	Route string `json:"route,omitempty"`
+}
+
+type compiled struct {
+	Rule
+	when node
+}
+
+// Engine holds the rules in effect, they can be replaced at any time.
+type Engine struct {
+	rules  atomic.Pointer[[]compiled]
+	logger *slog.Logger
+}
+
+// New creates a new Engine without rules.
+func New(logger *slog.Logger) *Engine {
+	e := &Engine{logger: logger}
+	e.rules.Store(&[]compiled{})
+	return e
+}
+
+// Set compiles and installs rules. On error, the rules in effect are kept.
+func (e *Engine) Set(rules []Rule) error {
+	set := make([]compiled, 0, len(rules))
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		when, err := compile(rule.When)
+		if err != nil {
+			return fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		switch rule.Action {
+		case "block":
+			if rule.Status == 0 {
+				rule.Status = http.StatusForbidden
+			}
+			if rule.Message == "" {
+				rule.Message = "Request blocked"
+			}
+		case "header":
+			if len(rule.Headers) == 0 {
+				return fmt.Errorf("rule %q: header rules need headers", rule.Name)
+			}
+		case "route":
+			if rule.Route == "" || strings.Contains(rule.Route, "/") {
+				return fmt.Errorf("rule %q: invalid route %q", rule.Name, rule.Route)
+			}
+		default:
+			return fmt.Errorf("rule %q: unknown action %q", rule.Name, rule.Action)
+		}
+		set = append(set, compiled{Rule: rule, when: when})
+	}
+	e.rules.Store(&set)
+	return nil
+}
+
+// Load reads a JSON list of rules from a file.
+func Load(path string) ([]Rule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.ReadFile: %w", err)
+	}
+	var rules []Rule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return rules, nil
+}
+
+// WatchFile installs the rules of path, then reloads them whenever the file
+// changes until ctx is done. Invalid rules are logged and the previous ones kept.
+func (e *Engine) WatchFile(ctx context.Context, path string, interval time.Duration) error {
+	rules, err := Load(path)
+	if err != nil {
+		return err
+	}
+	if err := e.Set(rules); err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("os.Stat: %w", err)
+	}
+	modified := info.ModTime()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			info, err := os.Stat(path)
+			if err != nil || info.ModTime().Equal(modified) {
+				continue
+			}
+			modified = info.ModTime()
+			rules, err := Load(path)
+			if err == nil {
+				err = e.Set(rules)
+			}
+			if err != nil {
+				e.logger.Error("Failed to reload rules", "path", path, "error", err)
+				continue
+			}
+			e.logger.Info("Rules reloaded", "path", path, "rules", len(rules))
+		}
+	}()
+	return nil
+}
+
+// HTTPHandlerMiddleware evaluates the rules before next. A rule that fails to
+// evaluate, e.g. comparing a string to an int, is skipped.
+func (e *Engine) HTTPHandlerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rules := *e.rules.Load()
+		if len(rules) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		vars := map[string]any{"request": requestMap(r)}
+		for _, rule := range rules {
+			match, err := evalBool(rule.when, vars)
+			if err != nil {
+				metrics.Add("errors", 1)
+				e.logger.Warn("Failed to evaluate rule", "rule", rule.Name, "error", err)
+				continue
+			}
+			if !match {
+				continue
+			}
+			metrics.Add(rule.Action, 1)
+			e.logger.Debug("Rule matched", "rule", rule.Name, "action", rule.Action)
+			switch rule.Action {
+			case "block":
+				http.Error(w, rule.Message, rule.Status)
+				return
+			case "header":
+				for name, value := range rule.Headers {
+					r.Header.Set(name, value)
+				}
+			case "route":
+				path := strings.TrimPrefix(r.URL.Path, "/")
+				_, rest, _ := strings.Cut(path, "/")
+				r.URL.Path = "/" + rule.Route + "/" + rest
+				r.URL.RawPath = ""
+			}
+			// later rules see the transformed request
+			vars["request"] = requestMap(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestMap exposes a request to the expressions.
+func requestMap(r *http.Request) map[string]any {
+	provider, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	return map[string]any{
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"host":        r.Host,
+		"provider":    provider,
+		"remote_addr": remote,
+		"header":      headerLookup(r.Header),
+		"query":       queryLookup(r.URL.Query()),
+	}
+}
+
+type headerLookup http.Header
+
+func (h headerLookup) get(key string) string { return http.Header(h).Get(key) }
+
+func (h headerLookup) has(key string) bool { return len(http.Header(h).Values(key)) > 0 }
+
+type queryLookup url.Values
+
+func (q queryLookup) get(key string) string { return url.Values(q).Get(key) }
+
+func (q queryLookup) has(key string) bool { return url.Values(q).Has(key) }
@@ -0,0 +1,175 @@
+package rules
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/proxy"
+)
+
+var discard = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// The batch sub-requests go through the mux, not the server handler, so the
+// batch is given the ruled mux as the server does.
+func TestBatchSubRequestsAreRuled(t *testing.T) {
+	e := New(discard)
+	if err := e.Set([]Rule{{Name: "no-internal", When: `request.path.contains("internal.example.com")`, Action: "block"}}); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	var served []string
+	mux.HandleFunc("/jina/", func(w http.ResponseWriter, r *http.Request) {
+		served = append(served, r.URL.Path)
+		_, _ = io.WriteString(w, "ok")
+	})
+	batch, err := proxy.NewBatch("/batch", e.HTTPHandlerMiddleware(mux), nil, 1, 10, discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.Handle("/batch", batch)
+	h := e.HTTPHandlerMiddleware(mux)
+
+	body, _ := json.Marshal([]proxy.BatchRequest{
+		{Path: "/jina/example.com/docs"},
+		{Path: "/jina/internal.example.com/secrets"},
+	})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/batch", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("batch answered %d: %s", rec.Code, rec.Body)
+	}
+	var results []proxy.BatchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Status != http.StatusOK || results[1].Status != http.StatusForbidden {
+		t.Fatalf("got %+v, want the blocked URL refused", results)
+	}
+	if len(served) != 1 || served[0] != "/jina/example.com/docs" {
+		t.Errorf("served %q, want the allowed URL only", served)
+	}
+}
+
+func TestRuleOrder(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		rules      []Rule
+		path       string
+		wantStatus int
+		wantBody   string
+		wantPath   string
+		wantHeader string
+	}{
+		{
+			name: "the first matching block answers",
+			rules: []Rule{
+				{Name: "pdf", When: `request.path.endsWith(".pdf")`, Action: "block", Status: 451, Message: "pdf"},
+				{Name: "jina", When: `request.provider == "jina"`, Action: "block", Status: 429, Message: "jina"},
+			},
+			path:       "/jina/example.com/a.pdf",
+			wantStatus: 451,
+			wantBody:   "pdf\n",
+		},
+		{
+			name: "rules not matching are passed over",
+			rules: []Rule{
+				{Name: "pdf", When: `request.path.endsWith(".pdf")`, Action: "block", Status: 451, Message: "pdf"},
+				{Name: "jina", When: `request.provider == "jina"`, Action: "block", Status: 429, Message: "jina"},
+			},
+			path:       "/jina/example.com/a.html",
+			wantStatus: 429,
+			wantBody:   "jina\n",
+		},
+		{
+			name: "a block stops the evaluation",
+			rules: []Rule{
+				{Name: "all", When: `true`, Action: "block"},
+				{Name: "tag", When: `true`, Action: "header", Headers: map[string]string{"X-Rule": "tag"}},
+			},
+			path:       "/jina/example.com/",
+			wantStatus: http.StatusForbidden,
+			wantBody:   "Request blocked\n",
+		},
+		{
+			name: "later rules see the headers of the earlier ones",
+			rules: []Rule{
+				{Name: "first", When: `true`, Action: "header", Headers: map[string]string{"X-Rule": "first"}},
+				{Name: "second", When: `request.header["X-Rule"] == "first"`, Action: "header", Headers: map[string]string{"X-Rule": "second"}},
+			},
+			path:       "/jina/example.com/",
+			wantStatus: http.StatusOK,
+			wantPath:   "/jina/example.com/",
+			wantHeader: "second",
+		},
+		{
+			name: "later rules see the route of the earlier ones",
+			rules: []Rule{
+				{Name: "route", When: `request.path.contains("docs.")`, Action: "route", Route: "fetch"},
+				{Name: "jina", When: `request.provider == "jina"`, Action: "block"},
+			},
+			path:       "/jina/docs.example.com/guide",
+			wantStatus: http.StatusOK,
+			wantPath:   "/fetch/docs.example.com/guide",
+		},
+		{
+			name: "a rule failing to evaluate is skipped",
+			rules: []Rule{
+				{Name: "broken", When: `request.nope == "x"`, Action: "block"},
+				{Name: "tag", When: `true`, Action: "header", Headers: map[string]string{"X-Rule": "tag"}},
+			},
+			path:       "/jina/example.com/",
+			wantStatus: http.StatusOK,
+			wantPath:   "/jina/example.com/",
+			wantHeader: "tag",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			e := New(discard)
+			if err := e.Set(tt.rules); err != nil {
+				t.Fatal(err)
+			}
+			var path, header string
+			h := e.HTTPHandlerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path, header = r.URL.Path, r.Header.Get("X-Rule")
+			}))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if rec.Body.String() != tt.wantBody {
+				t.Errorf("body %q, want %q", rec.Body, tt.wantBody)
+			}
+			if path != tt.wantPath || header != tt.wantHeader {
+				t.Errorf("served %q with X-Rule %q, want %q with %q", path, header, tt.wantPath, tt.wantHeader)
+			}
+		})
+	}
+}
+
+func TestSetKeepsTheRulesOnError(t *testing.T) {
+	e := New(discard)
+	if err := e.Set([]Rule{{When: `true`, Action: "block"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, rules := range [][]Rule{
+		{{When: `true`, Action: "block"}, {When: `(`, Action: "block"}},
+		{{When: `true`, Action: "drop"}},
+		{{When: `true`, Action: "header"}},
+		{{When: `true`, Action: "route", Route: "a/b"}},
+	} {
+		if err := e.Set(rules); err == nil {
+			t.Errorf("Set(%+v) succeeded, want an error", rules)
+		}
+	}
+	rec := httptest.NewRecorder()
+	e.HTTPHandlerMiddleware(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jina/", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status %d, want the block of the rules kept", rec.Code)
+	}
+}
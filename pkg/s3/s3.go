@@ -0,0 +1,71 @@
+// Package s3 is a minimal client for S3 compatible object stores,
+// it only uploads objects, signed with AWS signature version 4.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/sigv4"
+)
+
+// Client uploads objects to a bucket with path-style URLs, so it works with
+// AWS as well as MinIO or R2.
+type Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// New creates a new Client, endpoint is e.g. "https://s3.us-east-1.amazonaws.com".
+func New(endpoint, region, bucket, accessKey, secretKey string) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse(endpoint): %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	return &Client{
+		endpoint:  u,
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+// PutObject uploads body under key.
+func (c *Client) PutObject(ctx context.Context, key string, body []byte, contentType string) error {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket + "/" + key
+	u.RawPath = sigv4.EscapePath(u.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("http.NewRequest: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	creds := sigv4.Credentials{AccessKeyID: c.accessKey, SecretAccessKey: c.secretKey}
+	sigv4.Sign(req, creds, "s3", c.region, sigv4.PayloadHash(body), time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("client.Do: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("put object %q: %s: %s", key, resp.Status, msg)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package search
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultLimit = 10
+	maxLimit     = 50
+)
+
+// searchResponse is the answer of GET /search-cache.
+type searchResponse struct {
+	Query   string   `json:"query"`
+	Results []Result `json:"results"`
+}
+
+// ServeHTTP handles GET /search-cache?q=...&host=...&lang=...&type=...&limit=...,
+// it's mounted behind the tollgate of the internal key. lang and type are the
+// language and the media type detected in the pages, e.g. "en" and "text/html".
+//
+//	curl "https://cachev1.example.com/search-cache?q=%22rate+limit%22+redis&lang=en" -H "Authorization: Bearer xxx"
+func (ix *Index) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := query.Get("q")
+	if q == "" {
+		http.Error(w, "Missing q", http.StatusBadRequest)
+		return
+	}
+	limit := defaultLimit
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxLimit {
+			http.Error(w, "Invalid limit, expected 1 to "+strconv.Itoa(maxLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	filter := Filter{Host: query.Get("host"), Language: query.Get("lang"), ContentType: query.Get("type")}
+	results, err := ix.Search(r.Context(), q, filter, limit)
+	if err != nil {
+		ix.logger.Error("Failed to search the cached pages", "error", err)
+		http.Error(w, "Search failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(searchResponse{Query: q, Results: results}); err != nil {
+		// response was already committed, nothing left to do
+		_ = err
+	}
+}
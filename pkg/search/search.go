@@ -0,0 +1,312 @@
+// Package search indexes the pages read through the Jina and fetch routes in
+// Postgres full-text search, so teams can look up what was already scraped
+// about a topic before spending quota on it.
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"html"
+	"log/slog"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/cache"
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+	"github.com/Airren/poorman-httpcache/v2/pkg/proxy"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// metrics are published on /debug/vars under "search_index".
+var metrics = expvar.NewMap("search_index")
+
+const (
+	// maxPageSize caps what's read of a page to index it
+	maxPageSize = 1 << 20
+	// maxContentSize caps the indexed text, Postgres caps a tsvector at 1MB
+	maxContentSize = 256 << 10
+)
+
+var htmlTitle = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// page is a cached answer waiting to be indexed.
+type page struct {
+	url         string
+	host        string
+	provider    string
+	contentType string
+	// content is the type and the language the cache detected
+	content cache.Content
+	value   []byte
+}
+
+// Index keeps the full-text index of the cached pages. Pages are indexed
+// asynchronously, and dropped when the queue is full rather than slowing
+// requests down.
+type Index struct {
+	postgresURL string
+	pages       chan page
+	done        chan struct{}
+	logger      *slog.Logger
+
+	// mu guards the connection, shared by the indexing and the searches
+	mu   sync.Mutex
+	conn *pgx.Conn
+}
+
+// New creates a new Index in the Postgres at postgresURL, queueing up to
+// queueSize pages. Postgres is connected to on first use, so the cache keeps
+// running without it.
+func New(postgresURL string, queueSize int, logger *slog.Logger) *Index {
+	return &Index{
+		postgresURL: postgresURL,
+		pages:       make(chan page, queueSize),
+		done:        make(chan struct{}),
+		logger:      logger,
+	}
+}
+
+// query runs fn with the queries of the connection, connecting first when
+// there's none or it was lost.
+func (ix *Index) query(ctx context.Context, fn func(*dbsqlc.Queries) error) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.conn == nil || ix.conn.IsClosed() {
+		conn, err := pgx.Connect(ctx, ix.postgresURL)
+		if err != nil {
+			return fmt.Errorf("pgx.Connect: %w", err)
+		}
+		ix.conn = conn
+	}
+	return fn(dbsqlc.New(ix.conn))
+}
+
+// close closes the connection, once the index stopped.
+func (ix *Index) close() {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.conn != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		ix.conn.Close(ctx)
+		ix.conn = nil
+	}
+}
+
+// Add queues a page the cache stored for indexing, it's the cache.WithOnStore
+// hook. Only the GET answers of the Jina and fetch routes are indexed.
+func (ix *Index) Add(r *http.Request, response cache.Response) {
+	if r.Method != http.MethodGet {
+		return
+	}
+	var route string
+	for _, prefix := range []string{"/jina/", "/fetch/"} {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			route = strings.TrimSuffix(prefix, "/")
+		}
+	}
+	if route == "" {
+		return
+	}
+	target, err := proxy.FetchTarget(strings.TrimPrefix(r.URL.Path, route), r.URL.RawQuery)
+	if err != nil {
+		return
+	}
+	provider := response.Provenance.Provider
+	if provider == "" {
+		provider = strings.TrimPrefix(route, "/")
+	}
+	// the value is only valid during the call
+	value := response.Value[:min(len(response.Value), maxPageSize)]
+	p := page{
+		url:         target.String(),
+		host:        strings.ToLower(target.Hostname()),
+		provider:    provider,
+		contentType: response.Header.Get("Content-Type"),
+		content:     response.Content,
+		value:       append([]byte(nil), value...),
+	}
+	select {
+	case ix.pages <- p:
+	default:
+		metrics.Add("dropped", 1)
+	}
+}
+
+// Start indexes the queued pages until ctx is done, then closes the
+// connections. Wait returns once it stopped.
+func (ix *Index) Start(ctx context.Context) {
+	go func() {
+		defer close(ix.done)
+		defer ix.close()
+		for {
+			select {
+			case p := <-ix.pages:
+				ix.index(ctx, p)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Wait blocks until the index stopped after its context was done.
+func (ix *Index) Wait() {
+	<-ix.done
+}
+
+func (ix *Index) index(ctx context.Context, p page) {
+	title, content, ok := document(p.contentType, p.value)
+	if !ok || strings.TrimSpace(content) == "" {
+		metrics.Add("skipped", 1)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	err := ix.query(ctx, func(q *dbsqlc.Queries) error {
+		return q.UpsertCachedPage(ctx, &dbsqlc.UpsertCachedPageParams{
+			Url:         p.url,
+			Host:        p.host,
+			Provider:    p.provider,
+			ContentType: p.content.Type,
+			Language:    p.content.Language,
+			Title:       title,
+			Content:     content,
+		})
+	})
+	if err != nil {
+		metrics.Add("failed", 1)
+		ix.logger.Warn("Failed to index page", "url", p.url, "error", err)
+		return
+	}
+	metrics.Add("indexed", 1)
+}
+
+// document returns the title and the text of a page, false when it's not text.
+func document(contentType string, value []byte) (string, string, bool) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	var title, content string
+	switch {
+	case strings.Contains(mediaType, "html"):
+		if m := htmlTitle.FindSubmatch(value); m != nil {
+			title = html.UnescapeString(string(m[1]))
+		}
+		content = proxy.HTMLToText(string(value))
+	case strings.HasSuffix(mediaType, "json"):
+		// Jina answers {"data": {"title": ..., "content": ...}} when asked for JSON
+		var doc struct {
+			Data struct {
+				Title   string `json:"title"`
+				Content string `json:"content"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(value, &doc); err != nil || doc.Data.Content == "" {
+			return "", "", false
+		}
+		title, content = doc.Data.Title, doc.Data.Content
+	case strings.HasPrefix(mediaType, "text/"), mediaType == "":
+		if !utf8.Valid(value) {
+			return "", "", false
+		}
+		content = string(value)
+		// Jina answers start with "Title: ..."
+		if first, _, _ := strings.Cut(content, "\n"); strings.HasPrefix(first, "Title: ") {
+			title = strings.TrimSpace(strings.TrimPrefix(first, "Title: "))
+		}
+	default:
+		return "", "", false
+	}
+	return clean(title, 1024), clean(content, maxContentSize), true
+}
+
+// clean makes s fit a Postgres text of up to size bytes.
+func clean(s string, size int) string {
+	s = strings.ReplaceAll(strings.ToValidUTF8(s, ""), "\x00", "")
+	if len(s) <= size {
+		return strings.TrimSpace(s)
+	}
+	s = s[:size]
+	// don't cut a rune in two
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return strings.TrimSpace(s)
+}
+
+// Result is a page matching a search.
+type Result struct {
+	URL         string    `json:"url"`
+	Host        string    `json:"host"`
+	Provider    string    `json:"provider"`
+	ContentType string    `json:"content_type,omitempty"`
+	Language    string    `json:"language,omitempty"`
+	Title       string    `json:"title,omitempty"`
+	Snippet     string    `json:"snippet"`
+	Rank        float32   `json:"rank"`
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
+// Filter narrows a search down, its empty fields match any page.
+type Filter struct {
+	Host string
+	// Language is the detected language of the pages, e.g. "en"
+	Language string
+	// ContentType is the detected type of the pages, e.g. "text/html"
+	ContentType string
+}
+
+// Search returns up to limit pages matching query, a web search style query
+// such as `"rate limit" -redis`, and filter.
+func (ix *Index) Search(ctx context.Context, query string, filter Filter, limit int) ([]Result, error) {
+	var rows []*dbsqlc.SearchCachedPagesRow
+	err := ix.query(ctx, func(q *dbsqlc.Queries) (err error) {
+		rows, err = q.SearchCachedPages(ctx, &dbsqlc.SearchCachedPagesParams{
+			Query:       query,
+			Host:        strings.ToLower(filter.Host),
+			Language:    strings.ToLower(filter.Language),
+			ContentType: strings.ToLower(filter.ContentType),
+			MaxResults:  int32(limit),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("SearchCachedPages: %w", err)
+	}
+	results := make([]Result, 0, len(rows))
+	for _, row := range rows {
+		results = append(results, Result{
+			URL:         row.Url,
+			Host:        row.Host,
+			Provider:    row.Provider,
+			ContentType: row.ContentType,
+			Language:    row.Language,
+			Title:       row.Title,
+			Snippet:     row.Snippet,
+			Rank:        row.Rank,
+			FetchedAt:   row.FetchedAt.Time,
+		})
+	}
+	return results, nil
+}
+
+// DeleteDomain deletes the pages of a domain and its subdomains from the
+// index, for erasure requests.
+func (ix *Index) DeleteDomain(ctx context.Context, domain string) (int64, error) {
+	var deleted int64
+	err := ix.query(ctx, func(q *dbsqlc.Queries) (err error) {
+		deleted, err = q.DeleteCachedPagesByDomain(ctx, strings.ToLower(domain))
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("DeleteCachedPagesByDomain: %w", err)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,76 @@
+package semantic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Embedder computes the embeddings of the queries with an OpenAI compatible
+// embeddings endpoint, e.g. "https://api.openai.com/v1/embeddings".
+type Embedder struct {
+	url    string
+	key    string
+	model  string
+	client *http.Client
+}
+
+// NewEmbedder creates a new Embedder of model at url, authenticated with key
+// when it's not empty.
+func NewEmbedder(url, key, model string, transport http.RoundTripper) *Embedder {
+	return &Embedder{
+		url:    url,
+		key:    key,
+		model:  model,
+		client: &http.Client{Transport: transport, Timeout: 5 * time.Second},
+	}
+}
+
+type embeddingRequest struct {
+	Model string `json:"model,omitempty"`
+	Input string `json:"input"`
+}
+
+type embeddingResponse struct {
+	Data []struct {
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+// Embed returns the embedding of text.
+func (e *Embedder) Embed(ctx context.Context, text string) ([]float32, error) {
+	body, err := json.Marshal(embeddingRequest{Model: e.model, Input: text})
+	if err != nil {
+		return nil, fmt.Errorf("json.Marshal: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.key != "" {
+		req.Header.Set("Authorization", "Bearer "+e.key)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("embeddings request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("embeddings endpoint answered %d: %s", resp.StatusCode, msg)
+	}
+	var answer embeddingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, fmt.Errorf("decode embeddings: %w", err)
+	}
+	if len(answer.Data) == 0 || len(answer.Data[0].Embedding) == 0 {
+		return nil, errors.New("embeddings endpoint answered no embedding")
+	}
+	return answer.Data[0].Embedding, nil
+}
@@ -0,0 +1,317 @@
+// Package semantic serves rephrased search queries from the cached answer of
+// a near-duplicate query, compared by the cosine similarity of their
+// embeddings.
+package semantic
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/cache"
+	"github.com/Airren/poorman-httpcache/v2/pkg/privacy"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Headers disclosing a substitution: the query whose cached answer was
+// served, URL encoded, and its similarity to the requested one.
+const (
+	MatchHeader      = "X-Semantic-Match"
+	SimilarityHeader = "X-Semantic-Similarity"
+)
+
+// metrics are published on /debug/vars under "semantic".
+var metrics = expvar.NewMap("semantic")
+
+// storeTTL is how long the queries of a parameter set are kept, counted from
+// the first one so the set renews daily.
+const storeTTL = 24 * time.Hour
+
+// Matcher substitutes the cached answer of a near-duplicate query for the
+// cache misses of a search provider. Queries are only compared with the
+// queries of the same parameters, e.g. country and page, and a substitute is
+// only served while it's cached. The embeddings of the answered queries are
+// kept in Redis for every replica.
+type Matcher struct {
+	redis      redis.Cmdable
+	cache      *cache.Cache
+	embedder   *Embedder
+	provider   string
+	threshold  float64
+	maxQueries int64
+	logger     *slog.Logger
+}
+
+// New creates a new Matcher of provider, serving substitutes from a
+// similarity of threshold and comparing up to maxQueries queries per
+// parameter set.
+func New(rdb redis.Cmdable, c *cache.Cache, embedder *Embedder, provider string, threshold float64, maxQueries int, logger *slog.Logger) *Matcher {
+	return &Matcher{
+		redis:      rdb,
+		cache:      c,
+		embedder:   embedder,
+		provider:   provider,
+		threshold:  threshold,
+		maxQueries: int64(maxQueries),
+		logger:     logger,
+	}
+}
+
+// search is a search request split into its query and the rest.
+type search struct {
+	query string
+	// params are the path and the parameters but the query, the queries are
+	// only compared within a parameter set
+	params string
+	// raw is the request as the cache keys it, the body or the URL query
+	raw string
+}
+
+// stored is a query kept in Redis.
+type stored struct {
+	Raw string `json:"raw"`
+	// Embedding is normalized and quantized to int8
+	Embedding []byte `json:"embedding"`
+}
+
+func (m *Matcher) key(params string) string {
+	sum := sha256.Sum256([]byte(params))
+	return "semantic:" + m.provider + ":" + hex.EncodeToString(sum[:8])
+}
+
+// statusWriter captures the status of the answer.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// HTTPHandlerMiddleware serves the substitute of the cache misses with a
+// near-duplicate, and records the queries answered upstream. It sits in
+// front of the cache middleware. Embedding or Redis failures let the request
+// through unchanged, so does privacy mode: the queries would be kept in
+// Redis and sent to the embeddings endpoint.
+func (m *Matcher) HTTPHandlerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if privacy.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		s, ok := parse(r)
+		if !ok || cache.Bypassed(r.Context()) || m.cache.Contains(r.Context(), r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		embedding, err := m.embedder.Embed(ctx, s.query)
+		cancel()
+		if err != nil {
+			metrics.Add("errors", 1)
+			m.logger.Warn("Failed to embed search query", "provider", m.provider, "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		vector := quantize(embedding)
+
+		if match, similarity, ok := m.match(r.Context(), s, vector); ok {
+			substitute := replace(r, match.Raw)
+			if m.cache.Contains(r.Context(), substitute) {
+				metrics.Add("matched", 1)
+				query := queryOf(match.Raw, r.Method)
+				m.logger.Info("Serving near-duplicate search query", "provider", m.provider, "similarity", similarity)
+				w.Header().Set(MatchHeader, url.QueryEscape(query))
+				w.Header().Set(SimilarityHeader, strconv.FormatFloat(similarity, 'f', 3, 64))
+				next.ServeHTTP(w, substitute)
+				return
+			}
+		}
+		metrics.Add("missed", 1)
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status >= 200 && sw.status < 300 {
+			m.record(context.WithoutCancel(r.Context()), s, vector)
+		}
+	})
+}
+
+// match returns the most similar query of the parameter set of s, when it's
+// at least as similar as the threshold.
+func (m *Matcher) match(ctx context.Context, s search, vector []byte) (stored, float64, bool) {
+	entries, err := m.redis.HGetAll(ctx, m.key(s.params)).Result()
+	if err != nil {
+		metrics.Add("errors", 1)
+		m.logger.Warn("Failed to read search queries", "provider", m.provider, "error", err)
+		return stored{}, 0, false
+	}
+	var best stored
+	bestSimilarity := -1.0
+	for _, value := range entries {
+		var candidate stored
+		if err := json.Unmarshal([]byte(value), &candidate); err != nil {
+			continue
+		}
+		if similarity := cosine(vector, candidate.Embedding); similarity > bestSimilarity {
+			best, bestSimilarity = candidate, similarity
+		}
+	}
+	return best, bestSimilarity, bestSimilarity >= m.threshold
+}
+
+// record keeps the embedding of a query answered upstream, up to maxQueries
+// per parameter set.
+func (m *Matcher) record(ctx context.Context, s search, vector []byte) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	key := m.key(s.params)
+	count, err := m.redis.HLen(ctx, key).Result()
+	if err != nil || count >= m.maxQueries {
+		return
+	}
+	value, err := json.Marshal(stored{Raw: s.raw, Embedding: vector})
+	if err != nil {
+		return
+	}
+	pipe := m.redis.TxPipeline()
+	pipe.HSet(ctx, key, s.query, value)
+	pipe.ExpireNX(ctx, key, storeTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		m.logger.Warn("Failed to record search query", "provider", m.provider, "error", err)
+		return
+	}
+	metrics.Add("recorded", 1)
+}
+
+// parse splits a search request, a GET with a q parameter or a POST with a
+// JSON object body with a q field. The body is restored.
+func parse(r *http.Request) (search, bool) {
+	switch r.Method {
+	case http.MethodGet:
+		values := r.URL.Query()
+		query := normalize(values.Get("q"))
+		if query == "" {
+			return search{}, false
+		}
+		values.Del("q")
+		return search{query: query, params: r.URL.Path + "?" + values.Encode(), raw: r.URL.RawQuery}, true
+	case http.MethodPost:
+		if r.Body == nil {
+			return search{}, false
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return search{}, false
+		}
+		var fields map[string]any
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return search{}, false
+		}
+		q, _ := fields["q"].(string)
+		query := normalize(q)
+		if query == "" {
+			return search{}, false
+		}
+		delete(fields, "q")
+		// map keys are marshaled sorted
+		params, err := json.Marshal(fields)
+		if err != nil {
+			return search{}, false
+		}
+		return search{query: query, params: r.URL.Path + string(params), raw: string(body)}, true
+	}
+	return search{}, false
+}
+
+func normalize(query string) string {
+	return strings.Join(strings.Fields(strings.ToLower(query)), " ")
+}
+
+// replace returns r asking for the stored request raw instead.
+func replace(r *http.Request, raw string) *http.Request {
+	substitute := r.Clone(r.Context())
+	if r.Method == http.MethodGet {
+		substitute.URL.RawQuery = raw
+		substitute.RequestURI = ""
+		return substitute
+	}
+	substitute.Body = io.NopCloser(strings.NewReader(raw))
+	substitute.ContentLength = int64(len(raw))
+	return substitute
+}
+
+// queryOf returns the query of a stored request.
+func queryOf(raw, method string) string {
+	if method == http.MethodGet {
+		values, _ := url.ParseQuery(raw)
+		return values.Get("q")
+	}
+	var fields struct {
+		Q string `json:"q"`
+	}
+	_ = json.Unmarshal([]byte(raw), &fields)
+	return fields.Q
+}
+
+// quantize normalizes an embedding and scales it to int8, a quarter of the
+// size in Redis for a negligible loss of precision.
+func quantize(embedding []float32) []byte {
+	var norm float64
+	for _, v := range embedding {
+		norm += float64(v) * float64(v)
+	}
+	norm = math.Sqrt(norm)
+	vector := make([]byte, len(embedding))
+	if norm == 0 {
+		return vector
+	}
+	for i, v := range embedding {
+		vector[i] = byte(int8(math.Round(float64(v) / norm * 127)))
+	}
+	return vector
+}
+
+// cosine returns the cosine similarity of two quantized vectors, 0 when their
+// dimensions differ, e.g. after an embedding model change.
+func cosine(a, b []byte) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		x, y := float64(int8(a[i])), float64(int8(b[i]))
+		dot += x * y
+		normA += x * x
+		normB += y * y
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(normA*normB)
+}
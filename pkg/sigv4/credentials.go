@@ -0,0 +1,251 @@
+package sigv4
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials are AWS credentials, Expires is zero for long-term ones.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+}
+
+// Provider retrieves credentials.
+type Provider interface {
+	Retrieve(ctx context.Context) (Credentials, error)
+}
+
+// ProviderFunc adapts a function to the Provider interface.
+type ProviderFunc func(ctx context.Context) (Credentials, error)
+
+// Retrieve implements the Provider interface.
+func (f ProviderFunc) Retrieve(ctx context.Context) (Credentials, error) {
+	return f(ctx)
+}
+
+// Static returns long-term credentials.
+func Static(accessKeyID, secretAccessKey string) Provider {
+	return ProviderFunc(func(ctx context.Context) (Credentials, error) {
+		return Credentials{AccessKeyID: accessKeyID, SecretAccessKey: secretAccessKey}, nil
+	})
+}
+
+// errNoCredentials is returned by a provider of the chain that has nothing to offer.
+var errNoCredentials = errors.New("no credentials")
+
+// refreshMargin renews temporary credentials this long before they expire.
+const refreshMargin = 5 * time.Minute
+
+// Chain looks up credentials like the AWS SDKs do: the environment, the
+// shared credentials file, the container credentials endpoint, then the
+// EC2 instance metadata. Credentials are kept until shortly before they expire.
+type Chain struct {
+	client *http.Client
+
+	mu    sync.Mutex
+	creds Credentials
+	found bool
+}
+
+// NewChain creates a new Chain.
+func NewChain() *Chain {
+	return &Chain{client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+// Retrieve implements the Provider interface.
+func (c *Chain) Retrieve(ctx context.Context) (Credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.found && (c.creds.Expires.IsZero() || time.Until(c.creds.Expires) > refreshMargin) {
+		return c.creds, nil
+	}
+	for _, provider := range []func(context.Context) (Credentials, error){
+		fromEnv, fromFile, c.fromContainer, c.fromInstance,
+	} {
+		creds, err := provider(ctx)
+		if errors.Is(err, errNoCredentials) {
+			continue
+		}
+		if err != nil {
+			return Credentials{}, err
+		}
+		c.creds, c.found = creds, true
+		return creds, nil
+	}
+	return Credentials{}, fmt.Errorf("no AWS credentials in the environment, shared file, container or instance metadata")
+}
+
+func fromEnv(ctx context.Context) (Credentials, error) {
+	id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if id == "" || secret == "" {
+		return Credentials{}, errNoCredentials
+	}
+	return Credentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+}
+
+// fromFile reads the AWS_PROFILE section of the shared credentials file.
+func fromFile(ctx context.Context) (Credentials, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return Credentials{}, errNoCredentials
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return Credentials{}, errNoCredentials
+	}
+	defer f.Close()
+
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	var creds Credentials
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(name) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Credentials{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return Credentials{}, errNoCredentials
+	}
+	return creds, nil
+}
+
+// temporaryCredentials is the answer of the container and instance endpoints.
+type temporaryCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// fromContainer reads the ECS/EKS container credentials endpoint.
+func (c *Chain) fromContainer(ctx context.Context) (Credentials, error) {
+	u := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		u = "http://169.254.170.2" + relative
+	}
+	if u == "" {
+		return Credentials{}, errNoCredentials
+	}
+	header := http.Header{}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		header.Set("Authorization", token)
+	} else if path := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); path != "" {
+		token, err := os.ReadFile(path)
+		if err != nil {
+			return Credentials{}, fmt.Errorf("os.ReadFile: %w", err)
+		}
+		header.Set("Authorization", strings.TrimSpace(string(token)))
+	}
+	body, err := c.get(ctx, http.MethodGet, u, header)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("container credentials: %w", err)
+	}
+	return parseTemporary(body)
+}
+
+// imdsEndpoint is the EC2 instance metadata service.
+const imdsEndpoint = "http://169.254.169.254"
+
+// fromInstance reads the role credentials of the EC2 instance metadata, IMDSv2.
+func (c *Chain) fromInstance(ctx context.Context) (Credentials, error) {
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return Credentials{}, errNoCredentials
+	}
+	// the metadata service answers right away on EC2, don't wait for it elsewhere
+	tokenCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	token, err := c.get(tokenCtx, http.MethodPut, imdsEndpoint+"/latest/api/token", http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"21600"}})
+	if err != nil {
+		// not on EC2
+		return Credentials{}, errNoCredentials
+	}
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+	role, err := c.get(ctx, http.MethodGet, imdsEndpoint+"/latest/meta-data/iam/security-credentials/", header)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("instance role: %w", err)
+	}
+	name, _, _ := strings.Cut(strings.TrimSpace(string(role)), "\n")
+	body, err := c.get(ctx, http.MethodGet, imdsEndpoint+"/latest/meta-data/iam/security-credentials/"+name, header)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("instance credentials: %w", err)
+	}
+	return parseTemporary(body)
+}
+
+func (c *Chain) get(ctx context.Context, method, u string, header http.Header) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("client.Do: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, fmt.Errorf("io.ReadAll: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", method, u, resp.Status)
+	}
+	return body, nil
+}
+
+func parseTemporary(body []byte) (Credentials, error) {
+	var t temporaryCredentials
+	if err := json.Unmarshal(body, &t); err != nil {
+		return Credentials{}, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	if t.AccessKeyID == "" || t.SecretAccessKey == "" {
+		return Credentials{}, fmt.Errorf("credentials endpoint answered without keys")
+	}
+	return Credentials{AccessKeyID: t.AccessKeyID, SecretAccessKey: t.SecretAccessKey, SessionToken: t.Token, Expires: t.Expiration}, nil
+}
@@ -0,0 +1,156 @@
+// Package sigv4 signs requests with AWS signature version 4, so AWS services
+// (S3, OpenSearch, Kendra, Bedrock...) can be called without the AWS SDK.
+package sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UnsignedPayload is the payload hash of requests whose body isn't signed.
+const UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// Sign adds the signature version 4 headers to req, for service in region.
+// payloadHash is the hex SHA-256 of the body, see PayloadHash. The host,
+// Content-Type and X-Amz-* headers are signed, so they must not change
+// afterwards; the other headers, which proxies and transports may rewrite,
+// aren't.
+func Sign(req *http.Request, creds Credentials, service, region, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	req.Header.Del("Authorization")
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		if !signed(name) {
+			continue
+		}
+		trimmed := make([]string, len(values))
+		for i, v := range values {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	uri := EscapePath(path)
+	// every service but S3 expects the path encoded twice
+	if service != "s3" {
+		uri = EscapePath(uri)
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uri,
+		canonicalQuery(req),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// signed reports whether the header name is signed.
+func signed(name string) bool {
+	name = strings.ToLower(name)
+	return name == "host" || name == "content-type" || strings.HasPrefix(name, "x-amz-")
+}
+
+// PayloadHash returns the hex SHA-256 of a body.
+func PayloadHash(body []byte) string {
+	return sha256Hex(body)
+}
+
+// canonicalQuery sorts the query parameters by name then value, every byte
+// but the unreserved characters escaped.
+func canonicalQuery(req *http.Request) string {
+	type pair struct{ name, value string }
+	var pairs []pair
+	for name, values := range req.URL.Query() {
+		for _, v := range values {
+			pairs = append(pairs, pair{escape(name, false), escape(v, false)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].name != pairs[j].name {
+			return pairs[i].name < pairs[j].name
+		}
+		return pairs[i].value < pairs[j].value
+	})
+	parts := make([]string, len(pairs))
+	for i, p := range pairs {
+		parts[i] = p.name + "=" + p.value
+	}
+	return strings.Join(parts, "&")
+}
+
+// EscapePath escapes every byte but the unreserved characters and "/",
+// as signature version 4 expects.
+func EscapePath(path string) string {
+	return escape(path, true)
+}
+
+func escape(s string, keepSlash bool) string {
+	var sb strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', keepSlash && b == '/':
+			sb.WriteByte(b)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", b)
+		}
+	}
+	return sb.String()
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
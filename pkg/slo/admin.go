@@ -0,0 +1,31 @@
+package slo
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Admin serves the SLO reports of a replica, behind adminauth.
+//
+//	curl "https://cachev1.example.com/admin/slo" -H "X-Admin-Key: xxx"
+type Admin struct {
+	tracker *Tracker
+}
+
+// NewAdmin creates a new Admin handler set.
+func NewAdmin(tracker *Tracker) *Admin {
+	return &Admin{tracker: tracker}
+}
+
+// Reports handles GET /admin/slo.
+func (a *Admin) Reports(w http.ResponseWriter, r *http.Request) {
+	reports := a.tracker.Reports()
+	slices.SortFunc(reports, func(a, b Report) int { return strings.Compare(a.Provider, b.Provider) })
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(reports); err != nil {
+		// response was already committed, nothing left to do
+		_ = err
+	}
+}
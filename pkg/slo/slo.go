@@ -0,0 +1,257 @@
+// Package slo tracks the availability and latency of the upstream of each
+// provider against service level objectives, over a rolling window, and the
+// error budgets left. Providers whose budget is exhausted can be tripped into
+// cache-only mode: cached answers are still served, misses get a 503 until
+// the failures age out of the window.
+package slo
+
+import (
+	"expvar"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// metrics are published on /debug/vars under "slo", a report per provider.
+var metrics = expvar.NewMap("slo")
+
+// Objectives are the targets of the providers.
+type Objectives struct {
+	// Availability is the share of requests answered without a 5xx, e.g. 0.99
+	Availability float64
+	// Latency is the time to first byte of a fast request
+	Latency time.Duration
+	// LatencyTarget is the share of requests faster than Latency, e.g. 0.95
+	LatencyTarget float64
+	// Window is how far back the requests count, by the minute
+	Window time.Duration
+	// MinRequests is how many requests the window needs before a budget can
+	// be exhausted, a handful of failures don't trip a quiet provider
+	MinRequests int64
+	// CacheOnly trips the providers whose budget is exhausted into cache-only mode
+	CacheOnly bool
+}
+
+// bucket counts the requests of a minute.
+type bucket struct {
+	minute int64
+	total  int64
+	errors int64
+	slow   int64
+}
+
+// window is the rolling window of a provider.
+type window struct {
+	mu        sync.Mutex
+	buckets   []bucket
+	cacheOnly bool
+}
+
+// Tracker tracks the providers of a replica.
+type Tracker struct {
+	objectives Objectives
+	logger     *slog.Logger
+
+	mu      sync.Mutex
+	windows map[string]*window
+}
+
+// NewTracker creates a new Tracker of objectives.
+func NewTracker(objectives Objectives, logger *slog.Logger) *Tracker {
+	return &Tracker{objectives: objectives, logger: logger, windows: map[string]*window{}}
+}
+
+func (t *Tracker) window(provider string) *window {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	w, ok := t.windows[provider]
+	if !ok {
+		w = &window{buckets: make([]bucket, max(int(t.objectives.Window/time.Minute), 1))}
+		t.windows[provider] = w
+		metrics.Set(provider, expvar.Func(func() any { return t.Report(provider) }))
+	}
+	return w
+}
+
+// record counts a request of provider, and updates its mode.
+func (t *Tracker) record(provider string, w *window, now time.Time, failed, slow bool) {
+	minute := now.Unix() / 60
+	w.mu.Lock()
+	b := &w.buckets[minute%int64(len(w.buckets))]
+	if b.minute != minute {
+		*b = bucket{minute: minute}
+	}
+	b.total++
+	if failed {
+		b.errors++
+	}
+	if slow {
+		b.slow++
+	}
+	w.mu.Unlock()
+	t.update(provider, w, now)
+}
+
+// sums returns the counts of the window at now.
+func (w *window) sums(now time.Time) (total, errors, slow int64) {
+	minute := now.Unix() / 60
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, b := range w.buckets {
+		if minute-b.minute < int64(len(w.buckets)) {
+			total += b.total
+			errors += b.errors
+			slow += b.slow
+		}
+	}
+	return total, errors, slow
+}
+
+// budget returns the share of the error budget left, 1 untouched and 0 or
+// less exhausted.
+func budget(total, bad int64, target float64) float64 {
+	allowed := float64(total) * (1 - target)
+	if allowed <= 0 {
+		if bad > 0 {
+			return 0
+		}
+		return 1
+	}
+	return 1 - float64(bad)/allowed
+}
+
+// Report is the state of a provider.
+type Report struct {
+	Provider string `json:"provider"`
+	Window   string `json:"window"`
+	Requests int64  `json:"requests"`
+	// Availability is the share of requests answered without a 5xx
+	Availability       float64 `json:"availability"`
+	AvailabilityBudget float64 `json:"availability_budget"`
+	// Latency is the share of requests faster than the objective
+	Latency       float64 `json:"latency"`
+	LatencyBudget float64 `json:"latency_budget"`
+	CacheOnly     bool    `json:"cache_only"`
+}
+
+// Report returns the state of provider.
+func (t *Tracker) Report(provider string) Report {
+	w := t.window(provider)
+	total, errors, slow := w.sums(time.Now())
+	report := Report{
+		Provider:           provider,
+		Window:             t.objectives.Window.String(),
+		Requests:           total,
+		Availability:       1,
+		Latency:            1,
+		AvailabilityBudget: budget(total, errors, t.objectives.Availability),
+		LatencyBudget:      budget(total, slow, t.objectives.LatencyTarget),
+	}
+	if total > 0 {
+		report.Availability = 1 - float64(errors)/float64(total)
+		report.Latency = 1 - float64(slow)/float64(total)
+	}
+	w.mu.Lock()
+	report.CacheOnly = w.cacheOnly
+	w.mu.Unlock()
+	return report
+}
+
+// Reports returns the state of every provider tracked.
+func (t *Tracker) Reports() []Report {
+	t.mu.Lock()
+	providers := make([]string, 0, len(t.windows))
+	for provider := range t.windows {
+		providers = append(providers, provider)
+	}
+	t.mu.Unlock()
+	reports := make([]Report, 0, len(providers))
+	for _, provider := range providers {
+		reports = append(reports, t.Report(provider))
+	}
+	return reports
+}
+
+// update trips provider into cache-only mode when a budget is exhausted, and
+// back once it isn't.
+func (t *Tracker) update(provider string, w *window, now time.Time) {
+	if !t.objectives.CacheOnly {
+		return
+	}
+	total, errors, slow := w.sums(now)
+	exhausted := total >= t.objectives.MinRequests &&
+		(budget(total, errors, t.objectives.Availability) <= 0 || budget(total, slow, t.objectives.LatencyTarget) <= 0)
+	w.mu.Lock()
+	changed := w.cacheOnly != exhausted
+	w.cacheOnly = exhausted
+	w.mu.Unlock()
+	if !changed {
+		return
+	}
+	if exhausted {
+		t.logger.Warn("Error budget exhausted, serving from the cache only", "provider", provider, "requests", total, "errors", errors, "slow", slow)
+	} else {
+		t.logger.Info("Error budget recovered, serving from the upstream", "provider", provider, "requests", total)
+	}
+}
+
+// firstByteWriter records the status and the time of the first byte.
+type firstByteWriter struct {
+	http.ResponseWriter
+	status    int
+	firstByte time.Time
+}
+
+func (w *firstByteWriter) WriteHeader(statusCode int) {
+	if w.firstByte.IsZero() {
+		w.status = statusCode
+		w.firstByte = time.Now()
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *firstByteWriter) Write(b []byte) (int, error) {
+	if w.firstByte.IsZero() {
+		w.firstByte = time.Now()
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *firstByteWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Upstream measures the upstream of provider, and answers 503 without
+// calling it in cache-only mode. It goes under the cache, which keeps
+// serving the hits.
+func (t *Tracker) Upstream(provider string, upstream http.Handler) http.Handler {
+	w := t.window(provider)
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		// recovers as the failures age out of the window
+		t.update(provider, w, now)
+		w.mu.Lock()
+		cacheOnly := w.cacheOnly
+		w.mu.Unlock()
+		if cacheOnly {
+			metrics.Add(provider+"_cache_only_rejections", 1)
+			rw.Header().Set("Retry-After", "60")
+			http.Error(rw, provider+" is in cache-only mode, its error budget is exhausted", http.StatusServiceUnavailable)
+			return
+		}
+
+		fw := &firstByteWriter{ResponseWriter: rw, status: http.StatusOK}
+		upstream.ServeHTTP(fw, r)
+		if r.Context().Err() != nil {
+			// the client went away, it says nothing about the upstream
+			return
+		}
+		if fw.firstByte.IsZero() {
+			fw.firstByte = time.Now()
+		}
+		t.record(provider, w, now, fw.status >= 500, fw.firstByte.Sub(now) > t.objectives.Latency)
+	})
+}
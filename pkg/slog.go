@@ -8,6 +8,8 @@ import (
 	"os"
 	"strings"
 
+	"github.com/Airren/poorman-httpcache/v2/pkg/privacy"
+
 	"github.com/go-chi/httplog/v3"
 )
 
@@ -36,7 +38,8 @@ func GetLogger(levelStr string) *slog.Logger {
 
 	// Use JSON handler for structured logging
 	handler := slog.NewJSONHandler(os.Stdout, opts)
-	logger := slog.New(handler)
+	// bodies never reach the logs in privacy mode
+	logger := slog.New(privacy.Handler(handler))
 
 	// Replace the default slog logger
 	return logger
@@ -0,0 +1,221 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// NoticeHeader carries the service notice on the proxy responses.
+const NoticeHeader = "X-Service-Notice"
+
+// noticeKey is the Redis key of the service notice, shared by the replicas and
+// the staff server.
+const noticeKey = "status:notice"
+
+// maxNoticeLength is the longest notice, it's sent on every response.
+const maxNoticeLength = 512
+
+// Notice is a message for the users, e.g. a planned key rotation.
+type Notice struct {
+	Message string `json:"message"`
+	// Until is when the notice is removed, none keeps it until it's deleted
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// validate checks that n fits in a header.
+func (n Notice) validate() error {
+	if strings.TrimSpace(n.Message) == "" {
+		return errors.New("empty message")
+	}
+	if len(n.Message) > maxNoticeLength {
+		return fmt.Errorf("message longer than %d bytes", maxNoticeLength)
+	}
+	if strings.IndexFunc(n.Message, unicode.IsControl) >= 0 {
+		return errors.New("message has control characters")
+	}
+	if n.Until != nil && !n.Until.After(time.Now()) {
+		return errors.New("until is in the past")
+	}
+	return nil
+}
+
+// NoticeStore keeps the service notice in Redis. The replicas poll it, so a
+// notice set on one reaches the others within the interval.
+type NoticeStore struct {
+	redis    redis.Cmdable
+	interval time.Duration
+	logger   *slog.Logger
+	current  atomic.Pointer[Notice]
+}
+
+// NewNoticeStore creates a new NoticeStore polled every interval.
+func NewNoticeStore(rdb redis.Cmdable, interval time.Duration, logger *slog.Logger) *NoticeStore {
+	return &NoticeStore{redis: rdb, interval: interval, logger: logger}
+}
+
+// Start loads the notice, then every interval until ctx is done.
+func (s *NoticeStore) Start(ctx context.Context) {
+	s.refresh(ctx)
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.refresh(ctx)
+			}
+		}
+	}()
+}
+
+// refresh replaces the current notice by the stored one, it's kept when Redis
+// can't be read.
+func (s *NoticeStore) refresh(ctx context.Context) {
+	notice, err := s.Load(ctx)
+	if err != nil {
+		s.logger.Warn("Failed to load the service notice", "error", err)
+		return
+	}
+	if notice.Message == "" {
+		s.current.Store(nil)
+		return
+	}
+	s.current.Store(&notice)
+}
+
+// Load reads the stored notice, its message is empty when there's none.
+func (s *NoticeStore) Load(ctx context.Context) (Notice, error) {
+	b, err := s.redis.Get(ctx, noticeKey).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Notice{}, nil
+	}
+	if err != nil {
+		return Notice{}, fmt.Errorf("Get: %w", err)
+	}
+	var notice Notice
+	if err := json.Unmarshal(b, &notice); err != nil {
+		return Notice{}, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return notice, nil
+}
+
+// Set stores the notice, expired at its Until.
+func (s *NoticeStore) Set(ctx context.Context, notice Notice) error {
+	if err := notice.validate(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(notice)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	var ttl time.Duration
+	if notice.Until != nil {
+		ttl = time.Until(*notice.Until)
+	}
+	if err := s.redis.Set(ctx, noticeKey, b, ttl).Err(); err != nil {
+		return fmt.Errorf("Set: %w", err)
+	}
+	s.current.Store(&notice)
+	return nil
+}
+
+// Delete removes the notice.
+func (s *NoticeStore) Delete(ctx context.Context) error {
+	if err := s.redis.Del(ctx, noticeKey).Err(); err != nil {
+		return fmt.Errorf("Del: %w", err)
+	}
+	s.current.Store(nil)
+	return nil
+}
+
+// Current returns the message of the notice last loaded, empty without one.
+func (s *NoticeStore) Current() string {
+	notice := s.current.Load()
+	if notice == nil || (notice.Until != nil && !notice.Until.After(time.Now())) {
+		return ""
+	}
+	return notice.Message
+}
+
+// Middleware sets the NoticeHeader on the responses of next while there's a
+// notice.
+func (s *NoticeStore) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if message := s.Current(); message != "" {
+			w.Header().Set(NoticeHeader, message)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// NoticeAdmin serves the admin endpoints of the service notice, behind adminauth.
+//
+//	curl -X PUT "https://cachev1.example.com/admin/notice" -H "X-Admin-Key: xxx" \
+//		-d '{"message": "Jina keys rotate on 2026-10-20 at 18:00 UTC", "until": "2026-10-20T19:00:00Z"}'
+//	curl "https://cachev1.example.com/admin/notice" -H "X-Admin-Key: xxx"
+//	curl -X DELETE "https://cachev1.example.com/admin/notice" -H "X-Admin-Key: xxx"
+type NoticeAdmin struct {
+	store *NoticeStore
+}
+
+// NewNoticeAdmin creates a new NoticeAdmin handler set.
+func NewNoticeAdmin(store *NoticeStore) *NoticeAdmin {
+	return &NoticeAdmin{store: store}
+}
+
+// Get handles GET /admin/notice.
+func (a *NoticeAdmin) Get(w http.ResponseWriter, r *http.Request) {
+	notice, err := a.store.Load(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if notice.Message == "" {
+		http.Error(w, "No notice", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, notice)
+}
+
+// Set handles PUT /admin/notice.
+func (a *NoticeAdmin) Set(w http.ResponseWriter, r *http.Request) {
+	var notice Notice
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&notice); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := a.store.Set(r.Context(), notice); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, notice)
+}
+
+// Delete handles DELETE /admin/notice.
+func (a *NoticeAdmin) Delete(w http.ResponseWriter, r *http.Request) {
+	if err := a.store.Delete(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		// response was already committed, nothing left to do
+		_ = err
+	}
+}
@@ -0,0 +1,145 @@
+// Package status serves the public status page of a replica: the state of
+// the providers, the cache hit ratio and the maintenance notices. It's not
+// authenticated, it shows nothing about the keys or the traffic beyond
+// those.
+//
+//	curl "https://cachev1.example.com/status"
+package status
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/cache"
+	"github.com/Airren/poorman-httpcache/v2/pkg/slo"
+)
+
+// The states of a provider.
+const (
+	Operational = "operational"
+	// Degraded is a provider that exhausted an error budget
+	Degraded = "degraded"
+	// CacheOnly is a provider answered from the cache only, see SLO_CACHE_ONLY
+	CacheOnly = "cache_only"
+	// Unknown is a provider without SLO tracking
+	Unknown = "unknown"
+)
+
+// Provider is the state of a provider.
+type Provider struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Availability is the share of the upstream requests answered without a
+	// 5xx over the SLO window, absent without SLO tracking
+	Availability *float64 `json:"availability,omitempty"`
+}
+
+// Status is the status page document.
+type Status struct {
+	Time      time.Time  `json:"time"`
+	Providers []Provider `json:"providers"`
+	// HitRatio is the share of the lookups of the last 15 minutes answered
+	// from the cache, out of Lookups
+	HitRatio float64  `json:"hit_ratio"`
+	Lookups  int64    `json:"lookups"`
+	Notices  []string `json:"notices"`
+}
+
+// Page serves the status page.
+type Page struct {
+	providers []string
+	tracker   *slo.Tracker
+	cache     *cache.Cache
+	store     *NoticeStore
+
+	mu      sync.RWMutex
+	notices []string
+}
+
+// New creates a new Page of providers, tracker and store may be nil. The
+// notice of the store is shown before the notices.
+func New(providers []string, tracker *slo.Tracker, c *cache.Cache, store *NoticeStore, notices ...string) *Page {
+	p := &Page{providers: providers, tracker: tracker, cache: c, store: store}
+	p.SetNotices(notices)
+	return p
+}
+
+// SetNotices replaces the maintenance notices, blank ones are dropped.
+func (p *Page) SetNotices(notices []string) {
+	kept := make([]string, 0, len(notices))
+	for _, notice := range notices {
+		if notice = strings.TrimSpace(notice); notice != "" {
+			kept = append(kept, notice)
+		}
+	}
+	p.mu.Lock()
+	p.notices = kept
+	p.mu.Unlock()
+}
+
+// Status returns the current status.
+func (p *Page) Status() Status {
+	status := Status{Time: time.Now().UTC(), Providers: make([]Provider, 0, len(p.providers))}
+	for _, name := range p.providers {
+		provider := Provider{Name: name, Status: Unknown}
+		if p.tracker != nil {
+			report := p.tracker.Report(name)
+			provider.Availability = &report.Availability
+			switch {
+			case report.CacheOnly:
+				provider.Status = CacheOnly
+			case report.AvailabilityBudget <= 0 || report.LatencyBudget <= 0:
+				provider.Status = Degraded
+			default:
+				provider.Status = Operational
+			}
+		}
+		status.Providers = append(status.Providers, provider)
+	}
+	status.HitRatio, status.Lookups = p.cache.HitRatio()
+	status.Notices = []string{}
+	if p.store != nil {
+		if message := p.store.Current(); message != "" {
+			status.Notices = append(status.Notices, message)
+		}
+	}
+	p.mu.RLock()
+	status.Notices = append(status.Notices, p.notices...)
+	p.mu.RUnlock()
+	return status
+}
+
+var page = template.Must(template.New("status").Funcs(template.FuncMap{
+	"percent": func(ratio float64) float64 { return ratio * 100 },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Status</title></head>
+<body>
+<h1>Status</h1>
+{{range .Notices}}<p><strong>{{.}}</strong></p>
+{{end}}<table>
+{{range .Providers}}<tr><td>{{.Name}}</td><td>{{.Status}}</td></tr>
+{{end}}</table>
+<p>Cache hit ratio: {{printf "%.1f" (percent .HitRatio)}}% of {{.Lookups}} lookups in the last 15 minutes</p>
+<p><small>{{.Time.Format "2006-01-02 15:04:05 UTC"}}</small></p>
+</body>
+</html>
+`))
+
+// ServeHTTP handles GET /status, as HTML for the browsers and JSON otherwise.
+func (p *Page) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := p.Status()
+	w.Header().Set("Cache-Control", "public, max-age=10")
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := page.Execute(w, status); err != nil {
+			// response was already committed, nothing left to do
+			_ = err
+		}
+		return
+	}
+	writeJSON(w, status)
+}
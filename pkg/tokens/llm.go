@@ -0,0 +1,137 @@
+package tokens
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// chatRequest holds the fields of OpenAI-compatible and Gemini completion
+// requests that use tokens.
+type chatRequest struct {
+	Messages []struct {
+		Content json.RawMessage `json:"content"`
+	} `json:"messages"`
+	Contents []struct {
+		Parts json.RawMessage `json:"parts"`
+	} `json:"contents"`
+	GenerationConfig struct {
+		MaxOutputTokens int `json:"maxOutputTokens"`
+	} `json:"generationConfig"`
+	Prompt              json.RawMessage `json:"prompt"`
+	Input               json.RawMessage `json:"input"`
+	MaxTokens           int             `json:"max_tokens"`
+	MaxCompletionTokens int             `json:"max_completion_tokens"`
+}
+
+// RequestCost estimates the tokens of an OpenAI-compatible or Gemini request,
+// its prompt plus the completion it allows, for tollgate.WithCost. The actual
+// usage is reconciled with ResponseUsage.
+func RequestCost(counter Counter) func(r *http.Request) int {
+	return func(r *http.Request) int {
+		if r.Body == nil {
+			return 1
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return 1
+		}
+		var req chatRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return counter.Count(string(body))
+		}
+		n := 0
+		for _, m := range req.Messages {
+			n += countContent(counter, m.Content)
+		}
+		for _, c := range req.Contents {
+			n += countContent(counter, c.Parts)
+		}
+		n += countContent(counter, req.Prompt) + countContent(counter, req.Input)
+		return n + max(req.MaxTokens, req.MaxCompletionTokens, req.GenerationConfig.MaxOutputTokens)
+	}
+}
+
+// countContent counts a content field, a string, a list of strings or a list
+// of parts with a text field.
+func countContent(counter Counter, raw json.RawMessage) int {
+	if len(raw) == 0 {
+		return 0
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		return counter.Count(text)
+	}
+	var list []json.RawMessage
+	if json.Unmarshal(raw, &list) != nil {
+		return 0
+	}
+	n := 0
+	for _, item := range list {
+		var part struct {
+			Text string `json:"text"`
+		}
+		if json.Unmarshal(item, &text) == nil {
+			n += counter.Count(text)
+		} else if json.Unmarshal(item, &part) == nil {
+			n += counter.Count(part.Text)
+		}
+	}
+	return n
+}
+
+type usageBody struct {
+	Usage *struct {
+		TotalTokens  int `json:"total_tokens"`
+		PromptTokens int `json:"prompt_tokens"`
+		OutputTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+	// UsageMetadata is the usage of Gemini answers
+	UsageMetadata *struct {
+		TotalTokenCount int `json:"totalTokenCount"`
+	} `json:"usageMetadata"`
+}
+
+func (u usageBody) total() (int, bool) {
+	if u.UsageMetadata != nil && u.UsageMetadata.TotalTokenCount > 0 {
+		return u.UsageMetadata.TotalTokenCount, true
+	}
+	if u.Usage == nil {
+		return 0, false
+	}
+	if u.Usage.TotalTokens > 0 {
+		return u.Usage.TotalTokens, true
+	}
+	return u.Usage.PromptTokens + u.Usage.OutputTokens, true
+}
+
+// ResponseUsage reads the tokens used from the usage field of a provider
+// answer, JSON or a server-sent event stream, for tollgate.WithUsage.
+func ResponseUsage(header http.Header, body []byte) (int, bool) {
+	var u usageBody
+	if json.Unmarshal(body, &u) == nil {
+		return u.total()
+	}
+	// streams carry the usage in one of the last events
+	used, found := 0, false
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(nil, len(body)+1)
+	for scanner.Scan() {
+		data, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data:"))
+		if !ok {
+			continue
+		}
+		var event usageBody
+		if json.Unmarshal(bytes.TrimSpace(data), &event) != nil {
+			continue
+		}
+		if n, ok := event.total(); ok {
+			used, found = n, true
+		}
+	}
+	return used, found
+}
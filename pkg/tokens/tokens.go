@@ -0,0 +1,214 @@
+// Package tokens counts LLM tokens, so quotas of LLM routes can be
+// denominated in tokens rather than requests.
+package tokens
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Counter counts the tokens of a text.
+type Counter interface {
+	Count(text string) int
+}
+
+// Estimate is the Counter used without a ranks file, about 4 bytes per token,
+// which is close to BPE encodings on English text.
+type Estimate struct{}
+
+// Count implements the Counter interface.
+func (Estimate) Count(text string) int {
+	return int(math.Ceil(float64(len(text)) / 4))
+}
+
+// Encoding is a byte pair encoding loaded from a tiktoken ranks file, e.g.
+// cl100k_base.tiktoken. Counts match tiktoken for the cl100k split pattern.
+type Encoding struct {
+	ranks map[string]int
+}
+
+// Load reads a tiktoken ranks file, one base64 token and its rank per line.
+func Load(path string) (*Encoding, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("os.Open: %w", err)
+	}
+	defer f.Close()
+
+	ranks := map[string]int{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a token and a rank", path, line)
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid rank %q", path, line, fields[1])
+		}
+		ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scanner.Err: %w", err)
+	}
+	return &Encoding{ranks: ranks}, nil
+}
+
+// Count implements the Counter interface.
+func (e *Encoding) Count(text string) int {
+	n := 0
+	for _, piece := range split(text) {
+		if _, ok := e.ranks[piece]; ok {
+			n++
+			continue
+		}
+		n += e.merge(piece)
+	}
+	return n
+}
+
+// merge applies the byte pair merges to a piece, lowest rank first, and
+// returns the number of tokens left.
+func (e *Encoding) merge(piece string) int {
+	// parts holds the start offsets of the current tokens
+	parts := make([]int, len(piece)+1)
+	for i := range parts {
+		parts[i] = i
+	}
+	for len(parts) > 2 {
+		best, at := math.MaxInt, -1
+		for i := 0; i+2 < len(parts); i++ {
+			if rank, ok := e.ranks[piece[parts[i]:parts[i+2]]]; ok && rank < best {
+				best, at = rank, i
+			}
+		}
+		if at < 0 {
+			break
+		}
+		parts = append(parts[:at+1], parts[at+2:]...)
+	}
+	return len(parts) - 1
+}
+
+// split cuts text into the pieces encoded separately, following the cl100k
+// pattern:
+//
+//	(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}|
+//	 ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+func split(text string) []string {
+	var pieces []string
+	for i := 0; i < len(text); {
+		n := matchPiece(text[i:])
+		pieces = append(pieces, text[i:i+n])
+		i += n
+	}
+	return pieces
+}
+
+var contractions = []string{"'s", "'t", "'re", "'ve", "'m", "'ll", "'d"}
+
+// matchPiece returns the length of the piece at the start of s, s isn't empty.
+func matchPiece(s string) int {
+	for _, c := range contractions {
+		if len(s) >= len(c) && strings.EqualFold(s[:len(c)], c) {
+			return len(c)
+		}
+	}
+
+	r, size := utf8.DecodeRuneInString(s)
+	// [^\r\n\p{L}\p{N}]?\p{L}+
+	if unicode.IsLetter(r) {
+		return size + letters(s[size:])
+	}
+	if r != '\r' && r != '\n' && !unicode.IsNumber(r) {
+		if n := letters(s[size:]); n > 0 {
+			return size + n
+		}
+	}
+	// \p{N}{1,3}
+	if unicode.IsNumber(r) {
+		n := size
+		for count := 1; count < 3 && n < len(s); count++ {
+			next, nextSize := utf8.DecodeRuneInString(s[n:])
+			if !unicode.IsNumber(next) {
+				break
+			}
+			n += nextSize
+		}
+		return n
+	}
+	//  ?[^\s\p{L}\p{N}]+[\r\n]*
+	start := 0
+	if r == ' ' {
+		start = size
+	}
+	if n := symbols(s[start:]); n > 0 {
+		n += start
+		for n < len(s) && (s[n] == '\r' || s[n] == '\n') {
+			n++
+		}
+		return n
+	}
+	// \s*[\r\n]+, \s+(?!\S) and \s+
+	end, lastNewline := 0, -1
+	for end < len(s) {
+		next, nextSize := utf8.DecodeRuneInString(s[end:])
+		if !unicode.IsSpace(next) {
+			break
+		}
+		end += nextSize
+		if next == '\r' || next == '\n' {
+			lastNewline = end
+		}
+	}
+	if lastNewline > 0 {
+		return lastNewline
+	}
+	if end == len(s) {
+		return end
+	}
+	// leave the last space to the next piece
+	_, lastSize := utf8.DecodeLastRuneInString(s[:end])
+	if end-lastSize > 0 {
+		return end - lastSize
+	}
+	return end
+}
+
+func letters(s string) int {
+	n := 0
+	for n < len(s) {
+		r, size := utf8.DecodeRuneInString(s[n:])
+		if !unicode.IsLetter(r) {
+			break
+		}
+		n += size
+	}
+	return n
+}
+
+func symbols(s string) int {
+	n := 0
+	for n < len(s) {
+		r, size := utf8.DecodeRuneInString(s[n:])
+		if unicode.IsSpace(r) || unicode.IsLetter(r) || unicode.IsNumber(r) {
+			break
+		}
+		n += size
+	}
+	return n
+}
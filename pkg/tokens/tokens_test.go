@@ -0,0 +1,80 @@
+package tokens
+
+import (
+	"slices"
+	"testing"
+)
+
+// The pieces tiktoken cuts with the cl100k_base pattern, e.g.
+// [enc.decode([t]) for t in enc.encode(text)] on texts whose pieces are
+// single tokens.
+func TestSplitMatchesTiktoken(t *testing.T) {
+	for text, want := range map[string][]string{
+		"hello world":   {"hello", " world"},
+		"Hello, World!": {"Hello", ",", " World", "!"},
+		"I'm fine":      {"I", "'m", " fine"},
+		"don't":         {"don", "'t"},
+		"DON'T":         {"DON", "'T"},
+		"1234567":       {"123", "456", "7"},
+		"x = 1;":        {"x", " =", " ", "1", ";"},
+		"a\n\nb":        {"a", "\n\n", "b"},
+		"foo  bar":      {"foo", " ", " bar"},
+		"end.  ":        {"end", ".", "  "},
+		"$100":          {"$", "100"},
+		"_id":           {"_id"},
+		"print(x)\n":    {"print", "(x", ")\n"},
+		"héllo wörld":   {"héllo", " wörld"},
+	} {
+		if got := split(text); !slices.Equal(got, want) {
+			t.Errorf("split(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestCountMatchesTiktoken(t *testing.T) {
+	// the ranks of cl100k_base for the printable ASCII bytes, the space,
+	// "hello" and " world"
+	enc, err := Load("testdata/cl100k_excerpt.tiktoken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cl100k_base encodes "hello world!" as [15339, 1917, 0]
+	for text, want := range map[string]int{
+		"hello world!": 3,
+		"hello":        1,
+		"":             0,
+		// no merges are known past the bytes
+		"hi!": 3,
+	} {
+		if got := enc.Count(text); got != want {
+			t.Errorf("Count(%q) = %d, want %d", text, got, want)
+		}
+	}
+}
+
+func TestMergeLowestRankFirst(t *testing.T) {
+	enc := &Encoding{ranks: map[string]int{
+		"a": 0, "b": 1, "c": 2, "d": 3,
+		"bc": 4, "ab": 5, "cd": 6,
+	}}
+	// "bc" merges first and nothing merges with it: a, bc, d. Merging in
+	// order of appearance would give ab, cd.
+	if got := enc.merge("abcd"); got != 3 {
+		t.Errorf("merge(abcd) = %d tokens, want 3", got)
+	}
+	enc.ranks["abcd"] = 7
+	enc.ranks["abc"] = 8
+	// a+bc then abc+d
+	if got := enc.merge("abcd"); got != 1 {
+		t.Errorf("merge(abcd) = %d tokens, want 1", got)
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	if got := (Estimate{}).Count("12345678"); got != 2 {
+		t.Errorf("Estimate.Count = %d, want 2", got)
+	}
+	if got := (Estimate{}).Count("123456789"); got != 3 {
+		t.Errorf("Estimate.Count = %d, want 3", got)
+	}
+}
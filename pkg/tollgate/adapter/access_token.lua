@@ -0,0 +1,16 @@
+-- KEYS[1] is the "access_token:{jti}" hash of a token
+local tokenKey = KEYS[1]
+local amount = tonumber(ARGV[1])  -- Amount to take from its slice, negative to give it back
+
+local remaining = redis.call('HGET', tokenKey, 'remaining')
+if remaining == false then
+	-- Expired and refunded to its key already
+	return {-1, 'UNKNOWN'}
+end
+
+remaining = tonumber(remaining)
+if amount > 0 and remaining < amount then
+	return {remaining, 'EXHAUSTED'}
+end
+
+return {redis.call('HINCRBY', tokenKey, 'remaining', -amount), 'OK'}
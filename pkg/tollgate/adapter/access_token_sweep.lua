@@ -0,0 +1,11 @@
+-- KEYS[1] is the "access_token:{jti}" hash of an expired token
+-- KEYS[2] is the "access_tokens" sorted set of the tokens by expiry
+local tokenKey = KEYS[1]
+local expiryKey = KEYS[2]
+local jti = ARGV[1]
+
+-- Take the token once, the replicas may sweep at the same time
+local fields = redis.call('HMGET', tokenKey, 'key', 'service', 'remaining')
+redis.call('DEL', tokenKey)
+redis.call('ZREM', expiryKey, jti)
+return fields
@@ -0,0 +1,427 @@
+package adapter
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// accessTokenMetrics are published on /debug/vars under "access_tokens".
+var accessTokenMetrics = expvar.NewMap("access_tokens")
+
+const (
+	// defaultAccessTokenTTL is the lifetime of the tokens minted without one
+	defaultAccessTokenTTL = 15 * time.Minute
+	// accessTokenGrace keeps the tokens in Redis past their expiry, until the
+	// sweep refunds them
+	accessTokenGrace = 24 * time.Hour
+	// accessTokenSweepInterval is how often the expired tokens are refunded
+	accessTokenSweepInterval = time.Minute
+	// accessTokenExpiryKey is the sorted set of the tokens by expiry
+	accessTokenExpiryKey = "access_tokens"
+)
+
+var (
+	// errNotAccessToken is returned for the keys that aren't JWTs, they're
+	// plain keys
+	errNotAccessToken = errors.New("not an access token")
+	// errInvalidAccessToken is returned for JWTs that don't verify
+	errInvalidAccessToken = fmt.Errorf("%w: invalid access token", tollgate.ErrInvalidCredentials)
+)
+
+// accessClaims are the claims of an access token.
+type accessClaims struct {
+	ID        string `json:"jti"`
+	Service   string `json:"svc"`
+	Quota     int    `json:"quota"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// AccessTokens mints short-lived tokens signed with HS256 from long-lived
+// keys, so the keys never ship to browsers or notebooks:
+//
+//	curl -X POST https://cachev1.example.com/tokens -H "Authorization: Bearer $KEY" \
+//		-d '{"service": "jina", "quota": 100, "ttl_seconds": 600}'
+//
+// A token works on one service only, where it's sent instead of the key, and
+// from where its key is allowed. Its quota is a slice of the quota of its
+// key, reserved when it's minted, and the unused part is refunded to the key
+// once the token expires. The requests of a token are otherwise those of its
+// key: the limits, budgets and usage events see the key.
+type AccessTokens struct {
+	redis  redis.Cmdable
+	secret []byte
+	maxTTL time.Duration
+	logger *slog.Logger
+
+	mu sync.RWMutex
+	// services are the adapters and restrictions of the keys per service,
+	// filled by Adapter
+	services map[string]tokenService
+}
+
+// tokenService is where the slices of the tokens of a service come from.
+type tokenService struct {
+	// quota is the quota of the keys, under the limits and budgets
+	quota        tollgate.Adapter
+	restrictions func(ctx context.Context, key string) (tollgate.Restrictions, error)
+}
+
+type accessTokenCtxKey struct{}
+
+// NewAccessTokens creates AccessTokens signing with secret, the tokens live
+// maxTTL at most.
+func NewAccessTokens(rdb redis.Cmdable, secret string, maxTTL time.Duration, logger *slog.Logger) *AccessTokens {
+	return &AccessTokens{
+		redis:    rdb,
+		secret:   []byte(secret),
+		maxTTL:   maxTTL,
+		logger:   logger,
+		services: map[string]tokenService{},
+	}
+}
+
+// accessTokenKey is the hash of a token, with its key, service and the
+// remaining quota of its slice.
+func accessTokenKey(jti string) string {
+	return fmt.Sprintf("access_token:%s", jti)
+}
+
+func (t *AccessTokens) sign(claims accessClaims) string {
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parse verifies a token and returns its claims, errNotAccessToken when it's
+// a plain key. The expiry is left to the caller.
+func (t *AccessTokens) parse(token string) (*accessClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errNotAccessToken
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errNotAccessToken
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil {
+		return nil, errNotAccessToken
+	}
+	if h.Alg != "HS256" {
+		return nil, fmt.Errorf("%w: unsupported alg %q", errInvalidAccessToken, h.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidAccessToken, err)
+	}
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("%w: bad signature", errInvalidAccessToken)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidAccessToken, err)
+	}
+	var claims accessClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidAccessToken, err)
+	}
+	return &claims, nil
+}
+
+// mintRequest is the body of POST /tokens.
+type mintRequest struct {
+	Service    string `json:"service"`
+	Quota      int    `json:"quota"`
+	TTLSeconds int    `json:"ttl_seconds"`
+}
+
+// mintResponse is the answer of POST /tokens.
+type mintResponse struct {
+	Token     string    `json:"token"`
+	Service   string    `json:"service"`
+	Quota     int       `json:"quota"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Mint handles POST /tokens. The key is read from the Authorization bearer
+// token or the X-API-KEY header, the ones the services read.
+func (t *AccessTokens) Mint(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("X-API-KEY")
+	if key == "" {
+		key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if key == "" {
+		http.Error(w, "Missing key", http.StatusUnauthorized)
+		return
+	}
+	if _, err := t.parse(key); !errors.Is(err, errNotAccessToken) {
+		http.Error(w, "Access tokens can't mint tokens", http.StatusBadRequest)
+		return
+	}
+	var req mintRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	t.mu.RLock()
+	svc, ok := t.services[req.Service]
+	t.mu.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown service %q", req.Service), http.StatusNotFound)
+		return
+	}
+	// a key can't mint tokens from where it isn't allowed, the tokens are
+	// checked against its restrictions again when used
+	if svc.restrictions != nil {
+		restrictions, err := svc.restrictions(r.Context(), key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !restrictions.Allows(r) {
+			http.Error(w, "Key not allowed from this network or origin", http.StatusForbidden)
+			return
+		}
+	}
+	next := svc.quota
+	if req.Quota <= 0 {
+		http.Error(w, "quota must be positive", http.StatusBadRequest)
+		return
+	}
+	ttl := defaultAccessTokenTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	if ttl > t.maxTTL {
+		http.Error(w, fmt.Sprintf("ttl_seconds is %d at most", int(t.maxTTL.Seconds())), http.StatusBadRequest)
+		return
+	}
+
+	// the slice is reserved up front, which checks the key as well
+	ctx := tollgate.WithOutcome(r.Context(), tollgate.OutcomeAccessToken)
+	reserved, err := next.Reserve(ctx, key, req.Quota)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !reserved {
+		w.Header().Set(tollgate.ErrorCodeHeader, tollgate.ErrorQuotaExhausted)
+		http.Error(w, "Insufficient balance", http.StatusPaymentRequired)
+		return
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		_, _ = next.Refund(context.WithoutCancel(ctx), key, req.Quota)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	claims := accessClaims{
+		ID:        hex.EncodeToString(id),
+		Service:   req.Service,
+		Quota:     req.Quota,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	tokenKey := accessTokenKey(claims.ID)
+	_, err = t.redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, tokenKey, "key", key, "service", req.Service, "remaining", req.Quota)
+		pipe.ExpireAt(ctx, tokenKey, expiresAt.Add(accessTokenGrace))
+		pipe.ZAdd(ctx, accessTokenExpiryKey, redis.Z{Score: float64(claims.ExpiresAt), Member: claims.ID})
+		return nil
+	})
+	if err != nil {
+		_, _ = next.Refund(context.WithoutCancel(ctx), key, req.Quota)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	accessTokenMetrics.Add("minted", 1)
+
+	writeAdminJSON(w, http.StatusCreated, mintResponse{
+		Token:     t.sign(claims),
+		Service:   req.Service,
+		Quota:     req.Quota,
+		ExpiresAt: expiresAt.UTC(),
+	})
+}
+
+// Adapter returns next taking the requests of the access tokens of service
+// from their slice, see Resolve, and the others from next. next is the quota
+// of the keys, under the limits and budgets, the slices are taken from it.
+// restrictions are those of the keys, checked when the tokens are minted,
+// nil for none.
+func (t *AccessTokens) Adapter(service string, next tollgate.Adapter, restrictions func(ctx context.Context, key string) (tollgate.Restrictions, error)) tollgate.Adapter {
+	t.mu.Lock()
+	t.services[service] = tokenService{quota: next, restrictions: restrictions}
+	t.mu.Unlock()
+	return &tokenGate{tokens: t, next: next}
+}
+
+// Resolve returns the key an access token of service was minted from, for
+// tollgate.WithKeyResolver, with a context telling the adapter of the service
+// to take the requests from the slice of the token. Plain keys are returned as
+// they are.
+func (t *AccessTokens) Resolve(service string) func(ctx context.Context, credential string) (string, context.Context, error) {
+	return func(ctx context.Context, credential string) (string, context.Context, error) {
+		claims, err := t.parse(credential)
+		if errors.Is(err, errNotAccessToken) {
+			return credential, ctx, nil
+		}
+		if err != nil {
+			return "", ctx, err
+		}
+		if claims.Service != service {
+			return "", ctx, fmt.Errorf("%w: the token is for %s", errInvalidAccessToken, claims.Service)
+		}
+		if time.Now().Unix() >= claims.ExpiresAt {
+			return "", ctx, fmt.Errorf("%w: the token expired", errInvalidAccessToken)
+		}
+		key, err := t.redis.HGet(ctx, accessTokenKey(claims.ID), "key").Result()
+		if errors.Is(err, redis.Nil) {
+			return "", ctx, fmt.Errorf("%w: the token expired", errInvalidAccessToken)
+		}
+		if err != nil {
+			return "", ctx, fmt.Errorf("HGet: %w", err)
+		}
+		return key, context.WithValue(ctx, accessTokenCtxKey{}, claims.ID), nil
+	}
+}
+
+// tokenGate takes the requests made with access tokens from their slice.
+type tokenGate struct {
+	tokens *AccessTokens
+	next   tollgate.Adapter
+}
+
+// Reserve reserves a given amount of quota for a key.
+// Returns true if the reservation was successful, false if the quota is insufficient.
+func (g *tokenGate) Reserve(ctx context.Context, key string, amount int) (bool, error) {
+	jti, ok := ctx.Value(accessTokenCtxKey{}).(string)
+	if !ok {
+		return g.next.Reserve(ctx, key, amount)
+	}
+	status, err := g.take(ctx, jti, amount)
+	if err != nil {
+		return false, err
+	}
+	switch status {
+	case "OK":
+		return true, nil
+	case "EXHAUSTED":
+		tollgate.Warn(ctx, "access token quota exhausted")
+		return false, nil
+	default:
+		tollgate.Warn(ctx, "access token expired")
+		return false, nil
+	}
+}
+
+// Refund refunds a given amount of quota for a key.
+// Returns true if the refund was successful, false if the quota is insufficient.
+func (g *tokenGate) Refund(ctx context.Context, key string, amount int) (bool, error) {
+	jti, ok := ctx.Value(accessTokenCtxKey{}).(string)
+	if !ok {
+		return g.next.Refund(ctx, key, amount)
+	}
+	// once swept the slice went back to the key, there's nothing to refund
+	status, err := g.take(ctx, jti, -amount)
+	if err != nil {
+		return false, err
+	}
+	return status == "OK", nil
+}
+
+// take takes amount from the slice of a token, or gives it back when negative.
+func (g *tokenGate) take(ctx context.Context, jti string, amount int) (string, error) {
+	result, err := AccessTokenScript.Run(ctx, g.tokens.redis, []string{accessTokenKey(jti)}, amount).Slice()
+	if err != nil {
+		return "", fmt.Errorf("AccessTokenScript.Run: %w", err)
+	}
+	if len(result) != 2 {
+		return "", fmt.Errorf("AccessTokenScript.Run: expected 2, got %d", len(result))
+	}
+	status, _ := result[1].(string)
+	return status, nil
+}
+
+// Run refunds the unused slices of the expired tokens to their keys every
+// minute until ctx is done.
+func (t *AccessTokens) Run(ctx context.Context) {
+	ticker := time.NewTicker(accessTokenSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.Sweep(ctx); err != nil {
+				t.logger.Error("Access token sweep failed", "error", err)
+			}
+		}
+	}
+}
+
+// Sweep refunds the unused slices of the expired tokens to their keys.
+func (t *AccessTokens) Sweep(ctx context.Context) error {
+	expired, err := t.redis.ZRangeByScore(ctx, accessTokenExpiryKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Unix(), 10),
+	}).Result()
+	if err != nil {
+		return fmt.Errorf("ZRangeByScore: %w", err)
+	}
+	for _, jti := range expired {
+		fields, err := AccessTokenSweepScript.Run(ctx, t.redis, []string{accessTokenKey(jti), accessTokenExpiryKey}, jti).Slice()
+		if err != nil {
+			return fmt.Errorf("AccessTokenSweepScript.Run: %w", err)
+		}
+		if len(fields) != 3 || fields[0] == nil {
+			// another replica took it, or it outlived the grace period
+			continue
+		}
+		key, _ := fields[0].(string)
+		service, _ := fields[1].(string)
+		remaining, _ := strconv.Atoi(fmt.Sprint(fields[2]))
+		t.mu.RLock()
+		svc, ok := t.services[service]
+		t.mu.RUnlock()
+		if !ok || remaining <= 0 {
+			continue
+		}
+		refundCtx := tollgate.WithOutcome(ctx, tollgate.OutcomeAccessToken)
+		if _, err := svc.quota.Refund(refundCtx, key, remaining); err != nil {
+			t.logger.Error("Failed to refund access token", "service", service, "amount", remaining, "error", err)
+			continue
+		}
+		accessTokenMetrics.Add("refunded", int64(remaining))
+	}
+	return nil
+}
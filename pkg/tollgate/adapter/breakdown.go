@@ -0,0 +1,128 @@
+package adapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// maxReportDays caps the days of a usage breakdown report, the daily
+// counters are kept as long.
+const maxReportDays = 92
+
+// breakdownTTL keeps the daily counters for the longest report.
+const breakdownTTL = (maxReportDays + 1) * 24 * time.Hour
+
+// ErrInvalidReportRange is returned for reports ending before they start or
+// over maxReportDays.
+var ErrInvalidReportRange = errors.New("invalid report range")
+
+// breakdown counts the daily usage of the keys in Redis per value of a
+// request attribute, e.g. the member or the tag.
+type breakdown struct {
+	redis  redis.Cmdable
+	logger *slog.Logger
+	// name is the attribute, e.g. "member"
+	name string
+	// value returns the attribute of the request, "" without one
+	value func(ctx context.Context) string
+}
+
+func reportDay(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+// usageKey is the hash of the usage of a service on a day, its fields are
+// "{key_id}:{value}". Values can't hold a colon.
+func (b *breakdown) usageKey(service, day string) string {
+	return fmt.Sprintf("%s_usage:%s:%s", b.name, service, day)
+}
+
+// totals returns the usage of service per "{key_id}:{value}" from one day to
+// another, both included, of the key with the given ID or of all keys when
+// it's empty.
+func (b *breakdown) totals(ctx context.Context, service, id string, from, to time.Time) (map[string]int64, error) {
+	from, to = from.UTC().Truncate(24*time.Hour), to.UTC().Truncate(24*time.Hour)
+	if to.Before(from) {
+		return nil, fmt.Errorf("%w: it ends before it starts", ErrInvalidReportRange)
+	}
+	if to.Sub(from) >= maxReportDays*24*time.Hour {
+		return nil, fmt.Errorf("%w: reports cover %d days at most", ErrInvalidReportRange, maxReportDays)
+	}
+	pipe := b.redis.Pipeline()
+	var days []*redis.MapStringStringCmd
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		days = append(days, pipe.HGetAll(ctx, b.usageKey(service, reportDay(day))))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("HGetAll: %w", err)
+	}
+	totals := map[string]int64{}
+	for _, day := range days {
+		for field, value := range day.Val() {
+			if id != "" && !strings.HasPrefix(field, id+":") {
+				continue
+			}
+			usage, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				b.logger.Warn("Invalid "+b.name+" usage", "service", service, "field", field, "error", err)
+				continue
+			}
+			totals[field] += usage
+		}
+	}
+	return totals, nil
+}
+
+// Adapter returns next with the usage of service counted per value.
+func (b *breakdown) Adapter(service string, next tollgate.Adapter) tollgate.Adapter {
+	return &attributed{breakdown: b, service: service, next: next}
+}
+
+// attributed counts the reservations and refunds of next per value.
+type attributed struct {
+	breakdown *breakdown
+	service   string
+	next      tollgate.Adapter
+}
+
+// Reserve reserves a given amount of quota for a key.
+// Returns true if the reservation was successful, false if the quota is insufficient.
+func (a *attributed) Reserve(ctx context.Context, key string, amount int) (bool, error) {
+	ok, err := a.next.Reserve(ctx, key, amount)
+	if err == nil && ok {
+		a.count(ctx, key, amount)
+	}
+	return ok, err
+}
+
+// Refund refunds a given amount of quota for a key.
+// Returns true if the refund was successful, false if the quota is insufficient.
+func (a *attributed) Refund(ctx context.Context, key string, amount int) (bool, error) {
+	ok, err := a.next.Refund(ctx, key, amount)
+	if err == nil && ok {
+		a.count(ctx, key, -amount)
+	}
+	return ok, err
+}
+
+func (a *attributed) count(ctx context.Context, key string, amount int) {
+	b := a.breakdown
+	usageKey := b.usageKey(a.service, reportDay(time.Now()))
+	field := tollgate.KeyFingerprint(key) + ":" + b.value(ctx)
+	pipe := b.redis.Pipeline()
+	pipe.HIncrBy(ctx, usageKey, field, int64(amount))
+	pipe.Expire(ctx, usageKey, breakdownTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		// the quota is right, only the report is off
+		b.logger.Error("Failed to count "+b.name+" usage", "service", a.service, "error", err)
+	}
+}
@@ -0,0 +1,25 @@
+package adapter
+
+import "time"
+
+// Clock tells the local time, replaced by a fixed one in tests. The usage
+// buckets aren't on it, the scripts take them from the Redis clock so the
+// replicas agree on the minute boundaries whatever their skew.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the Clock of the machine.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// usageBucketGrace is how long after its minute a usage bucket may still be
+// written, by a replica whose clock is behind or a slow script.
+const usageBucketGrace = 10 * time.Second
+
+// bucketClosed reports whether the usage bucket of minute, a Unix time, is
+// no longer written at now.
+func bucketClosed(minute int64, now time.Time) bool {
+	return now.After(time.Unix(minute, 0).Add(time.Minute + usageBucketGrace))
+}
@@ -0,0 +1,109 @@
+package adapter
+
+import (
+	"cmp"
+	"context"
+	"expvar"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// domainMetrics is the usage of the day per service of its top domains, the
+// others are summed under "other" to bound the cardinality of the labels.
+var domainMetrics = expvar.NewMap("domain_usage")
+
+// otherDomains sums the domains past the top ones.
+const otherDomains = "other"
+
+// DomainUsage is the usage of the pages of one website, e.g. the reader
+// credits spent on it.
+type DomainUsage struct {
+	// Domain is the host of the target URLs without "www.", "" for the
+	// requests without one
+	Domain string `json:"domain"`
+	Usage  int64  `json:"usage"`
+}
+
+// DomainStore counts the daily usage of the keys per target domain in
+// Redis, for the providers fetching a page, e.g. jina and fetch.
+type DomainStore struct {
+	breakdown
+	// top is the number of domains of the metrics and, by default, of the reports
+	top int
+}
+
+// NewDomainStore creates a DomainStore, the metrics have the usage of the
+// top domains.
+func NewDomainStore(rdb redis.Cmdable, top int, logger *slog.Logger) *DomainStore {
+	return &DomainStore{
+		breakdown: breakdown{redis: rdb, logger: logger, name: "domain", value: targetDomain},
+		top:       max(top, 1),
+	}
+}
+
+func targetDomain(ctx context.Context) string {
+	return strings.TrimPrefix(strings.ToLower(tollgate.TargetHostFromContext(ctx)), "www.")
+}
+
+// Adapter returns next with the usage of service counted per domain, and
+// publishes the top domains of the day of service in the metrics.
+func (s *DomainStore) Adapter(service string, next tollgate.Adapter) tollgate.Adapter {
+	domainMetrics.Set(service, expvar.Func(func() any {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		now := time.Now()
+		domains, other, err := s.Report(ctx, service, "", now, now, s.top)
+		if err != nil {
+			s.logger.Warn("Failed to report domain usage", "service", service, "error", err)
+			return nil
+		}
+		usage := make(map[string]int64, len(domains)+1)
+		for _, domain := range domains {
+			usage[domain.Domain] = domain.Usage
+		}
+		if other > 0 {
+			usage[otherDomains] += other
+		}
+		return usage
+	}))
+	return s.breakdown.Adapter(service, next)
+}
+
+// Report returns the usage of service per domain from one day to another,
+// both included, of the key with the given ID or of all keys when it's
+// empty. The top domains are returned, the most used first, and the usage
+// of the others is summed; top 0 is the top of the store.
+func (s *DomainStore) Report(ctx context.Context, service, id string, from, to time.Time, top int) (domains []DomainUsage, other int64, err error) {
+	totals, err := s.totals(ctx, service, id, from, to)
+	if err != nil {
+		return nil, 0, err
+	}
+	perDomain := map[string]int64{}
+	for field, usage := range totals {
+		_, domain, _ := strings.Cut(field, ":")
+		perDomain[domain] += usage
+	}
+	domains = make([]DomainUsage, 0, len(perDomain))
+	for domain, usage := range perDomain {
+		domains = append(domains, DomainUsage{Domain: domain, Usage: usage})
+	}
+	slices.SortFunc(domains, func(a, b DomainUsage) int {
+		return cmp.Or(cmp.Compare(b.Usage, a.Usage), cmp.Compare(a.Domain, b.Domain))
+	})
+	if top <= 0 {
+		top = s.top
+	}
+	if len(domains) > top {
+		for _, domain := range domains[top:] {
+			other += domain.Usage
+		}
+		domains = domains[:top]
+	}
+	return domains, other, nil
+}
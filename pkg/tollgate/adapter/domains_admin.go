@@ -0,0 +1,67 @@
+package adapter
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// DomainsAdmin serves the usage reports per target domain, behind adminauth.
+// from and to are days, both included, the current month by default. key_id,
+// as listed by the limits, narrows the report to a key, and top is the number
+// of domains reported, the others are summed.
+//
+//	curl "https://cachev1.example.com/admin/usage/jina/domains?from=2025-01-01&to=2025-01-31&top=50" \
+//		-H "X-Admin-Key: xxx"
+type DomainsAdmin struct {
+	store *DomainStore
+}
+
+// NewDomainsAdmin creates a new DomainsAdmin handler set.
+func NewDomainsAdmin(store *DomainStore) *DomainsAdmin {
+	return &DomainsAdmin{store: store}
+}
+
+// domainReport is the answer of GET /admin/usage/{service}/domains.
+type domainReport struct {
+	Service string        `json:"service"`
+	From    string        `json:"from"`
+	To      string        `json:"to"`
+	Domains []DomainUsage `json:"domains"`
+	// Other is the usage of the domains past the top ones
+	Other int64 `json:"other"`
+}
+
+// Report handles GET /admin/usage/{service}/domains.
+func (a *DomainsAdmin) Report(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := reportRange(w, r)
+	if !ok {
+		return
+	}
+	top := 0
+	if v := r.URL.Query().Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid top, expected a positive number", http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+	service := r.PathValue("service")
+	domains, other, err := a.store.Report(r.Context(), service, r.URL.Query().Get("key_id"), from, to, top)
+	if errors.Is(err, ErrInvalidReportRange) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, domainReport{
+		Service: service,
+		From:    reportDay(from),
+		To:      reportDay(to),
+		Domains: domains,
+		Other:   other,
+	})
+}
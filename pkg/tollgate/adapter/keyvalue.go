@@ -6,8 +6,8 @@ import (
 	"log/slog"
 	"net/http"
 
-	"httpcache/pkg/dbsqlc"
-	"httpcache/pkg/tollgate"
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -51,8 +51,12 @@ func NewKeyValueWithDependencies(
 
 // NewKeyValue creates a new Redis adapter for a specific service with direct aggregation
 func NewKeyValue(rdb RedisClient, db *dbsqlc.Queries, serviceName string, logger *slog.Logger) *KeyValue {
-	keyStore := NewRedisMetadataStore(rdb, db)
+	return NewKeyValueWithMetaStore(rdb, db, NewRedisMetadataStore(rdb, db), serviceName, logger)
+}
 
+// NewKeyValueWithMetaStore creates a new Redis adapter reading metadata from keyStore,
+// see OpenMetaStore for the available backends
+func NewKeyValueWithMetaStore(rdb RedisClient, db *dbsqlc.Queries, keyStore MetaStore, serviceName string, logger *slog.Logger) *KeyValue {
 	// Create context for background processes
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -100,8 +104,9 @@ func (r *KeyValue) Refund(ctx context.Context, key string, amount int) (bool, er
 	return ok, nil
 }
 
-// NewRedisQuotaTollgate creates a new Tollgate using Redis for high-performance quota management
+// NewRedisQuotaTollgate creates a new Tollgate using Redis for high-performance quota management,
+// enforcing the network and origin restrictions of the keys
 func NewRedisQuotaTollgate(rdb RedisClient, db *dbsqlc.Queries, serviceID string, logger *slog.Logger, keyExtractor func(r *http.Request) string) *tollgate.Tollgate {
 	adapter := NewKeyValue(rdb, db, serviceID, logger)
-	return tollgate.New(adapter, keyExtractor)
+	return tollgate.New(adapter, keyExtractor, tollgate.WithRestrictions(KeyRestrictions(adapter.metaStore)))
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"log/slog"
 	"testing"
+	"time"
 )
 
 // MockMetaStore is a mock implementation of MetaStore for testing
@@ -142,3 +143,41 @@ func TestExampleKeyValueWithRealQuotaManager(t *testing.T) {
 	// Run your tests with the mixed real/mock setup
 	_ = keyValue // Use keyValue in your tests
 }
+
+// fixedClock is a Clock stopped at a given time.
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+func TestQuotaManagerClock(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	// the trial expires in an hour, the clock is two hours ahead
+	expiresAt := now.Add(time.Hour)
+	keyMeta := &KeyMetadata{APIKey: "sk-trial", HasQuota: true, ExpiresAt: &expiresAt}
+	qm, err := NewQuotaManager(ctx, nil, &MockMetaStore{}, "test-service", WithQuotaClock(fixedClock(now.Add(2*time.Hour))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rejected before Redis is reached
+	if ok, err := qm.Reserve(ctx, keyMeta, 1); ok || err != nil {
+		t.Errorf("Reserve on an expired trial = %v, %v, want false, nil", ok, err)
+	}
+}
+
+func TestBucketClosed(t *testing.T) {
+	minute := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		now  time.Time
+		want bool
+	}{
+		{minute.Add(30 * time.Second), false},
+		// a replica whose clock is a few seconds behind still writes it
+		{minute.Add(time.Minute + 5*time.Second), false},
+		{minute.Add(time.Minute + usageBucketGrace + time.Second), true},
+	} {
+		if got := bucketClosed(minute.Unix(), tc.now); got != tc.want {
+			t.Errorf("bucketClosed at %v = %v, want %v", tc.now.Sub(minute), got, tc.want)
+		}
+	}
+}
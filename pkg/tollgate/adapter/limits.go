@@ -0,0 +1,277 @@
+package adapter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// limitsMetrics are published on /debug/vars under "quota_limits".
+var limitsMetrics = expvar.NewMap("quota_limits")
+
+// DefaultLimitsKey sets the limits of the keys of a service without their own.
+const DefaultLimitsKey = "*"
+
+// limitsPeriodTTL keeps the counters of a period a little past its end.
+const limitsPeriodTTL = 32 * 24 * time.Hour
+
+// Limits are the usage thresholds of a key on a service, per calendar month
+// (UTC). Past Soft requests succeed with a warning and an alert fires once,
+// past Hard they're rejected. 0 disables a threshold.
+type Limits struct {
+	Soft int `json:"soft"`
+	Hard int `json:"hard"`
+}
+
+// Events of the LimitAlerts.
+const (
+	// EventSoftLimit is sent when a key passes its soft limit
+	EventSoftLimit = "quota.soft_limit"
+	// EventHardLimit is sent when a request of a key is first rejected at its hard limit
+	EventHardLimit = "quota.hard_limit"
+	// EventExhausted is sent when a request of a key is first refused for lack of quota
+	EventExhausted = "quota.exhausted"
+)
+
+// LimitAlert is sent when a key passes its soft limit, reaches its hard limit
+// or runs out of quota, once per event and period.
+type LimitAlert struct {
+	Event   string `json:"event"`
+	Service string `json:"service"`
+	// KeyID identifies the key without revealing it, as in the request logs
+	KeyID  string `json:"key_id"`
+	Period string `json:"period"`
+	Usage  int    `json:"usage"`
+	Limits
+}
+
+// LimitStore keeps the limits of the keys and their usage in Redis.
+type LimitStore struct {
+	redis  redis.Cmdable
+	alert  func(ctx context.Context, alert LimitAlert)
+	logger *slog.Logger
+}
+
+// NewLimitStore creates a LimitStore, alert is called with the LimitAlerts of
+// the keys, it must not block.
+func NewLimitStore(rdb redis.Cmdable, alert func(ctx context.Context, alert LimitAlert), logger *slog.Logger) *LimitStore {
+	return &LimitStore{redis: rdb, alert: alert, logger: logger}
+}
+
+// storedLimits is the value of a key in the limits hash of a service.
+type storedLimits struct {
+	KeyID string `json:"key_id"`
+	Limits
+}
+
+func limitsKey(service string) string {
+	return "limits:" + service
+}
+
+// limitsField is the hash field of a key, the key isn't stored in clear.
+func limitsField(key string) string {
+	if key == DefaultLimitsKey {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func limitsKeyID(key string) string {
+	if key == DefaultLimitsKey {
+		return key
+	}
+	return tollgate.KeyFingerprint(key)
+}
+
+func limitsPeriod(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+func limitsUsageKey(service, field, period string) string {
+	return fmt.Sprintf("limits_usage:%s:%s:%s", service, field, period)
+}
+
+func limitsAlertKey(service, field, period string) string {
+	return fmt.Sprintf("limits_alert:%s:%s:%s", service, field, period)
+}
+
+// Set sets the limits of key on service, DefaultLimitsKey for the default.
+func (s *LimitStore) Set(ctx context.Context, service, key string, limits Limits) error {
+	if limits.Soft < 0 || limits.Hard < 0 {
+		return errors.New("limits can't be negative")
+	}
+	if limits.Soft > 0 && limits.Hard > 0 && limits.Soft > limits.Hard {
+		return errors.New("the soft limit is past the hard limit")
+	}
+	value, err := json.Marshal(storedLimits{KeyID: limitsKeyID(key), Limits: limits})
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	if err := s.redis.HSet(ctx, limitsKey(service), limitsField(key), value).Err(); err != nil {
+		return fmt.Errorf("HSet: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the limits of key on service.
+func (s *LimitStore) Delete(ctx context.Context, service, key string) error {
+	if err := s.redis.HDel(ctx, limitsKey(service), limitsField(key)).Err(); err != nil {
+		return fmt.Errorf("HDel: %w", err)
+	}
+	return nil
+}
+
+// KeyLimits are the limits of a key with its usage of the current period.
+type KeyLimits struct {
+	KeyID  string `json:"key_id"`
+	Period string `json:"period"`
+	// Usage is unknown, 0, for the default limits
+	Usage int `json:"usage"`
+	Limits
+}
+
+// List returns the limits set on service.
+func (s *LimitStore) List(ctx context.Context, service string) ([]KeyLimits, error) {
+	values, err := s.redis.HGetAll(ctx, limitsKey(service)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("HGetAll: %w", err)
+	}
+	period := limitsPeriod(time.Now())
+	list := make([]KeyLimits, 0, len(values))
+	for field, value := range values {
+		var stored storedLimits
+		if err := json.Unmarshal([]byte(value), &stored); err != nil {
+			s.logger.Warn("Invalid stored limits", "service", service, "key_id", field, "error", err)
+			continue
+		}
+		limits := KeyLimits{KeyID: stored.KeyID, Period: period, Limits: stored.Limits}
+		if field != DefaultLimitsKey {
+			usage, err := s.redis.Get(ctx, limitsUsageKey(service, field, period)).Int()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return nil, fmt.Errorf("Get: %w", err)
+			}
+			limits.Usage = usage
+		}
+		list = append(list, limits)
+	}
+	return list, nil
+}
+
+// Adapter returns next with the limits of service enforced.
+func (s *LimitStore) Adapter(service string, next tollgate.Adapter) tollgate.Adapter {
+	return &limited{store: s, service: service, next: next}
+}
+
+// limited counts the usage of the keys of a service against their limits,
+// before the reservations of next.
+type limited struct {
+	store   *LimitStore
+	service string
+	next    tollgate.Adapter
+}
+
+// Reserve reserves a given amount of quota for a key.
+// Returns true if the reservation was successful, false if the quota is insufficient.
+func (l *limited) Reserve(ctx context.Context, key string, amount int) (bool, error) {
+	field := limitsField(key)
+	period := limitsPeriod(time.Now())
+	usageKey := limitsUsageKey(l.service, field, period)
+	keys := []string{limitsKey(l.service), usageKey, limitsAlertKey(l.service, field, period)}
+	result, err := LimitsScript.Run(ctx, l.store.redis, keys, field, amount, int(limitsPeriodTTL.Seconds())).Slice()
+	if err != nil {
+		return false, fmt.Errorf("LimitsScript.Run: %w", err)
+	}
+	if len(result) != 4 {
+		return false, fmt.Errorf("LimitsScript.Run: expected 4, got %d", len(result))
+	}
+	usage, _ := result[0].(int64)
+	soft, _ := result[1].(int64)
+	hard, _ := result[2].(int64)
+	status, _ := result[3].(string)
+	alert := LimitAlert{
+		Service: l.service,
+		KeyID:   limitsKeyID(key),
+		Period:  period,
+		Usage:   int(usage),
+		Limits:  Limits{Soft: int(soft), Hard: int(hard)},
+	}
+	if status == "HARD" {
+		limitsMetrics.Add("hard_rejections", 1)
+		tollgate.Warn(ctx, fmt.Sprintf("hard limit of %d reached for %s", hard, period))
+		alert.Event = EventHardLimit
+		l.alertOnce(ctx, keys[2]+":hard", alert)
+		return false, nil
+	}
+
+	ok, err := l.next.Reserve(ctx, key, amount)
+	if err != nil || !ok {
+		// the request isn't served, it doesn't count
+		l.store.redis.DecrBy(context.WithoutCancel(ctx), usageKey, int64(amount))
+		if status == "SOFT_CROSSED" {
+			l.store.redis.Del(context.WithoutCancel(ctx), keys[2])
+		}
+		if err == nil {
+			alert.Event = EventExhausted
+			alert.Usage -= amount
+			l.alertOnce(ctx, keys[2]+":exhausted", alert)
+		}
+		return ok, err
+	}
+	switch status {
+	case "SOFT_CROSSED":
+		limitsMetrics.Add("alerts", 1)
+		alert.Event = EventSoftLimit
+		l.store.logger.Warn("Key past its soft limit", "service", alert.Service, "key_id", alert.KeyID, "usage", alert.Usage, "soft", alert.Soft)
+		if l.store.alert != nil {
+			l.store.alert(ctx, alert)
+		}
+		fallthrough
+	case "SOFT":
+		limitsMetrics.Add("soft_warnings", 1)
+		tollgate.Warn(ctx, fmt.Sprintf("%d used of the soft limit of %d for %s", usage, soft, period))
+	}
+	return true, nil
+}
+
+// alertOnce sends alert unless flag says it was sent this period already.
+func (l *limited) alertOnce(ctx context.Context, flag string, alert LimitAlert) {
+	if l.store.alert == nil {
+		return
+	}
+	first, err := l.store.redis.SetNX(context.WithoutCancel(ctx), flag, 1, limitsPeriodTTL).Result()
+	if err != nil || !first {
+		return
+	}
+	limitsMetrics.Add("alerts", 1)
+	l.store.logger.Warn("Key refused", "event", alert.Event, "service", alert.Service, "key_id", alert.KeyID, "usage", alert.Usage)
+	l.store.alert(ctx, alert)
+}
+
+// Refund refunds a given amount of quota for a key.
+// Returns true if the refund was successful, false if the quota is insufficient.
+func (l *limited) Refund(ctx context.Context, key string, amount int) (bool, error) {
+	ok, err := l.next.Refund(ctx, key, amount)
+	if err != nil || !ok {
+		return ok, err
+	}
+	usageKey := limitsUsageKey(l.service, limitsField(key), limitsPeriod(time.Now()))
+	pipe := l.store.redis.Pipeline()
+	pipe.DecrBy(ctx, usageKey, int64(amount))
+	pipe.Expire(ctx, usageKey, limitsPeriodTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		// the refund went through, the usage is off by amount until the next period
+		l.store.logger.Error("Failed to refund usage", "service", l.service, "error", err)
+	}
+	return true, nil
+}
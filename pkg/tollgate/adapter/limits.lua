@@ -0,0 +1,35 @@
+-- All keys must be explicitly provided for Redis clustering compatibility
+local limitsKey = KEYS[1]  -- Pre-constructed "limits:{service}" hash
+local usageKey = KEYS[2]   -- Pre-constructed "limits_usage:{service}:{key}:{period}" counter
+local alertKey = KEYS[3]   -- Pre-constructed "limits_alert:{service}:{key}:{period}" flag
+local keyField = ARGV[1]   -- Hash field of the key, "*" is the service default
+local amount = tonumber(ARGV[2])  -- Amount to reserve
+local ttl = tonumber(ARGV[3])     -- TTL of the period keys in seconds
+
+-- The limits of the key, else the default of the service
+local limits = redis.call('HGET', limitsKey, keyField)
+if limits == false then
+	limits = redis.call('HGET', limitsKey, '*')
+end
+local soft, hard = 0, 0
+if limits ~= false then
+	local decoded = cjson.decode(limits)
+	soft = tonumber(decoded['soft']) or 0
+	hard = tonumber(decoded['hard']) or 0
+end
+
+local usage = tonumber(redis.call('GET', usageKey) or '0')
+if hard > 0 and usage + amount > hard then
+	return {usage, soft, hard, 'HARD'}
+end
+
+usage = redis.call('INCRBY', usageKey, amount)
+redis.call('EXPIRE', usageKey, ttl)
+if soft > 0 and usage > soft then
+	-- alert once per period
+	if redis.call('SET', alertKey, 1, 'NX', 'EX', ttl) then
+		return {usage, soft, hard, 'SOFT_CROSSED'}
+	end
+	return {usage, soft, hard, 'SOFT'}
+end
+return {usage, soft, hard, 'OK'}
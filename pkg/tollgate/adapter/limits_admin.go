@@ -0,0 +1,86 @@
+package adapter
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// LimitsAdmin serves the admin endpoints of the soft and hard limits, behind
+// adminauth. Keys are sent in the body, "*" sets the default limits of a
+// service.
+//
+//	curl -X PUT "https://cachev1.example.com/admin/limits/jina" -H "X-Admin-Key: xxx" \
+//		-d '{"key": "sk-...", "soft": 80000, "hard": 100000}'
+//	curl "https://cachev1.example.com/admin/limits/jina" -H "X-Admin-Key: xxx"
+//	curl -X DELETE "https://cachev1.example.com/admin/limits/jina" -H "X-Admin-Key: xxx" -d '{"key": "sk-..."}'
+type LimitsAdmin struct {
+	store *LimitStore
+}
+
+// NewLimitsAdmin creates a new LimitsAdmin handler set.
+func NewLimitsAdmin(store *LimitStore) *LimitsAdmin {
+	return &LimitsAdmin{store: store}
+}
+
+type limitsRequest struct {
+	Key string `json:"key"`
+	Limits
+}
+
+func (a *LimitsAdmin) decode(w http.ResponseWriter, r *http.Request) (limitsRequest, bool) {
+	var req limitsRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return req, false
+	}
+	if req.Key == "" {
+		http.Error(w, "Missing key", http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+// List handles GET /admin/limits/{service}.
+func (a *LimitsAdmin) List(w http.ResponseWriter, r *http.Request) {
+	list, err := a.store.List(r.Context(), r.PathValue("service"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, list)
+}
+
+// Set handles PUT /admin/limits/{service}.
+func (a *LimitsAdmin) Set(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	if err := a.store.Set(r.Context(), r.PathValue("service"), req.Key, req.Limits); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, storedLimits{KeyID: limitsKeyID(req.Key), Limits: req.Limits})
+}
+
+// Delete handles DELETE /admin/limits/{service}.
+func (a *LimitsAdmin) Delete(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	if err := a.store.Delete(r.Context(), r.PathValue("service"), req.Key); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeAdminJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		// response was already committed, nothing left to do
+		_ = err
+	}
+}
@@ -0,0 +1,126 @@
+package adapter
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+)
+
+// balances is an Adapter with a balance per key, unknown keys have none.
+type balances struct {
+	mu      sync.Mutex
+	balance map[string]int
+}
+
+func (b *balances) Reserve(ctx context.Context, key string, amount int) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.balance[key] < amount {
+		return false, nil
+	}
+	b.balance[key] -= amount
+	return true, nil
+}
+
+func (b *balances) Refund(ctx context.Context, key string, amount int) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.balance[key] += amount
+	return true, nil
+}
+
+// testGate serves 200 behind a tollgate of adapter, the key is X-API-KEY.
+func testGate(adapter tollgate.Adapter, opts ...tollgate.Option) http.Handler {
+	return tollgate.New(adapter, func(r *http.Request) string { return r.Header.Get("X-API-KEY") }, opts...).
+		HTTPHandlerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, "ok")
+		}))
+}
+
+// call sends a request of key through h, with the headers in pairs.
+func call(h http.Handler, key string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/jina/example.com", nil)
+	req.Header.Set("X-API-KEY", key)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestLimits(t *testing.T) {
+	rdb, _ := testRedis(t)
+	ctx := context.Background()
+	var mu sync.Mutex
+	var alerts []string
+	store := NewLimitStore(rdb, func(ctx context.Context, alert LimitAlert) {
+		mu.Lock()
+		defer mu.Unlock()
+		alerts = append(alerts, alert.Event)
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err := store.Set(ctx, "jina", "sk-a", Limits{Soft: 2, Hard: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set(ctx, "jina", DefaultLimitsKey, Limits{Hard: 1}); err != nil {
+		t.Fatal(err)
+	}
+	next := &balances{balance: map[string]int{"sk-a": 100, "sk-b": 100, "sk-poor": 0}}
+	h := testGate(store.Adapter("jina", next))
+
+	for i, want := range []struct {
+		status  int
+		warning bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusOK, false},
+		{http.StatusOK, true}, // past the soft limit
+		{http.StatusPaymentRequired, true},
+		{http.StatusPaymentRequired, true},
+	} {
+		rec := call(h, "sk-a")
+		if rec.Code != want.status || (rec.Header().Get(tollgate.WarningHeader) != "") != want.warning {
+			t.Errorf("request %d of sk-a: %d, warning %q", i+1, rec.Code, rec.Header().Get(tollgate.WarningHeader))
+		}
+	}
+	if next.balance["sk-a"] != 97 {
+		t.Errorf("sk-a was charged %d, want 3: the requests past the hard limit aren't reserved", 100-next.balance["sk-a"])
+	}
+	if want := []string{EventSoftLimit, EventHardLimit}; !slices.Equal(alerts, want) {
+		t.Errorf("alerts %q, want each once: %q", alerts, want)
+	}
+
+	// the keys without limits have the default ones
+	if rec := call(h, "sk-b"); rec.Code != http.StatusOK {
+		t.Errorf("first request of sk-b: %d", rec.Code)
+	}
+	if rec := call(h, "sk-b"); rec.Code != http.StatusPaymentRequired {
+		t.Errorf("sk-b past the default hard limit: %d, want 402", rec.Code)
+	}
+
+	// a request refused for lack of quota doesn't count against the limits
+	if rec := call(h, "sk-poor"); rec.Code != http.StatusPaymentRequired {
+		t.Errorf("sk-poor without quota: %d, want 402", rec.Code)
+	}
+	next.balance["sk-poor"] = 1
+	if rec := call(h, "sk-poor"); rec.Code != http.StatusOK {
+		t.Errorf("sk-poor topped up: %d, want 200, the refused request didn't count", rec.Code)
+	}
+
+	list, err := store.List(ctx, "jina")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range list {
+		if l.KeyID == tollgate.KeyFingerprint("sk-a") && l.Usage != 3 {
+			t.Errorf("usage of sk-a %d, want 3", l.Usage)
+		}
+	}
+}
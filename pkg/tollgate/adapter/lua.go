@@ -23,3 +23,27 @@ var SetAndReserveScript = redis.NewScript(setAndReserveQuotaScript)
 
 // RefundQuotaScript is the Redis script for refunding quota
 var RefundQuotaScript = redis.NewScript(refundQuotaScript)
+
+//go:embed limits.lua
+var limitsScript string
+
+// LimitsScript is the Redis script for counting usage against soft and hard limits
+var LimitsScript = redis.NewScript(limitsScript)
+
+//go:embed access_token.lua
+var accessTokenScript string
+
+//go:embed access_token_sweep.lua
+var accessTokenSweepScript string
+
+// AccessTokenScript is the Redis script for taking quota from the slice of an access token
+var AccessTokenScript = redis.NewScript(accessTokenScript)
+
+// AccessTokenSweepScript is the Redis script for taking the unused slice of an expired access token
+var AccessTokenSweepScript = redis.NewScript(accessTokenSweepScript)
+
+//go:embed tag_budget.lua
+var tagBudgetScript string
+
+// TagBudgetScript is the Redis script for counting the usage of a tag against its budget
+var TagBudgetScript = redis.NewScript(tagBudgetScript)
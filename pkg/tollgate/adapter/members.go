@@ -0,0 +1,52 @@
+package adapter
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// MemberUsage is the usage of a key by one member of its team.
+type MemberUsage struct {
+	KeyID string `json:"key_id"`
+	// Member is "" for the requests without X-Member-Id
+	Member string `json:"member"`
+	Usage  int64  `json:"usage"`
+}
+
+// MemberStore counts the daily usage of the keys per member in Redis, for
+// the keys shared by a team.
+type MemberStore struct {
+	breakdown
+}
+
+// NewMemberStore creates a MemberStore.
+func NewMemberStore(rdb redis.Cmdable, logger *slog.Logger) *MemberStore {
+	return &MemberStore{breakdown{redis: rdb, logger: logger, name: "member", value: tollgate.MemberFromContext}}
+}
+
+// Report returns the usage of service per key and member from one day to
+// another, both included, of the key with the given ID or of all keys when
+// it's empty.
+func (s *MemberStore) Report(ctx context.Context, service, id string, from, to time.Time) ([]MemberUsage, error) {
+	totals, err := s.totals(ctx, service, id, from, to)
+	if err != nil {
+		return nil, err
+	}
+	report := make([]MemberUsage, 0, len(totals))
+	for field, usage := range totals {
+		key, member, _ := strings.Cut(field, ":")
+		report = append(report, MemberUsage{KeyID: key, Member: member, Usage: usage})
+	}
+	slices.SortFunc(report, func(a, b MemberUsage) int {
+		return cmp.Or(cmp.Compare(a.KeyID, b.KeyID), cmp.Compare(b.Usage, a.Usage), cmp.Compare(a.Member, b.Member))
+	})
+	return report, nil
+}
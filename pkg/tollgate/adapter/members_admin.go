@@ -0,0 +1,76 @@
+package adapter
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// MembersAdmin serves the usage reports per member, behind adminauth. from
+// and to are days, both included, the current month by default. key_id, as
+// listed by the limits, narrows the report to a key.
+//
+//	curl "https://cachev1.example.com/admin/usage/jina/members?from=2025-01-01&to=2025-01-31&key_id=1a2b3c4d" \
+//		-H "X-Admin-Key: xxx"
+type MembersAdmin struct {
+	store *MemberStore
+}
+
+// NewMembersAdmin creates a new MembersAdmin handler set.
+func NewMembersAdmin(store *MemberStore) *MembersAdmin {
+	return &MembersAdmin{store: store}
+}
+
+// memberReport is the answer of GET /admin/usage/{service}/members.
+type memberReport struct {
+	Service string        `json:"service"`
+	From    string        `json:"from"`
+	To      string        `json:"to"`
+	Members []MemberUsage `json:"members"`
+}
+
+// Report handles GET /admin/usage/{service}/members.
+func (a *MembersAdmin) Report(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := reportRange(w, r)
+	if !ok {
+		return
+	}
+	service := r.PathValue("service")
+	members, err := a.store.Report(r.Context(), service, r.URL.Query().Get("key_id"), from, to)
+	if errors.Is(err, ErrInvalidReportRange) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, memberReport{
+		Service: service,
+		From:    reportDay(from),
+		To:      reportDay(to),
+		Members: members,
+	})
+}
+
+// reportRange reads the from and to days of a report, the current month by
+// default. It answers 400 and returns false when they're invalid.
+func reportRange(w http.ResponseWriter, r *http.Request) (from, to time.Time, ok bool) {
+	now := time.Now().UTC()
+	from = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to = now
+	var err error
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = time.Parse(time.DateOnly, v); err != nil {
+			http.Error(w, "Invalid from, expected YYYY-MM-DD", http.StatusBadRequest)
+			return from, to, false
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = time.Parse(time.DateOnly, v); err != nil {
+			http.Error(w, "Invalid to, expected YYYY-MM-DD", http.StatusBadRequest)
+			return from, to, false
+		}
+	}
+	return from, to, true
+}
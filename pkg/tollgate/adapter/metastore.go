@@ -3,10 +3,11 @@ package adapter
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
-	"httpcache/pkg/dbsqlc"
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
 
 	"golang.org/x/sync/singleflight"
 )
@@ -21,12 +22,66 @@ type MetaStore interface {
 	ResetQuota(ctx context.Context, serviceName string, keyString string) error
 }
 
+// ErrKeyNotFound is returned by FindKey when no key has the fingerprint.
+var ErrKeyNotFound = errors.New("key not found")
+
+// KeyFinder is implemented by the stores finding a key from its fingerprint,
+// the first 4 bytes of the SHA-256 of the key in hex, the ID the request logs
+// and the support tooling show instead of the key.
+type KeyFinder interface {
+	FindKey(ctx context.Context, fingerprint string) (*KeyMetadata, error)
+}
+
+// FindKey finds the key of store with the fingerprint, ErrKeyNotFound when
+// there is none.
+func FindKey(ctx context.Context, store MetaStore, fingerprint string) (*KeyMetadata, error) {
+	finder, ok := store.(KeyFinder)
+	if !ok {
+		return nil, fmt.Errorf("FindKey: %T can't find keys by fingerprint", store)
+	}
+	return finder.FindKey(ctx, fingerprint)
+}
+
+// findKeyRow returns the metadata of the only key of rows.
+func findKeyRow(rows []*dbsqlc.GetAPIKeysByFingerprintRow, fingerprint string) (*KeyMetadata, error) {
+	switch {
+	case len(rows) == 0:
+		return nil, ErrKeyNotFound
+	case len(rows) > 1:
+		return nil, fmt.Errorf("several keys have the fingerprint %s", fingerprint)
+	}
+	metadata := &KeyMetadata{
+		APIKeyID: rows[0].ID,
+		APIKey:   rows[0].KeyString,
+		HasQuota: rows[0].HasQuota,
+		Status:   rows[0].Status,
+
+		AllowedCIDRs:   rows[0].AllowedCidrs,
+		AllowedOrigins: rows[0].AllowedOrigins,
+	}
+	if rows[0].ExpiresAt.Valid {
+		metadata.ExpiresAt = &rows[0].ExpiresAt.Time
+	}
+	return metadata, nil
+}
+
 // KeyMetadata represents cached metadata for an API key
 type KeyMetadata struct {
 	APIKeyID int64  `json:"api_key_id"`
 	APIKey   string `json:"api_key"`
 	HasQuota bool   `json:"has_quota"`
 	Status   string `json:"status"`
+	// ExpiresAt is set on trial keys
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// AllowedCIDRs and AllowedOrigins restrict where the key works from, empty allows anywhere
+	AllowedCIDRs   []string `json:"allowed_cidrs,omitempty"`
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+}
+
+// Expired reports whether the key is a trial key past its expiry. The status
+// only changes when the expiry job runs, so the time is checked too.
+func (m *KeyMetadata) Expired(now time.Time) bool {
+	return m.Status == "expired" || (m.ExpiresAt != nil && !now.Before(*m.ExpiresAt))
 }
 
 // ServiceMetadata represents cached metadata for a service
@@ -80,6 +135,12 @@ func (c *RealMetaStore) GetKey(ctx context.Context, keyString string) (*KeyMetad
 		APIKey:   keyInfo.KeyString,
 		HasQuota: keyInfo.HasQuota,
 		Status:   keyInfo.Status,
+
+		AllowedCIDRs:   keyInfo.AllowedCidrs,
+		AllowedOrigins: keyInfo.AllowedOrigins,
+	}
+	if keyInfo.ExpiresAt.Valid {
+		metadata.ExpiresAt = &keyInfo.ExpiresAt.Time
 	}
 
 	// Cache the metadata for 1 hour
@@ -89,6 +150,16 @@ func (c *RealMetaStore) GetKey(ctx context.Context, keyString string) (*KeyMetad
 	return metadata, nil
 }
 
+// FindKey finds the key with the fingerprint in the DB, not cached since
+// impersonation is rare
+func (c *RealMetaStore) FindKey(ctx context.Context, fingerprint string) (*KeyMetadata, error) {
+	rows, err := c.db.GetAPIKeysByFingerprint(ctx, fingerprint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find key: %w", err)
+	}
+	return findKeyRow(rows, fingerprint)
+}
+
 // GetService retrieves cached service metadata, loading from DB if not cached
 func (c *RealMetaStore) GetService(ctx context.Context, serviceName string) (*ServiceMetadata, error) {
 	metaKey := fmt.Sprintf("service_meta:%s", serviceName)
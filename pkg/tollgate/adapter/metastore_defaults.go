@@ -0,0 +1,75 @@
+package adapter
+
+import (
+	"context"
+	"sync"
+)
+
+// QuotaDefaults is a MetaStore overriding the default quota of services, e.g.
+// from dynamic configuration. Services without an override use the store.
+// The keys created with a quota of their own, e.g. in Postgres, keep it, the
+// keys getting the default of a store telling them apart, e.g. a
+// FileMetaStore, get the override.
+type QuotaDefaults struct {
+	MetaStore
+	mu        sync.RWMutex
+	overrides map[string]int32
+}
+
+// NewQuotaDefaults creates a new QuotaDefaults wrapping store.
+func NewQuotaDefaults(store MetaStore) *QuotaDefaults {
+	return &QuotaDefaults{MetaStore: store}
+}
+
+// Set replaces the default quota overrides, by service name.
+func (q *QuotaDefaults) Set(overrides map[string]int32) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.overrides = overrides
+}
+
+// GetService retrieves the service metadata with its overridden default quota
+func (q *QuotaDefaults) GetService(ctx context.Context, serviceName string) (*ServiceMetadata, error) {
+	service, err := q.MetaStore.GetService(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if quota, ok := q.overrides[serviceName]; ok {
+		meta := *service
+		meta.DefaultQuota = quota
+		return &meta, nil
+	}
+	return service, nil
+}
+
+// FindKey finds the key with the fingerprint in the store
+func (q *QuotaDefaults) FindKey(ctx context.Context, fingerprint string) (*KeyMetadata, error) {
+	return FindKey(ctx, q.MetaStore, fingerprint)
+}
+
+// keyQuotas is implemented by the stores telling apart the keys with a quota
+// of their own from those getting the default quota of the service.
+type keyQuotas interface {
+	KeyQuota(ctx context.Context, serviceName string, keyString string) (quota int, explicit bool, err error)
+}
+
+// GetQuota retrieves the quota of a key, the overridden default quota for the
+// keys without their own.
+func (q *QuotaDefaults) GetQuota(ctx context.Context, serviceName string, keyString string) (int, error) {
+	store, ok := q.MetaStore.(keyQuotas)
+	if !ok {
+		return q.MetaStore.GetQuota(ctx, serviceName, keyString)
+	}
+	quota, explicit, err := store.KeyQuota(ctx, serviceName, keyString)
+	if err != nil || explicit {
+		return quota, err
+	}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if override, ok := q.overrides[serviceName]; ok {
+		return int(override), nil
+	}
+	return quota, nil
+}
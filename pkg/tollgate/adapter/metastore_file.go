@@ -0,0 +1,209 @@
+package adapter
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileMetaStore serves metadata defined in a static YAML file, for deployments
+// without a database:
+//
+//	services:
+//	  - name: jina
+//	    default_quota: 1000
+//	keys:
+//	  - key: sk-abc
+//	    status: assigned
+//	    has_quota: true
+//	    quotas:
+//	      jina: 100
+//	    allowed_cidrs:
+//	      - 203.0.113.0/24
+//	    allowed_origins:
+//	      - https://app.example.com
+//
+// IDs default to the position in the file. Quotas default to the service
+// default quota. Reset reloads the file, so edits are picked up without a restart.
+type FileMetaStore struct {
+	path string
+
+	mu       sync.RWMutex
+	keys     map[string]*fileKey
+	services map[string]*ServiceMetadata
+}
+
+type fileKey struct {
+	meta   KeyMetadata
+	quotas map[string]int
+}
+
+// NewFileMetaStore creates a new FileMetaStore from the file at path
+func NewFileMetaStore(path string) (*FileMetaStore, error) {
+	f := &FileMetaStore{path: path}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// metaStoreFile is the document of a FileMetaStore.
+type metaStoreFile struct {
+	Services []struct {
+		ID           int    `yaml:"id"`
+		Name         string `yaml:"name"`
+		DefaultQuota int32  `yaml:"default_quota"`
+	} `yaml:"services"`
+	Keys []struct {
+		ID             int            `yaml:"id"`
+		Key            string         `yaml:"key"`
+		Status         string         `yaml:"status"`
+		HasQuota       *bool          `yaml:"has_quota"`
+		Quotas         map[string]int `yaml:"quotas"`
+		AllowedCIDRs   []string       `yaml:"allowed_cidrs"`
+		AllowedOrigins []string       `yaml:"allowed_origins"`
+	} `yaml:"keys"`
+}
+
+func (f *FileMetaStore) load() error {
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("os.ReadFile: %w", err)
+	}
+	var doc metaStoreFile
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+
+	services := map[string]*ServiceMetadata{}
+	for i, service := range doc.Services {
+		if service.Name == "" {
+			return fmt.Errorf("%s: service #%d has no name", f.path, i+1)
+		}
+		id := cmp.Or(service.ID, i+1)
+		services[service.Name] = &ServiceMetadata{ServiceID: int64(id), ServiceName: service.Name, DefaultQuota: service.DefaultQuota}
+	}
+
+	keys := map[string]*fileKey{}
+	for i, key := range doc.Keys {
+		if key.Key == "" {
+			return fmt.Errorf("%s: key #%d has no key", f.path, i+1)
+		}
+		if _, err := tollgate.ParseRestrictions(key.AllowedCIDRs, key.AllowedOrigins); err != nil {
+			return fmt.Errorf("%s: key #%d: %w", f.path, i+1, err)
+		}
+		hasQuota := key.HasQuota == nil || *key.HasQuota
+		keys[key.Key] = &fileKey{
+			meta: KeyMetadata{
+				APIKeyID:       int64(cmp.Or(key.ID, i+1)),
+				APIKey:         key.Key,
+				HasQuota:       hasQuota,
+				Status:         cmp.Or(key.Status, "assigned"),
+				AllowedCIDRs:   key.AllowedCIDRs,
+				AllowedOrigins: key.AllowedOrigins,
+			},
+			quotas: key.Quotas,
+		}
+	}
+
+	f.mu.Lock()
+	f.keys, f.services = keys, services
+	f.mu.Unlock()
+	return nil
+}
+
+// GetKey retrieves key metadata
+func (f *FileMetaStore) GetKey(ctx context.Context, keyString string) (*KeyMetadata, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	key, ok := f.keys[keyString]
+	if !ok {
+		return nil, fmt.Errorf("failed to get key info: unknown key")
+	}
+	meta := key.meta
+	return &meta, nil
+}
+
+// FindKey finds the key with the fingerprint
+func (f *FileMetaStore) FindKey(ctx context.Context, fingerprint string) (*KeyMetadata, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	var found *KeyMetadata
+	for keyString, key := range f.keys {
+		if tollgate.KeyFingerprint(keyString) != fingerprint {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("several keys have the fingerprint %s", fingerprint)
+		}
+		meta := key.meta
+		found = &meta
+	}
+	if found == nil {
+		return nil, ErrKeyNotFound
+	}
+	return found, nil
+}
+
+// GetService retrieves service metadata
+func (f *FileMetaStore) GetService(ctx context.Context, serviceName string) (*ServiceMetadata, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	service, ok := f.services[serviceName]
+	if !ok {
+		return nil, fmt.Errorf("failed to get service info: unknown service %q", serviceName)
+	}
+	meta := *service
+	return &meta, nil
+}
+
+// GetQuota retrieves the configured quota of a key for a service
+func (f *FileMetaStore) GetQuota(ctx context.Context, serviceName string, keyString string) (int, error) {
+	quota, _, err := f.KeyQuota(ctx, serviceName, keyString)
+	return quota, err
+}
+
+// KeyQuota retrieves the configured quota of a key for a service, explicit is
+// false for the keys getting the default quota of the service.
+func (f *FileMetaStore) KeyQuota(ctx context.Context, serviceName string, keyString string) (quota int, explicit bool, err error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	key, ok := f.keys[keyString]
+	if !ok {
+		return 0, false, fmt.Errorf("GetQuota: unknown key")
+	}
+	if quota, ok := key.quotas[serviceName]; ok {
+		return quota, true, nil
+	}
+	service, ok := f.services[serviceName]
+	if !ok {
+		return 0, false, fmt.Errorf("GetQuota: unknown service %q", serviceName)
+	}
+	return int(service.DefaultQuota), false, nil
+}
+
+// ResetKey reloads the file
+func (f *FileMetaStore) ResetKey(ctx context.Context, keyString string) error {
+	return f.load()
+}
+
+// ResetService reloads the file
+func (f *FileMetaStore) ResetService(ctx context.Context, serviceName string) error {
+	return f.load()
+}
+
+// ResetQuota reloads the file
+func (f *FileMetaStore) ResetQuota(ctx context.Context, serviceName string, keyString string) error {
+	return f.load()
+}
@@ -0,0 +1,89 @@
+package adapter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+)
+
+// PostgresMetaStore reads metadata straight from PostgreSQL, without a Redis
+// cache. There is nothing to reset, every read sees the current rows.
+type PostgresMetaStore struct {
+	db *dbsqlc.Queries
+}
+
+// NewPostgresMetaStore creates a new PostgresMetaStore
+func NewPostgresMetaStore(db *dbsqlc.Queries) *PostgresMetaStore {
+	return &PostgresMetaStore{db: db}
+}
+
+// GetKey retrieves key metadata
+func (p *PostgresMetaStore) GetKey(ctx context.Context, keyString string) (*KeyMetadata, error) {
+	keyInfo, err := p.db.GetAPIKeyByKeyString(ctx, keyString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key info: %w", err)
+	}
+	metadata := &KeyMetadata{
+		APIKeyID: keyInfo.ID,
+		APIKey:   keyInfo.KeyString,
+		HasQuota: keyInfo.HasQuota,
+		Status:   keyInfo.Status,
+
+		AllowedCIDRs:   keyInfo.AllowedCidrs,
+		AllowedOrigins: keyInfo.AllowedOrigins,
+	}
+	if keyInfo.ExpiresAt.Valid {
+		metadata.ExpiresAt = &keyInfo.ExpiresAt.Time
+	}
+	return metadata, nil
+}
+
+// FindKey finds the key with the fingerprint
+func (p *PostgresMetaStore) FindKey(ctx context.Context, fingerprint string) (*KeyMetadata, error) {
+	rows, err := p.db.GetAPIKeysByFingerprint(ctx, fingerprint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find key: %w", err)
+	}
+	return findKeyRow(rows, fingerprint)
+}
+
+// GetService retrieves service metadata
+func (p *PostgresMetaStore) GetService(ctx context.Context, serviceName string) (*ServiceMetadata, error) {
+	serviceInfo, err := p.db.GetServiceByName(ctx, serviceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get service info: %w", err)
+	}
+	return &ServiceMetadata{
+		ServiceID:    serviceInfo.ID,
+		ServiceName:  serviceInfo.Name,
+		DefaultQuota: serviceInfo.DefaultQuota,
+	}, nil
+}
+
+// GetQuota retrieves the remaining quota of a key for a service
+func (p *PostgresMetaStore) GetQuota(ctx context.Context, serviceName string, keyString string) (int, error) {
+	res, err := p.db.GetQuota(ctx, &dbsqlc.GetQuotaParams{
+		KeyString: keyString,
+		Name:      serviceName,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("GetQuota: %w", err)
+	}
+	return int(res.RemainingQuota), nil
+}
+
+// ResetKey is a no-op, nothing is cached
+func (p *PostgresMetaStore) ResetKey(ctx context.Context, keyString string) error {
+	return nil
+}
+
+// ResetService is a no-op, nothing is cached
+func (p *PostgresMetaStore) ResetService(ctx context.Context, serviceName string) error {
+	return nil
+}
+
+// ResetQuota is a no-op, nothing is cached
+func (p *PostgresMetaStore) ResetQuota(ctx context.Context, serviceName string, keyString string) error {
+	return nil
+}
@@ -0,0 +1,81 @@
+package adapter
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+)
+
+// MetaStoreOptions holds what a MetaStore backend may need, each backend
+// uses the fields it knows about.
+type MetaStoreOptions struct {
+	// Redis caches metadata for the "redis" backend
+	Redis RedisClient
+	// DB is the source of truth of the "redis" and "postgres" backends
+	DB *dbsqlc.Queries
+	// Path is the key file of the "file" backend
+	Path string
+}
+
+// MetaStoreFactory creates a MetaStore from its options.
+type MetaStoreFactory func(opts MetaStoreOptions) (MetaStore, error)
+
+var (
+	metaStoresMu sync.RWMutex
+	metaStores   = map[string]MetaStoreFactory{}
+)
+
+// RegisterMetaStore makes a MetaStore backend available by name, like
+// database/sql drivers. It panics if the name is registered twice.
+func RegisterMetaStore(name string, factory MetaStoreFactory) {
+	metaStoresMu.Lock()
+	defer metaStoresMu.Unlock()
+	if _, dup := metaStores[name]; dup {
+		panic("adapter: RegisterMetaStore called twice for " + name)
+	}
+	metaStores[name] = factory
+}
+
+// MetaStores returns the names of the registered backends.
+func MetaStores() []string {
+	metaStoresMu.RLock()
+	defer metaStoresMu.RUnlock()
+	names := make([]string, 0, len(metaStores))
+	for name := range metaStores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OpenMetaStore creates a MetaStore with the backend registered as name.
+func OpenMetaStore(name string, opts MetaStoreOptions) (MetaStore, error) {
+	metaStoresMu.RLock()
+	factory, ok := metaStores[name]
+	metaStoresMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown MetaStore backend %q, registered: %v", name, MetaStores())
+	}
+	return factory(opts)
+}
+
+func init() {
+	RegisterMetaStore("redis", func(opts MetaStoreOptions) (MetaStore, error) {
+		if opts.Redis == nil || opts.DB == nil {
+			return nil, errors.New("redis MetaStore needs Redis and DB")
+		}
+		return NewRedisMetadataStore(opts.Redis, opts.DB), nil
+	})
+	RegisterMetaStore("postgres", func(opts MetaStoreOptions) (MetaStore, error) {
+		if opts.DB == nil {
+			return nil, errors.New("postgres MetaStore needs DB")
+		}
+		return NewPostgresMetaStore(opts.DB), nil
+	})
+	RegisterMetaStore("file", func(opts MetaStoreOptions) (MetaStore, error) {
+		return NewFileMetaStore(opts.Path)
+	})
+}
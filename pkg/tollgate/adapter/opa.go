@@ -0,0 +1,119 @@
+package adapter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+)
+
+var policyMetrics = expvar.NewMap("policy")
+
+// OPA asks an Open Policy Agent whether the requests are allowed, e.g. a
+// sidecar serving rules such as "interns can't fetch social-media domains".
+// The decision URL is the one of a rule, e.g.
+// "http://localhost:8181/v1/data/httpcache/allow", answering a boolean or
+// an object with "allow" and "reason"; an undefined rule denies.
+type OPA struct {
+	url    string
+	client *http.Client
+	// failOpen allows the requests when the agent can't be asked
+	failOpen bool
+	// store adds the metadata of the keys to the input when set
+	store  MetaStore
+	logger *slog.Logger
+}
+
+// NewOPA creates an OPA asking the decision URL, each decision within timeout.
+func NewOPA(url string, timeout time.Duration, failOpen bool, store MetaStore, logger *slog.Logger) *OPA {
+	return &OPA{
+		url:      url,
+		client:   &http.Client{Timeout: timeout},
+		failOpen: failOpen,
+		store:    store,
+		logger:   logger,
+	}
+}
+
+// policyKey is the metadata of a key in the policy input, without the key.
+type policyKey struct {
+	ID        int64      `json:"id"`
+	Status    string     `json:"status"`
+	HasQuota  bool       `json:"has_quota"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Decide implements tollgate.Policy.
+func (o *OPA) Decide(ctx context.Context, key string, input *tollgate.PolicyInput) (tollgate.Decision, error) {
+	if o.store != nil {
+		keyMeta, err := o.store.GetKey(ctx, key)
+		if err != nil {
+			return tollgate.Decision{}, fmt.Errorf("store.GetKey: %w", err)
+		}
+		input.Key = policyKey{ID: keyMeta.APIKeyID, Status: keyMeta.Status, HasQuota: keyMeta.HasQuota, ExpiresAt: keyMeta.ExpiresAt}
+	}
+
+	decision, err := o.ask(ctx, input)
+	if err != nil {
+		policyMetrics.Add("errors", 1)
+		if o.failOpen {
+			o.logger.Warn("Policy agent unavailable, request allowed", "error", err)
+			return tollgate.Decision{Allow: true}, nil
+		}
+		o.logger.Error("Policy agent unavailable, request denied", "error", err)
+		return tollgate.Decision{Reason: "Policy unavailable"}, nil
+	}
+	if decision.Allow {
+		policyMetrics.Add("allowed", 1)
+	} else {
+		policyMetrics.Add("denied", 1)
+	}
+	return decision, nil
+}
+
+func (o *OPA) ask(ctx context.Context, input *tollgate.PolicyInput) (tollgate.Decision, error) {
+	body, err := json.Marshal(map[string]any{"input": input})
+	if err != nil {
+		return tollgate.Decision{}, fmt.Errorf("json.Marshal: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(body))
+	if err != nil {
+		return tollgate.Decision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return tollgate.Decision{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+		return tollgate.Decision{}, fmt.Errorf("policy agent answered %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	var answer struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return tollgate.Decision{}, fmt.Errorf("json.Decode: %w", err)
+	}
+	if len(answer.Result) == 0 {
+		return tollgate.Decision{Reason: "Denied by policy"}, nil
+	}
+	var allow bool
+	if err := json.Unmarshal(answer.Result, &allow); err == nil {
+		return tollgate.Decision{Allow: allow}, nil
+	}
+	var decision tollgate.Decision
+	if err := json.Unmarshal(answer.Result, &decision); err != nil {
+		return tollgate.Decision{}, fmt.Errorf("policy result is neither a boolean nor a decision: %s", answer.Result)
+	}
+	return decision, nil
+}
@@ -0,0 +1,81 @@
+package adapter
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+)
+
+func TestOPA(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		result     string
+		status     int
+		wantStatus int
+		wantBody   string
+	}{
+		{"allowed", `{"result":true}`, http.StatusOK, http.StatusOK, "ok"},
+		{"denied", `{"result":false}`, http.StatusOK, http.StatusForbidden, "Denied by policy"},
+		{"denied with a reason", `{"result":{"allow":false,"reason":"No social media"}}`, http.StatusOK, http.StatusForbidden, "No social media"},
+		{"allowed by a decision", `{"result":{"allow":true}}`, http.StatusOK, http.StatusOK, "ok"},
+		{"undefined rule", `{}`, http.StatusOK, http.StatusForbidden, "Denied by policy"},
+		{"agent error", `{"code":"internal_error"}`, http.StatusInternalServerError, http.StatusForbidden, "Policy unavailable"},
+		{"invalid result", `{"result":"yes"}`, http.StatusOK, http.StatusForbidden, "Policy unavailable"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var input map[string]any
+			agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body struct {
+					Input map[string]any `json:"input"`
+				}
+				_ = json.NewDecoder(r.Body).Decode(&body)
+				input = body.Input
+				w.WriteHeader(tt.status)
+				_, _ = io.WriteString(w, tt.result)
+			}))
+			defer agent.Close()
+			opa := NewOPA(agent.URL, time.Second, false, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+			h := testGate(&balances{balance: map[string]int{"sk-a": 10}}, tollgate.WithPolicy("jina", opa.Decide))
+
+			rec := call(h, "sk-a")
+			if rec.Code != tt.wantStatus || strings.TrimSpace(rec.Body.String()) != tt.wantBody {
+				t.Errorf("got %d %q, want %d %q", rec.Code, rec.Body, tt.wantStatus, tt.wantBody)
+			}
+			if input["service"] != "jina" || input["key_id"] != tollgate.KeyFingerprint("sk-a") {
+				t.Errorf("input %v", input)
+			}
+			for _, v := range input {
+				if v == "sk-a" {
+					t.Errorf("the key was sent to the agent: %v", input)
+				}
+			}
+		})
+	}
+}
+
+func TestOPAUnreachable(t *testing.T) {
+	agent := httptest.NewServer(http.NotFoundHandler())
+	agent.Close()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	next := &balances{balance: map[string]int{"sk-a": 10}}
+
+	closed := testGate(next, tollgate.WithPolicy("jina", NewOPA(agent.URL, time.Second, false, nil, logger).Decide))
+	if rec := call(closed, "sk-a"); rec.Code != http.StatusForbidden {
+		t.Errorf("unreachable agent: %d, want 403", rec.Code)
+	}
+	if next.balance["sk-a"] != 10 {
+		t.Error("a request denied by the policy was charged")
+	}
+
+	open := testGate(next, tollgate.WithPolicy("jina", NewOPA(agent.URL, time.Second, true, nil, logger).Decide))
+	if rec := call(open, "sk-a"); rec.Code != http.StatusOK {
+		t.Errorf("unreachable agent failing open: %d, want 200", rec.Code)
+	}
+}
@@ -6,8 +6,8 @@ import (
 	"database/sql"
 	"errors"
 
-	"httpcache/pkg/dbsqlc"
-	"httpcache/pkg/tollgate"
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
 )
 
 // Postgres implements the tollgate.Adapter interface using PostgreSQL
@@ -0,0 +1,220 @@
+package adapter
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fallbackAttempts is how many times a fallback transaction is retried when
+// another replica changed its keys meanwhile.
+const fallbackAttempts = 32
+
+var fallbackMetrics = expvar.NewMap("quota_script_fallback")
+
+// watcher is the part of the Redis clients running optimistic transactions.
+type watcher interface {
+	Watch(ctx context.Context, fn func(*redis.Tx) error, keys ...string) error
+}
+
+// scriptFallback is the Go version of a quota script, taking the same keys
+// and arguments and returning the same reply, for the Redis that have EVAL
+// disabled. It runs as a WATCH/MULTI transaction instead of a script.
+type scriptFallback func(ctx context.Context, rdb watcher, keys []string, args ...interface{}) (interface{}, error)
+
+// scriptsDisabled reports whether err is Redis refusing to run scripts, e.g.
+// a managed Redis with EVAL renamed or an ACL without it.
+func scriptsDisabled(err error) bool {
+	msg := strings.ToLower(err.Error())
+	if !strings.Contains(msg, "eval") {
+		return false
+	}
+	return strings.Contains(msg, "unknown command") || strings.Contains(msg, "noperm") || strings.Contains(msg, "not allowed")
+}
+
+// runScript runs a quota script, or its fallback once Redis refused to run
+// scripts. The fallback needs a client running transactions.
+func (qm *QuotaManager) runScript(ctx context.Context, script *redis.Script, fallback scriptFallback, keys []string, args ...interface{}) (interface{}, error) {
+	w, canFallback := qm.redis.(watcher)
+	if !qm.noScripts.Load() || !canFallback {
+		result, err := script.Run(ctx, qm.redis, keys, args...).Result()
+		if err == nil || !canFallback || !scriptsDisabled(err) {
+			return result, err
+		}
+		if !qm.noScripts.Swap(true) {
+			fallbackMetrics.Add("switches", 1)
+		}
+	}
+	fallbackMetrics.Add("runs", 1)
+	return fallback(ctx, w, keys, args...)
+}
+
+// watch runs fn as an optimistic transaction on keys, retried while another
+// client changes them. The retries wait a random time growing with the
+// attempts, the clients retrying at once would conflict again.
+func watch(ctx context.Context, rdb watcher, fn func(*redis.Tx) error, keys ...string) error {
+	for attempt := range fallbackAttempts {
+		err := rdb.Watch(ctx, fn, keys...)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+		fallbackMetrics.Add("conflicts", 1)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Watch: %w", ctx.Err())
+		case <-time.After(time.Duration(rand.Int63n(int64(attempt+1) * int64(time.Millisecond)))):
+		}
+	}
+	return fmt.Errorf("Watch: %w after %d attempts", redis.TxFailedErr, fallbackAttempts)
+}
+
+// usageBucket returns the usage buffer of the minute of the Redis clock, as
+// the scripts name it.
+func usageBucket(ctx context.Context, tx *redis.Tx, prefix string) (string, error) {
+	now, err := tx.Time(ctx).Result()
+	if err != nil {
+		return "", fmt.Errorf("Time: %w", err)
+	}
+	return fmt.Sprintf("%s:%d", prefix, now.Truncate(time.Minute).Unix()), nil
+}
+
+// intArg returns a numeric script argument.
+func intArg(arg interface{}) int64 {
+	n, _ := strconv.ParseInt(fmt.Sprint(arg), 10, 64)
+	return n
+}
+
+// reserveFallback is reserve.lua.
+func reserveFallback(ctx context.Context, rdb watcher, keys []string, args ...interface{}) (interface{}, error) {
+	quotaKey, usagePrefix := keys[0], keys[1]
+	serviceKey, hasQuota, amount, timestamp := fmt.Sprint(args[0]), fmt.Sprint(args[1]) == "true", intArg(args[2]), args[3]
+	quotaTTL, usageTTL := time.Duration(intArg(args[4]))*time.Second, time.Duration(intArg(args[5]))*time.Second
+
+	var result []interface{}
+	err := watch(ctx, rdb, func(tx *redis.Tx) error {
+		usageKey, err := usageBucket(ctx, tx, usagePrefix)
+		if err != nil {
+			return err
+		}
+		remaining := int64(999999) // Unlimited indicator
+		if hasQuota {
+			current, err := tx.HGet(ctx, quotaKey, serviceKey).Int64()
+			if err == redis.Nil {
+				result = []interface{}{"-1", "LOAD_REQUIRED"}
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("HGet: %w", err)
+			}
+			if current < amount {
+				result = []interface{}{strconv.FormatInt(current, 10), "EXHAUSTED"}
+				return nil
+			}
+			remaining = current - amount
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if hasQuota {
+				pipe.HSet(ctx, quotaKey, serviceKey, remaining, "last_used", timestamp)
+				pipe.Expire(ctx, quotaKey, quotaTTL)
+			}
+			pipe.IncrBy(ctx, usageKey, amount)
+			pipe.Expire(ctx, usageKey, usageTTL)
+			return nil
+		})
+		result = []interface{}{strconv.FormatInt(remaining, 10), "OK"}
+		return err
+	}, quotaKey)
+	return result, err
+}
+
+// setAndReserveFallback is set_and_reserve.lua.
+func setAndReserveFallback(ctx context.Context, rdb watcher, keys []string, args ...interface{}) (interface{}, error) {
+	quotaKey, usagePrefix := keys[0], keys[1]
+	serviceKey, initialQuota, amount, timestamp := fmt.Sprint(args[0]), intArg(args[1]), intArg(args[2]), args[3]
+	quotaTTL, usageTTL := time.Duration(intArg(args[4]))*time.Second, time.Duration(intArg(args[5]))*time.Second
+
+	var result []interface{}
+	err := watch(ctx, rdb, func(tx *redis.Tx) error {
+		usageKey, err := usageBucket(ctx, tx, usagePrefix)
+		if err != nil {
+			return err
+		}
+		// another replica may have loaded it already
+		remaining, err := tx.HGet(ctx, quotaKey, serviceKey).Int64()
+		if err == redis.Nil {
+			remaining = initialQuota
+		} else if err != nil {
+			return fmt.Errorf("HGet: %w", err)
+		}
+		if remaining < amount {
+			result = []interface{}{strconv.FormatInt(remaining, 10), "EXHAUSTED"}
+			return nil
+		}
+		remaining -= amount
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, quotaKey, serviceKey, remaining, "last_used", timestamp)
+			pipe.Expire(ctx, quotaKey, quotaTTL)
+			pipe.IncrBy(ctx, usageKey, amount)
+			pipe.Expire(ctx, usageKey, usageTTL)
+			return nil
+		})
+		result = []interface{}{strconv.FormatInt(remaining, 10), "OK"}
+		return err
+	}, quotaKey)
+	return result, err
+}
+
+// refundFallback is refund.lua.
+func refundFallback(ctx context.Context, rdb watcher, keys []string, args ...interface{}) (interface{}, error) {
+	quotaKey, usagePrefix := keys[0], keys[1]
+	serviceKey, amount, timestamp := fmt.Sprint(args[0]), intArg(args[1]), args[2]
+	quotaTTL, usageTTL := time.Duration(intArg(args[3]))*time.Second, time.Duration(intArg(args[4]))*time.Second
+
+	var result []interface{}
+	err := watch(ctx, rdb, func(tx *redis.Tx) error {
+		usageKey, err := usageBucket(ctx, tx, usagePrefix)
+		if err != nil {
+			return err
+		}
+		if err := tx.Watch(ctx, usageKey).Err(); err != nil {
+			return fmt.Errorf("Watch: %w", err)
+		}
+		current, err := tx.HGet(ctx, quotaKey, serviceKey).Int64()
+		if err == redis.Nil {
+			// No quota key exists, nothing to refund
+			result = []interface{}{int64(0), "NO_QUOTA"}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("HGet: %w", err)
+		}
+		buffer, err := tx.Get(ctx, usageKey).Int64()
+		hasBuffer := err == nil
+		if err != nil && err != redis.Nil {
+			return fmt.Errorf("Get: %w", err)
+		}
+		remaining := current + amount
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, quotaKey, serviceKey, remaining, "last_refund", timestamp)
+			pipe.Expire(ctx, quotaKey, quotaTTL)
+			switch {
+			case !hasBuffer:
+			case buffer >= amount:
+				pipe.DecrBy(ctx, usageKey, amount)
+			default:
+				pipe.Set(ctx, usageKey, 0, usageTTL)
+			}
+			return nil
+		})
+		result = []interface{}{remaining, "OK"}
+		return err
+	}, quotaKey)
+	return result, err
+}
@@ -4,9 +4,25 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"sync/atomic"
 	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+)
+
+// The quota hashes "quota:{apikey}" hold the balances reserved ahead of
+// Postgres, a field per service. They're kept for QuotaKeyTTL after their
+// last reservation or refund, then reloaded from Postgres. The usage buffers
+// "usage:{apikey}:{service}:{minute}" are kept for UsageKeyTTL until archived,
+// their minute is the one of the Redis clock.
+const (
+	QuotaKeyTTL = 24 * time.Hour
+	UsageKeyTTL = 2 * time.Hour
 )
 
+// ttlArgs are the quota and usage TTLs as the scripts take them, in seconds.
+var ttlArgs = []interface{}{int64(QuotaKeyTTL / time.Second), int64(UsageKeyTTL / time.Second)}
+
 type SyncQuota func(ctx context.Context, ServiceMetaData ServiceMetadata, keyMeta KeyMetadata) (int, error)
 
 // QuotaManager handles quota operations in Redis
@@ -14,41 +30,72 @@ type QuotaManager struct {
 	serviceMetadata ServiceMetadata
 	metaStore       MetaStore
 	redis           RedisClient
+	clock           Clock
+	// noScripts is set once Redis refused to run the scripts, their Go
+	// fallbacks run instead
+	noScripts atomic.Bool
+}
+
+// QuotaManagerOption configures a QuotaManager.
+type QuotaManagerOption func(*QuotaManager)
+
+// WithQuotaClock sets the clock the trial expiries and the last use of the
+// quotas are told by, the system one by default.
+func WithQuotaClock(clock Clock) QuotaManagerOption {
+	return func(qm *QuotaManager) {
+		qm.clock = clock
+	}
 }
 
 // NewQuotaManager creates a new quota manager
-func NewQuotaManager(ctx context.Context, redis RedisClient, metaStore MetaStore, serviceName string) (*QuotaManager, error) {
+func NewQuotaManager(ctx context.Context, redis RedisClient, metaStore MetaStore, serviceName string, opts ...QuotaManagerOption) (*QuotaManager, error) {
 	// Get service metadata
 	serviceMeta, err := metaStore.GetService(ctx, serviceName)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get service metadata: %w", err)
 	}
 
-	return &QuotaManager{
+	qm := &QuotaManager{
 		redis:           redis,
 		metaStore:       metaStore,
 		serviceMetadata: *serviceMeta,
-	}, nil
+		clock:           systemClock{},
+	}
+	for _, opt := range opts {
+		opt(qm)
+	}
+	return qm, nil
+}
+
+// usagePrefix is the prefix of the usage buffers of a key, the scripts add
+// the minute of the Redis clock.
+func (qm *QuotaManager) usagePrefix(keyMeta *KeyMetadata) string {
+	return fmt.Sprintf("usage:%s:%s", keyMeta.APIKey, qm.serviceMetadata.ServiceName)
 }
 
 // Reserve attempts to reserve a given amount of quota and returns success status
 func (qm *QuotaManager) Reserve(ctx context.Context, keyMeta *KeyMetadata, amount int) (bool, error) {
+	// Expired trial keys are rejected whatever their remaining quota
+	if keyMeta.Expired(qm.clock.Now()) {
+		tollgate.Warn(ctx, "trial key expired")
+		return false, nil
+	}
+
 	// Construct keys explicitly for Redis clustering compatibility
-	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
-	minuteTimestamp := time.Now().Truncate(time.Minute)
+	timestamp := strconv.FormatInt(qm.clock.Now().Unix(), 10)
 
 	keys := []string{
 		fmt.Sprintf("quota:%s", keyMeta.APIKey),
-		fmt.Sprintf("service_%s", qm.serviceMetadata.ServiceName),
-		fmt.Sprintf("usage:%s:%s:%d", keyMeta.APIKey, qm.serviceMetadata.ServiceName, minuteTimestamp.Unix()),
+		qm.usagePrefix(keyMeta),
 	}
 
-	argv := []interface{}{
+	argv := append([]interface{}{
+		fmt.Sprintf("service_%s", qm.serviceMetadata.ServiceName),
 		strconv.FormatBool(keyMeta.HasQuota),
 		strconv.Itoa(amount),
 		timestamp,
-	}
-	result, err := ReserveQuotaScript.Run(ctx, qm.redis, keys, argv...).Result()
+	}, ttlArgs...)
+	result, err := qm.runScript(ctx, ReserveQuotaScript, reserveFallback, keys, argv...)
 	if err != nil {
 		return false, fmt.Errorf("ReserveQuotaScript.Run: %w", err)
 	}
@@ -93,16 +140,14 @@ func (qm *QuotaManager) Refund(ctx context.Context, keyMeta *KeyMetadata, amount
 	}
 
 	serviceKey := fmt.Sprintf("service_%s", qm.serviceMetadata.ServiceName)
-	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	timestamp := strconv.FormatInt(qm.clock.Now().Unix(), 10)
 
 	// Construct keys explicitly for Redis clustering compatibility
 	quotaKey := fmt.Sprintf("quota:%s", keyMeta.APIKey)
-	minuteTimestamp := time.Now().Truncate(time.Minute)
-	usageKey := fmt.Sprintf("usage:%s:%s:%d", keyMeta.APIKey, qm.serviceMetadata.ServiceName, minuteTimestamp.Unix())
 
-	result, err := RefundQuotaScript.Run(ctx, qm.redis,
-		[]string{quotaKey, usageKey},
-		serviceKey, strconv.Itoa(amount), timestamp).Result()
+	result, err := qm.runScript(ctx, RefundQuotaScript, refundFallback,
+		[]string{quotaKey, qm.usagePrefix(keyMeta)},
+		append([]interface{}{serviceKey, strconv.Itoa(amount), timestamp}, ttlArgs...)...)
 	if err != nil {
 		return false, fmt.Errorf("redis refund failed: %w", err)
 	}
@@ -155,23 +200,22 @@ func (qm *QuotaManager) setAndReserve(ctx context.Context, keyMeta *KeyMetadata,
 	}
 
 	// Now reserve the amount using the simplified set_and_reserve script
-	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
-	minuteTimestamp := time.Now().Truncate(time.Minute)
+	timestamp := strconv.FormatInt(qm.clock.Now().Unix(), 10)
 
 	// Construct keys explicitly for Redis clustering compatibility
 	keys := []string{
 		fmt.Sprintf("quota:%s", keyMeta.APIKey),
-		fmt.Sprintf("service_%s", qm.serviceMetadata.ServiceName),
-		fmt.Sprintf("usage:%s:%s:%d", keyMeta.APIKey, qm.serviceMetadata.ServiceName, minuteTimestamp.Unix()),
+		qm.usagePrefix(keyMeta),
 	}
 
-	argv := []interface{}{
+	argv := append([]interface{}{
+		fmt.Sprintf("service_%s", qm.serviceMetadata.ServiceName),
 		strconv.Itoa(result),
 		strconv.Itoa(amount),
 		timestamp,
-	}
+	}, ttlArgs...)
 
-	scriptResult, err := SetAndReserveScript.Run(ctx, qm.redis, keys, argv...).Result()
+	scriptResult, err := qm.runScript(ctx, SetAndReserveScript, setAndReserveFallback, keys, argv...)
 	if err != nil {
 		return false, fmt.Errorf("SetAndReserveScript.Run: %w", err)
 	}
@@ -208,15 +252,16 @@ func (qm *QuotaManager) setAndReserve(ctx context.Context, keyMeta *KeyMetadata,
 
 // trackConsumption tracks consumption for no-quota keys using direct aggregation
 func (qm *QuotaManager) trackConsumption(ctx context.Context, keyMeta *KeyMetadata, amount int) {
-	minuteTimestamp := time.Now().Truncate(time.Minute)
-	usageKey := fmt.Sprintf("usage:%s:%s:%d", keyMeta.APIKey, qm.serviceMetadata.ServiceName, minuteTimestamp.Unix())
-
-	// Increment counter and set TTL
-	pipe := qm.redis.Pipeline()
-	pipe.IncrBy(ctx, usageKey, int64(amount))
-	pipe.Expire(ctx, usageKey, 2*time.Hour)
-
-	if _, err := pipe.Exec(ctx); err != nil {
+	// The reserve script only counts the usage of keys without quota, in the
+	// bucket of the Redis clock
+	argv := append([]interface{}{
+		fmt.Sprintf("service_%s", qm.serviceMetadata.ServiceName),
+		strconv.FormatBool(false),
+		strconv.Itoa(amount),
+		strconv.FormatInt(qm.clock.Now().Unix(), 10),
+	}, ttlArgs...)
+	keys := []string{fmt.Sprintf("quota:%s", keyMeta.APIKey), qm.usagePrefix(keyMeta)}
+	if _, err := qm.runScript(ctx, ReserveQuotaScript, reserveFallback, keys, argv...); err != nil {
 		// Log the error but don't fail the request - usage tracking is best effort
 		// This prevents blocking the main quota consumption flow due to tracking failures
 		// TODO: Consider using structured logging when available in the context
@@ -231,8 +276,8 @@ func (qm *QuotaManager) BatchUpdateQuotas(ctx context.Context, updates map[strin
 	serviceKey := fmt.Sprintf("service_%s", qm.serviceMetadata.ServiceName)
 	for keyString, quota := range updates {
 		quotaKey := fmt.Sprintf("quota:%s", keyString)
-		pipe.HSet(ctx, quotaKey, serviceKey, quota, "updated_at", time.Now().Unix())
-		pipe.Expire(ctx, quotaKey, time.Hour)
+		pipe.HSet(ctx, quotaKey, serviceKey, quota, "updated_at", qm.clock.Now().Unix())
+		pipe.Expire(ctx, quotaKey, QuotaKeyTTL)
 	}
 
 	_, err := pipe.Exec(ctx)
@@ -0,0 +1,202 @@
+package adapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// quotaImpls are the implementations of the quota scripts, each case runs
+// against both so the fallback answers as the scripts do.
+var quotaImpls = []struct {
+	name string
+	run  func(ctx context.Context, rdb *redis.Client, script *redis.Script, fallback scriptFallback, keys []string, args ...interface{}) (interface{}, error)
+}{
+	{"script", func(ctx context.Context, rdb *redis.Client, script *redis.Script, _ scriptFallback, keys []string, args ...interface{}) (interface{}, error) {
+		return script.Run(ctx, rdb, keys, args...).Result()
+	}},
+	{"fallback", func(ctx context.Context, rdb *redis.Client, _ *redis.Script, fallback scriptFallback, keys []string, args ...interface{}) (interface{}, error) {
+		return fallback(ctx, rdb, keys, args...)
+	}},
+}
+
+// testRedis returns a client of the in-memory Redis the script tests run
+// against, and the server to move its clock.
+func testRedis(t *testing.T) (*redis.Client, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return rdb, mr
+}
+
+// quotaKeys returns the quota hash and usage prefix of a test, removed once
+// it's done.
+func quotaKeys(t *testing.T, rdb *redis.Client) (string, string) {
+	t.Helper()
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	quotaKey, usagePrefix := "quota:test-"+suffix, "usage:test-"+suffix+":svc"
+	t.Cleanup(func() {
+		ctx := context.Background()
+		keys, _ := rdb.Keys(ctx, usagePrefix+":*").Result()
+		rdb.Del(ctx, append(keys, quotaKey)...)
+	})
+	return quotaKey, usagePrefix
+}
+
+// usage sums the usage buffers of a prefix, whatever their minute.
+func usage(t *testing.T, rdb *redis.Client, prefix string) int64 {
+	t.Helper()
+	ctx := context.Background()
+	keys, err := rdb.Keys(ctx, prefix+":*").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total int64
+	for _, key := range keys {
+		n, _ := rdb.Get(ctx, key).Int64()
+		total += n
+	}
+	return total
+}
+
+func reserveArgs(hasQuota bool, amount int) []interface{} {
+	return append([]interface{}{"service_svc", strconv.FormatBool(hasQuota), amount, time.Now().Unix()}, ttlArgs...)
+}
+
+func wantReply(t *testing.T, got interface{}, err error, want ...interface{}) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply := []interface{}(want); fmt.Sprint(got) != fmt.Sprint(reply) {
+		t.Fatalf("reply %v, want %v", got, want)
+	}
+}
+
+func TestQuotaScripts(t *testing.T) {
+	rdb, mr := testRedis(t)
+	ctx := context.Background()
+	for _, impl := range quotaImpls {
+		t.Run(impl.name, func(t *testing.T) {
+			t.Run("load required", func(t *testing.T) {
+				quotaKey, usagePrefix := quotaKeys(t, rdb)
+				got, err := impl.run(ctx, rdb, ReserveQuotaScript, reserveFallback, []string{quotaKey, usagePrefix}, reserveArgs(true, 1)...)
+				wantReply(t, got, err, "-1", "LOAD_REQUIRED")
+				if n := usage(t, rdb, usagePrefix); n != 0 {
+					t.Errorf("usage %d counted before the quota was loaded", n)
+				}
+			})
+
+			t.Run("load and exhaust", func(t *testing.T) {
+				quotaKey, usagePrefix := quotaKeys(t, rdb)
+				keys := []string{quotaKey, usagePrefix}
+				args := append([]interface{}{"service_svc", 10, 3, time.Now().Unix()}, ttlArgs...)
+				got, err := impl.run(ctx, rdb, SetAndReserveScript, setAndReserveFallback, keys, args...)
+				wantReply(t, got, err, "7", "OK")
+				if ttl := rdb.TTL(ctx, quotaKey).Val(); ttl <= QuotaKeyTTL-time.Minute {
+					t.Errorf("quota TTL %v, want %v", ttl, QuotaKeyTTL)
+				}
+
+				got, err = impl.run(ctx, rdb, ReserveQuotaScript, reserveFallback, keys, reserveArgs(true, 8)...)
+				wantReply(t, got, err, "7", "EXHAUSTED")
+				got, err = impl.run(ctx, rdb, ReserveQuotaScript, reserveFallback, keys, reserveArgs(true, 7)...)
+				wantReply(t, got, err, "0", "OK")
+				if n := usage(t, rdb, usagePrefix); n != 10 {
+					t.Errorf("usage %d, want 10", n)
+				}
+			})
+
+			t.Run("no quota", func(t *testing.T) {
+				quotaKey, usagePrefix := quotaKeys(t, rdb)
+				got, err := impl.run(ctx, rdb, ReserveQuotaScript, reserveFallback, []string{quotaKey, usagePrefix}, reserveArgs(false, 5)...)
+				wantReply(t, got, err, "999999", "OK")
+				if n := usage(t, rdb, usagePrefix); n != 5 {
+					t.Errorf("usage %d, want 5", n)
+				}
+			})
+
+			t.Run("concurrent", func(t *testing.T) {
+				quotaKey, usagePrefix := quotaKeys(t, rdb)
+				keys := []string{quotaKey, usagePrefix}
+				const quota = 100
+				rdb.HSet(ctx, quotaKey, "service_svc", quota)
+				var granted atomic.Int64
+				var wg sync.WaitGroup
+				for range 20 {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for range 10 {
+							got, err := impl.run(ctx, rdb, ReserveQuotaScript, reserveFallback, keys, reserveArgs(true, 1)...)
+							if err != nil {
+								t.Error(err)
+								return
+							}
+							if got.([]interface{})[1] == "OK" {
+								granted.Add(1)
+							}
+						}
+					}()
+				}
+				wg.Wait()
+				remaining, _ := rdb.HGet(ctx, quotaKey, "service_svc").Int64()
+				if granted.Load() != quota || remaining != 0 {
+					t.Errorf("granted %d with %d remaining, want %d with 0", granted.Load(), remaining, quota)
+				}
+			})
+
+			t.Run("refund", func(t *testing.T) {
+				quotaKey, usagePrefix := quotaKeys(t, rdb)
+				keys := []string{quotaKey, usagePrefix}
+				rdb.HSet(ctx, quotaKey, "service_svc", 10)
+				got, err := impl.run(ctx, rdb, ReserveQuotaScript, reserveFallback, keys, reserveArgs(true, 4)...)
+				wantReply(t, got, err, "6", "OK")
+				args := append([]interface{}{"service_svc", 3, time.Now().Unix()}, ttlArgs...)
+				got, err = impl.run(ctx, rdb, RefundQuotaScript, refundFallback, keys, args...)
+				wantReply(t, got, err, int64(9), "OK")
+				if n := usage(t, rdb, usagePrefix); n != 1 {
+					t.Errorf("usage %d after the refund, want 1", n)
+				}
+			})
+
+			t.Run("refund after expiry", func(t *testing.T) {
+				quotaKey, usagePrefix := quotaKeys(t, rdb)
+				rdb.HSet(ctx, quotaKey, "service_svc", 10)
+				rdb.PExpire(ctx, quotaKey, time.Millisecond)
+				mr.FastForward(10 * time.Millisecond)
+				args := append([]interface{}{"service_svc", 3, time.Now().Unix()}, ttlArgs...)
+				got, err := impl.run(ctx, rdb, RefundQuotaScript, refundFallback, []string{quotaKey, usagePrefix}, args...)
+				wantReply(t, got, err, int64(0), "NO_QUOTA")
+				if rdb.Exists(ctx, quotaKey).Val() != 0 {
+					t.Errorf("refund recreated the expired quota")
+				}
+			})
+		})
+	}
+}
+
+func TestScriptsDisabled(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{errors.New("ERR unknown command 'evalsha', with args beginning with: "), true},
+		{errors.New("NOPERM this user has no permissions to run the 'evalsha' command"), true},
+		{errors.New("ERR command eval not allowed"), true},
+		{errors.New("NOSCRIPT No matching script. Please use EVAL."), false},
+		{errors.New("WRONGTYPE Operation against a key holding the wrong kind of value"), false},
+	} {
+		if got := scriptsDisabled(tc.err); got != tc.want {
+			t.Errorf("scriptsDisabled(%q) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
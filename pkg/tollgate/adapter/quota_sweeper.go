@@ -0,0 +1,115 @@
+package adapter
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// quotaSweepBatch is the number of keys scanned per round trip.
+const quotaSweepBatch = 500
+
+var quotaSweepMetrics = expvar.NewMap("quota_sweep")
+
+// QuotaSweeper gives the quota hashes and usage buffers left without a TTL,
+// e.g. by an older version or a manual edit, the TTL of the policy, so those
+// of deleted keys don't pile up. They're not deleted, a quota hash may hold
+// a balance not yet synced to Postgres.
+type QuotaSweeper struct {
+	redis    RedisClient
+	interval time.Duration
+	logger   *slog.Logger
+}
+
+// NewQuotaSweeper creates a new QuotaSweeper sweeping every interval.
+func NewQuotaSweeper(rdb RedisClient, interval time.Duration, logger *slog.Logger) *QuotaSweeper {
+	return &QuotaSweeper{redis: rdb, interval: interval, logger: logger}
+}
+
+// Run sweeps every interval until ctx is done.
+func (s *QuotaSweeper) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			swept, err := s.Sweep(ctx)
+			if err != nil {
+				s.logger.Error("Quota sweep failed", "error", err)
+				continue
+			}
+			if swept > 0 {
+				s.logger.Info("Quota keys without TTL expired", "keys", swept)
+			}
+		}
+	}
+}
+
+// Sweep sets the TTL of the quota and usage keys that have none, it returns
+// how many it set.
+func (s *QuotaSweeper) Sweep(ctx context.Context) (int, error) {
+	swept := 0
+	for _, policy := range []struct {
+		pattern string
+		ttl     time.Duration
+	}{
+		{"quota:*", QuotaKeyTTL},
+		{"usage:*", UsageKeyTTL},
+	} {
+		var cursor uint64
+		for {
+			keys, next, err := s.redis.Scan(ctx, cursor, policy.pattern, quotaSweepBatch).Result()
+			if err != nil {
+				return swept, fmt.Errorf("Scan: %w", err)
+			}
+			n, err := s.expire(ctx, keys, policy.ttl)
+			swept += n
+			if err != nil {
+				return swept, err
+			}
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+	}
+	quotaSweepMetrics.Add("runs", 1)
+	quotaSweepMetrics.Add("expired", int64(swept))
+	return swept, nil
+}
+
+// expire sets ttl on the keys without one.
+func (s *QuotaSweeper) expire(ctx context.Context, keys []string, ttl time.Duration) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	pipe := s.redis.Pipeline()
+	ttls := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		ttls[i] = pipe.TTL(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("TTL: %w", err)
+	}
+	pipe = s.redis.Pipeline()
+	n := 0
+	for i, key := range keys {
+		// -1 is no TTL, -2 a key gone since the scan
+		if ttls[i].Val() == -1 {
+			pipe.Expire(ctx, key, ttl)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("Expire: %w", err)
+	}
+	return n, nil
+}
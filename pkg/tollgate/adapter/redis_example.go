@@ -8,8 +8,8 @@ import (
 	"strings"
 	"time"
 
-	"httpcache/pkg/dbsqlc"
-	"httpcache/pkg/tollgate"
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -1,9 +1,15 @@
 -- All keys must be explicitly provided for Redis clustering compatibility
 local quotaKey = KEYS[1]    -- Pre-constructed "quota:{apikey}" key
-local usageKey = KEYS[2]   -- Pre-constructed usage buffer key
+local usagePrefix = KEYS[2] -- Pre-constructed usage prefix "usage:{apikey}:{service}"
 local serviceKey = ARGV[1]  -- Service key for hash field
 local amount = tonumber(ARGV[2])  -- Amount to refund
 local timestamp = ARGV[3]
+local quotaTTL = tonumber(ARGV[4])  -- Seconds the quota hash is kept after its last use
+local usageTTL = tonumber(ARGV[5])  -- Seconds the usage buffer is kept until archived
+
+-- Bucket by the Redis clock, the replicas agree on the minute whatever their skew
+local now = redis.call('TIME')
+local usageKey = usagePrefix .. ':' .. (math.floor(tonumber(now[1]) / 60) * 60)
 
 -- Get current quota
 local current = redis.call('HGET', quotaKey, serviceKey)
@@ -17,6 +23,7 @@ local remaining = tonumber(current)
 local newRemaining = remaining + amount
 redis.call('HSET', quotaKey, serviceKey, newRemaining)
 redis.call('HSET', quotaKey, 'last_refund', timestamp)
+redis.call('EXPIRE', quotaKey, quotaTTL)
 
 -- Reduce the usage buffer to correct tracking
 -- Only decrement if buffer exists and has enough to decrement
@@ -28,7 +35,7 @@ if bufferValue ~= false then
 	else
 		-- Buffer has less than refund amount, set to 0
 		redis.call('SET', usageKey, 0)
-		redis.call('EXPIRE', usageKey, 7200) -- Keep TTL
+		redis.call('EXPIRE', usageKey, usageTTL) -- Keep TTL
 	end
 end
 
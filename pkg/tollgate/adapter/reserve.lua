@@ -1,37 +1,41 @@
 -- All keys must be explicitly provided for Redis clustering compatibility
-local quotaKey = KEYS[1]    -- Pre-constructed "quota:{apikey}:{service}" key
-local metricKey = KEYS[2]   -- Pre-constructed usage "usage:{apikey}:{service}"
-local hasQuota = ARGV[1] == "true" -- whether this key has quota
-local amount = tonumber(ARGV[2])  -- Amount to reserve
+local quotaKey = KEYS[1]    -- Pre-constructed "quota:{apikey}" hash, a field per service
+local usagePrefix = KEYS[2] -- Pre-constructed usage prefix "usage:{apikey}:{service}"
+local serviceKey = ARGV[1]  -- Service key for hash field
+local hasQuota = ARGV[2] == "true" -- whether this key has quota
+local amount = tonumber(ARGV[3])  -- Amount to reserve
+local timestamp = ARGV[4]
+local quotaTTL = tonumber(ARGV[5])  -- Seconds the quota hash is kept after its last use
+local usageTTL = tonumber(ARGV[6])  -- Seconds the usage buffer is kept until archived
 
--- Get timestamp from Redis and truncate to 60 seconds (round down to nearest minute)
-local timeResult = redis.call('TIME')
-local timestamp = math.floor(timeResult[1] / 60) * 60
+-- Bucket by the Redis clock, the replicas agree on the minute whatever their skew
+local now = redis.call('TIME')
+local usageKey = usagePrefix .. ':' .. (math.floor(tonumber(now[1]) / 60) * 60)
 
 -- Get current quota only if has_quota is true
 local remaining = -1
 if hasQuota then
-	local current = redis.call('GET', quotaKey)
+	local current = redis.call('HGET', quotaKey, serviceKey)
 	if current == false then
-		return {-1, 'LOAD_REQUIRED'}
+		return {'-1', 'LOAD_REQUIRED'}
 	end
-	
+
 	remaining = tonumber(current)
 	if remaining < amount then
-		return {remaining, 'EXHAUSTED'}
+		return {tostring(remaining), 'EXHAUSTED'}
 	end
-	
-	-- Decrement quota by amount
-	remaining = remaining - amount
-	redis.call('SET', quotaKey, remaining, "EX", 24*60*60) -- 1 day TTL
+
+	-- Decrement quota by amount, the balance is kept as long as it's used
+	remaining = redis.call('HINCRBY', quotaKey, serviceKey, -amount)
+	redis.call('HSET', quotaKey, 'last_used', timestamp)
+	redis.call('EXPIRE', quotaKey, quotaTTL)
 else
 	-- No quota limit - always succeed but track consumption
 	remaining = 999999 -- Unlimited indicator
 end
 
--- Direct aggregation - increment usage buffer with timestamp
-local usageKey = metricKey .. ":" .. timestamp
+-- Direct aggregation - increment usage buffer of the minute
 redis.call('INCRBY', usageKey, amount)
-redis.call('EXPIRE', usageKey, 2*60*60) -- 2 hour TTL
+redis.call('EXPIRE', usageKey, usageTTL)
 
-return {remaining, 'OK'}
+return {tostring(remaining), 'OK'}
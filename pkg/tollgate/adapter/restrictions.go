@@ -0,0 +1,24 @@
+package adapter
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+)
+
+// KeyRestrictions reads the restrictions of the keys from store, for
+// tollgate.WithRestrictions.
+func KeyRestrictions(store MetaStore) func(ctx context.Context, key string) (tollgate.Restrictions, error) {
+	return func(ctx context.Context, key string) (tollgate.Restrictions, error) {
+		keyMeta, err := store.GetKey(ctx, key)
+		if err != nil {
+			return tollgate.Restrictions{}, fmt.Errorf("store.GetKey: %w", err)
+		}
+		restrictions, err := tollgate.ParseRestrictions(keyMeta.AllowedCIDRs, keyMeta.AllowedOrigins)
+		if err != nil {
+			return tollgate.Restrictions{}, fmt.Errorf("key %d: %w", keyMeta.APIKeyID, err)
+		}
+		return restrictions, nil
+	}
+}
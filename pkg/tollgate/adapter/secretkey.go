@@ -3,8 +3,9 @@ package adapter
 import (
 	"context"
 	"fmt"
+	"time"
 
-	"httpcache/pkg/tollgate"
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
 )
 
 // SecretKey is an adapter that validates against a secret key
@@ -41,6 +42,96 @@ func (s *SecretKey) Refund(ctx context.Context, key string, amount int) (bool, e
 	return true, nil
 }
 
+// InternalKey is an adapter letting the internal key through without quota,
+// e.g. for the jobs and the replays, the other keys are reserved from next.
+type InternalKey struct {
+	key  string
+	next tollgate.Adapter
+}
+
+// NewInternalKey creates a new internal key adapter in front of next, an
+// empty key lets nothing through.
+func NewInternalKey(key string, next tollgate.Adapter) tollgate.Adapter {
+	return &InternalKey{key: key, next: next}
+}
+
+// Reserve reserves a given amount of quota for a key, the internal key always gets it.
+func (i *InternalKey) Reserve(ctx context.Context, key string, amount int) (bool, error) {
+	if i.key != "" && key == i.key {
+		return true, nil
+	}
+	return i.next.Reserve(ctx, key, amount)
+}
+
+// Refund refunds a given amount of quota for a key.
+func (i *InternalKey) Refund(ctx context.Context, key string, amount int) (bool, error) {
+	if i.key != "" && key == i.key {
+		return true, nil
+	}
+	return i.next.Refund(ctx, key, amount)
+}
+
+// SupportKey is an adapter charging the requests admins run as another key,
+// see tollgate.WithImpersonated, to the support key, the other requests are
+// charged to their key. The layers above it, e.g. the limits, see the key.
+type SupportKey struct {
+	key  string
+	next tollgate.Adapter
+}
+
+// NewSupportKey creates a new support key adapter in front of next.
+func NewSupportKey(key string, next tollgate.Adapter) tollgate.Adapter {
+	return &SupportKey{key: key, next: next}
+}
+
+// Reserve reserves a given amount of quota for a key, from the support key
+// for the impersonated requests.
+func (s *SupportKey) Reserve(ctx context.Context, key string, amount int) (bool, error) {
+	if tollgate.ImpersonatedFromContext(ctx) != "" {
+		key = s.key
+	}
+	return s.next.Reserve(ctx, key, amount)
+}
+
+// Refund refunds a given amount of quota for a key, to the support key for
+// the impersonated requests.
+func (s *SupportKey) Refund(ctx context.Context, key string, amount int) (bool, error) {
+	if tollgate.ImpersonatedFromContext(ctx) != "" {
+		key = s.key
+	}
+	return s.next.Refund(ctx, key, amount)
+}
+
+// KnownKey is an adapter letting the keys of a MetaStore through without
+// quota, e.g. for the job submissions, charged when the jobs run. Expired
+// keys are refused.
+type KnownKey struct {
+	store MetaStore
+}
+
+// NewKnownKey creates a new known key adapter for the keys of store.
+func NewKnownKey(store MetaStore) tollgate.Adapter {
+	return &KnownKey{store: store}
+}
+
+// Reserve lets the known keys through.
+func (k *KnownKey) Reserve(ctx context.Context, key string, amount int) (bool, error) {
+	keyMeta, err := k.store.GetKey(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("store.GetKey: %w", err)
+	}
+	if keyMeta.Expired(time.Now()) {
+		tollgate.Warn(ctx, "trial key expired")
+		return false, nil
+	}
+	return true, nil
+}
+
+// Refund has nothing to refund.
+func (k *KnownKey) Refund(ctx context.Context, key string, amount int) (bool, error) {
+	return true, nil
+}
+
 // ServiceID returns the service ID this adapter is configured for
 func (s *SecretKey) ServiceID() string {
 	return s.serviceID
@@ -1,45 +1,36 @@
 -- All keys must be explicitly provided for Redis clustering compatibility
-local quotaKey = KEYS[1]    -- Pre-constructed "quota:{apikey}" key
-local usageKey = KEYS[2]   -- Pre-constructed usage buffer key
+local quotaKey = KEYS[1]    -- Pre-constructed "quota:{apikey}" hash, a field per service
+local usagePrefix = KEYS[2] -- Pre-constructed usage prefix "usage:{apikey}:{service}"
 local serviceKey = ARGV[1]  -- Service key for hash field
 local initialQuota = tonumber(ARGV[2])  -- Initial quota amount to set
 local amount = tonumber(ARGV[3])  -- Amount to reserve
 local timestamp = ARGV[4]
+local quotaTTL = tonumber(ARGV[5])  -- Seconds the quota hash is kept after its last use
+local usageTTL = tonumber(ARGV[6])  -- Seconds the usage buffer is kept until archived
 
--- Get current quota
+-- Bucket by the Redis clock, the replicas agree on the minute whatever their skew
+local now = redis.call('TIME')
+local usageKey = usagePrefix .. ':' .. (math.floor(tonumber(now[1]) / 60) * 60)
+
+-- Get current quota, another replica may have loaded it already
 local current = redis.call('HGET', quotaKey, serviceKey)
-if current == false then
-	-- No quota exists, set initial amount
-	if initialQuota < amount then
-		return {tostring(initialQuota), 'EXHAUSTED'}
-	end
-	
-	-- Set initial quota and decrement by amount
-	local remaining = initialQuota - amount
-	redis.call('HSET', quotaKey, serviceKey, remaining)
-	redis.call('HSET', quotaKey, 'last_used', timestamp)
-	redis.call('EXPIRE', quotaKey, 3600) -- 1 hour TTL
-	
-	-- Direct aggregation - increment usage buffer (key pre-constructed by caller)
-	redis.call('INCRBY', usageKey, amount)
-	redis.call('EXPIRE', usageKey, 7200) -- 2 hour TTL
-	
-	return {tostring(remaining), 'OK'}
+local remaining = initialQuota
+if current ~= false then
+	remaining = tonumber(current)
 end
 
--- Quota exists, check if sufficient
-local remaining = tonumber(current)
 if remaining < amount then
 	return {tostring(remaining), 'EXHAUSTED'}
 end
 
--- Decrement quota by amount
+-- Decrement quota by amount, the balance is kept as long as it's used
 remaining = remaining - amount
 redis.call('HSET', quotaKey, serviceKey, remaining)
 redis.call('HSET', quotaKey, 'last_used', timestamp)
+redis.call('EXPIRE', quotaKey, quotaTTL)
 
--- Direct aggregation - increment usage buffer (key pre-constructed by caller)
+-- Direct aggregation - increment usage buffer of the minute
 redis.call('INCRBY', usageKey, amount)
-redis.call('EXPIRE', usageKey, 7200) -- 2 hour TTL
+redis.call('EXPIRE', usageKey, usageTTL)
 
 return {tostring(remaining), 'OK'}
@@ -0,0 +1,18 @@
+-- All keys must be explicitly provided for Redis clustering compatibility
+local budgetsKey = KEYS[1]  -- Pre-constructed "tag_budgets:{service}" hash
+local usageKey = KEYS[2]    -- Pre-constructed "tag_budget_usage:{service}:{tag}" counter
+local tag = ARGV[1]         -- Tag of the request
+local amount = tonumber(ARGV[2])  -- Amount to count against the budget, negative to give it back
+
+local budget = redis.call('HGET', budgetsKey, tag)
+if budget == false then
+	-- Tags without a budget aren't counted
+	return {0, 0, 'NONE'}
+end
+
+budget = tonumber(budget)
+local usage = tonumber(redis.call('GET', usageKey) or '0')
+if amount > 0 and usage + amount > budget then
+	return {usage, budget, 'EXHAUSTED'}
+end
+return {redis.call('INCRBY', usageKey, amount), budget, 'OK'}
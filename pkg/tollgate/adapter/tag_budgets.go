@@ -0,0 +1,169 @@
+package adapter
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// tagBudgetsMetrics are published on /debug/vars under "tag_budgets".
+var tagBudgetsMetrics = expvar.NewMap("tag_budgets")
+
+// ErrInvalidTagBudget is returned for invalid tags and budgets under 1.
+var ErrInvalidTagBudget = errors.New("invalid tag budget")
+
+// TagBudget is the budget of a tag on a service, e.g. the calls an
+// experiment can make, whatever the keys it uses. It doesn't reset, setting
+// it again raises or lowers it.
+type TagBudget struct {
+	Tag    string `json:"tag"`
+	Budget int64  `json:"budget"`
+	Usage  int64  `json:"usage"`
+}
+
+// TagBudgetStore keeps the budgets of the tags and their usage in Redis.
+type TagBudgetStore struct {
+	redis  redis.Cmdable
+	logger *slog.Logger
+}
+
+// NewTagBudgetStore creates a TagBudgetStore.
+func NewTagBudgetStore(rdb redis.Cmdable, logger *slog.Logger) *TagBudgetStore {
+	return &TagBudgetStore{redis: rdb, logger: logger}
+}
+
+func tagBudgetsKey(service string) string {
+	return "tag_budgets:" + service
+}
+
+func tagBudgetUsageKey(service, tag string) string {
+	return fmt.Sprintf("tag_budget_usage:%s:%s", service, tag)
+}
+
+// Set sets the budget of tag on service, its usage so far counts.
+func (s *TagBudgetStore) Set(ctx context.Context, service, tag string, budget int64) error {
+	if !tollgate.ValidTag(tag) {
+		return fmt.Errorf("%w: invalid tag %q", ErrInvalidTagBudget, tag)
+	}
+	if budget < 1 {
+		return fmt.Errorf("%w: the budget must be positive", ErrInvalidTagBudget)
+	}
+	if err := s.redis.HSet(ctx, tagBudgetsKey(service), tag, budget).Err(); err != nil {
+		return fmt.Errorf("HSet: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the budget of tag on service and forgets its usage.
+func (s *TagBudgetStore) Delete(ctx context.Context, service, tag string) error {
+	pipe := s.redis.TxPipeline()
+	pipe.HDel(ctx, tagBudgetsKey(service), tag)
+	pipe.Del(ctx, tagBudgetUsageKey(service, tag))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("HDel: %w", err)
+	}
+	return nil
+}
+
+// List returns the budgets set on service with their usage.
+func (s *TagBudgetStore) List(ctx context.Context, service string) ([]TagBudget, error) {
+	values, err := s.redis.HGetAll(ctx, tagBudgetsKey(service)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("HGetAll: %w", err)
+	}
+	list := make([]TagBudget, 0, len(values))
+	for tag, value := range values {
+		budget, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			s.logger.Warn("Invalid tag budget", "service", service, "tag", tag, "error", err)
+			continue
+		}
+		usage, err := s.redis.Get(ctx, tagBudgetUsageKey(service, tag)).Int64()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, fmt.Errorf("Get: %w", err)
+		}
+		list = append(list, TagBudget{Tag: tag, Budget: budget, Usage: usage})
+	}
+	slices.SortFunc(list, func(a, b TagBudget) int { return strings.Compare(a.Tag, b.Tag) })
+	return list, nil
+}
+
+// Adapter returns next with the budgets of the tags of service enforced.
+func (s *TagBudgetStore) Adapter(service string, next tollgate.Adapter) tollgate.Adapter {
+	return &budgeted{store: s, service: service, next: next}
+}
+
+// budgeted counts the usage of the tags of a service against their budgets,
+// before the reservations of next. Untagged requests go straight to next.
+type budgeted struct {
+	store   *TagBudgetStore
+	service string
+	next    tollgate.Adapter
+}
+
+func (b *budgeted) count(ctx context.Context, tag string, amount int) (usage, budget int64, status string, err error) {
+	keys := []string{tagBudgetsKey(b.service), tagBudgetUsageKey(b.service, tag)}
+	result, err := TagBudgetScript.Run(ctx, b.store.redis, keys, tag, amount).Slice()
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("TagBudgetScript.Run: %w", err)
+	}
+	if len(result) != 3 {
+		return 0, 0, "", fmt.Errorf("TagBudgetScript.Run: expected 3, got %d", len(result))
+	}
+	usage, _ = result[0].(int64)
+	budget, _ = result[1].(int64)
+	status, _ = result[2].(string)
+	return usage, budget, status, nil
+}
+
+// Reserve reserves a given amount of quota for a key.
+// Returns true if the reservation was successful, false if the quota is insufficient.
+func (b *budgeted) Reserve(ctx context.Context, key string, amount int) (bool, error) {
+	tag := tollgate.TagFromContext(ctx)
+	if tag == "" {
+		return b.next.Reserve(ctx, key, amount)
+	}
+	usage, budget, status, err := b.count(ctx, tag, amount)
+	if err != nil {
+		return false, err
+	}
+	if status == "EXHAUSTED" {
+		tagBudgetsMetrics.Add("rejections", 1)
+		tollgate.Warn(ctx, fmt.Sprintf("budget of %d exhausted for tag %s, %d used", budget, tag, usage))
+		return false, nil
+	}
+
+	ok, err := b.next.Reserve(ctx, key, amount)
+	if (err != nil || !ok) && status == "OK" {
+		// the request isn't served, it doesn't count
+		if _, _, _, err := b.count(context.WithoutCancel(ctx), tag, -amount); err != nil {
+			b.store.logger.Error("Failed to give back tag budget", "service", b.service, "tag", tag, "error", err)
+		}
+	}
+	return ok, err
+}
+
+// Refund refunds a given amount of quota for a key.
+// Returns true if the refund was successful, false if the quota is insufficient.
+func (b *budgeted) Refund(ctx context.Context, key string, amount int) (bool, error) {
+	ok, err := b.next.Refund(ctx, key, amount)
+	if err != nil || !ok {
+		return ok, err
+	}
+	if tag := tollgate.TagFromContext(ctx); tag != "" {
+		if _, _, _, err := b.count(ctx, tag, -amount); err != nil {
+			// the refund went through, the usage of the tag is off by amount
+			b.store.logger.Error("Failed to refund tag budget", "service", b.service, "tag", tag, "error", err)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,81 @@
+package adapter
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// TagBudgetsAdmin serves the admin endpoints of the tag budgets, behind adminauth.
+//
+//	curl -X PUT "https://cachev1.example.com/admin/budgets/serper" -H "X-Admin-Key: xxx" \
+//		-d '{"tag": "experiment-foo", "budget": 10000}'
+//	curl "https://cachev1.example.com/admin/budgets/serper" -H "X-Admin-Key: xxx"
+//	curl -X DELETE "https://cachev1.example.com/admin/budgets/serper" -H "X-Admin-Key: xxx" -d '{"tag": "experiment-foo"}'
+type TagBudgetsAdmin struct {
+	store *TagBudgetStore
+}
+
+// NewTagBudgetsAdmin creates a new TagBudgetsAdmin handler set.
+func NewTagBudgetsAdmin(store *TagBudgetStore) *TagBudgetsAdmin {
+	return &TagBudgetsAdmin{store: store}
+}
+
+type tagBudgetRequest struct {
+	Tag    string `json:"tag"`
+	Budget int64  `json:"budget"`
+}
+
+func (a *TagBudgetsAdmin) decode(w http.ResponseWriter, r *http.Request) (tagBudgetRequest, bool) {
+	var req tagBudgetRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return req, false
+	}
+	if req.Tag == "" {
+		http.Error(w, "Missing tag", http.StatusBadRequest)
+		return req, false
+	}
+	return req, true
+}
+
+// List handles GET /admin/budgets/{service}.
+func (a *TagBudgetsAdmin) List(w http.ResponseWriter, r *http.Request) {
+	list, err := a.store.List(r.Context(), r.PathValue("service"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, list)
+}
+
+// Set handles PUT /admin/budgets/{service}.
+func (a *TagBudgetsAdmin) Set(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	err := a.store.Set(r.Context(), r.PathValue("service"), req.Tag, req.Budget)
+	if errors.Is(err, ErrInvalidTagBudget) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, req)
+}
+
+// Delete handles DELETE /admin/budgets/{service}.
+func (a *TagBudgetsAdmin) Delete(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.decode(w, r)
+	if !ok {
+		return
+	}
+	if err := a.store.Delete(r.Context(), r.PathValue("service"), req.Tag); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
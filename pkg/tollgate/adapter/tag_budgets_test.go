@@ -0,0 +1,71 @@
+package adapter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"testing"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+)
+
+func TestTagBudgets(t *testing.T) {
+	rdb, _ := testRedis(t)
+	ctx := context.Background()
+	store := NewTagBudgetStore(rdb, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err := store.Set(ctx, "jina", "experiment-1", 2); err != nil {
+		t.Fatal(err)
+	}
+	next := &balances{balance: map[string]int{"sk-a": 100, "sk-b": 100, "sk-poor": 0}}
+	h := testGate(store.Adapter("jina", next))
+
+	// the budget is the tag's, whatever the keys
+	for i, key := range []string{"sk-a", "sk-b"} {
+		if rec := call(h, key, tollgate.TagHeader, "experiment-1"); rec.Code != http.StatusOK {
+			t.Errorf("request %d of the tag: %d", i+1, rec.Code)
+		}
+	}
+	rec := call(h, "sk-a", tollgate.TagHeader, "experiment-1")
+	if rec.Code != http.StatusPaymentRequired || rec.Header().Get(tollgate.WarningHeader) == "" {
+		t.Errorf("request past the budget of the tag: %d, warning %q", rec.Code, rec.Header().Get(tollgate.WarningHeader))
+	}
+	if next.balance["sk-a"] != 99 {
+		t.Errorf("sk-a was charged %d, want 1: the request past the budget isn't reserved", 100-next.balance["sk-a"])
+	}
+
+	// other tags and untagged requests aren't held by it
+	if rec := call(h, "sk-a", tollgate.TagHeader, "experiment-2"); rec.Code != http.StatusOK {
+		t.Errorf("request of another tag: %d", rec.Code)
+	}
+	if rec := call(h, "sk-a"); rec.Code != http.StatusOK {
+		t.Errorf("untagged request: %d", rec.Code)
+	}
+
+	// raising the budget lets the tag through again, a request refused for
+	// lack of quota gives its share back
+	if err := store.Set(ctx, "jina", "experiment-1", 3); err != nil {
+		t.Fatal(err)
+	}
+	if rec := call(h, "sk-poor", tollgate.TagHeader, "experiment-1"); rec.Code != http.StatusPaymentRequired {
+		t.Errorf("request of a key without quota: %d, want 402", rec.Code)
+	}
+	if rec := call(h, "sk-b", tollgate.TagHeader, "experiment-1"); rec.Code != http.StatusOK {
+		t.Errorf("request within the raised budget: %d", rec.Code)
+	}
+	list, err := store.List(ctx, "jina")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0] != (TagBudget{Tag: "experiment-1", Budget: 3, Usage: 3}) {
+		t.Errorf("budgets %+v", list)
+	}
+
+	if err := store.Set(ctx, "jina", "not a tag", 1); !errors.Is(err, ErrInvalidTagBudget) {
+		t.Errorf("Set of an invalid tag = %v", err)
+	}
+	if err := store.Set(ctx, "jina", "experiment-1", 0); !errors.Is(err, ErrInvalidTagBudget) {
+		t.Errorf("Set of a zero budget = %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package adapter
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TagUsage is the usage of a key under one tag, e.g. an experiment.
+type TagUsage struct {
+	KeyID string `json:"key_id"`
+	// Tag is "" for the requests without X-Usage-Tag
+	Tag   string `json:"tag"`
+	Usage int64  `json:"usage"`
+}
+
+// TagStore counts the daily usage of the keys per tag in Redis, to break
+// the consumption of a key down by experiment.
+type TagStore struct {
+	breakdown
+}
+
+// NewTagStore creates a TagStore.
+func NewTagStore(rdb redis.Cmdable, logger *slog.Logger) *TagStore {
+	return &TagStore{breakdown{redis: rdb, logger: logger, name: "tag", value: tollgate.TagFromContext}}
+}
+
+// Report returns the usage of service per key and tag from one day to
+// another, both included, of the key with the given ID or of all keys when
+// it's empty.
+func (s *TagStore) Report(ctx context.Context, service, id string, from, to time.Time) ([]TagUsage, error) {
+	totals, err := s.totals(ctx, service, id, from, to)
+	if err != nil {
+		return nil, err
+	}
+	report := make([]TagUsage, 0, len(totals))
+	for field, usage := range totals {
+		key, tag, _ := strings.Cut(field, ":")
+		report = append(report, TagUsage{KeyID: key, Tag: tag, Usage: usage})
+	}
+	slices.SortFunc(report, func(a, b TagUsage) int {
+		return cmp.Or(cmp.Compare(a.KeyID, b.KeyID), cmp.Compare(b.Usage, a.Usage), cmp.Compare(a.Tag, b.Tag))
+	})
+	return report, nil
+}
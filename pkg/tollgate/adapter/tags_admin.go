@@ -0,0 +1,53 @@
+package adapter
+
+import (
+	"errors"
+	"net/http"
+)
+
+// TagsAdmin serves the usage reports per tag, behind adminauth. from and to
+// are days, both included, the current month by default. key_id, as listed
+// by the limits, narrows the report to a key.
+//
+//	curl "https://cachev1.example.com/admin/usage/jina/tags?from=2025-01-01&to=2025-01-31&key_id=1a2b3c4d" \
+//		-H "X-Admin-Key: xxx"
+type TagsAdmin struct {
+	store *TagStore
+}
+
+// NewTagsAdmin creates a new TagsAdmin handler set.
+func NewTagsAdmin(store *TagStore) *TagsAdmin {
+	return &TagsAdmin{store: store}
+}
+
+// tagReport is the answer of GET /admin/usage/{service}/tags.
+type tagReport struct {
+	Service string     `json:"service"`
+	From    string     `json:"from"`
+	To      string     `json:"to"`
+	Tags    []TagUsage `json:"tags"`
+}
+
+// Report handles GET /admin/usage/{service}/tags.
+func (a *TagsAdmin) Report(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := reportRange(w, r)
+	if !ok {
+		return
+	}
+	service := r.PathValue("service")
+	tags, err := a.store.Report(r.Context(), service, r.URL.Query().Get("key_id"), from, to)
+	if errors.Is(err, ErrInvalidReportRange) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, tagReport{
+		Service: service,
+		From:    reportDay(from),
+		To:      reportDay(to),
+		Tags:    tags,
+	})
+}
@@ -0,0 +1,87 @@
+package adapter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/tollgate"
+)
+
+// UsageEvent is a single reservation or refund, refunds have a negative amount.
+type UsageEvent struct {
+	Time    time.Time
+	Service string
+	// KeyFingerprint identifies the key without revealing it
+	KeyFingerprint string
+	Amount         int
+	// Outcome tells why the amount was reserved or refunded when it's not a
+	// plain request, e.g. tollgate.OutcomeClientCanceled, or the error code of
+	// the refunds of failed requests, e.g. proxy.ErrorProviderCredits
+	Outcome string
+	// Member is the team member of a shared key, from the X-Member-Id header
+	Member string
+	// OnBehalfOf is the ID of the key an admin ran the request as, the
+	// amount is charged to the support key
+	OnBehalfOf string
+	// Tag is the free-form tag of the request, e.g. an experiment, from the
+	// X-Usage-Tag header
+	Tag string
+}
+
+// UsageSink receives usage events. Record must not block the request.
+type UsageSink interface {
+	Record(event UsageEvent)
+}
+
+// EventRecorder wraps an adapter and records every successful reservation
+// and refund to a UsageSink, per request instead of per minute.
+type EventRecorder struct {
+	next        tollgate.Adapter
+	serviceName string
+	sink        UsageSink
+}
+
+// NewEventRecorder creates a new EventRecorder around next.
+func NewEventRecorder(next tollgate.Adapter, serviceName string, sink UsageSink) tollgate.Adapter {
+	return &EventRecorder{
+		next:        next,
+		serviceName: serviceName,
+		sink:        sink,
+	}
+}
+
+// Reserve reserves a given amount of quota for a key.
+// Returns true if the reservation was successful, false if the quota is insufficient.
+func (e *EventRecorder) Reserve(ctx context.Context, key string, amount int) (bool, error) {
+	ok, err := e.next.Reserve(ctx, key, amount)
+	if err == nil && ok {
+		e.record(ctx, key, amount)
+	}
+	return ok, err
+}
+
+// Refund refunds a given amount of quota for a key.
+// Returns true if the refund was successful, false if the quota is insufficient.
+func (e *EventRecorder) Refund(ctx context.Context, key string, amount int) (bool, error) {
+	ok, err := e.next.Refund(ctx, key, amount)
+	if err == nil && ok {
+		e.record(ctx, key, -amount)
+	}
+	return ok, err
+}
+
+func (e *EventRecorder) record(ctx context.Context, key string, amount int) {
+	sum := sha256.Sum256([]byte(key))
+	e.sink.Record(UsageEvent{
+		Time:           time.Now(),
+		Service:        e.serviceName,
+		KeyFingerprint: hex.EncodeToString(sum[:8]),
+		Amount:         amount,
+		Outcome:        tollgate.OutcomeFromContext(ctx),
+		Member:         tollgate.MemberFromContext(ctx),
+		OnBehalfOf:     tollgate.ImpersonatedFromContext(ctx),
+		Tag:            tollgate.TagFromContext(ctx),
+	})
+}
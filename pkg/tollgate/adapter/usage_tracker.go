@@ -7,29 +7,76 @@ import (
 	"strings"
 	"time"
 
-	"httpcache/pkg/dbsqlc"
+	"github.com/Airren/poorman-httpcache/v2/pkg/dbsqlc"
 
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
 // UsageTracker handles usage data aggregation and flushing to database
 type UsageTracker struct {
-	redis  RedisClient
-	db     *dbsqlc.Queries
-	logger *slog.Logger
+	redis    RedisClient
+	db       *dbsqlc.Queries
+	logger   *slog.Logger
+	clock    Clock
+	interval time.Duration
+}
+
+// UsageTrackerOption configures a UsageTracker.
+type UsageTrackerOption func(*UsageTracker)
+
+// WithUsageClock sets the clock the closed usage buckets are told by, the
+// system one by default.
+func WithUsageClock(clock Clock) UsageTrackerOption {
+	return func(ut *UsageTracker) {
+		ut.clock = clock
+	}
+}
+
+// WithArchiveInterval sets how often Run archives the closed buckets, every
+// minute by default.
+func WithArchiveInterval(interval time.Duration) UsageTrackerOption {
+	return func(ut *UsageTracker) {
+		ut.interval = interval
+	}
 }
 
 // NewUsageTracker creates a new usage tracker without background processing
-func NewUsageTracker(ctx context.Context, redis RedisClient, db *dbsqlc.Queries, logger *slog.Logger) *UsageTracker {
-	return &UsageTracker{
-		redis:  redis,
-		db:     db,
-		logger: logger,
+func NewUsageTracker(ctx context.Context, redis RedisClient, db *dbsqlc.Queries, logger *slog.Logger, opts ...UsageTrackerOption) *UsageTracker {
+	ut := &UsageTracker{
+		redis:    redis,
+		db:       db,
+		logger:   logger,
+		clock:    systemClock{},
+		interval: time.Minute,
 	}
+	for _, opt := range opts {
+		opt(ut)
+	}
+	return ut
 }
 
-// Archive flushes buffered minute aggregations to PostgreSQL
+// Run archives the closed buckets every interval until ctx is done. It
+// runs on the leader only, a bucket is flushed by a single replica.
+func (ut *UsageTracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(ut.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ut.Archive(ctx); err != nil {
+				ut.logger.Error("Usage archive failed", "error", err)
+			}
+		}
+	}
+}
+
+// Archive flushes the closed minute aggregations to PostgreSQL, the buckets
+// still written by a replica are left for the next run so a minute isn't
+// split across runs.
 func (ut *UsageTracker) Archive(ctx context.Context) error {
+	now := ut.clock.Now()
 	pattern := "usage:*"
 	iter := ut.redis.Scan(ctx, 0, pattern, 100).Iterator()
 
@@ -48,6 +95,9 @@ func (ut *UsageTracker) Archive(ctx context.Context) error {
 		if err1 != nil || err2 != nil || err3 != nil {
 			continue
 		}
+		if !bucketClosed(minuteTimestamp, now) {
+			continue
+		}
 
 		// Get and reset the count atomically
 		count, err := ut.redis.GetDel(ctx, key).Int()
@@ -0,0 +1,63 @@
+package tollgate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// PolicyInput is what a policy decides a request on.
+type PolicyInput struct {
+	Service string `json:"service"`
+	Method  string `json:"method"`
+	// Path is the path of the request to the proxy, e.g. "/https://example.com/"
+	Path string `json:"path"`
+	// Target is the URL the request is for, for the providers fetching a
+	// page, e.g. jina and fetch, and TargetHost its host
+	Target     string `json:"target,omitempty"`
+	TargetHost string `json:"target_host,omitempty"`
+	// KeyID is the short key identifier of the admin endpoints and the
+	// request logs, the key itself is never sent
+	KeyID        string `json:"key_id"`
+	Member       string `json:"member,omitempty"`
+	Tag          string `json:"tag,omitempty"`
+	Impersonated bool   `json:"impersonated,omitempty"`
+	// Key is the metadata of the key when the policy has a store of it
+	Key any `json:"key,omitempty"`
+}
+
+// Decision is the answer of a policy.
+type Decision struct {
+	Allow bool `json:"allow"`
+	// Reason tells the client why a request is denied
+	Reason string `json:"reason,omitempty"`
+}
+
+// Policy decides whether a request is allowed, key is the key it's charged to.
+type Policy func(ctx context.Context, key string, input *PolicyInput) (Decision, error)
+
+// WithPolicy rejects the requests policy denies with 403, before anything is
+// reserved, e.g. to keep some members from fetching some domains.
+func WithPolicy(service string, policy Policy) Option {
+	return func(t *Tollgate) {
+		t.service = service
+		t.policy = policy
+	}
+}
+
+// policyInput describes a request of key to a policy.
+func (t *Tollgate) policyInput(r *http.Request, key string) *PolicyInput {
+	sum := sha256.Sum256([]byte(key))
+	input := &PolicyInput{
+		Service:      t.service,
+		Method:       r.Method,
+		Path:         r.URL.Path,
+		KeyID:        hex.EncodeToString(sum[:4]),
+		Member:       MemberFromContext(r.Context()),
+		Tag:          TagFromContext(r.Context()),
+		Impersonated: ImpersonatedFromContext(r.Context()) != "",
+	}
+	input.Target, input.TargetHost = requestTarget(r)
+	return input
+}
@@ -0,0 +1,109 @@
+package tollgate
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Restrictions limit where a key can be used from, so a leaked key doesn't
+// work from anywhere. Empty lists allow anything.
+type Restrictions struct {
+	// CIDRs are the client networks allowed, e.g. "203.0.113.0/24"
+	CIDRs []netip.Prefix
+	// Origins are the web origins allowed, e.g. "https://app.example.com",
+	// "https://*.example.com" allows the subdomains
+	Origins []string
+}
+
+// ParseRestrictions parses the CIDRs and origins of a key. A single address
+// is a CIDR of its own.
+func ParseRestrictions(cidrs, origins []string) (Restrictions, error) {
+	var r Restrictions
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return Restrictions{}, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		r.CIDRs = append(r.CIDRs, prefix.Masked())
+	}
+	for _, origin := range origins {
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return Restrictions{}, fmt.Errorf("invalid origin %q, expected scheme://host[:port]", origin)
+		}
+		r.Origins = append(r.Origins, strings.ToLower(u.Scheme+"://"+u.Host))
+	}
+	return r, nil
+}
+
+// Allows reports whether r comes from an allowed network and origin. The
+// origin is the Origin header, or the origin of the Referer without one.
+func (res Restrictions) Allows(r *http.Request) bool {
+	if len(res.CIDRs) > 0 {
+		addr, ok := clientAddr(r)
+		if !ok || !slices.ContainsFunc(res.CIDRs, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+			return false
+		}
+	}
+	if len(res.Origins) > 0 {
+		origin := requestOrigin(r)
+		if origin == "" || !slices.ContainsFunc(res.Origins, func(allowed string) bool { return originMatches(allowed, origin) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// clientAddr returns the address of the client, the one the server sees.
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+func requestOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+		return strings.ToLower(origin)
+	}
+	referer, err := url.Parse(r.Header.Get("Referer"))
+	if err != nil || referer.Scheme == "" || referer.Host == "" {
+		return ""
+	}
+	return strings.ToLower(referer.Scheme + "://" + referer.Host)
+}
+
+func originMatches(allowed, origin string) bool {
+	if allowed == origin {
+		return true
+	}
+	scheme, host, ok := strings.Cut(allowed, "://*.")
+	if !ok {
+		return false
+	}
+	rest, found := strings.CutPrefix(origin, scheme+"://")
+	return found && strings.HasSuffix(rest, "."+host)
+}
+
+// WithRestrictions rejects the requests of keys used from outside their
+// restrictions with 403, before anything is reserved.
+func WithRestrictions(restrictions func(ctx context.Context, key string) (Restrictions, error)) Option {
+	return func(t *Tollgate) {
+		t.restrictions = restrictions
+	}
+}
@@ -1,14 +1,247 @@
 package tollgate
 
-import "net/http"
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// OutcomeClientCanceled is the outcome of the refunds of requests whose
+// client went away before the answer was complete.
+const OutcomeClientCanceled = "client_canceled"
+
+// OutcomeAccessToken is the outcome of the quota slices reserved for access
+// tokens when they're minted, and refunded unused when they expire.
+const OutcomeAccessToken = "access_token"
+
+// ErrInvalidCredentials is wrapped by the key resolvers for the credentials
+// that aren't valid, e.g. an expired access token. They're answered with 401.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// ErrorCodeHeader carries the normalized code of the error answers, e.g.
+// ErrorQuotaExhausted, the upstream ones are set by proxy.ClassifyErrors.
+// Refunds of failed requests record it as their outcome.
+const ErrorCodeHeader = "X-Error-Code"
+
+// ErrorQuotaExhausted is the code of the answers refused for lack of quota
+// of the key, ours rather than the provider's.
+const ErrorQuotaExhausted = "quota_exhausted"
+
+type outcomeKey struct{}
+
+// WithOutcome returns a context telling the adapters why a reservation is
+// reserved or refunded, e.g. to record it with the usage events.
+func WithOutcome(ctx context.Context, outcome string) context.Context {
+	return context.WithValue(ctx, outcomeKey{}, outcome)
+}
+
+// OutcomeFromContext returns the outcome set by WithOutcome, "" when unset.
+func OutcomeFromContext(ctx context.Context) string {
+	outcome, _ := ctx.Value(outcomeKey{}).(string)
+	return outcome
+}
+
+// WarningHeader carries the warnings of the adapters on the answer, e.g. a
+// key past its soft limit.
+const WarningHeader = "X-Quota-Warning"
+
+type warningsKey struct{}
+
+// Warn adds a warning to the answer of the request being reserved, adapters
+// call it from Reserve.
+func Warn(ctx context.Context, warning string) {
+	if warnings, ok := ctx.Value(warningsKey{}).(*[]string); ok {
+		*warnings = append(*warnings, warning)
+	}
+}
+
+// MemberHeader attributes the usage of a key shared by a team to one of its
+// members. It's optional and isn't forwarded upstream.
+const MemberHeader = "X-Member-Id"
+
+// validMember keeps the member IDs short and safe to store and log.
+var validMember = regexp.MustCompile(`^[A-Za-z0-9._@+-]{1,64}$`)
+
+type memberKey struct{}
+
+// MemberFromContext returns the member the request is attributed to, "" when
+// it has no X-Member-Id header.
+func MemberFromContext(ctx context.Context) string {
+	member, _ := ctx.Value(memberKey{}).(string)
+	return member
+}
+
+// TagHeader tags the usage of a request, e.g. with the experiment it's part
+// of, to break the consumption of a key down. It's optional and isn't
+// forwarded upstream.
+const TagHeader = "X-Usage-Tag"
+
+// validTag keeps the tags short and safe to store and log.
+var validTag = regexp.MustCompile(`^[A-Za-z0-9._/+-]{1,64}$`)
+
+// ValidTag reports whether tag is a valid X-Usage-Tag.
+func ValidTag(tag string) bool {
+	return validTag.MatchString(tag)
+}
+
+type tagKey struct{}
+
+// TagFromContext returns the tag of the request, "" when it has no
+// X-Usage-Tag header.
+func TagFromContext(ctx context.Context) string {
+	tag, _ := ctx.Value(tagKey{}).(string)
+	return tag
+}
+
+type targetHostKey struct{}
+
+// TargetHostFromContext returns the host of the target URL of the request,
+// for the providers fetching a page, e.g. jina and fetch, "" for the others.
+func TargetHostFromContext(ctx context.Context) string {
+	host, _ := ctx.Value(targetHostKey{}).(string)
+	return host
+}
+
+// requestTarget returns the target URL of a request and its host, "" for
+// the requests without one. The page providers take it as the path, behind
+// their prefix, e.g. "/jina/https://example.com/".
+func requestTarget(r *http.Request) (target, host string) {
+	path := r.URL.Path
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	for _, scheme := range []string{"https:/", "http:/"} {
+		i := strings.Index(path, scheme)
+		if i < 0 {
+			continue
+		}
+		target = path[i:]
+		if !strings.HasPrefix(target, scheme+"/") {
+			// the slashes of "https://" were merged in the path
+			target = scheme + "/" + target[len(scheme):]
+		}
+		if u, err := url.Parse(target); err == nil && u.Host != "" {
+			return target, u.Hostname()
+		}
+		return "", ""
+	}
+	return "", ""
+}
+
+// KeyFingerprint identifies a key in logs and metadata without revealing it,
+// the first 4 bytes of its SHA-256 in hex. The key stores find keys by it in
+// SQL too, keep it in step with the GetAPIKeysByFingerprint query.
+func KeyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+// ImpersonateHeader runs a request as the key with this ID, see
+// KeyFingerprint. It's accepted with admin credentials only, by the
+// impersonate package, and the debit of the request is charged to the
+// support key.
+const ImpersonateHeader = "X-Impersonate-Key-Id"
+
+type impersonatedKey struct{}
+
+// impersonation is the key an admin runs a request as.
+type impersonation struct {
+	keyID, key string
+}
+
+// WithImpersonated returns a context of a request an admin runs as key, with
+// the given ID.
+func WithImpersonated(ctx context.Context, keyID, key string) context.Context {
+	return context.WithValue(ctx, impersonatedKey{}, impersonation{keyID: keyID, key: key})
+}
+
+// ImpersonatedFromContext returns the ID of the key an admin runs the request
+// as, "" for the requests of the keys themselves.
+func ImpersonatedFromContext(ctx context.Context) string {
+	impersonated, _ := ctx.Value(impersonatedKey{}).(impersonation)
+	return impersonated.keyID
+}
+
+type backgroundKey struct{}
+
+// WithBackground returns a context of a request run in the background on
+// behalf of key, e.g. a job. It goes through the policy, the limits and the
+// quota of key as its requests do, but not its restrictions, which were
+// checked when it was submitted.
+func WithBackground(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, backgroundKey{}, key)
+}
 
 type Tollgate struct {
 	extractKey func(r *http.Request) string
 	adapter    Adapter
+	cost       func(r *http.Request) int
+	usage      func(header http.Header, body []byte) (int, bool)
+	// resolveKey resolves the credentials to the keys they were issued from when set
+	resolveKey func(ctx context.Context, credential string) (string, context.Context, error)
+	// restrictions limit where keys can be used from when set
+	restrictions func(ctx context.Context, key string) (Restrictions, error)
+	// supportKey is charged the debit of the impersonated requests
+	supportKey string
+	// policy decides whether the requests of service are allowed when set
+	service string
+	policy  Policy
+}
+
+// Option configures a Tollgate.
+type Option func(t *Tollgate)
+
+// WithCost sets the amount reserved for a request, 1 by default. For LLM
+// routes it's an estimate of the tokens the request uses.
+func WithCost(cost func(r *http.Request) int) Option {
+	return func(t *Tollgate) {
+		t.cost = cost
+	}
 }
 
-func New(adapter Adapter, keyFunc func(r *http.Request) string) *Tollgate {
-	return &Tollgate{adapter: adapter, extractKey: keyFunc}
+// WithUsage reconciles the reservation with the actual usage read from a
+// successful answer, e.g. the usage field of LLM providers. The difference
+// is reserved or refunded. Answers without usage keep the reservation.
+func WithUsage(usage func(header http.Header, body []byte) (int, bool)) Option {
+	return func(t *Tollgate) {
+		t.usage = usage
+	}
+}
+
+// WithSupportKey enables the requests admins run as another key, see
+// WithImpersonated. They go through the policy and the limits of the key,
+// but not its restrictions, the admins aren't where the key is used from;
+// the adapter charges their debit to key, the budget of the support team,
+// see adapter.NewSupportKey. Impersonated requests are rejected without one.
+func WithSupportKey(key string) Option {
+	return func(t *Tollgate) {
+		t.supportKey = key
+	}
+}
+
+// WithKeyResolver resolves the credentials of the requests, e.g. access
+// tokens, to the keys they were issued from, and returns the context of the
+// request. The restrictions, the policy and the adapter see the key; the
+// adapter can tell the credential from the context. Plain keys are returned
+// as they are.
+func WithKeyResolver(resolve func(ctx context.Context, credential string) (string, context.Context, error)) Option {
+	return func(t *Tollgate) {
+		t.resolveKey = resolve
+	}
+}
+
+func New(adapter Adapter, keyFunc func(r *http.Request) string, opts ...Option) *Tollgate {
+	t := &Tollgate{adapter: adapter, extractKey: keyFunc}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
 }
 
 func (t *Tollgate) HTTPHandlerMiddleware(next http.Handler) http.Handler {
@@ -34,30 +267,174 @@ func (w *statusCapturingWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
+// maxUsageBody caps the answer kept to read the usage from.
+const maxUsageBody = 1 << 20
+
+// usageCapturingWriter keeps the answer for the usage function. The usage is
+// at the end of streamed answers, so the tail is kept past the cap.
+type usageCapturingWriter struct {
+	*statusCapturingWriter
+	body []byte
+}
+
+func (w *usageCapturingWriter) Write(b []byte) (int, error) {
+	w.body = append(w.body, b[max(0, len(b)-maxUsageBody):]...)
+	// the tail is moved to the front once per maxUsageBody bytes written, not
+	// on every write
+	if len(w.body) > 2*maxUsageBody {
+		w.body = append(w.body[:0], w.body[len(w.body)-maxUsageBody:]...)
+	}
+	return w.statusCapturingWriter.Write(b)
+}
+
+// tail returns the last maxUsageBody bytes of the answer.
+func (w *usageCapturingWriter) tail() []byte {
+	return w.body[max(0, len(w.body)-maxUsageBody):]
+}
+
 func (h *tollgateHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Context().Err() != nil {
+		// the client went away before anything was reserved
+		return
+	}
+	if member := r.Header.Get(MemberHeader); member != "" {
+		if !validMember.MatchString(member) {
+			http.Error(w, "Invalid "+MemberHeader, http.StatusBadRequest)
+			return
+		}
+		r.Header.Del(MemberHeader)
+		r = r.WithContext(context.WithValue(r.Context(), memberKey{}, member))
+	}
+	if tag := r.Header.Get(TagHeader); tag != "" {
+		if !validTag.MatchString(tag) {
+			http.Error(w, "Invalid "+TagHeader, http.StatusBadRequest)
+			return
+		}
+		r.Header.Del(TagHeader)
+		r = r.WithContext(context.WithValue(r.Context(), tagKey{}, tag))
+	}
+	if _, host := requestTarget(r); host != "" {
+		r = r.WithContext(context.WithValue(r.Context(), targetHostKey{}, host))
+	}
 	key := h.client.extractKey(r)
-	reserved, err := h.client.adapter.Reserve(r.Context(), key, 1)
+	impersonated, _ := r.Context().Value(impersonatedKey{}).(impersonation)
+	background, _ := r.Context().Value(backgroundKey{}).(string)
+	switch {
+	case impersonated.keyID != "":
+		if h.client.supportKey == "" {
+			http.Error(w, "Impersonation is disabled", http.StatusForbidden)
+			return
+		}
+		key = impersonated.key
+	case background != "":
+		key = background
+	case h.client.resolveKey != nil && key != "":
+		resolved, ctx, err := h.client.resolveKey(r.Context(), key)
+		switch {
+		case errors.Is(err, ErrInvalidCredentials):
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		key = resolved
+		r = r.WithContext(ctx)
+	}
+	if h.client.restrictions != nil && impersonated.keyID == "" && background == "" {
+		restrictions, err := h.client.restrictions(r.Context(), key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !restrictions.Allows(r) {
+			http.Error(w, "Key not allowed from this network or origin", http.StatusForbidden)
+			return
+		}
+	}
+	if h.client.policy != nil {
+		decision, err := h.client.policy(r.Context(), key, h.client.policyInput(r, key))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !decision.Allow {
+			http.Error(w, cmp.Or(decision.Reason, "Denied by policy"), http.StatusForbidden)
+			return
+		}
+	}
+	amount := 1
+	if h.client.cost != nil {
+		amount = max(h.client.cost(r), 1)
+	}
+	var warnings []string
+	reserved, err := h.client.adapter.Reserve(context.WithValue(r.Context(), warningsKey{}, &warnings), key, amount)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	for _, warning := range warnings {
+		w.Header().Add(WarningHeader, warning)
+	}
 
 	if !reserved {
+		w.Header().Set(ErrorCodeHeader, ErrorQuotaExhausted)
 		http.Error(w, "Insufficient balance", http.StatusPaymentRequired)
 		return
 	}
 
+	// Refund the whole reservation when the client went away, the upstream
+	// request was aborted with its context. The proxy aborts answers the
+	// client left halfway with a panic, hence the defer.
+	settled := false
+	defer func() {
+		if !settled && r.Context().Err() != nil {
+			ctx := WithOutcome(context.WithoutCancel(r.Context()), OutcomeClientCanceled)
+			_, _ = h.client.adapter.Refund(ctx, key, amount)
+		}
+	}()
+
 	// Wrap the ResponseWriter to capture the status code
 	wrapper := &statusCapturingWriter{ResponseWriter: w, statusCode: http.StatusOK}
-	h.next.ServeHTTP(wrapper, r)
+	var captured *usageCapturingWriter
+	if h.client.usage != nil {
+		captured = &usageCapturingWriter{statusCapturingWriter: wrapper}
+		h.next.ServeHTTP(captured, r)
+	} else {
+		h.next.ServeHTTP(wrapper, r)
+	}
 
-	// Refund reserved quota if the request failed (status code >= 400)
+	if r.Context().Err() != nil {
+		return
+	}
+	settled = true
+	// Refund reserved quota if the request failed (status code >= 400), with
+	// the code of the error as outcome
 	if wrapper.statusCode >= 400 {
-		if _, err := h.client.adapter.Refund(r.Context(), key, 1); err != nil {
+		ctx := r.Context()
+		if code := wrapper.Header().Get(ErrorCodeHeader); code != "" {
+			ctx = WithOutcome(ctx, code)
+		}
+		if _, err := h.client.adapter.Refund(ctx, key, amount); err != nil {
 			// Log the refund error but don't fail the request
 			// The request has already been processed
 			_ = err // Acknowledge the error but continue
 		}
+		return
+	}
+	// If successful (status < 400), keep the reserved quota, settled to the actual usage when known
+	if captured == nil {
+		return
+	}
+	used, ok := h.client.usage(wrapper.Header(), captured.tail())
+	if !ok {
+		return
+	}
+	switch {
+	case used > amount:
+		// the answer was already served, an overage the quota can't cover is let go
+		_, _ = h.client.adapter.Reserve(r.Context(), key, used-amount)
+	case used < amount:
+		_, _ = h.client.adapter.Refund(r.Context(), key, amount-used)
 	}
-	// If successful (status < 400), keep the reserved quota (do nothing)
 }
@@ -0,0 +1,19 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package upgrade
+
+import (
+	"syscall"
+)
+
+// reusePortControl sets SO_REUSEPORT, so the next version can bind the port
+// while this one still serves.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+	if controlErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); controlErr != nil {
+		return controlErr
+	}
+	return err
+}
@@ -0,0 +1,6 @@
+//go:build linux && !(mips || mipsle || mips64 || mips64le)
+
+package upgrade
+
+// soReusePort is SO_REUSEPORT, syscall only has it on a few architectures.
+const soReusePort = 0xf
@@ -0,0 +1,227 @@
+// Package upgrade replaces the running binary without dropping connections,
+// for single-host deployments.
+//
+// On Upgrade the process starts its executable again and hands it the
+// listening socket. The new process serves on the same socket and reports
+// ready once it's up, then the old one stops accepting and drains its
+// in-flight requests. The old process keeps serving when the new one fails
+// to start or to get ready in time.
+//
+//	kill -HUP $(cat /run/cachev1.pid)
+//
+// The new process is a child of the old one, so a supervisor following the
+// PID has to read the PID file, written on Ready. Alternatively, with
+// SO_REUSEPORT both versions bind the port at once: start the new one, then
+// send SIGTERM to the old one.
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The environment of the new process, the files it inherits.
+const (
+	listenerFDEnv = "UPGRADE_LISTENER_FD"
+	readyFDEnv    = "UPGRADE_READY_FD"
+)
+
+var metrics = expvar.NewMap("upgrade")
+
+// ErrInProgress is returned by Upgrade while another upgrade runs.
+var ErrInProgress = errors.New("upgrade in progress")
+
+// Upgrader hands the listener of a process over to its next version.
+type Upgrader struct {
+	pidFile string
+	logger  *slog.Logger
+
+	listener *net.TCPListener
+	// ready is the pipe to the parent, nil without one
+	ready    *os.File
+	draining atomic.Bool
+	mu       sync.Mutex
+}
+
+// New creates a new Upgrader, pidFile is written on Ready when not empty.
+func New(pidFile string, logger *slog.Logger) *Upgrader {
+	return &Upgrader{pidFile: pidFile, logger: logger}
+}
+
+// Listen returns the listener inherited from the previous version, or a new
+// one on addr. reusePort sets SO_REUSEPORT on a new listener.
+func (u *Upgrader) Listen(addr string, reusePort bool) (net.Listener, error) {
+	if fd := os.Getenv(listenerFDEnv); fd != "" {
+		f, err := inherit(fd, "listener")
+		if err != nil {
+			return nil, err
+		}
+		ln, err := net.FileListener(f)
+		// the listener holds its own copy
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("net.FileListener: %w", err)
+		}
+		tcp, ok := ln.(*net.TCPListener)
+		if !ok {
+			return nil, fmt.Errorf("inherited listener is a %T, expected TCP", ln)
+		}
+		if fd := os.Getenv(readyFDEnv); fd != "" {
+			if u.ready, err = inherit(fd, "ready"); err != nil {
+				return nil, err
+			}
+		}
+		os.Unsetenv(listenerFDEnv)
+		os.Unsetenv(readyFDEnv)
+		u.listener = tcp
+		u.logger.Info("Inherited listener from the previous version", "addr", tcp.Addr().String(), "parent", os.Getppid())
+		return tcp, nil
+	}
+
+	lc := net.ListenConfig{}
+	if reusePort {
+		lc.Control = reusePortControl
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("net.Listen: %w", err)
+	}
+	u.listener = ln.(*net.TCPListener)
+	return ln, nil
+}
+
+// inherit opens the file descriptor fd passed by the previous version.
+func inherit(fd, name string) (*os.File, error) {
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s file descriptor %q: %w", name, fd, err)
+	}
+	f := os.NewFile(uintptr(n), name)
+	if f == nil {
+		return nil, fmt.Errorf("invalid %s file descriptor %d", name, n)
+	}
+	return f, nil
+}
+
+// Ready reports the process ready to serve, to the previous version when
+// there's one, and writes the PID file. It's called once the server runs.
+func (u *Upgrader) Ready() error {
+	if u.pidFile != "" {
+		// rename keeps the file whole for the supervisor reading it
+		tmp := u.pidFile + ".tmp"
+		if err := os.WriteFile(tmp, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+			return fmt.Errorf("os.WriteFile: %w", err)
+		}
+		if err := os.Rename(tmp, u.pidFile); err != nil {
+			return fmt.Errorf("os.Rename: %w", err)
+		}
+	}
+	if u.ready == nil {
+		return nil
+	}
+	defer func() {
+		u.ready.Close()
+		u.ready = nil
+	}()
+	if _, err := u.ready.Write([]byte{1}); err != nil {
+		return fmt.Errorf("notify the previous version: %w", err)
+	}
+	return nil
+}
+
+// Upgrade starts the next version on the listener and waits up to timeout
+// for it to get ready. On success the caller shuts its server down, the next
+// version keeps serving; on error it keeps serving itself.
+func (u *Upgrader) Upgrade(ctx context.Context, timeout time.Duration) error {
+	if !u.mu.TryLock() {
+		return ErrInProgress
+	}
+	defer u.mu.Unlock()
+	if u.listener == nil {
+		return errors.New("no listener to hand over")
+	}
+	metrics.Add("attempts", 1)
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("os.Executable: %w", err)
+	}
+	listener, err := u.listener.File()
+	if err != nil {
+		return fmt.Errorf("listener.File: %w", err)
+	}
+	defer listener.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("os.Pipe: %w", err)
+	}
+	defer readyR.Close()
+
+	// ExtraFiles start at file descriptor 3
+	env := append(os.Environ(), listenerFDEnv+"=3", readyFDEnv+"=4")
+	proc, err := os.StartProcess(executable, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, listener, readyW},
+	})
+	readyW.Close()
+	if err != nil {
+		metrics.Add("failures", 1)
+		return fmt.Errorf("os.StartProcess: %w", err)
+	}
+	u.logger.Info("Started the next version, waiting for it to get ready", "pid", proc.Pid, "executable", executable)
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		// EOF when the next version exits before getting ready
+		_, err := readyR.Read(b)
+		ready <- err
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err = <-ready:
+	case <-timer.C:
+		err = fmt.Errorf("not ready after %s", timeout)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		metrics.Add("failures", 1)
+		// the next version is of no use without the handover
+		_ = proc.Kill()
+		_, _ = proc.Wait()
+		return fmt.Errorf("next version (pid %d): %w", proc.Pid, err)
+	}
+	u.logger.Info("Next version is ready, draining", "pid", proc.Pid)
+	// the next version outlives this one
+	_ = proc.Release()
+	metrics.Add("handovers", 1)
+	u.draining.Store(true)
+	return nil
+}
+
+// Drain marks the process as draining, e.g. on SIGTERM, for Readiness.
+func (u *Upgrader) Drain() {
+	u.draining.Store(true)
+}
+
+// Readiness handles GET /readyz, 503 once the process drains so load
+// balancers stop sending it requests.
+func (u *Upgrader) Readiness(w http.ResponseWriter, r *http.Request) {
+	if u.draining.Load() {
+		http.Error(w, "Draining", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("OK"))
+}
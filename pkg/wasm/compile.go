@@ -0,0 +1,236 @@
+package wasm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// instr is a decoded instruction, its immediates are resolved ahead of
+// execution: the branch targets of blocks are instruction indices.
+type instr struct {
+	op uint16
+	// a is the index immediate: a local, global, function, label depth,
+	// memory offset, or the end (block) or else (if) of a block
+	a uint32
+	// b packs the arity of blocks, params<<16 | results
+	b uint32
+	// c is the constant of const instructions and the end of if blocks
+	c uint64
+}
+
+// Opcodes of the 0xFC prefix are stored as 0x100+subopcode.
+const prefixFC = 0x100
+
+// blockType reads the type of a block, its params and results count.
+func (m *Module) blockType(r *reader) (params, results uint32, err error) {
+	if r.pos < len(r.b) {
+		switch c := r.b[r.pos]; {
+		case c == 0x40:
+			r.pos++
+			return 0, 0, nil
+		case c == I32 || c == I64 || c == F32 || c == F64 || c == funcref || c == externref:
+			r.pos++
+			return 0, 1, nil
+		}
+	}
+	index, err := r.sleb(33)
+	if err != nil {
+		return 0, 0, err
+	}
+	if index < 0 || int(index) >= len(m.types) {
+		return 0, 0, fmt.Errorf("unknown block type %d", index)
+	}
+	t := m.types[index]
+	return uint32(len(t.Params)), uint32(len(t.Results)), nil
+}
+
+// compileBody decodes the locals and instructions of a function body.
+func (m *Module) compileBody(f *function, body []byte) error {
+	r := &reader{b: body}
+	groups, err := r.u32()
+	if err != nil {
+		return err
+	}
+	total := 0
+	for range groups {
+		n, err := r.u32()
+		if err != nil {
+			return err
+		}
+		typ, err := r.byte()
+		if err != nil {
+			return err
+		}
+		if total += int(n); total > 50000 {
+			return errors.New("too many locals")
+		}
+		for range n {
+			f.locals = append(f.locals, typ)
+		}
+	}
+
+	// control holds the open blocks, -1 is the function body
+	control := []int{-1}
+	for r.pos < len(r.b) {
+		op, err := r.byte()
+		if err != nil {
+			return err
+		}
+		in := instr{op: uint16(op)}
+		switch op {
+		case 0x02, 0x03, 0x04:
+			params, results, err := m.blockType(r)
+			if err != nil {
+				return err
+			}
+			in.b = params<<16 | results
+			control = append(control, len(f.code))
+		case 0x05:
+			if len(control) < 2 || f.code[control[len(control)-1]].op != 0x04 {
+				return errors.New("else without if")
+			}
+			f.code[control[len(control)-1]].a = uint32(len(f.code))
+		case 0x0B:
+			start := control[len(control)-1]
+			control = control[:len(control)-1]
+			end := uint32(len(f.code))
+			if start >= 0 {
+				block := &f.code[start]
+				switch block.op {
+				case 0x02:
+					block.a = end
+				case 0x04:
+					block.c = uint64(end)
+					if block.a == 0 {
+						block.a = end
+					} else {
+						// the then branch jumps from the else to the end
+						f.code[block.a].a = end
+					}
+				}
+			}
+			if len(control) == 0 {
+				f.code = append(f.code, in)
+				if r.pos != len(r.b) {
+					return errors.New("code after the end of the function")
+				}
+				return nil
+			}
+		case 0x0C, 0x0D, 0x10, 0x20, 0x21, 0x22, 0x23, 0x24, 0x25, 0x26, 0xD2:
+			if in.a, err = r.u32(); err != nil {
+				return err
+			}
+		case 0x0E:
+			targets, err := decodeVec(r, (*reader).u32)
+			if err != nil {
+				return err
+			}
+			fallback, err := r.u32()
+			if err != nil {
+				return err
+			}
+			in.c = uint64(len(m.brTables))
+			m.brTables = append(m.brTables, append(targets, fallback))
+		case 0x11:
+			if in.a, err = r.u32(); err != nil {
+				return err
+			}
+			if int(in.a) >= len(m.types) {
+				return fmt.Errorf("call_indirect: unknown type %d", in.a)
+			}
+			if _, err := r.u32(); err != nil {
+				return err
+			}
+		case 0x1C:
+			if _, err := r.valueTypes(); err != nil {
+				return err
+			}
+			in.op = 0x1B
+		case 0x3F, 0x40:
+			if _, err := r.byte(); err != nil {
+				return err
+			}
+		case 0x41:
+			v, err := r.sleb(32)
+			if err != nil {
+				return err
+			}
+			in.c = uint64(uint32(v))
+		case 0x42:
+			v, err := r.sleb(64)
+			if err != nil {
+				return err
+			}
+			in.c = uint64(v)
+		case 0x43:
+			b, err := r.bytes(4)
+			if err != nil {
+				return err
+			}
+			in.c = uint64(binary.LittleEndian.Uint32(b))
+		case 0x44:
+			b, err := r.bytes(8)
+			if err != nil {
+				return err
+			}
+			in.c = binary.LittleEndian.Uint64(b)
+		case 0xD0:
+			if _, err := r.byte(); err != nil {
+				return err
+			}
+			in.c = math.MaxUint64
+		case 0xFC:
+			sub, err := r.u32()
+			if err != nil {
+				return err
+			}
+			in.op = prefixFC + uint16(sub)
+			switch sub {
+			case 0, 1, 2, 3, 4, 5, 6, 7:
+			case 8:
+				if in.a, err = r.u32(); err != nil {
+					return err
+				}
+				if _, err := r.byte(); err != nil {
+					return err
+				}
+			case 9:
+				if in.a, err = r.u32(); err != nil {
+					return err
+				}
+			case 10:
+				if _, err := r.bytes(2); err != nil {
+					return err
+				}
+			case 11:
+				if _, err := r.byte(); err != nil {
+					return err
+				}
+			case 16:
+				if _, err := r.u32(); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("unsupported instruction 0xfc %d", sub)
+			}
+		default:
+			switch {
+			case op >= 0x28 && op <= 0x3E:
+				if _, err := r.u32(); err != nil {
+					return err
+				}
+				if in.a, err = r.u32(); err != nil {
+					return err
+				}
+			case op == 0x00 || op == 0x01 || op == 0x0F || op == 0x1A || op == 0x1B || op == 0xD1:
+			case op >= 0x45 && op <= 0xC4:
+			default:
+				return fmt.Errorf("unsupported instruction 0x%02x", op)
+			}
+		}
+		f.code = append(f.code, in)
+	}
+	return errors.New("function without end")
+}
@@ -0,0 +1,753 @@
+package wasm
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// run executes the body of f, its locals start at base of the stack.
+func (in *Instance) run(f *function, base int) {
+	code := f.code
+	st := in.stack
+	mem := in.memory
+	le := binary.LittleEndian
+	for pc := 0; pc < len(code); pc++ {
+		ins := &code[pc]
+		if in.fuel--; in.fuel&0xFFFF == 0 {
+			in.budget()
+		}
+		n := len(st)
+		switch ins.op {
+		// control
+		case 0x00:
+			trap("unreachable")
+		case 0x01:
+		case 0x02:
+			params := int(ins.b >> 16)
+			in.labels = append(in.labels, label{cont: int(ins.a) + 1, height: n - params, arity: int(ins.b & 0xFFFF)})
+		case 0x03:
+			params := int(ins.b >> 16)
+			in.labels = append(in.labels, label{cont: pc + 1, height: n - params, arity: params, loop: true})
+		case 0x04:
+			cond := uint32(st[n-1])
+			st = st[:n-1]
+			params := int(ins.b >> 16)
+			in.labels = append(in.labels, label{cont: int(ins.c) + 1, height: n - 1 - params, arity: int(ins.b & 0xFFFF)})
+			if cond == 0 {
+				if uint64(ins.a) == ins.c {
+					// no else, the end pops the label
+					pc = int(ins.a) - 1
+				} else {
+					pc = int(ins.a)
+				}
+			}
+		case 0x05:
+			pc = int(ins.a) - 1
+		case 0x0B:
+			in.labels = in.labels[:len(in.labels)-1]
+		case 0x0C:
+			st, pc = in.branch(st, ins.a)
+			pc--
+		case 0x0D:
+			cond := uint32(st[n-1])
+			st = st[:n-1]
+			if cond != 0 {
+				st, pc = in.branch(st, ins.a)
+				pc--
+			}
+		case 0x0E:
+			i := uint32(st[n-1])
+			st = st[:n-1]
+			targets := in.module.brTables[ins.c]
+			depth := targets[len(targets)-1]
+			if int(i) < len(targets)-1 {
+				depth = targets[i]
+			}
+			st, pc = in.branch(st, depth)
+			pc--
+		case 0x0F:
+			in.stack = st
+			return
+		case 0x10:
+			in.stack = st
+			in.call(ins.a)
+			st, mem = in.stack, in.memory
+		case 0x11:
+			callee := in.indirect(st[n-1], ins.a)
+			in.stack = st[:n-1]
+			in.call(callee)
+			st, mem = in.stack, in.memory
+
+		// parametric
+		case 0x1A:
+			st = st[:n-1]
+		case 0x1B:
+			if uint32(st[n-1]) == 0 {
+				st[n-3] = st[n-2]
+			}
+			st = st[:n-2]
+
+		// variables
+		case 0x20:
+			st = append(st, st[base+int(ins.a)])
+		case 0x21:
+			st[base+int(ins.a)] = st[n-1]
+			st = st[:n-1]
+		case 0x22:
+			st[base+int(ins.a)] = st[n-1]
+		case 0x23:
+			st = append(st, in.globals[ins.a])
+		case 0x24:
+			in.globals[ins.a] = st[n-1]
+			st = st[:n-1]
+		case 0x25:
+			i := uint32(st[n-1])
+			if uint64(i) >= uint64(len(in.table)) {
+				trap("out of bounds table access")
+			}
+			st[n-1] = funcRef(in.table[i])
+		case 0x26:
+			i := uint32(st[n-2])
+			if uint64(i) >= uint64(len(in.table)) {
+				trap("out of bounds table access")
+			}
+			in.table[i] = int32(st[n-1])
+			if st[n-1] == math.MaxUint64 {
+				in.table[i] = -1
+			}
+			st = st[:n-2]
+
+		// memory
+		case 0x28:
+			ea := address(mem, st[n-1], ins.a, 4)
+			st[n-1] = uint64(le.Uint32(mem[ea:]))
+		case 0x29:
+			ea := address(mem, st[n-1], ins.a, 8)
+			st[n-1] = le.Uint64(mem[ea:])
+		case 0x2A:
+			ea := address(mem, st[n-1], ins.a, 4)
+			st[n-1] = uint64(le.Uint32(mem[ea:]))
+		case 0x2B:
+			ea := address(mem, st[n-1], ins.a, 8)
+			st[n-1] = le.Uint64(mem[ea:])
+		case 0x2C:
+			ea := address(mem, st[n-1], ins.a, 1)
+			st[n-1] = uint64(uint32(int32(int8(mem[ea]))))
+		case 0x2D:
+			ea := address(mem, st[n-1], ins.a, 1)
+			st[n-1] = uint64(mem[ea])
+		case 0x2E:
+			ea := address(mem, st[n-1], ins.a, 2)
+			st[n-1] = uint64(uint32(int32(int16(le.Uint16(mem[ea:])))))
+		case 0x2F:
+			ea := address(mem, st[n-1], ins.a, 2)
+			st[n-1] = uint64(le.Uint16(mem[ea:]))
+		case 0x30:
+			ea := address(mem, st[n-1], ins.a, 1)
+			st[n-1] = uint64(int64(int8(mem[ea])))
+		case 0x31:
+			ea := address(mem, st[n-1], ins.a, 1)
+			st[n-1] = uint64(mem[ea])
+		case 0x32:
+			ea := address(mem, st[n-1], ins.a, 2)
+			st[n-1] = uint64(int64(int16(le.Uint16(mem[ea:]))))
+		case 0x33:
+			ea := address(mem, st[n-1], ins.a, 2)
+			st[n-1] = uint64(le.Uint16(mem[ea:]))
+		case 0x34:
+			ea := address(mem, st[n-1], ins.a, 4)
+			st[n-1] = uint64(int64(int32(le.Uint32(mem[ea:]))))
+		case 0x35:
+			ea := address(mem, st[n-1], ins.a, 4)
+			st[n-1] = uint64(le.Uint32(mem[ea:]))
+		case 0x36, 0x38, 0x3E:
+			ea := address(mem, st[n-2], ins.a, 4)
+			le.PutUint32(mem[ea:], uint32(st[n-1]))
+			st = st[:n-2]
+		case 0x37, 0x39:
+			ea := address(mem, st[n-2], ins.a, 8)
+			le.PutUint64(mem[ea:], st[n-1])
+			st = st[:n-2]
+		case 0x3A, 0x3C:
+			ea := address(mem, st[n-2], ins.a, 1)
+			mem[ea] = byte(st[n-1])
+			st = st[:n-2]
+		case 0x3B, 0x3D:
+			ea := address(mem, st[n-2], ins.a, 2)
+			le.PutUint16(mem[ea:], uint16(st[n-1]))
+			st = st[:n-2]
+		case 0x3F:
+			st = append(st, uint64(len(mem)/pageSize))
+		case 0x40:
+			st[n-1] = uint64(in.grow(uint32(st[n-1])))
+			mem = in.memory
+
+		// constants
+		case 0x41, 0x42, 0x43, 0x44:
+			st = append(st, ins.c)
+
+		// i32 comparisons
+		case 0x45:
+			st[n-1] = b2u(uint32(st[n-1]) == 0)
+		case 0x46:
+			st[n-2] = b2u(uint32(st[n-2]) == uint32(st[n-1]))
+			st = st[:n-1]
+		case 0x47:
+			st[n-2] = b2u(uint32(st[n-2]) != uint32(st[n-1]))
+			st = st[:n-1]
+		case 0x48:
+			st[n-2] = b2u(int32(st[n-2]) < int32(st[n-1]))
+			st = st[:n-1]
+		case 0x49:
+			st[n-2] = b2u(uint32(st[n-2]) < uint32(st[n-1]))
+			st = st[:n-1]
+		case 0x4A:
+			st[n-2] = b2u(int32(st[n-2]) > int32(st[n-1]))
+			st = st[:n-1]
+		case 0x4B:
+			st[n-2] = b2u(uint32(st[n-2]) > uint32(st[n-1]))
+			st = st[:n-1]
+		case 0x4C:
+			st[n-2] = b2u(int32(st[n-2]) <= int32(st[n-1]))
+			st = st[:n-1]
+		case 0x4D:
+			st[n-2] = b2u(uint32(st[n-2]) <= uint32(st[n-1]))
+			st = st[:n-1]
+		case 0x4E:
+			st[n-2] = b2u(int32(st[n-2]) >= int32(st[n-1]))
+			st = st[:n-1]
+		case 0x4F:
+			st[n-2] = b2u(uint32(st[n-2]) >= uint32(st[n-1]))
+			st = st[:n-1]
+
+		// i64 comparisons
+		case 0x50:
+			st[n-1] = b2u(st[n-1] == 0)
+		case 0x51:
+			st[n-2] = b2u(st[n-2] == st[n-1])
+			st = st[:n-1]
+		case 0x52:
+			st[n-2] = b2u(st[n-2] != st[n-1])
+			st = st[:n-1]
+		case 0x53:
+			st[n-2] = b2u(int64(st[n-2]) < int64(st[n-1]))
+			st = st[:n-1]
+		case 0x54:
+			st[n-2] = b2u(st[n-2] < st[n-1])
+			st = st[:n-1]
+		case 0x55:
+			st[n-2] = b2u(int64(st[n-2]) > int64(st[n-1]))
+			st = st[:n-1]
+		case 0x56:
+			st[n-2] = b2u(st[n-2] > st[n-1])
+			st = st[:n-1]
+		case 0x57:
+			st[n-2] = b2u(int64(st[n-2]) <= int64(st[n-1]))
+			st = st[:n-1]
+		case 0x58:
+			st[n-2] = b2u(st[n-2] <= st[n-1])
+			st = st[:n-1]
+		case 0x59:
+			st[n-2] = b2u(int64(st[n-2]) >= int64(st[n-1]))
+			st = st[:n-1]
+		case 0x5A:
+			st[n-2] = b2u(st[n-2] >= st[n-1])
+			st = st[:n-1]
+
+		// f32 comparisons
+		case 0x5B:
+			st[n-2] = b2u(f32(st[n-2]) == f32(st[n-1]))
+			st = st[:n-1]
+		case 0x5C:
+			st[n-2] = b2u(f32(st[n-2]) != f32(st[n-1]))
+			st = st[:n-1]
+		case 0x5D:
+			st[n-2] = b2u(f32(st[n-2]) < f32(st[n-1]))
+			st = st[:n-1]
+		case 0x5E:
+			st[n-2] = b2u(f32(st[n-2]) > f32(st[n-1]))
+			st = st[:n-1]
+		case 0x5F:
+			st[n-2] = b2u(f32(st[n-2]) <= f32(st[n-1]))
+			st = st[:n-1]
+		case 0x60:
+			st[n-2] = b2u(f32(st[n-2]) >= f32(st[n-1]))
+			st = st[:n-1]
+
+		// f64 comparisons
+		case 0x61:
+			st[n-2] = b2u(f64(st[n-2]) == f64(st[n-1]))
+			st = st[:n-1]
+		case 0x62:
+			st[n-2] = b2u(f64(st[n-2]) != f64(st[n-1]))
+			st = st[:n-1]
+		case 0x63:
+			st[n-2] = b2u(f64(st[n-2]) < f64(st[n-1]))
+			st = st[:n-1]
+		case 0x64:
+			st[n-2] = b2u(f64(st[n-2]) > f64(st[n-1]))
+			st = st[:n-1]
+		case 0x65:
+			st[n-2] = b2u(f64(st[n-2]) <= f64(st[n-1]))
+			st = st[:n-1]
+		case 0x66:
+			st[n-2] = b2u(f64(st[n-2]) >= f64(st[n-1]))
+			st = st[:n-1]
+
+		// i32 arithmetic
+		case 0x67:
+			st[n-1] = uint64(bits.LeadingZeros32(uint32(st[n-1])))
+		case 0x68:
+			st[n-1] = uint64(bits.TrailingZeros32(uint32(st[n-1])))
+		case 0x69:
+			st[n-1] = uint64(bits.OnesCount32(uint32(st[n-1])))
+		case 0x6A:
+			st[n-2] = uint64(uint32(st[n-2]) + uint32(st[n-1]))
+			st = st[:n-1]
+		case 0x6B:
+			st[n-2] = uint64(uint32(st[n-2]) - uint32(st[n-1]))
+			st = st[:n-1]
+		case 0x6C:
+			st[n-2] = uint64(uint32(st[n-2]) * uint32(st[n-1]))
+			st = st[:n-1]
+		case 0x6D:
+			a, b := int32(st[n-2]), int32(st[n-1])
+			if b == 0 {
+				trap("integer divide by zero")
+			}
+			if a == math.MinInt32 && b == -1 {
+				trap("integer overflow")
+			}
+			st[n-2] = uint64(uint32(a / b))
+			st = st[:n-1]
+		case 0x6E:
+			a, b := uint32(st[n-2]), uint32(st[n-1])
+			if b == 0 {
+				trap("integer divide by zero")
+			}
+			st[n-2] = uint64(a / b)
+			st = st[:n-1]
+		case 0x6F:
+			a, b := int32(st[n-2]), int32(st[n-1])
+			if b == 0 {
+				trap("integer divide by zero")
+			}
+			if b == -1 {
+				st[n-2] = 0
+			} else {
+				st[n-2] = uint64(uint32(a % b))
+			}
+			st = st[:n-1]
+		case 0x70:
+			a, b := uint32(st[n-2]), uint32(st[n-1])
+			if b == 0 {
+				trap("integer divide by zero")
+			}
+			st[n-2] = uint64(a % b)
+			st = st[:n-1]
+		case 0x71:
+			st[n-2] = uint64(uint32(st[n-2]) & uint32(st[n-1]))
+			st = st[:n-1]
+		case 0x72:
+			st[n-2] = uint64(uint32(st[n-2]) | uint32(st[n-1]))
+			st = st[:n-1]
+		case 0x73:
+			st[n-2] = uint64(uint32(st[n-2]) ^ uint32(st[n-1]))
+			st = st[:n-1]
+		case 0x74:
+			st[n-2] = uint64(uint32(st[n-2]) << (st[n-1] & 31))
+			st = st[:n-1]
+		case 0x75:
+			st[n-2] = uint64(uint32(int32(st[n-2]) >> (st[n-1] & 31)))
+			st = st[:n-1]
+		case 0x76:
+			st[n-2] = uint64(uint32(st[n-2]) >> (st[n-1] & 31))
+			st = st[:n-1]
+		case 0x77:
+			st[n-2] = uint64(bits.RotateLeft32(uint32(st[n-2]), int(st[n-1]&31)))
+			st = st[:n-1]
+		case 0x78:
+			st[n-2] = uint64(bits.RotateLeft32(uint32(st[n-2]), -int(st[n-1]&31)))
+			st = st[:n-1]
+
+		// i64 arithmetic
+		case 0x79:
+			st[n-1] = uint64(bits.LeadingZeros64(st[n-1]))
+		case 0x7A:
+			st[n-1] = uint64(bits.TrailingZeros64(st[n-1]))
+		case 0x7B:
+			st[n-1] = uint64(bits.OnesCount64(st[n-1]))
+		case 0x7C:
+			st[n-2] += st[n-1]
+			st = st[:n-1]
+		case 0x7D:
+			st[n-2] -= st[n-1]
+			st = st[:n-1]
+		case 0x7E:
+			st[n-2] *= st[n-1]
+			st = st[:n-1]
+		case 0x7F:
+			a, b := int64(st[n-2]), int64(st[n-1])
+			if b == 0 {
+				trap("integer divide by zero")
+			}
+			if a == math.MinInt64 && b == -1 {
+				trap("integer overflow")
+			}
+			st[n-2] = uint64(a / b)
+			st = st[:n-1]
+		case 0x80:
+			if st[n-1] == 0 {
+				trap("integer divide by zero")
+			}
+			st[n-2] /= st[n-1]
+			st = st[:n-1]
+		case 0x81:
+			a, b := int64(st[n-2]), int64(st[n-1])
+			if b == 0 {
+				trap("integer divide by zero")
+			}
+			if b == -1 {
+				st[n-2] = 0
+			} else {
+				st[n-2] = uint64(a % b)
+			}
+			st = st[:n-1]
+		case 0x82:
+			if st[n-1] == 0 {
+				trap("integer divide by zero")
+			}
+			st[n-2] %= st[n-1]
+			st = st[:n-1]
+		case 0x83:
+			st[n-2] &= st[n-1]
+			st = st[:n-1]
+		case 0x84:
+			st[n-2] |= st[n-1]
+			st = st[:n-1]
+		case 0x85:
+			st[n-2] ^= st[n-1]
+			st = st[:n-1]
+		case 0x86:
+			st[n-2] <<= st[n-1] & 63
+			st = st[:n-1]
+		case 0x87:
+			st[n-2] = uint64(int64(st[n-2]) >> (st[n-1] & 63))
+			st = st[:n-1]
+		case 0x88:
+			st[n-2] >>= st[n-1] & 63
+			st = st[:n-1]
+		case 0x89:
+			st[n-2] = bits.RotateLeft64(st[n-2], int(st[n-1]&63))
+			st = st[:n-1]
+		case 0x8A:
+			st[n-2] = bits.RotateLeft64(st[n-2], -int(st[n-1]&63))
+			st = st[:n-1]
+
+		// f32 arithmetic
+		case 0x8B:
+			st[n-1] &^= 1 << 31
+		case 0x8C:
+			st[n-1] ^= 1 << 31
+		case 0x8D:
+			st[n-1] = u32(float32(math.Ceil(float64(f32(st[n-1])))))
+		case 0x8E:
+			st[n-1] = u32(float32(math.Floor(float64(f32(st[n-1])))))
+		case 0x8F:
+			st[n-1] = u32(float32(math.Trunc(float64(f32(st[n-1])))))
+		case 0x90:
+			st[n-1] = u32(float32(math.RoundToEven(float64(f32(st[n-1])))))
+		case 0x91:
+			st[n-1] = u32(float32(math.Sqrt(float64(f32(st[n-1])))))
+		case 0x92:
+			st[n-2] = u32(f32(st[n-2]) + f32(st[n-1]))
+			st = st[:n-1]
+		case 0x93:
+			st[n-2] = u32(f32(st[n-2]) - f32(st[n-1]))
+			st = st[:n-1]
+		case 0x94:
+			st[n-2] = u32(f32(st[n-2]) * f32(st[n-1]))
+			st = st[:n-1]
+		case 0x95:
+			st[n-2] = u32(f32(st[n-2]) / f32(st[n-1]))
+			st = st[:n-1]
+		case 0x96:
+			st[n-2] = u32(float32(fmin(float64(f32(st[n-2])), float64(f32(st[n-1])))))
+			st = st[:n-1]
+		case 0x97:
+			st[n-2] = u32(float32(fmax(float64(f32(st[n-2])), float64(f32(st[n-1])))))
+			st = st[:n-1]
+		case 0x98:
+			st[n-2] = st[n-2]&^(1<<31) | st[n-1]&(1<<31)
+			st = st[:n-1]
+
+		// f64 arithmetic
+		case 0x99:
+			st[n-1] &^= 1 << 63
+		case 0x9A:
+			st[n-1] ^= 1 << 63
+		case 0x9B:
+			st[n-1] = math.Float64bits(math.Ceil(f64(st[n-1])))
+		case 0x9C:
+			st[n-1] = math.Float64bits(math.Floor(f64(st[n-1])))
+		case 0x9D:
+			st[n-1] = math.Float64bits(math.Trunc(f64(st[n-1])))
+		case 0x9E:
+			st[n-1] = math.Float64bits(math.RoundToEven(f64(st[n-1])))
+		case 0x9F:
+			st[n-1] = math.Float64bits(math.Sqrt(f64(st[n-1])))
+		case 0xA0:
+			st[n-2] = math.Float64bits(f64(st[n-2]) + f64(st[n-1]))
+			st = st[:n-1]
+		case 0xA1:
+			st[n-2] = math.Float64bits(f64(st[n-2]) - f64(st[n-1]))
+			st = st[:n-1]
+		case 0xA2:
+			st[n-2] = math.Float64bits(f64(st[n-2]) * f64(st[n-1]))
+			st = st[:n-1]
+		case 0xA3:
+			st[n-2] = math.Float64bits(f64(st[n-2]) / f64(st[n-1]))
+			st = st[:n-1]
+		case 0xA4:
+			st[n-2] = math.Float64bits(fmin(f64(st[n-2]), f64(st[n-1])))
+			st = st[:n-1]
+		case 0xA5:
+			st[n-2] = math.Float64bits(fmax(f64(st[n-2]), f64(st[n-1])))
+			st = st[:n-1]
+		case 0xA6:
+			st[n-2] = st[n-2]&^(1<<63) | st[n-1]&(1<<63)
+			st = st[:n-1]
+
+		// conversions
+		case 0xA7:
+			st[n-1] = uint64(uint32(st[n-1]))
+		case 0xA8:
+			st[n-1] = uint64(uint32(int32(truncate(float64(f32(st[n-1])), -2147483649, 2147483648))))
+		case 0xA9:
+			st[n-1] = uint64(uint32(truncate(float64(f32(st[n-1])), -1, 4294967296)))
+		case 0xAA:
+			st[n-1] = uint64(uint32(int32(truncate(f64(st[n-1]), -2147483649, 2147483648))))
+		case 0xAB:
+			st[n-1] = uint64(uint32(truncate(f64(st[n-1]), -1, 4294967296)))
+		case 0xAC:
+			st[n-1] = uint64(int64(int32(st[n-1])))
+		case 0xAD:
+			st[n-1] = uint64(uint32(st[n-1]))
+		case 0xAE:
+			st[n-1] = uint64(int64(truncate(float64(f32(st[n-1])), -9223372036854777856, 9223372036854775808)))
+		case 0xAF:
+			st[n-1] = truncateU64(truncate(float64(f32(st[n-1])), -1, 18446744073709551616))
+		case 0xB0:
+			st[n-1] = uint64(int64(truncate(f64(st[n-1]), -9223372036854777856, 9223372036854775808)))
+		case 0xB1:
+			st[n-1] = truncateU64(truncate(f64(st[n-1]), -1, 18446744073709551616))
+		case 0xB2:
+			st[n-1] = u32(float32(int32(st[n-1])))
+		case 0xB3:
+			st[n-1] = u32(float32(uint32(st[n-1])))
+		case 0xB4:
+			st[n-1] = u32(float32(int64(st[n-1])))
+		case 0xB5:
+			st[n-1] = u32(float32(st[n-1]))
+		case 0xB6:
+			st[n-1] = u32(float32(f64(st[n-1])))
+		case 0xB7:
+			st[n-1] = math.Float64bits(float64(int32(st[n-1])))
+		case 0xB8:
+			st[n-1] = math.Float64bits(float64(uint32(st[n-1])))
+		case 0xB9:
+			st[n-1] = math.Float64bits(float64(int64(st[n-1])))
+		case 0xBA:
+			st[n-1] = math.Float64bits(float64(st[n-1]))
+		case 0xBB:
+			st[n-1] = math.Float64bits(float64(f32(st[n-1])))
+		case 0xBC, 0xBD, 0xBE, 0xBF:
+			// reinterpretations keep the bits
+
+		// sign extension
+		case 0xC0:
+			st[n-1] = uint64(uint32(int32(int8(st[n-1]))))
+		case 0xC1:
+			st[n-1] = uint64(uint32(int32(int16(st[n-1]))))
+		case 0xC2:
+			st[n-1] = uint64(int64(int8(st[n-1])))
+		case 0xC3:
+			st[n-1] = uint64(int64(int16(st[n-1])))
+		case 0xC4:
+			st[n-1] = uint64(int64(int32(st[n-1])))
+
+		// references
+		case 0xD0:
+			st = append(st, ins.c)
+		case 0xD1:
+			st[n-1] = b2u(st[n-1] == math.MaxUint64)
+		case 0xD2:
+			st = append(st, uint64(ins.a))
+
+		// saturating conversions
+		case prefixFC + 0:
+			st[n-1] = uint64(uint32(int32(saturate(float64(f32(st[n-1])), math.MinInt32, math.MaxInt32))))
+		case prefixFC + 1:
+			st[n-1] = uint64(uint32(saturate(float64(f32(st[n-1])), 0, math.MaxUint32)))
+		case prefixFC + 2:
+			st[n-1] = uint64(uint32(int32(saturate(f64(st[n-1]), math.MinInt32, math.MaxInt32))))
+		case prefixFC + 3:
+			st[n-1] = uint64(uint32(saturate(f64(st[n-1]), 0, math.MaxUint32)))
+		case prefixFC + 4:
+			st[n-1] = saturateI64(float64(f32(st[n-1])))
+		case prefixFC + 5:
+			st[n-1] = saturateU64(float64(f32(st[n-1])))
+		case prefixFC + 6:
+			st[n-1] = saturateI64(f64(st[n-1]))
+		case prefixFC + 7:
+			st[n-1] = saturateU64(f64(st[n-1]))
+
+		// bulk memory
+		case prefixFC + 8:
+			d, s, size := uint64(uint32(st[n-3])), uint64(uint32(st[n-2])), uint64(uint32(st[n-1]))
+			var data []byte
+			if !in.dropped[ins.a] {
+				data = in.module.data[ins.a].data
+			}
+			if s+size > uint64(len(data)) || d+size > uint64(len(mem)) {
+				trap("out of bounds memory access")
+			}
+			copy(mem[d:], data[s:s+size])
+			st = st[:n-3]
+		case prefixFC + 9:
+			in.dropped[ins.a] = true
+		case prefixFC + 10:
+			d, s, size := uint64(uint32(st[n-3])), uint64(uint32(st[n-2])), uint64(uint32(st[n-1]))
+			if s+size > uint64(len(mem)) || d+size > uint64(len(mem)) {
+				trap("out of bounds memory access")
+			}
+			copy(mem[d:d+size], mem[s:s+size])
+			st = st[:n-3]
+		case prefixFC + 11:
+			d, value, size := uint64(uint32(st[n-3])), byte(st[n-2]), uint64(uint32(st[n-1]))
+			if d+size > uint64(len(mem)) {
+				trap("out of bounds memory access")
+			}
+			fill := mem[d : d+size]
+			for i := range fill {
+				fill[i] = value
+			}
+			st = st[:n-3]
+		case prefixFC + 16:
+			st = append(st, uint64(len(in.table)))
+
+		default:
+			trap("unsupported instruction 0x%x", ins.op)
+		}
+	}
+	in.stack = st
+}
+
+func b2u(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func f32(v uint64) float32 {
+	return math.Float32frombits(uint32(v))
+}
+
+func u32(f float32) uint64 {
+	return uint64(math.Float32bits(f))
+}
+
+func f64(v uint64) float64 {
+	return math.Float64frombits(v)
+}
+
+func funcRef(f int32) uint64 {
+	if f < 0 {
+		return math.MaxUint64
+	}
+	return uint64(f)
+}
+
+// fmin is the minimum of WebAssembly: NaN wins and -0 is below +0.
+func fmin(a, b float64) float64 {
+	switch {
+	case math.IsNaN(a) || math.IsNaN(b):
+		return math.NaN()
+	case a == b:
+		if math.Signbit(a) {
+			return a
+		}
+		return b
+	}
+	return math.Min(a, b)
+}
+
+// fmax is the maximum of WebAssembly: NaN wins and +0 is above -0.
+func fmax(a, b float64) float64 {
+	switch {
+	case math.IsNaN(a) || math.IsNaN(b):
+		return math.NaN()
+	case a == b:
+		if math.Signbit(a) {
+			return b
+		}
+		return a
+	}
+	return math.Max(a, b)
+}
+
+// truncate truncates f, trapping when it isn't strictly between lower and upper.
+func truncate(f, lower, upper float64) float64 {
+	if math.IsNaN(f) {
+		trap("invalid conversion to integer")
+	}
+	t := math.Trunc(f)
+	if t <= lower || t >= upper {
+		trap("integer overflow")
+	}
+	return t
+}
+
+// truncateU64 converts a truncated float in the uint64 range.
+func truncateU64(t float64) uint64 {
+	if t >= 9223372036854775808 {
+		return uint64(t-9223372036854775808) | 1<<63
+	}
+	return uint64(t)
+}
+
+func saturate(f, lower, upper float64) float64 {
+	switch {
+	case math.IsNaN(f):
+		return 0
+	case f <= lower:
+		return lower
+	case f >= upper:
+		return upper
+	}
+	return math.Trunc(f)
+}
+
+func saturateI64(f float64) uint64 {
+	switch {
+	case math.IsNaN(f):
+		return 0
+	case f <= math.MinInt64:
+		return 1 << 63
+	case f >= 9223372036854775808:
+		return math.MaxInt64
+	}
+	return uint64(int64(f))
+}
+
+func saturateU64(f float64) uint64 {
+	switch {
+	case math.IsNaN(f) || f <= 0:
+		return 0
+	case f >= 18446744073709551616:
+		return math.MaxUint64
+	}
+	return truncateU64(math.Trunc(f))
+}
@@ -0,0 +1,305 @@
+package wasm
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"runtime"
+)
+
+// HostFunc is a function the host provides to modules. It reads its
+// arguments and returns its results as raw bits, an error traps the call.
+type HostFunc func(ctx context.Context, in *Instance, args []uint64) ([]uint64, error)
+
+// Resolver returns the host function of an import, nil when it's unknown.
+type Resolver func(module, name string) HostFunc
+
+// Limits caps the resources of an instance.
+type Limits struct {
+	// Fuel is the number of instructions a call may execute, 0 is unlimited.
+	Fuel int64
+	// MaxMemory caps the linear memory in bytes, 0 keeps the module's own
+	// maximum.
+	MaxMemory int
+}
+
+// maxCallDepth caps the recursion of modules.
+const maxCallDepth = 4096
+
+// Trap is a runtime error of a module, e.g. an out of bounds memory access.
+// The instance that trapped shouldn't be used again.
+type Trap struct {
+	Reason string
+}
+
+func (t *Trap) Error() string {
+	return "wasm trap: " + t.Reason
+}
+
+// ErrFuelExhausted traps calls that ran out of fuel.
+var ErrFuelExhausted = &Trap{Reason: "fuel exhausted"}
+
+func trap(format string, args ...any) {
+	panic(&Trap{Reason: fmt.Sprintf(format, args...)})
+}
+
+type label struct {
+	// cont is the instruction a branch continues at
+	cont   int
+	height int
+	arity  int
+	loop   bool
+}
+
+// Instance is an instantiated module. It isn't safe for concurrent use.
+type Instance struct {
+	module   *Module
+	host     []HostFunc
+	memory   []byte
+	maxPages uint32
+	globals  []uint64
+	table    []int32
+	dropped  []bool
+	limits   Limits
+
+	ctx    context.Context
+	stack  []uint64
+	labels []label
+	depth  int
+	fuel   int64
+}
+
+// Instantiate creates an instance of the module, resolving its imports and
+// running its start function.
+func (m *Module) Instantiate(ctx context.Context, resolve Resolver, limits Limits) (*Instance, error) {
+	in := &Instance{module: m, limits: limits, dropped: make([]bool, len(m.data))}
+	for _, imp := range m.imports {
+		f := resolve(imp.Module, imp.Name)
+		if f == nil {
+			return nil, fmt.Errorf("unknown import %s.%s", imp.Module, imp.Name)
+		}
+		in.host = append(in.host, f)
+	}
+	if m.memory != nil {
+		in.maxPages = 65536
+		if m.memory.hasMax {
+			in.maxPages = m.memory.max
+		}
+		if limits.MaxMemory > 0 {
+			in.maxPages = min(in.maxPages, uint32(limits.MaxMemory/pageSize))
+		}
+		if m.memory.min > in.maxPages {
+			return nil, fmt.Errorf("module needs %d memory pages, the limit is %d", m.memory.min, in.maxPages)
+		}
+		in.memory = make([]byte, int(m.memory.min)*pageSize)
+	}
+	for _, g := range m.globals {
+		in.globals = append(in.globals, in.constValue(g.init))
+	}
+	if m.table != nil {
+		in.table = make([]int32, m.table.min)
+		for i := range in.table {
+			in.table[i] = -1
+		}
+	}
+	for i, seg := range m.elements {
+		if !seg.active {
+			continue
+		}
+		offset := uint64(uint32(in.constValue(seg.offset)))
+		if offset+uint64(len(seg.funcs)) > uint64(len(in.table)) {
+			return nil, fmt.Errorf("element segment %d out of bounds", i)
+		}
+		copy(in.table[offset:], seg.funcs)
+	}
+	for i, seg := range m.data {
+		if !seg.active {
+			continue
+		}
+		offset := uint64(uint32(in.constValue(seg.offset)))
+		if offset+uint64(len(seg.data)) > uint64(len(in.memory)) {
+			return nil, fmt.Errorf("data segment %d out of bounds", i)
+		}
+		copy(in.memory[offset:], seg.data)
+		in.dropped[i] = true
+	}
+	if m.start >= 0 {
+		if _, err := in.invoke(ctx, uint32(m.start), nil); err != nil {
+			return nil, fmt.Errorf("start function: %w", err)
+		}
+	}
+	return in, nil
+}
+
+func (in *Instance) constValue(e constExpr) uint64 {
+	if e.op == 0x23 && int(e.value) < len(in.globals) {
+		return in.globals[e.value]
+	}
+	return e.value
+}
+
+// Module returns the module of the instance.
+func (in *Instance) Module() *Module {
+	return in.module
+}
+
+// Memory returns the linear memory. It's replaced when the memory grows.
+func (in *Instance) Memory() []byte {
+	return in.memory
+}
+
+// Read returns size bytes of memory at ptr, the slice aliases the memory.
+func (in *Instance) Read(ptr, size uint32) ([]byte, error) {
+	if uint64(ptr)+uint64(size) > uint64(len(in.memory)) {
+		return nil, &Trap{Reason: "out of bounds memory access"}
+	}
+	return in.memory[ptr : ptr+size], nil
+}
+
+// Write copies b to memory at ptr.
+func (in *Instance) Write(ptr uint32, b []byte) error {
+	if uint64(ptr)+uint64(len(b)) > uint64(len(in.memory)) {
+		return &Trap{Reason: "out of bounds memory access"}
+	}
+	copy(in.memory[ptr:], b)
+	return nil
+}
+
+// Call calls an exported function with its arguments as raw bits, e.g.
+// uint64(uint32(x)) for an i32 or math.Float64bits(f) for an f64.
+func (in *Instance) Call(ctx context.Context, name string, args ...uint64) ([]uint64, error) {
+	e, ok := in.module.exports[name]
+	if !ok || e.kind != 0 {
+		return nil, fmt.Errorf("unknown function %q", name)
+	}
+	if n := len(in.module.funcs[e.index].typ.Params); n != len(args) {
+		return nil, fmt.Errorf("%s expects %d arguments, got %d", name, n, len(args))
+	}
+	return in.invoke(ctx, e.index, args)
+}
+
+func (in *Instance) invoke(ctx context.Context, index uint32, args []uint64) (results []uint64, err error) {
+	in.ctx = ctx
+	in.fuel = in.limits.Fuel
+	if in.fuel <= 0 {
+		in.fuel = math.MaxInt64
+	}
+	in.stack = append(in.stack[:0], args...)
+	in.labels = in.labels[:0]
+	in.depth = 0
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		switch e := r.(type) {
+		case runtime.Error:
+			// out of range locals and the like of invalid modules
+			err = &Trap{Reason: e.Error()}
+		case error:
+			err = e
+		default:
+			panic(r)
+		}
+		in.stack = in.stack[:0]
+	}()
+	in.call(index)
+	results = append([]uint64(nil), in.stack...)
+	in.stack = in.stack[:0]
+	return results, nil
+}
+
+// budget checks the fuel and the deadline, every 64K instructions.
+func (in *Instance) budget() {
+	if in.fuel <= 0 {
+		panic(ErrFuelExhausted)
+	}
+	if err := in.ctx.Err(); err != nil {
+		panic(fmt.Errorf("wasm: %w", err))
+	}
+}
+
+func (in *Instance) call(index uint32) {
+	f := &in.module.funcs[index]
+	if f.imported >= 0 {
+		n := len(f.typ.Params)
+		top := len(in.stack)
+		args := append([]uint64(nil), in.stack[top-n:]...)
+		results, err := in.host[f.imported](in.ctx, in, args)
+		if err != nil {
+			panic(err)
+		}
+		if len(results) != len(f.typ.Results) {
+			trap("host function %s returned %d results, expected %d", in.module.imports[f.imported].Name, len(results), len(f.typ.Results))
+		}
+		in.stack = append(in.stack[:top-n], results...)
+		return
+	}
+	if in.depth++; in.depth > maxCallDepth {
+		trap("call stack exhausted")
+	}
+	base := len(in.stack) - len(f.typ.Params)
+	for range f.locals {
+		in.stack = append(in.stack, 0)
+	}
+	labels := len(in.labels)
+	in.labels = append(in.labels, label{cont: len(f.code), height: len(in.stack), arity: len(f.typ.Results)})
+	in.run(f, base)
+	n := len(f.typ.Results)
+	top := len(in.stack)
+	copy(in.stack[base:], in.stack[top-n:top])
+	in.stack = in.stack[:base+n]
+	in.labels = in.labels[:labels]
+	in.depth--
+}
+
+// branch unwinds the labels to the one at depth, moving its results, and
+// returns the instruction to continue at.
+func (in *Instance) branch(st []uint64, depth uint32) ([]uint64, int) {
+	i := len(in.labels) - 1 - int(depth)
+	l := in.labels[i]
+	n := len(st)
+	copy(st[l.height:], st[n-l.arity:n])
+	st = st[:l.height+l.arity]
+	if l.loop {
+		in.labels = in.labels[:i+1]
+	} else {
+		in.labels = in.labels[:i]
+	}
+	return st, l.cont
+}
+
+// address returns the effective address of a memory access of size bytes.
+func address(mem []byte, addr uint64, offset uint32, size uint64) uint64 {
+	ea := uint64(uint32(addr)) + uint64(offset)
+	if ea+size > uint64(len(mem)) {
+		trap("out of bounds memory access")
+	}
+	return ea
+}
+
+// indirect returns the function of a table element for call_indirect.
+func (in *Instance) indirect(element uint64, typeIndex uint32) uint32 {
+	i := uint32(element)
+	if uint64(i) >= uint64(len(in.table)) {
+		trap("undefined element")
+	}
+	f := in.table[i]
+	if f < 0 {
+		trap("uninitialized element")
+	}
+	if !in.module.funcs[f].typ.equal(in.module.types[typeIndex]) {
+		trap("indirect call type mismatch")
+	}
+	return uint32(f)
+}
+
+// grow grows the memory by delta pages, returning the previous size or -1.
+func (in *Instance) grow(delta uint32) uint32 {
+	pages := uint32(len(in.memory) / pageSize)
+	if in.module.memory == nil || uint64(pages)+uint64(delta) > uint64(in.maxPages) {
+		return math.MaxUint32
+	}
+	in.memory = append(in.memory, make([]byte, int(delta)*pageSize)...)
+	return pages
+}
@@ -0,0 +1,603 @@
+// Package wasm runs WebAssembly modules with an interpreter, so filters can
+// be shipped as .wasm files without cgo or a JIT. It implements the
+// WebAssembly 1.0 instruction set with the sign extension, saturating
+// conversion, multi-value and bulk memory extensions, enough for the output
+// of Go (GOOS=wasip1), TinyGo and Rust (wasm32-wasip1).
+//
+// Every call runs under Limits: an instruction budget, a memory cap and the
+// deadline of its context.
+package wasm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Value types.
+const (
+	I32       byte = 0x7F
+	I64       byte = 0x7E
+	F32       byte = 0x7D
+	F64       byte = 0x7C
+	funcref   byte = 0x70
+	externref byte = 0x6F
+)
+
+// pageSize is the size of a memory page.
+const pageSize = 64 * 1024
+
+// FuncType is the signature of a function.
+type FuncType struct {
+	Params, Results []byte
+}
+
+func (t FuncType) equal(o FuncType) bool {
+	return bytes.Equal(t.Params, o.Params) && bytes.Equal(t.Results, o.Results)
+}
+
+// Import is a function imported by a module.
+type Import struct {
+	Module, Name string
+	Type         FuncType
+}
+
+type function struct {
+	typ    FuncType
+	locals []byte
+	code   []instr
+	// import is the index in Module.imports of imported functions, -1 otherwise
+	imported int
+}
+
+type global struct {
+	typ     byte
+	mutable bool
+	init    constExpr
+}
+
+type constExpr struct {
+	op    byte
+	value uint64
+}
+
+type export struct {
+	kind  byte
+	index uint32
+}
+
+type elemSegment struct {
+	active bool
+	offset constExpr
+	funcs  []int32
+}
+
+type dataSegment struct {
+	active bool
+	offset constExpr
+	data   []byte
+}
+
+type limits struct {
+	min, max uint32
+	hasMax   bool
+}
+
+// Module is a decoded and compiled module, it can be instantiated many times.
+type Module struct {
+	types     []FuncType
+	imports   []Import
+	funcs     []function
+	table     *limits
+	memory    *limits
+	globals   []global
+	exports   map[string]export
+	start     int
+	elements  []elemSegment
+	data      []dataSegment
+	dataCount int
+	// brTables holds the targets of the br_table instructions
+	brTables [][]uint32
+}
+
+// Imports returns the functions imported by the module.
+func (m *Module) Imports() []Import {
+	return m.imports
+}
+
+// ExportedFunc returns the signature of an exported function.
+func (m *Module) ExportedFunc(name string) (FuncType, bool) {
+	e, ok := m.exports[name]
+	if !ok || e.kind != 0 {
+		return FuncType{}, false
+	}
+	return m.funcs[e.index].typ, true
+}
+
+var errUnexpectedEnd = errors.New("unexpected end of module")
+
+// reader decodes the binary format.
+type reader struct {
+	b   []byte
+	pos int
+}
+
+func (r *reader) byte() (byte, error) {
+	if r.pos >= len(r.b) {
+		return 0, errUnexpectedEnd
+	}
+	c := r.b[r.pos]
+	r.pos++
+	return c, nil
+}
+
+func (r *reader) bytes(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.b) {
+		return nil, errUnexpectedEnd
+	}
+	b := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *reader) u32() (uint32, error) {
+	v, err := r.uleb(32)
+	return uint32(v), err
+}
+
+func (r *reader) uleb(bits uint) (uint64, error) {
+	var v uint64
+	for shift := uint(0); ; shift += 7 {
+		if shift >= bits+7 {
+			return 0, errors.New("integer representation too long")
+		}
+		c, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint64(c&0x7F) << shift
+		if c&0x80 == 0 {
+			return v, nil
+		}
+	}
+}
+
+func (r *reader) sleb(bits uint) (int64, error) {
+	var v int64
+	shift := uint(0)
+	for {
+		if shift >= bits+7 {
+			return 0, errors.New("integer representation too long")
+		}
+		c, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		v |= int64(c&0x7F) << shift
+		shift += 7
+		if c&0x80 == 0 {
+			if shift < 64 && c&0x40 != 0 {
+				v |= -1 << shift
+			}
+			return v, nil
+		}
+	}
+}
+
+func (r *reader) name() (string, error) {
+	n, err := r.u32()
+	if err != nil {
+		return "", err
+	}
+	b, err := r.bytes(int(n))
+	return string(b), err
+}
+
+func (r *reader) valueTypes() ([]byte, error) {
+	n, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	types, err := r.bytes(int(n))
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(types), nil
+}
+
+func (r *reader) limits() (*limits, error) {
+	flag, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	l := &limits{}
+	if l.min, err = r.u32(); err != nil {
+		return nil, err
+	}
+	if flag&1 != 0 {
+		l.hasMax = true
+		if l.max, err = r.u32(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// constExpr reads an initializer expression, a single constant instruction.
+func (r *reader) constExpr() (constExpr, error) {
+	op, err := r.byte()
+	if err != nil {
+		return constExpr{}, err
+	}
+	e := constExpr{op: op}
+	switch op {
+	case 0x41:
+		v, err := r.sleb(32)
+		if err != nil {
+			return e, err
+		}
+		e.value = uint64(uint32(v))
+	case 0x42:
+		v, err := r.sleb(64)
+		if err != nil {
+			return e, err
+		}
+		e.value = uint64(v)
+	case 0x43:
+		b, err := r.bytes(4)
+		if err != nil {
+			return e, err
+		}
+		e.value = uint64(binary.LittleEndian.Uint32(b))
+	case 0x44:
+		b, err := r.bytes(8)
+		if err != nil {
+			return e, err
+		}
+		e.value = binary.LittleEndian.Uint64(b)
+	case 0x23, 0xD2:
+		v, err := r.u32()
+		if err != nil {
+			return e, err
+		}
+		e.value = uint64(v)
+	case 0xD0:
+		if _, err := r.byte(); err != nil {
+			return e, err
+		}
+		e.value = math.MaxUint64
+	default:
+		return e, fmt.Errorf("unsupported constant expression 0x%02x", op)
+	}
+	end, err := r.byte()
+	if err != nil {
+		return e, err
+	}
+	if end != 0x0B {
+		return e, errors.New("unsupported constant expression")
+	}
+	return e, nil
+}
+
+// Compile decodes and compiles a binary module.
+func Compile(b []byte) (*Module, error) {
+	if len(b) < 8 || !bytes.Equal(b[:4], []byte("\x00asm")) {
+		return nil, errors.New("not a WebAssembly module")
+	}
+	if binary.LittleEndian.Uint32(b[4:8]) != 1 {
+		return nil, fmt.Errorf("unsupported version %d", binary.LittleEndian.Uint32(b[4:8]))
+	}
+	m := &Module{exports: map[string]export{}, start: -1, dataCount: -1}
+	r := &reader{b: b, pos: 8}
+	var funcTypes []uint32
+	var bodies [][]byte
+	for r.pos < len(r.b) {
+		id, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		size, err := r.u32()
+		if err != nil {
+			return nil, err
+		}
+		payload, err := r.bytes(int(size))
+		if err != nil {
+			return nil, err
+		}
+		s := &reader{b: payload}
+		switch id {
+		case 0:
+			// custom sections, e.g. names and producers
+		case 1:
+			err = m.decodeTypes(s)
+		case 2:
+			err = m.decodeImports(s)
+		case 3:
+			funcTypes, err = decodeVec(s, (*reader).u32)
+		case 4:
+			err = m.decodeTables(s)
+		case 5:
+			err = m.decodeMemories(s)
+		case 6:
+			err = m.decodeGlobals(s)
+		case 7:
+			err = m.decodeExports(s)
+		case 8:
+			var start uint32
+			start, err = s.u32()
+			m.start = int(start)
+		case 9:
+			err = m.decodeElements(s)
+		case 10:
+			bodies, err = decodeVec(s, func(r *reader) ([]byte, error) {
+				n, err := r.u32()
+				if err != nil {
+					return nil, err
+				}
+				return r.bytes(int(n))
+			})
+		case 11:
+			err = m.decodeData(s)
+		case 12:
+			var n uint32
+			n, err = s.u32()
+			m.dataCount = int(n)
+		default:
+			err = fmt.Errorf("unknown section %d", id)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("section %d: %w", id, err)
+		}
+	}
+	if len(funcTypes) != len(bodies) {
+		return nil, errors.New("function and code sections don't match")
+	}
+	for i, typeIndex := range funcTypes {
+		if int(typeIndex) >= len(m.types) {
+			return nil, fmt.Errorf("function %d: unknown type %d", i, typeIndex)
+		}
+		f := function{typ: m.types[typeIndex], imported: -1}
+		if err := m.compileBody(&f, bodies[i]); err != nil {
+			return nil, fmt.Errorf("function %d: %w", len(m.imports)+i, err)
+		}
+		m.funcs = append(m.funcs, f)
+	}
+	for name, e := range m.exports {
+		if e.kind == 0 && int(e.index) >= len(m.funcs) {
+			return nil, fmt.Errorf("export %q: unknown function %d", name, e.index)
+		}
+	}
+	if m.start >= len(m.funcs) {
+		return nil, fmt.Errorf("unknown start function %d", m.start)
+	}
+	return m, nil
+}
+
+func decodeVec[T any](r *reader, item func(*reader) (T, error)) ([]T, error) {
+	n, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]T, 0, min(int(n), len(r.b)))
+	for range n {
+		v, err := item(r)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+	}
+	return items, nil
+}
+
+func (m *Module) decodeTypes(r *reader) error {
+	types, err := decodeVec(r, func(r *reader) (FuncType, error) {
+		form, err := r.byte()
+		if err != nil {
+			return FuncType{}, err
+		}
+		if form != 0x60 {
+			return FuncType{}, fmt.Errorf("unsupported type form 0x%02x", form)
+		}
+		params, err := r.valueTypes()
+		if err != nil {
+			return FuncType{}, err
+		}
+		results, err := r.valueTypes()
+		return FuncType{Params: params, Results: results}, err
+	})
+	m.types = types
+	return err
+}
+
+func (m *Module) decodeImports(r *reader) error {
+	n, err := r.u32()
+	if err != nil {
+		return err
+	}
+	for range n {
+		module, err := r.name()
+		if err != nil {
+			return err
+		}
+		name, err := r.name()
+		if err != nil {
+			return err
+		}
+		kind, err := r.byte()
+		if err != nil {
+			return err
+		}
+		if kind != 0 {
+			// tables, memories and globals are provided by the module itself
+			return fmt.Errorf("import %s.%s: only functions can be imported", module, name)
+		}
+		typeIndex, err := r.u32()
+		if err != nil {
+			return err
+		}
+		if int(typeIndex) >= len(m.types) {
+			return fmt.Errorf("import %s.%s: unknown type %d", module, name, typeIndex)
+		}
+		imp := Import{Module: module, Name: name, Type: m.types[typeIndex]}
+		m.funcs = append(m.funcs, function{typ: imp.Type, imported: len(m.imports)})
+		m.imports = append(m.imports, imp)
+	}
+	return nil
+}
+
+func (m *Module) decodeTables(r *reader) error {
+	n, err := r.u32()
+	if err != nil {
+		return err
+	}
+	if n > 1 {
+		return errors.New("multiple tables aren't supported")
+	}
+	if n == 1 {
+		if _, err := r.byte(); err != nil {
+			return err
+		}
+		m.table, err = r.limits()
+	}
+	return err
+}
+
+func (m *Module) decodeMemories(r *reader) error {
+	n, err := r.u32()
+	if err != nil {
+		return err
+	}
+	if n > 1 {
+		return errors.New("multiple memories aren't supported")
+	}
+	if n == 1 {
+		m.memory, err = r.limits()
+		if err == nil && m.memory.min > 65536 {
+			err = errors.New("memory too large")
+		}
+	}
+	return err
+}
+
+func (m *Module) decodeGlobals(r *reader) error {
+	globals, err := decodeVec(r, func(r *reader) (global, error) {
+		typ, err := r.byte()
+		if err != nil {
+			return global{}, err
+		}
+		mutable, err := r.byte()
+		if err != nil {
+			return global{}, err
+		}
+		init, err := r.constExpr()
+		return global{typ: typ, mutable: mutable == 1, init: init}, err
+	})
+	m.globals = globals
+	return err
+}
+
+func (m *Module) decodeExports(r *reader) error {
+	n, err := r.u32()
+	if err != nil {
+		return err
+	}
+	for range n {
+		name, err := r.name()
+		if err != nil {
+			return err
+		}
+		kind, err := r.byte()
+		if err != nil {
+			return err
+		}
+		index, err := r.u32()
+		if err != nil {
+			return err
+		}
+		m.exports[name] = export{kind: kind, index: index}
+	}
+	return nil
+}
+
+func (m *Module) decodeElements(r *reader) error {
+	elements, err := decodeVec(r, func(r *reader) (elemSegment, error) {
+		var seg elemSegment
+		flags, err := r.u32()
+		if err != nil {
+			return seg, err
+		}
+		if flags > 7 {
+			return seg, fmt.Errorf("unknown element segment flags %d", flags)
+		}
+		seg.active = flags&1 == 0
+		if seg.active {
+			if flags&2 != 0 {
+				if _, err := r.u32(); err != nil {
+					return seg, err
+				}
+			}
+			if seg.offset, err = r.constExpr(); err != nil {
+				return seg, err
+			}
+		}
+		if flags&3 != 0 {
+			// element kind or reference type
+			if _, err := r.byte(); err != nil {
+				return seg, err
+			}
+		}
+		if flags&4 == 0 {
+			indices, err := decodeVec(r, (*reader).u32)
+			for _, i := range indices {
+				seg.funcs = append(seg.funcs, int32(i))
+			}
+			return seg, err
+		}
+		exprs, err := decodeVec(r, (*reader).constExpr)
+		for _, e := range exprs {
+			if e.op == 0xD2 {
+				seg.funcs = append(seg.funcs, int32(e.value))
+			} else {
+				seg.funcs = append(seg.funcs, -1)
+			}
+		}
+		return seg, err
+	})
+	m.elements = elements
+	return err
+}
+
+func (m *Module) decodeData(r *reader) error {
+	data, err := decodeVec(r, func(r *reader) (dataSegment, error) {
+		var seg dataSegment
+		flags, err := r.u32()
+		if err != nil {
+			return seg, err
+		}
+		switch flags {
+		case 0, 2:
+			if flags == 2 {
+				if _, err := r.u32(); err != nil {
+					return seg, err
+				}
+			}
+			seg.active = true
+			if seg.offset, err = r.constExpr(); err != nil {
+				return seg, err
+			}
+		case 1:
+		default:
+			return seg, fmt.Errorf("unknown data segment flags %d", flags)
+		}
+		n, err := r.u32()
+		if err != nil {
+			return seg, err
+		}
+		seg.data, err = r.bytes(int(n))
+		return seg, err
+	})
+	m.data = data
+	return err
+}
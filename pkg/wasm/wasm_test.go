@@ -0,0 +1,373 @@
+package wasm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Airren/poorman-httpcache/v2/pkg/internal/wasmtest"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// binaryOp returns a function applying the instruction op to its two params.
+func binaryOp(name string, typ, result byte, op ...byte) wasmtest.Func {
+	return wasmtest.Func{
+		Export: name, Params: []byte{typ, typ}, Results: []byte{result},
+		Code: wasmtest.Code([]byte{0x20, 0x00, 0x20, 0x01}, op),
+	}
+}
+
+// unaryOp returns a function applying the instruction op to its param.
+func unaryOp(name string, typ, result byte, op ...byte) wasmtest.Func {
+	return wasmtest.Func{
+		Export: name, Params: []byte{typ}, Results: []byte{result},
+		Code: wasmtest.Code([]byte{0x20, 0x00}, op),
+	}
+}
+
+// specModule exercises the instructions the differential test compares.
+var specModule = wasmtest.Module{
+	Memory: &wasmtest.Memory{Min: 1},
+	Funcs: []wasmtest.Func{
+		binaryOp("i32.add", I32, I32, 0x6A),
+		binaryOp("i32.div_s", I32, I32, 0x6D),
+		binaryOp("i32.div_u", I32, I32, 0x6E),
+		binaryOp("i32.rem_s", I32, I32, 0x6F),
+		binaryOp("i32.rem_u", I32, I32, 0x70),
+		binaryOp("i32.shr_s", I32, I32, 0x75),
+		binaryOp("i32.rotl", I32, I32, 0x77),
+		binaryOp("i32.lt_s", I32, I32, 0x48),
+		unaryOp("i32.clz", I32, I32, 0x67),
+		unaryOp("i32.ctz", I32, I32, 0x68),
+		unaryOp("i32.popcnt", I32, I32, 0x69),
+		unaryOp("i32.extend8_s", I32, I32, 0xC0),
+		binaryOp("i64.mul", I64, I64, 0x7E),
+		binaryOp("i64.div_s", I64, I64, 0x7F),
+		binaryOp("i64.shr_u", I64, I64, 0x88),
+		unaryOp("i64.extend_i32_s", I32, I64, 0xAC),
+		unaryOp("i32.wrap_i64", I64, I32, 0xA7),
+		binaryOp("f64.add", F64, F64, 0xA0),
+		binaryOp("f64.min", F64, F64, 0xA4),
+		unaryOp("f64.sqrt", F64, F64, 0x9F),
+		unaryOp("f64.nearest", F64, F64, 0x9E),
+		unaryOp("i32.trunc_f64_s", F64, I32, 0xAA),
+		unaryOp("i32.trunc_sat_f64_s", F64, I32, 0xFC, 0x02),
+		unaryOp("i64.trunc_sat_f64_u", F64, I64, 0xFC, 0x07),
+		{
+			// factorial, recursively
+			Export: "fac", Params: []byte{I64}, Results: []byte{I64},
+			Code: wasmtest.Code(
+				[]byte{0x20, 0x00, 0x50, 0x04, I64},
+				wasmtest.I64Const(1),
+				[]byte{0x05, 0x20, 0x00, 0x20, 0x00},
+				wasmtest.I64Const(1),
+				[]byte{0x7D, 0x10}, wasmtest.ULEB(24), []byte{0x7E, 0x0B},
+			),
+		},
+		{
+			// the sum of 1..n, with a loop
+			Export: "sum", Params: []byte{I32}, Results: []byte{I32}, Locals: []byte{I32},
+			Code: wasmtest.Code(
+				[]byte{0x02, 0x40, 0x03, 0x40},
+				[]byte{0x20, 0x00, 0x45, 0x0D, 0x01},
+				[]byte{0x20, 0x01, 0x20, 0x00, 0x6A, 0x21, 0x01},
+				[]byte{0x20, 0x00}, wasmtest.I32Const(1), []byte{0x6B, 0x21, 0x00},
+				[]byte{0x0C, 0x00, 0x0B, 0x0B, 0x20, 0x01},
+			),
+		},
+		{
+			// 10, 20 or 30 through a br_table
+			Export: "switch", Params: []byte{I32}, Results: []byte{I32},
+			Code: wasmtest.Code(
+				[]byte{0x02, 0x40, 0x02, 0x40, 0x02, 0x40},
+				[]byte{0x20, 0x00, 0x0E, 0x02, 0x00, 0x01, 0x02, 0x0B},
+				wasmtest.I32Const(10), []byte{0x0F, 0x0B},
+				wasmtest.I32Const(20), []byte{0x0F, 0x0B},
+				wasmtest.I32Const(30),
+			),
+		},
+		{
+			Export: "select", Params: []byte{I32, I32, I32}, Results: []byte{I32},
+			Code: []byte{0x20, 0x00, 0x20, 0x01, 0x20, 0x02, 0x1B},
+		},
+		{
+			// stores v at addr+4 and loads it back
+			Export: "store", Params: []byte{I32, I32}, Results: []byte{I32},
+			Code: []byte{0x20, 0x00, 0x20, 0x01, 0x36, 0x02, 0x04, 0x20, 0x00, 0x28, 0x02, 0x04},
+		},
+		{
+			// the sign extended byte at addr
+			Export: "load8_s", Params: []byte{I32}, Results: []byte{I64},
+			Code: []byte{0x20, 0x00, 0x30, 0x00, 0x00},
+		},
+		{
+			// fills size bytes at addr, then copies them to addr+size
+			Export: "fill_copy", Params: []byte{I32, I32, I32}, Results: []byte{I32},
+			Code: wasmtest.Code(
+				[]byte{0x20, 0x00, 0x20, 0x02, 0x20, 0x01, 0xFC, 0x0B, 0x00},
+				[]byte{0x20, 0x00, 0x20, 0x01, 0x6A, 0x20, 0x00, 0x20, 0x01, 0xFC, 0x0A, 0x00, 0x00},
+				[]byte{0x20, 0x00, 0x20, 0x01, 0x6A, 0x28, 0x02, 0x00},
+			),
+		},
+	},
+}
+
+func i32Arg(v int32) uint64 { return uint64(uint32(v)) }
+
+func f64Arg(v float64) uint64 { return math.Float64bits(v) }
+
+// TestMatchesWazero runs the same calls through the interpreter and wazero,
+// the results, or the traps, must match.
+func TestMatchesWazero(t *testing.T) {
+	ctx := context.Background()
+	bin := specModule.Bytes()
+	m, err := Compile(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfigInterpreter())
+	defer rt.Close(ctx)
+	compiled, err := rt.CompileModule(ctx, bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	minI32, minI64 := i32Arg(math.MinInt32), uint64(1)<<63
+	for i, tc := range []struct {
+		fn   string
+		args []uint64
+	}{
+		{"i32.add", []uint64{1, 2}},
+		{"i32.add", []uint64{math.MaxUint32, 2}},
+		{"i32.div_s", []uint64{i32Arg(-7), 2}},
+		{"i32.div_s", []uint64{1, 0}},
+		{"i32.div_s", []uint64{minI32, i32Arg(-1)}},
+		{"i32.div_u", []uint64{i32Arg(-7), 2}},
+		{"i32.rem_s", []uint64{i32Arg(-7), 2}},
+		{"i32.rem_s", []uint64{minI32, i32Arg(-1)}},
+		{"i32.rem_u", []uint64{7, 0}},
+		{"i32.shr_s", []uint64{i32Arg(-16), 34}},
+		{"i32.rotl", []uint64{0x80000001, 1}},
+		{"i32.lt_s", []uint64{i32Arg(-1), 1}},
+		{"i32.clz", []uint64{0}},
+		{"i32.clz", []uint64{0x00F00000}},
+		{"i32.ctz", []uint64{0x00F00000}},
+		{"i32.popcnt", []uint64{0xF0F0F0F0}},
+		{"i32.extend8_s", []uint64{0x180}},
+		{"i64.mul", []uint64{math.MaxUint64, 3}},
+		{"i64.div_s", []uint64{minI64, math.MaxUint64}},
+		{"i64.div_s", []uint64{minI64, 0}},
+		{"i64.shr_u", []uint64{math.MaxUint64, 65}},
+		{"i64.extend_i32_s", []uint64{i32Arg(-5)}},
+		{"i32.wrap_i64", []uint64{0x1234567800000009}},
+		{"f64.add", []uint64{f64Arg(0.1), f64Arg(0.2)}},
+		{"f64.min", []uint64{f64Arg(0), f64Arg(math.Copysign(0, -1))}},
+		{"f64.min", []uint64{f64Arg(1), f64Arg(math.NaN())}},
+		{"f64.sqrt", []uint64{f64Arg(2)}},
+		{"f64.nearest", []uint64{f64Arg(2.5)}},
+		{"f64.nearest", []uint64{f64Arg(-3.5)}},
+		{"i32.trunc_f64_s", []uint64{f64Arg(-3.9)}},
+		{"i32.trunc_f64_s", []uint64{f64Arg(math.NaN())}},
+		{"i32.trunc_f64_s", []uint64{f64Arg(3e9)}},
+		{"i32.trunc_sat_f64_s", []uint64{f64Arg(3e9)}},
+		{"i32.trunc_sat_f64_s", []uint64{f64Arg(math.NaN())}},
+		{"i64.trunc_sat_f64_u", []uint64{f64Arg(-1)}},
+		{"fac", []uint64{20}},
+		{"sum", []uint64{1000}},
+		{"switch", []uint64{0}},
+		{"switch", []uint64{1}},
+		{"switch", []uint64{7}},
+		{"select", []uint64{1, 2, 0}},
+		{"select", []uint64{1, 2, 5}},
+		{"store", []uint64{100, 0xDEADBEEF}},
+		{"store", []uint64{65532, 1}},
+		{"store", []uint64{math.MaxUint32, 1}},
+		{"load8_s", []uint64{65535}},
+		{"load8_s", []uint64{65536}},
+		{"fill_copy", []uint64{10, 8, 0xAB}},
+		{"fill_copy", []uint64{65530, 8, 0xAB}},
+	} {
+		t.Run(fmt.Sprintf("%s/%d", tc.fn, i), func(t *testing.T) {
+			in, err := m.Instantiate(ctx, func(string, string) HostFunc { return nil }, Limits{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, gotErr := in.Call(ctx, tc.fn, tc.args...)
+
+			ref, err := rt.InstantiateModule(ctx, compiled, wazero.NewModuleConfig().WithName(fmt.Sprint(i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ref.Close(ctx)
+			want, wantErr := ref.ExportedFunction(tc.fn).Call(ctx, tc.args...)
+
+			if (gotErr != nil) != (wantErr != nil) {
+				t.Fatalf("%s%v: error %v, wazero %v", tc.fn, tc.args, gotErr, wantErr)
+			}
+			if gotErr != nil {
+				var trap *Trap
+				if !errors.As(gotErr, &trap) {
+					t.Errorf("%s%v: %v isn't a trap", tc.fn, tc.args, gotErr)
+				}
+				return
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("%s%v = %#x, wazero %#x", tc.fn, tc.args, got, want)
+			}
+		})
+	}
+}
+
+func TestFuelExhausted(t *testing.T) {
+	// loops forever
+	m, err := Compile(wasmtest.Module{Funcs: []wasmtest.Func{
+		{Export: "spin", Code: []byte{0x03, 0x40, 0x0C, 0x00, 0x0B}},
+		{Export: "sum", Params: []byte{I32}, Results: []byte{I32}, Locals: []byte{I32}, Code: specModule.Funcs[25].Code},
+	}}.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	in, err := m.Instantiate(ctx, func(string, string) HostFunc { return nil }, Limits{Fuel: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := in.Call(ctx, "spin"); !errors.Is(err, ErrFuelExhausted) {
+		t.Fatalf("spin: got %v, want %v", err, ErrFuelExhausted)
+	}
+	// the budget is per call
+	for range 3 {
+		results, err := in.Call(ctx, "sum", 1000)
+		if err != nil || results[0] != 500500 {
+			t.Fatalf("sum(1000) = %v, %v", results, err)
+		}
+	}
+
+	unlimited, err := m.Instantiate(ctx, func(string, string) HostFunc { return nil }, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := unlimited.Call(ctx, "spin"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("spin past the deadline: got %v", err)
+	}
+}
+
+func TestCallStackExhausted(t *testing.T) {
+	m, err := Compile(wasmtest.Module{Funcs: []wasmtest.Func{
+		{Export: "recurse", Code: []byte{0x10, 0x00}},
+	}}.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := m.Instantiate(context.Background(), func(string, string) HostFunc { return nil }, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trap *Trap
+	if _, err := in.Call(context.Background(), "recurse"); !errors.As(err, &trap) || trap.Reason != "call stack exhausted" {
+		t.Fatalf("recurse: got %v", err)
+	}
+}
+
+func TestMaxMemory(t *testing.T) {
+	grow := wasmtest.Func{Export: "grow", Params: []byte{I32}, Results: []byte{I32}, Code: []byte{0x20, 0x00, 0x40, 0x00}}
+	ctx := context.Background()
+	resolve := func(string, string) HostFunc { return nil }
+
+	m, err := Compile(wasmtest.Module{Memory: &wasmtest.Memory{Min: 1}, Funcs: []wasmtest.Func{grow}}.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := m.Instantiate(ctx, resolve, Limits{MaxMemory: 3 * pageSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		delta, want uint64
+	}{
+		{1, 1},
+		{2, math.MaxUint32},
+		{1, 2},
+		{1, math.MaxUint32},
+		{0, 3},
+	} {
+		results, err := in.Call(ctx, "grow", tc.delta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[0] != tc.want {
+			t.Errorf("grow(%d) = %d, want %d", tc.delta, int32(results[0]), int32(tc.want))
+		}
+	}
+	if len(in.Memory()) != 3*pageSize {
+		t.Errorf("memory is %d bytes, want %d", len(in.Memory()), 3*pageSize)
+	}
+
+	// the module's own maximum is kept under the limit
+	m, err = Compile(wasmtest.Module{Memory: &wasmtest.Memory{Min: 1, Max: 2, HasMax: true}, Funcs: []wasmtest.Func{grow}}.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err = m.Instantiate(ctx, resolve, Limits{MaxMemory: 3 * pageSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results, err := in.Call(ctx, "grow", 2); err != nil || results[0] != math.MaxUint32 {
+		t.Errorf("grow(2) over the module's maximum = %v, %v", results, err)
+	}
+
+	// modules needing more than the limit aren't instantiated
+	m, err = Compile(wasmtest.Module{Memory: &wasmtest.Memory{Min: 4}, Funcs: []wasmtest.Func{grow}}.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Instantiate(ctx, resolve, Limits{MaxMemory: 3 * pageSize}); err == nil {
+		t.Error("instantiated a module needing 4 pages under a 3 pages limit")
+	}
+}
+
+func TestHostFunc(t *testing.T) {
+	m, err := Compile(wasmtest.Module{
+		Imports: []wasmtest.Import{{Module: "env", Name: "double", Params: []byte{I32}, Results: []byte{I32}}},
+		Funcs: []wasmtest.Func{
+			{Export: "quadruple", Params: []byte{I32}, Results: []byte{I32}, Code: []byte{0x20, 0x00, 0x10, 0x00, 0x10, 0x00}},
+		},
+	}.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing := errors.New("host failure")
+	double := func(_ context.Context, _ *Instance, args []uint64) ([]uint64, error) {
+		if args[0] > 100 {
+			return nil, failing
+		}
+		return []uint64{args[0] * 2}, nil
+	}
+	resolve := func(module, name string) HostFunc {
+		if module == "env" && name == "double" {
+			return double
+		}
+		return nil
+	}
+	ctx := context.Background()
+	in, err := m.Instantiate(ctx, resolve, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results, err := in.Call(ctx, "quadruple", 5); err != nil || results[0] != 20 {
+		t.Errorf("quadruple(5) = %v, %v", results, err)
+	}
+	if _, err := in.Call(ctx, "quadruple", 60); !errors.Is(err, failing) {
+		t.Errorf("quadruple(60): got %v, want %v", err, failing)
+	}
+	if _, err := m.Instantiate(ctx, func(string, string) HostFunc { return nil }, Limits{}); err == nil {
+		t.Error("instantiated a module with an unknown import")
+	}
+}
@@ -0,0 +1,63 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// Admin serves the webhook admin endpoints, behind adminauth.
+//
+//	curl "https://cachev1.example.com/admin/webhooks/failed" -H "X-Admin-Key: xxx"
+//	curl -X POST "https://cachev1.example.com/admin/webhooks/{id}/replay" -H "X-Admin-Key: xxx"
+type Admin struct {
+	deliverer *Deliverer
+}
+
+// NewAdmin creates a new Admin handler set.
+func NewAdmin(deliverer *Deliverer) *Admin {
+	return &Admin{deliverer: deliverer}
+}
+
+// Failed handles GET /admin/webhooks/failed?limit=50.
+func (a *Admin) Failed(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n <= 1000 {
+			limit = n
+		}
+	}
+	failed, err := a.deliverer.store.Failed(r.Context(), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if failed == nil {
+		failed = []*Delivery{}
+	}
+	writeJSON(w, http.StatusOK, failed)
+}
+
+// Replay handles POST /admin/webhooks/{id}/replay.
+func (a *Admin) Replay(w http.ResponseWriter, r *http.Request) {
+	delivery, err := a.deliverer.Replay(r.Context(), r.PathValue("id"))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, delivery)
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		// response was already committed, nothing left to do
+		_ = err
+	}
+}
@@ -0,0 +1,13 @@
+-- All keys must be explicitly provided for Redis clustering compatibility
+local dueKey = KEYS[1] -- Pre-constructed "webhooks:due" sorted set, scored by next attempt time
+local now = tonumber(ARGV[1])
+local leaseUntil = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+
+-- Claim the due deliveries until the lease ends, a replica that dies
+-- while attempting them leaves them to the others past it
+local ids = redis.call('ZRANGEBYSCORE', dueKey, '-inf', now, 'LIMIT', 0, limit)
+for _, id in ipairs(ids) do
+	redis.call('ZADD', dueKey, leaseUntil, id)
+end
+return ids
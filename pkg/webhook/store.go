@@ -0,0 +1,216 @@
+package webhook
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Store keeps the delivery logs.
+type Store interface {
+	// Save creates or updates a delivery.
+	Save(ctx context.Context, delivery *Delivery) error
+	// Get returns a delivery by ID, or ErrNotFound.
+	Get(ctx context.Context, id string) (*Delivery, error)
+	// Failed lists the most recent failed deliveries, newest first.
+	Failed(ctx context.Context, limit int) ([]*Delivery, error)
+	// Due claims up to limit pending deliveries due at now for lease, they
+	// aren't due again until the lease ends or they're saved.
+	Due(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*Delivery, error)
+}
+
+// MemoryStore is an in-process Store. Logs are lost on restart.
+type MemoryStore struct {
+	mu         sync.Mutex
+	deliveries map[string]*Delivery
+	retention  time.Duration
+}
+
+// NewMemoryStore creates a new MemoryStore keeping deliveries for retention.
+func NewMemoryStore(retention time.Duration) *MemoryStore {
+	return &MemoryStore{deliveries: map[string]*Delivery{}, retention: retention}
+}
+
+// Save implements the Store interface Save method.
+func (s *MemoryStore) Save(ctx context.Context, delivery *Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, d := range s.deliveries {
+		if time.Since(d.UpdatedAt) > s.retention {
+			delete(s.deliveries, id)
+		}
+	}
+	copied := *delivery
+	s.deliveries[delivery.ID] = &copied
+	return nil
+}
+
+// Get implements the Store interface Get method.
+func (s *MemoryStore) Get(ctx context.Context, id string) (*Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.deliveries[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	copied := *d
+	return &copied, nil
+}
+
+// Failed implements the Store interface Failed method.
+func (s *MemoryStore) Failed(ctx context.Context, limit int) ([]*Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var failed []*Delivery
+	for _, d := range s.deliveries {
+		if d.Status == StatusFailed {
+			copied := *d
+			failed = append(failed, &copied)
+		}
+	}
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].UpdatedAt.After(failed[j].UpdatedAt)
+	})
+	if len(failed) > limit {
+		failed = failed[:limit]
+	}
+	return failed, nil
+}
+
+// Due implements the Store interface Due method.
+func (s *MemoryStore) Due(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []*Delivery
+	for _, d := range s.deliveries {
+		if len(due) >= limit {
+			break
+		}
+		if d.Status != StatusPending || d.NextAttemptAt.After(now) {
+			continue
+		}
+		d.NextAttemptAt = now.Add(lease)
+		copied := *d
+		due = append(due, &copied)
+	}
+	return due, nil
+}
+
+//go:embed claim.lua
+var claimScript string
+
+// ClaimScript is the Redis script claiming the due deliveries
+var ClaimScript = redis.NewScript(claimScript)
+
+const (
+	failedKey = "webhooks:failed"
+	dueKey    = "webhooks:due"
+)
+
+// RedisStore is a Store shared by every replica.
+type RedisStore struct {
+	redis     redis.Cmdable
+	retention time.Duration
+}
+
+// NewRedisStore creates a new RedisStore keeping deliveries for retention.
+func NewRedisStore(rdb redis.Cmdable, retention time.Duration) *RedisStore {
+	return &RedisStore{redis: rdb, retention: retention}
+}
+
+func deliveryKey(id string) string {
+	return fmt.Sprintf("webhook:%s", id)
+}
+
+// Save implements the Store interface Save method.
+func (s *RedisStore) Save(ctx context.Context, delivery *Delivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("json.Marshal(delivery): %w", err)
+	}
+	pipe := s.redis.TxPipeline()
+	pipe.Set(ctx, deliveryKey(delivery.ID), data, s.retention)
+	if delivery.Status == StatusFailed {
+		pipe.ZAdd(ctx, failedKey, redis.Z{Score: float64(delivery.UpdatedAt.Unix()), Member: delivery.ID})
+	} else {
+		pipe.ZRem(ctx, failedKey, delivery.ID)
+	}
+	// forget failures older than retention
+	pipe.ZRemRangeByScore(ctx, failedKey, "-inf", fmt.Sprint(time.Now().Add(-s.retention).Unix()))
+	if delivery.Status == StatusPending {
+		pipe.ZAdd(ctx, dueKey, redis.Z{Score: float64(delivery.NextAttemptAt.UnixMilli()), Member: delivery.ID})
+	} else {
+		pipe.ZRem(ctx, dueKey, delivery.ID)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Get implements the Store interface Get method.
+func (s *RedisStore) Get(ctx context.Context, id string) (*Delivery, error) {
+	data, err := s.redis.Get(ctx, deliveryKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis.Get: %w", err)
+	}
+	var delivery Delivery
+	if err := json.Unmarshal(data, &delivery); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	return &delivery, nil
+}
+
+// Failed implements the Store interface Failed method.
+func (s *RedisStore) Failed(ctx context.Context, limit int) ([]*Delivery, error) {
+	ids, err := s.redis.ZRevRange(ctx, failedKey, 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("redis.ZRevRange: %w", err)
+	}
+	var failed []*Delivery
+	for _, id := range ids {
+		delivery, err := s.Get(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		failed = append(failed, delivery)
+	}
+	return failed, nil
+}
+
+// Due implements the Store interface Due method.
+func (s *RedisStore) Due(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*Delivery, error) {
+	ids, err := ClaimScript.Run(ctx, s.redis, []string{dueKey}, now.UnixMilli(), now.Add(lease).UnixMilli(), limit).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("ClaimScript.Run: %w", err)
+	}
+	var due []*Delivery
+	for _, id := range ids {
+		delivery, err := s.Get(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			// expired while pending
+			s.redis.ZRem(ctx, dueKey, id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if delivery.Status != StatusPending {
+			s.redis.ZRem(ctx, dueKey, id)
+			continue
+		}
+		due = append(due, delivery)
+	}
+	return due, nil
+}
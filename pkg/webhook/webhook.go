@@ -0,0 +1,285 @@
+// Package webhook delivers signed event notifications with retries and delivery logs.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Headers sent with every delivery. The signature is the hex HMAC-SHA256 of
+// "{timestamp}.{body}" with the shared secret, prefixed with "sha256=".
+const (
+	IDHeader        = "X-Webhook-ID"
+	EventHeader     = "X-Webhook-Event"
+	TimestampHeader = "X-Webhook-Timestamp"
+	SignatureHeader = "X-Webhook-Signature"
+)
+
+// ErrNotFound is returned when a delivery does not exist or has expired.
+var ErrNotFound = errors.New("delivery not found")
+
+// deliveryLease is how long a replica holds a delivery it attempts, the
+// deliveries of a replica that died are attempted again past it.
+const deliveryLease = time.Minute
+
+// maxDue caps the deliveries claimed at once.
+const maxDue = 100
+
+// Status is the state of a delivery.
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusDelivered Status = "delivered"
+	StatusFailed    Status = "failed"
+)
+
+// Delivery is a webhook event and the log of its delivery attempts.
+type Delivery struct {
+	ID             string          `json:"id"`
+	URL            string          `json:"url"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         Status          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastStatusCode int             `json:"last_status_code,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	// NextAttemptAt is when a pending delivery is attempted next
+	NextAttemptAt time.Time `json:"next_attempt_at,omitzero"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// Sign returns the signature header value of a body sent at timestamp.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature matches the body sent at timestamp.
+// Receivers should also reject timestamps too far in the past.
+func Verify(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// Deliverer sends webhook deliveries, retrying failures with exponential backoff.
+// Every attempt is logged in the store, failed deliveries can be replayed.
+// Pending deliveries are kept in the store too, so with a shared store they
+// survive restarts and any replica attempts them, see Start.
+type Deliverer struct {
+	store       Store
+	secret      string
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+	// due wakes the workers up when a delivery is queued
+	due chan struct{}
+	// slots holds a token per delivery in flight, up to the workers
+	slots  chan struct{}
+	logger *slog.Logger
+}
+
+// NewDeliverer creates a new Deliverer signing with secret and sending
+// through transport, e.g. one refusing private addresses, with up to workers
+// deliveries in flight. The receivers can't verify unsigned deliveries, so
+// secret is required.
+func NewDeliverer(store Store, secret string, maxAttempts, workers int, transport http.RoundTripper, logger *slog.Logger) (*Deliverer, error) {
+	if secret == "" {
+		return nil, errors.New("webhooks need a signing secret")
+	}
+	if maxAttempts < 1 {
+		return nil, fmt.Errorf("webhook max attempts must be at least 1, got %d", maxAttempts)
+	}
+	if workers < 1 {
+		return nil, fmt.Errorf("webhook workers must be at least 1, got %d", workers)
+	}
+	return &Deliverer{
+		store:       store,
+		secret:      secret,
+		client:      &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		maxAttempts: maxAttempts,
+		backoff:     5 * time.Second,
+		due:         make(chan struct{}, 1),
+		slots:       make(chan struct{}, workers),
+		logger:      logger,
+	}, nil
+}
+
+// Start attempts the due deliveries until ctx is done, the ones queued by
+// this replica and the ones left pending by others.
+func (d *Deliverer) Start(ctx context.Context) {
+	go d.Run(ctx)
+}
+
+// Run is Start in the foreground, for the leader when the deliveries are
+// shared by the replicas.
+func (d *Deliverer) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.due:
+		}
+		// only as many as the free workers are claimed, the others are left
+		// to a later tick or another replica rather than waiting past their lease
+		free := min(cap(d.slots)-len(d.slots), maxDue)
+		if free == 0 {
+			continue
+		}
+		due, err := d.store.Due(ctx, time.Now(), deliveryLease, free)
+		if err != nil {
+			if ctx.Err() == nil {
+				d.logger.Error("Failed to claim due webhook deliveries", "error", err)
+			}
+			continue
+		}
+		for _, delivery := range due {
+			d.slots <- struct{}{}
+			go func() {
+				defer d.done()
+				d.deliver(context.WithoutCancel(ctx), delivery)
+			}()
+		}
+	}
+}
+
+// done frees the slot of a delivery and wakes Run up, more may be due.
+func (d *Deliverer) done() {
+	<-d.slots
+	d.wake()
+}
+
+// wake tells the workers a delivery is due.
+func (d *Deliverer) wake() {
+	select {
+	case d.due <- struct{}{}:
+	default:
+	}
+}
+
+// newDeliveryID creates a random delivery ID.
+func newDeliveryID() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// Send queues an event for delivery to url and returns the delivery ID.
+// Delivery happens in the background, once Start is called.
+func (d *Deliverer) Send(ctx context.Context, url, event string, payload any) (string, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("json.Marshal(payload): %w", err)
+	}
+	id, err := newDeliveryID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	delivery := &Delivery{
+		ID:            id,
+		URL:           url,
+		Event:         event,
+		Payload:       body,
+		Status:        StatusPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := d.store.Save(ctx, delivery); err != nil {
+		return "", fmt.Errorf("d.store.Save: %w", err)
+	}
+	d.wake()
+	return id, nil
+}
+
+// Replay delivers a delivery again, with a fresh set of attempts.
+func (d *Deliverer) Replay(ctx context.Context, id string) (*Delivery, error) {
+	delivery, err := d.store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	// a pending delivery is still being attempted
+	if delivery.Status == StatusPending {
+		return delivery, nil
+	}
+	delivery.Status = StatusPending
+	delivery.Attempts = 0
+	delivery.UpdatedAt = time.Now()
+	delivery.NextAttemptAt = delivery.UpdatedAt
+	if err := d.store.Save(ctx, delivery); err != nil {
+		return nil, fmt.Errorf("d.store.Save: %w", err)
+	}
+	d.wake()
+	return delivery, nil
+}
+
+// deliver attempts a claimed delivery once, and schedules the next attempt
+// when it fails and has attempts left.
+func (d *Deliverer) deliver(ctx context.Context, delivery *Delivery) {
+	delivery.Attempts++
+	statusCode, err := d.attempt(ctx, delivery)
+	delivery.LastStatusCode = statusCode
+	delivery.LastError = ""
+	if err != nil {
+		delivery.LastError = err.Error()
+	}
+	delivery.UpdatedAt = time.Now()
+
+	switch {
+	case err == nil:
+		delivery.Status = StatusDelivered
+	case delivery.Attempts >= d.maxAttempts:
+		delivery.Status = StatusFailed
+		d.logger.Warn("Webhook delivery failed", "id", delivery.ID, "url", delivery.URL, "attempts", delivery.Attempts, "error", err)
+	default:
+		delivery.NextAttemptAt = delivery.UpdatedAt.Add(d.backoff << (delivery.Attempts - 1))
+	}
+	if saveErr := d.store.Save(ctx, delivery); saveErr != nil {
+		d.logger.Error("Failed to save webhook delivery", "id", delivery.ID, "error", saveErr)
+	}
+}
+
+func (d *Deliverer) attempt(ctx context.Context, delivery *Delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(IDHeader, delivery.ID)
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(d.secret, timestamp, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,133 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"event":"ping"}`)
+	// hmac.new(b"whsec_test", b'1700000000.{"event":"ping"}', hashlib.sha256).hexdigest()
+	want := "sha256=aa8efe37b751e71157c508c5ac4acb1e9fe5225db98355dfc00f4b680afbc447"
+	if got := Sign("whsec_test", 1700000000, body); got != want {
+		t.Errorf("Sign = %s, want %s", got, want)
+	}
+	if !Verify("whsec_test", 1700000000, body, want) {
+		t.Error("Verify refused the signature")
+	}
+	if Verify("whsec_test", 1700000001, body, want) || Verify("other", 1700000000, body, want) {
+		t.Error("Verify accepted the signature of another timestamp or secret")
+	}
+}
+
+func newTestDeliverer(t *testing.T, maxAttempts, workers int, receiver http.HandlerFunc) (*Deliverer, string) {
+	t.Helper()
+	srv := httptest.NewServer(receiver)
+	t.Cleanup(srv.Close)
+	d, err := NewDeliverer(NewMemoryStore(time.Hour), "whsec_test", maxAttempts, workers, http.DefaultTransport, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.backoff = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	d.Start(ctx)
+	return d, srv.URL
+}
+
+// waitFor waits for the delivery id to leave the pending status.
+func waitFor(t *testing.T, d *Deliverer, id string) *Delivery {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		delivery, err := d.store.Get(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if delivery.Status != StatusPending {
+			return delivery
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("delivery %s still pending", id)
+	return nil
+}
+
+func TestDeliverSigns(t *testing.T) {
+	signed := make(chan bool, 1)
+	d, url := newTestDeliverer(t, 1, 1, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+		signed <- Verify("whsec_test", timestamp, body, r.Header.Get(SignatureHeader)) && r.Header.Get(EventHeader) == "key.created"
+	})
+	id, err := d.Send(context.Background(), url, "key.created", map[string]string{"key_id": "ab12cd34"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivery := waitFor(t, d, id); delivery.Status != StatusDelivered || delivery.Attempts != 1 {
+		t.Errorf("delivery %s after %d attempts", delivery.Status, delivery.Attempts)
+	}
+	if !<-signed {
+		t.Error("the receiver got a delivery it can't verify")
+	}
+}
+
+func TestDeliverStopsAtMaxAttempts(t *testing.T) {
+	var calls atomic.Int32
+	d, url := newTestDeliverer(t, 3, 1, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	id, err := d.Send(context.Background(), url, "key.created", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery := waitFor(t, d, id)
+	if delivery.Status != StatusFailed || delivery.Attempts != 3 || delivery.LastStatusCode != http.StatusServiceUnavailable {
+		t.Errorf("delivery %s after %d attempts, last answer %d", delivery.Status, delivery.Attempts, delivery.LastStatusCode)
+	}
+	// a failed delivery isn't attempted again
+	time.Sleep(50 * time.Millisecond)
+	if n := calls.Load(); n != 3 {
+		t.Errorf("the receiver was called %d times, want 3", n)
+	}
+}
+
+func TestDeliverWorkersAreBounded(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	d, url := newTestDeliverer(t, 1, 2, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		peak = max(peak, inFlight)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	})
+	var ids []string
+	for range 10 {
+		id, err := d.Send(context.Background(), url, "key.created", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		if delivery := waitFor(t, d, id); delivery.Status != StatusDelivered {
+			t.Errorf("delivery %s %s", id, delivery.Status)
+		}
+	}
+	if peak > 2 {
+		t.Errorf("%d deliveries in flight, want at most 2", peak)
+	}
+}